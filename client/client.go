@@ -0,0 +1,248 @@
+// client.go -- dial through HTTP and SOCKS5 proxies
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package client dials TCP connections through the HTTP and SOCKS5
+// proxies of goproxy (or any others that speak the same protocols).
+// A Dialer is made from the URL of the proxy:
+//
+//	http://[user:pass@]host[:80]          HTTP CONNECT
+//	https://[user:pass@]host[:443]        HTTP CONNECT over TLS
+//	socks5://[user:pass@]host[:1080]      SOCKS5
+//	socks5+tls://[user:pass@]host[:1080]  SOCKS5 over TLS
+//
+// Names are sent to the proxy as they are; the proxy resolves them.
+//
+// Every dial takes a context. Its deadline, the Dialer's Timeout and its
+// cancellation bound the whole dial: the connection to the proxy, the
+// TLS handshake and the proxy's handshake. A dial that is cancelled
+// half way closes its connection and returns the context's error.
+//
+// A proxy that refuses a tunnel is a *ProxyError; it wraps the cause
+// the proxy gave (ErrAuthFailed, ErrDestDenied, ErrConnRefused, ...):
+//
+//	if errors.Is(err, client.ErrDestDenied) {
+//		...
+//	}
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// largest reply header of an HTTP proxy
+	MAX_HEADER_BYTES = 64 * 1024
+)
+
+// A ContextDialer dials connections with a context; net.Dialer is one
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// A Dialer makes TCP connections through a proxy. Make it with New; the
+// exported fields may be set before its first dial.
+type Dialer struct {
+	// Timeout bounds each dial on top of the deadline of its context;
+	// zero is no bound
+	Timeout time.Duration
+
+	// Forward dials the proxy; a net.Dialer if nil
+	Forward ContextDialer
+
+	// TLSConfig is the TLS of https and socks5+tls proxies; the proxy's
+	// host is the ServerName if it has none
+	TLSConfig *tls.Config
+
+	proto string // "http" or "socks5"
+	addr  string // host:port of the proxy
+	tls   bool
+	user  string
+	pass  string
+}
+
+// Return a Dialer for the proxy at the URL 's'
+func New(s string) (*Dialer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("client: %s", err)
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("client: proxy %s: no host", s)
+	}
+
+	d := &Dialer{}
+	port := "80"
+	switch u.Scheme {
+	case "http":
+		d.proto = "http"
+	case "https":
+		d.proto, d.tls, port = "http", true, "443"
+	case "socks5":
+		d.proto, port = "socks5", "1080"
+	case "socks5+tls":
+		d.proto, d.tls, port = "socks5", true, "1080"
+	default:
+		return nil, fmt.Errorf("client: proxy %s: unsupported scheme '%s'", s, u.Scheme)
+	}
+	if len(u.Port()) > 0 {
+		port = u.Port()
+	}
+	d.addr = net.JoinHostPort(u.Hostname(), port)
+
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.pass, _ = u.User.Password()
+		if len(d.user) == 0 {
+			return nil, fmt.Errorf("client: proxy %s: password without a user", s)
+		}
+		if d.proto == "socks5" && (len(d.user) > 255 || len(d.pass) > 255) {
+			return nil, fmt.Errorf("client: proxy %s: user or password too long", s)
+		}
+	}
+	return d, nil
+}
+
+// Dial connects to 'addr' through the proxy
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to 'addr' through the proxy; 'network' is "tcp",
+// "tcp4" or "tcp6" (the proxy picks the family of a name).
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("client: network %s not supported", network)
+	}
+	if _, _, err := splitAddr(addr); err != nil {
+		return nil, fmt.Errorf("client: %s", err)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	fwd := d.Forward
+	if fwd == nil {
+		fwd = &net.Dialer{}
+	}
+	c, err := fwd.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+
+	// A done context cuts the handshake short: the reads and writes on
+	// the connection fail at once.
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(time.Unix(1, 0))
+	})
+	c, err = d.handshake(ctx, c, addr)
+	if !stop() {
+		err = fmt.Errorf("client: proxy %s: %w", d.addr, ctx.Err())
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Speak TLS and the proxy protocol on 'c' for a tunnel to 'addr'
+func (d *Dialer) handshake(ctx context.Context, c net.Conn, addr string) (net.Conn, error) {
+	if d.tls {
+		conf := &tls.Config{}
+		if d.TLSConfig != nil {
+			conf = d.TLSConfig.Clone()
+		}
+		if len(conf.ServerName) == 0 {
+			conf.ServerName, _, _ = net.SplitHostPort(d.addr)
+		}
+		tc := tls.Client(c, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return c, fmt.Errorf("client: proxy %s: %w", d.addr, err)
+		}
+		c = tc
+	}
+
+	var err error
+	if d.proto == "socks5" {
+		err = d.socks(c, addr)
+	} else {
+		err = d.connect(c, addr)
+	}
+	return c, err
+}
+
+// Send CONNECT and read the reply without reading past it; the tunnel
+// data that follows belongs to the caller.
+func (d *Dialer) connect(c net.Conn, addr string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if len(d.user) > 0 {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+
+	var hdr []byte
+	var b [1]byte
+	for !endOfHeader(hdr) {
+		if len(hdr) > MAX_HEADER_BYTES {
+			return fmt.Errorf("client: proxy %s: reply header too large", d.addr)
+		}
+		if _, err := c.Read(b[:]); err != nil {
+			return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+		}
+		hdr = append(hdr, b[0])
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(hdr)), nil)
+	if err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return &ProxyError{Proxy: d.addr, Addr: addr, Code: res.StatusCode,
+			Reason: res.Status, Err: httpCause(res), RetryAfter: retryAfter(res)}
+	}
+	return nil
+}
+
+func endOfHeader(b []byte) bool {
+	n := len(b)
+	return n >= 4 && string(b[n-4:]) == "\r\n\r\n"
+}
+
+// Return the host and port of 'addr'
+func splitAddr(addr string) (string, int, error) {
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(ps)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %s", addr)
+	}
+	return host, port, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,297 @@
+// client_test.go -- tests for the proxy client
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An echo server on a loopback port
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// An HTTP proxy that tunnels CONNECT requests with the password of
+// "alice"; "localhost" is the loopback
+func connectProxy(w http.ResponseWriter, r *http.Request) {
+	if u, p, _ := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth(); u != "alice" || p != "wonder" {
+		http.Error(w, "who?", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method != "CONNECT" {
+		http.Error(w, "no", http.StatusMethodNotAllowed)
+		return
+	}
+	rc, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.Header().Set("Proxy-Status", "test; error=connection_refused")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c, _, _ := w.(http.Hijacker).Hijack()
+	io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+	go io.Copy(rc, c)
+	io.Copy(c, rc)
+	c.Close()
+	rc.Close()
+}
+
+// A SOCKS5 proxy on 'ln' that wants the password of "alice"
+func socksProxy(t *testing.T, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+	serve := func(c net.Conn) {
+		defer c.Close()
+		var b [262]byte
+		io.ReadFull(c, b[:3])
+		if b[2] != 0x2 {
+			c.Write([]byte{0x5, 0xff})
+			return
+		}
+		c.Write([]byte{0x5, 0x2})
+		io.ReadFull(c, b[:2])
+		user := make([]byte, b[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(c, pass)
+		if string(user) != "alice" || string(pass) != "wonder" {
+			c.Write([]byte{0x1, 0x1})
+			return
+		}
+		c.Write([]byte{0x1, 0x0})
+
+		io.ReadFull(c, b[:4])
+		var host string
+		switch b[3] {
+		case 0x1:
+			io.ReadFull(c, b[:4])
+			host = net.IP(b[:4]).String()
+		case 0x3:
+			io.ReadFull(c, b[:1])
+			n := int(b[0])
+			io.ReadFull(c, b[:n])
+			host = string(b[:n])
+		}
+		io.ReadFull(c, b[:2])
+		port := int(b[0])<<8 | int(b[1])
+		rc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			c.Write([]byte{0x5, 0x5, 0x0, 0x1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer rc.Close()
+		c.Write([]byte{0x5, 0x0, 0x0, 0x1, 127, 0, 0, 1, 0, 1})
+		go io.Copy(rc, c)
+		io.Copy(c, rc)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+}
+
+func TestNew(t *testing.T) {
+	for _, s := range []string{"ftp://proxy", "http://", "socks5://:p@proxy",
+		"socks5://" + strings.Repeat("u", 256) + "@proxy", "%"} {
+		if _, err := New(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+	for s, want := range map[string]string{
+		"http://proxy":          "http proxy:80 false",
+		"https://u:p@proxy":     "http proxy:443 true",
+		"socks5://proxy":        "socks5 proxy:1080 false",
+		"socks5+tls://[::1]:99": "socks5 [::1]:99 true",
+	} {
+		d, err := New(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if got := d.proto + " " + d.addr + " " + strconv.FormatBool(d.tls); got != want {
+			t.Errorf("%s: %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	hp := httptest.NewServer(http.HandlerFunc(connectProxy))
+	defer hp.Close()
+	hps := httptest.NewTLSServer(http.HandlerFunc(connectProxy))
+	defer hps.Close()
+	conf := hps.Client().Transport.(*http.Transport).TLSClientConfig
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	socksProxy(t, ln)
+	tln, _ := net.Listen("tcp", "127.0.0.1:0")
+	socksProxy(t, tls.NewListener(tln, hps.TLS))
+
+	for _, s := range []string{
+		"http://alice:wonder@" + hp.Listener.Addr().String(),
+		"https://alice:wonder@" + hps.Listener.Addr().String(),
+		"socks5://alice:wonder@" + ln.Addr().String(),
+		"socks5+tls://alice:wonder@" + tln.Addr().String(),
+	} {
+		d, err := New(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.TLSConfig = conf
+		for _, addr := range []string{echo, "localhost:" + port} {
+			c, err := d.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("%s %s: %s", s, addr, err)
+				continue
+			}
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(c, "ping")
+			var b [4]byte
+			if _, err := io.ReadFull(c, b[:]); err != nil || string(b[:]) != "ping" {
+				t.Errorf("%s %s: %q %v", s, addr, b, err)
+			}
+			c.Close()
+		}
+
+		// wrong password, refused destination
+		d.user = "bob"
+		if _, err := d.Dial("tcp", echo); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: bad password: %v", s, err)
+		}
+		d.user = "alice"
+		_, err = d.Dial("tcp", "127.0.0.1:1")
+		var pe *ProxyError
+		if !errors.Is(err, ErrConnRefused) || !errors.As(err, &pe) || pe.Addr != "127.0.0.1:1" {
+			t.Errorf("%s: refused: %v", s, err)
+		}
+	}
+
+	d, _ := New("http://" + hp.Listener.Addr().String())
+	if _, err := d.Dial("udp", echo); err == nil {
+		t.Errorf("udp: no error")
+	}
+	if _, err := d.Dial("tcp", "localhost"); err == nil {
+		t.Errorf("no port: no error")
+	}
+}
+
+func TestHTTPCause(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		ps   string
+		want error
+	}{
+		{http.StatusProxyAuthRequired, "", ErrAuthFailed},
+		{http.StatusForbidden, "", ErrDestDenied},
+		{http.StatusTooManyRequests, "", ErrQuotaExceeded},
+		{http.StatusGatewayTimeout, "", ErrDialTimeout},
+		{http.StatusBadGateway, "", nil},
+		{http.StatusBadGateway, `p; error="dns_error"; details="x"`, ErrDNS},
+		{http.StatusBadGateway, "p; error=destination_unavailable", ErrHostUnreachable},
+		{http.StatusForbidden, "p; error=http_request_denied", ErrDestDenied},
+	} {
+		res := &http.Response{StatusCode: tc.code, Header: http.Header{}}
+		if len(tc.ps) > 0 {
+			res.Header.Set("Proxy-Status", tc.ps)
+		}
+		if got := httpCause(res); got != tc.want {
+			t.Errorf("%d %q: %v, want %v", tc.code, tc.ps, got, tc.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"":     0,
+		"5":    5 * time.Second,
+		"-1":   0,
+		"soon": 0,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat): time.Hour,
+	} {
+		res := &http.Response{Header: http.Header{}}
+		if len(v) > 0 {
+			res.Header.Set("Retry-After", v)
+		}
+		if got := retryAfter(res); got > want || got < want-2*time.Second {
+			t.Errorf("%q: %s, want %s", v, got, want)
+		}
+	}
+}
+
+// Cancellation and timeouts end a dial stuck in the handshake
+func TestDialCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	for _, s := range []string{"http://", "https://", "socks5://"} {
+		d, _ := New(s + ln.Addr().String())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		t0 := time.Now()
+		_, err := d.DialContext(ctx, "tcp", "example.com:80")
+		if !errors.Is(err, context.Canceled) || time.Since(t0) > 2*time.Second {
+			t.Errorf("%s cancel: %v after %s", s, err, time.Since(t0))
+		}
+
+		d.Timeout = 50 * time.Millisecond
+		t0 = time.Now()
+		_, err = d.Dial("tcp", "example.com:80")
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(t0) > 2*time.Second {
+			t.Errorf("%s timeout: %v after %s", s, err, time.Since(t0))
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
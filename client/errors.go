@@ -0,0 +1,133 @@
+// errors.go -- why a dial through a proxy failed
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The causes of a failed dial, picked from the proxy's reply. A
+// ProxyError wraps one of them when the proxy says why; branch on them
+// with errors.Is.
+var (
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrDestDenied      = errors.New("destination not allowed")
+	ErrDialTimeout     = errors.New("dial timed out")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrConnRefused     = errors.New("connection refused")
+	ErrHostUnreachable = errors.New("host unreachable")
+	ErrNetUnreachable  = errors.New("network unreachable")
+	ErrDNS             = errors.New("name lookup failed")
+)
+
+// A ProxyError is a proxy's refusal of a tunnel
+type ProxyError struct {
+	Proxy  string // host:port of the proxy
+	Addr   string // the destination; "" if the proxy refused the client
+	Code   int    // the SOCKS5 reply or the HTTP status
+	Reason string // the reply's text
+	Err    error  // the cause (one of the Err... above); nil if unknown
+
+	// RetryAfter is how long the proxy asked the client to wait (the
+	// Retry-After of an HTTP proxy); 0 if it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *ProxyError) Error() string {
+	if len(e.Addr) == 0 {
+		return fmt.Sprintf("client: proxy %s: %s", e.Proxy, e.Reason)
+	}
+	return fmt.Sprintf("client: proxy %s: CONNECT %s: %s", e.Proxy, e.Addr, e.Reason)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Return the cause of the SOCKS5 reply 'code'
+func socksCause(code byte) error {
+	switch code {
+	case 0x02:
+		return ErrDestDenied
+	case 0x03:
+		return ErrNetUnreachable
+	case 0x04:
+		return ErrHostUnreachable
+	case 0x05:
+		return ErrConnRefused
+	case 0x06:
+		return ErrDialTimeout
+	}
+	return nil
+}
+
+// Return the wait in the Retry-After of 'res' (seconds or a date); 0 if
+// there is none
+func retryAfter(res *http.Response) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if len(v) == 0 {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// error types of Proxy-Status (RFC 9209)
+var proxyStatus = map[string]error{
+	"destination_ip_prohibited": ErrDestDenied,
+	"connection_timeout":        ErrDialTimeout,
+	"connection_refused":        ErrConnRefused,
+	"destination_unavailable":   ErrHostUnreachable,
+	"destination_ip_unroutable": ErrNetUnreachable,
+	"destination_not_found":     ErrDNS,
+	"dns_error":                 ErrDNS,
+	"dns_timeout":               ErrDNS,
+}
+
+// Return the cause of the HTTP reply 'res': its Proxy-Status error type
+// if it has one, else its status
+func httpCause(res *http.Response) error {
+	for _, v := range res.Header.Values("Proxy-Status") {
+		for _, p := range strings.Split(v, ";") {
+			k, typ, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k != "error" {
+				continue
+			}
+			if err, ok := proxyStatus[strings.Trim(typ, `"`)]; ok {
+				return err
+			}
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return ErrAuthFailed
+	case http.StatusForbidden:
+		return ErrDestDenied
+	case http.StatusTooManyRequests:
+		return ErrQuotaExceeded
+	case http.StatusGatewayTimeout:
+		return ErrDialTimeout
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
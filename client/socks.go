@@ -0,0 +1,135 @@
+// socks.go -- SOCKS5 client
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Text of the SOCKS5 replies (RFC 1928)
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Ask the SOCKS5 proxy on 'c' for a tunnel to 'addr'; the reply is read
+// without reading past it.
+func (d *Dialer) socks(c net.Conn, addr string) error {
+	host, port, _ := splitAddr(addr)
+	if len(host) > 255 {
+		return fmt.Errorf("client: proxy %s: name too long: %s", d.addr, host)
+	}
+
+	if err := d.socksMethod(c); err != nil {
+		return err
+	}
+
+	req := []byte{0x5, 0x1, 0x0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x1)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x4)
+			req = append(req, ip...)
+		}
+	} else {
+		req = append(req, 0x3, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+
+	var b [262]byte
+	if _, err := io.ReadFull(c, b[:5]); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	if b[0] != 0x5 {
+		return fmt.Errorf("client: proxy %s: not a SOCKS5 proxy", d.addr)
+	}
+	if b[1] != 0 {
+		why, ok := socksReplies[b[1]]
+		if !ok {
+			why = fmt.Sprintf("error %d", b[1])
+		}
+		return &ProxyError{Proxy: d.addr, Addr: addr, Code: int(b[1]),
+			Reason: why, Err: socksCause(b[1])}
+	}
+
+	// the rest of the bound address
+	var n int
+	switch b[3] {
+	case 0x1:
+		n = 4 - 1 + 2
+	case 0x4:
+		n = 16 - 1 + 2
+	case 0x3:
+		n = int(b[4]) + 2
+	default:
+		return fmt.Errorf("client: proxy %s: bad address type %d", d.addr, b[3])
+	}
+	if _, err := io.ReadFull(c, b[:n]); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	return nil
+}
+
+// Agree on the method; authenticate with the user and password (RFC
+// 1929) if there is a user.
+func (d *Dialer) socksMethod(c net.Conn) error {
+	hello := []byte{0x5, 0x1, 0x0}
+	if len(d.user) > 0 {
+		hello = []byte{0x5, 0x1, 0x2}
+	}
+	if _, err := c.Write(hello); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	switch {
+	case b[0] != 0x5:
+		return fmt.Errorf("client: proxy %s: not a SOCKS5 proxy", d.addr)
+	case b[1] != hello[2]:
+		return &ProxyError{Proxy: d.addr, Code: int(b[1]),
+			Reason: fmt.Sprintf("method %d not accepted", hello[2]), Err: ErrAuthFailed}
+	case b[1] == 0x0:
+		return nil
+	}
+
+	req := []byte{0x1, byte(len(d.user))}
+	req = append(req, d.user...)
+	req = append(req, byte(len(d.pass)))
+	req = append(req, d.pass...)
+	if _, err := c.Write(req); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return fmt.Errorf("client: proxy %s: %w", d.addr, err)
+	}
+	if b[1] != 0 {
+		return &ProxyError{Proxy: d.addr, Code: int(b[1]), Reason: "authentication failed",
+			Err: ErrAuthFailed}
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
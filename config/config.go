@@ -0,0 +1,1071 @@
+// config.go -- goproxy configuration
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package config has the types of the goproxy config file. Tools can
+// build a config with them and write it out with Marshal, or check one
+// against the JSON Schema that Schema returns.
+package config
+
+import (
+	"net"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// List of config entries
+type Conf struct {
+	Logging  string `yaml:"log"`
+	LogLevel string `yaml:"loglevel"`
+	URLlog   string `yaml:"urllog"`
+	Uid      string `yaml:"uid"`
+	Gid      string `yaml:"gid"`
+	Chroot   string `yaml:"chroot"` // after the listeners are setup
+	Http     []ListenConf
+	Socks    []ListenConf
+	Dns      []DNSConf
+	Admin    AdminConf   `yaml:"admin"`
+	Shared   SharedConf  `yaml:"shared"`
+	Sandbox  SandboxConf `yaml:"sandbox"`
+	Daemon   DaemonConf  `yaml:"daemon"`
+	Sidecar  SidecarConf `yaml:"sidecar"`
+	Tracing  TraceConf   `yaml:"tracing"`
+	Alerts   AlertConf   `yaml:"alerts"`
+	Anomaly  AnomalyConf `yaml:"anomaly"`
+	Fair     FairConf    `yaml:"fair"`
+	Export   ExportConf  `yaml:"export"`
+	Events   EventsConf  `yaml:"events"`
+
+	// lines of the log as "text" (the default), "json" objects or
+	// "logfmt" key=value pairs
+	LogFormat string `yaml:"logformat"`
+
+	// listeners of customers, kept apart from each other
+	Tenants []TenantConf `yaml:"tenants"`
+
+	// unix socket through which a new goproxy takes over the
+	// listeners of a running one; no handover if empty
+	Handover string `yaml:"handover"`
+
+	// seconds an old goproxy lets its sessions finish after a
+	// handover; default 300
+	Drain int `yaml:"drain"`
+}
+
+// The listeners of one customer: their users, rules, quotas, egress
+// and access log are the tenant's own
+type TenantConf struct {
+	Name string `yaml:"name"`
+
+	// access log of the tenant's listeners; none if empty
+	URLlog string `yaml:"urllog"`
+
+	Http  []ListenConf `yaml:"http"`
+	Socks []ListenConf `yaml:"socks"`
+}
+
+// Usage by day, user and destination written out every interval for
+// billing and capacity planning
+type ExportConf struct {
+	// directory the CSV files are written to
+	Dir string `yaml:"dir"`
+
+	// S3 compatible bucket the files are uploaded to
+	S3 S3Conf `yaml:"s3"`
+
+	// seconds between exports; default 3600
+	Interval int `yaml:"interval"`
+
+	// gzip the files
+	Gzip bool `yaml:"gzip"`
+
+	// name of this proxy in the files; default is the host name
+	Node string `yaml:"node"`
+}
+
+// Usage events (sessions that end, API keys crossing their quota)
+// delivered at least once to a billing system
+type EventsConf struct {
+	// URL the events are POSTed to, as a JSON array
+	URL string `yaml:"url"`
+
+	// key of an HMAC-SHA256 of each POST (X-Goproxy-Signature)
+	Secret string `yaml:"secret"`
+
+	// redis://[:password@]host[:port][/db] of a list the events are
+	// pushed to; "list" defaults to goproxy:events
+	Redis string `yaml:"redis"`
+	List  string `yaml:"list"`
+
+	// file the undelivered events are kept in, across restarts
+	Spool string `yaml:"spool"`
+
+	// seconds between deliveries; default 5
+	Interval int `yaml:"interval"`
+
+	// fractions of API key quotas that are events when crossed;
+	// default [0.8, 1]
+	Quota []float64 `yaml:"quota"`
+
+	// name of this proxy in the events; default is the host name
+	Node string `yaml:"node"`
+}
+
+// An S3 compatible bucket (AWS, MinIO, Ceph, ...)
+type S3Conf struct {
+	// URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+	Bucket   string `yaml:"bucket"`
+
+	// default us-east-1
+	Region string `yaml:"region"`
+
+	// start of the names of the objects, e.g. "goproxy/"
+	Prefix string `yaml:"prefix"`
+
+	// default $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY
+	AccessKey string `yaml:"accesskey"`
+	SecretKey string `yaml:"secretkey"`
+}
+
+// State shared by a fleet of proxies behind one address: the quotas of
+// API keys, per-source rate limits and bans
+type SharedConf struct {
+	// redis://[:password@]host[:port][/db]; nothing is shared if empty
+	Redis string `yaml:"redis"`
+
+	// prefix of the keys; default "goproxy:"
+	Prefix string `yaml:"prefix"`
+
+	// milliseconds a command may take; default 250
+	Timeout int `yaml:"timeout"`
+}
+
+// Running in the background under a plain init system
+type DaemonConf struct {
+	// detach from the terminal (as with -D)
+	Detach bool `yaml:"detach"`
+
+	// pid file, locked while goproxy runs
+	Pidfile string `yaml:"pidfile"`
+
+	// working directory; "/" when detached
+	Dir string `yaml:"dir"`
+
+	// octal umask; default 077
+	Umask string `yaml:"umask"`
+}
+
+// OpenTelemetry traces of the sessions
+type TraceConf struct {
+	// OTLP/HTTP traces URL (http://collector:4318/v1/traces); no
+	// tracing if empty
+	Endpoint string `yaml:"endpoint"`
+
+	// service.name of the spans; default "goproxy"
+	Service string `yaml:"service"`
+
+	// fraction of the sessions traced; default 1
+	Sample float64 `yaml:"sample"`
+
+	// continue the trace of a client's traceparent header and send
+	// ours to the origin (HTTP only)
+	Propagate bool `yaml:"propagate"`
+
+	// sent with every export, e.g. an API key of the collector
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Alerts on the health of the proxy, for deployments without an
+// Alertmanager
+type AlertConf struct {
+	// seconds between checks; default 30
+	Interval int `yaml:"interval"`
+
+	// URL the "webhook" action POSTs alerts to as JSON
+	Webhook string `yaml:"webhook"`
+
+	Rules []AlertRuleConf `yaml:"rules"`
+}
+
+type AlertRuleConf struct {
+	// default: the kind
+	Name string `yaml:"name"`
+
+	// "error-rate", "dial-failure-rate", "upstream-down" or "quota"
+	Kind string `yaml:"kind"`
+
+	// the alert fires above this fraction: of sessions that failed, of
+	// dials that failed, or of the quota of an API key used (default
+	// 0.9); not used for upstream-down
+	Above float64 `yaml:"above"`
+
+	// seconds the condition must hold before the alert fires
+	For int `yaml:"for"`
+
+	// fewest sessions (or dials) between two checks for a rate to
+	// count; default 10
+	Min int `yaml:"min"`
+
+	// "log" (the default), "webhook" and "exit"
+	Actions []string `yaml:"actions"`
+
+	// exit status of the "exit" action; default 1
+	Exit int `yaml:"exit"`
+}
+
+// Heuristics that flag unusual traffic of a user (or a client without
+// one); nothing is watched if all are 0
+type AnomalyConf struct {
+	// flag a user whose bytes in a minute are this many times those
+	// of its usual minute
+	Spike float64 `yaml:"spike"`
+
+	// fewest bytes in a minute that are a spike; default 10MB
+	SpikeMin int64 `yaml:"spikemin"`
+
+	// flag a user that reaches more distinct hosts in 10 minutes
+	Hosts int `yaml:"hosts"`
+
+	// flag a user whose last so many sessions to a destination
+	// started at regular intervals
+	Beacon int `yaml:"beacon"`
+
+	// sessions of a flagged user are "tag"ged in the access log (the
+	// default), their tunnels "throttle"d or they are denied ("block")
+	Action string `yaml:"action"`
+
+	// bytes/sec of the tunnels of a throttled user
+	Throttle int `yaml:"throttle"`
+
+	// seconds a user stays flagged; default 600
+	Hold int `yaml:"hold"`
+}
+
+// Fair shares of a constrained uplink: the tunnels of the host are
+// paced to Rate and the bytes served round robin across users (or
+// clients without one); off if Rate is 0
+type FairConf struct {
+	// bytes/sec of the uplink each way
+	Rate int `yaml:"rate"`
+
+	// bytes a user moves in its turn; default 16384
+	Quantum int `yaml:"quantum"`
+
+	// share by "user" (the default) or "client" address
+	By string `yaml:"by"`
+}
+
+// Running as a sidecar of a kubernetes pod
+type SidecarConf struct {
+	// watch the config file, keep the admin listener on the
+	// loopback and label logs and metrics with the pod (as with -k)
+	Enable bool `yaml:"enable"`
+
+	// seconds between checks of the config file; default 10
+	Watch int `yaml:"watch"`
+
+	// labels file of the downward API; its labels go on the metrics
+	Labels string `yaml:"labels"`
+}
+
+// Linux sandbox entered once the servers run
+type SandboxConf struct {
+	// fail syscalls a proxy never makes (mount, ptrace, exec, ...)
+	Seccomp bool `yaml:"seccomp"`
+
+	// only open files below /etc, Read and Write
+	Landlock bool     `yaml:"landlock"`
+	Read     []string `yaml:"read"`
+	Write    []string `yaml:"write"` // read, write, create and remove
+}
+
+// Admin listener; serves /metrics and, with a password, mints tokens
+type AdminConf struct {
+	Listen string `yaml:"listen"`
+
+	// htpasswd style hash of the password of the endpoints that change
+	// things
+	Password string `yaml:"password"`
+
+	// base32 secret of a TOTP second factor; with it, the password and
+	// a one-time code only get a session (see /login)
+	TOTP string `yaml:"totp"`
+
+	// seconds a login session lasts; default 900
+	Session int `yaml:"session"`
+
+	// seconds of the windows of /top; default 300, 3600 and 86400
+	Windows []int `yaml:"windows"`
+
+	// directory of the packet captures of /capture; none if empty
+	Capture string `yaml:"capture"`
+
+	// fleet of proxies managed as one; none if empty
+	Cluster ClusterConf `yaml:"cluster"`
+
+	// HTTPS for the admin endpoints; plain HTTP if empty
+	TLS TLSConf `yaml:"tls"`
+}
+
+// Nodes of a fleet elect a leader and replicate the rules pushed (to
+// /rules) on any of them
+type ClusterConf struct {
+	// admin URL of this node, as it is in the peers of the others
+	Self string `yaml:"self"`
+
+	// admin URLs of the other nodes
+	Peers []string `yaml:"peers"`
+
+	// secret of the fleet; signs the requests of the nodes to each other
+	Secret string `yaml:"secret"`
+
+	// seconds between heartbeats; default 2
+	Interval int `yaml:"interval"`
+}
+
+type ListenConf struct {
+	Listen string   `yaml:"listen"`
+	Bind   string   `yaml:"bind"`
+	Allow  []Subnet `yaml:"allow"`
+	Deny   []Subnet `yaml:"deny"`
+
+	// rate limit -- perhost and global
+	Ratelimit RateLimit `yaml:"ratelimit"`
+
+	// SOCKSv5 UDP relay
+	UDP UDPConf `yaml:"udp"`
+
+	// Outbound destination rules; first match wins
+	Rules []RuleConf `yaml:"rules"`
+
+	// all deny rules and filters only log what they would deny
+	LogOnly bool `yaml:"logonly"`
+
+	// Built-in abuse guards; applied after the rules
+	Guard GuardConf `yaml:"guard"`
+
+	// Client authentication
+	Auth AuthConf `yaml:"auth"`
+
+	// TLS for clients, with optional client certificates
+	TLS TLSConf `yaml:"tls"`
+
+	// Trojan instead of SOCKS on a SOCKS listener with TLS
+	Trojan TrojanConf `yaml:"trojan"`
+
+	// Serve SOCKS4 and SOCKS5 clients too on an HTTP listener
+	Mixed bool `yaml:"mixed"`
+
+	// CONNECT-IP (RFC 9484) sessions on an HTTP listener
+	ConnectIP ConnectIPConf `yaml:"connectip"`
+
+	// Content filters, in order
+	Filters []FilterConf `yaml:"filters"`
+
+	// max bytes of a request or response body given to filters; 0
+	// gives them no bodies
+	FilterBody int64 `yaml:"filterbody"`
+
+	// Lua script with hooks for authentication, routes and HTTP
+	// headers
+	Script ScriptConf `yaml:"script"`
+
+	// picks the routes of connections the script leaves alone
+	Router RouterConf `yaml:"router"`
+
+	// HTTP request limits
+	Limits LimitConf `yaml:"limits"`
+
+	// Client timeouts
+	Client ClientConf `yaml:"client"`
+
+	// Size of relay buffers (bytes)
+	Bufsize int `yaml:"bufsize"`
+
+	// send the session id to origins as X-Request-Id (HTTP only)
+	RequestId bool `yaml:"requestid"`
+
+	// Tunnel (CONNECT and SOCKS) timeouts
+	Tunnel TunnelConf `yaml:"tunnel"`
+
+	// Parent proxy (http[s]://[user:pass@]host:port,
+	// vless|vmess://uuid@host:port[?security=tls&sni=name] or
+	// trojan://password@host:port[?sni=name]), with pin=<base64 SPKI
+	// hash> and certpin=<hex certificate hash> for the TLS ones; if
+	// set, all outbound TCP connections go through it
+	Parent string `yaml:"parent"`
+
+	// Front domain (host[:port]) of an https parent: dialed and named
+	// in the TLS SNI, while the Host header names the parent
+	ParentFront string `yaml:"parentfront"`
+
+	// Stream transport (obfuscation) of connections from clients and
+	// of those to the parent
+	Transport       TransportConf `yaml:"transport"`
+	ParentTransport TransportConf `yaml:"parenttransport"`
+
+	// Source addresses of authenticated users' outbound connections
+	Egress EgressConf `yaml:"egress"`
+
+	// WireGuard tunnels rules can send their connections through
+	WireGuard []WireGuardConf `yaml:"wireguard"`
+
+	// SSH jump hosts rules can send their connections through
+	Jump []JumpConf `yaml:"jump"`
+
+	// Look up destinations through DNSSEC validating resolvers
+	DNSSEC DNSSECConf `yaml:"dnssec"`
+
+	// Connections to origins (HTTP forwarding) and the parent proxy
+	Pool PoolConf `yaml:"pool"`
+
+	// HTTP response cache
+	HTTPCache CacheConf `yaml:"httpcache"`
+
+	// Compression of HTTP responses to clients
+	Compress CompressConf `yaml:"compress"`
+
+	// HTML error pages of the HTTP proxy: html/template files by
+	// status ("403", "407", "429", "502", ...) or "default"
+	ErrorPages map[string]string `yaml:"errorpages"`
+
+	// Terms HTTP clients accept before they are proxied (guest
+	// networks)
+	Captive CaptiveConf `yaml:"captive"`
+
+	// Accept TCP fast open with a queue of this many pending
+	// requests; 0 disables it
+	Fastopen int `yaml:"fastopen"`
+
+	// Multipath TCP
+	MPTCP MPTCPConf `yaml:"mptcp"`
+
+	// Sockets accepting on the address, each with its own accept queue
+	// (SO_REUSEPORT); 0 or 1 is one
+	Shards int `yaml:"shards"`
+
+	// Let other processes listen on the same address (SO_REUSEPORT);
+	// implied by shards
+	ReusePort bool `yaml:"reuseport"`
+
+	// TCP congestion control for outbound connections (e.g., "bbr");
+	// default is the system default
+	Congestion string `yaml:"congestion"`
+
+	// the tenant of the listener; set from "tenants"
+	Tenant string `yaml:"-"`
+}
+
+// Tunnel timeouts in seconds; zero means the default
+type TunnelConf struct {
+	// both directions idle for this long closes the tunnel
+	Idle int `yaml:"idle"`
+
+	// after one side closes its half, the other direction may be
+	// idle for this long
+	Linger int `yaml:"linger"`
+
+	// relay in the kernel with a BPF sockmap (Linux; needs root or
+	// CAP_BPF at startup)
+	Sockmap bool `yaml:"sockmap"`
+
+	// max bytes relayed (both directions together); 0 is unlimited
+	MaxBytes int64 `yaml:"maxbytes"`
+
+	// note the protocol in the tunnel in the access log; always done
+	// if a rule has protocols
+	Sniff bool `yaml:"sniff"`
+
+	// note the JA3 and JA4 fingerprints of TLS clients in the access
+	// log; implies sniff
+	Fingerprint bool `yaml:"fingerprint"`
+
+	// ports of FTP servers: the data connections announced on tunnels
+	// to them may be opened for a while (default 21); 0 is none
+	FTP []int `yaml:"ftp"`
+}
+
+// Upstream connection pools; zero means the default
+type PoolConf struct {
+	// idle connections kept per host
+	MaxIdle int `yaml:"maxidle"`
+
+	// max connections per host; 0 is unlimited
+	PerHost int `yaml:"perhost"`
+
+	// seconds an idle connection is kept
+	Idle int `yaml:"idle"`
+
+	// max age (seconds) of a connection; 0 is unlimited
+	Lifetime int `yaml:"lifetime"`
+
+	// times an idempotent request is sent again after a connect
+	// failure or reset; -1 disables retries
+	Retries int `yaml:"retries"`
+
+	// TLS sessions with origins cached for resumption; -1 disables it
+	TLSSessions int `yaml:"tlssessions"`
+
+	// speak HTTP/2 to TLS origins that offer it
+	HTTP2 bool `yaml:"http2"`
+
+	// origins (host or host:port) that get cleartext HTTP/2; needs http2
+	H2C []string `yaml:"h2c"`
+
+	// ClientHello of TLS to origins: go (the default), chrome, firefox
+	// or safari
+	Hello string `yaml:"hello"`
+
+	// Encrypted Client Hello to origins that publish ECH configs
+	ECH ECHConf `yaml:"ech"`
+}
+
+// ECH to origins; off if there are no resolvers
+type ECHConf struct {
+	// host[:port] of each resolver asked for HTTPS records; the path
+	// to them must be private (e.g. the same host)
+	Resolvers []string `yaml:"resolvers"`
+}
+
+// HTTP response cache; enabled if Memory or Dir is set
+type CacheConf struct {
+	// MB of responses kept in memory
+	Memory int64 `yaml:"memory"`
+
+	// directory for the disk tier; optional
+	Dir string `yaml:"dir"`
+
+	// MB of responses kept on disk
+	Disk int64 `yaml:"disk"`
+
+	// largest response (MB) we store
+	MaxObject int64 `yaml:"maxobject"`
+}
+
+// Compression of HTTP responses; zero means the default
+type CompressConf struct {
+	// gzip or brotli compress responses for clients that accept it
+	Enable bool `yaml:"enable"`
+
+	// media types to compress ("text/*" matches all text); default is
+	// text, JSON, JavaScript, XML and SVG
+	Types []string `yaml:"types"`
+
+	// smallest response (bytes) compressed
+	MinSize int `yaml:"minsize"`
+}
+
+// Click-through terms of use; zero means the default
+type CaptiveConf struct {
+	// send clients that haven't accepted the terms to the terms page
+	Enable bool `yaml:"enable"`
+
+	// html/template file of the terms; it has a form that POSTs to
+	// .Accept. Default is a short built-in page.
+	Page string `yaml:"page"`
+
+	// host name of the terms page; default "goproxy.captive"
+	Host string `yaml:"host"`
+
+	// seconds an acceptance lasts; default 3600
+	TTL int `yaml:"ttl"`
+}
+
+// Multipath TCP for client and upstream connections (linux 5.6+);
+// falls back to TCP if either end doesn't support it.
+type MPTCPConf struct {
+	// accept MPTCP connections from clients
+	Listen bool `yaml:"listen"`
+
+	// make MPTCP connections to destinations
+	Dial bool `yaml:"dial"`
+}
+
+// Client timeouts and minimum transfer rate; zero means the default
+type ClientConf struct {
+	// seconds to finish the SOCKS negotiation or send the HTTP request header
+	Handshake int `yaml:"handshake"`
+
+	// seconds an idle HTTP keep-alive connection is kept open
+	Idle int `yaml:"idle"`
+
+	// seconds an HTTP body read or write may stall
+	Grace int `yaml:"grace"`
+
+	// min bytes/sec for HTTP request and response bodies (after the
+	// first Grace seconds); 0 disables the check
+	MinRate int `yaml:"minrate"`
+}
+
+// HTTP request limits; zero means the default
+type LimitConf struct {
+	// max length of the request line
+	RequestLine int `yaml:"requestline"`
+
+	// max number of header fields
+	Headers int `yaml:"headers"`
+
+	// max size of the request line and headers together
+	HeaderBytes int `yaml:"headerbytes"`
+
+	// max bytes of a request body; 0 is unlimited
+	Body int64 `yaml:"body"`
+
+	// max bytes of a response body from an origin; 0 is unlimited
+	Response int64 `yaml:"response"`
+}
+
+// A destination rule
+type RuleConf struct {
+	Name string `yaml:"name"`
+
+	// IP addresses, CIDRs or domain names (includes subdomains)
+	Dest []string `yaml:"dest"`
+
+	// ports or port ranges ("8000-8080")
+	Ports []string `yaml:"ports"`
+
+	// authenticated users (password, token or client certificate)
+	// the rule applies to; empty is all clients
+	Users []string `yaml:"users"`
+
+	// protocols in a tunnel: "tls", "http", "ssh", "bittorrent", "dns"
+	// or "unknown"; the rule applies once the first bytes are seen
+	Proto []string `yaml:"proto"`
+
+	// "allow" or "deny"
+	Action string `yaml:"action"`
+
+	// Use TCP fast open to destinations allowed by this rule
+	Fastopen bool `yaml:"fastopen"`
+
+	// TCP congestion control for destinations allowed by this rule
+	Congestion string `yaml:"congestion"`
+
+	// Faults injected on connections allowed by this rule (testing)
+	Chaos ChaosConf `yaml:"chaos"`
+
+	// host:port sent a copy of the bytes going upstream on connections
+	// allowed by this rule (best effort)
+	Mirror string `yaml:"mirror"`
+
+	// Split the TLS ClientHello sent to destinations allowed by this
+	// rule (SNI-based DPI)
+	Fragment FragmentConf `yaml:"fragment"`
+
+	// Name of the listener's WireGuard tunnel that connections allowed
+	// by this rule go through
+	WireGuard string `yaml:"wireguard"`
+
+	// Name of the listener's jump host that connections allowed by
+	// this rule go through
+	Jump string `yaml:"jump"`
+
+	// Seconds a session allowed by this rule may last; its tunnel or
+	// request is closed then. 0 is no limit.
+	Deadline int `yaml:"deadline"`
+
+	// html/template file answering HTTP requests denied by this rule
+	ErrorPage string `yaml:"errorpage"`
+
+	// a deny rule that only logs what it would deny; the rules after
+	// it decide
+	LogOnly bool `yaml:"logonly"`
+}
+
+// An SSH server (bastion) connections can be sent through
+type JumpConf struct {
+	Name string `yaml:"name"`
+
+	// host[:port] of the SSH server
+	Addr string `yaml:"addr"`
+	User string `yaml:"user"`
+
+	// private key file (OpenSSH or PEM) and its passphrase, if any
+	Key        string `yaml:"key"`
+	Passphrase string `yaml:"passphrase"`
+
+	// known_hosts file with the server's host key
+	KnownHosts string `yaml:"knownhosts"`
+
+	// seconds between keepalives; default 30, -1 is off
+	Keepalive int `yaml:"keepalive"`
+}
+
+// A userspace WireGuard tunnel to one peer
+type WireGuardConf struct {
+	Name string `yaml:"name"`
+
+	// base64 private key of this end
+	PrivateKey string `yaml:"privatekey"`
+
+	// addresses of this end in the tunnel (IPv4 and/or IPv6)
+	Address []string `yaml:"address"`
+
+	// default 1420
+	MTU int `yaml:"mtu"`
+
+	// UDP port; 0 is any
+	ListenPort int `yaml:"listenport"`
+
+	Peer WireGuardPeerConf `yaml:"peer"`
+}
+
+type WireGuardPeerConf struct {
+	// base64 keys
+	PublicKey    string `yaml:"publickey"`
+	PresharedKey string `yaml:"presharedkey"`
+
+	// host:port; the peer's last address is used once it sends
+	Endpoint string `yaml:"endpoint"`
+
+	// CIDRs routed to the peer; default is everything
+	AllowedIPs []string `yaml:"allowedips"`
+
+	// seconds between keepalives; 0 is off
+	Keepalive int `yaml:"keepalive"`
+}
+
+// Splitting of ClientHellos into TLS records; off if empty
+type FragmentConf struct {
+	// cut the first record inside the server name
+	SNI bool `yaml:"sni"`
+
+	// most bytes of the hello in a record; 0 is no limit
+	Size int `yaml:"size"`
+
+	// milliseconds between the writes of the records
+	Delay int `yaml:"delay"`
+}
+
+// Faults for testing clients against a degraded proxy
+type ChaosConf struct {
+	// milliseconds added to each dial and each read from the
+	// destination, plus a random part of jitter
+	Latency int `yaml:"latency"`
+	Jitter  int `yaml:"jitter"`
+
+	// bytes/sec each way; 0 is unlimited
+	Bandwidth int `yaml:"bandwidth"`
+
+	// percent of dials that fail
+	DialFail float64 `yaml:"dialfail"`
+
+	// percent of connections reset within resetafter seconds (default
+	// 10)
+	Reset      float64 `yaml:"reset"`
+	ResetAfter int     `yaml:"resetafter"`
+}
+
+// TLS on a listener; off if Cert is empty
+type TLSConf struct {
+	// PEM certificate chain and private key of the listener; the key
+	// may be in the Cert file
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+
+	// PEM CA certificates that issue client certificates
+	ClientCA string `yaml:"clientca"`
+
+	// client certificates: "none", "optional" (verified if sent) or
+	// "require"; default is "require" if ClientCA is set
+	ClientAuth string `yaml:"clientauth"`
+
+	// certificate names tried in order for the user: "dns", "email",
+	// "uri" (SANs) and "cn"; default is all of them in that order
+	Identity []string `yaml:"identity"`
+
+	// certificate name to proxy user; if set, names not here are refused
+	Users map[string]string `yaml:"users"`
+
+	// take plaintext clients too; TLS ones are told by their ClientHello
+	Plain bool `yaml:"plain"`
+
+	// staple OCSP responses of the responder the Cert names; its
+	// issuer must be in the Cert file
+	OCSP bool `yaml:"ocsp"`
+
+	// certificate from an ACME CA instead of Cert and Key
+	ACME ACMEConf `yaml:"acme"`
+}
+
+// Certificates obtained and renewed from an ACME CA
+type ACMEConf struct {
+	// names of the certificate; "*.example.com" needs dns-01
+	Domains []string `yaml:"domains"`
+
+	// contact of the account at the CA
+	Email string `yaml:"email"`
+
+	// directory URL of the CA; default is Let's Encrypt
+	Directory string `yaml:"directory"`
+
+	// directory that keeps the account key and the certificates
+	Cache string `yaml:"cache"`
+
+	// "tls-alpn-01" (default), "http-01" or "dns-01"
+	Challenge string `yaml:"challenge"`
+
+	// listen address of the http-01 responder; default ":80"
+	HTTP string `yaml:"http"`
+
+	// URL of the DNS hook of dns-01: POSTs of {"fqdn", "value"} to
+	// <url>/present and <url>/cleanup
+	DNSHook string `yaml:"dnshook"`
+
+	// seconds a TXT record is given before the CA checks it; default 30
+	DNSWait int `yaml:"dnswait"`
+
+	// external account binding: key id and base64url HMAC key
+	EABKid string `yaml:"eabkid"`
+	EABKey string `yaml:"eabkey"`
+}
+
+// Per user source addresses. A user in 'users' has those addresses;
+// others get one of each family from the pool, kept in 'file'.
+type EgressConf struct {
+	// addresses and CIDRs of this host
+	Pool []string `yaml:"pool"`
+
+	// JSON file of the users' addresses from the pool
+	File string `yaml:"file"`
+
+	// fixed addresses of users: user -> IP[,IP]
+	Users map[string]string `yaml:"users"`
+
+	// IPv6 prefix routed to this host (e.g. a delegated /64); IPv6
+	// connections come from temporary addresses in it
+	Prefix string `yaml:"prefix"`
+
+	// seconds each user keeps a temporary address; 0 gives every
+	// connection its own
+	Rotate int `yaml:"rotate"`
+}
+
+// Client authentication; off if Type is empty
+type AuthConf struct {
+	// a registered authenticator type (e.g. "htpasswd")
+	Type string `yaml:"type"`
+
+	// realm sent to HTTP clients
+	Realm string `yaml:"realm"`
+
+	// settings of the authenticator type
+	Args map[string]string `yaml:"args"`
+
+	// refuse a client address or user name for 'ban' seconds (default
+	// 300) after 'fails' failed logins within that time; 0 is never
+	Fails int `yaml:"fails"`
+	Ban   int `yaml:"ban"`
+}
+
+// A content filter
+type FilterConf struct {
+	// a registered filter type (e.g. "urlblock")
+	Type string `yaml:"type"`
+
+	// name in the logs; default is the type
+	Name string `yaml:"name"`
+
+	// settings of the filter type
+	Args map[string]string `yaml:"args"`
+
+	// denials are only noted in the log of the request
+	LogOnly bool `yaml:"logonly"`
+}
+
+// A script of a listener; none if File is empty
+type ScriptConf struct {
+	// Lua file defining any of the functions auth, route, request and
+	// response; read again when it changes
+	File string `yaml:"file"`
+
+	// milliseconds a call may take; default 50
+	Timeout int `yaml:"timeout"`
+
+	// steps (statements and expressions) a call may take; default
+	// 100000
+	Steps int `yaml:"steps"`
+
+	// if a call fails or runs out of time, go on as if there was no
+	// script; the default is to refuse the client or destination
+	FailOpen bool `yaml:"failopen"`
+}
+
+// A router of a listener; none if Type is empty
+type RouterConf struct {
+	// a registered router type (e.g. "plugin")
+	Type string `yaml:"type"`
+
+	// settings of the router type
+	Args map[string]string `yaml:"args"`
+}
+
+// Trojan clients of a listener
+type TrojanConf struct {
+	// user name -> password
+	Users map[string]string `yaml:"users"`
+
+	// host:port that gets connections that aren't from a Trojan
+	// client (a web server); they are closed if empty
+	Fallback string `yaml:"fallback"`
+}
+
+// CONNECT-IP sessions of an HTTP listener
+type ConnectIPConf struct {
+	// prefixes the clients' addresses are taken from, one of each
+	// (e.g. 10.77.0.0/16 and fd77::/64); CONNECT-IP is off if empty
+	Pool []string `yaml:"pool"`
+}
+
+// A stream transport; none if Type is empty
+type TransportConf struct {
+	// a registered transport type (e.g. "scramble")
+	Type string `yaml:"type"`
+
+	// settings of the transport type
+	Args map[string]string `yaml:"args"`
+}
+
+// Built-in guards: deny SMTP and private/link-local destinations and
+// ban clients that look like they are scanning.
+type GuardConf struct {
+	Disable bool     `yaml:"disable"`
+	Scan    ScanConf `yaml:"scan"`
+}
+
+// Trusted validating resolvers; the proxy requires their AD bit
+type DNSSECConf struct {
+	// host[:port] of each resolver; the path to them must be trusted
+	// (e.g. the same host)
+	Resolvers []string `yaml:"resolvers"`
+
+	// accept answers without the AD bit (unsigned zones); failed
+	// validations are still errors
+	Unsigned bool `yaml:"unsigned"`
+
+	// client subnets: "strip" (default) or "synthesize"
+	ECS ECSConf `yaml:"ecs"`
+}
+
+// Scan detection; Max < 0 disables it
+type ScanConf struct {
+	// max distinct destinations per client in Window seconds
+	Max    int `yaml:"max"`
+	Window int `yaml:"window"`
+
+	// seconds a client stays banned
+	Ban int `yaml:"ban"`
+}
+
+type RateLimit struct {
+	Global  uint `yaml:"global"`
+	PerHost uint `yaml:"perhost"`
+
+	// Max burst of new conns from a single host; defaults to PerHost
+	Burst uint `yaml:"burst"`
+
+	// Max conns at once from a single host; 0 is no limit
+	MaxConns uint `yaml:"maxconns"`
+
+	// Name lookups/sec for each client (or user) and their max burst;
+	// the burst defaults to Lookups
+	Lookups     uint `yaml:"lookups"`
+	LookupBurst uint `yaml:"lookupburst"`
+}
+
+// DNS proxy config; Listen is used for both UDP and TCP
+type DNSConf struct {
+	ListenConf `yaml:",inline"`
+
+	// optional DNS-over-HTTPS (RFC 8484) listen address
+	DoH string `yaml:"doh"`
+
+	// PEM certificate (chain) and key for the DoH listener; required
+	// with DoH
+	DoHCert string `yaml:"dohcert"`
+	DoHKey  string `yaml:"dohkey"`
+
+	// upstream resolvers - tried in order
+	Upstream []string `yaml:"upstream"`
+
+	// max number of cached responses
+	Cache int `yaml:"cache"`
+
+	// domains (and their subdomains) answered with NXDOMAIN
+	Block []string `yaml:"block"`
+
+	// client subnets of queries sent upstream
+	ECS ECSConf `yaml:"ecs"`
+}
+
+// EDNS Client Subnet (RFC 7871) of queries to resolvers
+type ECSConf struct {
+	// "forward" the client's, "strip" it or "synthesize" one from the
+	// client's address
+	Mode string `yaml:"mode"`
+
+	// prefix lengths of synthesized subnets; default 24 and 56
+	Prefix4 int `yaml:"prefix4"`
+	Prefix6 int `yaml:"prefix6"`
+}
+
+// UDP ASSOCIATE relay config
+type UDPConf struct {
+	// NAT behavior: "full-cone", "restricted" or "port-restricted"
+	Nat string `yaml:"nat"`
+
+	// Idle timeout in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+// An IP/Subnet
+type Subnet struct {
+	net.IPNet
+}
+
+// Custom unmarshaler for IPNet
+func (ipn *Subnet) UnmarshalYAML(unm func(v interface{}) error) error {
+	var s string
+
+	// First unpack the bytes as a string. We then parse the string
+	// as a CIDR
+	err := unm(&s)
+	if err != nil {
+		return err
+	}
+
+	_, net, err := net.ParseCIDR(s)
+	if err == nil {
+		ipn.IP = net.IP
+		ipn.Mask = net.Mask
+	}
+	return err
+}
+
+// Custom marshaler for IPNet: the CIDR
+func (ipn Subnet) MarshalYAML() (interface{}, error) {
+	return ipn.String(), nil
+}
+
+// Parse a config file in YAML (or JSON) format. Only its syntax is
+// checked; goproxy checks the rest when it starts.
+func Parse(b []byte) (*Conf, error) {
+	var cfg Conf
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Return 'cfg' in YAML format
+func Marshal(cfg *Conf) ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,193 @@
+// config_test.go -- tests for the config types and their schema
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Check the YAML document 'v' against 's'; enough of JSON Schema for
+// the config's
+func validate(root, s *JSONSchema, v interface{}, at string) error {
+	if len(s.Ref) > 0 {
+		return validate(root, root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")], v, at)
+	}
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("%s: not an object", at)
+		}
+		for k, x := range m {
+			key := fmt.Sprint(k)
+			p, ok := s.Properties[key]
+			if !ok {
+				if ap, ok := s.AdditionalProperties.(*JSONSchema); ok {
+					p = ap
+				} else {
+					return fmt.Errorf("%s: unknown key %q", at, key)
+				}
+			}
+			if err := validate(root, p, x, at+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: not an array", at)
+		}
+		for i, x := range a {
+			if err := validate(root, s.Items, x, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: not a string", at)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: not a boolean", at)
+		}
+	case "integer":
+		n, ok := v.(int)
+		if !ok || (s.Minimum != nil && float64(n) < *s.Minimum) {
+			return fmt.Errorf("%s: not an integer in range", at)
+		}
+	case "number":
+		switch v.(type) {
+		case int, float64:
+		default:
+			return fmt.Errorf("%s: not a number", at)
+		}
+	}
+	return nil
+}
+
+func parseDoc(t *testing.T, b []byte) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSchema(t *testing.T) {
+	s := Schema()
+	if s.Schema != SCHEMA_DRAFT || s.Ref != "#/$defs/Conf" {
+		t.Fatalf("root: %+v", s)
+	}
+
+	// the YAML keys: default, tagged, inline and skipped ones
+	lc := s.Defs["ListenConf"]
+	if lc.Properties["listen"] == nil || lc.Properties["ratelimit"].Ref != "#/$defs/RateLimit" ||
+		lc.Properties["tenant"] != nil || lc.AdditionalProperties != false {
+		t.Errorf("listener: %+v", lc)
+	}
+	if p := s.Defs["Conf"].Properties["http"]; p == nil || p.Items.Ref != "#/$defs/ListenConf" {
+		t.Errorf("http: %+v", p)
+	}
+	dc := s.Defs["DNSConf"]
+	if dc.Properties["listen"] == nil || dc.Properties["doh"] == nil || dc.Properties["listenconf"] != nil {
+		t.Errorf("dns: %+v", dc)
+	}
+	if a := lc.Properties["allow"]; a.Items.Type != "string" {
+		t.Errorf("subnets: %+v", a.Items)
+	}
+	if g := s.Defs["RateLimit"].Properties["global"]; g.Type != "integer" || *g.Minimum != 0 {
+		t.Errorf("uint: %+v", g)
+	}
+
+	// the doc comments
+	ac := s.Defs["ACMEConf"]
+	if !strings.HasPrefix(ac.Description, "Certificates obtained") ||
+		!strings.HasPrefix(ac.Properties["dnswait"].Description, "seconds a TXT record") {
+		t.Errorf("descriptions: %+v", ac)
+	}
+
+	if _, err := json.Marshal(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sample config is valid, and a misspelt key isn't
+	b, err := os.ReadFile("../etc/goproxy.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(s, s, parseDoc(t, b), "conf"); err != nil {
+		t.Errorf("goproxy.conf: %s", err)
+	}
+	for _, doc := range []string{
+		"http:\n  - listen: 127.0.0.1:8080\n    ratelimt: {global: 10}\n",
+		"http:\n  - listen: 127.0.0.1:8080\n    ratelimit: {global: -1}\n",
+		"socks:\n  - listen: [127.0.0.1]\n",
+	} {
+		if err := validate(s, s, parseDoc(t, []byte(doc)), "conf"); err == nil {
+			t.Errorf("%q: valid", doc)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	conf := `
+http:
+  - listen: 127.0.0.1:8080
+    allow: [192.0.2.0/24, 2001:db8::/32]
+    rules:
+      - name: lan
+        dest: [10.0.0.0/8]
+        action: deny
+dns:
+  - listen: 127.0.0.1:5353
+    upstream: [192.0.2.53:53]
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Http[0].Allow[1].String() != "2001:db8::/32" || c.Dns[0].Listen != "127.0.0.1:5353" {
+		t.Fatalf("parsed: %+v", c)
+	}
+
+	// what's written out is valid and reads back the same
+	b, err := Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Schema()
+	if err := validate(s, s, parseDoc(t, b), "conf"); err != nil {
+		t.Errorf("marshaled: %s\n%s", err, b)
+	}
+	d, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Http[0].Allow[0].String() != "192.0.2.0/24" || d.Http[0].Rules[0].Action != "deny" ||
+		d.Dns[0].Upstream[0] != "192.0.2.53:53" {
+		t.Errorf("round trip: %+v", d)
+	}
+
+	// JSON is YAML too
+	if j, err := Parse([]byte(`{"socks": [{"listen": "127.0.0.1:1080", "deny": ["192.0.2.9/32"]}]}`)); err != nil ||
+		j.Socks[0].Deny[0].String() != "192.0.2.9/32" {
+		t.Errorf("json: %v %v", j, err)
+	}
+	if _, err := Parse([]byte("http: [{allow: [nonsense]}]")); err == nil {
+		t.Errorf("bad subnet: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,293 @@
+// Code generated by gen.go from config.go; DO NOT EDIT.
+
+package config
+
+// Doc comments of the types and their fields
+var descriptions = map[string]string{
+	"ACMEConf":                     "Certificates obtained and renewed from an ACME CA",
+	"ACMEConf.Cache":               "directory that keeps the account key and the certificates",
+	"ACMEConf.Challenge":           "\"tls-alpn-01\" (default), \"http-01\" or \"dns-01\"",
+	"ACMEConf.DNSHook":             "URL of the DNS hook of dns-01: POSTs of {\"fqdn\", \"value\"} to <url>/present and <url>/cleanup",
+	"ACMEConf.DNSWait":             "seconds a TXT record is given before the CA checks it; default 30",
+	"ACMEConf.Directory":           "directory URL of the CA; default is Let's Encrypt",
+	"ACMEConf.Domains":             "names of the certificate; \"*.example.com\" needs dns-01",
+	"ACMEConf.EABKid":              "external account binding: key id and base64url HMAC key",
+	"ACMEConf.Email":               "contact of the account at the CA",
+	"ACMEConf.HTTP":                "listen address of the http-01 responder; default \":80\"",
+	"AdminConf":                    "Admin listener; serves /metrics and, with a password, mints tokens",
+	"AdminConf.Capture":            "directory of the packet captures of /capture; none if empty",
+	"AdminConf.Cluster":            "fleet of proxies managed as one; none if empty",
+	"AdminConf.Password":           "htpasswd style hash of the password of the endpoints that change things",
+	"AdminConf.Session":            "seconds a login session lasts; default 900",
+	"AdminConf.TLS":                "HTTPS for the admin endpoints; plain HTTP if empty",
+	"AdminConf.TOTP":               "base32 secret of a TOTP second factor; with it, the password and a one-time code only get a session (see /login)",
+	"AdminConf.Windows":            "seconds of the windows of /top; default 300, 3600 and 86400",
+	"AlertConf":                    "Alerts on the health of the proxy, for deployments without an Alertmanager",
+	"AlertConf.Interval":           "seconds between checks; default 30",
+	"AlertConf.Webhook":            "URL the \"webhook\" action POSTs alerts to as JSON",
+	"AlertRuleConf.Above":          "the alert fires above this fraction: of sessions that failed, of dials that failed, or of the quota of an API key used (default 0.9); not used for upstream-down",
+	"AlertRuleConf.Actions":        "\"log\" (the default), \"webhook\" and \"exit\"",
+	"AlertRuleConf.Exit":           "exit status of the \"exit\" action; default 1",
+	"AlertRuleConf.For":            "seconds the condition must hold before the alert fires",
+	"AlertRuleConf.Kind":           "\"error-rate\", \"dial-failure-rate\", \"upstream-down\" or \"quota\"",
+	"AlertRuleConf.Min":            "fewest sessions (or dials) between two checks for a rate to count; default 10",
+	"AlertRuleConf.Name":           "default: the kind",
+	"AnomalyConf":                  "Heuristics that flag unusual traffic of a user (or a client without one); nothing is watched if all are 0",
+	"AnomalyConf.Action":           "sessions of a flagged user are \"tag\"ged in the access log (the default), their tunnels \"throttle\"d or they are denied (\"block\")",
+	"AnomalyConf.Beacon":           "flag a user whose last so many sessions to a destination started at regular intervals",
+	"AnomalyConf.Hold":             "seconds a user stays flagged; default 600",
+	"AnomalyConf.Hosts":            "flag a user that reaches more distinct hosts in 10 minutes",
+	"AnomalyConf.Spike":            "flag a user whose bytes in a minute are this many times those of its usual minute",
+	"AnomalyConf.SpikeMin":         "fewest bytes in a minute that are a spike; default 10MB",
+	"AnomalyConf.Throttle":         "bytes/sec of the tunnels of a throttled user",
+	"AuthConf":                     "Client authentication; off if Type is empty",
+	"AuthConf.Args":                "settings of the authenticator type",
+	"AuthConf.Fails":               "refuse a client address or user name for 'ban' seconds (default 300) after 'fails' failed logins within that time; 0 is never",
+	"AuthConf.Realm":               "realm sent to HTTP clients",
+	"AuthConf.Type":                "a registered authenticator type (e.g. \"htpasswd\")",
+	"CacheConf":                    "HTTP response cache; enabled if Memory or Dir is set",
+	"CacheConf.Dir":                "directory for the disk tier; optional",
+	"CacheConf.Disk":               "MB of responses kept on disk",
+	"CacheConf.MaxObject":          "largest response (MB) we store",
+	"CacheConf.Memory":             "MB of responses kept in memory",
+	"CaptiveConf":                  "Click-through terms of use; zero means the default",
+	"CaptiveConf.Enable":           "send clients that haven't accepted the terms to the terms page",
+	"CaptiveConf.Host":             "host name of the terms page; default \"goproxy.captive\"",
+	"CaptiveConf.Page":             "html/template file of the terms; it has a form that POSTs to .Accept. Default is a short built-in page.",
+	"CaptiveConf.TTL":              "seconds an acceptance lasts; default 3600",
+	"ChaosConf":                    "Faults for testing clients against a degraded proxy",
+	"ChaosConf.Bandwidth":          "bytes/sec each way; 0 is unlimited",
+	"ChaosConf.DialFail":           "percent of dials that fail",
+	"ChaosConf.Latency":            "milliseconds added to each dial and each read from the destination, plus a random part of jitter",
+	"ChaosConf.Reset":              "percent of connections reset within resetafter seconds (default 10)",
+	"ClientConf":                   "Client timeouts and minimum transfer rate; zero means the default",
+	"ClientConf.Grace":             "seconds an HTTP body read or write may stall",
+	"ClientConf.Handshake":         "seconds to finish the SOCKS negotiation or send the HTTP request header",
+	"ClientConf.Idle":              "seconds an idle HTTP keep-alive connection is kept open",
+	"ClientConf.MinRate":           "min bytes/sec for HTTP request and response bodies (after the first Grace seconds); 0 disables the check",
+	"ClusterConf":                  "Nodes of a fleet elect a leader and replicate the rules pushed (to /rules) on any of them",
+	"ClusterConf.Interval":         "seconds between heartbeats; default 2",
+	"ClusterConf.Peers":            "admin URLs of the other nodes",
+	"ClusterConf.Secret":           "secret of the fleet; signs the requests of the nodes to each other",
+	"ClusterConf.Self":             "admin URL of this node, as it is in the peers of the others",
+	"CompressConf":                 "Compression of HTTP responses; zero means the default",
+	"CompressConf.Enable":          "gzip or brotli compress responses for clients that accept it",
+	"CompressConf.MinSize":         "smallest response (bytes) compressed",
+	"CompressConf.Types":           "media types to compress (\"text/*\" matches all text); default is text, JSON, JavaScript, XML and SVG",
+	"Conf":                         "List of config entries",
+	"Conf.Chroot":                  "after the listeners are setup",
+	"Conf.Drain":                   "seconds an old goproxy lets its sessions finish after a handover; default 300",
+	"Conf.Handover":                "unix socket through which a new goproxy takes over the listeners of a running one; no handover if empty",
+	"Conf.LogFormat":               "lines of the log as \"text\" (the default), \"json\" objects or \"logfmt\" key=value pairs",
+	"Conf.Tenants":                 "listeners of customers, kept apart from each other",
+	"ConnectIPConf":                "CONNECT-IP sessions of an HTTP listener",
+	"ConnectIPConf.Pool":           "prefixes the clients' addresses are taken from, one of each (e.g. 10.77.0.0/16 and fd77::/64); CONNECT-IP is off if empty",
+	"DNSConf":                      "DNS proxy config; Listen is used for both UDP and TCP",
+	"DNSConf.Block":                "domains (and their subdomains) answered with NXDOMAIN",
+	"DNSConf.Cache":                "max number of cached responses",
+	"DNSConf.DoH":                  "optional DNS-over-HTTPS (RFC 8484) listen address",
+	"DNSConf.DoHCert":              "PEM certificate (chain) and key for the DoH listener; required with DoH",
+	"DNSConf.ECS":                  "client subnets of queries sent upstream",
+	"DNSConf.Upstream":             "upstream resolvers - tried in order",
+	"DNSSECConf":                   "Trusted validating resolvers; the proxy requires their AD bit",
+	"DNSSECConf.ECS":               "client subnets: \"strip\" (default) or \"synthesize\"",
+	"DNSSECConf.Resolvers":         "host[:port] of each resolver; the path to them must be trusted (e.g. the same host)",
+	"DNSSECConf.Unsigned":          "accept answers without the AD bit (unsigned zones); failed validations are still errors",
+	"DaemonConf":                   "Running in the background under a plain init system",
+	"DaemonConf.Detach":            "detach from the terminal (as with -D)",
+	"DaemonConf.Dir":               "working directory; \"/\" when detached",
+	"DaemonConf.Pidfile":           "pid file, locked while goproxy runs",
+	"DaemonConf.Umask":             "octal umask; default 077",
+	"ECHConf":                      "ECH to origins; off if there are no resolvers",
+	"ECHConf.Resolvers":            "host[:port] of each resolver asked for HTTPS records; the path to them must be private (e.g. the same host)",
+	"ECSConf":                      "EDNS Client Subnet (RFC 7871) of queries to resolvers",
+	"ECSConf.Mode":                 "\"forward\" the client's, \"strip\" it or \"synthesize\" one from the client's address",
+	"ECSConf.Prefix4":              "prefix lengths of synthesized subnets; default 24 and 56",
+	"EgressConf":                   "Per user source addresses. A user in 'users' has those addresses; others get one of each family from the pool, kept in 'file'.",
+	"EgressConf.File":              "JSON file of the users' addresses from the pool",
+	"EgressConf.Pool":              "addresses and CIDRs of this host",
+	"EgressConf.Prefix":            "IPv6 prefix routed to this host (e.g. a delegated /64); IPv6 connections come from temporary addresses in it",
+	"EgressConf.Rotate":            "seconds each user keeps a temporary address; 0 gives every connection its own",
+	"EgressConf.Users":             "fixed addresses of users: user -> IP[,IP]",
+	"EventsConf":                   "Usage events (sessions that end, API keys crossing their quota) delivered at least once to a billing system",
+	"EventsConf.Interval":          "seconds between deliveries; default 5",
+	"EventsConf.Node":              "name of this proxy in the events; default is the host name",
+	"EventsConf.Quota":             "fractions of API key quotas that are events when crossed; default [0.8, 1]",
+	"EventsConf.Redis":             "redis://[:password@]host[:port][/db] of a list the events are pushed to; \"list\" defaults to goproxy:events",
+	"EventsConf.Secret":            "key of an HMAC-SHA256 of each POST (X-Goproxy-Signature)",
+	"EventsConf.Spool":             "file the undelivered events are kept in, across restarts",
+	"EventsConf.URL":               "URL the events are POSTed to, as a JSON array",
+	"ExportConf":                   "Usage by day, user and destination written out every interval for billing and capacity planning",
+	"ExportConf.Dir":               "directory the CSV files are written to",
+	"ExportConf.Gzip":              "gzip the files",
+	"ExportConf.Interval":          "seconds between exports; default 3600",
+	"ExportConf.Node":              "name of this proxy in the files; default is the host name",
+	"ExportConf.S3":                "S3 compatible bucket the files are uploaded to",
+	"FairConf":                     "Fair shares of a constrained uplink: the tunnels of the host are paced to Rate and the bytes served round robin across users (or clients without one); off if Rate is 0",
+	"FairConf.By":                  "share by \"user\" (the default) or \"client\" address",
+	"FairConf.Quantum":             "bytes a user moves in its turn; default 16384",
+	"FairConf.Rate":                "bytes/sec of the uplink each way",
+	"FilterConf":                   "A content filter",
+	"FilterConf.Args":              "settings of the filter type",
+	"FilterConf.LogOnly":           "denials are only noted in the log of the request",
+	"FilterConf.Name":              "name in the logs; default is the type",
+	"FilterConf.Type":              "a registered filter type (e.g. \"urlblock\")",
+	"FragmentConf":                 "Splitting of ClientHellos into TLS records; off if empty",
+	"FragmentConf.Delay":           "milliseconds between the writes of the records",
+	"FragmentConf.SNI":             "cut the first record inside the server name",
+	"FragmentConf.Size":            "most bytes of the hello in a record; 0 is no limit",
+	"GuardConf":                    "Built-in guards: deny SMTP and private/link-local destinations and ban clients that look like they are scanning.",
+	"JumpConf":                     "An SSH server (bastion) connections can be sent through",
+	"JumpConf.Addr":                "host[:port] of the SSH server",
+	"JumpConf.Keepalive":           "seconds between keepalives; default 30, -1 is off",
+	"JumpConf.Key":                 "private key file (OpenSSH or PEM) and its passphrase, if any",
+	"JumpConf.KnownHosts":          "known_hosts file with the server's host key",
+	"LimitConf":                    "HTTP request limits; zero means the default",
+	"LimitConf.Body":               "max bytes of a request body; 0 is unlimited",
+	"LimitConf.HeaderBytes":        "max size of the request line and headers together",
+	"LimitConf.Headers":            "max number of header fields",
+	"LimitConf.RequestLine":        "max length of the request line",
+	"LimitConf.Response":           "max bytes of a response body from an origin; 0 is unlimited",
+	"ListenConf.Auth":              "Client authentication",
+	"ListenConf.Bufsize":           "Size of relay buffers (bytes)",
+	"ListenConf.Captive":           "Terms HTTP clients accept before they are proxied (guest networks)",
+	"ListenConf.Client":            "Client timeouts",
+	"ListenConf.Compress":          "Compression of HTTP responses to clients",
+	"ListenConf.Congestion":        "TCP congestion control for outbound connections (e.g., \"bbr\"); default is the system default",
+	"ListenConf.ConnectIP":         "CONNECT-IP (RFC 9484) sessions on an HTTP listener",
+	"ListenConf.DNSSEC":            "Look up destinations through DNSSEC validating resolvers",
+	"ListenConf.Egress":            "Source addresses of authenticated users' outbound connections",
+	"ListenConf.ErrorPages":        "HTML error pages of the HTTP proxy: html/template files by status (\"403\", \"407\", \"429\", \"502\", ...) or \"default\"",
+	"ListenConf.Fastopen":          "Accept TCP fast open with a queue of this many pending requests; 0 disables it",
+	"ListenConf.FilterBody":        "max bytes of a request or response body given to filters; 0 gives them no bodies",
+	"ListenConf.Filters":           "Content filters, in order",
+	"ListenConf.Guard":             "Built-in abuse guards; applied after the rules",
+	"ListenConf.HTTPCache":         "HTTP response cache",
+	"ListenConf.Jump":              "SSH jump hosts rules can send their connections through",
+	"ListenConf.Limits":            "HTTP request limits",
+	"ListenConf.LogOnly":           "all deny rules and filters only log what they would deny",
+	"ListenConf.MPTCP":             "Multipath TCP",
+	"ListenConf.Mixed":             "Serve SOCKS4 and SOCKS5 clients too on an HTTP listener",
+	"ListenConf.Parent":            "Parent proxy (http[s]://[user:pass@]host:port, vless|vmess://uuid@host:port[?security=tls&sni=name] or trojan://password@host:port[?sni=name]), with pin=<base64 SPKI hash> and certpin=<hex certificate hash> for the TLS ones; if set, all outbound TCP connections go through it",
+	"ListenConf.ParentFront":       "Front domain (host[:port]) of an https parent: dialed and named in the TLS SNI, while the Host header names the parent",
+	"ListenConf.Pool":              "Connections to origins (HTTP forwarding) and the parent proxy",
+	"ListenConf.Ratelimit":         "rate limit -- perhost and global",
+	"ListenConf.RequestId":         "send the session id to origins as X-Request-Id (HTTP only)",
+	"ListenConf.ReusePort":         "Let other processes listen on the same address (SO_REUSEPORT); implied by shards",
+	"ListenConf.Router":            "picks the routes of connections the script leaves alone",
+	"ListenConf.Rules":             "Outbound destination rules; first match wins",
+	"ListenConf.Script":            "Lua script with hooks for authentication, routes and HTTP headers",
+	"ListenConf.Shards":            "Sockets accepting on the address, each with its own accept queue (SO_REUSEPORT); 0 or 1 is one",
+	"ListenConf.TLS":               "TLS for clients, with optional client certificates",
+	"ListenConf.Tenant":            "the tenant of the listener; set from \"tenants\"",
+	"ListenConf.Transport":         "Stream transport (obfuscation) of connections from clients and of those to the parent",
+	"ListenConf.Trojan":            "Trojan instead of SOCKS on a SOCKS listener with TLS",
+	"ListenConf.Tunnel":            "Tunnel (CONNECT and SOCKS) timeouts",
+	"ListenConf.UDP":               "SOCKSv5 UDP relay",
+	"ListenConf.WireGuard":         "WireGuard tunnels rules can send their connections through",
+	"MPTCPConf":                    "Multipath TCP for client and upstream connections (linux 5.6+); falls back to TCP if either end doesn't support it.",
+	"MPTCPConf.Dial":               "make MPTCP connections to destinations",
+	"MPTCPConf.Listen":             "accept MPTCP connections from clients",
+	"PoolConf":                     "Upstream connection pools; zero means the default",
+	"PoolConf.ECH":                 "Encrypted Client Hello to origins that publish ECH configs",
+	"PoolConf.H2C":                 "origins (host or host:port) that get cleartext HTTP/2; needs http2",
+	"PoolConf.HTTP2":               "speak HTTP/2 to TLS origins that offer it",
+	"PoolConf.Hello":               "ClientHello of TLS to origins: go (the default), chrome, firefox or safari",
+	"PoolConf.Idle":                "seconds an idle connection is kept",
+	"PoolConf.Lifetime":            "max age (seconds) of a connection; 0 is unlimited",
+	"PoolConf.MaxIdle":             "idle connections kept per host",
+	"PoolConf.PerHost":             "max connections per host; 0 is unlimited",
+	"PoolConf.Retries":             "times an idempotent request is sent again after a connect failure or reset; -1 disables retries",
+	"PoolConf.TLSSessions":         "TLS sessions with origins cached for resumption; -1 disables it",
+	"RateLimit.Burst":              "Max burst of new conns from a single host; defaults to PerHost",
+	"RateLimit.Lookups":            "Name lookups/sec for each client (or user) and their max burst; the burst defaults to Lookups",
+	"RateLimit.MaxConns":           "Max conns at once from a single host; 0 is no limit",
+	"RouterConf":                   "A router of a listener; none if Type is empty",
+	"RouterConf.Args":              "settings of the router type",
+	"RouterConf.Type":              "a registered router type (e.g. \"plugin\")",
+	"RuleConf":                     "A destination rule",
+	"RuleConf.Action":              "\"allow\" or \"deny\"",
+	"RuleConf.Chaos":               "Faults injected on connections allowed by this rule (testing)",
+	"RuleConf.Congestion":          "TCP congestion control for destinations allowed by this rule",
+	"RuleConf.Deadline":            "Seconds a session allowed by this rule may last; its tunnel or request is closed then. 0 is no limit.",
+	"RuleConf.Dest":                "IP addresses, CIDRs or domain names (includes subdomains)",
+	"RuleConf.ErrorPage":           "html/template file answering HTTP requests denied by this rule",
+	"RuleConf.Fastopen":            "Use TCP fast open to destinations allowed by this rule",
+	"RuleConf.Fragment":            "Split the TLS ClientHello sent to destinations allowed by this rule (SNI-based DPI)",
+	"RuleConf.Jump":                "Name of the listener's jump host that connections allowed by this rule go through",
+	"RuleConf.LogOnly":             "a deny rule that only logs what it would deny; the rules after it decide",
+	"RuleConf.Mirror":              "host:port sent a copy of the bytes going upstream on connections allowed by this rule (best effort)",
+	"RuleConf.Ports":               "ports or port ranges (\"8000-8080\")",
+	"RuleConf.Proto":               "protocols in a tunnel: \"tls\", \"http\", \"ssh\", \"bittorrent\", \"dns\" or \"unknown\"; the rule applies once the first bytes are seen",
+	"RuleConf.Users":               "authenticated users (password, token or client certificate) the rule applies to; empty is all clients",
+	"RuleConf.WireGuard":           "Name of the listener's WireGuard tunnel that connections allowed by this rule go through",
+	"S3Conf":                       "An S3 compatible bucket (AWS, MinIO, Ceph, ...)",
+	"S3Conf.AccessKey":             "default $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY",
+	"S3Conf.Endpoint":              "URL of the service, e.g. https://s3.eu-west-1.amazonaws.com",
+	"S3Conf.Prefix":                "start of the names of the objects, e.g. \"goproxy/\"",
+	"S3Conf.Region":                "default us-east-1",
+	"SandboxConf":                  "Linux sandbox entered once the servers run",
+	"SandboxConf.Landlock":         "only open files below /etc, Read and Write",
+	"SandboxConf.Seccomp":          "fail syscalls a proxy never makes (mount, ptrace, exec, ...)",
+	"SandboxConf.Write":            "read, write, create and remove",
+	"ScanConf":                     "Scan detection; Max < 0 disables it",
+	"ScanConf.Ban":                 "seconds a client stays banned",
+	"ScanConf.Max":                 "max distinct destinations per client in Window seconds",
+	"ScriptConf":                   "A script of a listener; none if File is empty",
+	"ScriptConf.FailOpen":          "if a call fails or runs out of time, go on as if there was no script; the default is to refuse the client or destination",
+	"ScriptConf.File":              "Lua file defining any of the functions auth, route, request and response; read again when it changes",
+	"ScriptConf.Steps":             "steps (statements and expressions) a call may take; default 100000",
+	"ScriptConf.Timeout":           "milliseconds a call may take; default 50",
+	"SharedConf":                   "State shared by a fleet of proxies behind one address: the quotas of API keys, per-source rate limits and bans",
+	"SharedConf.Prefix":            "prefix of the keys; default \"goproxy:\"",
+	"SharedConf.Redis":             "redis://[:password@]host[:port][/db]; nothing is shared if empty",
+	"SharedConf.Timeout":           "milliseconds a command may take; default 250",
+	"SidecarConf":                  "Running as a sidecar of a kubernetes pod",
+	"SidecarConf.Enable":           "watch the config file, keep the admin listener on the loopback and label logs and metrics with the pod (as with -k)",
+	"SidecarConf.Labels":           "labels file of the downward API; its labels go on the metrics",
+	"SidecarConf.Watch":            "seconds between checks of the config file; default 10",
+	"Subnet":                       "An IP/Subnet",
+	"TLSConf":                      "TLS on a listener; off if Cert is empty",
+	"TLSConf.ACME":                 "certificate from an ACME CA instead of Cert and Key",
+	"TLSConf.Cert":                 "PEM certificate chain and private key of the listener; the key may be in the Cert file",
+	"TLSConf.ClientAuth":           "client certificates: \"none\", \"optional\" (verified if sent) or \"require\"; default is \"require\" if ClientCA is set",
+	"TLSConf.ClientCA":             "PEM CA certificates that issue client certificates",
+	"TLSConf.Identity":             "certificate names tried in order for the user: \"dns\", \"email\", \"uri\" (SANs) and \"cn\"; default is all of them in that order",
+	"TLSConf.OCSP":                 "staple OCSP responses of the responder the Cert names; its issuer must be in the Cert file",
+	"TLSConf.Plain":                "take plaintext clients too; TLS ones are told by their ClientHello",
+	"TLSConf.Users":                "certificate name to proxy user; if set, names not here are refused",
+	"TenantConf":                   "The listeners of one customer: their users, rules, quotas, egress and access log are the tenant's own",
+	"TenantConf.URLlog":            "access log of the tenant's listeners; none if empty",
+	"TraceConf":                    "OpenTelemetry traces of the sessions",
+	"TraceConf.Endpoint":           "OTLP/HTTP traces URL (http://collector:4318/v1/traces); no tracing if empty",
+	"TraceConf.Headers":            "sent with every export, e.g. an API key of the collector",
+	"TraceConf.Propagate":          "continue the trace of a client's traceparent header and send ours to the origin (HTTP only)",
+	"TraceConf.Sample":             "fraction of the sessions traced; default 1",
+	"TraceConf.Service":            "service.name of the spans; default \"goproxy\"",
+	"TransportConf":                "A stream transport; none if Type is empty",
+	"TransportConf.Args":           "settings of the transport type",
+	"TransportConf.Type":           "a registered transport type (e.g. \"scramble\")",
+	"TrojanConf":                   "Trojan clients of a listener",
+	"TrojanConf.Fallback":          "host:port that gets connections that aren't from a Trojan client (a web server); they are closed if empty",
+	"TrojanConf.Users":             "user name -> password",
+	"TunnelConf":                   "Tunnel timeouts in seconds; zero means the default",
+	"TunnelConf.FTP":               "ports of FTP servers: the data connections announced on tunnels to them may be opened for a while (default 21); 0 is none",
+	"TunnelConf.Fingerprint":       "note the JA3 and JA4 fingerprints of TLS clients in the access log; implies sniff",
+	"TunnelConf.Idle":              "both directions idle for this long closes the tunnel",
+	"TunnelConf.Linger":            "after one side closes its half, the other direction may be idle for this long",
+	"TunnelConf.MaxBytes":          "max bytes relayed (both directions together); 0 is unlimited",
+	"TunnelConf.Sniff":             "note the protocol in the tunnel in the access log; always done if a rule has protocols",
+	"TunnelConf.Sockmap":           "relay in the kernel with a BPF sockmap (Linux; needs root or CAP_BPF at startup)",
+	"UDPConf":                      "UDP ASSOCIATE relay config",
+	"UDPConf.Nat":                  "NAT behavior: \"full-cone\", \"restricted\" or \"port-restricted\"",
+	"UDPConf.Timeout":              "Idle timeout in seconds",
+	"WireGuardConf":                "A userspace WireGuard tunnel to one peer",
+	"WireGuardConf.Address":        "addresses of this end in the tunnel (IPv4 and/or IPv6)",
+	"WireGuardConf.ListenPort":     "UDP port; 0 is any",
+	"WireGuardConf.MTU":            "default 1420",
+	"WireGuardConf.PrivateKey":     "base64 private key of this end",
+	"WireGuardPeerConf.AllowedIPs": "CIDRs routed to the peer; default is everything",
+	"WireGuardPeerConf.Endpoint":   "host:port; the peer's last address is used once it sends",
+	"WireGuardPeerConf.Keepalive":  "seconds between keepalives; 0 is off",
+	"WireGuardPeerConf.PublicKey":  "base64 keys",
+}
@@ -0,0 +1,96 @@
+// gen.go -- generate the descriptions of the schema from config.go
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build ignore
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "config.go", nil, parser.ParseComments)
+	if err != nil {
+		die(err)
+	}
+
+	m := make(map[string]string)
+	text := func(cg *ast.CommentGroup) string {
+		if cg == nil {
+			return ""
+		}
+		return strings.Join(strings.Fields(cg.Text()), " ")
+	}
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, sp := range gd.Specs {
+			ts := sp.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			if s := text(gd.Doc); len(s) > 0 {
+				m[ts.Name.Name] = s
+			}
+			for _, fl := range st.Fields.List {
+				s := text(fl.Doc)
+				if len(s) == 0 {
+					s = text(fl.Comment)
+				}
+				if len(s) == 0 {
+					continue
+				}
+				for _, n := range fl.Names {
+					m[ts.Name.Name+"."+n.Name] = s
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by gen.go from config.go; DO NOT EDIT.\n\npackage config\n\n")
+	b.WriteString("// Doc comments of the types and their fields\nvar descriptions = map[string]string{\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\t%q: %q,\n", k, m[k])
+	}
+	b.WriteString("}\n")
+
+	out, err := format.Source(b.Bytes())
+	if err != nil {
+		die(err)
+	}
+	if err := os.WriteFile("descr.go", out, 0644); err != nil {
+		die(err)
+	}
+}
+
+func die(err error) {
+	fmt.Fprintf(os.Stderr, "gen: %s\n", err)
+	os.Exit(1)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,133 @@
+// schema.go -- JSON Schema of the config file
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package config
+
+//go:generate go run gen.go
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Dialect of the schema
+const SCHEMA_DRAFT = "https://json-schema.org/draft/2020-12/schema"
+
+// A JSON Schema; only what the config needs
+type JSONSchema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Ref         string `json:"$ref,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+
+	Minimum *float64 `json:"minimum,omitempty"`
+
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Items      *JSONSchema            `json:"items,omitempty"`
+
+	// false or the schema of the values of a map
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+
+	Defs map[string]*JSONSchema `json:"$defs,omitempty"`
+}
+
+// Return the JSON Schema of the config file. It follows the YAML keys
+// of the types in this package: each struct is a definition in $defs
+// and objects have no keys other than their fields, so a misspelt key
+// fails validation (goproxy itself ignores it). The descriptions are
+// the doc comments of config.go; run "go generate" after changing them.
+func Schema() *JSONSchema {
+	g := &schemaGen{defs: make(map[string]*JSONSchema)}
+	root := g.of(reflect.TypeOf(Conf{}))
+	return &JSONSchema{
+		Schema: SCHEMA_DRAFT,
+		Title:  "goproxy config",
+		Ref:    root.Ref,
+		Defs:   g.defs,
+	}
+}
+
+var subnetType = reflect.TypeOf(Subnet{})
+
+type schemaGen struct {
+	defs map[string]*JSONSchema
+}
+
+// Return the schema of values of type 't'
+func (g *schemaGen) of(t reflect.Type) *JSONSchema {
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var zero float64
+		return &JSONSchema{Type: "integer", Minimum: &zero}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &JSONSchema{Type: "array", Items: g.of(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: g.of(t.Elem())}
+	case reflect.Ptr:
+		return g.of(t.Elem())
+	case reflect.Struct:
+		if t == subnetType {
+			return &JSONSchema{Type: "string", Description: "IP address prefix (CIDR)"}
+		}
+		name := t.Name()
+		if _, ok := g.defs[name]; !ok {
+			// a placeholder stops recursive types
+			g.defs[name] = nil
+			s := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema),
+				AdditionalProperties: false, Description: descriptions[name]}
+			g.fields(s, t)
+			g.defs[name] = s
+		}
+		return &JSONSchema{Ref: "#/$defs/" + name}
+	}
+	return &JSONSchema{}
+}
+
+// Add the fields of the struct 't' to 's'
+func (g *schemaGen) fields(s *JSONSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		key := tag[0]
+		if key == "-" {
+			continue
+		}
+		inline := false
+		for _, o := range tag[1:] {
+			inline = inline || o == "inline"
+		}
+		if inline {
+			g.fields(s, f.Type)
+			continue
+		}
+		if len(key) == 0 {
+			key = strings.ToLower(f.Name)
+		}
+		// a description next to a $ref is fine since draft 2019-09
+		p := g.of(f.Type)
+		if len(p.Description) == 0 {
+			p.Description = descriptions[t.Name()+"."+f.Name]
+		}
+		s.Properties[key] = p
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -1,10 +1,24 @@
 module github.com/opencoff/go-proxies
 
-go 1.12
+// go 1.21: the typed atomics (1.19), http.ResponseController (1.20),
+// MPTCP on net.Dialer and net.ListenConfig and context.AfterFunc (1.21)
+go 1.21
 
 require (
-	github.com/opencoff/go-logger v0.0.0-20190612060632-bf4528b7367d
+	github.com/andybalholm/brotli v1.1.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/opencoff/go-ratelimit v0.6.0
+	github.com/opencoff/golang-lru v0.6.0
 	github.com/opencoff/pflag v0.3.3
+	golang.org/x/crypto v0.19.0
+	golang.org/x/net v0.21.0
 	gopkg.in/yaml.v2 v2.2.2
 )
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/uuid v1.3.1 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
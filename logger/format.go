@@ -0,0 +1,198 @@
+// format.go -- structured output formats and fields of log lines
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The format of the lines a logger writes
+type Format uint32
+
+const (
+	// "<prio>:date time prefix: (file:line) message"; the default
+	FormatText Format = iota
+
+	// A JSON object per line: "time", "level", "prefix", "caller",
+	// "msg" and the "fields" of With()
+	FormatJSON
+
+	// logfmt: key=value pairs of the same keys, then the fields
+	FormatLogfmt
+)
+
+// Map the names of formats in config files to formats
+var formatName = map[string]Format{
+	"TEXT":   FormatText,
+	"JSON":   FormatJSON,
+	"LOGFMT": FormatLogfmt,
+}
+
+// Convert a format name ("text", "json", "logfmt") to the Format; "" is
+// text
+func ToFormat(s string) (f Format, ok bool) {
+	if len(s) == 0 {
+		return FormatText, true
+	}
+	f, ok = formatName[strings.ToUpper(s)]
+	return
+}
+
+// A key and value added to each line of a logger
+type field struct {
+	key string
+	val interface{}
+}
+
+// Set the format of the lines of 'l', its parent and its sub-loggers:
+// they share one output.
+func (l *Logger) SetFormat(f Format) {
+	atomic.StoreUint32(&l.ch.format, uint32(f))
+}
+
+func (l *Logger) format() Format {
+	return Format(atomic.LoadUint32(&l.ch.format))
+}
+
+// Return a sub-logger that adds the key-value pairs 'kv' to each line:
+// as "fields" in JSON and as key=value after the message in text. A key
+// without a value gets the value "MISSING".
+func (l *Logger) With(kv ...interface{}) *Logger {
+	nl := l.New("", LOG_NONE)
+	nl.prefix = l.prefix
+	nl.fields = make([]field, len(l.fields), len(l.fields)+(len(kv)+1)/2)
+	copy(nl.fields, l.fields)
+	for i := 0; i < len(kv); i += 2 {
+		f := field{key: fmt.Sprint(kv[i]), val: "MISSING"}
+		if i+1 < len(kv) {
+			f.val = kv[i+1]
+		}
+		nl.fields = append(nl.fields, f)
+	}
+	return nl
+}
+
+// Return the line of 'msg' in the format 'f'; 'where' is the caller
+func (l *Logger) encode(f Format, prio Priority, where, msg string, fields []field) string {
+	if f == FormatLogfmt {
+		return l.logfmt(prio, where, msg, fields)
+	}
+
+	var b strings.Builder
+
+	b.WriteString(`{"time":`)
+	b.WriteString(strconv.Quote(time.Now().UTC().Format(time.RFC3339Nano)))
+	if prio != LOG_NONE {
+		b.WriteString(`,"level":`)
+		jsonValue(&b, prio.String())
+	}
+	if (l.flag & lPrefix) != 0 {
+		b.WriteString(`,"prefix":`)
+		jsonValue(&b, strings.TrimSuffix(l.prefix, ": "))
+	}
+	if len(where) > 0 {
+		b.WriteString(`,"caller":`)
+		jsonValue(&b, where)
+	}
+	b.WriteString(`,"msg":`)
+	jsonValue(&b, msg)
+	if len(fields) > 0 {
+		b.WriteString(`,"fields":{`)
+		for i, x := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			jsonValue(&b, x.key)
+			b.WriteByte(':')
+			jsonValue(&b, x.val)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Return the logfmt line of 'msg'
+func (l *Logger) logfmt(prio Priority, where, msg string, fields []field) string {
+	var b strings.Builder
+
+	b.WriteString("time=")
+	b.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	if prio != LOG_NONE {
+		b.WriteString(" level=")
+		b.WriteString(prio.String())
+	}
+	if (l.flag & lPrefix) != 0 {
+		b.WriteString(" prefix=")
+		b.WriteString(textValue(strings.TrimSuffix(l.prefix, ": ")))
+	}
+	if len(where) > 0 {
+		b.WriteString(" caller=")
+		b.WriteString(textValue(where))
+	}
+	b.WriteString(" msg=")
+	b.WriteString(textValue(msg))
+	b.WriteString(textFields(fields))
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// Write 'v' as JSON; errors and Stringers as their text, and what JSON
+// can't encode as fmt prints it
+func jsonValue(b *strings.Builder, v interface{}) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// Return the fields as " key=value" pairs (logfmt); values with spaces,
+// quotes or '=' are quoted
+func textFields(fields []field) string {
+	var b strings.Builder
+	for _, x := range fields {
+		b.WriteByte(' ')
+		b.WriteString(textValue(x.key))
+		b.WriteByte('=')
+		b.WriteString(textValue(fieldText(x.val)))
+	}
+	return b.String()
+}
+
+// Return the text of a field's value; lists are a line each
+func fieldText(v interface{}) string {
+	switch x := v.(type) {
+	case []string:
+		return strings.Join(x, "\n")
+	case error:
+		return x.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+func textValue(s string) string {
+	if len(s) == 0 || strings.ContainsAny(s, " \t\r\n\"=\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
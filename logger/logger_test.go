@@ -0,0 +1,204 @@
+// logger_test.go -- tests for flushing and closing loggers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A buffer that counts its closes
+type closeBuf struct {
+	bytes.Buffer
+	closed int
+}
+
+func (b *closeBuf) Close() error {
+	b.closed++
+	return nil
+}
+
+func TestFlush(t *testing.T) {
+	var b closeBuf
+	l, _ := New(&b, LOG_DEBUG, "top", 0)
+	sub := l.New("sub", LOG_NONE)
+
+	for i := 0; i < 500; i++ {
+		l.Info("line %d", i)
+		sub.Info("sub %d", i)
+	}
+	sub.Flush()
+	if n := strings.Count(b.String(), "\n"); n != 1000 {
+		t.Errorf("flushed %d lines", n)
+	}
+	if !strings.Contains(b.String(), "top-sub: sub 499") {
+		t.Errorf("no sub-logger line")
+	}
+
+	// a sub-logger's close flushes and leaves the output to its parent
+	sub.Info("last")
+	if err := sub.Close(); err != nil || !strings.HasSuffix(b.String(), "last\n") {
+		t.Errorf("sub close: %v", err)
+	}
+	l.Info("after sub")
+	l.Close()
+	if !strings.HasSuffix(b.String(), "after sub\n") || b.closed != 0 {
+		t.Errorf("close: %d closes: %q", b.closed, b.String())
+	}
+
+	// closed: messages are dropped, flushes return
+	l.Info("dropped")
+	l.Backtrace(1)
+	l.Flush()
+	sub.Flush()
+	if strings.Contains(b.String(), "dropped") {
+		t.Errorf("logged after close")
+	}
+}
+
+func TestClose(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "log")
+	l, err := NewFilelog(fn, LOG_INFO, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		l.Info("line %d", i)
+	}
+
+	// every close returns once everything is written
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Close(); err != nil {
+				t.Errorf("close: %v", err)
+			}
+			b, _ := os.ReadFile(fn)
+			if n := strings.Count(string(b), "\n"); n != 1000 {
+				t.Errorf("closed with %d lines", n)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fd := l.out.(*os.File)
+	if _, err := fd.Write([]byte("x")); err == nil {
+		t.Errorf("file left open")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var b closeBuf
+	l, _ := New(&b, LOG_DEBUG, "top", Lshortfile)
+	l.SetFormat(FormatJSON)
+	sub := l.New("sub", LOG_NONE).With("listener", "l1", "n", 3, "err", errors.New("x \"y\""), "odd")
+
+	l.Info("hello\n")
+	sub.Debug("a %s", "b")
+	sub.With("more", true).Error("bad")
+	sub.StdLogger().Print("std")
+	l.Backtrace(2)
+	l.Close()
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("%d lines: %q", len(lines), b.String())
+	}
+	var v []map[string]interface{}
+	for _, s := range lines {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if _, ok := m["time"].(string); !ok {
+			t.Errorf("no time: %s", s)
+		}
+		v = append(v, m)
+	}
+
+	if m := v[0]; m["level"] != "INFO" || m["prefix"] != "top" || m["msg"] != "hello" || m["caller"] != nil {
+		t.Errorf("info: %v", m)
+	}
+	f, _ := v[1]["fields"].(map[string]interface{})
+	if m := v[1]; m["level"] != "DEBUG" || m["prefix"] != "top-sub" || m["msg"] != "a b" ||
+		!strings.HasPrefix(m["caller"].(string), "logger_test.go:") {
+		t.Errorf("debug: %v", m)
+	}
+	if f["listener"] != "l1" || f["n"] != 3.0 || f["err"] != `x "y"` || f["odd"] != "MISSING" {
+		t.Errorf("fields: %v", f)
+	}
+	if f, _ := v[2]["fields"].(map[string]interface{}); len(f) != 5 || f["more"] != true {
+		t.Errorf("more fields: %v", v[2])
+	}
+	if !strings.HasSuffix(v[3]["msg"].(string), "std") {
+		t.Errorf("std: %v", v[3])
+	}
+	f, _ = v[4]["fields"].(map[string]interface{})
+	if st, _ := f["stack"].([]interface{}); len(st) == 0 || v[4]["msg"] != "Backtrace" || v[4]["level"] != nil {
+		t.Errorf("backtrace: %v", v[4])
+	}
+
+	// fields in text
+	var tb closeBuf
+	l, _ = New(&tb, LOG_DEBUG, "", 0)
+	l.With("user", "a b", "n", 1).Info("hi")
+	l.Close()
+	if !strings.HasSuffix(tb.String(), `hi user="a b" n=1`+"\n") {
+		t.Errorf("text fields: %q", tb.String())
+	}
+	if f, ok := ToFormat("Json"); !ok || f != FormatJSON {
+		t.Errorf("ToFormat: %v %v", f, ok)
+	}
+	if _, ok := ToFormat("xml"); ok {
+		t.Errorf("ToFormat xml")
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	var b closeBuf
+	l, _ := New(&b, LOG_DEBUG, "goproxy", Lshortfile)
+	l.SetFormat(FormatLogfmt)
+	l.Info("plain")
+	l.With("user", "bob", "err", errors.New(`no "way"`)).Error("denied %s", "a=b")
+	l.Backtrace(2)
+	l.Close()
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines: %q", len(lines), b.String())
+	}
+	for i, s := range lines {
+		if !strings.HasPrefix(s, "time=") || strings.Contains(s, "<") {
+			t.Errorf("line %d: %s", i, s)
+		}
+	}
+	if !strings.HasSuffix(lines[0], " level=INFO prefix=goproxy msg=plain") {
+		t.Errorf("info: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], " level=ERROR prefix=goproxy caller=logger_test.go:") ||
+		!strings.HasSuffix(lines[1], ` msg="denied a=b" user=bob err="no \"way\""`) {
+		t.Errorf("error: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], ` msg=Backtrace stack="`) || strings.Contains(lines[2], "level=") {
+		t.Errorf("backtrace: %s", lines[2])
+	}
+	if f, ok := ToFormat("logfmt"); !ok || f != FormatLogfmt {
+		t.Errorf("ToFormat: %v %v", f, ok)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,30 @@
+// syslog_unix.go -- syslog loggers where there is a syslog
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+)
+
+// Open a new syslog logger.
+func NewSyslog(prio Priority, prefix string, flag int) (*Logger, error) {
+	flag &= ^(lSyslog | lPrefix | lClose)
+
+	wr, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, "")
+	if err != nil {
+		s := fmt.Sprintf("Can't open SYSLOG connection: %s", err)
+		return nil, errors.New(s)
+	}
+
+	return newLogger(&Logger{out: wr, prio: prio, prefix: prefix, flag: flag | lSyslog})
+}
@@ -0,0 +1,20 @@
+// syslog_windows.go -- no syslog on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build windows
+
+package logger
+
+import (
+	"errors"
+)
+
+// There is no syslog to log to; log to a file instead.
+func NewSyslog(prio Priority, prefix string, flag int) (*Logger, error) {
+	return nil, errors.New("Can't open SYSLOG connection: no syslog on windows")
+}
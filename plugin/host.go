@@ -0,0 +1,363 @@
+// host.go -- the goproxy side of plugins: start them and call them
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// default bound of the handshake and of a call without a deadline
+	TIMEOUT = 5 * time.Second
+
+	// least time between two starts of a plugin that exits
+	RESTART = time.Second
+
+	// how long Close waits for a plugin to exit before it kills it
+	CLOSE_WAIT = 2 * time.Second
+
+	// longest line of stderr that's logged as one
+	MAX_LOG_LINE = 4096
+)
+
+// The errors of a Client
+var (
+	ErrTimeout   = errors.New("plugin: call timed out")
+	ErrNotPlugin = errors.New("plugin: no handshake")
+	ErrExited    = errors.New("plugin: exited")
+	ErrClosed    = errors.New("plugin: closed")
+	ErrNoService = errors.New("plugin: service not offered")
+)
+
+// How to run a plugin
+type Config struct {
+	Cmd  string
+	Args []string
+
+	// added to goproxy's environment
+	Env []string
+
+	// bound of the handshake and of calls without a deadline; TIMEOUT
+	// if zero
+	Timeout time.Duration
+
+	// called with each line the plugin writes to stderr; nil sends them
+	// to goproxy's stderr
+	Log func(string)
+}
+
+// A running plugin. Its methods may be called concurrently.
+type Client struct {
+	cfg Config
+
+	mu      sync.Mutex
+	p       *proc
+	svc     map[string]bool
+	started time.Time
+	closed  bool
+}
+
+// A process of a plugin
+type proc struct {
+	cmd  *exec.Cmd
+	rpc  *rpc.Client
+	done chan struct{}
+	err  error // of the exit; set when done is closed
+}
+
+// Start the plugin of 'cfg' and shake hands with it
+func Start(cfg *Config) (*Client, error) {
+	c := &Client{cfg: *cfg}
+	if c.cfg.Timeout <= 0 {
+		c.cfg.Timeout = TIMEOUT
+	}
+
+	p, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	c.p = p
+	return c, nil
+}
+
+// Return true if the plugin offers 'svc' (one of the SVC_...)
+func (c *Client) Has(svc string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.svc[svc]
+}
+
+// Check a user name and password
+func (c *Client) Authenticate(ctx context.Context, a *AuthArgs) (*AuthReply, error) {
+	r := &AuthReply{}
+	if err := c.call(ctx, SVC_AUTH, "Authenticate", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Check a bearer token
+func (c *Client) AuthenticateToken(ctx context.Context, a *TokenArgs) (*AuthReply, error) {
+	r := &AuthReply{}
+	if err := c.call(ctx, SVC_TOKEN, "AuthenticateToken", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Return the route of a connection
+func (c *Client) Route(ctx context.Context, a *RouteArgs) (*RouteReply, error) {
+	r := &RouteReply{}
+	if err := c.call(ctx, SVC_ROUTE, "Route", a, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Stop the plugin: close its stdin and kill it if it doesn't exit
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	p := c.p
+	c.mu.Unlock()
+
+	p.stop()
+	return nil
+}
+
+func (c *Client) call(ctx context.Context, svc, method string, args, reply interface{}) error {
+	if !c.Has(svc) {
+		return ErrNoService
+	}
+
+	p, err := c.get()
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+	return p.call(ctx, method, args, reply)
+}
+
+// Return the running process; start it again if it exited
+func (c *Client) get() (*proc, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if !c.p.exited() {
+		return c.p, nil
+	}
+	if time.Since(c.started) < RESTART {
+		return nil, fmt.Errorf("%w: %v", ErrExited, c.p.err)
+	}
+
+	p, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	c.p = p
+	return p, nil
+}
+
+// Start a process of the plugin and shake hands with it
+func (c *Client) start() (*proc, error) {
+	c.started = time.Now()
+
+	cmd := exec.Command(c.cfg.Cmd, c.cfg.Args...)
+	cmd.Env = append(os.Environ(), c.cfg.Env...)
+	cmd.Env = append(cmd.Env, MAGIC_ENV+"="+MAGIC_VALUE)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = CLOSE_WAIT
+	var ll *lineLog
+	if c.cfg.Log != nil {
+		ll = &lineLog{log: c.cfg.Log}
+		cmd.Stderr = ll
+	}
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	cmd.Stdin = inR
+	cmd.Stdout = outW
+
+	err = cmd.Start()
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, fmt.Errorf("plugin %s: %w", c.cfg.Cmd, err)
+	}
+
+	p := &proc{
+		cmd:  cmd,
+		rpc:  jsonrpc.NewClient(&pipes{outR, inW}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		if ll != nil {
+			ll.flush()
+		}
+		close(p.done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+
+	var hr HandshakeReply
+	err = p.call(ctx, "Handshake", &HandshakeArgs{Version: VERSION}, &hr)
+	if err == nil && hr.Version != VERSION {
+		err = fmt.Errorf("protocol version %d, want %d", hr.Version, VERSION)
+	}
+	if err != nil {
+		p.stop()
+		var se rpc.ServerError
+		if errors.As(err, &se) {
+			return nil, fmt.Errorf("plugin %s: %s", c.cfg.Cmd, err)
+		}
+		return nil, fmt.Errorf("%w: %s: %v", ErrNotPlugin, c.cfg.Cmd, err)
+	}
+
+	c.svc = make(map[string]bool)
+	for _, s := range hr.Services {
+		c.svc[s] = true
+	}
+	return p, nil
+}
+
+// Call 'method' of the process; bounded by 'ctx'
+func (p *proc) call(ctx context.Context, method string, args, reply interface{}) error {
+	call := p.rpc.Go(SERVICE+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return nil
+		}
+		var se rpc.ServerError
+		if errors.As(call.Error, &se) {
+			return call.Error
+		}
+		if p.exited() {
+			return fmt.Errorf("%w: %v", ErrExited, p.err)
+		}
+		return fmt.Errorf("plugin: %s: %w", method, call.Error)
+
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// Return true if the process exited (and was reaped)
+func (p *proc) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the pipes; kill the process if it doesn't exit
+func (p *proc) stop() {
+	p.rpc.Close()
+	select {
+	case <-p.done:
+		return
+	case <-time.After(CLOSE_WAIT):
+	}
+	p.cmd.Process.Kill()
+	<-p.done
+}
+
+// goproxy's end of the pipes: the plugin's stdout and stdin
+type pipes struct {
+	r *os.File
+	w *os.File
+}
+
+func (f *pipes) Read(b []byte) (int, error)  { return f.r.Read(b) }
+func (f *pipes) Write(b []byte) (int, error) { return f.w.Write(b) }
+
+func (f *pipes) Close() error {
+	f.w.Close()
+	return f.r.Close()
+}
+
+// Calls log with each line written to it; longer lines are cut into
+// MAX_LOG_LINE pieces
+type lineLog struct {
+	log func(string)
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (l *lineLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 && len(l.buf) < MAX_LOG_LINE {
+			break
+		}
+		if i < 0 || i > MAX_LOG_LINE {
+			i = MAX_LOG_LINE
+		}
+		l.log(string(bytes.TrimRight(l.buf[:i], "\r")))
+		if i < len(l.buf) && l.buf[i] == '\n' {
+			i++
+		}
+		l.buf = l.buf[i:]
+	}
+	return len(b), nil
+}
+
+// Log what's left of the last line
+func (l *lineLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.log(string(l.buf))
+		l.buf = nil
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
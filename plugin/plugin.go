@@ -0,0 +1,254 @@
+// plugin.go -- the plugin side of goproxy's plugins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package plugin runs authenticators and routers for goproxy as
+// programs of their own, built and released apart from it. goproxy
+// starts the program and talks to it over the program's stdin and
+// stdout; what it writes to stderr goes to goproxy's log.
+//
+// A plugin implements one or more of Authenticator, TokenAuthenticator
+// and Router and hands itself to Serve:
+//
+//	type sso struct{}
+//
+//	func (sso) Authenticate(a *plugin.AuthArgs) (*plugin.AuthReply, error) {
+//		...
+//	}
+//
+//	func main() {
+//		if err := plugin.Serve(sso{}); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+//
+// The methods are called concurrently. An error is a failed call, not
+// a refusal: goproxy refuses the client (or, for routers that fail
+// open, uses the listener's own route). A plugin that exits is started
+// again on the next call.
+//
+// The wire protocol is JSON-RPC 1.0 (net/rpc/jsonrpc) on stdio with the
+// service "Plugin". goproxy first calls Plugin.Handshake with its
+// VERSION; the plugin answers with its own and the services it offers
+// ("auth", "token", "route"). Then Plugin.Authenticate,
+// Plugin.AuthenticateToken and Plugin.Route take and return the Args and
+// Reply types below. Plugins in other languages speak the same. goproxy
+// sets MAGIC_ENV to MAGIC_VALUE in a plugin's environment; a program
+// started by hand says so rather than waiting for JSON on its terminal.
+//
+// Nothing but the protocol may be written to stdout.
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+)
+
+const (
+	// version of the protocol
+	VERSION = 1
+
+	// goproxy sets MAGIC_ENV=MAGIC_VALUE for its plugins
+	MAGIC_ENV   = "GOPROXY_PLUGIN"
+	MAGIC_VALUE = "b7f3c2e9a1d54e08"
+
+	// name of the RPC service
+	SERVICE = "Plugin"
+)
+
+// The services a plugin offers
+const (
+	SVC_AUTH  = "auth"
+	SVC_TOKEN = "token"
+	SVC_ROUTE = "route"
+)
+
+// The routes a Router picks (RouteReply.Action)
+const (
+	ROUTE_DEFAULT   = ""          // the listener's own route
+	ROUTE_DENY      = "deny"      // refuse the connection
+	ROUTE_DIRECT    = "direct"    // connect directly, not through the parent
+	ROUTE_WIREGUARD = "wireguard" // through the WireGuard tunnel Name
+	ROUTE_JUMP      = "jump"      // through the jump host Name
+)
+
+// ErrNoHost is returned by Serve for a program that goproxy didn't start
+var ErrNoHost = errors.New("plugin: not started by goproxy")
+
+// goproxy's first call
+type HandshakeArgs struct {
+	Version int
+}
+
+// The plugin's answer: its version and one or more of the SVC_... above
+type HandshakeReply struct {
+	Version  int
+	Services []string
+}
+
+// A user name and password to check
+type AuthArgs struct {
+	User     string
+	Password string
+	Client   string // IP address; "" if not known
+	Listener string
+}
+
+// A bearer token to check
+type TokenArgs struct {
+	Token    string
+	Client   string
+	Listener string
+}
+
+// What the plugin says about credentials
+type AuthReply struct {
+	OK bool
+
+	// the user a token was issued to; unused for passwords
+	User string
+
+	// why the credentials are refused; logged
+	Reason string
+}
+
+// A connection to route
+type RouteArgs struct {
+	User     string // "" if the listener has no auth
+	Client   string
+	Host     string // name or IP address
+	Port     int
+	Listener string
+}
+
+// The route of a connection
+type RouteReply struct {
+	Action string // one of the ROUTE_... above
+
+	// the tunnel or jump host; for ROUTE_DENY, the rule named in the
+	// logs and denials
+	Name string
+}
+
+// Checks user names and passwords
+type Authenticator interface {
+	Authenticate(a *AuthArgs) (*AuthReply, error)
+}
+
+// Checks bearer tokens
+type TokenAuthenticator interface {
+	AuthenticateToken(a *TokenArgs) (*AuthReply, error)
+}
+
+// Picks the routes of connections
+type Router interface {
+	Route(a *RouteArgs) (*RouteReply, error)
+}
+
+// Serve the Authenticator, TokenAuthenticator and Router that 'impl'
+// implements to goproxy on stdio; return when goproxy closes stdin.
+func Serve(impl interface{}) error {
+	if os.Getenv(MAGIC_ENV) != MAGIC_VALUE {
+		return ErrNoHost
+	}
+	return ServeConn(impl, stdio{})
+}
+
+// Serve 'impl' on 'c' rather than stdio; for tests and other transports
+func ServeConn(impl interface{}, c io.ReadWriteCloser) error {
+	s := &server{impl: impl}
+	if _, ok := impl.(Authenticator); ok {
+		s.svc = append(s.svc, SVC_AUTH)
+	}
+	if _, ok := impl.(TokenAuthenticator); ok {
+		s.svc = append(s.svc, SVC_TOKEN)
+	}
+	if _, ok := impl.(Router); ok {
+		s.svc = append(s.svc, SVC_ROUTE)
+	}
+	if len(s.svc) == 0 {
+		return fmt.Errorf("plugin: %T implements no services", impl)
+	}
+
+	rs := rpc.NewServer()
+	if err := rs.RegisterName(SERVICE, s); err != nil {
+		return err
+	}
+	rs.ServeCodec(jsonrpc.NewServerCodec(c))
+	return nil
+}
+
+// The RPC methods; net/rpc wants them in this form
+type server struct {
+	impl interface{}
+	svc  []string
+}
+
+func (s *server) Handshake(a *HandshakeArgs, r *HandshakeReply) error {
+	if a.Version != VERSION {
+		return fmt.Errorf("protocol version %d; this plugin speaks %d", a.Version, VERSION)
+	}
+	r.Version = VERSION
+	r.Services = s.svc
+	return nil
+}
+
+func (s *server) Authenticate(a *AuthArgs, r *AuthReply) error {
+	p, ok := s.impl.(Authenticator)
+	if !ok {
+		return errors.New("no auth service")
+	}
+	v, err := p.Authenticate(a)
+	return reply(r, v, err)
+}
+
+func (s *server) AuthenticateToken(a *TokenArgs, r *AuthReply) error {
+	p, ok := s.impl.(TokenAuthenticator)
+	if !ok {
+		return errors.New("no token service")
+	}
+	v, err := p.AuthenticateToken(a)
+	return reply(r, v, err)
+}
+
+func (s *server) Route(a *RouteArgs, r *RouteReply) error {
+	p, ok := s.impl.(Router)
+	if !ok {
+		return errors.New("no route service")
+	}
+	v, err := p.Route(a)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		*r = *v
+	}
+	return nil
+}
+
+func reply(r *AuthReply, v *AuthReply, err error) error {
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		*r = *v
+	}
+	return nil
+}
+
+// The plugin's end of the pipes
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdio) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (stdio) Close() error                { return os.Stdout.Close() }
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,244 @@
+// plugin_test.go -- tests for starting and calling plugins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The test binary is its own plugin when TEST_PLUGIN is set
+const TEST_ENV = "TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(TEST_ENV) {
+	case "":
+		os.Exit(m.Run())
+	case "serve":
+		if err := Serve(testPlugin{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "route":
+		Serve(testRouter{})
+	case "garbage":
+		fmt.Println("hello, world")
+	case "hang":
+		io.Copy(ioutil.Discard, os.Stdin)
+	}
+	os.Exit(0)
+}
+
+type testPlugin struct{}
+
+func (testPlugin) Authenticate(a *AuthArgs) (*AuthReply, error) {
+	fmt.Fprintf(os.Stderr, "checking %s from %s\n", a.User, a.Client)
+	switch a.User {
+	case "slow":
+		time.Sleep(time.Second)
+	case "crash":
+		os.Exit(3)
+	case "fail":
+		return nil, errors.New("directory down")
+	}
+	if a.User == "alice" && a.Password == "wonder" {
+		return &AuthReply{OK: true}, nil
+	}
+	return &AuthReply{Reason: "no such user at " + a.Listener}, nil
+}
+
+func (testPlugin) AuthenticateToken(a *TokenArgs) (*AuthReply, error) {
+	if a.Token == "t1" {
+		return &AuthReply{OK: true, User: "bob"}, nil
+	}
+	return &AuthReply{}, nil
+}
+
+type testRouter struct{}
+
+func (testRouter) Route(a *RouteArgs) (*RouteReply, error) {
+	switch a.Host {
+	case "tunnel.example":
+		return &RouteReply{Action: ROUTE_WIREGUARD, Name: "wg0"}, nil
+	case "deny.example":
+		return &RouteReply{Action: ROUTE_DENY, Name: "no-" + a.User}, nil
+	}
+	return nil, nil
+}
+
+func startTest(t *testing.T, mode string, log func(string)) (*Client, error) {
+	c, err := Start(&Config{
+		Cmd:     os.Args[0],
+		Env:     []string{TEST_ENV + "=" + mode},
+		Timeout: 500 * time.Millisecond,
+		Log:     log,
+	})
+	if err == nil {
+		t.Cleanup(func() { c.Close() })
+	}
+	return c, err
+}
+
+func TestPlugin(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	c, err := startTest(t, "serve", func(s string) {
+		mu.Lock()
+		logged = append(logged, s)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Has(SVC_AUTH) || !c.Has(SVC_TOKEN) || c.Has(SVC_ROUTE) {
+		t.Errorf("services: %v", c.svc)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := c.Authenticate(ctx, &AuthArgs{User: "alice", Password: "wonder", Client: "192.0.2.1"})
+			if err != nil || !r.OK {
+				t.Errorf("alice: %+v %v", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	r, err := c.Authenticate(ctx, &AuthArgs{User: "alice", Password: "x", Listener: "l1"})
+	if err != nil || r.OK || r.Reason != "no such user at l1" {
+		t.Errorf("bad password: %+v %v", r, err)
+	}
+	var se rpc.ServerError
+	if _, err := c.Authenticate(ctx, &AuthArgs{User: "fail"}); !errors.As(err, &se) ||
+		!strings.Contains(err.Error(), "directory down") {
+		t.Errorf("fail: %v", err)
+	}
+	if r, err := c.AuthenticateToken(ctx, &TokenArgs{Token: "t1"}); err != nil || !r.OK || r.User != "bob" {
+		t.Errorf("token: %+v %v", r, err)
+	}
+	if _, err := c.Route(ctx, &RouteArgs{Host: "x"}); err != ErrNoService {
+		t.Errorf("route: %v", err)
+	}
+
+	// a call is bounded by its context, and by the timeout without one
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	if _, err := c.Authenticate(tctx, &AuthArgs{User: "slow"}); err != ErrTimeout || time.Since(t0) > 400*time.Millisecond {
+		t.Errorf("timeout: %v after %s", err, time.Since(t0))
+	}
+	if _, err := c.Authenticate(ctx, &AuthArgs{User: "slow"}); err != ErrTimeout {
+		t.Errorf("default timeout: %v", err)
+	}
+
+	// a plugin that exits is started again, but not at once
+	crash := func() {
+		if _, err := c.Authenticate(ctx, &AuthArgs{User: "crash"}); err == nil {
+			t.Errorf("crash: no error")
+		}
+		<-c.p.done
+	}
+	crash()
+	time.Sleep(RESTART)
+	if r, err := c.Authenticate(ctx, &AuthArgs{User: "alice", Password: "wonder"}); err != nil || !r.OK {
+		t.Errorf("restarted: %+v %v", r, err)
+	}
+	crash()
+	if _, err := c.Authenticate(ctx, &AuthArgs{User: "alice"}); !errors.Is(err, ErrExited) {
+		t.Errorf("after crash: %v", err)
+	}
+
+	mu.Lock()
+	if len(logged) == 0 || logged[0] != "checking alice from 192.0.2.1" {
+		t.Errorf("stderr: %q", logged)
+	}
+	mu.Unlock()
+
+	p := c.p
+	c.Close()
+	if !p.exited() {
+		t.Errorf("running after close")
+	}
+	if _, err := c.Authenticate(ctx, &AuthArgs{User: "alice"}); err != ErrClosed {
+		t.Errorf("closed: %v", err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	c, err := startTest(t, "route", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Has(SVC_AUTH) || !c.Has(SVC_ROUTE) {
+		t.Errorf("services: %v", c.svc)
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		host, action, name string
+	}{
+		{"tunnel.example", ROUTE_WIREGUARD, "wg0"},
+		{"deny.example", ROUTE_DENY, "no-carol"},
+		{"other.example", ROUTE_DEFAULT, ""},
+	} {
+		r, err := c.Route(ctx, &RouteArgs{User: "carol", Host: tc.host, Port: 443})
+		if err != nil || r.Action != tc.action || r.Name != tc.name {
+			t.Errorf("%s: %+v %v", tc.host, r, err)
+		}
+	}
+	if _, err := c.Authenticate(ctx, &AuthArgs{}); err != ErrNoService {
+		t.Errorf("auth: %v", err)
+	}
+}
+
+func TestNotPlugin(t *testing.T) {
+	for _, m := range []string{"garbage", "hang"} {
+		t0 := time.Now()
+		if _, err := startTest(t, m, nil); !errors.Is(err, ErrNotPlugin) || time.Since(t0) > CLOSE_WAIT {
+			t.Errorf("%s: %v after %s", m, err, time.Since(t0))
+		}
+	}
+	if _, err := Start(&Config{Cmd: "/nonexistent/plugin"}); err == nil {
+		t.Errorf("no program: no error")
+	}
+
+	if err := Serve(testPlugin{}); err != ErrNoHost {
+		t.Errorf("serve by hand: %v", err)
+	}
+	if err := ServeConn(struct{}{}, nil); err == nil {
+		t.Errorf("no services: no error")
+	}
+}
+
+func TestLineLog(t *testing.T) {
+	var v []string
+	l := &lineLog{log: func(s string) { v = append(v, s) }}
+	io.WriteString(l, "one\r\ntw")
+	io.WriteString(l, "o\n"+strings.Repeat("x", MAX_LOG_LINE+10))
+	io.WriteString(l, "\nend")
+	l.flush()
+	if len(v) != 5 || v[0] != "one" || v[1] != "two" || len(v[2]) != MAX_LOG_LINE || v[3] != "xxxxxxxxxx" || v[4] != "end" {
+		t.Errorf("lines: %d %q", len(v), v)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,575 @@
+// acme.go -- certificates of TLS listeners from an ACME CA
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// A listener with "acme" in its TLS gets its certificate from an ACME
+// CA (Let's Encrypt by default) and renews it before it expires. The
+// CA checks that we hold the names with one of three challenges:
+//
+//   - tls-alpn-01: answered in the TLS handshakes of the listener; the
+//     CA connects to port 443 of each name
+//   - http-01: answered by a plain HTTP server on port 80 (tried after
+//     tls-alpn-01)
+//   - dns-01: a TXT record set through a DNS hook; the only one that
+//     works for wildcard names and listeners the CA can't reach
+//
+// The first two are done by autocert when a client first asks for a
+// name; dns-01 certificates are obtained when the listener starts.
+
+const (
+	ACME_DIRECTORY = autocert.DefaultACMEDirectory
+
+	// Days before it expires that a certificate is renewed
+	ACME_RENEW = 30
+
+	// Time an order (all its challenges) may take
+	ACME_TIMEOUT = 10 * time.Minute
+
+	// Wait after a failed dns-01 order
+	ACME_RETRY = time.Hour
+
+	// Default seconds a new TXT record is given to reach the
+	// authoritative servers
+	ACME_DNS_WAIT = 30
+)
+
+var errNoACMECert = errors.New("acme: no certificate yet")
+
+// The certificates of a listener from an ACME CA
+type acmeCerts struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	issued uint64
+	failed uint64
+
+	domains []string
+	log     *L.Logger
+
+	mgr  *autocert.Manager // tls-alpn-01 and http-01
+	http string            // address of the http-01 server; "" if none
+
+	// dns-01
+	dns    *dnsChallenger
+	cert   atomic.Pointer[tls.Certificate]
+	expiry atomic.Int64 // unix time of cert
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Return the certificates of 'ac' or nil if it has none
+func newACMECerts(ac *ACMEConf, log *L.Logger) (*acmeCerts, error) {
+	if len(ac.Domains) == 0 {
+		if len(ac.Cache) > 0 || len(ac.Email) > 0 || len(ac.Challenge) > 0 {
+			return nil, fmt.Errorf("acme: no domains")
+		}
+		return nil, nil
+	}
+	if len(ac.Cache) == 0 {
+		return nil, fmt.Errorf("acme: no cache directory")
+	}
+
+	a := &acmeCerts{
+		domains: ac.Domains,
+		log:     log,
+		stop:    make(chan struct{}),
+	}
+
+	dir := ac.Directory
+	if len(dir) == 0 {
+		dir = ACME_DIRECTORY
+	}
+	if u, err := url.Parse(dir); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("acme: invalid directory %q", dir)
+	}
+
+	var eab *acme.ExternalAccountBinding
+	if len(ac.EABKid) > 0 || len(ac.EABKey) > 0 {
+		k, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(ac.EABKey, "="))
+		if err != nil || len(ac.EABKid) == 0 || len(k) == 0 {
+			return nil, fmt.Errorf("acme: eab needs a kid and a base64url key")
+		}
+		eab = &acme.ExternalAccountBinding{KID: ac.EABKid, Key: k}
+	}
+
+	cache := autocert.DirCache(ac.Cache)
+	switch strings.ToLower(ac.Challenge) {
+	case "", "tls-alpn-01", "http-01":
+		for _, d := range ac.Domains {
+			if strings.HasPrefix(d, "*.") {
+				return nil, fmt.Errorf("acme: wildcard %s needs dns-01", d)
+			}
+		}
+		a.mgr = &autocert.Manager{
+			Prompt:                 autocert.AcceptTOS,
+			Cache:                  cache,
+			HostPolicy:             autocert.HostWhitelist(ac.Domains...),
+			RenewBefore:            ACME_RENEW * 24 * time.Hour,
+			Client:                 &acme.Client{DirectoryURL: dir, UserAgent: "goproxy"},
+			Email:                  ac.Email,
+			ExternalAccountBinding: eab,
+		}
+		if strings.ToLower(ac.Challenge) == "http-01" {
+			a.http = ac.HTTP
+			if len(a.http) == 0 {
+				a.http = ":80"
+			}
+			if err := acmeHTTP.add(a.http, a); err != nil {
+				return nil, err
+			}
+		} else if len(ac.HTTP) > 0 {
+			return nil, fmt.Errorf("acme: 'http' is for http-01")
+		}
+
+	case "dns-01":
+		if len(ac.DNSHook) == 0 {
+			return nil, fmt.Errorf("acme: dns-01 needs a dnshook")
+		}
+		u, err := url.Parse(ac.DNSHook)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("acme: invalid dnshook %q", ac.DNSHook)
+		}
+		if ac.DNSWait < 0 {
+			return nil, fmt.Errorf("acme: negative dnswait %d", ac.DNSWait)
+		}
+		wait := time.Duration(ac.DNSWait) * time.Second
+		if ac.DNSWait == 0 {
+			wait = ACME_DNS_WAIT * time.Second
+		}
+		a.dns = &dnsChallenger{
+			dir:   dir,
+			email: ac.Email,
+			eab:   eab,
+			cache: cache,
+			hook:  strings.TrimSuffix(ac.DNSHook, "/"),
+			wait:  wait,
+			http:  &http.Client{Timeout: 30 * time.Second},
+		}
+		a.load()
+		a.wg.Add(1)
+		go a.renew()
+		addCollector(a)
+
+	default:
+		return nil, fmt.Errorf("acme: unknown challenge %q", ac.Challenge)
+	}
+	return a, nil
+}
+
+// Use the certificates in 'conf'
+func (a *acmeCerts) use(conf *tls.Config) {
+	conf.Certificates = nil
+	if a.dns != nil {
+		conf.GetCertificate = a.getDNSCert
+		return
+	}
+
+	// the handshakes of the CA's tls-alpn-01 checks speak acme-tls/1
+	// and nothing else; others must not see it in the config
+	conf.GetCertificate = a.mgr.GetCertificate
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, p := range hello.SupportedProtos {
+			if p == acme.ALPNProto {
+				c := conf.Clone()
+				c.NextProtos = []string{acme.ALPNProto}
+				c.ClientAuth = tls.NoClientCert
+				return c, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Stop renewing; the listener is done
+func (a *acmeCerts) close() {
+	if a.http != "" {
+		acmeHTTP.del(a.http, a)
+	}
+	close(a.stop)
+	a.wg.Wait()
+}
+
+func (a *acmeCerts) getDNSCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := a.cert.Load(); c != nil {
+		return c, nil
+	}
+	return nil, errNoACMECert
+}
+
+// Use the dns-01 certificate in the cache, if there is one
+func (a *acmeCerts) load() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b, err := a.dns.cache.Get(ctx, a.cacheKey())
+	if err != nil {
+		return
+	}
+	c, err := parseCertPEM(b)
+	if err != nil {
+		a.log.Warn("acme: cached certificate of %s: %s", a.domains[0], err)
+		return
+	}
+	a.set(c)
+}
+
+func (a *acmeCerts) set(c *tls.Certificate) {
+	a.cert.Store(c)
+	a.expiry.Store(c.Leaf.NotAfter.Unix())
+}
+
+// The cache entry of the dns-01 certificate
+func (a *acmeCerts) cacheKey() string {
+	return "dns01+" + strings.ReplaceAll(strings.Join(a.domains, ","), "*", "_")
+}
+
+// Obtain the dns-01 certificate when it is missing or due, until stopped
+func (a *acmeCerts) renew() {
+	defer a.wg.Done()
+	for {
+		wait := time.Until(time.Unix(a.expiry.Load(), 0).Add(-ACME_RENEW * 24 * time.Hour))
+		if wait <= 0 {
+			if err := a.obtain(); err != nil {
+				atomic.AddUint64(&a.failed, 1)
+				a.log.Warn("acme: %s: %s; retrying in %s", strings.Join(a.domains, ","), err,
+					ACME_RETRY)
+				wait = ACME_RETRY
+			} else {
+				continue
+			}
+		}
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Obtain a new dns-01 certificate and keep it in the cache
+func (a *acmeCerts) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ACME_TIMEOUT)
+	defer cancel()
+	go func() {
+		select {
+		case <-a.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := a.dns.order(ctx, a.domains, key)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	kb, _ := x509.MarshalECPrivateKey(key)
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	c, err := parseCertPEM(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := a.dns.cache.Put(ctx, a.cacheKey(), buf.Bytes()); err != nil {
+		a.log.Warn("acme: can't cache the certificate of %s: %s", a.domains[0], err)
+	}
+	a.set(c)
+	atomic.AddUint64(&a.issued, 1)
+	a.log.Info("acme: new certificate for %s, valid until %s", strings.Join(a.domains, ","),
+		c.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (a *acmeCerts) metrics() []metric {
+	lbl := fmt.Sprintf("domain=%q", a.domains[0])
+	return []metric{
+		{"goproxy_acme_issued_total", "counter", "Certificates obtained from the ACME CA", lbl,
+			float64(atomic.LoadUint64(&a.issued))},
+		{"goproxy_acme_failures_total", "counter", "ACME orders that failed", lbl,
+			float64(atomic.LoadUint64(&a.failed))},
+		{"goproxy_acme_expiry_seconds", "gauge", "Unix time the ACME certificate expires", lbl,
+			float64(a.expiry.Load())},
+	}
+}
+
+// Return the certificate of the PEM key and chain 'b'
+func parseCertPEM(b []byte) (*tls.Certificate, error) {
+	c, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if time.Now().After(c.Leaf.NotAfter) {
+		return nil, fmt.Errorf("expired on %s", c.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &c, nil
+}
+
+// Orders of dns-01 certificates. The TXT records are set through a hook:
+// a POST of {"fqdn", "value"} to <dnshook>/present and then <dnshook>/cleanup
+// (the "httpreq" convention of lego and acme-dns bridges).
+type dnsChallenger struct {
+	dir   string
+	email string
+	eab   *acme.ExternalAccountBinding
+	cache autocert.Cache
+	hook  string
+	wait  time.Duration
+	http  *http.Client
+
+	sync.Mutex
+	client *acme.Client // registered
+}
+
+// Return the client of the account, registered if it's new
+func (d *dnsChallenger) account(ctx context.Context) (*acme.Client, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	var key crypto.Signer
+	if b, err := d.cache.Get(ctx, "dns01+account.key"); err == nil {
+		if blk, _ := pem.Decode(b); blk != nil {
+			key, _ = x509.ParseECPrivateKey(blk.Bytes)
+		}
+	}
+	if key == nil {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		kb, _ := x509.MarshalECPrivateKey(k)
+		b := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+		if err := d.cache.Put(ctx, "dns01+account.key", b); err != nil {
+			return nil, err
+		}
+		key = k
+	}
+
+	c := &acme.Client{Key: key, DirectoryURL: d.dir, UserAgent: "goproxy"}
+	acct := &acme.Account{ExternalAccountBinding: d.eab}
+	if len(d.email) > 0 {
+		acct.Contact = []string{"mailto:" + d.email}
+	}
+	_, err := c.Register(ctx, acct, acme.AcceptTOS)
+	var ae *acme.Error
+	if err != nil && err != acme.ErrAccountAlreadyExists &&
+		!(errors.As(err, &ae) && ae.StatusCode == http.StatusConflict) {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	d.client = c
+	return c, nil
+}
+
+// Prove 'domains' with dns-01 and return the DER chain of a certificate
+// for them and 'key'
+func (d *dnsChallenger) order(ctx context.Context, domains []string, key crypto.Signer) ([][]byte, error) {
+	c, err := d.account(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o, err := c.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zu := range o.AuthzURLs {
+		z, err := c.GetAuthorization(ctx, zu)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, ch := range z.Challenges {
+			if ch.Type == "dns-01" {
+				chal = ch
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("%s: the CA offers no dns-01", z.Identifier.Value)
+		}
+		val, err := c.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.") + "."
+		if err := d.call(ctx, "present", fqdn, val); err != nil {
+			return nil, err
+		}
+		defer d.call(context.Background(), "cleanup", fqdn, val)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d.wait):
+		}
+		if _, err := c.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err := c.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, err
+		}
+	}
+
+	if o, err = c.WaitOrder(ctx, o.URI); err != nil {
+		return nil, err
+	}
+	req := &x509.CertificateRequest{DNSNames: domains}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, req, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := c.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	return der, err
+}
+
+// Ask the hook to 'action' ("present" or "cleanup") the TXT record
+// 'fqdn' of 'value'
+func (d *dnsChallenger) call(ctx context.Context, action, fqdn, value string) error {
+	b, _ := json.Marshal(map[string]string{"fqdn": fqdn, "value": value})
+	r, err := http.NewRequestWithContext(ctx, "POST", d.hook+"/"+action, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := d.http.Do(r)
+	if err != nil {
+		return fmt.Errorf("dnshook: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("dnshook: %s %s: %s", action, fqdn, res.Status)
+	}
+	return nil
+}
+
+// The plain HTTP servers answering http-01 challenges, by address;
+// listeners on the same address share one.
+var acmeHTTP = &acmeResponders{m: make(map[string]*acmeResponder)}
+
+type acmeResponders struct {
+	sync.Mutex
+	m map[string]*acmeResponder
+}
+
+type acmeResponder struct {
+	srv  *http.Server
+	ln   net.Listener
+	mgrs []*acmeCerts
+	h    map[*acmeCerts]http.Handler
+}
+
+// Answer the challenges of 'a' on 'addr'
+func (r *acmeResponders) add(addr string, a *acmeCerts) error {
+	r.Lock()
+	defer r.Unlock()
+
+	// autocert offers http-01 to the CA once it has a handler
+	h := a.mgr.HTTPHandler(http.NotFoundHandler())
+	if x, ok := r.m[addr]; ok {
+		x.mgrs = append(x.mgrs, a)
+		x.h[a] = h
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("acme: http-01: %s", err)
+	}
+	x := &acmeResponder{ln: ln, mgrs: []*acmeCerts{a}, h: map[*acmeCerts]http.Handler{a: h}}
+	x.srv = &http.Server{
+		Handler:           http.HandlerFunc(x.serve),
+		ReadHeaderTimeout: CLIENT_HANDSHAKE * time.Second,
+	}
+	r.m[addr] = x
+	go x.srv.Serve(ln)
+	return nil
+}
+
+// Stop answering for 'a'; the server stops with its last listener
+func (r *acmeResponders) del(addr string, a *acmeCerts) {
+	r.Lock()
+	defer r.Unlock()
+	x, ok := r.m[addr]
+	if !ok {
+		return
+	}
+	for i, v := range x.mgrs {
+		if v == a {
+			x.mgrs = append(x.mgrs[:i], x.mgrs[i+1:]...)
+			break
+		}
+	}
+	delete(x.h, a)
+	if len(x.mgrs) == 0 {
+		x.srv.Close()
+		delete(r.m, addr)
+	}
+}
+
+// Hand the request to the listener with the name in its Host
+func (x *acmeResponder) serve(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var h http.Handler = http.NotFoundHandler()
+	acmeHTTP.Lock()
+	for _, a := range x.mgrs {
+		for _, d := range a.domains {
+			if strings.EqualFold(d, host) {
+				h = x.h[a]
+			}
+		}
+	}
+	acmeHTTP.Unlock()
+	h.ServeHTTP(w, req)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,427 @@
+// acme_test.go -- tests for the ACME certificates
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/acme"
+)
+
+// A small ACME CA: one account, orders of one challenge type, and
+// certificates signed by a test CA. It checks each challenge the way a
+// CA would, through 'check'.
+type fakeACME struct {
+	ca   *testCA
+	srv  *httptest.Server
+	typ  string // the challenge it offers
+	hook *dnsHook
+	http string // address of the http-01 responder
+	tls  string // address of the tls-alpn-01 listener
+
+	sync.Mutex
+	key     *ecdsa.PublicKey // of the account
+	domains []string         // of the order
+	valid   map[string]bool  // domain -> its challenge is done
+	issued  int
+	csr     *x509.CertificateRequest
+	bad     []string
+}
+
+func startACME(t *testing.T, typ string) *fakeACME {
+	f := &fakeACME{ca: newTestCA(t), typ: typ, valid: map[string]bool{}}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	u := f.srv.URL
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("n%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{"newNonce": u + "/nonce",
+			"newAccount": u + "/acct", "newOrder": u + "/order", "revokeCert": u + "/revoke",
+			"keyChange": u + "/key"})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	hdr, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	f.Lock()
+	defer f.Unlock()
+	reply := func(code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+	order := func() map[string]interface{} {
+		o := map[string]interface{}{"status": "pending", "finalize": u + "/finalize"}
+		var ids, authz []interface{}
+		ready := true
+		for _, d := range f.domains {
+			ids = append(ids, map[string]string{"type": "dns", "value": d})
+			authz = append(authz, u+"/authz/"+d)
+			ready = ready && f.valid[d]
+		}
+		o["identifiers"], o["authorizations"] = ids, authz
+		if ready {
+			o["status"] = "ready"
+		}
+		if f.issued > 0 {
+			o["status"], o["certificate"] = "valid", u+"/cert"
+		}
+		return o
+	}
+
+	switch p := r.URL.Path; {
+	case p == "/acct":
+		var h struct {
+			JWK struct{ X, Y string }
+		}
+		json.Unmarshal(hdr, &h)
+		x, _ := base64.RawURLEncoding.DecodeString(h.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(h.JWK.Y)
+		f.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y)}
+		w.Header().Set("Location", u+"/acct/1")
+		reply(http.StatusCreated, map[string]string{"status": "valid"})
+
+	case p == "/order":
+		var o struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &o)
+		f.domains, f.issued = nil, 0
+		for _, id := range o.Identifiers {
+			f.domains = append(f.domains, id.Value)
+		}
+		w.Header().Set("Location", u+"/order/1")
+		reply(http.StatusCreated, order())
+
+	case p == "/order/1":
+		w.Header().Set("Location", u+"/order/1")
+		reply(http.StatusOK, order())
+
+	case strings.HasPrefix(p, "/authz/"):
+		d := strings.TrimPrefix(p, "/authz/")
+		st := "pending"
+		if f.valid[d] {
+			st = "valid"
+		}
+		reply(http.StatusOK, map[string]interface{}{"status": st,
+			"identifier": map[string]string{"type": "dns", "value": d},
+			"challenges": []interface{}{map[string]string{"type": f.typ, "status": st,
+				"url": u + "/chal/" + d, "token": acmeToken(d)}}})
+
+	case strings.HasPrefix(p, "/chal/"):
+		d := strings.TrimPrefix(p, "/chal/")
+		tok := acmeToken(d)
+		th, _ := acme.JWKThumbprint(f.key)
+		f.Unlock()
+		err := f.check(d, tok+"."+th)
+		f.Lock()
+		if err != nil {
+			f.bad = append(f.bad, fmt.Sprintf("%s: %s", d, err))
+			reply(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:unauthorized",
+				"detail": err.Error()})
+			return
+		}
+		f.valid[d] = true
+		reply(http.StatusOK, map[string]string{"type": f.typ, "status": "valid", "url": u + p})
+
+	case p == "/finalize":
+		var c struct{ CSR string }
+		json.Unmarshal(payload, &c)
+		der, _ := base64.RawURLEncoding.DecodeString(c.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			reply(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+			return
+		}
+		f.issued, f.csr = f.issued+1, csr
+		w.Header().Set("Location", u+"/order/1")
+		reply(http.StatusOK, order())
+
+	case p == "/cert":
+		n := f.ca.n + 1
+		f.ca.n = n
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(n),
+			DNSNames:     f.csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca.cert, f.csr.PublicKey, f.ca.key)
+		if err != nil {
+			f.bad = append(f.bad, err.Error())
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.ca.cert.Raw})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// The token of the challenge of 'domain'
+func acmeToken(domain string) string {
+	return "tok-" + strings.NewReplacer(".", "-", "*", "_").Replace(domain)
+}
+
+// Check the challenge of 'domain' with the key authorization 'ka'
+func (f *fakeACME) check(domain, ka string) error {
+	sum := sha256.Sum256([]byte(ka))
+	switch f.typ {
+	case "dns-01":
+		fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+		if v := f.hook.get(fqdn); v != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return fmt.Errorf("TXT %s is %q", fqdn, v)
+		}
+
+	case "http-01":
+		r, _ := http.NewRequest("GET", "http://"+f.http+"/.well-known/acme-challenge/"+
+			strings.SplitN(ka, ".", 2)[0], nil)
+		r.Host = domain
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != ka {
+			return fmt.Errorf("http-01: %d %q", res.StatusCode, b)
+		}
+
+	case "tls-alpn-01":
+		c, err := tls.Dial("tcp", f.tls, &tls.Config{ServerName: domain, InsecureSkipVerify: true,
+			NextProtos: []string{acme.ALPNProto}})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		cs := c.ConnectionState()
+		if cs.NegotiatedProtocol != acme.ALPNProto || len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("tls-alpn-01: protocol %q", cs.NegotiatedProtocol)
+		}
+		for _, e := range cs.PeerCertificates[0].Extensions {
+			var v []byte
+			if e.Id.String() == "1.3.6.1.5.5.7.1.31" {
+				asn1.Unmarshal(e.Value, &v)
+				if bytes.Equal(v, sum[:]) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("tls-alpn-01: no acmeIdentifier")
+	}
+	return nil
+}
+
+// A DNS hook that keeps the TXT records it is asked to present
+type dnsHook struct {
+	sync.Mutex
+	txt     map[string]string
+	cleaned []string
+}
+
+func startDNSHook(t *testing.T) (*dnsHook, string) {
+	h := &dnsHook{txt: map[string]string{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec struct{ FQDN, Value string }
+		json.NewDecoder(r.Body).Decode(&rec)
+		h.Lock()
+		defer h.Unlock()
+		switch r.URL.Path {
+		case "/dns/present":
+			h.txt[rec.FQDN] = rec.Value
+		case "/dns/cleanup":
+			delete(h.txt, rec.FQDN)
+			h.cleaned = append(h.cleaned, rec.FQDN)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return h, srv.URL + "/dns"
+}
+
+func (h *dnsHook) get(fqdn string) string {
+	h.Lock()
+	defer h.Unlock()
+	return h.txt[fqdn]
+}
+
+// Wait for a handshake with 'addr' as 'name' to show a certificate of
+// the fake CA and return it
+func acmeHandshake(t *testing.T, f *fakeACME, addr, name string) *x509.Certificate {
+	var err error
+	for i := 0; i < 100; i++ {
+		var c *tls.Conn
+		c, err = tls.Dial("tcp", addr, &tls.Config{ServerName: name, RootCAs: f.ca.pool})
+		if err == nil {
+			defer c.Close()
+			return c.ConnectionState().PeerCertificates[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	f.Lock()
+	defer f.Unlock()
+	t.Fatalf("handshake as %s: %s; CA: %v", name, err, f.bad)
+	return nil
+}
+
+func TestACMEDNS(t *testing.T) {
+	f := startACME(t, "dns-01")
+	hook, hu := startDNSHook(t)
+	f.hook = hook
+	cache := t.TempDir()
+	ac := ACMEConf{Domains: []string{"proxy.example.com", "*.example.com"}, Directory: f.srv.URL + "/dir",
+		Cache: cache, Challenge: "dns-01", DNSHook: hu, DNSWait: 1}
+
+	addr := startHTTPProxy(t, &ListenConf{TLS: TLSConf{ACME: ac}})
+	c := acmeHandshake(t, f, addr, "a.example.com")
+	if len(c.DNSNames) != 2 || c.DNSNames[1] != "*.example.com" {
+		t.Errorf("names %v", c.DNSNames)
+	}
+	hook.Lock()
+	if len(hook.txt) != 0 || len(hook.cleaned) != 2 {
+		t.Errorf("records %v; cleaned %v", hook.txt, hook.cleaned)
+	}
+	hook.Unlock()
+
+	// a restart uses the cached certificate
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	a, err := newACMECerts(&ac, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	got, err := a.getDNSCert(nil)
+	if err != nil || !bytes.Equal(got.Leaf.Raw, c.Raw) {
+		t.Errorf("cached: %v", err)
+	}
+	f.Lock()
+	if f.issued != 1 {
+		t.Errorf("%d issued", f.issued)
+	}
+	f.Unlock()
+}
+
+func TestACMEHTTP01(t *testing.T) {
+	f := startACME(t, "http-01")
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	f.http = ln.Addr().String()
+	ln.Close()
+	ac := ACMEConf{Domains: []string{"proxy.example.com"}, Directory: f.srv.URL + "/dir",
+		Cache: t.TempDir(), Challenge: "http-01", HTTP: f.http}
+
+	addr := startHTTPProxy(t, &ListenConf{TLS: TLSConf{ACME: ac}})
+	c := acmeHandshake(t, f, addr, "proxy.example.com")
+	if len(c.DNSNames) != 1 || c.DNSNames[0] != "proxy.example.com" {
+		t.Errorf("names %v", c.DNSNames)
+	}
+
+	// names it has no certificate for are refused
+	if _, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.example.com",
+		RootCAs: f.ca.pool}); err == nil {
+		t.Errorf("other.example.com: no error")
+	}
+}
+
+func TestACMETLSALPN(t *testing.T) {
+	f := startACME(t, "tls-alpn-01")
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	a, err := NewAdminServer(&AdminConf{Listen: "127.0.0.1:0", TLS: TLSConf{ACME: ACMEConf{
+		Domains: []string{"admin.example.com"}, Directory: f.srv.URL + "/dir",
+		Cache: t.TempDir()}}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	defer a.Stop()
+	addr := a.(*AdminServer).Addr().String()
+	f.tls = addr
+
+	acmeHandshake(t, f, addr, "admin.example.com")
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: f.ca.pool,
+		ServerName: "admin.example.com"}}}
+	res, err := hc.Get("https://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("healthz: %s", res.Status)
+	}
+}
+
+func TestACMEConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	dns := func(ac ACMEConf) ACMEConf {
+		ac.Domains, ac.Cache = []string{"x.example.com"}, t.TempDir()
+		return ac
+	}
+	for _, ac := range []ACMEConf{
+		{Cache: "/tmp"},
+		{Domains: []string{"x.example.com"}},
+		dns(ACMEConf{Challenge: "dns-02"}),
+		dns(ACMEConf{Challenge: "dns-01"}),
+		dns(ACMEConf{Challenge: "dns-01", DNSHook: "ftp://x"}),
+		dns(ACMEConf{Challenge: "dns-01", DNSHook: "http://x", DNSWait: -1}),
+		dns(ACMEConf{Directory: "file:///x"}),
+		dns(ACMEConf{HTTP: ":80"}),
+		dns(ACMEConf{EABKid: "kid"}),
+		{Domains: []string{"*.example.com"}, Cache: "/tmp"},
+	} {
+		if _, err := newACMECerts(&ac, log); err == nil {
+			t.Errorf("%+v: no error", ac)
+		}
+	}
+	tc := TLSConf{Cert: "x.pem", ACME: dns(ACMEConf{})}
+	if _, err := newListenTLS(&tc, log); err == nil {
+		t.Errorf("cert and acme: no error")
+	}
+	if _, err := NewAdminServer(&AdminConf{Listen: "127.0.0.1:0", TLS: TLSConf{Plain: true,
+		ACME: dns(ACMEConf{})}}, log); err == nil {
+		t.Errorf("admin plain: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
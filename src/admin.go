@@ -0,0 +1,873 @@
+// admin.go -- admin listener: runtime metrics, tokens and logins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// Seconds a login session lasts by default
+	ADMIN_SESSION = 900
+
+	// Failed logins in a row that lock logins for ADMIN_LOCKOUT seconds
+	ADMIN_MAXFAIL = 5
+	ADMIN_LOCKOUT = 60
+
+	// Cookie with the session of browsers
+	ADMIN_COOKIE = "goproxy_session"
+)
+
+// A sample of a metric
+type metric struct {
+	name   string
+	kind   string // "counter", "gauge" or "histogram"
+	help   string
+	labels string // name="value",...
+	value  float64
+}
+
+// Anything that has metrics to report
+type collector interface {
+	metrics() []metric
+}
+
+var collectors struct {
+	sync.Mutex
+	v []collector
+}
+
+// Report the metrics of 'c' on the admin listener
+func addCollector(c collector) {
+	collectors.Lock()
+	collectors.v = append(collectors.v, c)
+	collectors.Unlock()
+}
+
+type AdminServer struct {
+	*net.TCPListener
+
+	log      *L.Logger
+	password string // hash; "" if nothing may be changed
+	otp      *totp  // second factor; nil if none
+	session  time.Duration
+	windows  []time.Duration // of the top talkers
+	capture  string          // directory of packet captures
+	cluster  *cluster        // the fleet; its own if none
+	srv      *http.Server
+	tls      *listenTLS // nil if plain HTTP
+	wg       sync.WaitGroup
+	stop     chan struct{}
+
+	sync.Mutex
+	sessions map[string]time.Time // token -> expiry
+	fails    int
+	locked   time.Time // logins refused until then
+}
+
+func NewAdminServer(ac *AdminConf, log *L.Logger) (Proxy, error) {
+	ln, err := listenShared("admin "+ac.Listen, ac.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ac.Password) > 0 && !knownHash(ac.Password) {
+		ln.Close()
+		return nil, fmt.Errorf("admin password: not a supported hash")
+	}
+
+	a := &AdminServer{
+		TCPListener: ln,
+		log:         log.New("admin-"+ln.Addr().String(), 0),
+		password:    ac.Password,
+		session:     ADMIN_SESSION * time.Second,
+		sessions:    make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}
+	if a.windows, err = talkWindows(ac.Windows); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("admin %s", err)
+	}
+	if len(ac.Capture) > 0 {
+		if fi, err := os.Stat(ac.Capture); err != nil || !fi.IsDir() {
+			ln.Close()
+			return nil, fmt.Errorf("admin capture: %s is not a directory", ac.Capture)
+		}
+		a.capture = ac.Capture
+	}
+	if ac.Session > 0 {
+		a.session = time.Duration(ac.Session) * time.Second
+	}
+	if len(ac.TOTP) > 0 {
+		if len(ac.Password) == 0 {
+			ln.Close()
+			return nil, fmt.Errorf("admin totp: needs a password")
+		}
+		if a.otp, err = newTOTP(ac.TOTP); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("admin %s", err)
+		}
+	}
+
+	// the admin endpoints have their own logins; a certificate is all
+	// their TLS needs
+	if len(ac.TLS.Users) > 0 || len(ac.TLS.Identity) > 0 || ac.TLS.Plain {
+		ln.Close()
+		return nil, fmt.Errorf("admin tls: only cert, key, clientca, clientauth and acme")
+	}
+	if a.tls, err = newListenTLS(&ac.TLS, a.log); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("admin %s", err)
+	}
+
+	if a.cluster, err = newCluster(&ac.Cluster, a.log); err != nil {
+		a.tls.close()
+		ln.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.serveMetrics)
+	mux.HandleFunc("/healthz", a.serveHealth)
+	mux.HandleFunc("/readyz", a.serveHealth)
+	mux.HandleFunc("/tokens", a.serveTokens)
+	mux.HandleFunc("/jwks", a.serveJWKS)
+	mux.HandleFunc("/apikeys", a.serveAPIKeys)
+	mux.HandleFunc("/sessions", a.serveSessions)
+	mux.HandleFunc("/dashboard", a.serveDashboard)
+	mux.HandleFunc("/top", a.serveTop)
+	mux.HandleFunc("/capture", a.serveCapture)
+	mux.HandleFunc("/login", a.serveLogin)
+	mux.HandleFunc("/logout", a.serveLogout)
+	mux.HandleFunc("/rules", a.serveRules)
+	if a.cluster.fleet() {
+		mux.Handle("/cluster/", a.cluster)
+		addCollector(a.cluster)
+	}
+
+	a.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: CLIENT_HANDSHAKE * time.Second,
+		IdleTimeout:       CLIENT_IDLE * time.Second,
+	}
+	enableTalkers()
+	return a, nil
+}
+
+func (a *AdminServer) Start() {
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		a.log.Info("Starting admin listener ..")
+		if a.tls != nil {
+			a.srv.Serve(tls.NewListener(a.TCPListener, a.tls.conf))
+		} else {
+			a.srv.Serve(a.TCPListener)
+		}
+	}()
+
+	// count the bytes of open tunnels in the top talkers, slot by slot
+	go func() {
+		defer a.wg.Done()
+		t := time.NewTicker(TALKERS_SLOT)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case now := <-t.C:
+				countSessions(now)
+			}
+		}
+	}()
+
+	if a.cluster.fleet() {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.cluster.run(a.stop)
+		}()
+	}
+}
+
+func (a *AdminServer) Stop() {
+	close(a.stop)
+	cx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	a.srv.Shutdown(cx)
+	cancel()
+
+	a.wg.Wait()
+	a.tls.close()
+	a.log.Info("admin listener shutdown")
+}
+
+// Write all metrics in the Prometheus text format
+func (a *AdminServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	collectors.Lock()
+	cv := append([]collector(nil), collectors.v...)
+	collectors.Unlock()
+
+	// Group samples by metric; in the order they first appear. The
+	// samples of a histogram are its _bucket, _sum and _count.
+	var names []string
+	fam := make(map[string][]metric)
+	for _, c := range cv {
+		for _, m := range c.metrics() {
+			nm := m.name
+			if m.kind == "histogram" {
+				for _, sfx := range []string{"_bucket", "_sum", "_count"} {
+					if strings.HasSuffix(nm, sfx) {
+						nm = strings.TrimSuffix(nm, sfx)
+						break
+					}
+				}
+			}
+			if _, ok := fam[nm]; !ok {
+				names = append(names, nm)
+			}
+			fam[nm] = append(fam[nm], m)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, nm := range names {
+		v := fam[nm]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", nm, v[0].help, nm, v[0].kind)
+		for _, m := range v {
+			l := m.labels
+			if len(podLabels) > 0 {
+				if len(l) > 0 {
+					l = podLabels + "," + l
+				} else {
+					l = podLabels
+				}
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, l, strconv.FormatFloat(m.value, 'f', -1, 64))
+		}
+	}
+}
+
+// Return true if 'r' has a session, or the admin password when there is
+// no second factor; answer it if not.
+func (a *AdminServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if len(a.password) == 0 {
+		http.Error(w, "Forbidden: the admin listener has no password", http.StatusForbidden)
+		return false
+	}
+	if tok := sessionToken(r); len(tok) > 0 {
+		if a.validSession(tok) {
+			return true
+		}
+	} else if a.otp == nil {
+		if _, pass, ok := r.BasicAuth(); ok && checkHash(a.password, pass) {
+			return true
+		}
+	}
+
+	if a.otp != nil {
+		a.log.Info("%s: %s %s: no admin session", r.RemoteAddr, r.Method, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy admin"`)
+		http.Error(w, "Unauthorized: log in at /login with the password and a one-time code",
+			http.StatusUnauthorized)
+		return false
+	}
+	a.log.Info("%s: %s %s: bad admin password", r.RemoteAddr, r.Method, r.URL.Path)
+	w.Header().Set("WWW-Authenticate", `Basic realm="goproxy admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// Return the session token of 'r': a Bearer Authorization or the cookie
+func sessionToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if c, err := r.Cookie(ADMIN_COOKIE); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Return true if 'tok' is a session that hasn't expired
+func (a *AdminServer) validSession(tok string) bool {
+	now := time.Now()
+	a.Lock()
+	defer a.Unlock()
+
+	exp, ok := a.sessions[tok]
+	if ok && now.Before(exp) {
+		return true
+	}
+	delete(a.sessions, tok)
+	return false
+}
+
+// Start a session: POST with the password (Basic) and, if there is a
+// second factor, the one-time code "otp".
+func (a *AdminServer) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(a.password) == 0 {
+		http.Error(w, "Forbidden: the admin listener has no password", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	a.Lock()
+	locked := now.Before(a.locked)
+	a.Unlock()
+	if !locked && shared != nil {
+		locked, _ = shared.banned("admin:locked")
+	}
+	if locked {
+		a.log.Info("%s: admin login refused: too many failures", r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(ADMIN_LOCKOUT))
+		http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+		return
+	}
+
+	_, pass, ok := r.BasicAuth()
+	ok = ok && checkHash(a.password, pass)
+	if ok && a.otp != nil {
+		ok = a.otp.check(r.FormValue("otp"), now)
+	}
+	if !ok {
+		a.Lock()
+		if a.fails++; a.fails >= ADMIN_MAXFAIL {
+			a.fails = 0
+			a.locked = now.Add(ADMIN_LOCKOUT * time.Second)
+		}
+		a.Unlock()
+		if shared != nil {
+			// failures on all the nodes lock the logins of all of them
+			n, err := shared.incr("admin:fails", 1, ADMIN_LOCKOUT*time.Second)
+			if err == nil && n >= ADMIN_MAXFAIL {
+				shared.del("admin:fails")
+				shared.ban("admin:locked", ADMIN_LOCKOUT*time.Second)
+			}
+		}
+		a.log.Info("%s: admin login failed", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="goproxy admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var b [32]byte
+	rand.Read(b[:])
+	tok := hex.EncodeToString(b[:])
+	exp := now.Add(a.session)
+
+	if shared != nil {
+		shared.del("admin:fails")
+	}
+
+	a.Lock()
+	a.fails = 0
+	for k, t := range a.sessions {
+		if now.After(t) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[tok] = exp
+	a.Unlock()
+	a.log.Info("%s: admin login; session until %s", r.RemoteAddr, exp.UTC().Format(time.RFC3339))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ADMIN_COOKIE,
+		Value:    tok,
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": tok,
+		"expires": exp.Unix(),
+	})
+}
+
+// End the session of 'r'
+func (a *AdminServer) serveLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if tok := sessionToken(r); len(tok) > 0 {
+		a.Lock()
+		delete(a.sessions, tok)
+		a.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: ADMIN_COOKIE, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Mint a token: POST user, and optionally issuer, scope and ttl
+func (a *AdminServer) serveTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	ji, err := tokenIssuer(r.FormValue("issuer"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var ttl time.Duration
+	if s := r.FormValue("ttl"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "ttl: not a number of seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+
+	user := r.FormValue("user")
+	scopes := strings.Fields(r.FormValue("scope"))
+	tok, exp, err := ji.mint(user, scopes, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.log.Info("%s: minted a token for %q, scope %q, until %s", r.RemoteAddr, user,
+		strings.Join(scopes, " "), exp.UTC().Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   tok,
+		"issuer":  ji.issuer,
+		"expires": exp.Unix(),
+	})
+}
+
+// Manage API keys: GET lists them, POST creates one (name, and
+// optionally dest, ports, quota and ttl) and DELETE revokes one (name).
+// "file" picks the apikey authenticator when there are several.
+func (a *AdminServer) serveAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	ks, err := apiKeyStore(r.FormValue("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": ks.list()})
+
+	case "DELETE":
+		name := r.FormValue("name")
+		if err := ks.revoke(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		a.log.Info("%s: revoked api key %q", r.RemoteAddr, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "POST":
+		r.ParseForm()
+		x := &apiKey{
+			Name:  r.FormValue("name"),
+			Dest:  formList(r, "dest"),
+			Ports: formList(r, "ports"),
+		}
+		for _, k := range []string{"quota", "ttl"} {
+			s := r.FormValue(k)
+			if len(s) == 0 {
+				continue
+			}
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, k+": not a positive number", http.StatusBadRequest)
+				return
+			}
+			if k == "quota" {
+				x.Quota = n
+			} else {
+				x.Expires = time.Now().Unix() + n
+			}
+		}
+
+		key, err := ks.create(x)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.log.Info("%s: created api key %q", r.RemoteAddr, x.Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"key":     key,
+			"name":    x.Name,
+			"expires": x.Expires,
+		})
+	}
+}
+
+// Show (GET) or replace (POST) the rules pushed to the listeners: a
+// YAML map of listen addresses to their rules. In a fleet, the rules go
+// to all the nodes.
+func (a *AdminServer) serveRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "POST":
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	cur := a.cluster.rules()
+	if r.Method == "POST" {
+		b, err := io.ReadAll(io.LimitReader(r.Body, CLUSTER_MAXBODY))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m map[string][]RuleConf
+		if err := yaml.UnmarshalStrict(b, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := compileRules(m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cr, err := a.cluster.push(m)
+		if err != nil {
+			a.log.Warn("%s: can't push rules: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		a.log.Info("%s: pushed rules version %d for %d listeners", r.RemoteAddr, cr.Version, len(m))
+		cur = *cr
+	}
+
+	b, _ := yaml.Marshal(&cur)
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+// Return the values of form field 'k'; each may be a list separated by
+// commas or spaces.
+func formList(r *http.Request, k string) []string {
+	var v []string
+	for _, s := range r.Form[k] {
+		v = append(v, strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	return v
+}
+
+// Write the public keys of a jwt issuer as a JWK set
+func (a *AdminServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	ji, err := tokenIssuer(r.FormValue("issuer"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": ji.publicKeys()})
+}
+
+// List the open tunnels, the busiest first: GET, optionally for one
+// "tenant" or "user" and at most "limit" of them. DELETE kills one
+// ("id") or those of a "user" (of a "tenant").
+func (a *AdminServer) serveSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		id, tenant, user := r.FormValue("id"), r.FormValue("tenant"), r.FormValue("user")
+		if len(id) == 0 && len(user) == 0 {
+			http.Error(w, "id or user needed", http.StatusBadRequest)
+			return
+		}
+		n := killSessions(id, tenant, user)
+		if n == 0 {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		a.log.Info("%s: killed %d sessions (id %q, tenant %q, user %q)", r.RemoteAddr, n, id,
+			tenant, user)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"killed": n})
+		return
+	}
+
+	v := sessionStats(r.FormValue("user"), time.Now())
+	if tenant := r.FormValue("tenant"); len(tenant) > 0 {
+		keep := v[:0]
+		for _, s := range v {
+			if s.Tenant == tenant {
+				keep = append(keep, s)
+			}
+		}
+		v = keep
+	}
+	if s := r.FormValue("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "limit: not a number", http.StatusBadRequest)
+			return
+		}
+		if n < len(v) {
+			v = v[:n]
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": v})
+}
+
+// A page with the open tunnels
+func (a *AdminServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	io.WriteString(w, dashboardHTML)
+}
+
+// The busiest destinations, users and clients: GET, for one "window"
+// (seconds) or all of them, the top "n" (default 10) of each by "bytes"
+// or "sessions"
+func (a *AdminServer) serveTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+
+	windows := a.windows
+	if s := r.FormValue("window"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "window: not a number", http.StatusBadRequest)
+			return
+		}
+		if windows, err = talkWindows([]int{n}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n := 10
+	if s := r.FormValue("n"); len(s) > 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "n: not a number", http.StatusBadRequest)
+			return
+		}
+	}
+	var bySessions bool
+	switch r.FormValue("by") {
+	case "", "bytes":
+	case "sessions":
+		bySessions = true
+	default:
+		http.Error(w, "by: bytes or sessions", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	countSessions(now)
+	v := make([]topWindow, 0, len(windows))
+	for _, d := range windows {
+		t := topTalkers(d, n, bySessions, now)
+		v = append(v, topWindow{int(d / time.Second), t["dest"], t["user"], t["client"]})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"windows": v})
+}
+
+// Packet captures of tunnels: a POST captures the open tunnel "id" or
+// the next one of "user", "client" and "dest" (a host pattern) that
+// starts within "wait" seconds, up to "bytes" of it; a GET lists the
+// captures or returns the "file".
+func (a *AdminServer) serveCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, r) {
+		return
+	}
+	if len(a.capture) == 0 {
+		http.Error(w, "Forbidden: the admin listener has no capture directory", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		a.listCaptures(w, r)
+		return
+	}
+
+	max := int64(CAPTURE_BYTES)
+	if s := r.FormValue("bytes"); len(s) > 0 {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 || n > CAPTURE_MAX {
+			http.Error(w, fmt.Sprintf("bytes: not a number up to %d", CAPTURE_MAX), http.StatusBadRequest)
+			return
+		}
+		max = n
+	}
+	wait := CAPTURE_WAIT
+	if s := r.FormValue("wait"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "wait: not a number", http.StatusBadRequest)
+			return
+		}
+		wait = n
+	}
+	if d := r.FormValue("dest"); len(d) > 0 {
+		if _, err := path.Match(d, ""); err != nil {
+			http.Error(w, "dest: bad pattern", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	id := r.FormValue("id")
+	var s *liveSession
+	if len(id) > 0 {
+		if s = findSession(id); s == nil {
+			http.Error(w, "Not found: no open tunnel "+id, http.StatusNotFound)
+			return
+		}
+	} else {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+
+	name := captureName(id, now)
+	t, err := newCapture(a.capture, name, max)
+	if err != nil {
+		a.log.Warn("capture: %s", err)
+		http.Error(w, "Can't create the capture file", http.StatusInternalServerError)
+		return
+	}
+
+	if s != nil {
+		if err := s.capture(t); err != nil {
+			t.Close()
+			os.Remove(t.file)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		a.log.Info("%s: capturing tunnel %s (%s to %s) to %s", r.RemoteAddr, s.id, s.user, s.dest, name)
+	} else {
+		wantCapture(&captureWant{
+			user:   r.FormValue("user"),
+			client: r.FormValue("client"),
+			dest:   r.FormValue("dest"),
+			until:  now.Add(time.Duration(wait) * time.Second),
+			t:      t,
+		})
+		a.log.Info("%s: capturing the next tunnel of user %q client %q dest %q to %s", r.RemoteAddr,
+			r.FormValue("user"), r.FormValue("client"), r.FormValue("dest"), name)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"file": name})
+}
+
+// List the capture files, or return the one named by "file"
+func (a *AdminServer) listCaptures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if f := r.FormValue("file"); len(f) > 0 {
+		if ok, _ := path.Match("goproxy-*.pcapng", f); !ok || f != filepath.Base(f) {
+			http.Error(w, "file: not a capture", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f))
+		http.ServeFile(w, r, filepath.Join(a.capture, f))
+		return
+	}
+
+	m, _ := filepath.Glob(filepath.Join(a.capture, "goproxy-*.pcapng"))
+	v := make([]map[string]interface{}, 0, len(m))
+	for _, fn := range m {
+		if fi, err := os.Stat(fn); err == nil {
+			v = append(v, map[string]interface{}{"file": filepath.Base(fn), "size": fi.Size(),
+				"time": fi.ModTime().Unix()})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"captures": v})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
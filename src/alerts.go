@@ -0,0 +1,422 @@
+// alerts.go -- threshold alerts on the health of the proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Small deployments without an Alertmanager can have the proxy watch
+// itself: every interval each rule is checked and, once its condition
+// has held for long enough, the alert fires - it is logged, POSTed to a
+// webhook or ends goproxy with an exit status for its supervisor. An
+// alert that no longer holds is resolved the same way.
+
+const (
+	// Seconds between checks
+	ALERT_INTERVAL = 30
+
+	// Fewest sessions (or dials) between two checks for a rate
+	ALERT_MIN = 10
+
+	// Fraction of the quota of an API key
+	ALERT_QUOTA = 0.9
+
+	// Time a POST to the webhook may take
+	ALERT_TIMEOUT = 10 * time.Second
+)
+
+// Sessions and dials so far, and those that failed. Sessions that were
+// denied aren't counted.
+var alertCounts struct {
+	sessions, failed   atomic.Uint64
+	dials, dialsFailed atomic.Uint64
+}
+
+// Count a session that ended; 'failed' if it couldn't reach its
+// destination or the origin answered with a server error
+func noteSession(failed bool) {
+	alertCounts.sessions.Add(1)
+	if failed {
+		alertCounts.failed.Add(1)
+	}
+}
+
+// Count a dial that ended with 'err'; denials and clients that went
+// away aren't counted
+func noteDial(err error) {
+	if isDenied(err) != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	alertCounts.dials.Add(1)
+	if err != nil {
+		alertCounts.dialsFailed.Add(1)
+	}
+}
+
+type alertRule struct {
+	name    string
+	kind    string
+	above   float64
+	hold    time.Duration
+	min     uint64
+	log     bool
+	webhook bool
+	exit    int // 0 if the alert doesn't end goproxy
+
+	since  time.Time // the condition holds since; zero if it doesn't
+	firing bool
+}
+
+// An alert as the webhook gets it
+type alertEvent struct {
+	Alert     string  `json:"alert"`
+	Kind      string  `json:"kind"`
+	State     string  `json:"state"` // "firing" or "resolved"
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Detail    string  `json:"detail,omitempty"`
+	Since     int64   `json:"since"` // unix time the condition started
+	Time      int64   `json:"time"`
+}
+
+type alerter struct {
+	rules    []*alertRule
+	interval time.Duration
+	webhook  string
+	log      *L.Logger
+	client   *http.Client
+
+	// the exit status of an alert that ends goproxy
+	exit chan int
+
+	// the counts at the last check
+	sessions, failed, dials, dialsFailed uint64
+
+	sync.Mutex // of the rules
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Make an alerter of 'ac'; return nil if there are no rules
+func newAlerter(ac *AlertConf, log *L.Logger) (*alerter, error) {
+	if len(ac.Rules) == 0 {
+		return nil, nil
+	}
+	if len(ac.Webhook) > 0 {
+		u, err := url.Parse(ac.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("alerts: invalid webhook %q", ac.Webhook)
+		}
+	}
+
+	a := &alerter{
+		interval: time.Duration(ac.Interval) * time.Second,
+		webhook:  ac.Webhook,
+		log:      log,
+		client:   &http.Client{Timeout: ALERT_TIMEOUT},
+		exit:     make(chan int, 1),
+		stop:     make(chan struct{}),
+	}
+	if a.interval <= 0 {
+		a.interval = ALERT_INTERVAL * time.Second
+	}
+
+	have := make(map[string]bool)
+	for i := range ac.Rules {
+		rc := &ac.Rules[i]
+		r := &alertRule{
+			name:  rc.Name,
+			kind:  rc.Kind,
+			above: rc.Above,
+			hold:  time.Duration(rc.For) * time.Second,
+			min:   uint64(rc.Min),
+		}
+		if len(r.name) == 0 {
+			r.name = r.kind
+		}
+		if have[r.name] {
+			return nil, fmt.Errorf("alerts: rule %s: duplicate name", r.name)
+		}
+		have[r.name] = true
+
+		switch r.kind {
+		case "error-rate", "dial-failure-rate":
+			if r.above <= 0 || r.above >= 1 {
+				return nil, fmt.Errorf("alerts: rule %s: 'above' must be between 0 and 1", r.name)
+			}
+		case "quota":
+			if r.above == 0 {
+				r.above = ALERT_QUOTA
+			}
+			if r.above < 0 || r.above > 1 {
+				return nil, fmt.Errorf("alerts: rule %s: 'above' must be between 0 and 1", r.name)
+			}
+		case "upstream-down":
+		default:
+			return nil, fmt.Errorf("alerts: rule %s: unknown kind %q", r.name, r.kind)
+		}
+		if r.min == 0 {
+			r.min = ALERT_MIN
+		}
+
+		if len(rc.Actions) == 0 {
+			r.log = true
+		}
+		for _, act := range rc.Actions {
+			switch strings.ToLower(act) {
+			case "log":
+				r.log = true
+			case "webhook":
+				if len(a.webhook) == 0 {
+					return nil, fmt.Errorf("alerts: rule %s: no webhook", r.name)
+				}
+				r.webhook = true
+			case "exit":
+				if r.exit = rc.Exit; r.exit == 0 {
+					r.exit = 1
+				}
+			default:
+				return nil, fmt.Errorf("alerts: rule %s: unknown action %q", r.name, act)
+			}
+		}
+		a.rules = append(a.rules, r)
+	}
+
+	a.sessions, a.failed = alertCounts.sessions.Load(), alertCounts.failed.Load()
+	a.dials, a.dialsFailed = alertCounts.dials.Load(), alertCounts.dialsFailed.Load()
+	return a, nil
+}
+
+// Check the rules every interval until Stop
+func (a *alerter) Start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		t := time.NewTicker(a.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case now := <-t.C:
+				a.check(now)
+			}
+		}
+	}()
+}
+
+// Stop checking and wait for the webhooks in flight
+func (a *alerter) Stop() {
+	close(a.stop)
+	a.wg.Wait()
+}
+
+// The exit status of an alert with the "exit" action, once one fires
+func (a *alerter) Exit() <-chan int {
+	return a.exit
+}
+
+// Check each rule at 'now'; fire the alerts that held long enough and
+// resolve those that no longer hold
+func (a *alerter) check(now time.Time) {
+	sessions, failed := alertCounts.sessions.Load(), alertCounts.failed.Load()
+	dials, dialsFailed := alertCounts.dials.Load(), alertCounts.dialsFailed.Load()
+	ds, df := sessions-a.sessions, failed-a.failed
+	dd, ddf := dials-a.dials, dialsFailed-a.dialsFailed
+	a.sessions, a.failed, a.dials, a.dialsFailed = sessions, failed, dials, dialsFailed
+
+	var down []string
+	for _, r := range a.rules {
+		if r.kind == "upstream-down" {
+			down = parentsDown()
+			break
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for _, r := range a.rules {
+		var val float64
+		var detail string
+		var holds bool
+
+		switch r.kind {
+		case "error-rate":
+			if ds >= r.min {
+				val = float64(df) / float64(ds)
+				holds = val > r.above
+				detail = fmt.Sprintf("%d of %d sessions failed", df, ds)
+			}
+		case "dial-failure-rate":
+			if dd >= r.min {
+				val = float64(ddf) / float64(dd)
+				holds = val > r.above
+				detail = fmt.Sprintf("%d of %d dials failed", ddf, dd)
+			}
+		case "upstream-down":
+			val = float64(len(down))
+			holds = len(down) > 0
+			detail = strings.Join(down, ", ")
+		case "quota":
+			key, used := quotaUsed()
+			val = used
+			holds = used > r.above
+			if len(key) > 0 {
+				detail = fmt.Sprintf("API key %s", key)
+			}
+		}
+
+		switch {
+		case holds && r.since.IsZero():
+			r.since = now
+			fallthrough
+		case holds:
+			if !r.firing && now.Sub(r.since) >= r.hold {
+				r.firing = true
+				a.notify(r, "firing", val, detail, now)
+			}
+		default:
+			if r.firing {
+				a.notify(r, "resolved", val, detail, now)
+			}
+			r.since, r.firing = time.Time{}, false
+		}
+	}
+}
+
+// Act on alert 'r' going into 'state'
+func (a *alerter) notify(r *alertRule, state string, val float64, detail string, now time.Time) {
+	ev := &alertEvent{
+		Alert:     r.name,
+		Kind:      r.kind,
+		State:     state,
+		Value:     val,
+		Threshold: r.above,
+		Detail:    detail,
+		Since:     r.since.Unix(),
+		Time:      now.Unix(),
+	}
+
+	if r.log {
+		if state == "firing" {
+			a.log.Warn("alert %s firing: %s %g (threshold %g) %s", r.name, r.kind, val, r.above, detail)
+		} else {
+			a.log.Info("alert %s resolved after %s", r.name, format(now.Sub(r.since)))
+		}
+	}
+	if r.webhook {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.post(ev)
+		}()
+	}
+	if r.exit != 0 && state == "firing" {
+		a.log.Warn("alert %s: exiting with status %d ..", r.name, r.exit)
+		select {
+		case a.exit <- r.exit:
+		default:
+		}
+	}
+}
+
+// POST 'ev' to the webhook
+func (a *alerter) post(ev *alertEvent) {
+	b, _ := json.Marshal(ev)
+	res, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(b))
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s", res.Status)
+		}
+	}
+	if err != nil {
+		a.log.Warn("alert %s: can't send to %s: %s", ev.Alert, a.webhook, err)
+	}
+}
+
+func (a *alerter) metrics() []metric {
+	a.Lock()
+	defer a.Unlock()
+	v := make([]metric, 0, len(a.rules))
+	for _, r := range a.rules {
+		var n float64
+		if r.firing {
+			n = 1
+		}
+		v = append(v, metric{"goproxy_alert_firing", "gauge", "Alerts firing now",
+			fmt.Sprintf("alert=%q", r.name), n})
+	}
+	return v
+}
+
+// Return the parent proxies that fail their health check, by name
+func parentsDown() []string {
+	health.Lock()
+	var v []healthCheck
+	for _, c := range health.checks {
+		if strings.HasPrefix(c.name, "parent ") {
+			v = append(v, c)
+		}
+	}
+	health.Unlock()
+
+	var down []string
+	for _, c := range v {
+		if c.check() != nil {
+			down = append(down, strings.TrimPrefix(c.name, "parent "))
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+// Return the API key that used most of its quota, and the fraction
+func quotaUsed() (string, float64) {
+	apiKeyStores.Lock()
+	ks := make([]*apiKeys, 0, len(apiKeyStores.m))
+	for _, k := range apiKeyStores.m {
+		ks = append(ks, k)
+	}
+	apiKeyStores.Unlock()
+
+	var name string
+	var most float64
+	for _, k := range ks {
+		k.Lock()
+		for _, x := range k.byName {
+			if x.Quota <= 0 {
+				continue
+			}
+			if f := float64(x.Used) / float64(x.Quota); f > most {
+				name, most = x.Name, f
+			}
+		}
+		k.Unlock()
+	}
+	return name, most
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,179 @@
+// alerts_test.go -- tests for the threshold alerts
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestAlertConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if a, err := newAlerter(&AlertConf{}, log); a != nil || err != nil {
+		t.Errorf("no rules: %v %v", a, err)
+	}
+	for _, ac := range []AlertConf{
+		{Rules: []AlertRuleConf{{Kind: "cpu"}}},
+		{Rules: []AlertRuleConf{{Kind: "error-rate"}}},
+		{Rules: []AlertRuleConf{{Kind: "dial-failure-rate", Above: 1.5}}},
+		{Rules: []AlertRuleConf{{Kind: "quota", Above: -1}}},
+		{Rules: []AlertRuleConf{{Kind: "upstream-down", Actions: []string{"webhook"}}}},
+		{Rules: []AlertRuleConf{{Kind: "upstream-down", Actions: []string{"page"}}}},
+		{Rules: []AlertRuleConf{{Kind: "upstream-down"}, {Kind: "upstream-down"}}},
+		{Webhook: "hooks.example.com", Rules: []AlertRuleConf{{Kind: "upstream-down"}}},
+	} {
+		if _, err := newAlerter(&ac, log); err == nil {
+			t.Errorf("%+v: no error", ac)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	events := make(chan alertEvent, 8)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev alertEvent
+		if json.NewDecoder(r.Body).Decode(&ev) != nil {
+			http.Error(w, "bad alert", 400)
+			return
+		}
+		events <- ev
+	}))
+	defer hook.Close()
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	a, err := newAlerter(&AlertConf{Webhook: hook.URL, Rules: []AlertRuleConf{
+		{Name: "errors", Kind: "error-rate", Above: 0.5, For: 60, Actions: []string{"log", "webhook"}},
+		{Kind: "dial-failure-rate", Above: 0.2, Actions: []string{"exit"}, Exit: 3},
+		{Kind: "upstream-down", For: 30, Actions: []string{"webhook"}},
+		{Kind: "quota", Actions: []string{"webhook"}},
+	}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firing := func() string {
+		var v []string
+		for _, m := range a.metrics() {
+			if m.value == 1 {
+				v = append(v, m.labels)
+			}
+		}
+		return strings.Join(v, " ")
+	}
+	next := func() alertEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook")
+		}
+		return alertEvent{}
+	}
+
+	// Too few sessions to count
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		noteSession(true)
+	}
+	a.check(now)
+	if s := firing(); len(s) > 0 {
+		t.Errorf("few sessions: %s", s)
+	}
+
+	// The error rate has to hold for a minute
+	for i := 0; i < 20; i++ {
+		noteSession(i%4 != 0)
+	}
+	a.check(now.Add(30 * time.Second))
+	if s := firing(); len(s) > 0 {
+		t.Errorf("not held: %s", s)
+	}
+	for i := 0; i < 20; i++ {
+		noteSession(i%4 != 0)
+	}
+	a.check(now.Add(90 * time.Second))
+	if s := firing(); s != `alert="errors"` {
+		t.Errorf("held: %q", s)
+	}
+	if ev := next(); ev.Alert != "errors" || ev.State != "firing" || ev.Value != 0.75 || ev.Detail != "15 of 20 sessions failed" {
+		t.Errorf("firing: %+v", ev)
+	}
+	for i := 0; i < 20; i++ {
+		noteSession(false)
+	}
+	a.check(now.Add(120 * time.Second))
+	if ev := next(); ev.Alert != "errors" || ev.State != "resolved" {
+		t.Errorf("resolved: %+v", ev)
+	}
+
+	// Failed dials end goproxy; denials aren't failures
+	for i := 0; i < 10; i++ {
+		noteDial(nil)
+		noteDial(&policyErr{rule: "x"})
+	}
+	for i := 0; i < 5; i++ {
+		noteDial(errors.New("connection refused"))
+	}
+	a.check(now.Add(150 * time.Second))
+	select {
+	case n := <-a.Exit():
+		if n != 3 {
+			t.Errorf("exit %d", n)
+		}
+	default:
+		t.Errorf("no exit")
+	}
+
+	// A parent that's down
+	down := errors.New("down")
+	addCheck(&down, "parent 192.0.2.1:3128 of 127.0.0.1:3128", false, func() error { return down })
+	defer delCheck(&down)
+	a.check(now.Add(180 * time.Second))
+	a.check(now.Add(210 * time.Second))
+	if ev := next(); ev.Alert != "upstream-down" || ev.Value != 1 || ev.Since != now.Add(180*time.Second).Unix() ||
+		!strings.HasPrefix(ev.Detail, "192.0.2.1:3128") {
+		t.Errorf("upstream down: %+v", ev)
+	}
+	down = nil
+	a.check(now.Add(240 * time.Second))
+	if ev := next(); ev.Alert != "upstream-down" || ev.State != "resolved" {
+		t.Errorf("upstream up: %+v", ev)
+	}
+
+	// An API key near its quota
+	au, err := newAPIKeyAuth(map[string]string{"file": filepath.Join(t.TempDir(), "keys.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := au.(*apiKeys)
+	defer k.Close()
+	if _, err := k.create(&apiKey{Name: "ci", Quota: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	k.Lock()
+	k.byName["ci"].Used = 950
+	k.Unlock()
+	a.check(now.Add(270 * time.Second))
+	if ev := next(); ev.Alert != "quota" || ev.Value != 0.95 || ev.Detail != "API key ci" {
+		t.Errorf("quota: %+v", ev)
+	}
+
+	a.Stop()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
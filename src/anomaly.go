@@ -0,0 +1,396 @@
+// anomaly.go -- heuristics that flag unusual traffic of a user
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// The traffic of each user (or client without one) is watched for
+//
+//   - "spike": the bytes of a minute are many times those the user
+//     usually moves in a minute
+//   - "hosts": more distinct hosts in ANOMALY_WINDOW than a browsing
+//     user reaches
+//   - "beacon": connections to one destination at regular intervals,
+//     as malware checks in with its controller
+//
+// A user that trips one is flagged for a while: its sessions are tagged
+// in the access log and, if so configured, its tunnels throttled or its
+// new sessions denied.
+
+const (
+	// Window of the distinct hosts
+	ANOMALY_WINDOW = 10 * time.Minute
+
+	// Least bytes in a minute that can be a spike; minutes a user is
+	// watched before its spikes count
+	ANOMALY_SPIKE_MIN  = 10 * 1024 * 1024
+	ANOMALY_SPIKE_WARM = 5
+
+	// Beacons: the least interval and the most variation of the
+	// intervals (stddev/mean)
+	ANOMALY_BEACON_GAP = 5 * time.Second
+	ANOMALY_BEACON_CV  = 0.1
+
+	// Seconds a user is flagged
+	ANOMALY_HOLD = 600
+
+	// Most users (and destinations of a user) watched; users idle for
+	// an hour are forgotten
+	ANOMALY_KEYS  = 8192
+	ANOMALY_DESTS = 1024
+	ANOMALY_IDLE  = time.Hour
+
+	// Rule named in the denials of flagged users
+	ANOMALY_RULE = "anomaly"
+)
+
+// The anomaly detector of the process; nil if traffic isn't watched
+var anomalies *anomalyDetector
+
+type anomalyDetector struct {
+	spike    float64
+	spikeMin int64
+	hosts    int
+	beacon   int
+	block    bool
+	throttle *chaos // bandwidth cap of throttled tunnels; or nil
+	hold     time.Duration
+	log      *L.Logger
+
+	sync.Mutex
+	keys map[string]*anomalyKey
+
+	spikes, scans, beacons atomic.Uint64
+}
+
+// The traffic of a user
+type anomalyKey struct {
+	seen time.Time
+
+	// bytes of the current minute and the moving average of the
+	// minutes before it
+	minute  int64
+	bytes   int64
+	avg     float64
+	minutes int
+
+	hosts map[string]time.Time   // last time each host was reached
+	dests map[string][]time.Time // recent session starts by host:port
+
+	flags map[string]time.Time // kind -> until
+}
+
+// Start the detector of 'ac'; return nil if nothing is watched
+func newAnomalyDetector(ac *AnomalyConf, log *L.Logger) (*anomalyDetector, error) {
+	if ac.Spike == 0 && ac.Hosts == 0 && ac.Beacon == 0 {
+		return nil, nil
+	}
+	if ac.Spike < 0 || (ac.Spike > 0 && ac.Spike < 2) {
+		return nil, fmt.Errorf("anomaly: spike %g must be at least 2", ac.Spike)
+	}
+	if ac.Hosts < 0 || ac.Beacon < 0 || (ac.Beacon > 0 && ac.Beacon < 3) {
+		return nil, fmt.Errorf("anomaly: hosts must be positive and beacon at least 3")
+	}
+
+	a := &anomalyDetector{
+		spike:    ac.Spike,
+		spikeMin: ac.SpikeMin,
+		hosts:    ac.Hosts,
+		beacon:   ac.Beacon,
+		hold:     time.Duration(ac.Hold) * time.Second,
+		log:      log,
+		keys:     make(map[string]*anomalyKey),
+	}
+	if a.spikeMin <= 0 {
+		a.spikeMin = ANOMALY_SPIKE_MIN
+	}
+	if a.hold <= 0 {
+		a.hold = ANOMALY_HOLD * time.Second
+	}
+
+	switch strings.ToLower(ac.Action) {
+	case "", "tag":
+	case "block":
+		a.block = true
+	case "throttle":
+		if ac.Throttle <= 0 {
+			return nil, fmt.Errorf("anomaly: throttle needs the bytes/sec of 'throttle'")
+		}
+		a.throttle = &chaos{rule: ANOMALY_RULE, rate: ac.Throttle}
+	default:
+		return nil, fmt.Errorf("anomaly: unknown action %q", ac.Action)
+	}
+	return a, nil
+}
+
+// The key of 'user', or 'client' without one; "" if there is neither
+func anomalyKeyOf(user string, client net.IP) string {
+	if len(user) > 0 {
+		return "user " + user
+	}
+	if client != nil {
+		return "client " + client.String()
+	}
+	return ""
+}
+
+// Return the traffic of 'key' at 'now'; nil if there are too many users.
+// The caller holds the lock.
+func (a *anomalyDetector) key(key string, now time.Time) *anomalyKey {
+	k, ok := a.keys[key]
+	if !ok {
+		if len(a.keys) >= ANOMALY_KEYS {
+			a.prune(now)
+			if len(a.keys) >= ANOMALY_KEYS {
+				return nil
+			}
+		}
+		k = &anomalyKey{
+			minute: now.Unix() / 60,
+			hosts:  make(map[string]time.Time),
+			dests:  make(map[string][]time.Time),
+			flags:  make(map[string]time.Time),
+		}
+		a.keys[key] = k
+	}
+	k.seen = now
+	return k
+}
+
+// Forget users idle for ANOMALY_IDLE
+func (a *anomalyDetector) prune(now time.Time) {
+	for key, k := range a.keys {
+		if now.Sub(k.seen) > ANOMALY_IDLE {
+			delete(a.keys, key)
+		}
+	}
+}
+
+// Flag 'key' as 'kind' until the hold time from 'now'
+func (a *anomalyDetector) flag(k *anomalyKey, key, kind, why string, now time.Time) {
+	if until, ok := k.flags[kind]; ok && until.After(now) {
+		k.flags[kind] = now.Add(a.hold)
+		return
+	}
+	k.flags[kind] = now.Add(a.hold)
+	switch kind {
+	case "spike":
+		a.spikes.Add(1)
+	case "hosts":
+		a.scans.Add(1)
+	case "beacon":
+		a.beacons.Add(1)
+	}
+	a.log.Info("anomaly: %s: %s: %s", key, kind, why)
+}
+
+// Return the flags of 'k' at 'now', sorted; the caller holds the lock
+func (k *anomalyKey) flagged(now time.Time) []string {
+	var v []string
+	for kind, until := range k.flags {
+		if until.After(now) {
+			v = append(v, kind)
+		} else {
+			delete(k.flags, kind)
+		}
+	}
+	sort.Strings(v)
+	return v
+}
+
+// A session of the client in 'ctx' to 'dest' starts: count the host and
+// look for beacons. Deny it if the client is flagged and flagged clients
+// are blocked.
+func (a *anomalyDetector) start(ctx context.Context, dest string) error {
+	if a == nil {
+		return nil
+	}
+	return a.startAt(ctx, dest, time.Now())
+}
+
+func (a *anomalyDetector) startAt(ctx context.Context, dest string, now time.Time) error {
+	key := anomalyKeyOf(userOf(ctx), clientOf(ctx))
+	if len(key) == 0 {
+		return nil
+	}
+	host := dest
+	if h, _, err := net.SplitHostPort(dest); err == nil {
+		host = h
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	k := a.key(key, now)
+	if k == nil {
+		return nil
+	}
+
+	if a.hosts > 0 {
+		k.hosts[host] = now
+		if len(k.hosts) > a.hosts {
+			for h, t := range k.hosts {
+				if now.Sub(t) > ANOMALY_WINDOW {
+					delete(k.hosts, h)
+				}
+			}
+		}
+		if n := len(k.hosts); n > a.hosts {
+			a.flag(k, key, "hosts", fmt.Sprintf("%d hosts in %s", n, ANOMALY_WINDOW), now)
+		}
+	}
+
+	if a.beacon > 0 {
+		v, ok := k.dests[dest]
+		if !ok && len(k.dests) >= ANOMALY_DESTS {
+			for d, w := range k.dests {
+				if now.Sub(w[len(w)-1]) > ANOMALY_IDLE {
+					delete(k.dests, d)
+				}
+			}
+		}
+		if ok || len(k.dests) < ANOMALY_DESTS {
+			v = append(v, now)
+			if len(v) > a.beacon+1 {
+				v = v[len(v)-a.beacon-1:]
+			}
+			k.dests[dest] = v
+			if gap, ok := beaconing(v, a.beacon); ok {
+				a.flag(k, key, "beacon", fmt.Sprintf("%s every %s", dest, format(gap)), now)
+			}
+		}
+	}
+
+	if a.block && len(k.flagged(now)) > 0 {
+		return &policyErr{rule: ANOMALY_RULE, dest: dest}
+	}
+	return nil
+}
+
+// Return the mean interval of the session starts 'v' and true if the
+// last 'n' intervals are regular
+func beaconing(v []time.Time, n int) (time.Duration, bool) {
+	if len(v) < n+1 {
+		return 0, false
+	}
+	v = v[len(v)-n-1:]
+	var sum, sq float64
+	for i := 1; i < len(v); i++ {
+		d := v[i].Sub(v[i-1]).Seconds()
+		sum += d
+		sq += d * d
+	}
+	mean := sum / float64(n)
+	if mean < ANOMALY_BEACON_GAP.Seconds() {
+		return 0, false
+	}
+	sd := math.Sqrt(math.Max(sq/float64(n)-mean*mean, 0))
+	return time.Duration(mean * float64(time.Second)), sd/mean < ANOMALY_BEACON_CV
+}
+
+// Count 'n' bytes moved by 'user' or 'client' at 'now'; flag a spike
+func (a *anomalyDetector) moved(user string, client net.IP, n int64, now time.Time) {
+	if a == nil || a.spike == 0 || n <= 0 {
+		return
+	}
+	key := anomalyKeyOf(user, client)
+	if len(key) == 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	k := a.key(key, now)
+	if k == nil {
+		return
+	}
+
+	// Minutes without traffic count as zero in the average
+	if m := now.Unix() / 60; m > k.minute {
+		k.avg = 0.8*k.avg + 0.2*float64(k.bytes)
+		if gap := m - k.minute - 1; gap > 0 {
+			k.avg *= math.Pow(0.8, float64(gap))
+		}
+		k.minute, k.bytes = m, 0
+		k.minutes++
+	}
+
+	k.bytes += n
+	if k.minutes >= ANOMALY_SPIKE_WARM && k.bytes >= a.spikeMin && float64(k.bytes) > a.spike*k.avg {
+		a.flag(k, key, "spike", fmt.Sprintf("%d bytes this minute, usually %.0f", k.bytes, k.avg), now)
+	}
+}
+
+// Return the flags of the client in 'ctx' for the access log: "" or
+// " anomaly=kind,kind"
+func (a *anomalyDetector) tags(ctx context.Context) string {
+	if a == nil {
+		return ""
+	}
+	key := anomalyKeyOf(userOf(ctx), clientOf(ctx))
+	a.Lock()
+	defer a.Unlock()
+	k, ok := a.keys[key]
+	if !ok {
+		return ""
+	}
+	if v := k.flagged(time.Now()); len(v) > 0 {
+		return fmt.Sprintf(" anomaly=%q", strings.Join(v, ","))
+	}
+	return ""
+}
+
+// Return the tunnel 'c' of the client in 'ctx' under the bandwidth cap
+// if the client is flagged and flagged clients are throttled
+func (a *anomalyDetector) wrap(ctx context.Context, c net.Conn) net.Conn {
+	if a == nil || a.throttle == nil {
+		return c
+	}
+	key := anomalyKeyOf(userOf(ctx), clientOf(ctx))
+	a.Lock()
+	k, ok := a.keys[key]
+	flagged := ok && len(k.flagged(time.Now())) > 0
+	a.Unlock()
+	if !flagged {
+		return c
+	}
+	return a.throttle.wrap(c)
+}
+
+func (a *anomalyDetector) metrics() []metric {
+	const help = "Users flagged by the anomaly heuristics"
+	a.Lock()
+	now := time.Now()
+	var n int
+	for _, k := range a.keys {
+		if len(k.flagged(now)) > 0 {
+			n++
+		}
+	}
+	a.Unlock()
+	return []metric{
+		{"goproxy_anomalies_total", "counter", help, `kind="spike"`, float64(a.spikes.Load())},
+		{"goproxy_anomalies_total", "counter", help, `kind="hosts"`, float64(a.scans.Load())},
+		{"goproxy_anomalies_total", "counter", help, `kind="beacon"`, float64(a.beacons.Load())},
+		{"goproxy_anomaly_flagged", "gauge", "Users flagged now", "", float64(n)},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
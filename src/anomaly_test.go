@@ -0,0 +1,138 @@
+// anomaly_test.go -- tests for the anomaly heuristics
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestAnomalyConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if a, err := newAnomalyDetector(&AnomalyConf{}, log); a != nil || err != nil {
+		t.Errorf("nothing watched: %v %v", a, err)
+	}
+	for _, ac := range []AnomalyConf{
+		{Spike: 1.5},
+		{Hosts: -1},
+		{Beacon: 2},
+		{Hosts: 10, Action: "page"},
+		{Hosts: 10, Action: "throttle"},
+	} {
+		if _, err := newAnomalyDetector(&ac, log); err == nil {
+			t.Errorf("%+v: no error", ac)
+		}
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	a, err := newAnomalyDetector(&AnomalyConf{Spike: 4, SpikeMin: 1000, Hosts: 3, Beacon: 4, Action: "block"}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := func(u string) context.Context { return withUser(context.Background(), u) }
+	now := time.Now()
+
+	// Many hosts; the one too many is denied
+	alice := user("alice")
+	for i, h := range []string{"a.example:443", "b.example:443", "c.example:443", "a.example:80"} {
+		if err := a.startAt(alice, h, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+	}
+	if pe := isDenied(a.startAt(alice, "d.example:443", now.Add(5*time.Second))); pe == nil || pe.rule != ANOMALY_RULE {
+		t.Errorf("hosts: %v", pe)
+	}
+	if s := a.tags(alice); s != ` anomaly="hosts"` {
+		t.Errorf("hosts tags: %q", s)
+	}
+
+	// Regular check-ins are a beacon; irregular ones aren't
+	bob, carol := user("bob"), user("carol")
+	for i, gap := range []int{0, 30, 60, 91, 120} {
+		err := a.startAt(bob, "c2.example:443", now.Add(time.Duration(gap)*time.Second))
+		if i < 4 && err != nil {
+			t.Fatalf("beacon %d: %v", i, err)
+		} else if i == 4 && isDenied(err) == nil {
+			t.Errorf("beacon: %v", err)
+		}
+	}
+	for _, gap := range []int{0, 10, 60, 80, 170, 180} {
+		if err := a.startAt(carol, "app.example:443", now.Add(time.Duration(gap)*time.Second)); err != nil {
+			t.Errorf("not a beacon: %v", err)
+		}
+	}
+	if _, ok := beaconing([]time.Time{now, now.Add(time.Second), now.Add(2 * time.Second), now.Add(3 * time.Second)}, 3); ok {
+		t.Errorf("too often for a beacon")
+	}
+
+	// A minute of many times the usual bytes; a client without a user
+	ip := net.ParseIP("192.0.2.7")
+	dave := withClient(context.Background(), ip)
+	t0 := time.Unix(now.Unix()/60*60, 0)
+	for m := 0; m < 6; m++ {
+		a.moved("", ip, 1000, t0.Add(time.Duration(m)*time.Minute))
+	}
+	if s := a.tags(dave); len(s) > 0 {
+		t.Errorf("usual bytes: %q", s)
+	}
+	a.moved("", ip, 3000, t0.Add(6*time.Minute))
+	a.moved("", ip, 3000, t0.Add(6*time.Minute+time.Second))
+	if s := a.tags(dave); s != ` anomaly="spike"` {
+		t.Errorf("spike tags: %q", s)
+	}
+	if n := a.spikes.Load(); n != 1 {
+		t.Errorf("%d spikes", n)
+	}
+
+	// Flags wear off
+	a.Lock()
+	k := a.keys["user alice"]
+	if v := k.flagged(now.Add(5*time.Second + ANOMALY_HOLD*time.Second + time.Second)); len(v) > 0 {
+		t.Errorf("still flagged: %v", v)
+	}
+	a.Unlock()
+}
+
+func TestAnomalyThrottle(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	a, err := newAnomalyDetector(&AnomalyConf{Hosts: 1, Action: "throttle", Throttle: 1000}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startEcho(t)
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	ctx := withUser(context.Background(), "eve")
+	a.start(ctx, "a.example:443")
+	if _, ok := a.wrap(ctx, dial()).(*chaosConn); ok {
+		t.Errorf("throttled before a flag")
+	}
+	if err := a.start(ctx, "b.example:443"); err != nil {
+		t.Errorf("throttle denied: %v", err)
+	}
+	if _, ok := a.wrap(ctx, dial()).(*chaosConn); !ok {
+		t.Errorf("flagged, not throttled")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
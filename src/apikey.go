@@ -0,0 +1,417 @@
+// apikey.go -- API keys with per-key limits
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of our keys; it tells them from user names
+	APIKEY_PREFIX = "gpk_"
+
+	// Seconds between writes of the byte counts of the keys
+	APIKEY_SAVE = 60
+)
+
+var (
+	errKeyExpired = newError(ErrAuthFailed, "api key expired")
+	errKeyQuota   = newError(ErrQuotaExceeded, "api key quota used up")
+)
+
+func init() {
+	RegisterAuth("apikey", newAPIKeyAuth)
+}
+
+// An API key. Only the hash of the key is kept.
+type apiKey struct {
+	Name    string   `json:"name"`
+	Hash    string   `json:"hash"` // hex SHA-256 of the key
+	Dest    []string `json:"dest,omitempty"`
+	Ports   []string `json:"ports,omitempty"`
+	Quota   int64    `json:"quota,omitempty"` // bytes both ways; 0 is unlimited
+	Used    int64    `json:"used"`
+	Created int64    `json:"created"`
+	Expires int64    `json:"expires,omitempty"` // unix time; 0 is never
+
+	rule *rule // nil if the key may go anywhere
+}
+
+// API keys stored in a JSON file ("file"), created and revoked on the
+// admin listener. Clients send a key as the SOCKS user name, as an HTTP
+// bearer token, or as the Basic user name or password. The user of a
+// key is its name. A key may be limited to some destinations and ports,
+// to a number of bytes relayed (counted when a session ends), and may
+// expire. Listeners with the same file share the keys.
+type apiKeys struct {
+	file string
+	refs int
+
+	sync.Mutex
+	byHash map[string]*apiKey
+	byName map[string]*apiKey
+	dirty  bool
+	saved  time.Time
+}
+
+// The API keys, by file, for listeners and the admin listener
+var apiKeyStores = struct {
+	sync.Mutex
+	m map[string]*apiKeys
+}{m: make(map[string]*apiKeys)}
+
+func newAPIKeyAuth(args map[string]string) (Authenticator, error) {
+	fn := args["file"]
+	if len(fn) == 0 {
+		return nil, fmt.Errorf("missing 'file'")
+	}
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeyStores.Lock()
+	defer apiKeyStores.Unlock()
+	if k, ok := apiKeyStores.m[fn]; ok {
+		k.refs++
+		return k, nil
+	}
+
+	k := &apiKeys{
+		file:   fn,
+		refs:   1,
+		byHash: make(map[string]*apiKey),
+		byName: make(map[string]*apiKey),
+		saved:  time.Now(),
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	apiKeyStores.m[fn] = k
+	return k, nil
+}
+
+// Read the file; a missing file has no keys
+func (k *apiKeys) load() error {
+	b, err := os.ReadFile(k.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f struct {
+		Keys []*apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %s", k.file, err)
+	}
+	for _, x := range f.Keys {
+		if err := x.compile(); err != nil {
+			return fmt.Errorf("%s: %s", k.file, err)
+		}
+		if _, ok := k.byName[x.Name]; ok {
+			return fmt.Errorf("%s: key %q is there twice", k.file, x.Name)
+		}
+		k.byHash[x.Hash] = x
+		k.byName[x.Name] = x
+	}
+	return nil
+}
+
+// Check the key and make its destination rule
+func (x *apiKey) compile() error {
+	if len(x.Name) == 0 || len(x.Hash) != 2*sha256.Size {
+		return fmt.Errorf("key %q: missing name or hash", x.Name)
+	}
+	if len(x.Dest) == 0 && len(x.Ports) == 0 {
+		x.rule = nil
+		return nil
+	}
+	r, err := newRule(&RuleConf{Name: "apikey " + x.Name, Dest: x.Dest, Ports: x.Ports, Action: "allow"}, 0)
+	if err != nil {
+		return err
+	}
+	x.rule = r
+	return nil
+}
+
+// Write the file; the caller holds the lock
+func (k *apiKeys) save() error {
+	v := make([]*apiKey, 0, len(k.byName))
+	for _, x := range k.byName {
+		v = append(v, x)
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+
+	b, err := json.MarshalIndent(map[string]interface{}{"keys": v}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.file + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	k.dirty = false
+	k.saved = time.Now()
+	return nil
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Return the key 'key' if it is good to use at 'now'
+func (k *apiKeys) lookup(key string, now time.Time) (*apiKey, error) {
+	if !strings.HasPrefix(key, APIKEY_PREFIX) {
+		return nil, errAuthFailed
+	}
+
+	k.Lock()
+	x, ok := k.byHash[hashKey(key)]
+	switch {
+	case !ok:
+		k.Unlock()
+		return nil, errAuthFailed
+	case x.Expires > 0 && now.Unix() >= x.Expires:
+		k.Unlock()
+		return nil, errKeyExpired
+	case x.Quota > 0 && x.Used >= x.Quota:
+		k.Unlock()
+		return nil, errKeyQuota
+	}
+	quota := x.Quota
+	k.Unlock()
+
+	// the bytes used through the other nodes count too
+	if quota > 0 && shared != nil {
+		if n, err := shared.get(x.sharedKey()); err == nil && n >= quota {
+			return nil, errKeyQuota
+		}
+	}
+	return x, nil
+}
+
+// Name of the fleet's byte count of the key
+func (x *apiKey) sharedKey() string {
+	return "quota:" + x.Hash[:32]
+}
+
+// The key is the user name (SOCKS) or the password (Basic)
+func (k *apiKeys) Authenticate(ctx context.Context, user, pass string) error {
+	key := pass
+	if strings.HasPrefix(user, APIKEY_PREFIX) {
+		key = user
+	}
+	x, err := k.lookup(key, time.Now())
+	if err != nil {
+		return err
+	}
+	if key == pass && user != x.Name {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func (k *apiKeys) AuthenticateToken(ctx context.Context, token string) (string, error) {
+	x, err := k.lookup(token, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return x.Name, nil
+}
+
+// Limit the users of keys to the destinations of their key
+func (k *apiKeys) CheckDest(user, host string, ip net.IP, port int) error {
+	k.Lock()
+	x, ok := k.byName[user]
+	k.Unlock()
+	if !ok || x.rule == nil || x.rule.match(user, host, ip, port) {
+		return nil
+	}
+	return &policyErr{rule: x.rule.name, dest: net.JoinHostPort(ip.String(), strconv.Itoa(port))}
+}
+
+func (k *apiKeys) Start(s *Session) {}
+
+// Count the bytes of the session toward the quota of its key
+func (k *apiKeys) Stop(s *Session) {
+	in, out := s.Bytes()
+
+	k.Lock()
+	x, ok := k.byName[s.User]
+	if !ok {
+		k.Unlock()
+		return
+	}
+	x.Used += in + out
+	k.dirty = true
+	if time.Since(k.saved) >= APIKEY_SAVE*time.Second {
+		k.save()
+	}
+	skey := x.sharedKey()
+	name, used, quota := x.Name, x.Used, x.Quota
+	k.Unlock()
+
+	// the fleet's count is the one that crosses the thresholds
+	if shared != nil && in+out > 0 {
+		if n, err := shared.incr(skey, in+out, 0); err == nil {
+			used = n
+		}
+	}
+	if in+out > 0 {
+		events.quotaUsed(s.Tenant, name, used-in-out, used, quota)
+	}
+}
+
+// Save the byte counts when the last listener with these keys stops
+func (k *apiKeys) Close() error {
+	apiKeyStores.Lock()
+	defer apiKeyStores.Unlock()
+	if k.refs--; k.refs > 0 {
+		return nil
+	}
+	delete(apiKeyStores.m, k.file)
+
+	k.Lock()
+	defer k.Unlock()
+	if k.dirty {
+		return k.save()
+	}
+	return nil
+}
+
+// Add the key 'x' (its name and limits) with a new secret; return the
+// secret. Only its hash is stored.
+func (k *apiKeys) create(x *apiKey) (string, error) {
+	if len(x.Name) == 0 || strings.HasPrefix(x.Name, APIKEY_PREFIX) {
+		return "", fmt.Errorf("name must be set and can't start with %s", APIKEY_PREFIX)
+	}
+
+	var b [24]byte
+	rand.Read(b[:])
+	key := APIKEY_PREFIX + hex.EncodeToString(b[:])
+	x.Hash = hashKey(key)
+	x.Used = 0
+	x.Created = time.Now().Unix()
+	if err := x.compile(); err != nil {
+		return "", err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if _, ok := k.byName[x.Name]; ok {
+		return "", fmt.Errorf("key %q exists", x.Name)
+	}
+	k.byHash[x.Hash] = x
+	k.byName[x.Name] = x
+	if err := k.save(); err != nil {
+		delete(k.byHash, x.Hash)
+		delete(k.byName, x.Name)
+		return "", err
+	}
+	return key, nil
+}
+
+// Remove the key named 'name'
+func (k *apiKeys) revoke(name string) error {
+	k.Lock()
+	defer k.Unlock()
+	x, ok := k.byName[name]
+	if !ok {
+		return fmt.Errorf("no key %q", name)
+	}
+	delete(k.byHash, x.Hash)
+	delete(k.byName, name)
+	if err := k.save(); err != nil {
+		k.byHash[x.Hash] = x
+		k.byName[name] = x
+		return err
+	}
+	return nil
+}
+
+// Return copies of the keys, without their hashes
+func (k *apiKeys) list() []apiKey {
+	k.Lock()
+	defer k.Unlock()
+	v := make([]apiKey, 0, len(k.byName))
+	for _, x := range k.byName {
+		c := *x
+		c.Hash, c.rule = "", nil
+		v = append(v, c)
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+	return v
+}
+
+// Key metrics for the admin listener
+func (k *apiKeys) metrics() []metric {
+	k.Lock()
+	defer k.Unlock()
+	l := fmt.Sprintf("file=%q", k.file)
+	v := []metric{{"goproxy_apikeys", "gauge", "API keys", l, float64(len(k.byName))}}
+	for _, x := range k.byName {
+		v = append(v, metric{"goproxy_apikey_bytes_total", "counter", "Bytes relayed with an API key",
+			fmt.Sprintf("%s,key=%q", l, x.Name), float64(x.Used)})
+	}
+	return v
+}
+
+// Return the API keys of 'file'; any one if it is "" and there is only
+// one.
+func apiKeyStore(file string) (*apiKeys, error) {
+	apiKeyStores.Lock()
+	defer apiKeyStores.Unlock()
+
+	if len(file) > 0 {
+		fn, _ := filepath.Abs(file)
+		if k, ok := apiKeyStores.m[fn]; ok {
+			return k, nil
+		}
+		return nil, fmt.Errorf("no apikey authenticator with file %q", file)
+	}
+
+	switch len(apiKeyStores.m) {
+	case 0:
+		return nil, fmt.Errorf("no apikey authenticators")
+	case 1:
+		for _, k := range apiKeyStores.m {
+			return k, nil
+		}
+	}
+
+	v := make([]string, 0, len(apiKeyStores.m))
+	for fn := range apiKeyStores.m {
+		v = append(v, fn)
+	}
+	sort.Strings(v)
+	return nil, fmt.Errorf("pick a file: %s", strings.Join(v, ", "))
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
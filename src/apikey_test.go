@@ -0,0 +1,238 @@
+// apikey_test.go -- tests for API keys
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func newTestKeys(t *testing.T, fn string) *apiKeys {
+	a, err := newAPIKeyAuth(map[string]string{"file": fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*apiKeys)
+}
+
+func TestAPIKeys(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "keys.json")
+	k := newTestKeys(t, fn)
+	ctx := context.Background()
+
+	web, err := k.create(&apiKey{Name: "web", Dest: []string{"example.com"}, Ports: []string{"443"}, Quota: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := k.create(&apiKey{Name: "old", Expires: time.Now().Unix() - 1})
+	if _, err := k.create(&apiKey{Name: "web"}); err == nil {
+		t.Errorf("second key named web")
+	}
+	if _, err := k.create(&apiKey{Name: "bad", Ports: []string{"x"}}); err == nil {
+		t.Errorf("bad ports accepted")
+	}
+
+	if u, err := k.AuthenticateToken(ctx, web); err != nil || u != "web" {
+		t.Fatalf("bearer: %q %v", u, err)
+	}
+	if err := k.Authenticate(ctx, web, ""); err != nil {
+		t.Errorf("as user name: %s", err)
+	}
+	if err := k.Authenticate(ctx, "web", web); err != nil {
+		t.Errorf("as password: %s", err)
+	}
+	if err := k.Authenticate(ctx, "other", web); err != errAuthFailed {
+		t.Errorf("password of another name: %v", err)
+	}
+	if _, err := k.AuthenticateToken(ctx, web+"0"); err != errAuthFailed {
+		t.Errorf("bad key: %v", err)
+	}
+	if _, err := k.AuthenticateToken(ctx, old); err != errKeyExpired {
+		t.Errorf("expired key: %v", err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	if err := k.CheckDest("web", "www.example.com", ip, 443); err != nil {
+		t.Errorf("allowed dest: %s", err)
+	}
+	for _, d := range []struct {
+		host string
+		port int
+	}{{"example.org", 443}, {"example.com", 80}} {
+		if pe := isDenied(k.CheckDest("web", d.host, ip, d.port)); pe == nil || pe.rule != "apikey web" {
+			t.Errorf("%s:%d: %v", d.host, d.port, pe)
+		}
+	}
+	if err := k.CheckDest("old", "example.org", ip, 80); err != nil {
+		t.Errorf("key without limits: %s", err)
+	}
+
+	// Used up
+	k.Stop(&Session{User: "web", in: 600, out: 400})
+	if _, err := k.AuthenticateToken(ctx, web); err != errKeyQuota {
+		t.Errorf("over quota: %v", err)
+	}
+
+	// The keys and their counts outlive the listener
+	k.Close()
+	k = newTestKeys(t, fn)
+	v := k.list()
+	if len(v) != 2 || v[1].Name != "web" || v[1].Used != 1000 || len(v[1].Hash) > 0 {
+		t.Fatalf("reloaded: %+v", v)
+	}
+	if err := k.revoke("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.AuthenticateToken(ctx, web); err != errAuthFailed {
+		t.Errorf("revoked key: %v", err)
+	}
+	if err := k.revoke("web"); err == nil {
+		t.Errorf("revoked twice")
+	}
+
+	// Listeners with the same file share the keys
+	k2 := newTestKeys(t, fn)
+	if k2 != k {
+		t.Errorf("two stores of one file")
+	}
+	k2.Close()
+	k.Close()
+
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	ioutil.WriteFile(bad, []byte(`{"keys": [{"name": "x", "hash": "00"}]}`), 0600)
+	if _, err := newAPIKeyAuth(map[string]string{"file": bad}); err == nil {
+		t.Errorf("bad file accepted")
+	}
+}
+
+func TestAPIKeyProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	fn := filepath.Join(t.TempDir(), "keys.json")
+	k := newTestKeys(t, fn)
+	ok, _ := k.create(&apiKey{Name: "robot", Ports: []string{port}})
+	other, _ := k.create(&apiKey{Name: "elsewhere", Ports: []string{"1"}})
+	k.Close()
+
+	ac := AuthConf{Type: "apikey", Args: map[string]string{"file": fn}}
+	addr := startHTTPProxy(t, &ListenConf{Auth: ac})
+	get := func(auth string) int {
+		pu := &url.URL{Scheme: "http", Host: addr}
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		req.Header.Set("Proxy-Authorization", auth)
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if n := get("Bearer " + ok); n != 200 {
+		t.Errorf("bearer: %d", n)
+	}
+	if n := get("Bearer " + other); n != http.StatusForbidden {
+		t.Errorf("key for other ports: %d", n)
+	}
+	x := &http.Request{Header: http.Header{}}
+	x.SetBasicAuth(ok, "")
+	if n := get(x.Header.Get("Authorization")); n != 200 {
+		t.Errorf("basic user name: %d", n)
+	}
+
+	saddr := startSocksProxy(t, &ListenConf{Auth: ac})
+	dial := func(user string) error {
+		d, _ := proxy.SOCKS5("tcp", saddr, &proxy.Auth{User: user, Password: "x"}, proxy.Direct)
+		c, err := d.Dial("tcp", origin.Listener.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := dial(ok); err != nil {
+		t.Errorf("socks: %s", err)
+	}
+	if err := dial(other); err == nil {
+		t.Errorf("socks: key for other ports accepted")
+	}
+	if err := dial("robot"); err == nil {
+		t.Errorf("socks: key name accepted")
+	}
+}
+
+func TestAdminAPIKeys(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "keys.json")
+	k := newTestKeys(t, fn)
+	t.Cleanup(func() { k.Close() })
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+
+	do := func(method, path string, v url.Values) *http.Response {
+		req, _ := http.NewRequest(method, u+path, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "adm1n")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do("POST", "/apikeys", url.Values{"name": {"ci"}, "dest": {"example.com, 10.0.0.0/8"}, "quota": {"5000"}, "ttl": {"60"}})
+	var out struct {
+		Key string `json:"key"`
+	}
+	json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if res.StatusCode != 200 || !strings.HasPrefix(out.Key, APIKEY_PREFIX) {
+		t.Fatalf("create: %d %q", res.StatusCode, out.Key)
+	}
+	if u, err := k.AuthenticateToken(context.Background(), out.Key); err != nil || u != "ci" {
+		t.Errorf("created key: %q %v", u, err)
+	}
+
+	res = do("GET", "/apikeys", nil)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	var list struct {
+		Keys []apiKey `json:"keys"`
+	}
+	json.Unmarshal(b, &list)
+	if len(list.Keys) != 1 || len(list.Keys[0].Dest) != 2 || list.Keys[0].Quota != 5000 ||
+		list.Keys[0].Expires == 0 || strings.Contains(string(b), hashKey(out.Key)) {
+		t.Errorf("list: %s", b)
+	}
+
+	if res := do("POST", "/apikeys", url.Values{"name": {"x"}, "quota": {"-1"}}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad quota: %d", res.StatusCode)
+	}
+	if res := do("DELETE", "/apikeys?name=ci", nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("revoke: %d", res.StatusCode)
+	}
+	if _, err := k.AuthenticateToken(context.Background(), out.Key); err == nil {
+		t.Errorf("revoked key accepted")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
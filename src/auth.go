@@ -0,0 +1,706 @@
+// auth.go -- client authentication
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opencoff/golang-lru"
+)
+
+// A listener with an "auth" block asks its clients for a user name and
+// password: HTTP clients with Proxy-Authorization (Basic), SOCKS clients
+// with RFC 1929. The credentials are checked by an authenticator; like
+// filters, an authenticator type is compiled in and registers an
+// AuthFactory in init(). See htpasswd.go.
+
+var errAuthFailed = newError(ErrAuthFailed, "bad user name or password")
+
+const (
+	// Verified users remembered by an authCache
+	AUTH_CACHE = 4096
+
+	// Default seconds a client or user with too many failed logins is
+	// refused, and the "rule" that refuses it
+	AUTH_BAN      = 300
+	AUTH_BAN_RULE = "guard-auth"
+)
+
+// Checks a user's credentials. It is called concurrently.
+type Authenticator interface {
+	// Return nil if 'pass' is the password of 'user'
+	Authenticate(ctx context.Context, user, pass string) error
+}
+
+// An Authenticator that also takes bearer tokens; HTTP clients send them
+// with Proxy-Authorization: Bearer.
+type TokenAuthenticator interface {
+	// Return the user 'token' was issued to if it is good
+	AuthenticateToken(ctx context.Context, token string) (string, error)
+}
+
+// An Authenticator that limits where its users may connect (API keys);
+// checked along with the rules of the listener.
+type DestChecker interface {
+	// Return an error (a *policyErr) if 'user' may not connect to
+	// 'ip:port' for 'host'
+	CheckDest(user, host string, ip net.IP, port int) error
+}
+
+// Told about the sessions of authenticated users. An Authenticator that
+// also implements Accounter gets the sessions of its listener; one that
+// implements io.Closer is closed when the listener stops.
+type Accounter interface {
+	// A session started; called before any data is relayed
+	Start(s *Session)
+
+	// The session ended; its byte counts are final
+	Stop(s *Session)
+}
+
+// A session of an authenticated user: a tunnel, or an HTTP request
+// (which starts and stops when it is done).
+type Session struct {
+	ID     string
+	Tenant string // of the listener; "" if none
+	User   string
+	Client net.IP
+	Proto  string // "http", "connect", "upgrade" or "socks"
+	Dest   string // host:port
+	Start  time.Time
+
+	// bytes from and to the client of a request
+	in, out int64
+
+	// bytes from and to the client of a tunnel so far
+	moved func() (in, out int64)
+}
+
+// Return the bytes from and to the client so far
+func (s *Session) Bytes() (in, out int64) {
+	if s.moved != nil {
+		return s.moved()
+	}
+	return s.in, s.out
+}
+
+// Users and passwords that were verified, remembered for 'ttl' so HTTP
+// clients, which send their password with every request, don't cost a
+// round trip to a server each. Only hashes are kept.
+type authCache struct {
+	ttl time.Duration
+
+	sync.Mutex
+	ok map[[32]byte]time.Time
+}
+
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{ttl: ttl, ok: make(map[[32]byte]time.Time)}
+}
+
+func authKey(user, pass string) [32]byte {
+	return sha256.Sum256([]byte(user + "\x00" + pass))
+}
+
+// Return true if 'user' and 'pass' were verified recently
+func (c *authCache) has(user, pass string) bool {
+	k := authKey(user, pass)
+	c.Lock()
+	exp, ok := c.ok[k]
+	c.Unlock()
+	return ok && time.Now().Before(exp)
+}
+
+// Remember that 'user' and 'pass' are good
+func (c *authCache) add(user, pass string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	k := authKey(user, pass)
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if len(c.ok) >= AUTH_CACHE {
+		for k, exp := range c.ok {
+			if !now.Before(exp) {
+				delete(c.ok, k)
+			}
+		}
+		if len(c.ok) >= AUTH_CACHE {
+			c.ok = make(map[[32]byte]time.Time)
+		}
+	}
+	c.ok[k] = now.Add(c.ttl)
+}
+
+// Make an authenticator from its config args
+type AuthFactory func(args map[string]string) (Authenticator, error)
+
+var authTypes = struct {
+	sync.Mutex
+	m map[string]AuthFactory
+}{m: make(map[string]AuthFactory)}
+
+// Make the authenticator type 'name' available to the config file
+func RegisterAuth(name string, f AuthFactory) {
+	authTypes.Lock()
+	defer authTypes.Unlock()
+
+	if _, ok := authTypes.m[name]; ok {
+		panic("authenticator " + name + " registered twice")
+	}
+	authTypes.m[name] = f
+}
+
+// Return the registered authenticator types
+func authNames() []string {
+	authTypes.Lock()
+	defer authTypes.Unlock()
+
+	v := make([]string, 0, len(authTypes.m))
+	for k := range authTypes.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Authentication of a listener's clients
+type clientAuth struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	ok     uint64
+	fail   uint64
+	banned uint64
+
+	Authenticator
+	acct  Accounter              // nil if the authenticator doesn't do accounting
+	tok   TokenAuthenticator     // nil if it doesn't take tokens
+	neg   NegotiateAuthenticator // nil if it doesn't take Negotiate
+	realm string
+	name  string     // listener
+	guard *authGuard // nil if failed logins aren't banned
+
+	// the auth hook; nil if none
+	script *scriptHooks
+}
+
+// Return the authentication of 'lc' or nil if it has none
+func newClientAuth(lc *ListenConf, name string) (*clientAuth, error) {
+	c := &lc.Auth
+	if len(c.Type) == 0 {
+		return nil, nil
+	}
+
+	authTypes.Lock()
+	mk, ok := authTypes.m[c.Type]
+	authTypes.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("auth: unknown type %q (have %s)", c.Type,
+			strings.Join(authNames(), ", "))
+	}
+
+	a, err := mk(c.Args)
+	if err != nil {
+		return nil, fmt.Errorf("auth %s: %s", c.Type, err)
+	}
+
+	realm := c.Realm
+	if len(realm) == 0 {
+		realm = "go-proxies"
+		if len(lc.Tenant) > 0 {
+			realm = lc.Tenant
+		}
+	}
+	ca := &clientAuth{Authenticator: a, realm: realm, name: name}
+	if ca.guard, err = newAuthGuard(c, name); err != nil {
+		return nil, err
+	}
+	ca.acct, _ = a.(Accounter)
+	ca.tok, _ = a.(TokenAuthenticator)
+	ca.neg, _ = a.(NegotiateAuthenticator)
+	return ca, nil
+}
+
+// Close the authenticator, if it needs closing
+func (ca *clientAuth) Close() {
+	if c, ok := ca.Authenticator.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func newSession(ctx context.Context, proto, dest string) *Session {
+	var b [8]byte
+	rand.Read(b[:])
+	return &Session{
+		ID:     hex.EncodeToString(b[:]),
+		Tenant: tenantOf(ctx),
+		User:   userOf(ctx),
+		Client: clientOf(ctx),
+		Proto:  proto,
+		Dest:   dest,
+		Start:  time.Now(),
+	}
+}
+
+// Start the session of a tunnel for the user of ctx; 'moved' returns
+// the bytes from and to the client so far. Return nil if there is no
+// user or no accounting.
+func (ca *clientAuth) begin(ctx context.Context, proto, dest string, moved func() (int64, int64)) *Session {
+	if ca == nil || ca.acct == nil || len(userOf(ctx)) == 0 {
+		return nil
+	}
+
+	s := newSession(ctx, proto, dest)
+	s.moved = moved
+	ca.acct.Start(s)
+	return s
+}
+
+// End the session 's' (which may be nil)
+func (ca *clientAuth) end(s *Session) {
+	if s != nil {
+		ca.acct.Stop(s)
+	}
+}
+
+// Account for HTTP request 'r', started at 't0', that sent 'nr' bytes
+// to the client.
+func (ca *clientAuth) request(r *http.Request, t0 time.Time, nr int64) {
+	ctx := r.Context()
+	if ca == nil || ca.acct == nil || len(userOf(ctx)) == 0 {
+		return
+	}
+
+	s := newSession(ctx, "http", extractHost(r.URL))
+	s.Start = t0
+	if r.ContentLength > 0 {
+		s.in = r.ContentLength
+	}
+	s.out = nr
+	ca.acct.Start(s)
+	ca.acct.Stop(s)
+}
+
+// Check the credentials of 'user'; return the user they name. Token
+// authenticators also take a token as the user name (with any password)
+// - SOCKS clients have no other place for it.
+func (ca *clientAuth) check(ctx context.Context, user, pass string) (string, error) {
+	if err := ca.refused(ctx, user); err != nil {
+		return "", err
+	}
+	if ca.tok != nil {
+		if u, err := ca.tok.AuthenticateToken(ctx, user); err == nil {
+			return ca.result(ctx, u, nil, true)
+		}
+	}
+
+	return ca.result(ctx, user, ca.Authenticate(ctx, user, pass), false)
+}
+
+// Check the bearer 'token'; return its user
+func (ca *clientAuth) checkToken(ctx context.Context, token string) (string, error) {
+	if err := ca.refused(ctx, ""); err != nil {
+		return "", err
+	}
+	user, err := ca.tok.AuthenticateToken(ctx, token)
+	return ca.result(ctx, user, err, true)
+}
+
+// Check the Negotiate 'token'; return its user
+func (ca *clientAuth) checkNegotiate(ctx context.Context, token []byte) (string, error) {
+	if err := ca.refused(ctx, ""); err != nil {
+		return "", err
+	}
+	user, err := ca.neg.AuthenticateNegotiate(ctx, token)
+	return ca.result(ctx, user, err, true)
+}
+
+// Return an error if the client in 'ctx' or 'user' is banned for failed
+// logins
+func (ca *clientAuth) refused(ctx context.Context, user string) error {
+	err := ca.guard.check(ctx, user)
+	if err != nil {
+		atomic.AddUint64(&ca.banned, 1)
+	}
+	return err
+}
+
+// Count the outcome of authenticating 'user'; the script's auth hook
+// has the last word on those that passed. Bad credentials count towards
+// a ban, an authenticator that couldn't answer doesn't; any failure of
+// a 'token' is a bad one.
+func (ca *clientAuth) result(ctx context.Context, user string, err error, token bool) (string, error) {
+	login := user
+	if err == nil && ca.script != nil {
+		user, err = ca.script.auth(ctx, user)
+	}
+	if err != nil {
+		atomic.AddUint64(&ca.fail, 1)
+		if token || errors.Is(err, ErrAuthFailed) {
+			ca.guard.fail(ctx, login)
+		}
+		return "", err
+	}
+	atomic.AddUint64(&ca.ok, 1)
+	ca.guard.ok(user)
+	return user, nil
+}
+
+// Failed logins of a listener's clients and users. After 'max' within
+// 'ban', the client address (or its /64) or the user name is refused
+// for 'ban'. With shared state, the failures on all the nodes count and
+// a ban holds on all of them.
+type authGuard struct {
+	max  int
+	ban  time.Duration
+	skey string // prefix of the keys in the shared state
+
+	keys *lru.TwoQueueCache
+}
+
+// Failed logins of a client or user
+type authFails struct {
+	sync.Mutex
+	t0     time.Time
+	n      int
+	banned time.Time
+}
+
+// Return the guard of 'c' for the listener 'name'; nil if it has none
+func newAuthGuard(c *AuthConf, name string) (*authGuard, error) {
+	if c.Fails <= 0 {
+		return nil, nil
+	}
+	g := &authGuard{
+		max:  c.Fails,
+		ban:  time.Duration(c.Ban) * time.Second,
+		skey: "auth:" + name + ":",
+	}
+	if g.ban <= 0 {
+		g.ban = AUTH_BAN * time.Second
+	}
+	keys, err := lru.New2Q(RATELIMIT_SOURCES)
+	if err != nil {
+		return nil, err
+	}
+	g.keys = keys
+	return g, nil
+}
+
+// A client or user of a login: its key, and what it is in the logs.
+// User names are hashed; some (API keys) are secrets.
+type guardKey struct {
+	key  string
+	what string
+}
+
+func authKeys(ctx context.Context, user string) []guardKey {
+	var v []guardKey
+	if ip := clientOf(ctx); ip != nil {
+		k := "client " + srcKey(ip)
+		v = append(v, guardKey{k, k})
+	}
+	if len(user) > 0 {
+		v = append(v, guardKey{userKey(user), "user"})
+	}
+	return v
+}
+
+func userKey(user string) string {
+	h := sha256.Sum256([]byte(user))
+	return "user " + hex.EncodeToString(h[:16])
+}
+
+// Return an error if the client in 'ctx' or 'user' is banned
+func (g *authGuard) check(ctx context.Context, user string) error {
+	if g == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, k := range authKeys(ctx, user) {
+		if v, ok := g.keys.Peek(k.key); ok {
+			st := v.(*authFails)
+			st.Lock()
+			left := st.banned.Sub(now)
+			st.Unlock()
+			if left > 0 {
+				return &policyErr{rule: AUTH_BAN_RULE, dest: k.what, retry: left}
+			}
+		}
+		if shared != nil {
+			if ok, _ := shared.banned(g.skey + "ban:" + k.key); ok {
+				return &policyErr{rule: AUTH_BAN_RULE, dest: k.what, retry: g.ban}
+			}
+		}
+	}
+	return nil
+}
+
+// Count a failed login of the client in 'ctx' as 'user'
+func (g *authGuard) fail(ctx context.Context, user string) {
+	if g == nil {
+		return
+	}
+	now := time.Now()
+	for _, k := range authKeys(ctx, user) {
+		v, _ := g.keys.Probe(k.key, func(_ interface{}) interface{} {
+			return &authFails{}
+		})
+		st := v.(*authFails)
+		st.Lock()
+		if now.Sub(st.t0) > g.ban {
+			st.t0, st.n = now, 0
+		}
+		if st.n++; st.n >= g.max {
+			st.n = 0
+			st.banned = now.Add(g.ban)
+		}
+		st.Unlock()
+
+		if shared != nil {
+			// failures on all the nodes ban on all of them
+			n, err := shared.incr(g.skey+"fails:"+k.key, 1, g.ban)
+			if err == nil && n >= int64(g.max) {
+				shared.del(g.skey + "fails:" + k.key)
+				shared.ban(g.skey+"ban:"+k.key, g.ban)
+			}
+		}
+	}
+}
+
+// Forget the failed logins of 'user', who just logged in
+func (g *authGuard) ok(user string) {
+	if g == nil || len(user) == 0 {
+		return
+	}
+	k := userKey(user)
+	g.keys.Remove(k)
+	if shared != nil {
+		shared.del(g.skey + "fails:" + k)
+	}
+}
+
+// Authentication metrics for the admin listener
+func (ca *clientAuth) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", ca.name)
+	v := []metric{
+		{"goproxy_auth_ok_total", "counter", "Clients that authenticated", l,
+			float64(atomic.LoadUint64(&ca.ok))},
+		{"goproxy_auth_failed_total", "counter", "Clients that failed to authenticate", l,
+			float64(atomic.LoadUint64(&ca.fail))},
+		{"goproxy_auth_banned_total", "counter", "Logins refused for failed logins before", l,
+			float64(atomic.LoadUint64(&ca.banned))},
+	}
+
+	// Authenticators may have metrics of their own
+	if c, ok := ca.Authenticator.(interface{ metrics() []metric }); ok {
+		for _, m := range c.metrics() {
+			m.labels = l + "," + m.labels
+			v = append(v, m)
+		}
+	}
+	return v
+}
+
+// Return a context that carries the authenticated 'user'
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, ctxUser, user)
+}
+
+// Return the authenticated user of ctx; "" if there is none
+func userOf(ctx context.Context) string {
+	s, _ := ctx.Value(ctxUser).(string)
+	return s
+}
+
+// The user of an HTTP connection that authenticated with Negotiate;
+// clients authenticate a connection once (RFC 4559).
+type connAuth struct {
+	user string
+}
+
+// Return a context for a new connection 'c' of an http.Server
+func withConnAuth(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, ctxConnAuth, &connAuth{})
+}
+
+// Return the connAuth of ctx (or nil)
+func connAuthOf(ctx context.Context) *connAuth {
+	c, _ := ctx.Value(ctxConnAuth).(*connAuth)
+	return c
+}
+
+// Check the Proxy-Authorization of 'r'. Return the request to go on
+// with and true; or false if it was answered with a 407.
+func (p *HTTPProxy) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	ctx := r.Context()
+	log := logOf(ctx, p.log)
+	ct := connAuthOf(ctx)
+	if ct != nil && len(ct.user) > 0 && len(r.Header.Get("Proxy-Authorization")) == 0 {
+		return r.WithContext(withUser(ctx, ct.user)), true
+	}
+
+	bad := ""
+	var err error
+	if token, ok := proxyNegotiate(r); ok && p.auth.neg != nil {
+		var user string
+		if user, err = p.auth.checkNegotiate(ctx, token); err == nil {
+			if ct != nil {
+				ct.user = user
+			}
+			return r.WithContext(withUser(ctx, user)), true
+		}
+		log.Info("%s: negotiate refused: %s", r.RemoteAddr, err)
+	} else if token, ok := proxyBearer(r); ok && p.auth.tok != nil {
+		var user string
+		if user, err = p.auth.checkToken(ctx, token); err == nil {
+			return r.WithContext(withUser(ctx, user)), true
+		}
+		log.Info("%s: bearer token refused: %s", r.RemoteAddr, err)
+		bad = `, error="invalid_token"`
+	} else if user, pass, ok := proxyBasicAuth(r); ok {
+		var u string
+		if u, err = p.auth.check(ctx, user, pass); err == nil {
+			return r.WithContext(withUser(ctx, u)), true
+		}
+		log.Info("%s: authentication of %.64q failed: %s", r.RemoteAddr, user, err)
+	}
+
+	// a used up key or a client banned for its failed logins needs no
+	// new credentials
+	if errors.Is(err, ErrQuotaExceeded) {
+		p.replyError(w, r, err, extractHost(r.URL))
+		return nil, false
+	}
+
+	// Kerberos takes no passwords; Basic would only prompt for one
+	h := w.Header()
+	if p.auth.neg != nil {
+		h.Set("Proxy-Authenticate", "Negotiate")
+	} else {
+		h.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.auth.realm))
+	}
+	if p.auth.tok != nil {
+		h.Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q%s", p.auth.realm, bad))
+	}
+	p.httpError(w, r, "Proxy authentication required", http.StatusProxyAuthRequired, "")
+	return nil, false
+}
+
+// Return the token in a Bearer Proxy-Authorization of 'r'
+func proxyBearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Proxy-Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	t := strings.TrimSpace(h[7:])
+	return t, len(t) > 0
+}
+
+// Return the token in a Negotiate Proxy-Authorization of 'r'
+func proxyNegotiate(r *http.Request) ([]byte, bool) {
+	h := r.Header.Get("Proxy-Authorization")
+	if len(h) < 10 || !strings.EqualFold(h[:10], "Negotiate ") {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[10:]))
+	return b, err == nil && len(b) > 0
+}
+
+// Return the Basic credentials in the Proxy-Authorization of 'r'
+func proxyBasicAuth(r *http.Request) (user, pass string, ok bool) {
+	h := r.Header.Get("Proxy-Authorization")
+	if len(h) == 0 {
+		return
+	}
+
+	// net/http decodes Basic credentials of the Authorization header
+	x := &http.Request{Header: http.Header{"Authorization": {h}}}
+	return x.BasicAuth()
+}
+
+// SOCKS authentication methods
+const (
+	SOCKS_NOAUTH   = 0x00
+	SOCKS_PASSWORD = 0x02
+	SOCKS_NOMETHOD = 0xff
+)
+
+// Pick the SOCKS method from those the client offers in 'm': none, or
+// user name and password (RFC 1929) if the listener has authentication.
+// Clients with a certificate naming 'certUser' need no password if they
+// offer none. Return the user and true if the client may go on.
+func (px *socksProxy) authenticate(ctx context.Context, conn net.Conn, m *Methods, certUser string) (string, bool) {
+	log := logOf(ctx, px.log)
+	noAuth := bytes.IndexByte(m.methods, SOCKS_NOAUTH) >= 0
+	if px.auth == nil || (len(certUser) > 0 && noAuth) {
+		conn.Write([]byte{5, SOCKS_NOAUTH})
+		return certUser, true
+	}
+
+	rem := conn.RemoteAddr().String()
+	if bytes.IndexByte(m.methods, SOCKS_PASSWORD) < 0 {
+		log.Info("%s: client doesn't offer user name and password authentication", rem)
+		conn.Write([]byte{5, SOCKS_NOMETHOD})
+		return "", false
+	}
+	conn.Write([]byte{5, SOCKS_PASSWORD})
+
+	// Version 1, user name and password; each with a length byte
+	var b [256]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		log.Info("%s: bad authentication request: %s", rem, err)
+		return "", false
+	}
+	if b[0] != 1 {
+		log.Info("%s: bad authentication request: version %d", rem, b[0])
+		return "", false
+	}
+	n := int(b[1])
+	if _, err := io.ReadFull(conn, b[:n+1]); err != nil {
+		log.Info("%s: bad authentication request: %s", rem, err)
+		return "", false
+	}
+	user := string(b[:n])
+	n = int(b[n])
+	if _, err := io.ReadFull(conn, b[:n]); err != nil {
+		log.Info("%s: bad authentication request: %s", rem, err)
+		return "", false
+	}
+	pass := string(b[:n])
+
+	// the auth hook sees the client
+	host, _, _ := net.SplitHostPort(rem)
+	u, err := px.auth.check(withClient(ctx, net.ParseIP(host)), user, pass)
+	if err != nil {
+		log.Info("%s: authentication of %.64q failed: %s", rem, user, err)
+		conn.Write([]byte{1, 1})
+		return "", false
+	}
+	conn.Write([]byte{1, 0})
+	return u, true
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,290 @@
+// auth_test.go -- tests for client authentication
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/proxy"
+)
+
+// Start a SOCKS proxy for 'lc' on a loopback port
+func startSocksProxy(t *testing.T, lc *ListenConf) string {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc.Listen = "127.0.0.1:0"
+	lc.Rules = append(lc.Rules, RuleConf{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"})
+
+	px, err := NewSocksv5Proxy(lc, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Start()
+	t.Cleanup(px.Stop)
+	return px.Addr().String()
+}
+
+// Write an htpasswd file with 'lines'; return its name
+func writeHtpasswd(t *testing.T, lines string) string {
+	fn := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(fn, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func bcryptHash(t *testing.T, pass string) string {
+	b, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCheckHash(t *testing.T) {
+	tests := []struct {
+		hash, pass string
+		want       bool
+	}{
+		// openssl passwd -apr1 / -1
+		{"$apr1$r31.....$G/cElGhD0cboYkZN5h5Ne/", "secret", true},
+		{"$apr1$abcdefgh$CZx3qOBL3IJw7t4yUwt4J.", "hello world", true},
+		{"$apr1$abcdefgh$CZx3qOBL3IJw7t4yUwt4J.", "hello World", false},
+		{"$1$saltsalt$NYbDBJPL4SYkHUYcroZkM/", "pa55 word", true},
+		{"{SHA}t6h1/B6iKLkGEEG3zsS9PFKrPOM=", "letmein", true},
+		{"{SHA}t6h1/B6iKLkGEEG3zsS9PFKrPOM=", "letmeout", false},
+		{bcryptHash(t, "s3cret"), "s3cret", true},
+		{bcryptHash(t, "s3cret"), "s3cre", false},
+		{"plain", "plain", false},
+	}
+
+	for _, tt := range tests {
+		if got := checkHash(tt.hash, tt.pass); got != tt.want {
+			t.Errorf("%s %q: got %v", tt.hash, tt.pass, got)
+		}
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	fn := writeHtpasswd(t, "# users\n\nalice:"+bcryptHash(t, "wonder")+
+		"\nbob:$apr1$r31.....$G/cElGhD0cboYkZN5h5Ne/\n")
+	a, err := newHtpasswd(map[string]string{"file": fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+			t.Errorf("alice: %s", err)
+		}
+	}
+	if err := a.Authenticate(ctx, "bob", "secret"); err != nil {
+		t.Errorf("bob: %s", err)
+	}
+	if err := a.Authenticate(ctx, "bob", "wonder"); err != errAuthFailed {
+		t.Errorf("bob with alice's password: %v", err)
+	}
+	if err := a.Authenticate(ctx, "carol", ""); err != errAuthFailed {
+		t.Errorf("unknown user: %v", err)
+	}
+
+	// Changes are picked up; a broken file keeps the old users
+	h := a.(*htpasswd)
+	ioutil.WriteFile(fn, []byte("alice:{SHA}t6h1/B6iKLkGEEG3zsS9PFKrPOM=\n"), 0600)
+	os.Chtimes(fn, time.Now(), time.Now().Add(time.Minute))
+	h.checked = time.Time{}
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != errAuthFailed {
+		t.Errorf("old password after reload: %v", err)
+	}
+	if err := a.Authenticate(ctx, "alice", "letmein"); err != nil {
+		t.Errorf("new password after reload: %s", err)
+	}
+
+	ioutil.WriteFile(fn, []byte("alice:nohash\n"), 0600)
+	os.Chtimes(fn, time.Now(), time.Now().Add(2*time.Minute))
+	h.checked = time.Time{}
+	if err := a.Authenticate(ctx, "alice", "letmein"); err != nil {
+		t.Errorf("after bad reload: %s", err)
+	}
+
+	for _, s := range []string{"nocolon\n", "dave:$6$x$y\n"} {
+		if _, err := newHtpasswd(map[string]string{"file": writeHtpasswd(t, s)}); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func authConf(t *testing.T) AuthConf {
+	fn := writeHtpasswd(t, "alice:"+bcryptHash(t, "wonder")+"\n")
+	return AuthConf{Type: "htpasswd", Realm: "test", Args: map[string]string{"file": fn}}
+}
+
+func TestAuthHTTP(t *testing.T) {
+	hdrs := make(chan http.Header, 4)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrs <- r.Header
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	addr := startHTTPProxy(t, &ListenConf{Auth: authConf(t)})
+
+	do := func(user *url.Userinfo) *http.Response {
+		pu := &url.URL{Scheme: "http", Host: addr, User: user}
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+		res, err := c.Get(origin.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for _, u := range []*url.Userinfo{nil, url.UserPassword("alice", "nope"), url.UserPassword("bob", "wonder")} {
+		res := do(u)
+		if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") != `Basic realm="test"` {
+			t.Errorf("%v: %d %v", u, res.StatusCode, res.Header)
+		}
+	}
+
+	if res := do(url.UserPassword("alice", "wonder")); res.StatusCode != 200 {
+		t.Fatalf("alice: %d", res.StatusCode)
+	}
+	if h := <-hdrs; len(h.Get("Proxy-Authorization")) > 0 {
+		t.Errorf("credentials sent to the origin")
+	}
+
+	// CONNECT needs them too
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", origin.Listener.Addr(), origin.Listener.Addr())
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("CONNECT without credentials: %v %v", res, err)
+	}
+}
+
+func TestAuthSOCKS(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	addr := startSocksProxy(t, &ListenConf{Auth: authConf(t)})
+	dest := origin.Listener.Addr().String()
+
+	dial := func(a *proxy.Auth) error {
+		d, _ := proxy.SOCKS5("tcp", addr, a, proxy.Direct)
+		c, err := d.Dial("tcp", dest)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(&proxy.Auth{User: "alice", Password: "wonder"}); err != nil {
+		t.Errorf("alice: %s", err)
+	}
+	if err := dial(&proxy.Auth{User: "alice", Password: "nope"}); err == nil {
+		t.Errorf("bad password accepted")
+	}
+	if err := dial(nil); err == nil {
+		t.Errorf("no credentials accepted")
+	}
+}
+
+// Clients and users with too many failed logins are refused for a while
+func TestAuthBan(t *testing.T) {
+	ac := authConf(t)
+	ac.Fails = 3
+	addr := startHTTPProxy(t, &ListenConf{Auth: ac})
+	echo := startEcho(t)
+
+	connect := func(user, pass string) *http.Response {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		req, _ := http.NewRequest("CONNECT", "http://"+echo.Addr().String(), nil)
+		req.Host = echo.Addr().String()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		req.Write(c)
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := connect("alice", "wonder"); res.StatusCode != 200 {
+		t.Fatalf("alice: %d", res.StatusCode)
+	}
+	for i := 0; i < ac.Fails; i++ {
+		if res := connect("mallory", "guess"); res.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("failure %d: %d", i, res.StatusCode)
+		}
+	}
+	res := connect("alice", "wonder")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != strconv.Itoa(AUTH_BAN) {
+		t.Errorf("banned client: %d %v", res.StatusCode, res.Header)
+	}
+
+	// a user is banned whatever client it comes from; a login that works
+	// forgets the user's failures
+	g, err := newAuthGuard(&AuthConf{Fails: 2, Ban: 60}, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := func(n int) context.Context {
+		return withClient(context.Background(), net.IPv4(192, 0, 2, byte(n)))
+	}
+	g.fail(from(1), "bob")
+	g.ok("bob")
+	g.fail(from(2), "bob")
+	if err := g.check(from(3), "bob"); err != nil {
+		t.Errorf("bob after a login: %v", err)
+	}
+	g.fail(from(4), "bob")
+	err = g.check(from(5), "bob")
+	if pe := isDenied(err); pe == nil || pe.rule != AUTH_BAN_RULE || pe.dest != "user" ||
+		pe.retry <= 0 || pe.retry > time.Minute {
+		t.Errorf("bob: %v", err)
+	}
+	if err := g.check(from(5), "carol"); err != nil {
+		t.Errorf("carol: %v", err)
+	}
+	if g, _ := newAuthGuard(&AuthConf{}, "x"); g != nil || g.check(from(1), "bob") != nil {
+		t.Errorf("off: %v", g)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,241 @@
+// bench.go -- load a proxy with synthetic sessions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+)
+
+const (
+	// Default sessions at once, seconds of a run and bytes each
+	// session fetches
+	BENCH_CONC     = 16
+	BENCH_DURATION = 10
+	BENCH_DOWN     = 65536
+)
+
+// Sessions through a proxy to the sink, from 'conc' clients at once
+// until 'dur' passes or 'sessions' are done. Each client waits about
+// 'think' between its sessions.
+type bencher struct {
+	rp       *replayer
+	rec      logRecord // of every session: the method and bytes each way
+	conc     int
+	dur      time.Duration
+	sessions int // 0 is until 'dur'
+	think    time.Duration
+}
+
+// The outcome of a run
+type benchSummary struct {
+	Sessions   int      `json:"sessions"`
+	Errors     int      `json:"errors"`
+	Sent       int64    `json:"sent"`
+	Recv       int64    `json:"recv"`
+	Wall       float64  `json:"wall_seconds"`
+	Rate       float64  `json:"sessions_per_second"`
+	Throughput float64  `json:"bytes_per_second"` // sent and received
+	Latency    durStats `json:"latency"`
+}
+
+// Run the sessions; return how they went
+func (b *bencher) run() benchSummary {
+	defer b.rp.setup()()
+
+	var started int64
+	var mu sync.Mutex
+	var lat []time.Duration
+	var errs int
+	var wg sync.WaitGroup
+
+	t0 := time.Now()
+	end := t0.Add(b.dur)
+	for i := 0; i < b.conc; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for time.Now().Before(end) {
+				if b.sessions > 0 && atomic.AddInt64(&started, 1) > int64(b.sessions) {
+					return
+				}
+				rec := b.rec
+				r := b.rp.one(&rec)
+
+				mu.Lock()
+				if r.err != nil || r.status != http.StatusOK {
+					errs++
+				} else {
+					lat = append(lat, r.dur)
+				}
+				mu.Unlock()
+
+				// between half and one and a half times the think
+				// time, so clients don't keep in step
+				if b.think > 0 {
+					time.Sleep(b.think/2 + time.Duration(rnd.Int63n(int64(b.think))))
+				}
+			}
+		}(int64(i + 1))
+	}
+	wg.Wait()
+	wall := time.Since(t0)
+
+	s := benchSummary{
+		Sessions: len(lat) + errs,
+		Errors:   errs,
+		Sent:     int64(len(lat)) * b.rec.Sent,
+		Recv:     int64(len(lat)) * b.rec.Recv,
+		Wall:     wall.Seconds(),
+		Latency:  newDurStats(lat),
+	}
+	if s.Wall > 0 {
+		s.Rate = float64(s.Sessions) / s.Wall
+		s.Throughput = float64(s.Sent+s.Recv) / s.Wall
+	}
+	return s
+}
+
+// Write the summary 's', and how it compares with 'base' if that isn't
+// nil.
+func (s *benchSummary) print(w io.Writer, base *benchSummary) {
+	fmt.Fprintf(w, "sessions %d: %d errors in %.1fs, %.1f/s\n", s.Sessions, s.Errors, s.Wall, s.Rate)
+	fmt.Fprintf(w, "bytes: %d sent, %d received, %.1f MB/s\n", s.Sent, s.Recv, s.Throughput/1e6)
+	line := func(name string, d durStats) {
+		fmt.Fprintf(w, "%-10s p50 %9.1f ms  p90 %9.1f ms  p99 %9.1f ms  max %9.1f ms\n",
+			name, d.P50, d.P90, d.P99, d.Max)
+	}
+	line("latency", s.Latency)
+	if base != nil {
+		line("baseline", base.Latency)
+		pct := func(a, b float64) float64 {
+			if b == 0 {
+				return 0
+			}
+			return 100 * (a - b) / b
+		}
+		fmt.Fprintf(w, "vs baseline: throughput %+.1f%%, sessions/s %+.1f%%, p50 %+.1f%%, p99 %+.1f%%, errors %d -> %d\n",
+			pct(s.Throughput, base.Throughput), pct(s.Rate, base.Rate),
+			pct(s.Latency.P50, base.Latency.P50), pct(s.Latency.P99, base.Latency.P99),
+			base.Errors, s.Errors)
+	}
+}
+
+// The "bench" command: load a proxy with sessions to a sink of its own
+func benchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	hp := fs.StringP("http", "H", "", "HTTP proxy `URL` (http://[user:pass@]host:port)")
+	sp := fs.StringP("socks", "S", "", "SOCKS proxy `URL` (socks5://[user:pass@]host:port)")
+	mode := fs.StringP("mode", "m", "connect", "Sessions through the HTTP proxy are CONNECT tunnels or http `requests`")
+	conc := fs.IntP("concurrency", "c", BENCH_CONC, "Run `N` sessions at once")
+	dur := fs.IntP("duration", "d", BENCH_DURATION, "Run for `N` seconds")
+	num := fs.IntP("sessions", "n", 0, "Stop after `N` sessions")
+	up := fs.Int64("up", 0, "Send `N` bytes in each session")
+	down := fs.Int64("down", BENCH_DOWN, "Fetch `N` bytes in each session")
+	think := fs.Int("think", 0, "Pause about `N` milliseconds between the sessions of a client")
+	tmo := fs.IntP("timeout", "t", REPLAY_TIMEOUT, "Give each session at most `N` seconds")
+	sink := fs.String("sink", "127.0.0.1:0", "Serve the destination on `ADDR`")
+	dest := fs.String("dest", "", "Reach the sink as `HOST:PORT` through the proxy; default its address")
+	out := fs.String("json", "", "Write the summary to `FILE` as JSON")
+	bl := fs.String("baseline", "", "Compare with the summary in `FILE`")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s bench [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || (len(*hp) == 0) == (len(*sp) == 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *up < 0 || *down < 0 || *think < 0 || *dur <= 0 {
+		die("bench: sizes, think time and duration can't be negative")
+	}
+
+	b := &bencher{
+		rp:       &replayer{conc: *conc, timeout: time.Duration(*tmo) * time.Second},
+		rec:      logRecord{Sent: *up, Recv: *down},
+		conc:     *conc,
+		dur:      time.Duration(*dur) * time.Second,
+		sessions: *num,
+		think:    time.Duration(*think) * time.Millisecond,
+	}
+	if b.conc <= 0 {
+		b.conc = 1
+		b.rp.conc = 1
+	}
+
+	var err error
+	switch {
+	case len(*sp) > 0:
+		if b.rp.socks, err = url.Parse(*sp); err != nil || b.rp.socks.Scheme != "socks5" {
+			die("bench: %s: not a socks5:// URL", *sp)
+		}
+		b.rec.Method = "SOCKS"
+	default:
+		if b.rp.http, err = url.Parse(*hp); err != nil || b.rp.http.Scheme != "http" {
+			die("bench: %s: not an http:// URL", *hp)
+		}
+		switch *mode {
+		case "connect":
+			b.rec.Method = "CONNECT"
+		case "http":
+			b.rec.Method = "GET"
+			if b.rec.Sent > 0 {
+				b.rec.Method = "POST"
+			}
+		default:
+			die("bench: unknown mode %q", *mode)
+		}
+	}
+
+	var base *benchSummary
+	if len(*bl) > 0 {
+		v, err := os.ReadFile(*bl)
+		if err != nil {
+			die("bench: %s", err)
+		}
+		base = &benchSummary{}
+		if err := json.Unmarshal(v, base); err != nil {
+			die("bench: %s: %s", *bl, err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", *sink)
+	if err != nil {
+		die("bench: sink: %s", err)
+	}
+	go http.Serve(ln, http.HandlerFunc(serveSink))
+	b.rp.sink = ln.Addr().String()
+	if len(*dest) > 0 {
+		b.rp.sink = *dest
+	}
+
+	s := b.run()
+	s.print(os.Stdout, base)
+	if len(*out) > 0 {
+		v, _ := json.MarshalIndent(&s, "", "  ")
+		if err := os.WriteFile(*out, append(v, '\n'), 0644); err != nil {
+			die("bench: %s", err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,75 @@
+// bench_test.go -- tests for the bench command
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	addr := startHTTPProxy(t, &ListenConf{})
+	sx := startSocksProxy(t, &ListenConf{})
+
+	sink, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { sink.Close() })
+	go http.Serve(sink, http.HandlerFunc(serveSink))
+
+	hp := &url.URL{Scheme: "http", Host: addr}
+	sp := &url.URL{Scheme: "socks5", Host: sx}
+	for _, tc := range []struct {
+		method     string
+		http, sock *url.URL
+	}{
+		{"CONNECT", hp, nil},
+		{"POST", hp, nil},
+		{"SOCKS", nil, sp},
+	} {
+		b := &bencher{
+			rp:       &replayer{http: tc.http, socks: tc.sock, conc: 4, timeout: 5 * time.Second, sink: sink.Addr().String()},
+			rec:      logRecord{Method: tc.method, Sent: 1000, Recv: 5000},
+			conc:     4,
+			dur:      5 * time.Second,
+			sessions: 20,
+		}
+		s := b.run()
+		if s.Sessions != 20 || s.Errors != 0 || s.Sent != 20000 || s.Recv != 100000 ||
+			s.Latency.Max <= 0 || s.Throughput <= 0 {
+			t.Errorf("%s: %+v", tc.method, s)
+		}
+	}
+
+	// the think time paces the sessions; errors are counted
+	b := &bencher{
+		rp:    &replayer{http: hp, conc: 2, timeout: time.Second, sink: "127.0.0.1:1"},
+		rec:   logRecord{Method: "GET", Recv: 10},
+		conc:  2,
+		dur:   300 * time.Millisecond,
+		think: 100 * time.Millisecond,
+	}
+	s := b.run()
+	if s.Sessions < 2 || s.Sessions > 12 || s.Errors != s.Sessions || s.Recv != 0 {
+		t.Errorf("think: %+v", s)
+	}
+
+	var w strings.Builder
+	s.print(&w, &s)
+	if !strings.Contains(w.String(), "vs baseline: throughput +0.0%") {
+		t.Errorf("print: %s", w.String())
+	}
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,807 @@
+// cache.go -- HTTP response cache (RFC 9111) for the forward proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/golang-lru"
+)
+
+// Cache defaults (MB)
+const (
+	CACHE_DISK      = 1024
+	CACHE_MAXOBJECT = 64
+)
+
+// Number of URLs we track; responses of other URLs can't be found
+const CACHE_URLS = 131072
+
+// Limit of the heuristic freshness lifetime (10% of the time since
+// Last-Modified)
+const CACHE_HEURISTIC_MAX = 24 * time.Hour
+
+var errTooBig = errors.New("response too large to cache")
+
+// A shared cache of GET responses. Small responses are kept in memory;
+// with a cache directory, larger ones and those evicted from memory are
+// kept on disk.
+type httpCache struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	lookups     uint64
+	hits        uint64
+	revalidated uint64
+	stores      uint64
+	served      uint64
+
+	sync.Mutex
+
+	mem  *cacheTier
+	disk *cacheTier // nil if memory only
+
+	// *cacheURL by URL
+	urls *lru.TwoQueueCache
+
+	maxObject int64 // largest response we store
+	memObject int64 // larger responses go to disk
+
+	name string
+	log  *L.Logger
+}
+
+// What we know of a URL: the request headers its responses vary on and
+// the time it was last invalidated.
+type cacheURL struct {
+	vary  []string
+	since time.Time
+}
+
+// Return a new cache or nil if 'cc' doesn't enable one
+func newHTTPCache(cc *CacheConf, name string, log *L.Logger) (*httpCache, error) {
+	if cc.Memory <= 0 && len(cc.Dir) == 0 {
+		return nil, nil
+	}
+
+	urls, err := lru.New2Q(CACHE_URLS)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &httpCache{
+		mem:       newTier(cc.Memory<<20, ""),
+		urls:      urls,
+		maxObject: cc.MaxObject << 20,
+		name:      name,
+		log:       log,
+	}
+
+	if c.maxObject <= 0 {
+		c.maxObject = CACHE_MAXOBJECT << 20
+	}
+	c.memObject = c.mem.max / 8
+	if c.memObject > c.maxObject {
+		c.memObject = c.maxObject
+	}
+
+	if len(cc.Dir) > 0 {
+		sz := cc.Disk
+		if sz <= 0 {
+			sz = CACHE_DISK
+		}
+
+		if err := os.MkdirAll(cc.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("cache: %s", err)
+		}
+
+		c.disk = newTier(sz<<20, cc.Dir)
+		v, err := c.disk.load()
+		if err != nil {
+			return nil, fmt.Errorf("cache: %s", err)
+		}
+
+		for _, e := range v {
+			c.urls.Add(e.URL, &cacheURL{vary: e.Vary})
+		}
+		log.Info("cache: loaded %d responses (%d MB) from %s", len(v), c.disk.size>>20, cc.Dir)
+	}
+	return c, nil
+}
+
+// A stored response found for a request. Its body is kept open so that it
+// can't vanish while it is being validated.
+type cacheHit struct {
+	*cacheEntry
+	body  cacheBody
+	fresh bool
+}
+
+func (h *cacheHit) Close() {
+	h.body.Close()
+}
+
+// Find a stored response for 'r'. If it is fresh, it can be served as is;
+// else it must be validated first. Return nil if there is none.
+func (c *httpCache) lookup(r *http.Request) *cacheHit {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return nil
+	}
+
+	atomic.AddUint64(&c.lookups, 1)
+	url := r.URL.String()
+
+	c.Lock()
+	var e *cacheEntry
+	if v, ok := c.urls.Get(url); ok {
+		u := v.(*cacheURL)
+		key := varyKey(url, u.vary, r.Header)
+		if e = c.mem.get(key); e == nil && c.disk != nil {
+			e = c.disk.get(key)
+		}
+		if e != nil && e.ResTime.Before(u.since) {
+			e = nil
+		}
+	}
+	c.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	rq := requestControl(r.Header)
+	rs := parseCacheControl(e.Header)
+
+	// A response to another user's credentials is only shared if it
+	// says so
+	if len(r.Header.Get("Authorization")) > 0 && !rs.shared() {
+		return nil
+	}
+
+	fresh := e.fresh(rq, rs, time.Now())
+	if len(r.Header.Get("Range")) > 0 && (!fresh || !e.rangeable()) {
+		return nil
+	}
+	if !fresh && !e.validator() {
+		return nil
+	}
+
+	b, err := e.open()
+	if err != nil {
+		return nil
+	}
+	return &cacheHit{cacheEntry: e, body: b, fresh: fresh}
+}
+
+// Return true if 'r' only wants a stored response
+func onlyIfCached(r *http.Request) bool {
+	return requestControl(r.Header).has("only-if-cached")
+}
+
+// Make 'req' validate the stored response
+func (h *cacheHit) condition(req *http.Request) {
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if v := h.Header.Get("Etag"); len(v) > 0 {
+		req.Header.Set("If-None-Match", v)
+	}
+	if v := h.Header.Get("Last-Modified"); len(v) > 0 {
+		req.Header.Set("If-Modified-Since", v)
+	}
+}
+
+// Update the stored response from the 304 'res' (RFC 9111 4.3.4); the
+// request was sent at 't0' and the response received at 't1'.
+func (c *httpCache) refresh(h *cacheHit, res *http.Response, t0, t1 time.Time) {
+	e := *h.cacheEntry
+	e.Header = cloneHeader(h.Header)
+	e.Header.Del("Age")
+	for k, vv := range cleanHeaders(cloneHeader(res.Header)) {
+		if k != "Content-Length" {
+			e.Header[k] = vv
+		}
+	}
+	e.ReqTime, e.ResTime = t0, t1
+	h.cacheEntry = &e
+
+	if len(e.file) > 0 {
+		if err := c.disk.saveMeta(&e); err != nil {
+			c.log.Warn("cache: %s", err)
+			return
+		}
+	}
+	c.insert(&e)
+}
+
+// Write the stored response to 'w' and return the bytes written. 'how'
+// goes in the X-Cache header.
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, h *cacheHit, how string) int64 {
+	hdr := w.Header()
+	copyHeader(hdr, h.Header)
+	hdr.Set("Age", strconv.FormatInt(int64(h.age(time.Now())/time.Second), 10))
+	hdr.Set("X-Cache", how)
+	if h.Status != http.StatusNoContent {
+		hdr.Set("Content-Length", strconv.FormatInt(h.Size, 10))
+	}
+
+	cw := &countWriter{ResponseWriter: w}
+	if h.Status == http.StatusOK {
+		// handles conditional and range requests
+		lm, _ := http.ParseTime(h.Header.Get("Last-Modified"))
+		http.ServeContent(cw, r, "", lm, h.body)
+	} else {
+		cw.WriteHeader(h.Status)
+		if r.Method != "HEAD" {
+			io.Copy(cw, h.body)
+		}
+	}
+
+	if how == "HIT" {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.revalidated, 1)
+	}
+	atomic.AddUint64(&c.served, uint64(cw.n))
+	return cw.n
+}
+
+type countWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unsafe requests invalidate the stored responses of their target and of
+// the Location and Content-Location of a successful response (RFC 9111
+// 4.4).
+func (c *httpCache) invalidate(r *http.Request, res *http.Response) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return
+	}
+
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+
+	c.drop(r.URL.String(), now)
+	for _, k := range []string{"Location", "Content-Location"} {
+		if v := res.Header.Get(k); len(v) > 0 {
+			if u, err := r.URL.Parse(v); err == nil && u.Host == r.URL.Host {
+				c.drop(u.String(), now)
+			}
+		}
+	}
+}
+
+// Invalidate all responses of 'url'; called with the lock held
+func (c *httpCache) drop(url string, now time.Time) {
+	if v, ok := c.urls.Get(url); ok {
+		v.(*cacheURL).since = now
+	}
+}
+
+// Collects the body of a response for the cache as it is relayed to the
+// client. Bodies that outgrow the memory tier continue on disk.
+type cacheFill struct {
+	c *httpCache
+	e *cacheEntry
+
+	buf  bytes.Buffer
+	fd   *os.File
+	n    int64
+	want int64 // Content-Length; -1 if unknown
+	err  error // set once the fill is abandoned
+}
+
+// Start storing 'res' if it may be stored; else return nil. The request
+// was sent at 't0' and the response received at 't1'.
+func (c *httpCache) fill(r *http.Request, res *http.Response, t0, t1 time.Time) *cacheFill {
+	if !c.storable(r, res) || res.ContentLength > c.maxObject {
+		return nil
+	}
+
+	url := r.URL.String()
+	vary, _ := varyNames(res.Header)
+	f := &cacheFill{
+		c: c,
+		e: &cacheEntry{
+			Key:     varyKey(url, vary, r.Header),
+			URL:     url,
+			Vary:    vary,
+			Status:  res.StatusCode,
+			Header:  cleanHeaders(cloneHeader(res.Header)),
+			ReqTime: t0,
+			ResTime: t1,
+		},
+		want: res.ContentLength,
+	}
+
+	if c.memObject == 0 || res.ContentLength > c.memObject {
+		if c.disk == nil {
+			return nil
+		}
+		if f.err = f.spill(); f.err != nil {
+			c.log.Warn("cache: %s", f.err)
+			return nil
+		}
+	}
+	return f
+}
+
+// Write never fails; a body that can't be stored is just not stored.
+func (f *cacheFill) Write(b []byte) (int, error) {
+	if f.err == nil {
+		f.err = f.add(b)
+	}
+	return len(b), nil
+}
+
+func (f *cacheFill) add(b []byte) error {
+	f.n += int64(len(b))
+	if f.n > f.c.maxObject {
+		return errTooBig
+	}
+
+	if f.fd == nil && f.n > f.c.memObject {
+		if f.c.disk == nil {
+			return errTooBig
+		}
+		if err := f.spill(); err != nil {
+			f.c.log.Warn("cache: %s", err)
+			return err
+		}
+	}
+
+	if f.fd != nil {
+		_, err := f.fd.Write(b)
+		return err
+	}
+	f.buf.Write(b)
+	return nil
+}
+
+// Move the body collected so far to a file on the disk tier
+func (f *cacheFill) spill() error {
+	fd, err := ioutil.TempFile(f.c.disk.dir, "fill-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(f.buf.Bytes()); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+
+	f.fd = fd
+	f.buf = bytes.Buffer{}
+	return nil
+}
+
+// The relay of the body has ended; store the response if the body is
+// complete.
+func (f *cacheFill) commit(ok bool) {
+	if ok && f.err == nil && (f.want < 0 || f.n == f.want) {
+		f.err = f.c.store(f)
+		if f.err == nil {
+			return
+		}
+		f.c.log.Warn("cache: %s", f.err)
+	}
+
+	if f.fd != nil {
+		f.fd.Close()
+		os.Remove(f.fd.Name())
+	}
+}
+
+func (c *httpCache) store(f *cacheFill) error {
+	e := f.e
+	e.Size = f.n
+
+	if f.fd != nil {
+		e.file = c.disk.bodyName(e.Key)
+		err := f.fd.Close()
+		if err == nil {
+			err = os.Rename(f.fd.Name(), e.file)
+		}
+		if err == nil {
+			f.fd = nil
+			err = c.disk.saveMeta(e)
+		}
+		if err != nil {
+			os.Remove(e.file)
+			return err
+		}
+	} else {
+		e.body = append([]byte(nil), f.buf.Bytes()...)
+	}
+
+	c.Lock()
+	v, ok := c.urls.Get(e.URL)
+	switch {
+	case !ok:
+		c.urls.Add(e.URL, &cacheURL{vary: e.Vary, since: e.ResTime})
+	case e.ResTime.Before(v.(*cacheURL).since):
+		// invalidated while we were fetching it
+		c.Unlock()
+		discard(e)
+		return nil
+	case !sameNames(v.(*cacheURL).vary, e.Vary):
+		c.urls.Add(e.URL, &cacheURL{vary: e.Vary, since: e.ResTime})
+	}
+	c.Unlock()
+
+	c.insert(e)
+	atomic.AddUint64(&c.stores, 1)
+	return nil
+}
+
+// Put 'e' in its tier and drop any other copy of it. Responses evicted
+// from memory move to disk.
+func (c *httpCache) insert(e *cacheEntry) {
+	var lost, ev []*cacheEntry
+	var old *cacheEntry
+
+	c.Lock()
+	if len(e.file) > 0 {
+		c.mem.remove(e.Key)
+		old, lost = c.disk.add(e)
+	} else {
+		if c.disk != nil {
+			old = c.disk.remove(e.Key)
+		}
+		_, ev = c.mem.add(e)
+	}
+	c.Unlock()
+
+	if old != nil && old.file != e.file {
+		discard(old)
+	}
+	discard(lost...)
+
+	if c.disk != nil && len(ev) > 0 {
+		go c.demote(ev)
+	}
+}
+
+// Move responses evicted from memory to disk
+func (c *httpCache) demote(v []*cacheEntry) {
+	for _, e := range v {
+		d, err := c.disk.write(e)
+		if err != nil {
+			c.log.Warn("cache: %s", err)
+			return
+		}
+
+		c.Lock()
+		if c.mem.has(e.Key) || c.disk.has(e.Key) {
+			// a newer copy is already there
+			c.Unlock()
+			discard(d)
+			continue
+		}
+		_, lost := c.disk.add(d)
+		c.Unlock()
+		discard(lost...)
+	}
+}
+
+// Return true if 'res' (the response to 'r') may be stored (RFC 9111 3)
+func (c *httpCache) storable(r *http.Request, res *http.Response) bool {
+	if r.Method != "GET" || len(r.Header.Get("Range")) > 0 {
+		return false
+	}
+
+	rq := requestControl(r.Header)
+	rs := parseCacheControl(res.Header)
+	if rq.has("no-store") || rs.has("no-store") || rs.has("private") {
+		return false
+	}
+
+	if len(r.Header.Get("Authorization")) > 0 && !rs.shared() {
+		return false
+	}
+
+	// Cookies are someone's state; only store them if told so
+	if len(res.Header.Get("Set-Cookie")) > 0 && !rs.has("public") {
+		return false
+	}
+
+	if _, star := varyNames(res.Header); star {
+		return false
+	}
+
+	explicit := rs.has("max-age") || rs.has("s-maxage") || rs.has("public") ||
+		len(res.Header.Get("Expires")) > 0
+
+	switch res.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		lm := len(res.Header.Get("Last-Modified")) > 0
+		return explicit || lm || len(res.Header.Get("Etag")) > 0
+	case 302, 307:
+		return explicit
+	}
+	return false
+}
+
+// Return true if the stored response can be used for 'r' without
+// validation (RFC 9111 4.2); 'rq' and 'rs' are the cache directives of
+// the request and the stored response.
+func (e *cacheEntry) fresh(rq, rs cacheControl, now time.Time) bool {
+	if rq.has("no-cache") || rs.has("no-cache") {
+		return false
+	}
+
+	life := e.lifetime(rs)
+	age := e.age(now)
+	if d, ok := rq.secs("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := rq.secs("min-fresh"); ok {
+		life -= d
+	}
+	if life > age {
+		return true
+	}
+
+	// stale; the client may accept it
+	if rs.has("must-revalidate") || rs.has("proxy-revalidate") || rs.has("s-maxage") {
+		return false
+	}
+	if v, ok := rq["max-stale"]; ok {
+		if len(v) == 0 {
+			return true
+		}
+		d, _ := rq.secs("max-stale")
+		return age-life <= d
+	}
+	return false
+}
+
+// Freshness lifetime (RFC 9111 4.2.1)
+func (e *cacheEntry) lifetime(rs cacheControl) time.Duration {
+	if d, ok := rs.secs("s-maxage"); ok {
+		return d
+	}
+	if d, ok := rs.secs("max-age"); ok {
+		return d
+	}
+
+	date := e.date()
+	if v := e.Header.Get("Expires"); len(v) > 0 {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+
+	switch e.Status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+	default:
+		return 0
+	}
+
+	d := date.Sub(lm) / 10
+	if d > CACHE_HEURISTIC_MAX {
+		d = CACHE_HEURISTIC_MAX
+	}
+	return d
+}
+
+// Current age (RFC 9111 4.2.3)
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+
+	var av time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		av = time.Duration(n) * time.Second
+	}
+
+	corrected := av + e.ResTime.Sub(e.ReqTime)
+	if corrected > apparent {
+		apparent = corrected
+	}
+	return apparent + now.Sub(e.ResTime)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResTime
+}
+
+// Return true if the stored response can be validated with the origin
+func (e *cacheEntry) validator() bool {
+	return len(e.Header.Get("Etag")) > 0 || len(e.Header.Get("Last-Modified")) > 0
+}
+
+// Return true if range requests can be served from the stored response
+func (e *cacheEntry) rangeable() bool {
+	return e.Status == http.StatusOK && len(e.Header.Get("Content-Encoding")) == 0
+}
+
+// Cache-Control directives (lower case) and their values
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, s := range h["Cache-Control"] {
+		for _, d := range strings.Split(s, ",") {
+			d = strings.TrimSpace(d)
+			if len(d) == 0 {
+				continue
+			}
+
+			var v string
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				d, v = strings.TrimSpace(d[:i]), strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			cc[strings.ToLower(d)] = v
+		}
+	}
+	return cc
+}
+
+// Request directives; a Pragma: no-cache counts if there is no
+// Cache-Control
+func requestControl(h http.Header) cacheControl {
+	cc := parseCacheControl(h)
+	if len(h["Cache-Control"]) == 0 && strings.Contains(h.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// Value of a delta-seconds directive; an invalid value is zero
+func (cc cacheControl) secs(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Return true if a response to an authorized request may be shared
+func (cc cacheControl) shared() bool {
+	return cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+}
+
+// Return the sorted header names in Vary and whether it has "*"
+func varyNames(h http.Header) ([]string, bool) {
+	var v []string
+	seen := make(map[string]bool)
+	for _, s := range h["Vary"] {
+		for _, nm := range strings.Split(s, ",") {
+			nm = strings.TrimSpace(nm)
+			if nm == "*" {
+				return nil, true
+			}
+			if len(nm) == 0 {
+				continue
+			}
+
+			nm = http.CanonicalHeaderKey(nm)
+			if !seen[nm] {
+				seen[nm] = true
+				v = append(v, nm)
+			}
+		}
+	}
+	sort.Strings(v)
+	return v, false
+}
+
+// Key of the response to 'url' for a request with header 'h'
+func varyKey(url string, vary []string, h http.Header) string {
+	if len(vary) == 0 {
+		return url
+	}
+
+	var b strings.Builder
+	b.WriteString(url)
+	for _, nm := range vary {
+		b.WriteString("\n")
+		b.WriteString(nm)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(h[nm], ","))
+	}
+	return b.String()
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Cache metrics for the admin listener
+func (c *httpCache) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", c.name)
+
+	c.Lock()
+	tiers := []struct {
+		name string
+		t    *cacheTier
+	}{{"memory", c.mem}, {"disk", c.disk}}
+
+	var m []metric
+	for _, x := range tiers {
+		if x.t == nil {
+			continue
+		}
+
+		tl := fmt.Sprintf("%s,tier=%q", l, x.name)
+		m = append(m,
+			metric{"goproxy_cache_bytes", "gauge", "Bytes of stored responses", tl, float64(x.t.size)},
+			metric{"goproxy_cache_objects", "gauge", "Stored responses", tl, float64(x.t.lru.Len())},
+			metric{"goproxy_cache_evictions_total", "counter", "Responses evicted", tl, float64(x.t.evict)})
+	}
+	c.Unlock()
+
+	return append(m,
+		metric{"goproxy_cache_lookups_total", "counter", "GET and HEAD requests looked up", l,
+			float64(atomic.LoadUint64(&c.lookups))},
+		metric{"goproxy_cache_hits_total", "counter", "Fresh responses served from the cache", l,
+			float64(atomic.LoadUint64(&c.hits))},
+		metric{"goproxy_cache_revalidated_total", "counter", "Stale responses served after a 304 from the origin", l,
+			float64(atomic.LoadUint64(&c.revalidated))},
+		metric{"goproxy_cache_stores_total", "counter", "Responses stored", l,
+			float64(atomic.LoadUint64(&c.stores))},
+		metric{"goproxy_cache_served_bytes_total", "counter", "Bytes served from the cache", l,
+			float64(atomic.LoadUint64(&c.served))})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,283 @@
+// cachestore.go -- memory and disk tiers of the HTTP cache
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A stored response. On the disk tier the body is in 'file' and the
+// rest is saved as JSON in 'file'.meta.
+type cacheEntry struct {
+	Key     string      `json:"key"`
+	URL     string      `json:"url"`
+	Vary    []string    `json:"vary"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	ReqTime time.Time   `json:"reqtime"`
+	ResTime time.Time   `json:"restime"`
+	Size    int64       `json:"size"`
+
+	body []byte // memory tier
+	file string // disk tier
+}
+
+// An open body of a stored response
+type cacheBody interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type memBody struct {
+	*bytes.Reader
+}
+
+func (m memBody) Close() error { return nil }
+
+func (e *cacheEntry) open() (cacheBody, error) {
+	if len(e.file) == 0 {
+		return memBody{bytes.NewReader(e.body)}, nil
+	}
+	return os.Open(e.file)
+}
+
+// Bytes charged to the tier holding 'e'
+func (e *cacheEntry) cost() int64 {
+	n := e.Size + int64(len(e.Key))
+	if len(e.file) > 0 {
+		return n
+	}
+	for k, vv := range e.Header {
+		for _, v := range vv {
+			n += int64(len(k) + len(v) + 4)
+		}
+	}
+	return n
+}
+
+// A byte bounded LRU of stored responses. It is not safe for concurrent
+// use; httpCache serializes access.
+type cacheTier struct {
+	max   int64
+	size  int64
+	evict uint64
+
+	lru *list.List
+	idx map[string]*list.Element
+
+	dir string // disk tier only
+}
+
+func newTier(max int64, dir string) *cacheTier {
+	return &cacheTier{
+		max: max,
+		lru: list.New(),
+		idx: make(map[string]*list.Element),
+		dir: dir,
+	}
+}
+
+// Return the entry for 'key' (or nil) and mark it recently used
+func (t *cacheTier) get(key string) *cacheEntry {
+	if el, ok := t.idx[key]; ok {
+		t.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+func (t *cacheTier) has(key string) bool {
+	_, ok := t.idx[key]
+	return ok
+}
+
+// Add 'e'; return the entry it replaced (if any) and the entries evicted
+// to make room for it.
+func (t *cacheTier) add(e *cacheEntry) (old *cacheEntry, ev []*cacheEntry) {
+	old = t.remove(e.Key)
+
+	t.idx[e.Key] = t.lru.PushFront(e)
+	t.size += e.cost()
+
+	for t.size > t.max && t.lru.Len() > 0 {
+		x := t.lru.Back().Value.(*cacheEntry)
+		t.remove(x.Key)
+		t.evict++
+		ev = append(ev, x)
+	}
+	return old, ev
+}
+
+func (t *cacheTier) remove(key string) *cacheEntry {
+	el, ok := t.idx[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	t.lru.Remove(el)
+	delete(t.idx, key)
+	t.size -= e.cost()
+	return e
+}
+
+// Delete the files of entries that are gone from the disk tier
+func discard(v ...*cacheEntry) {
+	for _, e := range v {
+		if e != nil && len(e.file) > 0 {
+			os.Remove(e.file + ".meta")
+			os.Remove(e.file)
+		}
+	}
+}
+
+// Return a new body file name for 'key'
+func (t *cacheTier) bodyName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	s := fmt.Sprintf("%s-%d", hex.EncodeToString(h[:12]), time.Now().UnixNano())
+	return filepath.Join(t.dir, s)
+}
+
+// Save everything but the body of 'e' next to its body file
+func (t *cacheTier) saveMeta(e *cacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(t.dir, "meta-")
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(b)
+	if err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), e.file+".meta")
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// Write the body of the memory entry 'e' to a new file and return the
+// disk entry for it.
+func (t *cacheTier) write(e *cacheEntry) (*cacheEntry, error) {
+	d := *e
+	d.body = nil
+	d.file = t.bodyName(e.Key)
+
+	if err := ioutil.WriteFile(d.file, e.body, 0600); err != nil {
+		os.Remove(d.file)
+		return nil, err
+	}
+	if err := t.saveMeta(&d); err != nil {
+		os.Remove(d.file)
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Rebuild the disk tier from its directory. Incomplete entries and
+// temporary files left behind by an unclean shutdown are removed. Return
+// the entries loaded, oldest first.
+func (t *cacheTier) load() ([]*cacheEntry, error) {
+	names, err := filepath.Glob(filepath.Join(t.dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	var v []*cacheEntry
+	for _, nm := range names {
+		if !strings.HasSuffix(nm, ".meta") {
+			continue
+		}
+
+		e, err := readMeta(nm)
+		if err != nil {
+			continue
+		}
+
+		fi, err := os.Stat(e.file)
+		if err != nil || fi.Size() != e.Size {
+			continue
+		}
+
+		keep[nm] = true
+		keep[e.file] = true
+		v = append(v, e)
+	}
+
+	for _, nm := range names {
+		if !keep[nm] {
+			os.Remove(nm)
+		}
+	}
+
+	sort.Slice(v, func(i, j int) bool {
+		return v[i].ResTime.Before(v[j].ResTime)
+	})
+
+	var lost []*cacheEntry
+	for _, e := range v {
+		old, ev := t.add(e)
+		lost = append(lost, ev...)
+		lost = append(lost, old)
+	}
+	t.evict = 0
+	discard(lost...)
+
+	// only the survivors
+	w := v[:0]
+	for _, e := range v {
+		if t.has(e.Key) && t.idx[e.Key].Value == e {
+			w = append(w, e)
+		}
+	}
+	return w, nil
+}
+
+func readMeta(nm string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if len(e.Key) == 0 || len(e.URL) == 0 {
+		return nil, fmt.Errorf("%s: incomplete cache entry", nm)
+	}
+
+	e.file = strings.TrimSuffix(nm, ".meta")
+	return &e, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
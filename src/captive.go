@@ -0,0 +1,244 @@
+// captive.go -- click-through terms for guest networks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Host name of the terms page; requests to it never leave the proxy
+	CAPTIVE_HOST = "goproxy.captive"
+
+	// Default seconds an acceptance lasts
+	CAPTIVE_TTL = 3600
+)
+
+// SOCKS clients of a mixed listener that haven't accepted the terms
+var errTerms = newError(ErrDestDenied, "terms of use not accepted")
+
+// The page shown if the config names none
+const captiveHTML = `<!DOCTYPE html>
+<html><head><title>Terms of use</title></head>
+<body>
+<h1>Terms of use</h1>
+<p>This network is provided as is. By going on you agree to use it lawfully
+and to have your use of it logged.</p>
+<form method="POST" action="{{.Accept}}">
+<input type="hidden" name="url" value="{{.URL}}">
+<button type="submit">Accept</button>
+</form>
+<p>Access lasts {{.TTL}}.</p>
+</body></html>
+`
+
+// The data of the terms page template
+type captivePage struct {
+	URL    string // where the client was going
+	Accept string // the URL the form posts to
+	Client string
+	User   string
+	TTL    time.Duration
+}
+
+// Clients (or users) must accept the terms before they are proxied; each
+// acceptance lasts 'ttl'.
+type captive struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	shown    uint64
+	accepted uint64
+
+	host string
+	ttl  time.Duration
+	page *template.Template
+	name string
+	skey string // prefix of the keys in the shared state
+
+	sync.Mutex
+	until map[string]time.Time
+}
+
+// Return the captive portal of 'cc'; nil if it is off
+func newCaptive(cc *CaptiveConf, name, tenant string) (*captive, error) {
+	if !cc.Enable {
+		return nil, nil
+	}
+	c := &captive{
+		host:  cc.Host,
+		ttl:   time.Duration(cc.TTL) * time.Second,
+		name:  name,
+		skey:  "captive:",
+		until: make(map[string]time.Time),
+	}
+	if len(c.host) == 0 {
+		c.host = CAPTIVE_HOST
+	}
+	if len(tenant) > 0 {
+		c.skey += tenant + ":"
+	}
+	switch {
+	case cc.TTL < 0:
+		return nil, fmt.Errorf("captive: negative ttl %d", cc.TTL)
+	case cc.TTL == 0:
+		c.ttl = CAPTIVE_TTL * time.Second
+	}
+
+	var err error
+	if len(cc.Page) > 0 {
+		c.page, err = template.New(filepath.Base(cc.Page)).ParseFiles(cc.Page)
+	} else {
+		c.page, err = template.New("captive").Parse(captiveHTML)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("captive: %w", err)
+	}
+	return c, nil
+}
+
+// Return the key of an acceptance: the user if there is one, else the
+// client's address
+func captiveKey(user string, ip net.IP) string {
+	if len(user) > 0 {
+		return "user:" + user
+	}
+	return "ip:" + ip.String()
+}
+
+// Return true if the terms were accepted for 'key' and haven't expired
+func (c *captive) ok(key string) bool {
+	c.Lock()
+	t, ok := c.until[key]
+	c.Unlock()
+	if ok && time.Now().Before(t) {
+		return true
+	}
+	if shared != nil {
+		ok, _ := shared.banned(c.skey + key)
+		return ok
+	}
+	return false
+}
+
+// Record that 'key' accepted the terms; return when it expires
+func (c *captive) accept(key string) time.Time {
+	now := time.Now()
+	until := now.Add(c.ttl)
+
+	c.Lock()
+	for k, t := range c.until {
+		if now.After(t) {
+			delete(c.until, k)
+		}
+	}
+	c.until[key] = until
+	c.Unlock()
+
+	if shared != nil {
+		shared.ban(c.skey+key, c.ttl)
+	}
+	atomic.AddUint64(&c.accepted, 1)
+	return until
+}
+
+// Serve the terms to 'r' if it hasn't accepted them; return true if it
+// has and can go on.
+func (p *HTTPProxy) captivePortal(w http.ResponseWriter, r *http.Request) bool {
+	c := p.captive
+	ctx := r.Context()
+	key := captiveKey(userOf(ctx), clientOf(ctx))
+	if r.URL.Hostname() == c.host {
+		p.serveTerms(w, r, key)
+		return false
+	}
+	if c.ok(key) {
+		return true
+	}
+
+	// Browsers don't show the replies to CONNECT: those clients are
+	// told where to go and the next plain request is redirected
+	terms := "http://" + c.host + "/"
+	if r.Method != "GET" || r.URL.Scheme != "http" {
+		p.httpError(w, r, "Accept the terms of use at "+terms, http.StatusNetworkAuthenticationRequired, "")
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, terms+"?url="+url.QueryEscape(r.URL.String()), http.StatusFound)
+	return false
+}
+
+// Show the terms, or record their acceptance and send the client on to
+// where it was going
+func (p *HTTPProxy) serveTerms(w http.ResponseWriter, r *http.Request, key string) {
+	c := p.captive
+	log := logOf(r.Context(), p.log)
+	next := r.FormValue("url")
+	if u, err := url.Parse(next); err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		next = ""
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/accept":
+		until := c.accept(key)
+		log.Info("%s: %s accepted the terms until %s", r.RemoteAddr, key, until.UTC().Format(time.RFC3339))
+		if len(next) == 0 {
+			http.Error(w, "Thank you; you may browse now", http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		d := &captivePage{
+			URL:    next,
+			Accept: "http://" + c.host + "/accept",
+			Client: r.RemoteAddr,
+			User:   userOf(r.Context()),
+			TTL:    c.ttl,
+		}
+		var b bytes.Buffer
+		if err := c.page.Execute(&b, d); err != nil {
+			log.Warn("captive: %s: %s", c.page.Name(), err)
+			http.Error(w, "Terms page unavailable", http.StatusInternalServerError)
+			return
+		}
+		atomic.AddUint64(&c.shown, 1)
+		h := w.Header()
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Cache-Control", "no-store")
+		w.Write(b.Bytes())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *captive) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", c.name)
+	c.Lock()
+	n := len(c.until)
+	c.Unlock()
+	return []metric{
+		{"goproxy_captive_shown_total", "counter", "Terms pages shown", l,
+			float64(atomic.LoadUint64(&c.shown))},
+		{"goproxy_captive_accepted_total", "counter", "Acceptances of the terms", l,
+			float64(atomic.LoadUint64(&c.accepted))},
+		{"goproxy_captive_clients", "gauge", "Clients and users with an acceptance (some expired)", l,
+			float64(n)},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,158 @@
+// captive_test.go -- tests for the click-through terms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/net/proxy"
+)
+
+func TestCaptive(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+	echo := startEcho(t)
+
+	addr := startHTTPProxy(t, &ListenConf{Mixed: true, Captive: CaptiveConf{Enable: true}})
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(pu)},
+		Timeout:   5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	do := func(method, u string, form url.Values) (*http.Response, string) {
+		var res *http.Response
+		var err error
+		if form != nil {
+			res, err = hc.PostForm(u, form)
+		} else {
+			req, _ := http.NewRequest(method, u, nil)
+			res, err = hc.Do(req)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(b)
+	}
+	socks := func() error {
+		d, _ := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+		c, err := d.Dial("tcp", echo.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	// not accepted: redirected, CONNECT and SOCKS refused
+	res, _ := do("GET", origin.URL+"/x", nil)
+	loc := res.Header.Get("Location")
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(loc, "http://"+CAPTIVE_HOST+"/?url=") {
+		t.Fatalf("redirect: %d %q", res.StatusCode, loc)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\n\r\n")
+		b := make([]byte, 12)
+		io.ReadFull(c, b)
+		if string(b) != "HTTP/1.1 511" {
+			t.Errorf("connect: %q", b)
+		}
+		c.Close()
+	}
+	if socks() == nil {
+		t.Errorf("socks: no error")
+	}
+
+	// the terms, then accept them
+	res, body := do("GET", loc, nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `action="http://goproxy.captive/accept"`) ||
+		!strings.Contains(body, `value="`+origin.URL+`/x"`) {
+		t.Fatalf("terms: %d %s", res.StatusCode, body)
+	}
+	res, _ = do("POST", "http://"+CAPTIVE_HOST+"/accept", url.Values{"url": {origin.URL + "/x"}})
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != origin.URL+"/x" {
+		t.Fatalf("accept: %d %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	if res, body := do("GET", origin.URL, nil); res.StatusCode != 200 || body != "origin" {
+		t.Errorf("accepted: %d %q", res.StatusCode, body)
+	}
+	if err := socks(); err != nil {
+		t.Errorf("socks accepted: %s", err)
+	}
+
+	// no open redirects
+	res, _ = do("POST", "http://"+CAPTIVE_HOST+"/accept", url.Values{"url": {"javascript:alert(1)"}})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("bad url: %d %q", res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestCaptiveExpiry(t *testing.T) {
+	c, err := newCaptive(&CaptiveConf{Enable: true, TTL: 60}, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := captiveKey("", net.ParseIP("10.0.0.1"))
+	if c.ok(key) {
+		t.Fatalf("accepted before accepting")
+	}
+	if until := c.accept(key); until.Sub(time.Now()) < 59*time.Second || !c.ok(key) {
+		t.Fatalf("not accepted until %s", until)
+	}
+	if c.ok(captiveKey("alice", net.ParseIP("10.0.0.1"))) {
+		t.Errorf("user shares the client's acceptance")
+	}
+
+	c.until[key] = time.Now().Add(-time.Second)
+	if c.ok(key) {
+		t.Errorf("expired acceptance")
+	}
+	c.accept("user:bob")
+	if _, ok := c.until[key]; ok {
+		t.Errorf("expired acceptance kept")
+	}
+}
+
+func TestCaptiveConf(t *testing.T) {
+	if c, err := newCaptive(&CaptiveConf{}, "x", ""); c != nil || err != nil {
+		t.Errorf("off: %v %v", c, err)
+	}
+	for _, cc := range []CaptiveConf{
+		{Enable: true, TTL: -1},
+		{Enable: true, Page: "/nonexistent/terms.html"},
+		{Enable: true, Page: writePage(t, "bad.html", "{{.URL")},
+	} {
+		if _, err := newCaptive(&cc, "x", ""); err == nil {
+			t.Errorf("%+v: no error", cc)
+		}
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewSocksv5Proxy(&ListenConf{Listen: "127.0.0.1:0",
+		Captive: CaptiveConf{Enable: true}}, log, nil); err == nil {
+		t.Errorf("captive on socks: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
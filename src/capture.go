@@ -0,0 +1,365 @@
+// capture.go -- pcapng captures of the bytes a tunnel relays
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default and most bytes of a capture; seconds a capture of the
+	// next matching tunnel waits for one by default
+	CAPTURE_BYTES = 16 * 1048576
+	CAPTURE_MAX   = 1024 * 1048576
+	CAPTURE_WAIT  = 600
+
+	// Most payload in a captured segment
+	CAPTURE_SEG = 32768
+
+	// pcapng block types and the link type of raw IP packets
+	PCAPNG_SHB     = 0x0a0d0d0a
+	PCAPNG_IDB     = 1
+	PCAPNG_EPB     = 6
+	LINKTYPE_RAW   = 101
+	PCAPNG_BYTEORD = 0x1a2b3c4d
+	TCP_FIN        = 0x01
+	TCP_SYN        = 0x02
+	TCP_PSH        = 0x08
+	TCP_ACK        = 0x10
+)
+
+var (
+	errCaptureKernel = errors.New("capture: the tunnel is relayed in the kernel (sockmap)")
+	errCaptureBusy   = errors.New("capture: the tunnel is being captured")
+)
+
+// A capture of a tunnel: its bytes as the TCP segments of one connection
+// from the client to the destination with made up sequence numbers, so
+// Wireshark and friends can follow the stream and dissect the protocol
+// in it.
+type capture struct {
+	file string
+	max  int64 // bytes of payload
+
+	sync.Mutex
+	fd     *os.File
+	w      *bufio.Writer
+	addr   [2]*net.TCPAddr // client, destination
+	seq    [2]uint32       // next sequence number from each
+	shut   [2]bool         // FIN sent
+	n      int64
+	err    error
+	closed bool
+}
+
+// A capture of the next tunnel that matches
+type captureWant struct {
+	user, client, dest string // "" matches all; dest is a host pattern
+	until              time.Time
+	t                  *capture
+}
+
+// Captures waiting for a tunnel
+var captureWants = struct {
+	sync.Mutex
+	v []*captureWant
+}{}
+
+// Return a capture of at most 'max' bytes to a new file 'name' in 'dir'
+func newCapture(dir, name string, max int64) (*capture, error) {
+	fn := filepath.Join(dir, name)
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &capture{
+		file: fn,
+		max:  max,
+		fd:   fd,
+		w:    bufio.NewWriter(fd),
+		seq:  [2]uint32{1, 1},
+	}
+
+	// Section header and the one interface, both without options
+	var b [48]byte
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], PCAPNG_SHB)
+	le.PutUint32(b[4:], 28)
+	le.PutUint32(b[8:], PCAPNG_BYTEORD)
+	le.PutUint16(b[12:], 1)
+	le.PutUint16(b[14:], 0)
+	le.PutUint64(b[16:], ^uint64(0)) // section length unknown
+	le.PutUint32(b[24:], 28)
+
+	le.PutUint32(b[28:], PCAPNG_IDB)
+	le.PutUint32(b[32:], 20)
+	le.PutUint16(b[36:], LINKTYPE_RAW)
+	le.PutUint32(b[40:], 0) // no snap length
+	le.PutUint32(b[44:], 20)
+	if _, err := t.w.Write(b[:]); err != nil {
+		fd.Close()
+		os.Remove(fn)
+		return nil, err
+	}
+	return t, nil
+}
+
+// Start the capture of tunnel 'cp': a handshake opens the connection
+func (t *capture) start(cp *CancellableCopier) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.addr[0] = tcpAddrOf(cp.Lhs.RemoteAddr())
+	t.addr[1] = tcpAddrOf(cp.Rhs.RemoteAddr())
+	t.packet(0, TCP_SYN, nil)
+	t.seq[0]++
+	t.packet(1, TCP_SYN|TCP_ACK, nil)
+	t.seq[1]++
+	t.packet(0, TCP_ACK, nil)
+}
+
+func tcpAddrOf(a net.Addr) *net.TCPAddr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return ta
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// Add 'b', from the client if 'toRhs'
+func (t *capture) data(toRhs bool, b []byte) {
+	i := 1
+	if toRhs {
+		i = 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for len(b) > 0 && !t.closed {
+		n := len(b)
+		if n > CAPTURE_SEG {
+			n = CAPTURE_SEG
+		}
+		if left := t.max - t.n; int64(n) > left {
+			n = int(left)
+		}
+		if n == 0 {
+			t.close()
+			return
+		}
+
+		t.packet(i, TCP_PSH|TCP_ACK, b[:n])
+		t.seq[i] += uint32(n)
+		t.n += int64(n)
+		b = b[n:]
+	}
+}
+
+// The client (if 'toRhs') or the destination closed its half
+func (t *capture) fin(toRhs bool) {
+	i := 1
+	if toRhs {
+		i = 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.closed || t.shut[i] {
+		return
+	}
+	t.shut[i] = true
+	t.packet(i, TCP_FIN|TCP_ACK, nil)
+	t.seq[i]++
+}
+
+// Finish the file
+func (t *capture) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	t.close()
+	return t.err
+}
+
+func (t *capture) close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if err := t.w.Flush(); err != nil && t.err == nil {
+		t.err = err
+	}
+	if err := t.fd.Close(); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+// Write a segment from end 'i' with 'flags' and 'payload'; the caller
+// holds the lock.
+func (t *capture) packet(i int, flags byte, payload []byte) {
+	if t.closed || t.err != nil {
+		return
+	}
+
+	src, dst := t.addr[i], t.addr[1-i]
+	s4, d4 := src.IP.To4(), dst.IP.To4()
+	v4 := s4 != nil && d4 != nil
+
+	hl := 40
+	if v4 {
+		hl = 20
+	}
+	pkt := make([]byte, hl+20+len(payload))
+	be := binary.BigEndian
+
+	tcp := pkt[hl:]
+	be.PutUint16(tcp[0:], uint16(src.Port))
+	be.PutUint16(tcp[2:], uint16(dst.Port))
+	be.PutUint32(tcp[4:], t.seq[i])
+	if flags&TCP_ACK != 0 {
+		be.PutUint32(tcp[8:], t.seq[1-i])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	be.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	// the pseudo header of the checksum
+	var sum uint32
+	if v4 {
+		ip := pkt[:20]
+		ip[0] = 0x45
+		be.PutUint16(ip[2:], uint16(len(pkt)))
+		be.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		be.PutUint16(ip[10:], ^fold(csum(0, ip)))
+		sum = csum(csum(0, s4), d4)
+	} else {
+		ip := pkt[:40]
+		be.PutUint32(ip[0:], 6<<28)
+		be.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+		sum = csum(csum(0, ip[8:24]), ip[24:40])
+	}
+	sum += 6 + uint32(len(tcp))
+	be.PutUint16(tcp[16:], ^fold(csum(sum, tcp)))
+
+	// the enhanced packet block; time in microseconds
+	pad := (4 - len(pkt)%4) % 4
+	blen := 32 + len(pkt) + pad
+	us := uint64(time.Now().UnixNano() / 1000)
+	h := make([]byte, 28, blen)
+	le := binary.LittleEndian
+	le.PutUint32(h[0:], PCAPNG_EPB)
+	le.PutUint32(h[4:], uint32(blen))
+	le.PutUint32(h[8:], 0)
+	le.PutUint32(h[12:], uint32(us>>32))
+	le.PutUint32(h[16:], uint32(us))
+	le.PutUint32(h[20:], uint32(len(pkt)))
+	le.PutUint32(h[24:], uint32(len(pkt)))
+	h = append(h, pkt...)
+	h = append(h, make([]byte, pad)...)
+	h = le.AppendUint32(h, uint32(blen))
+	if _, err := t.w.Write(h); err != nil {
+		t.err = err
+	}
+}
+
+// Add the 16-bit words of 'b' to 'sum'
+func csum(sum uint32, b []byte) uint32 {
+	for len(b) > 1 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// Capture the next tunnel that 'w' matches
+func wantCapture(w *captureWant) {
+	captureWants.Lock()
+	captureWants.v = append(captureWants.v, w)
+	captureWants.Unlock()
+}
+
+// Return the capture waiting for tunnel 's', if any; captures that
+// waited too long are dropped.
+func (s *liveSession) wanted(now time.Time) *capture {
+	captureWants.Lock()
+	defer captureWants.Unlock()
+
+	var t *capture
+	v := captureWants.v[:0]
+	for _, w := range captureWants.v {
+		switch {
+		case now.After(w.until):
+			w.t.Close()
+			os.Remove(w.t.file)
+		case t == nil && w.match(s):
+			t = w.t
+		default:
+			v = append(v, w)
+		}
+	}
+	for i := len(v); i < len(captureWants.v); i++ {
+		captureWants.v[i] = nil
+	}
+	captureWants.v = v
+	return t
+}
+
+func (w *captureWant) match(s *liveSession) bool {
+	if len(w.user) > 0 && w.user != s.user {
+		return false
+	}
+	if len(w.client) > 0 && (s.client == nil || w.client != s.client.String()) {
+		return false
+	}
+	if len(w.dest) > 0 {
+		h := s.dest
+		if x, _, err := net.SplitHostPort(h); err == nil {
+			h = x
+		}
+		if ok, _ := path.Match(strings.ToLower(w.dest), strings.ToLower(h)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the name of a new capture file for a tunnel
+func captureName(id string, now time.Time) string {
+	return fmt.Sprintf("goproxy-%s-%s.pcapng", now.UTC().Format("20060102T150405"), id)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,211 @@
+// capture_test.go -- tests for tunnel packet captures
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// The payloads of a capture from the client and from the destination;
+// fail if the file or a checksum is wrong.
+func readCapture(t *testing.T, b []byte) (up, down []byte, flags []byte) {
+	le := binary.LittleEndian
+	if len(b) < 48 || le.Uint32(b) != PCAPNG_SHB || le.Uint32(b[8:]) != PCAPNG_BYTEORD ||
+		le.Uint32(b[28:]) != PCAPNG_IDB || le.Uint16(b[36:]) != LINKTYPE_RAW {
+		t.Fatalf("bad pcapng header: % x", b[:48])
+	}
+
+	var client uint16
+	for b = b[48:]; len(b) > 0; {
+		typ, n := le.Uint32(b), int(le.Uint32(b[4:]))
+		if typ != PCAPNG_EPB || n > len(b) || le.Uint32(b[n-4:]) != uint32(n) {
+			t.Fatalf("bad block %#x of %d bytes", typ, n)
+		}
+		pkt := b[28 : 28+le.Uint32(b[20:])]
+		b = b[n:]
+
+		if pkt[0] != 0x45 || fold(csum(0, pkt[:20])) != 0xffff {
+			t.Fatalf("bad IPv4 header: % x", pkt[:20])
+		}
+		tcp := pkt[20:]
+		sum := csum(csum(0, pkt[12:16]), pkt[16:20]) + 6 + uint32(len(tcp))
+		if fold(csum(sum, tcp)) != 0xffff {
+			t.Fatalf("bad TCP checksum")
+		}
+
+		sport := binary.BigEndian.Uint16(tcp)
+		if tcp[13] == TCP_SYN {
+			client = sport
+		}
+		flags = append(flags, tcp[13])
+		if sport == client {
+			up = append(up, tcp[20:]...)
+		} else {
+			down = append(down, tcp[20:]...)
+		}
+	}
+	return
+}
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	ln := startEcho(t)
+	pw := writeHtpasswd(t, "alice:"+bcryptHash(t, "wonder")+"\n")
+	addr := startHTTPProxy(t, &ListenConf{Auth: AuthConf{Type: "htpasswd", Args: map[string]string{"file": pw}}})
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n"), Capture: dir})
+
+	do := func(method, path string, v url.Values) *http.Response {
+		req, _ := http.NewRequest(method, u+path, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "adm1n")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	start := func(v url.Values) string {
+		res := do("POST", "/capture", v)
+		defer res.Body.Close()
+		var out struct {
+			File string `json:"file"`
+		}
+		json.NewDecoder(res.Body).Decode(&out)
+		if res.StatusCode != 200 || len(out.File) == 0 {
+			t.Fatalf("capture %v: %d", v, res.StatusCode)
+		}
+		return out.File
+	}
+	fetch := func(f string) []byte {
+		res := do("GET", "/capture?file="+f, nil)
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		if res.StatusCode != 200 {
+			t.Fatalf("%s: %d", f, res.StatusCode)
+		}
+		return b
+	}
+	echo := func(c io.ReadWriter, br io.Reader, s string) {
+		io.WriteString(c, s)
+		b := make([]byte, len(s))
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != s {
+			t.Fatalf("echo %q: %q %v", s, b, err)
+		}
+	}
+	waitClosed := func(f string) {
+		for i := 0; i < 100; i++ {
+			if len(sessionStats("alice", time.Now())) == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s: tunnel still open", f)
+	}
+
+	// The next tunnel of alice to a matching host
+	f := start(url.Values{"user": {"alice"}, "dest": {"127.0.0.*"}})
+	c, br := connectTunnel(t, addr, ln.Addr().String(), "alice", "wonder")
+	echo(c, br, "hello")
+	echo(c, br, strings.Repeat("x", 40000))
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	io.Copy(io.Discard, br)
+	c.Close()
+	waitClosed(f)
+
+	up, down, flags := readCapture(t, fetch(f))
+	want := "hello" + strings.Repeat("x", 40000)
+	if string(up) != want || string(down) != want {
+		t.Errorf("payloads: %d up, %d down", len(up), len(down))
+	}
+	if flags[0] != TCP_SYN || flags[len(flags)-1]&TCP_FIN == 0 {
+		t.Errorf("flags: %x", flags)
+	}
+
+	// An open tunnel from now on, up to 'bytes'
+	c, br = connectTunnel(t, addr, ln.Addr().String(), "alice", "wonder")
+	echo(c, br, "before")
+	ss := sessionStats("alice", time.Now())
+	if len(ss) != 1 {
+		t.Fatalf("sessions: %+v", ss)
+	}
+	f = start(url.Values{"id": {ss[0].ID}, "bytes": {"10"}})
+	echo(c, br, "after")
+	echo(c, br, "and more")
+	c.Close()
+	waitClosed(f)
+
+	up, down, _ = readCapture(t, fetch(f))
+	if string(up) != "after" || string(down) != "after" {
+		t.Errorf("open tunnel: %q %q", up, down)
+	}
+
+	res := do("GET", "/capture", nil)
+	var list struct {
+		Captures []struct {
+			File string `json:"file"`
+		} `json:"captures"`
+	}
+	json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	if len(list.Captures) != 2 {
+		t.Errorf("list: %+v", list)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		v            url.Values
+		code         int
+	}{
+		{"POST", "/capture", url.Values{"id": {"nope"}}, 404},
+		{"POST", "/capture", url.Values{"bytes": {"0"}}, 400},
+		{"POST", "/capture", url.Values{"dest": {"["}}, 400},
+		{"GET", "/capture?file=../x.pcapng", nil, 400},
+		{"DELETE", "/capture", nil, 405},
+	} {
+		res := do(tt.method, tt.path, tt.v)
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s %s %v: %d, want %d", tt.method, tt.path, tt.v, res.StatusCode, tt.code)
+		}
+	}
+
+	// A capture that waited too long is dropped with its file
+	f = start(url.Values{"user": {"nobody"}, "wait": {"1"}})
+	(&liveSession{}).wanted(time.Now().Add(2 * time.Second))
+	if _, err := os.Stat(dir + "/" + f); !os.IsNotExist(err) {
+		t.Errorf("%s: %v", f, err)
+	}
+
+	// No directory, no captures
+	u2 := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+	req, _ := http.NewRequest("GET", u2+"/capture", nil)
+	req.SetBasicAuth("admin", "adm1n")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 403 {
+		t.Errorf("no directory: %v %v", res, err)
+	} else {
+		res.Body.Close()
+	}
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewAdminServer(&AdminConf{Listen: "127.0.0.1:0", Capture: dir + "/none"}, log); err == nil {
+		t.Errorf("missing capture directory")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,282 @@
+// certfile.go -- certificate files of TLS listeners: reloads and OCSP staples
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// Seconds between checks of the certificate files for changes
+	CERT_CHECK = 10
+
+	// Wait after an OCSP responder failed
+	OCSP_RETRY = 5 * time.Minute
+
+	// Wait for a responder that gives no next update
+	OCSP_REFRESH = time.Hour
+
+	// Time an OCSP request may take
+	OCSP_TIMEOUT = 10 * time.Second
+)
+
+// The certificate of a listener from its cert and key files. A handshake
+// gets the one of the files as they are now: when they change, the next
+// handshake reads them again; connections already up keep theirs. With
+// OCSP, a response of the responder the certificate names is stapled to
+// the handshakes and renewed half way to its next update.
+type certFile struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	reloads uint64
+	stapled uint64
+	failed  uint64 // OCSP requests
+
+	cert, key string
+	log       *L.Logger
+	cur       atomic.Pointer[tls.Certificate]
+
+	sync.Mutex
+	mtime   [2]time.Time // of cert and key
+	checked time.Time
+
+	// OCSP; nil stop if not stapled
+	http *http.Client
+	kick chan struct{} // a new certificate
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Return the certificate in 'cert' and 'key' (which may be the same
+// file); staple OCSP responses if 'staple' is set
+func newCertFile(cert, key string, staple bool, log *L.Logger) (*certFile, error) {
+	if len(key) == 0 {
+		key = cert
+	}
+	c := &certFile{cert: cert, key: key, log: log}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	addCollector(c)
+	if !staple {
+		return c, nil
+	}
+
+	if _, _, err := ocspOf(c.cur.Load()); err != nil {
+		return nil, err
+	}
+	c.http = &http.Client{Timeout: OCSP_TIMEOUT}
+	c.kick = make(chan struct{}, 1)
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+	go c.staple()
+	return c, nil
+}
+
+// Stop stapling
+func (c *certFile) close() {
+	if c.stop != nil {
+		close(c.stop)
+		c.wg.Wait()
+	}
+}
+
+// The current certificate; for tls.Config.GetCertificate
+func (c *certFile) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.refresh()
+	return c.cur.Load(), nil
+}
+
+// Read the files
+func (c *certFile) load() error {
+	var mt [2]time.Time
+	for i, fn := range []string{c.cert, c.key} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		mt[i] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.mtime = mt
+	c.Unlock()
+	old := c.cur.Swap(&cert)
+	if old != nil && c.kick != nil {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Reload the files if they changed; at most every CERT_CHECK seconds. A
+// pair that doesn't load (e.g. a cert written before its key) is tried
+// again at the next check.
+func (c *certFile) refresh() {
+	c.Lock()
+	now := time.Now()
+	if now.Sub(c.checked) < CERT_CHECK*time.Second {
+		c.Unlock()
+		return
+	}
+	c.checked = now
+	mt := c.mtime
+	c.Unlock()
+
+	for i, fn := range []string{c.cert, c.key} {
+		if fi, err := os.Stat(fn); err == nil && !fi.ModTime().Equal(mt[i]) {
+			if err := c.load(); err != nil {
+				c.log.Warn("tls: reloading %s: %s; keeping the old certificate", c.cert, err)
+				return
+			}
+			atomic.AddUint64(&c.reloads, 1)
+			c.log.Info("tls: reloaded %s", c.cert)
+			return
+		}
+	}
+}
+
+// Keep an OCSP response stapled to the certificate until stopped
+func (c *certFile) staple() {
+	defer c.wg.Done()
+	for {
+		wait, err := c.fetch()
+		if err != nil {
+			atomic.AddUint64(&c.failed, 1)
+			c.log.Warn("tls: %s: ocsp: %s; retrying in %s", c.cert, err, OCSP_RETRY)
+			c.expire()
+			wait = OCSP_RETRY
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-c.kick:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Staple a new OCSP response and return the wait until the next one
+func (c *certFile) fetch() (time.Duration, error) {
+	cur := c.cur.Load()
+	leaf, issuer, err := ocspOf(cur)
+	if err != nil {
+		return 0, err
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.http.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return 0, err
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	res.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", leaf.OCSPServer[0], res.Status)
+	}
+	r, err := ocsp.ParseResponseForCert(b, leaf, issuer)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", leaf.OCSPServer[0], err)
+	}
+	if r.Status != ocsp.Good {
+		return 0, fmt.Errorf("certificate is %s", ocspStatus(r.Status))
+	}
+
+	nc := *cur
+	nc.OCSPStaple = b
+	if !c.cur.CompareAndSwap(cur, &nc) {
+		// new files; their certificate gets its own
+		return 0, nil
+	}
+	atomic.AddUint64(&c.stapled, 1)
+
+	if r.NextUpdate.IsZero() {
+		return OCSP_REFRESH, nil
+	}
+	return max(time.Until(r.ThisUpdate.Add(r.NextUpdate.Sub(r.ThisUpdate)/2)), time.Minute), nil
+}
+
+// Drop a staple past its next update; clients would refuse it
+func (c *certFile) expire() {
+	cur := c.cur.Load()
+	if len(cur.OCSPStaple) == 0 {
+		return
+	}
+	r, err := ocsp.ParseResponse(cur.OCSPStaple, nil)
+	if err == nil && (r.NextUpdate.IsZero() || time.Now().Before(r.NextUpdate)) {
+		return
+	}
+	nc := *cur
+	nc.OCSPStaple = nil
+	c.cur.CompareAndSwap(cur, &nc)
+}
+
+func (c *certFile) metrics() []metric {
+	lbl := fmt.Sprintf("cert=%q", c.cert)
+	return []metric{
+		{"goproxy_tls_reloads_total", "counter", "Certificates reloaded from changed files", lbl,
+			float64(atomic.LoadUint64(&c.reloads))},
+		{"goproxy_ocsp_stapled_total", "counter", "OCSP responses stapled", lbl,
+			float64(atomic.LoadUint64(&c.stapled))},
+		{"goproxy_ocsp_failures_total", "counter", "OCSP requests that failed", lbl,
+			float64(atomic.LoadUint64(&c.failed))},
+	}
+}
+
+// Return the leaf and issuer of 'c' for OCSP
+func ocspOf(c *tls.Certificate) (*x509.Certificate, *x509.Certificate, error) {
+	if len(c.Leaf.OCSPServer) == 0 {
+		return nil, nil, fmt.Errorf("ocsp: the certificate names no responder")
+	}
+	if len(c.Certificate) < 2 {
+		return nil, nil, fmt.Errorf("ocsp: the certificate file has no issuer")
+	}
+	issuer, err := x509.ParseCertificate(c.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("ocsp: issuer: %s", err)
+	}
+	return c.Leaf, issuer, nil
+}
+
+func ocspStatus(s int) string {
+	switch s {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,187 @@
+// certfile_test.go -- tests for certificate reloads and OCSP staples
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Issue a server certificate with the OCSP responder 'responder' and
+// write it, the CA and its key to 'fn'
+func ocspCert(t *testing.T, ca *testCA, responder, fn string) *x509.Certificate {
+	c, _ := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:  []string{responder},
+	})
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	kb, _ := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb})...)
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := x509.ParseCertificate(c.Certificate[0])
+	return x
+}
+
+// Return the serial number of the certificate a handshake with 'c' gets,
+// and its OCSP staple
+func certHandshake(t *testing.T, c *certFile, ca *testCA) (int64, []byte) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	go tls.Server(sc, &tls.Config{GetCertificate: c.get}).Handshake()
+	tc := tls.Client(cc, &tls.Config{ServerName: "127.0.0.1", RootCAs: ca.pool})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	cs := tc.ConnectionState()
+	return cs.PeerCertificates[0].SerialNumber.Int64(), cs.OCSPResponse
+}
+
+func TestCertReload(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ca := newTestCA(t)
+	fn := filepath.Join(t.TempDir(), "proxy.pem")
+	a := ocspCert(t, ca, "http://127.0.0.1:1", fn)
+
+	c, err := newCertFile(fn, "", false, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if n, _ := certHandshake(t, c, ca); n != a.SerialNumber.Int64() {
+		t.Fatalf("serial %d", n)
+	}
+
+	// a new pair of files; the next check sees it
+	b := ocspCert(t, ca, "http://127.0.0.1:1", fn)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fn, later, later)
+	if n, _ := certHandshake(t, c, ca); n != a.SerialNumber.Int64() {
+		t.Errorf("reloaded before the check: %d", n)
+	}
+	c.checked = time.Time{}
+	if n, _ := certHandshake(t, c, ca); n != b.SerialNumber.Int64() {
+		t.Errorf("not reloaded: serial %d", n)
+	}
+
+	// a broken file keeps the certificate
+	ioutil.WriteFile(fn, []byte("half written"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(fn, later, later)
+	c.checked = time.Time{}
+	if n, _ := certHandshake(t, c, ca); n != b.SerialNumber.Int64() {
+		t.Errorf("after a broken file: serial %d", n)
+	}
+	if c.reloads != 1 {
+		t.Errorf("%d reloads", c.reloads)
+	}
+}
+
+func TestOCSPStaple(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ca := newTestCA(t)
+
+	var mu sync.Mutex
+	status := ocsp.Good
+	var asked int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asked, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		st := status
+		mu.Unlock()
+		now := time.Now()
+		res, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{Status: st,
+			SerialNumber: req.SerialNumber, ThisUpdate: now.Add(-time.Minute),
+			NextUpdate: now.Add(time.Hour), RevokedAt: now}, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(res)
+	}))
+	defer srv.Close()
+
+	fn := filepath.Join(t.TempDir(), "proxy.pem")
+	ocspCert(t, ca, srv.URL, fn)
+	c, err := newCertFile(fn, "", true, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	var staple []byte
+	for i := 0; i < 100 && len(staple) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, staple = certHandshake(t, c, ca)
+	}
+	r, err := ocsp.ParseResponse(staple, ca.cert)
+	if err != nil || r.Status != ocsp.Good {
+		t.Fatalf("staple: %v %v", r, err)
+	}
+
+	// a new certificate that is revoked: no staple
+	mu.Lock()
+	status = ocsp.Revoked
+	mu.Unlock()
+	ocspCert(t, ca, srv.URL, fn)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fn, later, later)
+	c.checked = time.Time{}
+	for i := 0; i < 100 && atomic.LoadUint64(&c.failed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, staple = certHandshake(t, c, ca)
+	}
+	if _, staple = certHandshake(t, c, ca); len(staple) != 0 || atomic.LoadInt32(&asked) != 2 {
+		t.Errorf("revoked: %d bytes stapled; %d requests", len(staple), asked)
+	}
+}
+
+func TestOCSPConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ca := newTestCA(t)
+	cert := ca.server(t)
+	for _, tc := range []TLSConf{
+		{Cert: cert, OCSP: true},
+		{ACME: ACMEConf{Domains: []string{"x.example.com"}, Cache: t.TempDir()}, OCSP: true},
+	} {
+		if lt, err := newListenTLS(&tc, log); err == nil {
+			lt.close()
+			t.Errorf("%+v: no error", tc)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
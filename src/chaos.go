@@ -0,0 +1,232 @@
+// chaos.go -- faults injected on the connections of a rule
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Default seconds before a connection picked for a reset is reset
+const CHAOS_RESET = 10
+
+var (
+	errChaosDial = errors.New("chaos: injected dial failure")
+	errChaosRaw  = errors.New("chaos: no raw access to a faulty connection")
+)
+
+// Faults of the connections a rule allows: latency, a bandwidth cap,
+// failed dials and resets. For testing how clients cope with a bad
+// network; not for production.
+type chaos struct {
+	// faults injected so far; 64-bit atomics first (alignment on
+	// 32-bit platforms)
+	dials, resets, delays uint64
+
+	rule       string
+	latency    time.Duration
+	jitter     time.Duration
+	rate       int     // bytes/sec each way; 0 is unlimited
+	dialFail   float64 // probabilities
+	reset      float64
+	resetAfter time.Duration
+}
+
+// The faults of a listener's rules, for the admin listener
+type chaosSet struct {
+	listener string
+	v        []*chaos
+}
+
+// Return the faults of 'c' for rule 'name' or nil if there are none
+func newChaos(c *ChaosConf, name string) (*chaos, error) {
+	if *c == (ChaosConf{}) {
+		return nil, nil
+	}
+
+	for _, x := range []struct {
+		what string
+		v    float64
+		max  float64
+	}{
+		{"latency", float64(c.Latency), 1e9},
+		{"jitter", float64(c.Jitter), 1e9},
+		{"bandwidth", float64(c.Bandwidth), 1e12},
+		{"dialfail", c.DialFail, 100},
+		{"reset", c.Reset, 100},
+		{"resetafter", float64(c.ResetAfter), 1e9},
+	} {
+		if x.v < 0 || x.v > x.max {
+			return nil, fmt.Errorf("rule %s: chaos %s: %v is out of range", name, x.what, x.v)
+		}
+	}
+
+	f := &chaos{
+		rule:       name,
+		latency:    time.Duration(c.Latency) * time.Millisecond,
+		jitter:     time.Duration(c.Jitter) * time.Millisecond,
+		rate:       c.Bandwidth,
+		dialFail:   c.DialFail / 100,
+		reset:      c.Reset / 100,
+		resetAfter: CHAOS_RESET * time.Second,
+	}
+	if c.ResetAfter > 0 {
+		f.resetAfter = time.Duration(c.ResetAfter) * time.Second
+	}
+	return f, nil
+}
+
+// Return the latency of the next connection or chunk: the latency and
+// a random part of the jitter
+func (f *chaos) delay() time.Duration {
+	d := f.latency
+	if f.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(f.jitter) + 1))
+	}
+	return d
+}
+
+// Delay a dial by the latency; fail it if the dice say so
+func (f *chaos) dial() error {
+	if d := f.delay(); d > 0 {
+		atomic.AddUint64(&f.delays, 1)
+		time.Sleep(d)
+	}
+	if f.dialFail > 0 && rand.Float64() < f.dialFail {
+		atomic.AddUint64(&f.dials, 1)
+		return errChaosDial
+	}
+	return nil
+}
+
+// Return 'c' with the faults; it may be reset after a while
+func (f *chaos) wrap(c net.Conn) net.Conn {
+	tc, ok := c.(*net.TCPConn)
+	if !ok || (f.latency == 0 && f.jitter == 0 && f.rate == 0 && f.reset == 0) {
+		return c
+	}
+
+	x := &chaosConn{TCPConn: tc, f: f}
+	if f.reset > 0 && rand.Float64() < f.reset {
+		d := time.Duration(rand.Int63n(int64(f.resetAfter) + 1))
+		x.timer = time.AfterFunc(d, func() {
+			atomic.AddUint64(&f.resets, 1)
+			tc.SetLinger(0)
+			tc.Close()
+		})
+	}
+	return x
+}
+
+// A connection with faults. It has no raw access, so the copier relays
+// it through buffers; splice and the sockmap would skip the faults.
+type chaosConn struct {
+	*net.TCPConn
+	f     *chaos
+	timer *time.Timer
+
+	// when the next read or write may start, for the bandwidth cap
+	mu    sync.Mutex
+	rnext time.Time
+	wnext time.Time
+}
+
+// Read from the destination: with the latency and at most the
+// bandwidth cap
+func (c *chaosConn) Read(b []byte) (int, error) {
+	b = c.chunk(b)
+	n, err := c.TCPConn.Read(b)
+	if n > 0 {
+		if d := c.f.delay(); d > 0 {
+			time.Sleep(d)
+		}
+		c.pace(&c.rnext, n)
+	}
+	return n, err
+}
+
+// Write to the destination at most at the bandwidth cap
+func (c *chaosConn) Write(b []byte) (int, error) {
+	var nw int
+	for len(b) > 0 {
+		p := c.chunk(b)
+		n, err := c.TCPConn.Write(p)
+		nw += n
+		if err != nil {
+			return nw, err
+		}
+		c.pace(&c.wnext, n)
+		b = b[n:]
+	}
+	return nw, nil
+}
+
+// Return the part of 'b' to move at once: a tenth of a second's worth
+// under a bandwidth cap
+func (c *chaosConn) chunk(b []byte) []byte {
+	if m := c.f.rate / 10; c.f.rate > 0 && len(b) > m {
+		if m == 0 {
+			m = 1
+		}
+		return b[:m]
+	}
+	return b
+}
+
+// Wait until 'n' more bytes fit the bandwidth cap
+func (c *chaosConn) pace(next *time.Time, n int) {
+	if c.f.rate <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	if next.Before(now) {
+		*next = now
+	}
+	*next = next.Add(time.Duration(n) * time.Second / time.Duration(c.f.rate))
+	d := next.Sub(now)
+	c.mu.Unlock()
+	time.Sleep(d)
+}
+
+func (c *chaosConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errChaosRaw
+}
+
+func (c *chaosConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.TCPConn.Close()
+}
+
+// Chaos metrics for the admin listener
+func (s *chaosSet) metrics() []metric {
+	var v []metric
+	for _, f := range s.v {
+		l := fmt.Sprintf("listener=%q,rule=%q", s.listener, f.rule)
+		v = append(v,
+			metric{"goproxy_chaos_dial_failures_total", "counter", "Dials failed on purpose",
+				l, float64(atomic.LoadUint64(&f.dials))},
+			metric{"goproxy_chaos_resets_total", "counter", "Connections reset on purpose",
+				l, float64(atomic.LoadUint64(&f.resets))},
+			metric{"goproxy_chaos_delays_total", "counter", "Dials delayed on purpose",
+				l, float64(atomic.LoadUint64(&f.delays))})
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
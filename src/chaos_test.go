@@ -0,0 +1,114 @@
+// chaos_test.go -- tests for injected faults
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChaosConf(t *testing.T) {
+	if f, err := newChaos(&ChaosConf{}, "r"); f != nil || err != nil {
+		t.Errorf("empty: %v %v", f, err)
+	}
+	f, err := newChaos(&ChaosConf{Latency: 20, Jitter: 10, DialFail: 25, Reset: 50}, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.dialFail != 0.25 || f.reset != 0.5 || f.resetAfter != CHAOS_RESET*time.Second {
+		t.Errorf("%+v", f)
+	}
+	for i := 0; i < 100; i++ {
+		if d := f.delay(); d < 20*time.Millisecond || d > 30*time.Millisecond {
+			t.Fatalf("delay %s", d)
+		}
+	}
+
+	for _, c := range []ChaosConf{{Latency: -1}, {DialFail: 100.5}, {Reset: -3}, {Bandwidth: -10}} {
+		if _, err := newChaos(&c, "r"); err == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+	if _, err := newPolicy(&ListenConf{Rules: []RuleConf{{Action: "allow", Chaos: ChaosConf{Jitter: -1}}}}); err == nil {
+		t.Errorf("rule with bad chaos")
+	}
+}
+
+func TestChaosProxy(t *testing.T) {
+	body := strings.Repeat("x", 5000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(origin.Close)
+
+	proxyWith := func(c ChaosConf) *http.Client {
+		lc := &ListenConf{Rules: []RuleConf{{Name: "chaos", Dest: []string{"127.0.0.0/8"}, Action: "allow", Chaos: c}}}
+		addr := startHTTPProxy(t, lc)
+		tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr}), DisableKeepAlives: true}
+		t.Cleanup(tr.CloseIdleConnections)
+		return &http.Client{Transport: tr}
+	}
+	get := func(c *http.Client) (int, string, time.Duration) {
+		t0 := time.Now()
+		res, err := c.Get(origin.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(b), time.Since(t0)
+	}
+
+	c := proxyWith(ChaosConf{DialFail: 100})
+	if code, _, _ := get(c); code == 200 {
+		t.Errorf("dial failure: %d", code)
+	}
+
+	c = proxyWith(ChaosConf{Latency: 150})
+	if code, b, d := get(c); code != 200 || b != body || d < 300*time.Millisecond {
+		t.Errorf("latency: %d %d bytes in %s", code, len(b), d)
+	}
+
+	// 5000 bytes at 10000 B/s
+	c = proxyWith(ChaosConf{Bandwidth: 10000})
+	if code, b, d := get(c); code != 200 || b != body || d < 400*time.Millisecond {
+		t.Errorf("bandwidth: %d %d bytes in %s", code, len(b), d)
+	}
+
+	// A tunnel to an echo server is reset within a second
+	ln := startEcho(t)
+	lc := &ListenConf{Rules: []RuleConf{{Name: "rst", Dest: []string{"127.0.0.0/8"}, Action: "allow",
+		Chaos: ChaosConf{Reset: 100, ResetAfter: 1}}}}
+	addr := startHTTPProxy(t, lc)
+	tc, br := connectTunnel(t, addr, ln.Addr().String(), "", "")
+	defer tc.Close()
+	t0 := time.Now()
+	tc.SetDeadline(t0.Add(5 * time.Second))
+	go func() {
+		for {
+			if _, err := io.WriteString(tc, "ping"); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// the client sees an EOF or a reset
+	_, err := io.Copy(io.Discard, br)
+	if isTimeout(err) || time.Since(t0) > 3*time.Second {
+		t.Errorf("tunnel not reset: %v after %s", err, time.Since(t0))
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,473 @@
+// cluster.go -- a fleet of proxies managed as one: leader election and
+// replicated rules
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// Default seconds between heartbeats
+	CLUSTER_INTERVAL = 2
+
+	// Seconds the clock of a signed request may be off
+	CLUSTER_SKEW = 30
+
+	// Max bytes of a rule set
+	CLUSTER_MAXBODY = 4 << 20
+
+	CLUSTER_HEADER = "X-Goproxy-Cluster"
+)
+
+var errNotLeader = errors.New("cluster: not the leader")
+
+// Rules that compile but can't be put in force in place
+var errRulesRestart = errors.New("faults and mirrors need a restart")
+
+// The policies of the listeners by listen address and the rules pushed
+// to them
+var policies = struct {
+	sync.Mutex
+	m     map[string][]*policy
+	rules map[string][]*rule
+}{m: make(map[string][]*policy)}
+
+// Register the policy of a listener; it gets the rules pushed to it
+func addPolicy(listen string, p *policy) {
+	policies.Lock()
+	defer policies.Unlock()
+	policies.m[listen] = append(policies.m[listen], p)
+	if v, ok := policies.rules[listen]; ok {
+		p.setRules(v)
+	}
+}
+
+func delPolicy(listen string, p *policy) {
+	policies.Lock()
+	defer policies.Unlock()
+	v := policies.m[listen]
+	for i := range v {
+		if v[i] == p {
+			v = append(v[:i], v[i+1:]...)
+			break
+		}
+	}
+	if len(v) == 0 {
+		delete(policies.m, listen)
+	} else {
+		policies.m[listen] = v
+	}
+}
+
+// Put the rules 'm' in force; listeners not in it go back to the rules
+// of their config
+func applyRules(m map[string][]*rule) {
+	policies.Lock()
+	defer policies.Unlock()
+	policies.rules = m
+	for listen, v := range policies.m {
+		for _, p := range v {
+			p.setRules(m[listen])
+		}
+	}
+}
+
+// Replace the config rules of the listeners in 'm', keeping those pushed
+func reloadRules(m map[string][]*rule) {
+	policies.Lock()
+	defer policies.Unlock()
+	for listen, v := range m {
+		_, pushed := policies.rules[listen]
+		for _, p := range policies.m[listen] {
+			p.setConf(v, pushed)
+		}
+	}
+}
+
+// Compile the rules of each listener
+func compileRules(m map[string][]RuleConf) (map[string][]*rule, error) {
+	c := make(map[string][]*rule, len(m))
+	for listen, rv := range m {
+		v := make([]*rule, 0, len(rv))
+		for i := range rv {
+			r, err := newRule(&rv[i], i)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", listen, err)
+			}
+			if r.chaos != nil || r.mirror != nil {
+				return nil, fmt.Errorf("%s: rule %s: %w", listen, r.name, errRulesRestart)
+			}
+			v = append(v, r)
+		}
+		c[listen] = v
+	}
+	return c, nil
+}
+
+// The rules pushed to the fleet, by listen address
+type clusterRules struct {
+	Version uint64                `yaml:"version"`
+	Origin  string                `yaml:"origin"` // the leader that numbered them
+	Rules   map[string][]RuleConf `yaml:"rules"`
+}
+
+// Return true if 'r' replaces rules of 'version' from 'origin'
+func (r *clusterRules) newer(version uint64, origin string) bool {
+	return r.Version > version || (r.Version == version && r.Origin > origin)
+}
+
+// What a node answers a heartbeat with
+type clusterState struct {
+	Node    string `yaml:"node"`
+	Version uint64 `yaml:"version"`
+	Origin  string `yaml:"origin"`
+}
+
+// A node of a fleet. Nodes are named by their admin URL; the leader is
+// the first (in sort order) of the nodes that answered the last
+// heartbeat. Only the leader numbers new rules; every node takes the
+// newest rules any of the others has.
+type cluster struct {
+	self   string
+	peers  []string
+	secret []byte
+	every  time.Duration
+	log    *L.Logger
+	client *http.Client
+
+	sync.Mutex
+	cur    clusterRules
+	leader string
+	alive  int // peers that answered the last heartbeat
+}
+
+// Make the node of 'cc'; without a fleet, it is its own leader.
+func newCluster(cc *ClusterConf, log *L.Logger) (*cluster, error) {
+	c := &cluster{
+		self:   strings.TrimSuffix(cc.Self, "/"),
+		secret: []byte(cc.Secret),
+		every:  time.Duration(cc.Interval) * time.Second,
+		log:    log,
+		client: &http.Client{},
+	}
+	if c.every <= 0 {
+		c.every = CLUSTER_INTERVAL * time.Second
+	}
+	c.leader = c.self
+	if len(c.self) == 0 {
+		if len(cc.Peers) > 0 {
+			return nil, fmt.Errorf("cluster: peers without self")
+		}
+		return c, nil
+	}
+
+	if len(c.secret) < 16 {
+		return nil, fmt.Errorf("cluster: the secret must have at least 16 characters")
+	}
+	for _, s := range append([]string{c.self}, cc.Peers...) {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("cluster: %s is not an http(s) URL", s)
+		}
+	}
+	for _, s := range cc.Peers {
+		if s = strings.TrimSuffix(s, "/"); s != c.self {
+			c.peers = append(c.peers, s)
+		}
+	}
+	return c, nil
+}
+
+// Return true if the node is in a fleet
+func (c *cluster) fleet() bool {
+	return len(c.self) > 0
+}
+
+// Send heartbeats until 'stop' is closed
+func (c *cluster) run(stop chan struct{}) {
+	t := time.NewTicker(c.every)
+	defer t.Stop()
+	for {
+		c.beat()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Ask the peers for their state: elect the leader and take newer rules
+func (c *cluster) beat() {
+	type answer struct {
+		peer string
+		st   *clusterState
+	}
+
+	ch := make(chan answer, len(c.peers))
+	for _, p := range c.peers {
+		go func(p string) {
+			var st clusterState
+			if err := c.call("GET", p, "/cluster/state", nil, &st); err != nil {
+				c.log.Debug("cluster: %s: %s", p, err)
+				ch <- answer{p, nil}
+				return
+			}
+			ch <- answer{p, &st}
+		}(p)
+	}
+
+	c.Lock()
+	newest := clusterRules{Version: c.cur.Version, Origin: c.cur.Origin}
+	c.Unlock()
+
+	leader, from, alive := c.self, "", 0
+	for range c.peers {
+		a := <-ch
+		if a.st == nil {
+			continue
+		}
+		alive++
+		if a.peer < leader {
+			leader = a.peer
+		}
+		r := &clusterRules{Version: a.st.Version, Origin: a.st.Origin}
+		if r.newer(newest.Version, newest.Origin) {
+			newest, from = *r, a.peer
+		}
+	}
+
+	c.Lock()
+	if leader != c.leader {
+		c.log.Info("cluster: %s is the leader (%d of %d peers up)", leader, alive, len(c.peers))
+	}
+	c.leader, c.alive = leader, alive
+	c.Unlock()
+
+	if len(from) > 0 {
+		var r clusterRules
+		if err := c.call("GET", from, "/cluster/rules", nil, &r); err != nil {
+			c.log.Warn("cluster: can't fetch rules from %s: %s", from, err)
+			return
+		}
+		if err := c.adopt(&r); err != nil {
+			c.log.Warn("cluster: rules version %d from %s: %s", r.Version, from, err)
+		}
+	}
+}
+
+// Put the rules 'r' in force if they are newer than ours
+func (c *cluster) adopt(r *clusterRules) error {
+	m, err := compileRules(r.Rules)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if !r.newer(c.cur.Version, c.cur.Origin) {
+		return nil
+	}
+	applyRules(m)
+	c.cur = *r
+	c.log.Info("cluster: rules version %d (from %s) in force", r.Version, r.Origin)
+	return nil
+}
+
+// Number the rules 'm' and put them in force; only on the leader
+func (c *cluster) commit(m map[string][]RuleConf) (*clusterRules, error) {
+	cm, err := compileRules(m)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.leader != c.self {
+		return nil, errNotLeader
+	}
+	applyRules(cm)
+	c.cur = clusterRules{Version: c.cur.Version + 1, Origin: c.self, Rules: m}
+	c.log.Info("cluster: rules version %d in force", c.cur.Version)
+	r := c.cur
+	return &r, nil
+}
+
+// Put the rules 'm' in force on the fleet: through the leader if it
+// isn't this node. The others take them at their next heartbeat.
+func (c *cluster) push(m map[string][]RuleConf) (*clusterRules, error) {
+	c.Lock()
+	leader := c.leader
+	c.Unlock()
+	if leader == c.self {
+		return c.commit(m)
+	}
+
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var r clusterRules
+	if err := c.call("POST", leader, "/cluster/push", b, &r); err != nil {
+		return nil, fmt.Errorf("cluster: leader %s: %s", leader, err)
+	}
+	if err := c.adopt(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Return the rules in force
+func (c *cluster) rules() clusterRules {
+	c.Lock()
+	defer c.Unlock()
+	return c.cur
+}
+
+// Send a signed request to the node 'node'; decode its answer into 'out'
+func (c *cluster) call(method, node, path string, body []byte, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.every)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, node+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(CLUSTER_HEADER, c.sign(method, path, strconv.FormatInt(time.Now().Unix(), 10), body))
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, CLUSTER_MAXBODY))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	return yaml.Unmarshal(b, out)
+}
+
+// Return the signature header of a request made at 'ts'
+func (c *cluster) sign(method, path, ts string, body []byte) string {
+	h := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(h, "%s\n%s\n%s\n", method, path, ts)
+	h.Write(body)
+	return ts + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// Return true if 'r' (with 'body') was signed by a node of the fleet
+func (c *cluster) verify(r *http.Request, body []byte) bool {
+	ts, mac, ok := strings.Cut(r.Header.Get(CLUSTER_HEADER), " ")
+	if !ok {
+		return false
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := time.Now().Unix() - t; d > CLUSTER_SKEW || d < -CLUSTER_SKEW {
+		return false
+	}
+	want := c.sign(r.Method, r.URL.Path, ts, body)
+	return hmac.Equal([]byte(want), []byte(ts+" "+mac))
+}
+
+// Serve the requests of the other nodes
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, CLUSTER_MAXBODY))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.verify(r, body) {
+		c.log.Info("%s: %s %s: bad cluster signature", r.RemoteAddr, r.Method, r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var out interface{}
+	switch r.URL.Path {
+	case "/cluster/state":
+		cur := c.rules()
+		out = &clusterState{Node: c.self, Version: cur.Version, Origin: cur.Origin}
+
+	case "/cluster/rules":
+		cur := c.rules()
+		out = &cur
+
+	case "/cluster/push":
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var m map[string][]RuleConf
+		if err := yaml.UnmarshalStrict(body, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cr, err := c.commit(m)
+		switch {
+		case err == errNotLeader:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.log.Info("%s: rules version %d pushed by a peer", r.RemoteAddr, cr.Version)
+		out = cr
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	b, _ := yaml.Marshal(out)
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+func (c *cluster) metrics() []metric {
+	c.Lock()
+	defer c.Unlock()
+
+	l := fmt.Sprintf("node=%q", c.self)
+	leader := 0.0
+	if c.leader == c.self {
+		leader = 1
+	}
+	return []metric{
+		{"goproxy_cluster_leader", "gauge", "1 if this node is the leader of the fleet", l, leader},
+		{"goproxy_cluster_peers_up", "gauge", "Peers that answered the last heartbeat", l, float64(c.alive)},
+		{"goproxy_cluster_rules_version", "gauge", "Version of the rules in force", l, float64(c.cur.Version)},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,198 @@
+// cluster_test.go -- tests for fleets of proxies
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+const testClusterSecret = "0123456789abcdef-fleet"
+
+func TestCluster(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	bad := []ClusterConf{
+		{Peers: []string{"http://a:1"}},
+		{Self: "http://a:1", Secret: "short"},
+		{Self: "a:1", Secret: testClusterSecret},
+		{Self: "http://a:1", Secret: testClusterSecret, Peers: []string{"ftp://b"}},
+	}
+	for _, cc := range bad {
+		if _, err := newCluster(&cc, log); err == nil {
+			t.Errorf("%+v: no error", cc)
+		}
+	}
+
+	// Three nodes; the handlers are set once the URLs are known
+	nodes := make([]*cluster, 3)
+	srv := make([]*httptest.Server, 3)
+	var urls []string
+	for i := range srv {
+		i := i
+		srv[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].ServeHTTP(w, r)
+		}))
+		defer srv[i].Close()
+		urls = append(urls, srv[i].URL)
+	}
+	for i := range nodes {
+		c, err := newCluster(&ClusterConf{Self: urls[i], Peers: urls, Secret: testClusterSecret}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = c
+	}
+	beat := func() {
+		for _, c := range nodes {
+			c.beat()
+		}
+	}
+	beat()
+
+	sorted := append([]string(nil), urls...)
+	sort.Strings(sorted)
+	for _, c := range nodes {
+		if c.leader != sorted[0] || c.alive != 2 {
+			t.Errorf("%s: leader %s, %d alive", c.self, c.leader, c.alive)
+		}
+	}
+
+	// A listener of this process that gets the rules
+	pol, _ := newPolicy(&ListenConf{Rules: []RuleConf{{Action: "allow"}}})
+	addPolicy("fleet:1", pol)
+	defer delPolicy("fleet:1", pol)
+	defer applyRules(nil)
+	ip := net.ParseIP("192.0.2.1")
+
+	var follower *cluster
+	for _, c := range nodes {
+		if c.self != sorted[0] {
+			follower = c
+		}
+	}
+	deny := map[string][]RuleConf{"fleet:1": {{Name: "nope", Dest: []string{"192.0.2.0/24"}, Action: "deny"}}}
+	r, err := follower.push(deny)
+	if err != nil || r.Version != 1 || r.Origin != sorted[0] {
+		t.Fatalf("push: %+v %v", r, err)
+	}
+	if _, err := pol.eval("", "", ip, 80); isDenied(err) == nil {
+		t.Errorf("pushed rule not in force: %v", err)
+	}
+	beat()
+	for _, c := range nodes {
+		if cur := c.rules(); cur.Version != 1 || len(cur.Rules["fleet:1"]) != 1 {
+			t.Errorf("%s: %+v", c.self, cur)
+		}
+	}
+
+	if _, err := follower.push(map[string][]RuleConf{"fleet:1": {{Action: "maybe"}}}); err == nil {
+		t.Errorf("bad rule: no error")
+	}
+	if _, err := follower.commit(deny); err != errNotLeader {
+		t.Errorf("commit on a follower: %v", err)
+	}
+
+	// The leader goes away; the next one takes over
+	for i := range nodes {
+		if urls[i] == sorted[0] {
+			srv[i].Close()
+		}
+	}
+	for _, c := range nodes {
+		if c.self != sorted[0] {
+			c.beat()
+			if c.leader != sorted[1] {
+				t.Errorf("%s: leader %s after the first went away", c.self, c.leader)
+			}
+		}
+	}
+	r, err = follower.push(map[string][]RuleConf{})
+	if err != nil || r.Version != 2 || r.Origin != sorted[1] {
+		t.Fatalf("push to the new leader: %+v %v", r, err)
+	}
+	if _, err := pol.eval("", "", ip, 80); err != nil {
+		t.Errorf("config rules aren't back: %v", err)
+	}
+
+	// Requests of nodes outside the fleet are refused
+	other, _ := newCluster(&ClusterConf{Self: "http://x:1", Peers: urls, Secret: testClusterSecret + "!"}, log)
+	var st clusterState
+	if err := other.call("GET", sorted[1], "/cluster/state", nil, &st); err == nil ||
+		!strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong secret: %v", err)
+	}
+	res, err := http.Get(sorted[1] + "/cluster/rules")
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned: %v %v", res, err)
+	}
+}
+
+func TestAdminRules(t *testing.T) {
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+	ln := startEcho(t)
+	addr := startHTTPProxy(t, &ListenConf{})
+	defer applyRules(nil)
+
+	push := func(body string) int {
+		req, _ := http.NewRequest("POST", u+"/rules", strings.NewReader(body))
+		req.SetBasicAuth("admin", "adm1n")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	connect := func() int {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: x\r\n\r\n", ln.Addr())
+		var proto string
+		var code int
+		fmt.Fscanf(c, "%s %d", &proto, &code)
+		return code
+	}
+
+	if n := connect(); n != 200 {
+		t.Fatalf("before: %d", n)
+	}
+	if n := push("127.0.0.1:0:\n  - {name: block, dest: [127.0.0.0/8], action: deny}\n"); n != 200 {
+		t.Fatalf("push: %d", n)
+	}
+	if n := connect(); n != http.StatusForbidden {
+		t.Errorf("after push: %d", n)
+	}
+	if n := push("127.0.0.1:0:\n  - {name: x, actoin: deny}\n"); n != http.StatusBadRequest {
+		t.Errorf("typo: %d", n)
+	}
+	if n := push("{}"); n != 200 {
+		t.Fatalf("push: %d", n)
+	}
+	if n := connect(); n != 200 {
+		t.Errorf("config rules back: %d", n)
+	}
+
+	res, _ := http.Get(u + "/rules")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without password: %d", res.StatusCode)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
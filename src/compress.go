@@ -0,0 +1,361 @@
+// compress.go -- on-the-fly compression of HTTP responses
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses smaller than this (bytes) aren't worth compressing
+const COMPRESS_MINSIZE = 1024
+
+// Compression levels; brotli's default (11) is too slow for a proxy
+const (
+	COMPRESS_GZIP   = gzip.DefaultCompression
+	COMPRESS_BROTLI = 4
+)
+
+// Media types compressed by default
+var compressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Compresses the responses of one listener to clients that ask for it
+type compressor struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	responses uint64
+	in        uint64
+	out       uint64
+
+	types   []string
+	minSize int64
+	name    string
+}
+
+// Return a new compressor or nil if 'cc' doesn't enable one
+func newCompressor(cc *CompressConf, name string) (*compressor, error) {
+	if !cc.Enable {
+		return nil, nil
+	}
+
+	c := &compressor{
+		types:   compressTypes,
+		minSize: int64(cc.MinSize),
+		name:    name,
+	}
+
+	if len(cc.Types) > 0 {
+		c.types = make([]string, 0, len(cc.Types))
+		for _, t := range cc.Types {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if strings.Count(t, "/") != 1 {
+				return nil, fmt.Errorf("compress: invalid media type %q", t)
+			}
+			c.types = append(c.types, t)
+		}
+	}
+	if c.minSize <= 0 {
+		c.minSize = COMPRESS_MINSIZE
+	}
+	return c, nil
+}
+
+// Return true if responses of type 'ct' are compressed
+func (c *compressor) compressible(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range c.types {
+		if strings.HasSuffix(t, "/*") {
+			if strings.HasPrefix(mt, t[:len(t)-1]) {
+				return true
+			}
+		} else if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the encoding we use for a client sending Accept-Encoding 'ae':
+// "br", "gzip" or "" if it takes neither. Higher q-values win; brotli
+// wins ties.
+func acceptEncoding(ae string) string {
+	var best string
+	var bestq float64
+
+	for _, f := range strings.Split(ae, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+
+		q := 1.0
+		if i := strings.IndexByte(f, ';'); i >= 0 {
+			p := strings.TrimSpace(f[i+1:])
+			f = strings.TrimSpace(f[:i])
+			if strings.HasPrefix(p, "q=") {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					continue
+				}
+				q = v
+			}
+		}
+
+		var enc string
+		switch strings.ToLower(f) {
+		case "br":
+			enc = "br"
+		case "gzip", "x-gzip":
+			enc = "gzip"
+		case "*":
+			enc = "gzip"
+		default:
+			continue
+		}
+
+		if q > bestq || (q == bestq && q > 0 && enc == "br") {
+			best, bestq = enc, q
+		}
+	}
+	return best
+}
+
+// Wrap 'w' so the response to 'r' is compressed if the client takes
+// it and the response is worth it. Close() must be called when the
+// response is done.
+func (c *compressor) writer(w http.ResponseWriter, r *http.Request) *compressWriter {
+	cw := &compressWriter{
+		ResponseWriter: w,
+		c:              c,
+	}
+	if r.Method != "HEAD" {
+		cw.enc = acceptEncoding(r.Header.Get("Accept-Encoding"))
+	}
+	return cw
+}
+
+// A response writer that picks compression when the headers are
+// written. A response of unknown length is held back until we have
+// minSize bytes of it or it ends.
+type compressWriter struct {
+	http.ResponseWriter
+
+	c   *compressor
+	enc string // encoding the client takes
+
+	status  int
+	header  bool // WriteHeader() was called
+	pending bool // holding back the headers and 'buf'
+	buf     []byte
+
+	z  io.WriteCloser // encoder if compressing
+	cz *countWriter   // output of z
+	n  int64          // bytes into z
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.header {
+		return
+	}
+	w.header = true
+	w.status = code
+
+	h := w.Header()
+	if code != http.StatusOK || len(w.enc) == 0 || !w.eligible(h) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// Whatever we send varies on this
+	h.Add("Vary", "Accept-Encoding")
+
+	if cl := h.Get("Content-Length"); len(cl) > 0 {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < w.c.minSize {
+			w.ResponseWriter.WriteHeader(code)
+			return
+		}
+		w.start()
+		return
+	}
+	w.pending = true
+}
+
+// Return true if a response with headers 'h' can be compressed
+func (w *compressWriter) eligible(h http.Header) bool {
+	if ce := h.Get("Content-Encoding"); len(ce) > 0 && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if len(h.Get("Content-Range")) > 0 {
+		return false
+	}
+	if parseCacheControl(h).has("no-transform") {
+		return false
+	}
+	return w.c.compressible(h.Get("Content-Type"))
+}
+
+// Send the headers of the compressed response and set up the encoder
+func (w *compressWriter) start() {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.enc)
+
+	// The compressed response is a different representation
+	if et := h.Get("ETag"); len(et) > 0 && !strings.HasPrefix(et, "W/") {
+		h.Set("ETag", "W/"+et)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.pending = false
+
+	w.cz = &countWriter{ResponseWriter: w.ResponseWriter}
+	switch w.enc {
+	case "br":
+		w.z = brotli.NewWriterLevel(w.cz, COMPRESS_BROTLI)
+	default:
+		w.z, _ = gzip.NewWriterLevel(w.cz, COMPRESS_GZIP)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.header {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.pending {
+		w.buf = append(w.buf, b...)
+		if int64(len(w.buf)) < w.c.minSize {
+			return len(b), nil
+		}
+
+		w.start()
+		buf := w.buf
+		w.buf = nil
+		if _, err := w.compress(buf); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if w.z != nil {
+		return w.compress(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) compress(b []byte) (int, error) {
+	n, err := w.z.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Send what we have so far; a held back response is compressed
+func (w *compressWriter) Flush() {
+	if w.pending {
+		w.start()
+		buf := w.buf
+		w.buf = nil
+		w.compress(buf)
+	}
+
+	switch z := w.z.(type) {
+	case *gzip.Writer:
+		z.Flush()
+	case *brotli.Writer:
+		z.Flush()
+	}
+
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Finish the response: send a held back response as is or flush the
+// encoder.
+func (w *compressWriter) Close() error {
+	if w.pending {
+		w.pending = false
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+
+	if w.z == nil {
+		return nil
+	}
+
+	err := w.z.Close()
+	w.z = nil
+
+	atomic.AddUint64(&w.c.responses, 1)
+	atomic.AddUint64(&w.c.in, uint64(w.n))
+	atomic.AddUint64(&w.c.out, uint64(w.cz.n))
+	return err
+}
+
+// For http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Return a reader of the decoded body 'r' with Content-Encoding 'ce'.
+// Content filters use this to look at compressed bodies.
+func decodeBody(ce string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(ce)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported content-encoding %q", ce)
+}
+
+// Compression metrics for the admin listener
+func (c *compressor) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", c.name)
+	return []metric{
+		{"goproxy_compress_responses_total", "counter", "Responses compressed", l,
+			float64(atomic.LoadUint64(&c.responses))},
+		{"goproxy_compress_in_bytes_total", "counter", "Bytes of responses before compression", l,
+			float64(atomic.LoadUint64(&c.in))},
+		{"goproxy_compress_out_bytes_total", "counter", "Bytes of compressed responses", l,
+			float64(atomic.LoadUint64(&c.out))},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
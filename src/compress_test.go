@@ -0,0 +1,310 @@
+// compress_test.go -- tests for HTTP response compression
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		ae   string
+		want string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"GZIP, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br, gzip;q=0.9", "br"},
+		{"gzip;q=0.5, br;q=0.5", "br"},
+		{"br;q=0, gzip;q=0", ""},
+		{"br;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=x, br;q=0.1", "br"},
+		{"deflate, compress", ""},
+	}
+
+	for _, tt := range tests {
+		if got := acceptEncoding(tt.ae); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.ae, got, tt.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	c, err := newCompressor(&CompressConf{Enable: true}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yes := []string{"text/html", "text/plain; charset=utf-8", "Text/CSS",
+		"application/json", "application/javascript", "image/svg+xml"}
+	no := []string{"", "image/png", "application/octet-stream", "video/mp4", "textual/x", "bogus"}
+
+	for _, ct := range yes {
+		if !c.compressible(ct) {
+			t.Errorf("%q: not compressible", ct)
+		}
+	}
+	for _, ct := range no {
+		if c.compressible(ct) {
+			t.Errorf("%q: compressible", ct)
+		}
+	}
+
+	if _, err := newCompressor(&CompressConf{Enable: true, Types: []string{"text"}}, "test"); err == nil {
+		t.Errorf("invalid media type accepted")
+	}
+	if c, _ = newCompressor(&CompressConf{}, "test"); c != nil {
+		t.Errorf("compressor without enable")
+	}
+}
+
+// Respond to a request with Accept-Encoding 'ae' through a compressWriter;
+// 'h' is called with the writer to produce the response.
+func compressResponse(t *testing.T, method, ae string, h func(w http.ResponseWriter)) *http.Response {
+	c, err := newCompressor(&CompressConf{Enable: true, MinSize: 100}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, "http://example.com/", nil)
+	if len(ae) > 0 {
+		r.Header.Set("Accept-Encoding", ae)
+	}
+
+	rec := httptest.NewRecorder()
+	cw := c.writer(rec, r)
+	h(cw)
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result()
+}
+
+// Return the decoded body of 'res'
+func decoded(t *testing.T, res *http.Response) string {
+	rd, err := decodeBody(res.Header.Get("Content-Encoding"), res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressWriter(t *testing.T) {
+	big := strings.Repeat("hello, world. ", 100)
+	small := "short"
+
+	respond := func(ct, cl, body string, extra ...string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			h := w.Header()
+			h.Set("Content-Type", ct)
+			if len(cl) > 0 {
+				h.Set("Content-Length", cl)
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				h.Set(extra[i], extra[i+1])
+			}
+			w.WriteHeader(http.StatusOK)
+
+			// in pieces, so held back responses see several writes
+			for i := 0; i < len(body); i += 64 {
+				j := i + 64
+				if j > len(body) {
+					j = len(body)
+				}
+				w.Write([]byte(body[i:j]))
+			}
+		}
+	}
+	length := func(s string) string { return strconv.Itoa(len(s)) }
+
+	tests := []struct {
+		name   string
+		method string
+		ae     string
+		h      func(w http.ResponseWriter)
+		enc    string
+		body   string
+	}{
+		{"gzip", "GET", "gzip", respond("text/html", length(big), big), "gzip", big},
+		{"br", "GET", "gzip, br", respond("text/html", length(big), big), "br", big},
+		{"unknown length", "GET", "gzip", respond("application/json", "", big), "gzip", big},
+		{"small", "GET", "gzip", respond("text/html", length(small), small), "", small},
+		{"small unknown length", "GET", "gzip", respond("text/html", "", small), "", small},
+		{"no accept-encoding", "GET", "", respond("text/html", length(big), big), "", big},
+		{"binary", "GET", "gzip", respond("image/png", length(big), big), "", big},
+		{"HEAD", "HEAD", "gzip", respond("text/html", length(big), ""), "", ""},
+		{"already encoded", "GET", "gzip",
+			respond("text/html", length(big), big, "Content-Encoding", "deflate"), "deflate", big},
+		{"no-transform", "GET", "gzip",
+			respond("text/html", length(big), big, "Cache-Control", "no-transform"), "", big},
+	}
+
+	for _, tt := range tests {
+		res := compressResponse(t, tt.method, tt.ae, tt.h)
+		enc := res.Header.Get("Content-Encoding")
+		if enc != tt.enc {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, enc, tt.enc)
+			continue
+		}
+
+		if enc == "deflate" {
+			// the body isn't really deflated; just check it's untouched
+			if b, _ := ioutil.ReadAll(res.Body); string(b) != tt.body {
+				t.Errorf("%s: body changed", tt.name)
+			}
+			continue
+		}
+
+		if got := decoded(t, res); got != tt.body {
+			t.Errorf("%s: body %.32q.. (%d bytes), want %d bytes", tt.name, got, len(got), len(tt.body))
+		}
+		if len(enc) > 0 && len(res.Header.Get("Content-Length")) > 0 {
+			t.Errorf("%s: compressed response has a Content-Length", tt.name)
+		}
+	}
+}
+
+func TestCompressHeaders(t *testing.T) {
+	big := strings.Repeat("x", 1000)
+
+	res := compressResponse(t, "GET", "gzip", func(w http.ResponseWriter) {
+		h := w.Header()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Content-Length", "1000")
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("ETag", `"v1"`)
+		w.Write([]byte(big))
+	})
+
+	if et := res.Header.Get("ETag"); et != `W/"v1"` {
+		t.Errorf("ETag %q", et)
+	}
+	if len(res.Header.Get("Accept-Ranges")) > 0 {
+		t.Errorf("Accept-Ranges on a compressed response")
+	}
+	if v := res.Header.Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("Vary %q", v)
+	}
+
+	// Partial content is left alone
+	res = compressResponse(t, "GET", "gzip", func(w http.ResponseWriter) {
+		h := w.Header()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Content-Range", "bytes 0-999/2000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(big))
+	})
+	if len(res.Header.Get("Content-Encoding")) > 0 {
+		t.Errorf("206 response compressed")
+	}
+
+	// Errors too
+	res = compressResponse(t, "GET", "gzip", func(w http.ResponseWriter) {
+		http.Error(w, big, http.StatusForbidden)
+	})
+	if len(res.Header.Get("Content-Encoding")) > 0 || res.StatusCode != http.StatusForbidden {
+		t.Errorf("error response: %d, %q", res.StatusCode, res.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	c, _ := newCompressor(&CompressConf{Enable: true}, "test")
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	rec := httptest.NewRecorder()
+	cw := c.writer(rec, r)
+	cw.Header().Set("Content-Type", "text/event-stream")
+	cw.Header().Set("Cache-Control", "no-cache")
+	cw.WriteHeader(http.StatusOK)
+
+	// A held back response goes out on a flush
+	cw.Write([]byte("data: 1\n\n"))
+	cw.Flush()
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("flush: flushed %v, encoding %q", rec.Flushed, rec.Header().Get("Content-Encoding"))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 9)
+	if _, err := zr.Read(b); err != nil || string(b) != "data: 1\n\n" {
+		t.Errorf("flushed data %q, %v", b, err)
+	}
+	cw.Close()
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := strings.Repeat("decode me ", 50)
+
+	var gz, zl, br bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(body))
+	w.Close()
+
+	z := zlib.NewWriter(&zl)
+	z.Write([]byte(body))
+	z.Close()
+
+	b := brotli.NewWriter(&br)
+	b.Write([]byte(body))
+	b.Close()
+
+	tests := []struct {
+		ce   string
+		data []byte
+	}{
+		{"", []byte(body)},
+		{"identity", []byte(body)},
+		{"gzip", gz.Bytes()},
+		{"X-Gzip", gz.Bytes()},
+		{"deflate", zl.Bytes()},
+		{"br", br.Bytes()},
+	}
+
+	for _, tt := range tests {
+		rd, err := decodeBody(tt.ce, bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%q: %s", tt.ce, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(rd)
+		if err != nil || string(got) != body {
+			t.Errorf("%q: got %d bytes, %v", tt.ce, len(got), err)
+		}
+	}
+
+	if _, err := decodeBody("compress", bytes.NewReader(nil)); err == nil {
+		t.Errorf("unknown encoding decoded")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
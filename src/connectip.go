@@ -0,0 +1,890 @@
+// connectip.go -- CONNECT-IP (RFC 9484): IP packets tunneled over HTTP
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// A CONNECT-IP client (a MASQUE VPN) upgrades a request for
+// /.well-known/masque/ip/{target}/{ipproto}/ to "connect-ip" and then
+// sends and gets IP packets in DATAGRAM capsules (RFC 9297) on the
+// connection. The client is given an address from the listener's pool
+// and the routes of its scope. Its packets aren't forwarded as they
+// are: TCP is ended on a stack of our own (wgstack.go) and UDP on
+// sockets of the proxy, and the connections and datagrams go out
+// through the dialer like those of any other client, under the same
+// rules. Other protocols are dropped.
+
+const (
+	// MTU of the TCP of sessions; clients' MSS may lower it
+	CONNECT_IP_MTU = 1500
+
+	// capsules queued to a client before packets are dropped
+	CONNECT_IP_QUEUE = 512
+
+	// largest capsule taken from a client
+	CONNECT_IP_MAX_CAPSULE = 65535 + 64
+)
+
+// The path of CONNECT-IP requests (RFC 9484, 3)
+const connectIPPath = "/.well-known/masque/ip/"
+
+// Capsule types
+const (
+	capDatagram    = 0x00
+	capAddrAssign  = 0x01
+	capAddrRequest = 0x02
+	capRouteAdvert = 0x03
+)
+
+// Return true if 'r' asks for a CONNECT-IP session
+func isConnectIP(r *http.Request) bool {
+	return r.Method == "GET" && strings.EqualFold(upgradeType(r.Header), "connect-ip") &&
+		strings.HasPrefix(r.URL.Path, connectIPPath)
+}
+
+// The addresses given to clients; one of each prefix per session
+type ipPool struct {
+	sync.Mutex
+	v    []netip.Prefix
+	used map[netip.Addr]bool
+}
+
+func newIPPool(v []string) (*ipPool, error) {
+	p := &ipPool{used: make(map[netip.Addr]bool)}
+	for _, s := range v {
+		pfx, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("connectip: pool %s: %w", s, err)
+		}
+		if pfx.Addr().BitLen()-pfx.Bits() < 2 {
+			return nil, fmt.Errorf("connectip: pool %s: too small", s)
+		}
+		p.v = append(p.v, pfx.Masked())
+	}
+	return p, nil
+}
+
+// Return the address 'off' hosts into 'pfx'
+func addrAt(pfx netip.Prefix, off uint64) netip.Addr {
+	b := pfx.Addr().AsSlice()
+	for i := len(b) - 1; i >= 0 && off > 0; i-- {
+		s := uint64(b[i]) + off&0xff
+		b[i] = byte(s)
+		off = off>>8 + s>>8
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// Take an address from each prefix
+func (p *ipPool) get() ([]netip.Addr, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	var v []netip.Addr
+	for _, pfx := range p.v {
+		a, ok := p.take(pfx)
+		if !ok {
+			for _, x := range v {
+				delete(p.used, x)
+			}
+			return nil, fmt.Errorf("connectip: no free address in %s", pfx)
+		}
+		v = append(v, a)
+	}
+	return v, nil
+}
+
+// Take a free address of 'pfx'; the first and last aren't given out
+func (p *ipPool) take(pfx netip.Prefix) (netip.Addr, bool) {
+	hb := pfx.Addr().BitLen() - pfx.Bits()
+	free := func(a netip.Addr) bool {
+		if p.used[a] {
+			return false
+		}
+		p.used[a] = true
+		return true
+	}
+	if hb <= 16 {
+		for off := uint64(1); off < 1<<hb-1; off++ {
+			if a := addrAt(pfx, off); free(a) {
+				return a, true
+			}
+		}
+		return netip.Addr{}, false
+	}
+	lim := uint64(1) << min(hb, 63)
+	for i := 0; i < 64; i++ {
+		if a := addrAt(pfx, 1+rand.Uint64()%(lim-2)); free(a) {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func (p *ipPool) put(v []netip.Addr) {
+	p.Lock()
+	for _, a := range v {
+		delete(p.used, a)
+	}
+	p.Unlock()
+}
+
+// CONNECT-IP on an HTTP listener
+type connectIP struct {
+	listener string
+	pool     *ipPool
+
+	sessions, in, out, drops atomic.Uint64
+}
+
+func newConnectIP(c *ConnectIPConf, listen string) (*connectIP, error) {
+	if len(c.Pool) == 0 {
+		return nil, nil
+	}
+	pool, err := newIPPool(c.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return &connectIP{listener: listen, pool: pool}, nil
+}
+
+func (ci *connectIP) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", ci.listener)
+	return []metric{
+		{"goproxy_connectip_sessions_total", "counter", "CONNECT-IP sessions", l, float64(ci.sessions.Load())},
+		{"goproxy_connectip_packets_total", "counter", "IP packets of CONNECT-IP sessions",
+			l + `,direction="in"`, float64(ci.in.Load())},
+		{"goproxy_connectip_packets_total", "counter", "IP packets of CONNECT-IP sessions",
+			l + `,direction="out"`, float64(ci.out.Load())},
+		{"goproxy_connectip_drops_total", "counter", "IP packets of CONNECT-IP sessions dropped", l, float64(ci.drops.Load())},
+	}
+}
+
+// What a session may reach: the addresses of its target and an IP
+// protocol; nil and 0 are any
+type ipScope struct {
+	nets  []netip.Prefix
+	proto byte
+}
+
+// Parse the target and protocol of a CONNECT-IP request; names are
+// resolved by 'd'
+func parseIPScope(ctx context.Context, d *dialer, r *http.Request) (*ipScope, int, error) {
+	v := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), connectIPPath), "/")
+	if len(v) != 3 || len(v[2]) > 0 {
+		return nil, http.StatusBadRequest, errors.New("bad path")
+	}
+	target, err := url.PathUnescape(v[0])
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	sc := &ipScope{}
+	switch ps := v[1]; ps {
+	case "*":
+	case "6", "17":
+		n, _ := strconv.Atoi(ps)
+		sc.proto = byte(n)
+	default:
+		return nil, http.StatusNotImplemented, fmt.Errorf("unsupported ipproto %s", ps)
+	}
+
+	switch {
+	case target == "*":
+	case strings.Contains(target, "/"):
+		pfx, err := netip.ParsePrefix(target)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		sc.nets = []netip.Prefix{pfx.Masked()}
+	default:
+		if a, err := netip.ParseAddr(target); err == nil {
+			sc.nets = []netip.Prefix{netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())}
+			break
+		}
+		addrs, err := d.lookupIP(ctx, target)
+		if err != nil {
+			return nil, http.StatusBadGateway, err
+		}
+		for _, ia := range addrs {
+			if a, ok := netip.AddrFromSlice(ia.IP); ok {
+				a = a.Unmap()
+				sc.nets = append(sc.nets, netip.PrefixFrom(a, a.BitLen()))
+			}
+		}
+	}
+	return sc, 0, nil
+}
+
+// Return true if the scope has 'a'
+func (sc *ipScope) has(a netip.Addr, proto byte) bool {
+	if sc.proto != 0 && sc.proto != proto {
+		return false
+	}
+	if sc.nets == nil {
+		return true
+	}
+	for _, pfx := range sc.nets {
+		if pfx.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// The last address of 'pfx'
+func lastAddr(pfx netip.Prefix) netip.Addr {
+	b := pfx.Masked().Addr().AsSlice()
+	for i := pfx.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// The ROUTE_ADVERTISEMENT of the scope, for the families of 'addrs'
+func (sc *ipScope) routes(addrs []netip.Addr) []byte {
+	type rng struct{ lo, hi netip.Addr }
+	var v []rng
+	fam := func(a netip.Addr) bool {
+		for _, x := range addrs {
+			if x.Is4() == a.Is4() {
+				return true
+			}
+		}
+		return false
+	}
+	nets := sc.nets
+	if nets == nil {
+		nets = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	for _, pfx := range nets {
+		if fam(pfx.Addr()) {
+			v = append(v, rng{pfx.Addr(), lastAddr(pfx)})
+		}
+	}
+
+	// in order of family and start, without overlaps
+	sort.Slice(v, func(i, j int) bool {
+		if v[i].lo.Is4() != v[j].lo.Is4() {
+			return v[i].lo.Is4()
+		}
+		return v[i].lo.Less(v[j].lo)
+	})
+	var m []rng
+	for _, r := range v {
+		if k := len(m) - 1; k >= 0 && m[k].lo.Is4() == r.lo.Is4() && !m[k].hi.Less(r.lo) {
+			if m[k].hi.Less(r.hi) {
+				m[k].hi = r.hi
+			}
+			continue
+		}
+		m = append(m, r)
+	}
+
+	var b []byte
+	for _, r := range m {
+		if r.lo.Is4() {
+			b = append(b, 4)
+		} else {
+			b = append(b, 6)
+		}
+		b = append(b, r.lo.AsSlice()...)
+		b = append(b, r.hi.AsSlice()...)
+		b = append(b, sc.proto)
+	}
+	return b
+}
+
+// Append the QUIC variable length integer 'n' (RFC 9000, 16)
+func appendVarint(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, 0x40|byte(n>>8), byte(n))
+	case n < 1<<30:
+		return binary.BigEndian.AppendUint32(b, 0x80<<24|uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(b, 0xc0<<56|n)
+}
+
+func readVarint(r io.ByteReader) (uint64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(c & 0x3f)
+	for i := 1; i < 1<<(c>>6); i++ {
+		x, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | uint64(x)
+	}
+	return n, nil
+}
+
+// Parse a varint from 'b'; return it and the bytes used (0 if short)
+func parseVarint(b []byte) (uint64, int) {
+	r := bytes.NewReader(b)
+	n, err := readVarint(r)
+	if err != nil {
+		return 0, 0
+	}
+	return n, len(b) - r.Len()
+}
+
+// A capsule of 'typ' with the value 'v'
+func capsule(typ uint64, v []byte) []byte {
+	b := appendVarint(nil, typ)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// A CONNECT-IP session
+type ipSession struct {
+	p     *HTTPProxy
+	ci    *connectIP
+	log   *L.Logger
+	ctx   context.Context
+	stop  context.CancelFunc
+	c     net.Conn
+	br    *bufio.Reader
+	scope *ipScope
+	addrs []netip.Addr // the client's
+	stack *wgStack
+	q     chan []byte // capsules to the client
+
+	mu  sync.Mutex
+	udp map[netip.AddrPort]*ipUDPFlow
+
+	wg sync.WaitGroup
+
+	in, out atomic.Int64 // bytes from and to the client
+}
+
+// Serve a CONNECT-IP request
+func (p *HTTPProxy) handleConnectIP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := logOf(ctx, p.log)
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't support CONNECT-IP", http.StatusNotImplemented)
+		return
+	}
+	if r.Header.Get("Capsule-Protocol") != "?1" {
+		http.Error(w, "CONNECT-IP needs the capsule protocol", http.StatusBadRequest)
+		return
+	}
+	scope, code, err := parseIPScope(ctx, p.dial, r)
+	if err != nil {
+		log.Debug("%s: CONNECT-IP %s: %s", r.RemoteAddr, r.URL.Path, err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	addrs, err := p.cip.pool.get()
+	if err != nil {
+		log.Warn("%s: %s", r.RemoteAddr, err)
+		http.Error(w, "No address to assign", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.cip.pool.put(addrs)
+
+	client, brw, err := h.Hijack()
+	if err != nil {
+		log.Warn("can't do CONNECT-IP: hijack failed: %s", err)
+		return
+	}
+	defer client.Close()
+	t0 := time.Now()
+
+	client.SetDeadline(time.Now().Add(UPGRADE_TIMEOUT * time.Second))
+	_, err = io.WriteString(client, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: connect-ip\r\nCapsule-Protocol: ?1\r\n\r\n")
+	if err != nil {
+		log.Debug("%s: CONNECT-IP: %s", r.RemoteAddr, err)
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &ipSession{
+		p: p, ci: p.cip, log: log, ctx: ctx, stop: cancel,
+		c: client, br: brw.Reader, scope: scope, addrs: addrs,
+		q:   make(chan []byte, CONNECT_IP_QUEUE),
+		udp: make(map[netip.AddrPort]*ipUDPFlow),
+	}
+	s.stack = newWGStack(nil, CONNECT_IP_MTU, s.send)
+	s.stack.any = true
+	p.cip.sessions.Add(1)
+
+	dest := strings.TrimPrefix(r.URL.Path, connectIPPath)
+	moved := func() (int64, int64) { return s.in.Load(), s.out.Load() }
+	sess := p.auth.begin(ctx, "connect-ip", dest, moved)
+	live := startSession(ctx, p.conf.Listen, "connect-ip", dest, nil, moved)
+	log.Debug("%s: CONNECT-IP %s as %v", r.RemoteAddr, dest, addrs)
+
+	err = s.run()
+
+	live.done()
+	p.auth.end(sess)
+	log.Debug("%s: CONNECT-IP %s done: %d bytes in, %d out, %s: %v", r.RemoteAddr, dest,
+		s.in.Load(), s.out.Load(), time.Since(t0), err)
+	p.logRequest(r, http.StatusSwitchingProtocols, s.in.Load()+s.out.Load(), t0, t0, "")
+}
+
+// Relay packets until the client goes or the session is idle
+func (s *ipSession) run() error {
+	ln := s.stack.listen(0)
+	s.wg.Add(2)
+	go s.writer()
+	go s.accept(ln)
+	defer func() {
+		s.stop()
+		ln.Close()
+		s.c.Close()
+		s.stack.close()
+		s.mu.Lock()
+		for _, f := range s.udp {
+			f.c.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	}()
+
+	s.queue(capsule(capAddrAssign, s.assign(nil)))
+	s.queue(capsule(capRouteAdvert, s.scope.routes(s.addrs)))
+
+	idle := time.Duration(s.p.conf.Tunnel.Idle) * time.Second
+	for {
+		if idle > 0 {
+			s.c.SetReadDeadline(time.Now().Add(idle))
+		}
+		typ, v, err := s.readCapsule()
+		if err != nil {
+			if err == io.EOF || s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		switch typ {
+		case capDatagram:
+			// context 0 is IP packets; clients register no others
+			if id, n := parseVarint(v); n > 0 && id == 0 {
+				s.fromClient(v[n:])
+			}
+		case capAddrRequest:
+			s.queue(capsule(capAddrAssign, s.assign(v)))
+		}
+	}
+}
+
+// Read a capsule; those that aren't datagrams or address requests are
+// skipped (RFC 9297, 3.2)
+func (s *ipSession) readCapsule() (uint64, []byte, error) {
+	for {
+		typ, err := readVarint(s.br)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err := readVarint(s.br)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n > CONNECT_IP_MAX_CAPSULE {
+			return 0, nil, fmt.Errorf("capsule of %d bytes", n)
+		}
+		if typ != capDatagram && typ != capAddrRequest {
+			if _, err := s.br.Discard(int(n)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		v := make([]byte, n)
+		if _, err := io.ReadFull(s.br, v); err != nil {
+			return 0, nil, err
+		}
+		s.in.Add(int64(n))
+		return typ, v, nil
+	}
+}
+
+// The ADDRESS_ASSIGN of the client's addresses, answering the
+// ADDRESS_REQUEST 'req' if there is one: requests of a family we have
+// get our address, others the unspecified one (RFC 9484, 4.7.1)
+func (s *ipSession) assign(req []byte) []byte {
+	ids := make(map[int]uint64)
+	var want []int
+	for len(req) > 0 {
+		id, n := parseVarint(req)
+		if n == 0 || len(req) < n+1 {
+			break
+		}
+		ver := int(req[n])
+		sz := n + 1 + 4 + 1
+		if ver == 6 {
+			sz = n + 1 + 16 + 1
+		} else if ver != 4 {
+			break
+		}
+		if len(req) < sz {
+			break
+		}
+		if _, ok := ids[ver]; !ok {
+			want = append(want, ver)
+		}
+		ids[ver] = id
+		req = req[sz:]
+	}
+
+	var b []byte
+	add := func(id uint64, a netip.Addr) {
+		b = appendVarint(b, id)
+		if a.Is4() {
+			b = append(b, 4)
+		} else {
+			b = append(b, 6)
+		}
+		b = append(b, a.AsSlice()...)
+		b = append(b, byte(a.BitLen()))
+	}
+	for _, a := range s.addrs {
+		ver := 6
+		if a.Is4() {
+			ver = 4
+		}
+		add(ids[ver], a)
+		delete(ids, ver)
+	}
+	for _, ver := range want {
+		id, ok := ids[ver]
+		switch {
+		case !ok:
+		case ver == 4:
+			add(id, netip.IPv4Unspecified())
+		default:
+			add(id, netip.IPv6Unspecified())
+		}
+	}
+	return b
+}
+
+// Queue a capsule to the client; wait for room
+func (s *ipSession) queue(b []byte) {
+	select {
+	case s.q <- b:
+	case <-s.ctx.Done():
+	}
+}
+
+// Send the packet 'pkt' to the client; it is dropped if the client is
+// behind, as a congested link would
+func (s *ipSession) send(pkt []byte) {
+	v := make([]byte, 1, len(pkt)+1)
+	select {
+	case s.q <- capsule(capDatagram, append(v, pkt...)):
+		s.ci.out.Add(1)
+	default:
+		s.ci.drops.Add(1)
+	}
+}
+
+func (s *ipSession) writer() {
+	defer s.wg.Done()
+	bw := bufio.NewWriter(s.c)
+	for {
+		var b []byte
+		select {
+		case b = <-s.q:
+		case <-s.ctx.Done():
+			return
+		}
+		s.c.SetWriteDeadline(time.Now().Add(UPGRADE_TIMEOUT * time.Second))
+		for {
+			bw.Write(b)
+			s.out.Add(int64(len(b)))
+			if len(s.q) == 0 {
+				break
+			}
+			b = <-s.q
+		}
+		if err := bw.Flush(); err != nil {
+			s.log.Debug("CONNECT-IP: %s", err)
+			s.stop()
+			s.c.Close()
+			return
+		}
+	}
+}
+
+// Take a packet from the client: from its address, to its scope, of
+// TCP or UDP
+func (s *ipSession) fromClient(pkt []byte) {
+	var src, dst netip.Addr
+	var proto byte
+	var data []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		hl, n := int(pkt[0]&0xf)*4, int(binary.BigEndian.Uint16(pkt[2:]))
+		if hl < 20 || n < hl || n > len(pkt) || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			s.ci.drops.Add(1)
+			return
+		}
+		pkt = pkt[:n]
+		src, dst = netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+		proto, data = pkt[9], pkt[hl:]
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		n := 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if n > len(pkt) {
+			s.ci.drops.Add(1)
+			return
+		}
+		pkt = pkt[:n]
+		src, dst = netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+		proto, data = pkt[6], pkt[40:]
+	default:
+		s.ci.drops.Add(1)
+		return
+	}
+
+	mine := false
+	for _, a := range s.addrs {
+		mine = mine || a == src
+	}
+	if !mine || !s.scope.has(dst, proto) {
+		s.ci.drops.Add(1)
+		return
+	}
+
+	s.ci.in.Add(1)
+	switch proto {
+	case 6:
+		s.stack.input(pkt)
+	case 17:
+		s.fromClientUDP(src, dst, data)
+	default:
+		s.ci.drops.Add(1)
+	}
+}
+
+// Take the TCP connections of the client and dial their destinations
+func (s *ipSession) accept(ln *wgListener) {
+	defer s.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.relayTCP(c.(*wgConn))
+	}
+}
+
+func (s *ipSession) relayTCP(c *wgConn) {
+	defer s.wg.Done()
+	addr := c.LocalAddr().String()
+	d, err := s.p.dial.DialContext(s.ctx, "tcp", addr)
+	if err != nil {
+		if pe := isDenied(err); pe != nil {
+			s.log.Info("%s: CONNECT-IP: %s", s.c.RemoteAddr(), pe)
+		} else {
+			s.log.Debug("CONNECT-IP: can't connect to %s: %s", addr, err)
+		}
+		c.abort(err, true)
+		return
+	}
+
+	cp := &CancellableCopier{
+		Lhs:          c,
+		Rhs:          d.(tcpConn),
+		ReadTimeout:  s.p.conf.Tunnel.Idle,
+		WriteTimeout: 15, // XXX Config file
+		Linger:       s.p.conf.Tunnel.Linger,
+		IOBufsize:    s.p.conf.Bufsize,
+		MaxBytes:     s.p.conf.Tunnel.MaxBytes,
+	}
+	cp.Copy(s.ctx)
+}
+
+// The UDP socket of a client's port
+type ipUDPFlow struct {
+	c     *net.UDPConn
+	src   netip.AddrPort // of the client
+	last  atomic.Int64   // unix nsec
+	mu    sync.Mutex
+	peers map[netip.AddrPort]bool // sent to; only they may answer
+}
+
+func (s *ipSession) fromClientUDP(src, dst netip.Addr, b []byte) {
+	if len(b) < 8 || int(binary.BigEndian.Uint16(b[4:])) > len(b) || int(binary.BigEndian.Uint16(b[4:])) < 8 {
+		s.ci.drops.Add(1)
+		return
+	}
+	b = b[:binary.BigEndian.Uint16(b[4:])]
+	if binary.BigEndian.Uint16(b[6:]) != 0 && ipChecksum(src, dst, 17, b) != 0 {
+		s.ci.drops.Add(1)
+		return
+	}
+	from := netip.AddrPortFrom(src, binary.BigEndian.Uint16(b[0:]))
+	to := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(b[2:]))
+
+	ua := net.UDPAddrFromAddrPort(to)
+	if err := s.p.dial.CheckUDP(userOf(s.ctx), dst.String(), ua); err != nil {
+		s.log.Debug("CONNECT-IP: %s", err)
+		s.ci.drops.Add(1)
+		return
+	}
+
+	s.mu.Lock()
+	f := s.udp[from]
+	if f == nil {
+		var err error
+		if f, err = s.newUDPFlow(from, ua.IP); err != nil {
+			s.mu.Unlock()
+			s.log.Debug("CONNECT-IP: UDP from %s: %s", from, err)
+			s.ci.drops.Add(1)
+			return
+		}
+		s.udp[from] = f
+	}
+	s.mu.Unlock()
+
+	f.mu.Lock()
+	f.peers[to] = true
+	f.mu.Unlock()
+	f.last.Store(time.Now().UnixNano())
+	f.c.WriteToUDPAddrPort(b[8:], to)
+}
+
+// Make the socket of the client's 'src'; the caller holds s.mu
+func (s *ipSession) newUDPFlow(src netip.AddrPort, dst net.IP) (*ipUDPFlow, error) {
+	ip, err := s.p.dial.source(userOf(s.ctx), dst)
+	if err != nil {
+		return nil, err
+	}
+	var la *net.UDPAddr
+	if ip != nil {
+		la = &net.UDPAddr{IP: ip}
+	}
+	c, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return nil, err
+	}
+	f := &ipUDPFlow{c: c, src: src, peers: make(map[netip.AddrPort]bool)}
+	f.last.Store(time.Now().UnixNano())
+	s.wg.Add(1)
+	go s.fromRemoteUDP(f)
+	return f, nil
+}
+
+// Send the datagrams of the peers of 'f' to the client until it is idle
+func (s *ipSession) fromRemoteUDP(f *ipUDPFlow) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		if s.udp[f.src] == f {
+			delete(s.udp, f.src)
+		}
+		s.mu.Unlock()
+		f.c.Close()
+	}()
+
+	tout := time.Duration(UDP_TIMEOUT) * time.Second
+	b := make([]byte, 65536)
+	for {
+		f.c.SetReadDeadline(time.Now().Add(tout))
+		n, from, err := f.c.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if isTimeout(err) && time.Since(time.Unix(0, f.last.Load())) < tout {
+				continue
+			}
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		f.mu.Lock()
+		ok := f.peers[from]
+		f.mu.Unlock()
+		if !ok || from.Addr().Is4() != f.src.Addr().Is4() {
+			continue
+		}
+		f.last.Store(time.Now().UnixNano())
+		s.send(udpPacket(from, f.src, b[:n]))
+	}
+}
+
+// The checksum of the 'proto' payload 'seg' from 'src' to 'dst'; 0 if
+// it is right
+func ipChecksum(src, dst netip.Addr, proto byte, seg []byte) uint16 {
+	sum := csum(0, src.AsSlice())
+	sum = csum(sum, dst.AsSlice())
+	sum += uint32(proto) + uint32(len(seg))
+	return ^fold(csum(sum, seg))
+}
+
+// An IP packet with the UDP datagram 'data' from 'src' to 'dst'
+func udpPacket(src, dst netip.AddrPort, data []byte) []byte {
+	seg := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(seg[0:], src.Port())
+	binary.BigEndian.PutUint16(seg[2:], dst.Port())
+	binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)))
+	copy(seg[8:], data)
+	sum := ipChecksum(src.Addr(), dst.Addr(), 17, seg)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(seg[6:], sum)
+
+	var ip []byte
+	if src.Addr().Is4() {
+		ip = make([]byte, 20, 20+len(seg))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(seg)))
+		ip[8], ip[9] = 64, 17
+		a, b := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], a[:])
+		copy(ip[16:], b[:])
+		binary.BigEndian.PutUint16(ip[10:], ^fold(csum(0, ip)))
+	} else {
+		ip = make([]byte, 40, 40+len(seg))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(seg)))
+		ip[6], ip[7] = 17, 64
+		a, b := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], a[:])
+		copy(ip[24:], b[:])
+	}
+	return append(ip, seg...)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
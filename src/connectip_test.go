@@ -0,0 +1,288 @@
+// connectip_test.go -- tests for CONNECT-IP
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectIPPool(t *testing.T) {
+	for _, s := range []string{"10.0.0.1/31", "10.0.0.0", "fd00::/127"} {
+		if _, err := newIPPool([]string{s}); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+
+	p, err := newIPPool([]string{"10.0.0.5/30", "fd77::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.get()
+	if err != nil || len(a) != 2 || a[0].String() != "10.0.0.5" || !netip.MustParsePrefix("fd77::/64").Contains(a[1]) {
+		t.Fatalf("get: %v %v", a, err)
+	}
+	b, err := p.get()
+	if err != nil || b[0].String() != "10.0.0.6" || b[1] == a[1] {
+		t.Fatalf("get: %v %v", b, err)
+	}
+	if _, err := p.get(); err == nil {
+		t.Errorf("exhausted: no error")
+	}
+	if len(p.used) != 4 {
+		t.Errorf("used: %v", p.used)
+	}
+	p.put(a)
+	if c, err := p.get(); err != nil || c[0] != a[0] {
+		t.Errorf("again: %v %v", c, err)
+	}
+
+	if a := addrAt(netip.MustParsePrefix("10.0.0.0/8"), 0x1ff); a.String() != "10.0.1.255" {
+		t.Errorf("addrAt: %s", a)
+	}
+	if a := lastAddr(netip.MustParsePrefix("fd00::/120")); a.String() != "fd00::ff" {
+		t.Errorf("lastAddr: %s", a)
+	}
+
+	for _, n := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, n)
+		if m, k := parseVarint(b); m != n || k != len(b) {
+			t.Errorf("varint %d: %x -> %d", n, b, m)
+		}
+	}
+}
+
+func TestConnectIPRoutes(t *testing.T) {
+	v4, v6 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd77::2")
+	for _, v := range []struct {
+		sc    ipScope
+		addrs []netip.Addr
+		want  string
+	}{
+		{ipScope{}, []netip.Addr{v4}, "04" + "00000000" + "ffffffff" + "00"},
+		{ipScope{proto: 6}, []netip.Addr{v6, v4}, "04" + "00000000" + "ffffffff" + "06" +
+			"06" + strings.Repeat("00", 16) + strings.Repeat("ff", 16) + "06"},
+		{ipScope{nets: []netip.Prefix{
+			netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("fd00::/8"),
+		}}, []netip.Addr{v4}, "04" + "0a000000" + "0affffff" + "00" + "04" + "c0000201" + "c0000201" + "00"},
+	} {
+		if got := hex.EncodeToString(v.sc.routes(v.addrs)); got != v.want {
+			t.Errorf("%+v: %s, want %s", v.sc, got, v.want)
+		}
+	}
+}
+
+// A CONNECT-IP client: a stack on the addresses it is given
+type ipClient struct {
+	c     net.Conn
+	br    *bufio.Reader
+	addrs []netip.Addr
+	stack *wgStack
+	udp   chan []byte
+}
+
+func (ic *ipClient) readCapsule(t *testing.T) (uint64, []byte) {
+	typ, err := readVarint(ic.br)
+	if err != nil {
+		return 0, nil
+	}
+	n, _ := readVarint(ic.br)
+	v := make([]byte, n)
+	if _, err := io.ReadFull(ic.br, v); err != nil {
+		return 0, nil
+	}
+	return typ, v
+}
+
+func (ic *ipClient) send(pkt []byte) {
+	ic.c.Write(capsule(capDatagram, append([]byte{0}, pkt...)))
+}
+
+// Start a CONNECT-IP session to 'path' at 'addr'; return the client
+// after its addresses and routes came
+func connectIPClient(t *testing.T, addr, path string) (*ipClient, string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(c, "GET "+path+" HTTP/1.1\r\nHost: "+addr+
+		"\r\nConnection: Upgrade\r\nUpgrade: connect-ip\r\nCapsule-Protocol: ?1\r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := &ipClient{c: c, br: br, udp: make(chan []byte, 16)}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return ic, res.Status
+	}
+
+	typ, v := ic.readCapsule(t)
+	if typ != capAddrAssign {
+		t.Fatalf("capsule %d, want ADDRESS_ASSIGN", typ)
+	}
+	for len(v) > 0 {
+		n := 1 + 4
+		if v[1] == 6 {
+			n = 1 + 16
+		}
+		a, _ := netip.AddrFromSlice(v[2 : 1+n])
+		ic.addrs = append(ic.addrs, a)
+		v = v[1+n+1:]
+	}
+	if typ, _ = ic.readCapsule(t); typ != capRouteAdvert {
+		t.Fatalf("capsule %d, want ROUTE_ADVERTISEMENT", typ)
+	}
+
+	ic.stack = newWGStack(ic.addrs, 1400, ic.send)
+	go func() {
+		for {
+			typ, v := ic.readCapsule(t)
+			switch {
+			case v == nil:
+				ic.stack.close()
+				return
+			case typ != capDatagram:
+			case v[1]>>4 == 4 && v[1+9] == 17:
+				ic.udp <- v[1:]
+			default:
+				ic.stack.input(v[1:])
+			}
+		}
+	}()
+	return ic, res.Status
+}
+
+func TestConnectIP(t *testing.T) {
+	echo := startEcho(t)
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, from, err := uc.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			uc.WriteToUDP(bytes.ToUpper(b[:n]), from)
+		}
+	}()
+
+	addr := startHTTPProxy(t, &ListenConf{
+		ConnectIP: ConnectIPConf{Pool: []string{"10.77.0.0/24", "fd77::/64"}},
+		Rules:     []RuleConf{{Name: "no", Dest: []string{"127.0.0.2/32"}, Action: "deny"}},
+	})
+
+	ic, st := connectIPClient(t, addr, "/.well-known/masque/ip/*/*/")
+	if len(ic.addrs) != 2 || ic.addrs[0].String() != "10.77.0.1" {
+		t.Fatalf("%s: addresses %v", st, ic.addrs)
+	}
+
+	// TCP, ended at the proxy and dialed from there
+	ep := echo.Addr().(*net.TCPAddr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := ic.stack.dial(ctx, netip.MustParseAddr("127.0.0.1"), ep.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := bytes.Repeat([]byte("0123456789"), 20000)
+	go c.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("tcp echo: %v", err)
+	}
+	c.Close()
+
+	// the rules apply: the connection is reset
+	if c, err := ic.stack.dial(ctx, netip.MustParseAddr("127.0.0.2"), ep.Port); err == nil {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(got); err == nil || err == io.EOF || isTimeout(err) {
+			t.Errorf("denied: %d %v", n, err)
+		}
+		c.Close()
+	}
+
+	// UDP
+	src := netip.AddrPortFrom(ic.addrs[0], 5353)
+	dst := netip.MustParseAddrPort(uc.LocalAddr().String())
+	ic.send(udpPacket(src, dst, []byte("hello")))
+	select {
+	case p := <-ic.udp:
+		if !bytes.Equal(p, udpPacket(dst, src, []byte("HELLO"))) {
+			t.Errorf("udp: %x", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("udp: no reply")
+	}
+
+	// packets from other addresses are dropped
+	ic.send(udpPacket(netip.MustParseAddrPort("10.77.0.9:5353"), dst, []byte("spoof")))
+
+	// a scope of TCP to one address
+	ic2, _ := connectIPClient(t, addr, "/.well-known/masque/ip/127.0.0.1/6/")
+	if ic2.addrs[0] == ic.addrs[0] {
+		t.Errorf("same address for both sessions: %s", ic2.addrs[0])
+	}
+	ic2.send(udpPacket(netip.AddrPortFrom(ic2.addrs[0], 5353), dst, []byte("hello")))
+	select {
+	case p := <-ic2.udp:
+		t.Errorf("udp outside the scope: %x", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel2()
+	if _, err := ic2.stack.dial(ctx2, netip.MustParseAddr("127.0.0.3"), ep.Port); err == nil {
+		t.Errorf("outside the scope: no error")
+	}
+
+	for _, v := range []struct{ path, status string }{
+		{"/.well-known/masque/ip/*/1/", "501"},
+		{"/.well-known/masque/ip/*/", "400"},
+		{"/.well-known/masque/ip/10.0.0.0%2F33/*/", "400"},
+	} {
+		if _, st := connectIPClient(t, addr, v.path); !strings.HasPrefix(st, v.status) {
+			t.Errorf("%s: %s", v.path, st)
+		}
+	}
+}
+
+// The ADDRESS_ASSIGN answering a request
+func TestConnectIPAssign(t *testing.T) {
+	s := &ipSession{addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")}}
+	req := append(appendVarint(nil, 7), 4, 0, 0, 0, 0, 32)
+	req = append(append(req, appendVarint(nil, 9)...), 6)
+	req = append(req, make([]byte, 16)...)
+	req = append(req, 128)
+	want := "07" + "04" + "0a000002" + "20" + "09" + "06" + strings.Repeat("00", 16) + "80"
+	if got := hex.EncodeToString(s.assign(req)); got != want {
+		t.Errorf("assign: %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(s.assign(nil)); got != "00040a00000220" {
+		t.Errorf("unsolicited: %s", got)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -13,38 +13,115 @@ import (
 	"net"
 	"io"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// Default tunnel timeouts (seconds)
+const (
+	TUNNEL_IDLE   = 300
+	TUNNEL_LINGER = 30
+)
+
+var errTunnelLimit = newError(ErrQuotaExceeded, "tunnel byte limit exceeded")
+
+// The TCP connection methods the copier needs; *net.TCPConn and
+// wrappers around it.
+type tcpConn interface {
+	net.Conn
+	CloseWrite() error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// How a tunnel moves bytes from 's' to 'd': copyBuf or one of the relays
+type relayFunc func(c *CancellableCopier, d, s tcpConn, pool *bufPool) (int, error)
 
 type CancellableCopier struct {
-	Lhs *net.TCPConn
-	Rhs *net.TCPConn
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	last  int64 // time of last read in either direction (unix nanosec)
+	idle  int64 // current idle timeout (nanosec)
+	moved int64 // bytes read in both directions
+	toRhs int64 // bytes sent to Rhs
+	toLhs int64 // bytes sent to Lhs
 
+	Lhs tcpConn
+	Rhs tcpConn
+
+	// Seconds both directions may be idle before the tunnel is closed
 	ReadTimeout int
 	WriteTimeout int
 
+	// Seconds the remaining direction may be idle after the other
+	// side has closed its half
+	Linger int
+
 	IOBufsize  int
+
+	// Max bytes relayed in both directions together; 0 is unlimited
+	MaxBytes int64
+
+	// Bytes read from Lhs before the copy (see sniff.go); they are sent
+	// to Rhs first
+	Prelude []byte
+
+	// Relay in the kernel through the BPF sockmap, where we can
+	Sockmap bool
+	kern    *sockPair
+
+	// Closed when the tunnel is aborted or its idle timeout changes;
+	// wakes relays that don't wait in the netpoller (see copy_uring.go)
+	mu   sync.Mutex
+	wake chan struct{}
+
+	// Capture of the relayed bytes, if any (see capture.go); a tapped
+	// tunnel is relayed by copyBuf. kernel is true if the tunnel is in
+	// the sockmap, where it can't be tapped; under mu.
+	tap    atomic.Pointer[capture]
+	kernel bool
 }
 
 // CancellableCopy does bi-directional I/O between two connections d & s. It is cancellable
 // if the context 'ctx' is cancelled.
-// It returns number of bytes transferred in each direction.
+// When one side closes its half (EOF), the FIN is forwarded and the other direction drains
+// until it closes too or is idle for c.Linger seconds. Errors abort both directions. Both
+// connections are closed when Copy returns.
+// It returns number of bytes transferred in each direction; the error is errTunnelLimit if
+// the tunnel was closed for relaying more than c.MaxBytes.
 func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error) {
 
-	bufsz := c.IOBufsize
-	if bufsz <= 0 {
-		bufsz = 16384
-	}
+	pool := getPool(c.IOBufsize)
 
 	if c.ReadTimeout <= 0 {
-		c.ReadTimeout = 10  // seconds
+		c.ReadTimeout = TUNNEL_IDLE
 	}
 
 	if c.WriteTimeout <= 0 {
 		c.WriteTimeout = 15 // seconds
 	}
 
+	if c.Linger <= 0 {
+		c.Linger = TUNNEL_LINGER
+	}
+
+	atomic.StoreInt64(&c.idle, int64(time.Duration(c.ReadTimeout)*time.Second))
+	c.touch()
+
+	pre := len(c.Prelude)
+	if pre > 0 {
+		c.Rhs.SetWriteDeadline(time.Now().Add(time.Duration(c.WriteTimeout) * time.Second))
+		_, err = c.Rhs.Write(c.Prelude)
+		c.Rhs.SetWriteDeadline(time.Time{})
+		if err == nil {
+			err = c.account(c.Rhs, pre)
+		}
+		if err != nil {
+			c.Lhs.Close()
+			c.Rhs.Close()
+			return 0, 0, err
+		}
+	}
+
 	// have to wait until both go-routines are done.
 	var wg sync.WaitGroup
 
@@ -59,19 +136,32 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 		close(ch)
 	}()
 
-	b0 := make([]byte, bufsz)
-	b1 := make([]byte, bufsz)
+	var once sync.Once
+
+	// The kernel can't stop a tunnel at its byte limit or show us
+	// its bytes
+	relay := (*CancellableCopier).relay
+	c.mu.Lock()
+	if c.Sockmap && c.MaxBytes <= 0 && c.tap.Load() == nil {
+		relay = c.redirect()
+	}
+	c.kernel = c.kern != nil
+	c.mu.Unlock()
 
 	// copy #1
 	go func() {
 		defer wg.Done()
-		_, nLhs, _ = c.copyBuf(c.Lhs, c.Rhs, b0)
+		var err error
+		nLhs, err = relay(c, c.Lhs, c.Rhs, pool)
+		c.done(c.Lhs, c.Rhs, err, &once)
 	}()
 
 	// copy #2
 	go func() {
 		defer wg.Done()
-		_, nRhs, _ = c.copyBuf(c.Rhs, c.Lhs, b1)
+		var err error
+		nRhs, err = relay(c, c.Rhs, c.Lhs, pool)
+		c.done(c.Rhs, c.Lhs, err, &once)
 	}()
 
 
@@ -80,6 +170,7 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 	select {
 	case <-ctx.Done():
 		// close the sockets and force the i/o loop in copybuf to end.
+		c.notify()
 		c.Lhs.Close()
 		c.Rhs.Close()
 		<- ch
@@ -87,40 +178,179 @@ func (c *CancellableCopier) Copy(ctx context.Context) (nLhs, nRhs int, err error
 	case <-ch:
 	}
 
+	c.Lhs.Close()
+	c.Rhs.Close()
+
+	nRhs += pre
+	atomic.StoreInt64(&c.toRhs, int64(nRhs))
+	atomic.StoreInt64(&c.toLhs, int64(nLhs))
 
 	// XXX Gah which error do I report?
 	err = nil
+	if c.MaxBytes > 0 && atomic.LoadInt64(&c.moved) > c.MaxBytes {
+		err = errTunnelLimit
+	}
 	return
 }
 
+// The copy from 's' to 'd' has ended with 'err'. On EOF forward the
+// FIN to 'd' and let the other direction (d -> s) drain; else abort
+// both directions.
+func (c *CancellableCopier) done(d, s tcpConn, err error, once *sync.Once) {
+	if err != nil {
+		c.notify()
+		c.Lhs.Close()
+		c.Rhs.Close()
+		return
+	}
+
+	d.CloseWrite()
+
+	// The first half-close switches the tunnel to the linger timeout
+	once.Do(func() {
+		linger := time.Duration(c.Linger) * time.Second
+		if linger < c.timeout() {
+			atomic.StoreInt64(&c.idle, int64(linger))
+			d.SetReadDeadline(time.Now().Add(linger))
+			c.notify()
+		}
+	})
+}
+
+// Return a channel that is closed at the next notify()
+func (c *CancellableCopier) changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
+	if c.wake == nil {
+		c.wake = make(chan struct{})
+	}
+	return c.wake
+}
 
-func (c *CancellableCopier) copyBuf(d, s *net.TCPConn, b []byte) (nr, nw int, err error) {
-	rto := time.Duration(c.ReadTimeout) * time.Second
+// Wake everyone waiting on changed()
+func (c *CancellableCopier) notify() {
+	c.mu.Lock()
+	if c.wake != nil {
+		close(c.wake)
+		c.wake = nil
+	}
+	c.mu.Unlock()
+}
+
+// Note activity on the tunnel
+func (c *CancellableCopier) touch() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// Account for 'n' bytes read for 'd'; return errTunnelLimit if the
+// tunnel is over its limit. The bytes that go over aren't relayed.
+func (c *CancellableCopier) account(d tcpConn, n int) error {
+	if d == c.Rhs {
+		atomic.AddInt64(&c.toRhs, int64(n))
+	} else {
+		atomic.AddInt64(&c.toLhs, int64(n))
+	}
+
+	if c.MaxBytes <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&c.moved, int64(n)) > c.MaxBytes {
+		return errTunnelLimit
+	}
+	return nil
+}
+
+// Copy the bytes relayed from now on to 't'; the relays switch to
+// copyBuf at their next read.
+func (c *CancellableCopier) Tap(t *capture) error {
+	c.mu.Lock()
+	switch {
+	case c.kernel:
+		c.mu.Unlock()
+		return errCaptureKernel
+	case !c.tap.CompareAndSwap(nil, t):
+		c.mu.Unlock()
+		return errCaptureBusy
+	}
+	c.mu.Unlock()
+	c.notify()
+	return nil
+}
+
+// Return the bytes relayed so far from Lhs to Rhs and from Rhs to Lhs.
+// Bytes relayed in the kernel (sockmap) are known when Copy returns.
+func (c *CancellableCopier) Moved() (lhs, rhs int64) {
+	return atomic.LoadInt64(&c.toRhs), atomic.LoadInt64(&c.toLhs)
+}
+
+// Current idle timeout
+func (c *CancellableCopier) timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.idle))
+}
+
+// Return true if the tunnel saw activity within the idle timeout. A
+// read that times out while the other direction is busy just goes on
+// reading.
+func (c *CancellableCopier) active() bool {
+	t := time.Unix(0, atomic.LoadInt64(&c.last))
+	return time.Since(t) < c.timeout()
+}
+
+// Generic copy loop from 's' to 'd' via pooled buffers; return bytes
+// written to 'd'. A nil error means 's' reached EOF. Between reads the
+// connection is parked until it is readable - so idle connections don't
+// hold a buffer.
+func (c *CancellableCopier) copyBuf(d, s tcpConn, pool *bufPool) (nw int, err error) {
 	wto := time.Duration(c.WriteTimeout) * time.Second
 	for {
-		s.SetReadDeadline(time.Now().Add(rto))
-		nr, err = s.Read(b)
-		if err != nil && err != io.EOF && err != context.Canceled && !isReset(err) {
+		s.SetReadDeadline(time.Now().Add(c.timeout()))
+		if err = park(s); err != nil {
+			if isTimeout(err) && c.active() {
+				continue
+			}
 			return
 		}
+
+		b := pool.Get()
+		nr, rerr := s.Read(*b)
 		if nr > 0 {
+			var m int
+
+			c.touch()
+			if err = c.account(d, nr); err != nil {
+				pool.Put(b)
+				return
+			}
+			if t := c.tap.Load(); t != nil {
+				t.data(d == c.Rhs, (*b)[:nr])
+			}
 			d.SetWriteDeadline(time.Now().Add(wto))
-			nw, err = d.Write(b[:nr])
+			m, err = d.Write((*b)[:nr])
+			nw += m
 			if err != nil {
+				pool.Put(b)
 				return
 			}
-			if nw != nr {
-				return
+		}
+		pool.Put(b)
+
+		if rerr != nil {
+			if isTimeout(rerr) && c.active() {
+				continue
+			}
+			if rerr != io.EOF {
+				err = rerr
+			} else if t := c.tap.Load(); t != nil {
+				t.fin(d == c.Rhs)
 			}
+			return
 		}
-		if err != nil || nr == 0 {
+		if nr == 0 {
+			if t := c.tap.Load(); t != nil {
+				t.fin(d == c.Rhs)
+			}
 			return
 		}
 	}
-
-	d.CloseWrite()
-	s.CloseRead()
-	err = nil
-	return
 }
@@ -0,0 +1,202 @@
+// copy_linux.go -- zero-copy relay with splice(2)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux
+
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// splice(2) flags
+const (
+	_SPLICE_F_MOVE     = 0x1
+	_SPLICE_F_NONBLOCK = 0x2
+)
+
+// Max bytes moved per splice; this is the default pipe capacity.
+const SPLICE_SIZE = 65536
+
+// Empty pipes kept for reuse. A tunnel direction holds a pipe only while
+// data is moving; idle tunnels hold none.
+const SPLICE_PIPES = 64
+
+var pipes = struct {
+	sync.Mutex
+	v [][2]int
+}{}
+
+// Return an empty pipe
+func getPipe() ([2]int, error) {
+	var p [2]int
+
+	pipes.Lock()
+	if n := len(pipes.v); n > 0 {
+		p = pipes.v[n-1]
+		pipes.v = pipes.v[:n-1]
+		pipes.Unlock()
+		return p, nil
+	}
+	pipes.Unlock()
+
+	err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK)
+	return p, err
+}
+
+// Return the empty pipe 'p' for reuse
+func putPipe(p [2]int) {
+	pipes.Lock()
+	if len(pipes.v) < SPLICE_PIPES {
+		pipes.v = append(pipes.v, p)
+		pipes.Unlock()
+		return
+	}
+	pipes.Unlock()
+	closePipe(p)
+}
+
+func closePipe(p [2]int) {
+	syscall.Close(p[0])
+	syscall.Close(p[1])
+}
+
+// Copy from 's' to 'd' until EOF or error; return bytes written to 'd'.
+//
+// The data moves socket -> pipe -> socket inside the kernel and never
+// touches a user space buffer. Between bursts the connection is parked
+// and the pipe goes back to the pool. Deadlines, idle handling and the
+// return values are the same as copyBuf(). If a pipe can't be had or the
+// kernel doesn't splice these sockets, we fall back to copyBuf().
+func (c *CancellableCopier) spliceRelay(d, s tcpConn, pool *bufPool) (int, error) {
+	rc, err := s.SyscallConn()
+	if err != nil {
+		return c.fallback(d, s, pool)
+	}
+	wc, err := d.SyscallConn()
+	if err != nil {
+		return c.fallback(d, s, pool)
+	}
+
+	var nw int
+	for {
+		s.SetReadDeadline(time.Now().Add(c.timeout()))
+		if err = park(s); err != nil {
+			if isTimeout(err) && c.active() {
+				continue
+			}
+			return nw, err
+		}
+		if c.tap.Load() != nil {
+			m, err := c.copyBuf(d, s, pool)
+			return nw + m, err
+		}
+
+		p, err := getPipe()
+		if err != nil {
+			m, err := c.fallback(d, s, pool)
+			return nw + m, err
+		}
+
+		m, eof, err := c.burst(d, wc, rc, p)
+		nw += m
+		if err != nil {
+			closePipe(p)
+			if nw == 0 && noSplice(err) {
+				return c.fallback(d, s, pool)
+			}
+			return nw, err
+		}
+
+		putPipe(p)
+		if eof {
+			return nw, nil
+		}
+	}
+}
+
+// Move what 's' (read via 'rc') has to read through pipe 'p' to 'd' (via
+// 'wc'); stop when 's' has nothing more for now or is at EOF. The pipe
+// is empty unless there is an error.
+func (c *CancellableCopier) burst(d tcpConn, wc, rc syscall.RawConn, p [2]int) (nw int, eof bool, err error) {
+	wto := time.Duration(c.WriteTimeout) * time.Second
+	for {
+		var n int64
+		var serr error
+
+		err = rc.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), p[1], SPLICE_SIZE)
+			return true
+		})
+		if err == nil {
+			err = serr
+		}
+
+		switch {
+		case err == syscall.EAGAIN:
+			return nw, false, nil
+		case err != nil:
+			return nw, false, err
+		case n == 0:
+			return nw, true, nil
+		}
+		c.touch()
+		if err = c.account(d, int(n)); err != nil {
+			return nw, false, err
+		}
+
+		// Drain the pipe into 'd'
+		for n > 0 {
+			var m int64
+
+			d.SetWriteDeadline(time.Now().Add(wto))
+			err = wc.Write(func(fd uintptr) bool {
+				m, serr = splice(p[0], int(fd), int(n))
+				return serr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return nw, false, err
+			}
+
+			n -= m
+			nw += int(m)
+		}
+	}
+}
+
+// Generic copy loop
+func (c *CancellableCopier) fallback(d, s tcpConn, pool *bufPool) (int, error) {
+	return c.copyBuf(d, s, pool)
+}
+
+// Return true if 'err' says the kernel can't splice this socket (e.g.,
+// MPTCP sockets on older kernels)
+func noSplice(err error) bool {
+	switch err {
+	case syscall.EINVAL, syscall.ENOSYS, syscall.EOPNOTSUPP:
+		return true
+	}
+	return false
+}
+
+// Move up to 'n' bytes from 'rfd' to 'wfd'
+func splice(rfd, wfd int, n int) (int64, error) {
+	for {
+		m, err := syscall.Splice(rfd, nil, wfd, nil, n, _SPLICE_F_MOVE|_SPLICE_F_NONBLOCK)
+		if err != syscall.EINTR {
+			return int64(m), err
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
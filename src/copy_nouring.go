@@ -0,0 +1,18 @@
+// copy_nouring.go -- relay for linux builds without io_uring
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,!iouring
+
+package main
+
+// Copy from 's' to 'd' until EOF or error; return bytes written to 'd'
+func (c *CancellableCopier) relay(d, s tcpConn, pool *bufPool) (int, error) {
+	return c.spliceRelay(d, s, pool)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
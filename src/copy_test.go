@@ -0,0 +1,98 @@
+// copy_test.go -- tests for the tunnel copier
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// A tunnel over its byte limit is closed without relaying the excess
+func TestTunnelMaxBytes(t *testing.T) {
+	const max = 64 << 10
+
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	c := &CancellableCopier{
+		Lhs:      lhs,
+		Rhs:      rhs,
+		MaxBytes: max,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.Copy(context.Background())
+		done <- err
+	}()
+
+	go client.Write(make([]byte, 1<<20))
+
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	got, _ := ioutil.ReadAll(server)
+	if len(got) > max {
+		t.Errorf("relayed %d bytes; limit %d", len(got), max)
+	}
+
+	select {
+	case err := <-done:
+		if err != errTunnelLimit {
+			t.Errorf("Copy: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel didn't end")
+	}
+}
+
+// Under the limit, a tunnel ends as usual
+func TestTunnelUnderLimit(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	c := &CancellableCopier{
+		Lhs:      lhs,
+		Rhs:      rhs,
+		MaxBytes: 1 << 20,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.Copy(context.Background())
+		done <- err
+	}()
+
+	go func() {
+		client.Write(make([]byte, 1000))
+		client.Close()
+	}()
+
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	got, _ := ioutil.ReadAll(server)
+	server.Close()
+	if len(got) != 1000 {
+		t.Errorf("relayed %d of 1000 bytes", len(got))
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Copy: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel didn't end")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
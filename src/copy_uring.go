@@ -0,0 +1,119 @@
+// copy_uring.go -- relay through io_uring (experimental)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,iouring
+
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Copy from 's' to 'd' until EOF or error; return bytes written to 'd'.
+//
+// Waits and I/O go through the shared io_uring instead of the runtime
+// netpoller: a tunnel waits for input with a poll request (and a linked
+// timeout) and takes a pooled buffer only to receive and send what is
+// there. Timeouts, half-closes and the return values are the same as
+// copyBuf(). If the ring can't be set up, we use spliceRelay().
+func (c *CancellableCopier) relay(d, s tcpConn, pool *bufPool) (int, error) {
+	r, err := getRing()
+	if err != nil {
+		return c.spliceRelay(d, s, pool)
+	}
+
+	rc, err := s.SyscallConn()
+	if err != nil {
+		return c.spliceRelay(d, s, pool)
+	}
+	wc, err := d.SyscallConn()
+	if err != nil {
+		return c.spliceRelay(d, s, pool)
+	}
+
+	// completions of our ops; we have at most one outstanding
+	ch := make(chan int32, 1)
+
+	var nw int
+	for {
+		wake := c.changed()
+		last := time.Unix(0, atomic.LoadInt64(&c.last))
+		tmo := c.timeout() - time.Since(last)
+		if tmo <= 0 {
+			return nw, os.ErrDeadlineExceeded
+		}
+
+		// Timeouts and wakeups just go around again: the idle timeout
+		// may have changed or the other direction is busy.
+		if err = r.poll(ch, rc, _POLLIN, tmo, wake); err != nil {
+			if err == errRingWoken || isTimeout(err) {
+				continue
+			}
+			return nw, err
+		}
+		if c.tap.Load() != nil {
+			m, err := c.copyBuf(d, s, pool)
+			return nw + m, err
+		}
+
+		b := pool.Get()
+		n, err := r.io(ch, rc, _IORING_OP_RECV, *b, 0)
+		if err != nil || n == 0 {
+			pool.Put(b)
+			switch {
+			case err == syscall.EAGAIN:
+				continue
+			case err == syscall.EINVAL && nw == 0:
+				// the kernel can't RECV on this socket
+				return c.spliceRelay(d, s, pool)
+			}
+			return nw, err
+		}
+		c.touch()
+		if err = c.account(d, n); err != nil {
+			pool.Put(b)
+			return nw, err
+		}
+
+		m, err := c.ringSend(r, ch, wc, (*b)[:n])
+		nw += m
+		pool.Put(b)
+		if err != nil {
+			return nw, err
+		}
+	}
+}
+
+// Send all of 'b' to the socket 'wc'
+func (c *CancellableCopier) ringSend(r *ioRing, ch chan int32, wc syscall.RawConn, b []byte) (int, error) {
+	wto := time.Duration(c.WriteTimeout) * time.Second
+
+	var nw int
+	for len(b) > 0 {
+		n, err := r.io(ch, wc, _IORING_OP_SEND, b, _MSG_NOSIGNAL)
+		if err == syscall.EAGAIN {
+			err = r.poll(ch, wc, _POLLOUT, wto, c.changed())
+			if err != nil && err != errRingWoken {
+				return nw, err
+			}
+			continue
+		}
+		if err != nil {
+			return nw, err
+		}
+
+		nw += n
+		b = b[n:]
+	}
+	return nw, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,40 @@
+// copy_uring_test.go -- io_uring relay benchmarks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,iouring
+
+package main
+
+import (
+	"testing"
+)
+
+// The io_uring relay against the runtime netpoller (copyBuf) and splice
+// on the same tunnels. Run with:
+//
+//	go test -tags iouring -run XXX -bench Relay ./src
+func BenchmarkRelay(b *testing.B) {
+	if _, err := getRing(); err != nil {
+		b.Skipf("no io_uring: %s", err)
+	}
+
+	pool := getPool(IO_BUFSIZE)
+	newPool := func() *bufPool { return pool }
+
+	b.Run("netpoller", func(b *testing.B) {
+		benchRelay(b, (*CancellableCopier).copyBuf, newPool)
+	})
+	b.Run("splice", func(b *testing.B) {
+		benchRelay(b, (*CancellableCopier).spliceRelay, newPool)
+	})
+	b.Run("uring", func(b *testing.B) {
+		benchRelay(b, (*CancellableCopier).relay, newPool)
+	})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
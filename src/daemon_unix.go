@@ -0,0 +1,165 @@
+// daemon_unix.go -- running in the background with a pid file
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A goproxy can't fork(2); it starts itself again in a new session with
+// DAEMON_ENV set and waits until that one serves. Until then the
+// daemon's warnings go to its parent, which prints them and exits with
+// its status.
+
+const (
+	DAEMON_ENV = "GOPROXY_DAEMON"
+
+	// What the daemon writes to its parent once it serves
+	DAEMON_READY = "\x00ready\n"
+)
+
+// The pipe to the parent, in the daemon until it serves
+var daemonParent *os.File
+
+// The locked pid file
+var pidfile = struct {
+	sync.Mutex
+	path string
+	fd   *os.File
+}{}
+
+// Run goproxy in the background. The parent returns only if it can't
+// start the daemon; in the daemon, it returns at once.
+func daemonize() error {
+	if len(os.Getenv(DAEMON_ENV)) > 0 {
+		// an upgrade started from here daemonizes on its own
+		os.Unsetenv(DAEMON_ENV)
+		daemonParent = os.NewFile(3, "daemon-parent")
+		os.Stderr = daemonParent
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("daemon: %s", err)
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("daemon: %s", err)
+	}
+
+	// stdin, stdout and stderr are /dev/null
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), DAEMON_ENV+"=1")
+	cmd.ExtraFiles = []*os.File{wr}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("daemon: can't start %s: %s", exe, err)
+	}
+	wr.Close()
+
+	b, _ := io.ReadAll(rd)
+	if bytes.HasSuffix(b, []byte(DAEMON_READY)) {
+		os.Stderr.Write(b[:len(b)-len(DAEMON_READY)])
+		os.Exit(0)
+	}
+
+	os.Stderr.Write(b)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("daemon didn't start: %s", err)
+	}
+	return errors.New("daemon didn't start")
+}
+
+// Tell the parent that the daemon serves; later warnings are dropped.
+func daemonReady() {
+	if daemonParent == nil {
+		return
+	}
+	if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stderr = null
+	}
+	io.WriteString(daemonParent, DAEMON_READY)
+	daemonParent.Close()
+	daemonParent = nil
+}
+
+// Create and lock the pid file 'path' and write our pid to it; it stays
+// locked until we exit. With 'wait', wait for the goproxy that has it to
+// exit; else fail if it is locked.
+func lockPidfile(path string, wait bool) error {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("pidfile: %s", err)
+	}
+	// readable by init scripts, whatever the umask
+	fd.Chmod(0644)
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(fd.Fd()), how); err != nil {
+		defer fd.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b, _ := io.ReadAll(fd)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+			return fmt.Errorf("pidfile: %s: goproxy already running (pid %d)", path, pid)
+		}
+		return fmt.Errorf("pidfile: %s: %s", path, err)
+	}
+
+	if err := fd.Truncate(0); err != nil {
+		fd.Close()
+		return fmt.Errorf("pidfile: %s: %s", path, err)
+	}
+	if _, err := fd.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		fd.Close()
+		return fmt.Errorf("pidfile: %s: %s", path, err)
+	}
+
+	pidfile.Lock()
+	pidfile.path, pidfile.fd = path, fd
+	pidfile.Unlock()
+	return nil
+}
+
+// Remove the pid file if we have it, and let go of it. A successor that
+// waits for it locks the same file, so it isn't removed after a handover.
+func unlockPidfile(remove bool) {
+	pidfile.Lock()
+	defer pidfile.Unlock()
+	if pidfile.fd == nil {
+		return
+	}
+	if remove {
+		os.Remove(pidfile.path)
+	}
+	pidfile.fd.Close()
+	pidfile.fd = nil
+}
+
+// Set the umask of the files we create to 'm'
+func setUmask(m int) error {
+	syscall.Umask(m)
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,119 @@
+// daemon_unix_test.go -- tests for the daemon mode
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPidfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goproxy.pid")
+	if err := lockPidfile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	me := fmt.Sprintf("(pid %d)", os.Getpid())
+	if err := lockPidfile(path, false); err == nil || !strings.Contains(err.Error(), me) {
+		t.Fatalf("second lock: %v", err)
+	}
+
+	// a successor gets the same file once we let go
+	got := make(chan error)
+	go func() { got <- lockPidfile(path, true) }()
+	select {
+	case err := <-got:
+		t.Fatalf("waiting lock didn't wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockPidfile(false)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("pid file: %q", b)
+	}
+
+	unlockPidfile(true)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file left: %v", err)
+	}
+}
+
+// The test process starts itself as the parent, which starts the daemon.
+func TestDaemon(t *testing.T) {
+	if m := os.Getenv("GOPROXY_DAEMON_TEST"); len(m) > 0 {
+		daemonTest(m)
+		return
+	}
+
+	dir := t.TempDir()
+	run := func(m string) (string, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDaemon$")
+		cmd.Env = append(os.Environ(), "GOPROXY_DAEMON_TEST="+m+":"+dir)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := run("ok")
+	if err != nil || !strings.Contains(out, "warned before ready") || strings.Contains(out, "after ready") {
+		t.Fatalf("daemon: %v %q", err, out)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "pid"))
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid <= 0 {
+		t.Fatalf("pid file: %q", b)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	if pg, err := syscall.Getpgid(pid); err != nil || pg != pid {
+		t.Errorf("daemon %d not in its own session: %d %v", pid, pg, err)
+	}
+
+	out, err = run("fail")
+	if err == nil || !strings.Contains(out, "boom") {
+		t.Errorf("failed daemon: %v %q", err, out)
+	}
+}
+
+func daemonTest(m string) {
+	v := strings.SplitN(m, ":", 2)
+	inDaemon := len(os.Getenv(DAEMON_ENV)) > 0
+	if err := daemonize(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(3)
+	}
+	if !inDaemon {
+		os.Exit(4)
+	}
+
+	switch v[0] {
+	case "ok":
+		if err := lockPidfile(filepath.Join(v[1], "pid"), false); err != nil {
+			warn("%s", err)
+			os.Exit(1)
+		}
+		warn("warned before ready")
+		daemonReady()
+		warn("after ready")
+		time.Sleep(5 * time.Second)
+	case "fail":
+		warn("boom")
+	}
+	os.Exit(1)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,35 @@
+// daemon_windows.go -- no daemon mode on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build windows
+
+package main
+
+import (
+	"errors"
+)
+
+var errNoDaemon = errors.New("daemon: not supported on this platform")
+
+func daemonize() error {
+	return errNoDaemon
+}
+
+func daemonReady() {}
+
+func lockPidfile(path string, wait bool) error {
+	return errNoDaemon
+}
+
+func unlockPidfile(remove bool) {}
+
+func setUmask(m int) error {
+	return errors.New("daemon: no umask on this platform")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,893 @@
+// dialer.go -- outbound connections on behalf of clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Timeouts for outbound connections
+const (
+	DIAL_TIMEOUT   = 5 * time.Second
+	DIAL_KEEPALIVE = 10 * time.Second
+)
+
+// Context keys
+type ctxKey int
+
+const (
+	ctxClient ctxKey = iota
+	ctxFilter
+	ctxRetry
+	ctxUser
+	ctxConnAuth
+	ctxSpan
+	ctxSession
+	ctxConnTLS
+	ctxTenant
+	ctxRoute
+)
+
+// Return a context that carries the client address
+func withClient(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, ctxClient, ip)
+}
+
+// Return the client address in ctx (or nil)
+func clientOf(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(ctxClient).(net.IP)
+	return ip
+}
+
+// Dialer for a listener: applies the bind address and the outbound
+// policy to every connection.
+type dialer struct {
+	listen string
+	bind   net.IP
+	pol    *policy
+	mptcp  bool
+
+	// congestion control; rules can override it
+	congestion string
+
+	// upstream pool limits
+	pool *poolPolicy
+
+	// if set, connections go through this proxy
+	parent *parent
+
+	// source addresses of users; nil if they all use bind
+	egress *egress
+
+	// faults of the rules; nil if none
+	chaos *chaosSet
+
+	// mirrors of the rules; nil if none
+	mirrors *mirrorSet
+
+	// name lookups per client or user
+	lookups *srcLimiter
+
+	// validating resolvers; nil for the system resolver
+	dnssec *dnssecResolver
+
+	// ECH configs of origins; nil if ECH is off
+	ech *echResolver
+
+	// WireGuard tunnels of the rules; nil if none
+	wg *wgSet
+
+	// jump hosts of the rules; nil if none
+	jumps *jumpSet
+
+	// hooks of the listener's script; nil if none
+	script *scriptHooks
+
+	// the listener's router; nil if none
+	router Router
+
+	// data connections announced on FTP tunnels; nil if they aren't
+	// watched
+	ftp *ftpPasses
+
+	log *L.Logger
+}
+
+func newDialer(lc *ListenConf, log *L.Logger) (*dialer, error) {
+	d := &dialer{
+		listen:     lc.Listen,
+		log:        log,
+		mptcp:      lc.MPTCP.Dial,
+		congestion: lc.Congestion,
+		pool:       newPoolPolicy(&lc.Pool),
+	}
+
+	if len(d.congestion) > 0 {
+		if err := checkCongestion(d.congestion); err != nil {
+			return nil, err
+		}
+	}
+
+	hello, err := helloProfile(lc.Pool.Hello)
+	if err != nil {
+		return nil, err
+	}
+	d.pool.hello = hello
+
+	if d.ftp, err = newFTPPasses(&lc.Tunnel); err != nil {
+		return nil, err
+	}
+
+	if len(lc.Bind) > 0 {
+		a, err := net.ResolveTCPAddr("tcp", lc.Bind)
+		if err != nil {
+			// A bare IP address is also fine
+			a, err = net.ResolveTCPAddr("tcp", net.JoinHostPort(lc.Bind, "0"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		d.bind = a.IP
+	}
+
+	pol, err := newPolicy(lc)
+	if err != nil {
+		return nil, err
+	}
+	pol.log = log
+	addCollector(pol)
+	d.pol = pol
+
+	if d.lookups, err = newLookupLimiter(&lc.Ratelimit); err != nil {
+		return nil, err
+	}
+	if d.dnssec, err = newDNSSEC(&lc.DNSSEC, d.bind); err != nil {
+		return nil, err
+	}
+	if d.ech, err = newECH(&lc.Pool.ECH, lc.Listen, d.bind); err != nil {
+		return nil, err
+	}
+	if d.script, err = newScriptHooks(&lc.Script, lc.Listen, log); err != nil {
+		return nil, err
+	}
+
+	for _, r := range pol.rules {
+		if r.chaos != nil {
+			if d.chaos == nil {
+				d.chaos = &chaosSet{listener: lc.Listen}
+			}
+			d.chaos.v = append(d.chaos.v, r.chaos)
+			log.Warn("rule %s: injecting faults (chaos) on its connections", r.name)
+		}
+		if r.mirror != nil {
+			if d.mirrors == nil {
+				d.mirrors = &mirrorSet{listener: lc.Listen}
+			}
+			d.mirrors.v = append(d.mirrors.v, r.mirror)
+			log.Info("rule %s: mirroring its connections to %s", r.name, r.mirror.addr)
+		}
+	}
+
+	if len(lc.ParentTransport.Type) > 0 && len(lc.Parent) == 0 {
+		return nil, fmt.Errorf("parenttransport: needs a parent")
+	}
+	if d.egress, err = newEgress(&lc.Egress, lc.Listen); err != nil {
+		return nil, err
+	}
+	if d.egress != nil && len(lc.Parent) > 0 {
+		d.egress.Close()
+		return nil, fmt.Errorf("egress: destinations see the parent proxy's address")
+	}
+
+	if d.wg, err = newWGSet(lc.WireGuard, lc.Listen); err != nil {
+		return nil, err
+	}
+	if d.jumps, err = newJumpSet(lc.Jump, lc.Listen, d.netDialer()); err != nil {
+		d.Close()
+		return nil, err
+	}
+	for _, r := range pol.rules {
+		if err := d.checkVia(r, len(lc.Parent) > 0); err != nil {
+			d.Close()
+			return nil, err
+		}
+		if len(r.wireguard) > 0 {
+			log.Info("rule %s: connections go through wireguard %s", r.name, r.wireguard)
+		}
+		if len(r.jump) > 0 {
+			log.Info("rule %s: connections go through jump host %s", r.name, r.jump)
+		}
+	}
+
+	if len(lc.Parent) > 0 {
+		// Connections to the parent aren't for any one destination;
+		// only the listener's congestion control applies.
+		nd := d.netDialer()
+		if len(d.congestion) > 0 {
+			nd.Control = func(network, address string, c syscall.RawConn) error {
+				c.Control(func(fd uintptr) {
+					d.congest(fd, address, d.congestion)
+				})
+				return nil
+			}
+		}
+
+		p, err := newParent(lc.Parent, lc.ParentFront, d.pool, nd)
+		if err != nil {
+			return nil, err
+		}
+		if p.trans, err = newStreamTransport(&lc.ParentTransport); err != nil {
+			return nil, err
+		}
+		d.parent = p
+		addCheck(p, "parent "+p.addr+" of "+lc.Listen, false, p.probe)
+	}
+
+	if d.router, err = newRouter(&lc.Router); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if a, ok := d.router.(attacher); ok {
+		a.attach(lc.Listen, log)
+	}
+
+	addPolicy(d.listen, pol)
+	return d, nil
+}
+
+// Base dialer for outbound connections
+func (d *dialer) netDialer() *net.Dialer {
+	nd := &net.Dialer{
+		Timeout:   DIAL_TIMEOUT,
+		KeepAlive: DIAL_KEEPALIVE,
+	}
+
+	if d.bind != nil {
+		nd.LocalAddr = &net.TCPAddr{IP: d.bind}
+	}
+	nd.SetMultipathTCP(d.mptcp)
+	return nd
+}
+
+// Connect to 'addr' on behalf of the client in 'ctx'
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	sp := startSpan(ctx, "dial", _SPAN_CLIENT)
+	c, err := d.dialContext(ctx, network, addr)
+	noteDial(err)
+	if sp != nil {
+		sp.set("server.address", addr)
+		if err == nil {
+			sp.set("network.peer.address", c.RemoteAddr().String())
+		}
+		sp.fail(err)
+		sp.finish()
+	}
+	return c, err
+}
+
+func (d *dialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(ps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if err := d.checkScan(ctx, host, port); err != nil {
+		return nil, err
+	}
+
+	rt, err := d.route(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := ctx.Value(ctxRoute).(*Route); ok {
+		*p = rt
+	}
+	if len(rt.Name) > 0 {
+		return d.dialRouted(ctx, rt, host, port)
+	}
+	direct := rt.Via == "direct"
+
+	if d.parent != nil && !direct {
+		if err := d.checkDest(ctx, host, port); err != nil {
+			return nil, err
+		}
+		t0 := time.Now()
+		c, err := d.parent.connect(ctx, addr)
+		if err == nil {
+			observe("goproxy_dial_seconds", routeLabels(ctx, d.listen), time.Since(t0))
+		}
+		return c, err
+	}
+
+	t0 := time.Now()
+	if err := d.lookup(ctx, host, addr); err != nil {
+		return nil, err
+	}
+	if (d.wg != nil || d.jumps != nil) && !direct {
+		if c, ok, err := d.dialVia(ctx, host, port); ok {
+			if err == nil {
+				observe("goproxy_dial_seconds", routeLabels(ctx, d.listen), time.Since(t0))
+			}
+			return c, err
+		}
+	}
+
+	nd := d.netDialer()
+
+	// Policy is checked for each resolved address; addresses may be
+	// dialed in parallel. The first address dialed ends the lookup and
+	// starts the dial.
+	var fault atomic.Pointer[chaos]
+	var shadow atomic.Pointer[mirror]
+	var frag atomic.Pointer[fragment]
+	var allowed atomic.Pointer[rule]
+	var dialed atomic.Int64
+	nd.Control = func(network, address string, c syscall.RawConn) error {
+		dialed.CompareAndSwap(0, time.Now().UnixNano())
+		h, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+
+		r, err := d.eval(ctx, host, net.ParseIP(h), port)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			allowed.Store(r)
+		}
+		if r != nil && r.chaos != nil {
+			if err := r.chaos.dial(); err != nil {
+				return err
+			}
+			fault.Store(r.chaos)
+		}
+		if r != nil && r.mirror != nil {
+			shadow.Store(r.mirror)
+		}
+		if r != nil && r.fragment != nil {
+			frag.Store(r.fragment)
+		}
+
+		cc := d.congestion
+		if r != nil && len(r.congestion) > 0 {
+			cc = r.congestion
+		}
+
+		// Best effort; the connection works without these
+		c.Control(func(fd uintptr) {
+			if r != nil && r.fastopen {
+				if err := setFastOpenConnect(fd); err != nil {
+					d.log.Debug("%s: can't use TCP fast open: %s", address, err)
+				}
+			}
+			if len(cc) > 0 {
+				d.congest(fd, address, cc)
+			}
+		})
+		return nil
+	}
+
+	c, err := d.dial(ctx, nd, network, host, ps)
+	if err == nil {
+		setRoute(ctx, allowed.Load(), "direct")
+		t1, now := time.Unix(0, dialed.Load()), time.Now()
+		if dialed.Load() == 0 {
+			t1 = t0
+		}
+		if net.ParseIP(host) == nil {
+			observe("goproxy_dns_seconds", fmt.Sprintf("listen=%q", d.listen), t1.Sub(t0))
+		}
+		observe("goproxy_dial_seconds", routeLabels(ctx, d.listen), now.Sub(t1))
+	}
+	if f := frag.Load(); f != nil && err == nil {
+		c = f.wrap(c)
+	}
+	if f := fault.Load(); f != nil && err == nil {
+		c = f.wrap(c)
+	}
+	if m := shadow.Load(); m != nil && err == nil {
+		c = m.wrap(c)
+	}
+	return c, err
+}
+
+// Check that the tunnel or jump host of 'r' exists
+func (d *dialer) checkVia(r *rule, parent bool) error {
+	switch {
+	case len(r.wireguard) == 0 && len(r.jump) == 0:
+		return nil
+	case parent:
+		return fmt.Errorf("rule %s: wireguard or jump and a parent can't both be used", r.name)
+	case len(r.wireguard) > 0 && (d.wg == nil || d.wg.m[r.wireguard] == nil):
+		return fmt.Errorf("rule %s: no wireguard tunnel named %s", r.name, r.wireguard)
+	case len(r.jump) > 0 && (d.jumps == nil || d.jumps.m[r.jump] == nil):
+		return fmt.Errorf("rule %s: no jump host named %s", r.name, r.jump)
+	}
+	return nil
+}
+
+// Connect to 'host:port' through the WireGuard tunnel or jump host of
+// the rule that allows it; false if that rule has neither. A name is
+// sent unresolved to a jump host if the rule matches it, since names
+// behind a bastion often only resolve there; otherwise the rules are
+// checked for each address of 'host' in turn and the first allowed
+// address is dialed.
+func (d *dialer) dialVia(ctx context.Context, host string, port int) (net.Conn, bool, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if d.jumps != nil {
+			r, err := d.eval(ctx, host, nil, port)
+			if err != nil {
+				return nil, true, err
+			}
+			if r != nil && len(r.jump) > 0 {
+				c, err := d.via(ctx, r, host, port)
+				return c, true, err
+			}
+		}
+		addrs, err := d.lookupIP(ctx, host)
+		if err != nil {
+			return nil, true, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		r, err := d.eval(ctx, host, ip, port)
+		if err != nil {
+			return nil, true, err
+		}
+		if r == nil || (len(r.wireguard) == 0 && len(r.jump) == 0) {
+			return nil, false, nil
+		}
+		c, err := d.via(ctx, r, ip.String(), port)
+		return c, true, err
+	}
+	return nil, false, nil
+}
+
+// Return a context whose dial keeps the route the script or router
+// picked in 'rt'
+func keepRoute(ctx context.Context, rt *Route) context.Context {
+	return context.WithValue(ctx, ctxRoute, rt)
+}
+
+// Return the route of 'host:port': the script's if it picks one, else
+// the router's
+func (d *dialer) route(ctx context.Context, host string, port int) (Route, error) {
+	host, port, _ = d.ftp.as(ctx, host, port)
+	rt, err := d.script.route(ctx, host, port)
+	if err != nil || len(rt.Via) > 0 || d.router == nil {
+		return rt, err
+	}
+
+	rt, err = d.router.Route(ctx, host, port)
+	if err == nil {
+		err = rt.check()
+	}
+	if err != nil {
+		if isDenied(err) == nil {
+			d.log.Warn("router: %s:%d: %s", host, port, err)
+			err = &policyErr{rule: ROUTER_RULE, dest: net.JoinHostPort(host, strconv.Itoa(port))}
+		}
+		return Route{}, err
+	}
+	rt.rule = ROUTER_RULE
+	return rt, nil
+}
+
+// Connect to 'host:port' through the tunnel or jump host the script or
+// router picked; the rules still apply. Names are sent to a jump host
+// unresolved, as in dialVia.
+func (d *dialer) dialRouted(ctx context.Context, rt Route, host string, port int) (net.Conn, error) {
+	r := &rule{name: rt.rule}
+	if rt.Via == "wireguard" {
+		r.wireguard = rt.Name
+	} else {
+		r.jump = rt.Name
+	}
+	if err := d.checkVia(r, d.parent != nil); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && len(r.jump) > 0 {
+		if _, err := d.eval(ctx, host, nil, port); err != nil {
+			return nil, err
+		}
+		return d.via(ctx, r, host, port)
+	}
+	if ip == nil {
+		if err := d.lookup(ctx, host, net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+			return nil, err
+		}
+		addrs, err := d.lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%s: no addresses", host)
+		}
+		ip = addrs[0].IP
+	}
+	if _, err := d.eval(ctx, host, ip, port); err != nil {
+		return nil, err
+	}
+	return d.via(ctx, r, ip.String(), port)
+}
+
+// Connect to 'host:port' through the tunnel or jump host of 'r'
+func (d *dialer) via(ctx context.Context, r *rule, host string, port int) (net.Conn, error) {
+	if err := d.checkVia(r, false); err != nil {
+		return nil, err
+	}
+
+	var c net.Conn
+	var err error
+	if len(r.wireguard) > 0 {
+		w := d.wg.m[r.wireguard]
+		if c, err = w.dial(ctx, net.ParseIP(host), port); err != nil {
+			return nil, err
+		}
+		setRoute(ctx, r, "wireguard:"+w.name)
+	} else {
+		j := d.jumps.m[r.jump]
+		if c, err = j.dial(ctx, host, port); err != nil {
+			return nil, err
+		}
+		setRoute(ctx, r, "jump:"+j.name)
+	}
+	if r.fragment != nil {
+		c = r.fragment.wrap(c)
+	}
+	if r.mirror != nil {
+		c = r.mirror.wrap(c)
+	}
+	return c, nil
+}
+
+// Connect to 'host:port' with 'nd'
+func (d *dialer) dial(ctx context.Context, nd *net.Dialer, network, host, ps string) (net.Conn, error) {
+	if user := userOf(ctx); d.egress != nil && (len(user) > 0 || d.egress.anyone()) {
+		return d.dialFrom(ctx, nd, network, host, ps, user)
+	}
+
+	// A retry dials the addresses that haven't failed
+	if rs := retryOf(ctx); rs != nil && net.ParseIP(host) == nil {
+		if v := rs.untried(ctx, host, d.lookupIP); len(v) > 0 {
+			var c net.Conn
+			var err error
+			for _, ip := range v {
+				if c, err = nd.DialContext(ctx, network, net.JoinHostPort(ip.String(), ps)); err == nil {
+					return c, nil
+				}
+			}
+			return nil, err
+		}
+	}
+
+	// Names are looked up here when the system resolver can't be used,
+	// or to trace the lookup
+	if (d.dnssec != nil || spanOf(ctx) != nil) && net.ParseIP(host) == nil {
+		addrs, err := d.lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var c net.Conn
+		for _, a := range addrs {
+			if c, err = nd.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), ps)); err == nil {
+				return c, nil
+			}
+		}
+		return nil, err
+	}
+
+	return nd.DialContext(ctx, network, net.JoinHostPort(host, ps))
+}
+
+// Return the addresses of 'host' from the validating resolvers, if
+// any, or the system resolver
+func (d *dialer) lookupIP(ctx context.Context, host string) ([]net.IPAddr, error) {
+	sp := startSpan(ctx, "resolve", _SPAN_CLIENT)
+	defer sp.finish()
+	sp.set("dns.question.name", host)
+
+	var v []net.IPAddr
+	var err error
+	if d.dnssec != nil {
+		v, err = d.dnssec.LookupIPAddr(ctx, host)
+	} else {
+		v, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	sp.fail(err)
+	return v, err
+}
+
+// Connect to 'host:port' from the source addresses of 'user'; each
+// address of 'host' is dialed from the user's address of its family.
+func (d *dialer) dialFrom(ctx context.Context, nd *net.Dialer, network, host, port, user string) (net.Conn, error) {
+	var v []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		v = []net.IP{ip}
+	} else {
+		if rs := retryOf(ctx); rs != nil {
+			v = rs.untried(ctx, host, d.lookupIP)
+		}
+		if len(v) == 0 {
+			addrs, err := d.lookupIP(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				v = append(v, a.IP)
+			}
+		}
+	}
+
+	var err error
+	for _, ip := range v {
+		var src net.IP
+		if src, err = d.source(user, ip); err != nil {
+			continue
+		}
+
+		x := *nd
+		if src != nil {
+			x.LocalAddr = &net.TCPAddr{IP: src}
+		}
+		var c net.Conn
+		if c, err = x.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return c, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("%s: no addresses", host)
+	}
+	return nil, err
+}
+
+// Return the source address of a connection of 'user' to 'dst' (nil if
+// it isn't known yet); nil if any will do.
+func (d *dialer) source(user string, dst net.IP) (net.IP, error) {
+	if d.egress != nil && (len(user) > 0 || d.egress.anyone()) {
+		src, err := d.egress.addr(user, dst)
+		if err != nil || src != nil {
+			return src, err
+		}
+	}
+	return d.bind, nil
+}
+
+// Use congestion control 'cc' on the socket 'fd' connecting to 'addr'
+func (d *dialer) congest(fd uintptr, addr, cc string) {
+	if err := setCongestion(fd, cc); err != nil {
+		d.log.Debug("%s: can't use congestion control '%s': %s", addr, cc, err)
+	}
+}
+
+// Check 'addr' for a request the HTTP transport sends to the parent
+// proxy; without a parent, connections are checked when they are dialed.
+// Pooled connections are shared by all users: if the policy depends on
+// the user, a request is checked here as well. So are the script's
+// route hook and the router, which may deny it; the route they pick
+// applies to connections that are dialed.
+func (d *dialer) Preflight(ctx context.Context, addr string) error {
+	routed := d.script.has(hookRoute) || d.router != nil
+	if d.parent == nil && !d.pol.byUser() && !routed {
+		return nil
+	}
+
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(ps)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if err := d.checkScan(ctx, host, port); err != nil {
+		return err
+	}
+	if routed {
+		if _, err := d.route(ctx, host, port); err != nil {
+			return err
+		}
+		if d.parent == nil && !d.pol.byUser() {
+			return nil
+		}
+	}
+	return d.checkDest(ctx, host, port)
+}
+
+// Check 'addr' for a request sent on an existing connection to 'ip'
+// that was made for another host (see h2Pool).
+func (d *dialer) CheckReuse(ctx context.Context, addr string, ip net.IP) error {
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(ps)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if err := d.checkScan(ctx, host, port); err != nil {
+		return err
+	}
+	return d.pol.check(userOf(ctx), host, ip, port)
+}
+
+// Apply the destination limits of the authenticator of 'ca', if it has
+// any; and the auth hook of the script
+func (d *dialer) restrict(ca *clientAuth) {
+	if ca != nil {
+		d.pol.users, _ = ca.Authenticator.(DestChecker)
+		ca.script = d.script
+		if a, ok := ca.Authenticator.(attacher); ok {
+			a.attach(d.listen, d.log)
+		}
+	}
+}
+
+// Close idle upstream connections
+func (d *dialer) Close() {
+	delPolicy(d.listen, d.pol)
+	if d.parent != nil {
+		delCheck(d.parent)
+		d.parent.Close()
+	}
+	if d.egress != nil {
+		d.egress.Close()
+	}
+	if d.wg != nil {
+		d.wg.Close()
+	}
+	if d.jumps != nil {
+		d.jumps.Close()
+	}
+	if c, ok := d.router.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Evaluate the rules for the connection of the client in 'ctx' to
+// 'host:port' at 'ip'; an announced FTP data connection is evaluated as
+// its control connection
+func (d *dialer) eval(ctx context.Context, host string, ip net.IP, port int) (*rule, error) {
+	host, port, _ = d.ftp.as(ctx, host, port)
+	return d.pol.eval(userOf(ctx), host, ip, port)
+}
+
+// Check the client in 'ctx' against the scan guard for 'host:port'; the
+// announced data connections of its FTP tunnels aren't scans
+func (d *dialer) checkScan(ctx context.Context, host string, port int) error {
+	s, cl := d.pol.scan, clientOf(ctx)
+	if s == nil || cl == nil {
+		return nil
+	}
+	if _, _, ok := d.ftp.as(ctx, host, port); ok {
+		return nil
+	}
+	return s.check(cl, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Check the destination 'host:port' before it is handed to the parent
+// proxy. The policy is applied to every address 'host' resolves to here;
+// the parent may pick any of them. Names sent to a Tor parent are
+// resolved by Tor: the rules see only the name.
+func (d *dialer) checkDest(ctx context.Context, host string, port int) error {
+	if ip := net.ParseIP(host); ip != nil || (d.parent != nil && d.parent.tor) {
+		r, err := d.eval(ctx, host, ip, port)
+		if err == nil {
+			d.parentRoute(ctx, r)
+		}
+		return err
+	}
+	if err := d.lookup(ctx, host, net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	addrs, err := d.lookupIP(ctx, host)
+	if err != nil {
+		return err
+	}
+	if d.parent != nil {
+		observe("goproxy_dns_seconds", fmt.Sprintf("listen=%q", d.listen), time.Since(t0))
+	}
+
+	var r *rule
+	for _, a := range addrs {
+		if r, err = d.eval(ctx, host, a.IP, port); err != nil {
+			return err
+		}
+	}
+	d.parentRoute(ctx, r)
+	return nil
+}
+
+// Note the route of a session through the parent proxy; without one the
+// route is known when the destination is dialed
+func (d *dialer) parentRoute(ctx context.Context, r *rule) {
+	if d.parent != nil {
+		setRoute(ctx, r, d.parent.addr)
+	}
+}
+
+// Note the route of a request sent on the pooled connection 'c' to
+// 'addr', unless it was dialed for this request
+func (d *dialer) reused(ctx context.Context, addr string, c net.Conn) {
+	if rule, _ := routeOf(ctx); len(rule) > 0 {
+		return
+	}
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(ps)
+	ta, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	if r, err := d.pol.eval(userOf(ctx), host, ta.IP, port); err == nil {
+		setRoute(ctx, r, "direct")
+	}
+}
+
+// Count a lookup of 'host' against the client (or user) in 'ctx'; deny
+// 'addr' if the client has made too many. IP addresses aren't looked up.
+func (d *dialer) lookup(ctx context.Context, host, addr string) error {
+	if d.lookups.src == nil || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	key := userOf(ctx)
+	if len(key) > 0 {
+		key = "user:" + key
+	} else if cl := clientOf(ctx); cl != nil {
+		key = srcKey(cl)
+	} else {
+		return nil
+	}
+
+	if d.lookups.LimitKey(key) {
+		return &policyErr{rule: LOOKUP_RULE, dest: addr, retry: RATELIMIT_RETRY * time.Second}
+	}
+	return nil
+}
+
+// Check a UDP datagram from the client 'user' to dst (named as 'host'
+// by the client)
+func (d *dialer) CheckUDP(user, host string, dst *net.UDPAddr) error {
+	return d.pol.check(user, host, dst.IP, dst.Port)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,623 @@
+// dns.go -- caching, filtering DNS proxy (UDP, TCP and DNS-over-HTTPS)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/go-ratelimit"
+	"github.com/opencoff/golang-lru"
+)
+
+// Default number of cached responses
+const DNS_CACHE_SIZE = 4096
+
+// Bounds for cached responses (seconds)
+const (
+	DNS_MAX_TTL = 3600
+	DNS_NEG_TTL = 60
+)
+
+// Timeout for each upstream query
+const DNS_TIMEOUT = 3 * time.Second
+
+type dnsProxy struct {
+	cfg *DNSConf
+
+	udp *net.UDPConn
+	tcp *net.TCPListener
+	doh *http.Server
+	dln net.Listener
+
+	// egress address for upstream queries
+	bind net.IP
+
+	cache *lru.TwoQueueCache
+	block []string
+
+	grl *ratelimit.RateLimiter
+	prl *srcLimiter
+
+	// client subnets sent upstream
+	ecs *ecsPolicy
+
+	log *L.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+// A cached response
+type dnsCached struct {
+	m   *dnsMsg
+	t0  time.Time
+	ttl uint32
+}
+
+// Make a new DNS proxy
+func NewDNSProxy(cfg *DNSConf, log *L.Logger) (Proxy, error) {
+	if len(cfg.Upstream) == 0 {
+		return nil, errors.New("no upstream resolvers")
+	}
+
+	ups := make([]string, len(cfg.Upstream))
+	for i, s := range cfg.Upstream {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		ups[i] = s
+	}
+	cfg.Upstream = ups
+
+	ecs, err := newECS(&cfg.ECS, "forward", "forward", "strip", "synthesize")
+	if err != nil {
+		return nil, err
+	}
+
+	ua, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, err := inheritUDP("udp " + cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if uc == nil {
+		if uc, err = net.ListenUDP("udp", ua); err != nil {
+			return nil, err
+		}
+	}
+	shareSocket("udp "+cfg.Listen, uc)
+
+	ta := &net.TCPAddr{IP: ua.IP, Port: uc.LocalAddr().(*net.UDPAddr).Port, Zone: ua.Zone}
+	ln, err := listenTCP(&cfg.ListenConf, ta, log)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+
+	var bind net.IP
+	if len(cfg.Bind) > 0 {
+		if bind = net.ParseIP(cfg.Bind); bind == nil {
+			return nil, fmt.Errorf("invalid bind address %s", cfg.Bind)
+		}
+	}
+
+	n := cfg.Cache
+	if n <= 0 {
+		n = DNS_CACHE_SIZE
+	}
+	cache, err := lru.New2Q(n)
+	if err != nil {
+		return nil, err
+	}
+
+	grl, _ := ratelimit.New(cfg.Ratelimit.Global, 1)
+	prl, err := newSrcLimiter(&cfg.Ratelimit, "dns:"+cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dnsProxy{
+		cfg:    cfg,
+		udp:    uc,
+		tcp:    ln,
+		bind:   bind,
+		cache:  cache,
+		grl:    grl,
+		prl:    prl,
+		ecs:    ecs,
+		log:    log.New("dns-"+uc.LocalAddr().String(), 0),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for _, s := range cfg.Block {
+		s = strings.Trim(strings.ToLower(s), ".")
+		if len(s) > 0 {
+			d.block = append(d.block, s)
+		}
+	}
+
+	if len(cfg.DoH) > 0 {
+		if len(cfg.DoHCert) == 0 || len(cfg.DoHKey) == 0 {
+			uc.Close()
+			ln.Close()
+			return nil, fmt.Errorf("doh %s needs dohcert and dohkey", cfg.DoH)
+		}
+
+		cert, err := newCertFile(cfg.DoHCert, cfg.DoHKey, false, log)
+		if err != nil {
+			uc.Close()
+			ln.Close()
+			return nil, fmt.Errorf("doh %s: %s", cfg.DoH, err)
+		}
+
+		d.dln, err = listenShared("doh "+cfg.DoH, cfg.DoH)
+		if err != nil {
+			uc.Close()
+			ln.Close()
+			return nil, err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/dns-query", d.serveDoH)
+		d.doh = &http.Server{
+			Handler:        mux,
+			ReadTimeout:    5 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 16384,
+			TLSConfig: &tls.Config{
+				GetCertificate: cert.get,
+				MinVersion:     tls.VersionTLS12,
+			},
+		}
+	}
+
+	return d, nil
+}
+
+func (d *dnsProxy) Start() {
+	lns := []interface{}{d.udp, d.tcp}
+	if d.dln != nil {
+		lns = append(lns, d.dln)
+	}
+	addCheck(d, "dns "+d.udp.LocalAddr().String(), true, listening(lns...))
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.serveUDP()
+	}()
+
+	go func() {
+		defer d.wg.Done()
+		d.serveTCP()
+	}()
+
+	if d.doh != nil {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.log.Info("Starting DoH listener on %s ..", d.dln.Addr().String())
+			d.doh.ServeTLS(d.dln, "", "")
+		}()
+	}
+
+	d.log.Info("Starting DNS proxy ..")
+}
+
+func (d *dnsProxy) Stop() {
+	delCheck(d)
+	d.cancel()
+	d.udp.Close()
+	d.tcp.Close()
+
+	if d.doh != nil {
+		cx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		d.doh.Shutdown(cx)
+		cancel()
+	}
+
+	d.wg.Wait()
+	d.log.Info("DNS proxy shutdown")
+}
+
+// Return true if a query from 'ip' is allowed
+func (d *dnsProxy) allow(ip net.IP) bool {
+	if d.grl.Limit() {
+		d.log.Debug("%s: globally ratelimited", ip)
+		return false
+	}
+
+	if d.prl.Limit(ip) {
+		d.log.Debug("%s: per-IP ratelimited", ip)
+		return false
+	}
+
+	if !AclIP(&d.cfg.ListenConf, ip) {
+		d.log.Debug("%s: ACL failure", ip)
+		return false
+	}
+	return true
+}
+
+func (d *dnsProxy) serveUDP() {
+	b := make([]byte, 65536)
+	for {
+		n, src, err := d.udp.ReadFromUDP(b)
+		if err != nil {
+			select {
+			case <-d.ctx.Done():
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			d.log.Error("UDP read failed: %s", err)
+			return
+		}
+
+		if !d.allow(src.IP) {
+			continue
+		}
+
+		q := make([]byte, n)
+		copy(q, b[:n])
+
+		d.wg.Add(1)
+		go func(q []byte, src *net.UDPAddr) {
+			defer d.wg.Done()
+
+			m, r := d.query(q, src.IP)
+			if r == nil {
+				return
+			}
+
+			if m != nil && len(r) > m.udpSize {
+				r = dnsTruncate(m, r)
+			}
+			d.udp.WriteToUDP(r, src)
+		}(q, src)
+	}
+}
+
+func (d *dnsProxy) serveTCP() {
+	for {
+		conn, err := d.tcp.Accept()
+		if err != nil {
+			select {
+			case <-d.ctx.Done():
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			d.log.Error("Failed to accept new connection: %s", err)
+			return
+		}
+
+		ra := conn.RemoteAddr().(*net.TCPAddr)
+		if !d.allow(ra.IP) {
+			conn.Close()
+			continue
+		}
+
+		d.wg.Add(1)
+		go func(conn net.Conn, ip net.IP) {
+			defer d.wg.Done()
+			defer conn.Close()
+
+			// A client can send several queries on one connection
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				q, err := readTCPMsg(conn)
+				if err != nil {
+					return
+				}
+
+				_, r := d.query(q, ip)
+				if r == nil {
+					return
+				}
+				if err = writeTCPMsg(conn, r); err != nil {
+					return
+				}
+			}
+		}(conn, ra.IP)
+	}
+}
+
+// Handle RFC 8484 queries: GET with ?dns=<base64url> or POST of
+// application/dns-message
+func (d *dnsProxy) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var q []byte
+	var err error
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || !d.allow(ip) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		q, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		q, err = ioutil.ReadAll(io.LimitReader(r.Body, 65535))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil || len(q) == 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	m, resp := d.query(q, ip)
+	if resp == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if m != nil {
+		if rm, err := parseDNS(resp); err == nil {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", d.ttl(rm)))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+// Answer the query 'q' from 'ip'. Return the parsed query (nil if it
+// can't be parsed) and the response to send (nil to drop the query).
+func (d *dnsProxy) query(q []byte, ip net.IP) (*dnsMsg, []byte) {
+	m, err := parseDNS(q)
+	if err != nil {
+		d.log.Debug("%s: bad query: %s", ip, err)
+		if len(q) < dnsHeaderLen {
+			return nil, nil
+		}
+
+		// Echo the header with FORMERR
+		b := make([]byte, dnsHeaderLen)
+		copy(b, q)
+		binary.BigEndian.PutUint16(b[2:], dnsFlagQR|rcodeFormErr)
+		binary.BigEndian.PutUint16(b[4:], 0)
+		binary.BigEndian.PutUint16(b[6:], 0)
+		binary.BigEndian.PutUint16(b[8:], 0)
+		binary.BigEndian.PutUint16(b[10:], 0)
+		return nil, b
+	}
+
+	if m.flags&dnsFlagQR != 0 {
+		return nil, nil
+	}
+
+	if d.blocked(m.qname) {
+		d.log.Debug("%s: %s blocked", ip, m.qname)
+		return m, dnsReply(m, rcodeNXDomain)
+	}
+
+	// Answers may depend on the client subnet sent upstream
+	ecs := d.ecs.option(m.ecs, ip, m.opt >= 0)
+	key := fmt.Sprintf("%s/%d/%d", m.qname, m.qtype, m.qclass)
+	if len(ecs) > 4 {
+		key += fmt.Sprintf("/%x", ecs)
+	}
+	if r := d.cached(key, m.id); r != nil {
+		return m, r
+	}
+
+	fq := m
+	if d.ecs.mode != ECS_FORWARD {
+		if fq, err = parseDNS(dnsEditOPT(m, ecs, false)); err != nil {
+			return m, dnsReply(m, rcodeServFail)
+		}
+	}
+
+	r, err := d.forward(fq)
+	if err != nil {
+		d.log.Debug("%s: %s %d: %s", ip, m.qname, m.qtype, err)
+		return m, dnsReply(m, rcodeServFail)
+	}
+
+	// The client gets no subnet it didn't send, nor EDNS if it had none
+	if d.ecs.mode != ECS_FORWARD && (r.ecs != nil || m.opt < 0) {
+		if r, err = parseDNS(dnsEditOPT(r, nil, m.opt < 0)); err != nil {
+			return m, dnsReply(m, rcodeServFail)
+		}
+	}
+
+	rc := r.rcode()
+	if rc == rcodeOK || rc == rcodeNXDomain {
+		d.cache.Add(key, &dnsCached{m: r, t0: time.Now(), ttl: d.ttl(r)})
+	}
+
+	return m, r.raw
+}
+
+// Return true if 'name' or a parent domain is on the block list
+func (d *dnsProxy) blocked(name string) bool {
+	for _, s := range d.block {
+		if name == s || strings.HasSuffix(name, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the cache lifetime of a response
+func (d *dnsProxy) ttl(r *dnsMsg) uint32 {
+	if r.nrr == 0 {
+		return DNS_NEG_TTL
+	}
+	if r.minTTL > DNS_MAX_TTL {
+		return DNS_MAX_TTL
+	}
+	return r.minTTL
+}
+
+// Return a copy of a cached response with the TTLs aged and with
+// the given query id
+func (d *dnsProxy) cached(key string, id uint16) []byte {
+	v, ok := d.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	c := v.(*dnsCached)
+	age := uint32(time.Since(c.t0) / time.Second)
+	if age >= c.ttl {
+		d.cache.Remove(key)
+		return nil
+	}
+
+	b := make([]byte, len(c.m.raw))
+	copy(b, c.m.raw)
+	binary.BigEndian.PutUint16(b[0:], id)
+	for _, off := range c.m.ttls {
+		ttl := binary.BigEndian.Uint32(b[off:])
+		if ttl > age {
+			ttl -= age
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(b[off:], ttl)
+	}
+	return b
+}
+
+// Send the query to the upstream resolvers in turn; retry over TCP if
+// the UDP response is truncated.
+func (d *dnsProxy) forward(q *dnsMsg) (*dnsMsg, error) {
+	var err error
+	var r []byte
+
+	for _, up := range d.cfg.Upstream {
+		r, err = d.exchange("udp", up, q.raw)
+		if err == nil && len(r) > 2 && binary.BigEndian.Uint16(r[2:])&dnsFlagTC != 0 {
+			r, err = d.exchange("tcp", up, q.raw)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		var m *dnsMsg
+		if m, err = parseDNS(r); err != nil {
+			continue
+		}
+
+		// Make sure this is an answer to our question
+		if m.id != q.id || m.qname != q.qname || m.qtype != q.qtype {
+			err = fmt.Errorf("%s: mismatched response", up)
+			continue
+		}
+		return m, nil
+	}
+	return nil, err
+}
+
+// Do a single query/response with 'server'
+func (d *dnsProxy) exchange(network, server string, q []byte) ([]byte, error) {
+	return dnsExchange(d.ctx, d.bind, network, server, q)
+}
+
+// Do a single query/response with 'server' from address 'bind' (if set)
+func dnsExchange(ctx context.Context, bind net.IP, network, server string, q []byte) ([]byte, error) {
+	dl := &net.Dialer{Timeout: DNS_TIMEOUT}
+	if bind != nil {
+		if network == "udp" {
+			dl.LocalAddr = &net.UDPAddr{IP: bind}
+		} else {
+			dl.LocalAddr = &net.TCPAddr{IP: bind}
+		}
+	}
+
+	conn, err := dl.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if network == "tcp" {
+		if err = writeTCPMsg(conn, q); err != nil {
+			return nil, err
+		}
+		return readTCPMsg(conn)
+	}
+
+	if _, err = conn.Write(q); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 65536)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// The answer may be cached; don't pin the whole buffer
+	return append([]byte(nil), b[:n]...), nil
+}
+
+// Read a length prefixed DNS message
+func readTCPMsg(conn net.Conn) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write a length prefixed DNS message
+func writeTCPMsg(conn net.Conn, b []byte) error {
+	m := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(m, uint16(len(b)))
+	copy(m[2:], b)
+	_, err := conn.Write(m)
+	return err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,377 @@
+// dnsmsg.go -- minimal DNS wire format support
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RR types and classes we care about
+const (
+	dnsTypeA     = 1
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsTypeHTTPS = 65
+	dnsClassIN   = 1
+	dnsHeaderLen = 12
+
+	// EDNS(0) UDP payload size of our queries (DNS flag day 2020)
+	DNS_UDP_SIZE = 1232
+)
+
+// Response codes
+const (
+	rcodeOK       = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+// Header flags
+const (
+	dnsFlagQR = 1 << 15
+	dnsFlagTC = 1 << 9
+	dnsFlagRD = 1 << 8
+	dnsFlagRA = 1 << 7
+	dnsFlagAD = 1 << 5
+
+	// the DO bit in the TTL of the OPT RR
+	dnsFlagDO = 1 << 15
+
+	// EDNS options: client subnet (RFC 7871) and extended DNS errors
+	// (RFC 8914)
+	dnsOptECS = 8
+	dnsOptEDE = 15
+)
+
+// A parsed DNS message. We only decode what the proxy needs to make
+// decisions; the raw message is what is forwarded or cached.
+type dnsMsg struct {
+	raw []byte
+
+	id     uint16
+	flags  uint16
+	qname  string // lower case; no trailing dot
+	qtype  uint16
+	qclass uint16
+
+	// offset of the first byte after the question
+	qend int
+
+	// offsets of the TTL fields of all RRs other than OPT
+	ttls []int
+
+	// smallest TTL seen in the answer and authority sections
+	minTTL uint32
+	nrr    int
+
+	// EDNS(0) UDP payload size; 512 if there is no OPT RR
+	udpSize int
+
+	// extended DNS error (RFC 8914); -1 if there is none
+	ede int
+
+	// the OPT RR: its offsets (-1 if there is none) and its client
+	// subnet option (RFC 7871; nil if there is none)
+	opt, optRD, optEnd int
+	ecs                []byte
+
+	// addresses in the answer section
+	addrs []net.IP
+
+	// RDATA of the HTTPS RRs in the answer section
+	https [][]byte
+}
+
+var errDNSShort = errors.New("short DNS message")
+
+// Decode the header, the (single) question and the RR framing of 'b'
+func parseDNS(b []byte) (*dnsMsg, error) {
+	if len(b) < dnsHeaderLen {
+		return nil, errDNSShort
+	}
+
+	m := &dnsMsg{
+		raw:     b,
+		id:      binary.BigEndian.Uint16(b[0:]),
+		flags:   binary.BigEndian.Uint16(b[2:]),
+		udpSize: 512,
+		ede:     -1,
+	}
+
+	qd := binary.BigEndian.Uint16(b[4:])
+	an := int(binary.BigEndian.Uint16(b[6:]))
+	ns := int(binary.BigEndian.Uint16(b[8:]))
+	ar := int(binary.BigEndian.Uint16(b[10:]))
+
+	if qd != 1 {
+		return nil, fmt.Errorf("DNS message has %d questions", qd)
+	}
+
+	name, off, err := dnsName(b, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < off+4 {
+		return nil, errDNSShort
+	}
+
+	m.qname = strings.ToLower(name)
+	m.qtype = binary.BigEndian.Uint16(b[off:])
+	m.qclass = binary.BigEndian.Uint16(b[off+2:])
+	m.qend = off + 4
+
+	off = m.qend
+	m.opt = -1
+	for i := 0; i < an+ns+ar; i++ {
+		start := off
+		if _, off, err = dnsName(b, off); err != nil {
+			return nil, err
+		}
+
+		if len(b) < off+10 {
+			return nil, errDNSShort
+		}
+
+		typ := binary.BigEndian.Uint16(b[off:])
+		class := binary.BigEndian.Uint16(b[off+2:])
+		ttl := binary.BigEndian.Uint32(b[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+
+		if len(b) < off+10+rdlen {
+			return nil, errDNSShort
+		}
+
+		rdata := b[off+10 : off+10+rdlen]
+		if typ == dnsTypeOPT {
+			if class > 512 {
+				m.udpSize = int(class)
+			}
+			if v := dnsOption(rdata, dnsOptEDE); len(v) >= 2 {
+				m.ede = int(binary.BigEndian.Uint16(v))
+			}
+			m.ecs = dnsOption(rdata, dnsOptECS)
+			m.opt, m.optRD, m.optEnd = start, off+10, off+10+rdlen
+		} else {
+			if i < an && class == dnsClassIN {
+				if typ == dnsTypeA && rdlen == 4 || typ == dnsTypeAAAA && rdlen == 16 {
+					m.addrs = append(m.addrs, net.IP(append([]byte(nil), rdata...)))
+				}
+				if typ == dnsTypeHTTPS {
+					m.https = append(m.https, rdata)
+				}
+			}
+			m.ttls = append(m.ttls, off+4)
+			if i < an+ns {
+				if m.nrr == 0 || ttl < m.minTTL {
+					m.minTTL = ttl
+				}
+				m.nrr++
+			}
+		}
+
+		off += 10 + rdlen
+	}
+
+	return m, nil
+}
+
+// Return the response code
+func (m *dnsMsg) rcode() int {
+	return int(m.flags & 0xf)
+}
+
+// Return the data of option 'code' in the options 'b' of an OPT RR; nil
+// if it isn't there
+func dnsOption(b []byte, code uint16) []byte {
+	for len(b) >= 4 {
+		c := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		if c == code {
+			return b[4 : 4+n : 4+n]
+		}
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// Return the raw message 'm' with the client subnet option 'ecs' in
+// place of the one it had; nil 'ecs' removes it. A message without an
+// OPT RR gets one. If 'drop', the OPT RR is removed instead.
+func dnsEditOPT(m *dnsMsg, ecs []byte, drop bool) []byte {
+	b := m.raw
+	ar := binary.BigEndian.Uint16(b[10:])
+	if m.opt < 0 {
+		if drop || ecs == nil {
+			return b
+		}
+		v := make([]byte, len(b), len(b)+15+len(ecs))
+		copy(v, b)
+		binary.BigEndian.PutUint16(v[10:], ar+1)
+		v = append(v, 0)
+		v = binary.BigEndian.AppendUint16(v, dnsTypeOPT)
+		v = binary.BigEndian.AppendUint16(v, 512)
+		v = binary.BigEndian.AppendUint32(v, 0)
+		v = binary.BigEndian.AppendUint16(v, uint16(4+len(ecs)))
+		v = binary.BigEndian.AppendUint16(v, dnsOptECS)
+		v = binary.BigEndian.AppendUint16(v, uint16(len(ecs)))
+		return append(v, ecs...)
+	}
+
+	v := append([]byte(nil), b[:m.opt]...)
+	if drop {
+		binary.BigEndian.PutUint16(v[10:], ar-1)
+		return append(v, b[m.optEnd:]...)
+	}
+
+	// the header of the RR, the other options and the new one
+	v = append(v, b[m.opt:m.optRD]...)
+	for o := b[m.optRD:m.optEnd]; len(o) >= 4; {
+		n := 4 + int(binary.BigEndian.Uint16(o[2:]))
+		if n > len(o) {
+			break
+		}
+		if binary.BigEndian.Uint16(o) != dnsOptECS {
+			v = append(v, o[:n]...)
+		}
+		o = o[n:]
+	}
+	if ecs != nil {
+		v = binary.BigEndian.AppendUint16(v, dnsOptECS)
+		v = binary.BigEndian.AppendUint16(v, uint16(len(ecs)))
+		v = append(v, ecs...)
+	}
+	binary.BigEndian.PutUint16(v[m.optRD-2:], uint16(len(v)-m.optRD))
+	return append(v, b[m.optEnd:]...)
+}
+
+// Make a recursive query for 'name' of type 'qtype' with EDNS(0); 'do'
+// asks for DNSSEC records, 'ad' for the authenticated data bit and
+// 'ecs' (if set) is the client subnet option.
+func dnsQuery(id uint16, name string, qtype uint16, do, ad bool, ecs []byte) ([]byte, error) {
+	b := make([]byte, dnsHeaderLen, 64)
+	flags := uint16(dnsFlagRD)
+	if ad {
+		flags |= dnsFlagAD
+	}
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[10:], 1)
+
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, fmt.Errorf("bad DNS name %q", name)
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	if len(b) > dnsHeaderLen+254 {
+		return nil, fmt.Errorf("DNS name too long: %.64q", name)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+
+	// OPT: root name, type, UDP payload size, extended rcode and flags
+	var ttl uint32
+	if do {
+		ttl = dnsFlagDO
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, DNS_UDP_SIZE)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	if ecs == nil {
+		return binary.BigEndian.AppendUint16(b, 0), nil
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(ecs)))
+	b = binary.BigEndian.AppendUint16(b, dnsOptECS)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ecs)))
+	return append(b, ecs...), nil
+}
+
+// Decode the (possibly compressed) domain name at 'off'. Return the name
+// and the offset past it.
+func dnsName(b []byte, off int) (string, int, error) {
+	var labels []string
+
+	end := -1
+	for hops := 0; ; {
+		if off >= len(b) {
+			return "", 0, errDNSShort
+		}
+
+		n := int(b[off])
+		switch n & 0xc0 {
+		case 0x00:
+			if n == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return strings.Join(labels, "."), end, nil
+			}
+			if off+1+n > len(b) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+
+		case 0xc0:
+			if off+2 > len(b) {
+				return "", 0, errDNSShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if hops++; hops > 32 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+
+		default:
+			return "", 0, fmt.Errorf("bad DNS label type %#x", n)
+		}
+	}
+}
+
+// Make a response to 'q' with just the question and the given rcode
+func dnsReply(q *dnsMsg, rcode int) []byte {
+	b := make([]byte, q.qend)
+	copy(b, q.raw[:q.qend])
+
+	flags := dnsFlagQR | dnsFlagRA | (q.flags & dnsFlagRD) | uint16(rcode)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[6:], 0)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], 0)
+	return b
+}
+
+// Make a truncated response to 'q' from the full response 'r'; the
+// client is expected to retry over TCP.
+func dnsTruncate(q *dnsMsg, r []byte) []byte {
+	b := dnsReply(q, 0)
+	flags := binary.BigEndian.Uint16(r[2:]) | dnsFlagTC
+	binary.BigEndian.PutUint16(b[2:], flags)
+	return b
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,281 @@
+// dnsmsg_test.go -- tests for the DNS wire format parser
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/opencoff/golang-lru"
+)
+
+// Encode 'name' as uncompressed labels
+func wireName(name string) []byte {
+	var b []byte
+	if len(name) > 0 {
+		for _, l := range splitDots(name) {
+			b = append(b, byte(len(l)))
+			b = append(b, l...)
+		}
+	}
+	return append(b, 0)
+}
+
+func splitDots(s string) []string {
+	var v []string
+	i := 0
+	for j := 0; j < len(s); j++ {
+		if s[j] == '.' {
+			v = append(v, s[i:j])
+			i = j + 1
+		}
+	}
+	return append(v, s[i:])
+}
+
+func u16(v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return b[:]
+}
+
+func u32(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+// A DNS header with the given section counts
+func header(id, flags uint16, qd, an, ns, ar uint16) []byte {
+	var b []byte
+	for _, v := range []uint16{id, flags, qd, an, ns, ar} {
+		b = append(b, u16(v)...)
+	}
+	return b
+}
+
+// A resource record; 'name' is raw wire bytes (so it may be a pointer)
+func rr(name []byte, typ, class uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte(nil), name...)
+	b = append(b, u16(typ)...)
+	b = append(b, u16(class)...)
+	b = append(b, u32(ttl)...)
+	b = append(b, u16(uint16(len(rdata)))...)
+	return append(b, rdata...)
+}
+
+// Pointer to the question name (right after the header)
+var qptr = []byte{0xc0, dnsHeaderLen}
+
+func question(name string, typ uint16) []byte {
+	b := wireName(name)
+	b = append(b, u16(typ)...)
+	return append(b, u16(dnsClassIN)...)
+}
+
+func msg(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestDNSName(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		off  int
+		want string
+		end  int
+		ok   bool
+	}{
+		{"root", []byte{0}, 0, "", 1, true},
+		{"plain", wireName("www.example.com"), 0, "www.example.com", 17, true},
+		{"pointer", msg(wireName("example.com"), []byte{3, 'w', 'w', 'w', 0xc0, 0}), 13,
+			"www.example.com", 19, true},
+		{"pointer only", msg(wireName("a.b"), []byte{0xc0, 0}), 5, "a.b", 7, true},
+		{"pointer chain", msg(wireName("a.b"), []byte{1, 'x', 0xc0, 0}, []byte{1, 'y', 0xc0, 5}), 9,
+			"y.x.a.b", 13, true},
+		{"self loop", []byte{0xc0, 0}, 0, "", 0, false},
+		{"two pointer loop", []byte{0xc0, 2, 0xc0, 0}, 0, "", 0, false},
+		{"truncated label", []byte{5, 'a', 'b'}, 0, "", 0, false},
+		{"missing root", []byte{1, 'a'}, 0, "", 0, false},
+		{"truncated pointer", []byte{1, 'a', 0xc0}, 0, "", 0, false},
+		{"pointer past end", []byte{0xc0, 9}, 0, "", 0, false},
+		{"bad label type", []byte{0x40, 'a', 0}, 0, "", 0, false},
+		{"offset past end", []byte{0}, 3, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		name, end, err := dnsName(tt.b, tt.off)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (name != tt.want || end != tt.end) {
+			t.Errorf("%s: got %q, %d; want %q, %d", tt.name, name, end, tt.want, tt.end)
+		}
+	}
+}
+
+func TestParseDNS(t *testing.T) {
+	q := question("WWW.Example.com", dnsTypeA)
+	a := rr(qptr, dnsTypeA, dnsClassIN, 300, []byte{1, 2, 3, 4})
+	a2 := rr(qptr, dnsTypeA, dnsClassIN, 60, []byte{1, 2, 3, 5})
+	soa := rr(wireName("example.com"), dnsTypeSOA, dnsClassIN, 900, make([]byte, 22))
+	opt := rr([]byte{0}, dnsTypeOPT, 4096, 0, nil)
+	smallOpt := rr([]byte{0}, dnsTypeOPT, 256, 0, nil)
+
+	tests := []struct {
+		name    string
+		b       []byte
+		ok      bool
+		nrr     int
+		minTTL  uint32
+		ttls    int
+		udpSize int
+	}{
+		{"query", msg(header(1, dnsFlagRD, 1, 0, 0, 0), q), true, 0, 0, 0, 512},
+		{"query with OPT", msg(header(1, dnsFlagRD, 1, 0, 0, 1), q, opt), true, 0, 0, 0, 4096},
+		{"OPT below 512", msg(header(1, dnsFlagRD, 1, 0, 0, 1), q, smallOpt), true, 0, 0, 0, 512},
+		{"answers", msg(header(1, dnsFlagQR, 1, 2, 0, 0), q, a, a2), true, 2, 60, 2, 512},
+		{"authority", msg(header(1, dnsFlagQR|rcodeNXDomain, 1, 0, 1, 0), q, soa), true, 1, 900, 1, 512},
+		{"additional not in minTTL", msg(header(1, dnsFlagQR, 1, 1, 0, 1), q, a, a2), true, 1, 300, 2, 512},
+		{"OPT has no TTL", msg(header(1, dnsFlagQR, 1, 1, 0, 1), q, a, opt), true, 1, 300, 1, 4096},
+
+		{"short header", []byte{0, 1, 0}, false, 0, 0, 0, 0},
+		{"no question", header(1, 0, 0, 0, 0, 0), false, 0, 0, 0, 0},
+		{"two questions", msg(header(1, 0, 2, 0, 0, 0), q, q), false, 0, 0, 0, 0},
+		{"truncated question", msg(header(1, 0, 1, 0, 0, 0), q[:len(q)-2]), false, 0, 0, 0, 0},
+		{"missing RR", msg(header(1, dnsFlagQR, 1, 2, 0, 0), q, a), false, 0, 0, 0, 0},
+		{"truncated RR header", msg(header(1, dnsFlagQR, 1, 1, 0, 0), q, a[:6]), false, 0, 0, 0, 0},
+		{"truncated rdata", msg(header(1, dnsFlagQR, 1, 1, 0, 0), q, a[:len(a)-1]), false, 0, 0, 0, 0},
+		{"RR name loop", msg(header(1, dnsFlagQR, 1, 1, 0, 0), q,
+			rr([]byte{0xc0, dnsHeaderLen + byte(len(q))}, dnsTypeA, dnsClassIN, 1, nil)), false, 0, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		m, err := parseDNS(tt.b)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+
+		if m.qname != "www.example.com" || m.qtype != dnsTypeA || m.qclass != dnsClassIN {
+			t.Errorf("%s: question %q %d %d", tt.name, m.qname, m.qtype, m.qclass)
+		}
+		if m.qend != dnsHeaderLen+len(q) {
+			t.Errorf("%s: qend %d, want %d", tt.name, m.qend, dnsHeaderLen+len(q))
+		}
+		if m.nrr != tt.nrr || m.minTTL != tt.minTTL {
+			t.Errorf("%s: nrr %d minTTL %d; want %d %d", tt.name, m.nrr, m.minTTL, tt.nrr, tt.minTTL)
+		}
+		if len(m.ttls) != tt.ttls {
+			t.Errorf("%s: %d TTL offsets, want %d", tt.name, len(m.ttls), tt.ttls)
+		}
+		if m.udpSize != tt.udpSize {
+			t.Errorf("%s: udpSize %d, want %d", tt.name, m.udpSize, tt.udpSize)
+		}
+	}
+}
+
+func TestDNSCachedTTL(t *testing.T) {
+	q := question("example.com", dnsTypeA)
+	b := msg(header(7, dnsFlagQR, 1, 2, 0, 2), q,
+		rr(qptr, dnsTypeA, dnsClassIN, 300, []byte{1, 2, 3, 4}),
+		rr(qptr, dnsTypeA, dnsClassIN, 30, []byte{1, 2, 3, 5}),
+		rr([]byte{0}, dnsTypeOPT, 4096, 0x8000, nil),
+		rr(qptr, dnsTypeAAAA, dnsClassIN, 10, make([]byte, 16)))
+
+	m, err := parseDNS(b)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	cache, _ := lru.New2Q(16)
+	d := &dnsProxy{cache: cache}
+
+	tests := []struct {
+		age  time.Duration
+		ttl  uint32
+		want []uint32 // TTLs of the RRs other than OPT; nil if expired
+	}{
+		{0, 30, []uint32{300, 30, 10}},
+		{20 * time.Second, 30, []uint32{280, 10, 0}},
+		{29 * time.Second, 30, []uint32{271, 1, 0}},
+		{30 * time.Second, 30, nil},
+	}
+
+	for _, tt := range tests {
+		d.cache.Add("k", &dnsCached{m: m, t0: time.Now().Add(-tt.age), ttl: tt.ttl})
+
+		r := d.cached("k", 99)
+		if tt.want == nil {
+			if r != nil {
+				t.Errorf("age %s: expired response returned", tt.age)
+			}
+			if _, ok := d.cache.Get("k"); ok {
+				t.Errorf("age %s: expired response still cached", tt.age)
+			}
+			continue
+		}
+
+		if r == nil {
+			t.Fatalf("age %s: no response", tt.age)
+		}
+		if id := binary.BigEndian.Uint16(r); id != 99 {
+			t.Errorf("age %s: id %d, want 99", tt.age, id)
+		}
+		for i, off := range m.ttls {
+			if v := binary.BigEndian.Uint32(r[off:]); v != tt.want[i] {
+				t.Errorf("age %s: RR %d TTL %d, want %d", tt.age, i, v, tt.want[i])
+			}
+		}
+
+		// OPT's TTL field holds flags; it must not be aged
+		rm, err := parseDNS(r)
+		if err != nil {
+			t.Fatalf("age %s: reparse: %s", tt.age, err)
+		}
+		if rm.udpSize != 4096 {
+			t.Errorf("age %s: OPT mangled", tt.age)
+		}
+
+		// the cached message itself is untouched
+		if v := binary.BigEndian.Uint32(m.raw[m.ttls[0]:]); v != 300 {
+			t.Errorf("age %s: cached message modified", tt.age)
+		}
+	}
+}
+
+func TestDNSReply(t *testing.T) {
+	q, err := parseDNS(msg(header(42, dnsFlagRD, 1, 0, 0, 0), question("a.example", dnsTypeAAAA)))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	r, err := parseDNS(dnsReply(q, rcodeNXDomain))
+	if err != nil {
+		t.Fatalf("parse reply: %s", err)
+	}
+
+	if r.id != 42 || r.rcode() != rcodeNXDomain || r.qname != "a.example" || r.qtype != dnsTypeAAAA {
+		t.Errorf("reply: id %d rcode %d %q %d", r.id, r.rcode(), r.qname, r.qtype)
+	}
+	if r.flags&dnsFlagQR == 0 || r.flags&dnsFlagRD == 0 {
+		t.Errorf("reply flags %#x", r.flags)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
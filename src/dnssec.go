@@ -0,0 +1,197 @@
+// dnssec.go -- name lookups through trusted DNSSEC validating resolvers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// Names of the extended DNS errors (RFC 8914) of failed validations
+var dnssecEDE = map[int]string{
+	1:  "unsupported DNSKEY algorithm",
+	2:  "unsupported DS digest type",
+	5:  "DNSSEC indeterminate",
+	6:  "DNSSEC bogus",
+	7:  "signature expired",
+	8:  "signature not yet valid",
+	9:  "DNSKEY missing",
+	10: "RRSIGs missing",
+	11: "no zone key bit set",
+	12: "NSEC missing",
+}
+
+// Lookups through validating resolvers: the proxy doesn't check
+// signatures itself, it trusts the AD bit of resolvers it reaches over
+// a trusted path (e.g. on the same host).
+type dnssecResolver struct {
+	servers  []string
+	unsigned bool // accept answers without the AD bit
+	bind     net.IP
+	ecs      *ecsPolicy
+}
+
+// A name that failed DNSSEC validation
+type dnssecErr struct {
+	host   string
+	reason string
+}
+
+func (e *dnssecErr) Error() string {
+	return fmt.Sprintf("dnssec: %s: %s", e.host, e.reason)
+}
+
+func (e *dnssecErr) Unwrap() error {
+	return ErrDNS
+}
+
+// Return the dnssec error if 'err' is (or wraps) one
+func isDNSSEC(err error) *dnssecErr {
+	var e *dnssecErr
+	if errors.As(err, &e) {
+		return e
+	}
+	return nil
+}
+
+// Make a resolver for 'c'; nil if there are no validating resolvers
+func newDNSSEC(c *DNSSECConf, bind net.IP) (*dnssecResolver, error) {
+	if len(c.Resolvers) == 0 {
+		if c.Unsigned {
+			return nil, fmt.Errorf("dnssec: unsigned without resolvers")
+		}
+		return nil, nil
+	}
+
+	ecs, err := newECS(&c.ECS, "strip", "strip", "synthesize")
+	if err != nil {
+		return nil, fmt.Errorf("dnssec: %s", err)
+	}
+
+	r := &dnssecResolver{unsigned: c.Unsigned, bind: bind, ecs: ecs}
+	for _, s := range c.Resolvers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("dnssec: resolver %s: %s", s, err)
+		}
+		r.servers = append(r.servers, s)
+	}
+	return r, nil
+}
+
+// Return the validated addresses of 'host'
+func (r *dnssecResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	type answer struct {
+		v   []net.IP
+		err error
+	}
+
+	ch := make(chan answer, 2)
+	for _, qt := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qt uint16) {
+			v, err := r.lookup(ctx, host, qt)
+			ch <- answer{v, err}
+		}(qt)
+	}
+
+	var addrs []net.IPAddr
+	var err error
+	for i := 0; i < 2; i++ {
+		a := <-ch
+		switch {
+		case isDNSSEC(a.err) != nil:
+			// one bad answer spoils the name
+			return nil, a.err
+		case a.err != nil:
+			err = a.err
+		}
+		for _, ip := range a.v {
+			addrs = append(addrs, net.IPAddr{IP: ip})
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// Look up the records of type 'qt' of 'host'
+func (r *dnssecResolver) lookup(ctx context.Context, host string, qt uint16) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	m, srv, err := r.query(ctx, name, qt)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := m.flags&dnsFlagAD != 0
+	switch m.rcode() {
+	case rcodeOK:
+	case rcodeNXDomain:
+		if !ad && !r.unsigned {
+			return nil, &dnssecErr{host, "denial of existence not authenticated"}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: srv, IsNotFound: true}
+	case rcodeServFail:
+		if s, ok := dnssecEDE[m.ede]; ok {
+			return nil, &dnssecErr{host, s}
+		}
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, Server: srv}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("rcode %d", m.rcode()), Name: host, Server: srv}
+	}
+
+	if !ad && !r.unsigned {
+		return nil, &dnssecErr{host, fmt.Sprintf("answer from %s not authenticated", srv)}
+	}
+	return m.addrs, nil
+}
+
+// Ask the resolvers in turn; retry over TCP if the UDP answer is
+// truncated. Return the answer and the resolver that gave it.
+func (r *dnssecResolver) query(ctx context.Context, name string, qt uint16) (*dnsMsg, string, error) {
+	id := uint16(rand.Uint32())
+	q, err := dnsQuery(id, name, qt, true, true, r.ecs.option(nil, clientOf(ctx), true))
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, srv := range r.servers {
+		var b []byte
+		b, err = dnsExchange(ctx, r.bind, "udp", srv, q)
+		if err == nil && len(b) > 2 && binary.BigEndian.Uint16(b[2:])&dnsFlagTC != 0 {
+			b, err = dnsExchange(ctx, r.bind, "tcp", srv, q)
+		}
+		if err != nil {
+			continue
+		}
+
+		var m *dnsMsg
+		if m, err = parseDNS(b); err != nil {
+			continue
+		}
+		if m.id != id || m.flags&dnsFlagQR == 0 || m.qname != name || m.qtype != qt {
+			err = fmt.Errorf("%s: mismatched response", srv)
+			continue
+		}
+		return m, srv, nil
+	}
+	return nil, "", err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,142 @@
+// dnssec_test.go -- tests for lookups through validating resolvers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Start a validating resolver on a loopback port: good.test is signed,
+// plain.test isn't, bogus.test fails validation and gone.test doesn't
+// exist. All names resolve to 127.0.0.1.
+func startValidator(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, a, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q, err := parseDNS(b[:n])
+			if err != nil {
+				continue
+			}
+
+			r := dnsReply(q, rcodeOK)
+			flags := binary.BigEndian.Uint16(r[2:])
+			var ans, ede []byte
+			switch q.qname {
+			case "good.test":
+				flags |= dnsFlagAD
+			case "plain.test":
+			case "bogus.test":
+				flags |= rcodeServFail
+				ede = []byte{0, dnsOptEDE, 0, 2, 0, 6}
+			default:
+				flags |= rcodeNXDomain | dnsFlagAD
+			}
+			if flags&0xf == 0 && q.qtype == dnsTypeA {
+				ans = []byte{0xc0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1}
+			}
+			binary.BigEndian.PutUint16(r[2:], flags)
+			if len(ans) > 0 {
+				binary.BigEndian.PutUint16(r[6:], 1)
+			}
+			binary.BigEndian.PutUint16(r[10:], 1)
+			r = append(r, ans...)
+			r = append(r, 0, 0, dnsTypeOPT, 4, 0xd0, 0, 0, 0x80, 0, 0, byte(len(ede)))
+			r = append(r, ede...)
+			pc.WriteTo(r, a)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSSEC(t *testing.T) {
+	q, err := dnsQuery(7, "Good.Test.", dnsTypeAAAA, true, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseDNS(q)
+	if err != nil || m.id != 7 || m.qname != "good.test" || m.qtype != dnsTypeAAAA ||
+		m.flags&dnsFlagAD == 0 || m.udpSize != DNS_UDP_SIZE || m.ede != -1 {
+		t.Fatalf("query: %+v %v", m, err)
+	}
+	if _, err := dnsQuery(1, "a..b", dnsTypeA, false, false, nil); err == nil {
+		t.Errorf("empty label: no error")
+	}
+
+	if r, err := newDNSSEC(&DNSSECConf{}, nil); r != nil || err != nil {
+		t.Errorf("no resolvers: %v %v", r, err)
+	}
+	if _, err := newDNSSEC(&DNSSECConf{Unsigned: true}, nil); err == nil {
+		t.Errorf("unsigned without resolvers: no error")
+	}
+
+	srv := startValidator(t)
+	ctx := context.Background()
+	for _, unsigned := range []bool{false, true} {
+		r, err := newDNSSEC(&DNSSECConf{Resolvers: []string{srv}, Unsigned: unsigned}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			host   string
+			ok     bool
+			dnssec bool // a validation error
+		}{
+			{"good.test", true, false},
+			{"plain.test", unsigned, !unsigned},
+			{"bogus.test", false, true},
+			{"gone.test", false, false},
+		}
+		for _, tt := range tests {
+			v, err := r.LookupIPAddr(ctx, tt.host)
+			if tt.ok != (err == nil) || tt.dnssec != (isDNSSEC(err) != nil) {
+				t.Errorf("unsigned %v: %s: %v %v", unsigned, tt.host, v, err)
+			}
+			if tt.ok && (len(v) != 1 || !v[0].IP.Equal(net.IPv4(127, 0, 0, 1))) {
+				t.Errorf("%s: %v", tt.host, v)
+			}
+		}
+	}
+
+	// Tunnels through the proxy; failures get a 502
+	ln := startEcho(t)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := startHTTPProxy(t, &ListenConf{DNSSEC: DNSSECConf{Resolvers: []string{srv}}})
+	c, _ := connectTunnel(t, addr, "good.test:"+port, "", "")
+	c.Close()
+
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT bogus.test:%s HTTP/1.1\r\nHost: bogus.test\r\n\r\n", port)
+	var code int
+	fmt.Fscanf(c, "HTTP/1.1 %d", &code)
+	if code != http.StatusBadGateway {
+		t.Errorf("bogus.test: %d", code)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,258 @@
+// ech.go -- Encrypted Client Hello to origins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An origin that publishes ECH configs in its HTTPS record (RFC 9460)
+// gets the name it is asked for in the encrypted inner ClientHello; the
+// egress network sees the public name of the config. The HTTPS records
+// come from the resolvers of pool.ech - they should be trusted or on the
+// same host, or the lookup gives the name away. An origin that rejects
+// ECH and sends retry configs is dialed again with them; one that sends
+// none has turned ECH off and is dialed again without it.
+
+const (
+	// bounds of the time an ECH config (or its absence) is cached; in
+	// seconds
+	ECH_TTL_MIN = 60
+	ECH_TTL_MAX = 3600
+
+	// the SvcParamKey of ECH configs
+	dnsSvcECH = 5
+)
+
+// ECH configs of origins
+type echResolver struct {
+	listen  string
+	servers []string
+	bind    net.IP
+
+	sync.Mutex
+	m map[string]*echEntry
+
+	// handshakes by the outcome of ECH
+	accepted, rejected, none atomic.Uint64
+}
+
+type echEntry struct {
+	list []byte // nil if the origin has none
+	exp  time.Time
+}
+
+// Make the ECH resolver of 'ec' for the listener 'listen'; nil if it
+// has no resolvers
+func newECH(ec *ECHConf, listen string, bind net.IP) (*echResolver, error) {
+	if len(ec.Resolvers) == 0 {
+		return nil, nil
+	}
+	if !echSupported {
+		return nil, fmt.Errorf("ech: needs goproxy built with Go 1.23 or later")
+	}
+
+	r := &echResolver{listen: listen, bind: bind, m: make(map[string]*echEntry)}
+	for _, s := range ec.Resolvers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("ech: resolver %s: %s", s, err)
+		}
+		r.servers = append(r.servers, s)
+	}
+	return r, nil
+}
+
+// Return the HTTPS name of the origin 'host' on 'port'
+func httpsName(host, port string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if port == "443" || len(port) == 0 {
+		return host
+	}
+	return "_" + port + "._https." + host
+}
+
+// Return the ECH configs in the RDATA of an HTTPS RR; nil if there are
+// none or it is an alias
+func echConfigs(rd []byte) []byte {
+	if len(rd) < 3 || binary.BigEndian.Uint16(rd) == 0 {
+		return nil
+	}
+	_, off, err := dnsName(rd, 2)
+	if err != nil {
+		return nil
+	}
+	for b := rd[off:]; len(b) >= 4; {
+		key := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n > len(b)-4 {
+			return nil
+		}
+		if key == dnsSvcECH {
+			return append([]byte(nil), b[4:4+n]...)
+		}
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// Return the ECH configs of the origin 'addr'; nil if it has none
+func (r *echResolver) configs(ctx context.Context, addr string) []byte {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	name := httpsName(host, port)
+
+	now := time.Now()
+	r.Lock()
+	e, ok := r.m[name]
+	r.Unlock()
+	if ok && now.Before(e.exp) {
+		return e.list
+	}
+
+	list, ttl := r.query(ctx, name)
+	r.set(name, list, ttl, now)
+	return list
+}
+
+// Cache the ECH configs 'list' of 'name' for 'ttl' seconds
+func (r *echResolver) set(name string, list []byte, ttl uint32, now time.Time) {
+	ttl = min(max(ttl, ECH_TTL_MIN), ECH_TTL_MAX)
+
+	r.Lock()
+	defer r.Unlock()
+	for k, e := range r.m {
+		if now.After(e.exp) {
+			delete(r.m, k)
+		}
+	}
+	r.m[name] = &echEntry{list, now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// Ask the resolvers in turn for the HTTPS records of 'name'; return the
+// ECH configs of the first (by priority) that has them and the TTL
+func (r *echResolver) query(ctx context.Context, name string) ([]byte, uint32) {
+	id := uint16(rand.Uint32())
+	q, err := dnsQuery(id, name, dnsTypeHTTPS, false, false, nil)
+	if err != nil {
+		return nil, 0
+	}
+
+	for _, srv := range r.servers {
+		b, err := dnsExchange(ctx, r.bind, "udp", srv, q)
+		if err == nil && len(b) > 2 && binary.BigEndian.Uint16(b[2:])&dnsFlagTC != 0 {
+			b, err = dnsExchange(ctx, r.bind, "tcp", srv, q)
+		}
+		if err != nil {
+			continue
+		}
+		m, err := parseDNS(b)
+		if err != nil || m.id != id || m.flags&dnsFlagQR == 0 || m.qname != name {
+			continue
+		}
+
+		var list []byte
+		prio := -1
+		for _, rd := range m.https {
+			p := int(binary.BigEndian.Uint16(rd))
+			if v := echConfigs(rd); v != nil && (prio < 0 || p < prio) {
+				list, prio = v, p
+			}
+		}
+		return list, m.minTTL
+	}
+	return nil, 0
+}
+
+// Return the TLS dialer of 'tr' with ECH: the connections are made by
+// tr.DialContext, the TLS is that of tr.TLSClientConfig
+func (r *echResolver) dialTLS(tr *http.Transport) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		list := r.configs(ctx, addr)
+		c, err := r.handshake(ctx, tr, network, addr, list)
+		if retry, ok := echRetry(err); ok {
+			host, port, _ := net.SplitHostPort(addr)
+			r.set(httpsName(host, port), retry, ECH_TTL_MIN, time.Now())
+			c, err = r.handshake(ctx, tr, network, addr, retry)
+		}
+		return c, err
+	}
+}
+
+// Dial 'addr' and do the TLS handshake with the ECH configs 'list'
+func (r *echResolver) handshake(ctx context.Context, tr *http.Transport, network, addr string, list []byte) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := tr.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := tr.TLSClientConfig.Clone()
+	conf.ServerName = host
+	if len(list) > 0 {
+		setECH(conf, list)
+	}
+
+	// the transport only traces the handshakes it does itself
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tc := tls.Client(c, conf)
+	hctx, cancel := context.WithTimeout(ctx, tr.TLSHandshakeTimeout)
+	err = tc.HandshakeContext(hctx)
+	cancel()
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tc.ConnectionState(), err)
+	}
+
+	switch _, rej := echRetry(err); {
+	case len(list) == 0:
+		r.none.Add(1)
+	case rej:
+		r.rejected.Add(1)
+	case err == nil:
+		r.accepted.Add(1)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (r *echResolver) metrics() []metric {
+	const help = "TLS handshakes with origins by the outcome of ECH"
+	l := fmt.Sprintf("listener=%q,result=", r.listen)
+	return []metric{
+		{"goproxy_ech_handshakes_total", "counter", help, l + `"accepted"`, float64(r.accepted.Load())},
+		{"goproxy_ech_handshakes_total", "counter", help, l + `"rejected"`, float64(r.rejected.Load())},
+		{"goproxy_ech_handshakes_total", "counter", help, l + `"none"`, float64(r.none.Load())},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
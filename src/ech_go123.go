@@ -0,0 +1,36 @@
+// ech_go123.go -- ECH with crypto/tls of Go 1.23 and later
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build go1.23
+// +build go1.23
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+const echSupported = true
+
+// Offer the ECH configs 'list' in the handshakes of 'c'
+func setECH(c *tls.Config, list []byte) {
+	c.EncryptedClientHelloConfigList = list
+}
+
+// Return the retry configs of an origin that rejected ECH and true if
+// 'err' is such a rejection
+func echRetry(err error) ([]byte, bool) {
+	var re *tls.ECHRejectionError
+	if errors.As(err, &re) {
+		return re.RetryConfigList, true
+	}
+	return nil, false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
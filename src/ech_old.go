@@ -0,0 +1,27 @@
+// ech_old.go -- no ECH before Go 1.23
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !go1.23
+// +build !go1.23
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+const echSupported = false
+
+func setECH(c *tls.Config, list []byte) {
+}
+
+func echRetry(err error) ([]byte, bool) {
+	return nil, false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,170 @@
+// ech_test.go -- tests for ECH to origins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Return an ECHConfig (draft-ietf-tls-esni-22) for 'public' and its
+// X25519 private key
+func echKey(t *testing.T, public string) ([]byte, []byte) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u16 := binary.BigEndian.AppendUint16
+
+	var c []byte
+	c = append(c, 7)   // config_id
+	c = u16(c, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	c = u16(c, uint16(len(k.PublicKey().Bytes())))
+	c = append(c, k.PublicKey().Bytes()...)
+	c = u16(c, 4)
+	c = u16(u16(c, 0x0001), 0x0001) // HKDF-SHA256, AES-128-GCM
+	c = append(c, 0)                // maximum_name_length
+	c = append(append(c, byte(len(public))), public...)
+	c = u16(c, 0)
+
+	cfg := u16(u16(nil, 0xfe0d), uint16(len(c)))
+	return append(cfg, c...), k.Bytes()
+}
+
+// Start a resolver on a loopback port that answers every HTTPS query
+// with the ECH configs 'list'; count the queries in 'n'
+func startHTTPSResolver(t *testing.T, list []byte, n *atomic.Int32) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			m, a, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q, err := parseDNS(b[:m])
+			if err != nil || q.qtype != dnsTypeHTTPS {
+				continue
+			}
+			n.Add(1)
+
+			// priority 1, target ".", alpn=h2 and ech
+			rd := []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'}
+			rd = binary.BigEndian.AppendUint16(rd, dnsSvcECH)
+			rd = binary.BigEndian.AppendUint16(rd, uint16(len(list)))
+			rd = append(rd, list...)
+
+			r := dnsReply(q, rcodeOK)
+			binary.BigEndian.PutUint16(r[6:], 1)
+			r = append(r, 0xc0, 12, 0, dnsTypeHTTPS, 0, dnsClassIN, 0, 0, 1, 0x2c)
+			r = binary.BigEndian.AppendUint16(r, uint16(len(rd)))
+			r = append(r, rd...)
+			pc.WriteTo(r, a)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestECHConfigs(t *testing.T) {
+	if s := httpsName("Example.COM.", "443"); s != "example.com" {
+		t.Errorf("443: %s", s)
+	}
+	if s := httpsName("example.com", "8443"); s != "_8443._https.example.com" {
+		t.Errorf("8443: %s", s)
+	}
+
+	ech := []byte{0, 4, 1, 2, 3, 4}
+	rd := append([]byte{0, 1, 3, 'c', 'd', 'n', 0, 0, 1, 0, 3, 2, 'h', '3', 0, 5, 0, 6}, ech...)
+	if v := echConfigs(rd); string(v) != string(ech) {
+		t.Errorf("ech: %x", v)
+	}
+	for _, rd := range [][]byte{
+		{0, 0, 3, 'c', 'd', 'n', 0},        // alias
+		{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'}, // no ech
+		{0, 1, 0, 0, 5, 0, 9, 1, 2},        // short
+	} {
+		if v := echConfigs(rd); v != nil {
+			t.Errorf("%x: %x", rd, v)
+		}
+	}
+	if _, err := newECH(&ECHConf{Resolvers: []string{"[::1"}}, "test", nil); err == nil {
+		t.Errorf("bad resolver: no error")
+	}
+}
+
+func TestECH(t *testing.T) {
+	cfg, key := echKey(t, "public.example")
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(cfg)))
+	list = append(list, cfg...)
+
+	// The origin's certificate covers example.com, the inner name
+	var inner atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner.Store(r.TLS.ServerName)
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{{Config: cfg, PrivateKey: key}}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var queries atomic.Int32
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{Listen: "test", Pool: PoolConf{ECH: ECHConf{Resolvers: []string{startHTTPSResolver(t, list, &queries)}}}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// example.com is the origin
+	tr := newTransport(d)
+	tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, srv.Listener.Addr().String())
+	}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com:8443/", nil)
+	for i := 0; i < 2; i++ {
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if !resp.TLS.ECHAccepted || inner.Load() != "example.com" {
+			t.Errorf("ech: accepted %v, inner name %v", resp.TLS.ECHAccepted, inner.Load())
+		}
+		tr.CloseIdleConnections()
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d HTTPS queries", n)
+	}
+	if d.ech.accepted.Load() != 2 {
+		t.Errorf("metrics: %+v", d.ech.metrics())
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,106 @@
+// ecs.go -- EDNS Client Subnet (RFC 7871) on queries to resolvers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// What is sent upstream in place of a client's subnet
+const (
+	ECS_FORWARD    = iota // the client's option, if any
+	ECS_STRIP             // none; queries with EDNS ask for none (a /0)
+	ECS_SYNTHESIZE        // the client's address, truncated
+)
+
+// Default prefix lengths of synthesized subnets (RFC 7871 section 11.1)
+const (
+	ECS_PREFIX4 = 24
+	ECS_PREFIX6 = 56
+)
+
+var ecsModes = map[string]int{
+	"forward":    ECS_FORWARD,
+	"strip":      ECS_STRIP,
+	"synthesize": ECS_SYNTHESIZE,
+}
+
+// The client subnets of a resolver's queries
+type ecsPolicy struct {
+	mode         int
+	bits4, bits6 int
+}
+
+// Make the policy for 'c'; 'def' is the mode if it's empty and
+// 'modes' are the ones allowed.
+func newECS(c *ECSConf, def string, modes ...string) (*ecsPolicy, error) {
+	s := strings.ToLower(c.Mode)
+	if len(s) == 0 {
+		s = def
+	}
+
+	ok := false
+	for _, m := range modes {
+		ok = ok || m == s
+	}
+	if !ok {
+		return nil, fmt.Errorf("ecs: unknown mode '%s' (want one of %s)", c.Mode, strings.Join(modes, ", "))
+	}
+
+	e := &ecsPolicy{mode: ecsModes[s], bits4: c.Prefix4, bits6: c.Prefix6}
+	if e.bits4 == 0 {
+		e.bits4 = ECS_PREFIX4
+	}
+	if e.bits6 == 0 {
+		e.bits6 = ECS_PREFIX6
+	}
+	if e.bits4 < 0 || e.bits4 > 32 || e.bits6 < 0 || e.bits6 > 128 {
+		return nil, fmt.Errorf("ecs: bad prefix lengths %d, %d", e.bits4, e.bits6)
+	}
+	return e, nil
+}
+
+// Return the client subnet option to send for a query from 'ip' that
+// had the option 'client' (nil if none) and EDNS if 'edns'; nil for no
+// option.
+func (e *ecsPolicy) option(client []byte, ip net.IP, edns bool) []byte {
+	switch e.mode {
+	case ECS_FORWARD:
+		return client
+	case ECS_SYNTHESIZE:
+		if ip != nil {
+			return ecsOption(ip, e.bits4, e.bits6)
+		}
+	}
+	if edns {
+		return []byte{0, 1, 0, 0}
+	}
+	return nil
+}
+
+// Return the client subnet option of the first 'bits4' or 'bits6' bits
+// of 'ip'
+func ecsOption(ip net.IP, bits4, bits6 int) []byte {
+	fam, bits := 2, bits6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, fam, bits = ip4, 1, bits4
+	} else {
+		ip = ip.To16()
+	}
+
+	a := ip.Mask(net.CIDRMask(bits, len(ip)*8))
+	b := binary.BigEndian.AppendUint16(nil, uint16(fam))
+	b = append(b, byte(bits), 0)
+	return append(b, a[:(bits+7)/8]...)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
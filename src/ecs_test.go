@@ -0,0 +1,162 @@
+// ecs_test.go -- tests for EDNS Client Subnet handling
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/golang-lru"
+)
+
+func TestECSOption(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want []byte
+	}{
+		{"192.0.2.77", []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"2001:db8:1:2ff::1", []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		if b := ecsOption(net.ParseIP(tt.ip), 24, 56); !bytes.Equal(b, tt.want) {
+			t.Errorf("%s: % x", tt.ip, b)
+		}
+	}
+	if b := ecsOption(net.ParseIP("192.0.2.77"), 20, 56); !bytes.Equal(b, []byte{0, 1, 20, 0, 192, 0, 0}) {
+		t.Errorf("/20: % x", b)
+	}
+
+	for _, c := range []ECSConf{{Mode: "leak"}, {Prefix4: 33}, {Prefix6: -1}} {
+		if _, err := newECS(&c, "strip", "strip", "synthesize"); err == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+	if _, err := newECS(&ECSConf{Mode: "forward"}, "strip", "strip", "synthesize"); err == nil {
+		t.Errorf("forward where it isn't allowed")
+	}
+}
+
+func TestDNSEditOPT(t *testing.T) {
+	cookie := []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	ecs := []byte{0, 8, 0, 7, 0, 1, 24, 0, 10, 1, 2}
+	b := msg(header(1, dnsFlagRD, 1, 0, 0, 1), question("example.com", dnsTypeA),
+		rr([]byte{0}, dnsTypeOPT, 1232, 0, msg(ecs, cookie)))
+	m, err := parseDNS(b)
+	if err != nil || !bytes.Equal(m.ecs, ecs[4:]) {
+		t.Fatalf("parse: %v % x", err, m.ecs)
+	}
+
+	// replaced; the cookie stays
+	x, err := parseDNS(dnsEditOPT(m, []byte{0, 1, 0, 0}, false))
+	if err != nil || !bytes.Equal(x.ecs, []byte{0, 1, 0, 0}) || x.udpSize != 1232 ||
+		!bytes.Equal(x.raw[x.optRD:x.optEnd], msg(cookie, []byte{0, 8, 0, 4, 0, 1, 0, 0})) {
+		t.Errorf("replace: %v % x", err, x.raw)
+	}
+
+	// removed, and the OPT RR dropped
+	if x, err = parseDNS(dnsEditOPT(m, nil, false)); err != nil || x.ecs != nil || x.opt < 0 {
+		t.Errorf("remove: %v %+v", err, x)
+	}
+	if x, err = parseDNS(dnsEditOPT(m, nil, true)); err != nil || x.opt >= 0 || len(x.raw) != m.opt {
+		t.Errorf("drop: %v %+v", err, x)
+	}
+
+	// added to a query without EDNS
+	m, _ = parseDNS(msg(header(1, dnsFlagRD, 1, 0, 0, 0), question("example.com", dnsTypeA)))
+	if x, err = parseDNS(dnsEditOPT(m, ecs[4:], false)); err != nil || !bytes.Equal(x.ecs, ecs[4:]) {
+		t.Errorf("add: %v %+v", err, x)
+	}
+	if r := dnsEditOPT(m, nil, true); !bytes.Equal(r, m.raw) {
+		t.Errorf("drop without OPT: % x", r)
+	}
+}
+
+func TestDNSProxyECS(t *testing.T) {
+	// An upstream that answers with the client subnet it was sent
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	seen := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, a, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q, err := parseDNS(append([]byte(nil), b[:n]...))
+			if err != nil {
+				continue
+			}
+			seen <- q.ecs
+			r := dnsReply(q, rcodeOK)
+			if q.opt >= 0 {
+				r[11] = 1
+				opt := []byte{}
+				if q.ecs != nil {
+					opt = msg(u16(dnsOptECS), u16(uint16(len(q.ecs))), q.ecs)
+				}
+				r = append(r, rr([]byte{0}, dnsTypeOPT, 1232, 0, opt)...)
+			}
+			pc.WriteTo(r, a)
+		}
+	}()
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	proxy := func(mode string) *dnsProxy {
+		ecs, err := newECS(&ECSConf{Mode: mode}, "forward", "forward", "strip", "synthesize")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, _ := lru.New2Q(16)
+		return &dnsProxy{cfg: &DNSConf{Upstream: []string{pc.LocalAddr().String()}},
+			cache: cache, ecs: ecs, log: log, ctx: context.Background()}
+	}
+
+	client := net.ParseIP("198.51.100.9")
+	mine := []byte{0, 1, 32, 0, 198, 51, 100, 9}
+	plain := msg(header(1, dnsFlagRD, 1, 0, 0, 0), question("a.example", dnsTypeA))
+	edns := msg(header(2, dnsFlagRD, 1, 0, 0, 1), question("b.example", dnsTypeA),
+		rr([]byte{0}, dnsTypeOPT, 1232, 0, msg(u16(dnsOptECS), u16(8), mine)))
+
+	tests := []struct {
+		mode   string
+		q      []byte
+		up     []byte // subnet sent upstream
+		answer []byte // subnet in the answer to the client
+		opt    bool   // the answer has EDNS
+	}{
+		{"forward", edns, mine, mine, true},
+		{"forward", plain, nil, nil, false},
+		{"strip", edns, []byte{0, 1, 0, 0}, nil, true},
+		{"strip", plain, nil, nil, false},
+		{"synthesize", edns, []byte{0, 1, 24, 0, 198, 51, 100}, nil, true},
+		{"synthesize", plain, []byte{0, 1, 24, 0, 198, 51, 100}, nil, false},
+	}
+	for _, tt := range tests {
+		d := proxy(tt.mode)
+		_, r := d.query(tt.q, client)
+		up := <-seen
+		m, err := parseDNS(r)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.mode, err)
+		}
+		if !bytes.Equal(up, tt.up) || !bytes.Equal(m.ecs, tt.answer) || (m.opt >= 0) != tt.opt {
+			t.Errorf("%s %s: upstream % x, answer % x, opt %v", tt.mode, m.qname, up, m.ecs, m.opt >= 0)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
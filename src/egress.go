@@ -0,0 +1,356 @@
+// egress.go -- source addresses of outbound connections per user
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Most addresses in an egress pool
+const EGRESS_MAX = 65536
+
+// Source addresses of a listener's authenticated users. Each user gets
+// an address of each family in the pool the first time it connects and
+// keeps it; the assignments are kept in a file. Users in the config
+// have fixed addresses. With a prefix, IPv6 connections of the others
+// (and of clients that don't authenticate) come from temporary
+// addresses instead.
+type egress struct {
+	name   string // listener
+	pool   []net.IP
+	inPool map[string]bool
+	fixed  map[string][]net.IP
+	m      *egressMap
+	temp   *tempAddrs // nil if there is no prefix
+}
+
+// Addresses given to users, kept in a file; listeners with the same
+// file share them.
+type egressMap struct {
+	file string
+	refs int
+
+	sync.Mutex
+	users map[string][]net.IP
+	used  map[string]string // address -> user
+}
+
+// The egress maps, by file
+var egressMaps = struct {
+	sync.Mutex
+	m map[string]*egressMap
+}{m: make(map[string]*egressMap)}
+
+// Return the egress of 'c' or nil if it has none
+func newEgress(c *EgressConf, name string) (*egress, error) {
+	if len(c.Pool) == 0 && len(c.Users) == 0 && len(c.Prefix) == 0 {
+		return nil, nil
+	}
+
+	e := &egress{
+		name:   name,
+		inPool: make(map[string]bool),
+		fixed:  make(map[string][]net.IP),
+	}
+	for u, s := range c.Users {
+		for _, a := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("egress: user %s: %q is not an IP address", u, a)
+			}
+			e.fixed[u] = append(e.fixed[u], ip)
+		}
+	}
+	taken := make(map[string]bool)
+	for _, v := range e.fixed {
+		for _, ip := range v {
+			taken[ip.String()] = true
+		}
+	}
+
+	for _, s := range c.Pool {
+		v, err := egressAddrs(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range v {
+			k := ip.String()
+			if taken[k] || e.inPool[k] {
+				continue
+			}
+			if len(e.pool) == EGRESS_MAX {
+				return nil, fmt.Errorf("egress: more than %d addresses in the pool", EGRESS_MAX)
+			}
+			e.pool = append(e.pool, ip)
+			e.inPool[k] = true
+		}
+	}
+
+	if len(c.Prefix) > 0 {
+		t, err := newTempAddrs(c.Prefix, c.Rotate)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range e.pool {
+			if ip.To4() == nil {
+				return nil, fmt.Errorf("egress: IPv6 address %s in the pool and a prefix", ip)
+			}
+		}
+		e.temp = t
+	}
+
+	if len(e.pool) > 0 {
+		if len(c.File) == 0 {
+			return nil, fmt.Errorf("egress: a pool needs a 'file' to keep the assignments in")
+		}
+		m, err := openEgressMap(c.File)
+		if err != nil {
+			return nil, err
+		}
+		e.m = m
+	}
+	return e, nil
+}
+
+// Return the addresses of 's': an IP address or a CIDR. The network and
+// broadcast addresses of IPv4 subnets are left out.
+func egressAddrs(s string) ([]net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("egress: %q is not an address or CIDR", s)
+	}
+	ones, bits := n.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("egress: %s: more than %d addresses", s, EGRESS_MAX)
+	}
+
+	var v []net.IP
+	count := 1 << uint(bits-ones)
+	ip := n.IP
+	for i := 0; i < count; i++ {
+		if bits == 32 && ones <= 30 && (i == 0 || i == count-1) {
+			ip = nextIP(ip)
+			continue
+		}
+		v = append(v, ip)
+		ip = nextIP(ip)
+	}
+	return v, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		if n[i]++; n[i] != 0 {
+			break
+		}
+	}
+	return n
+}
+
+func openEgressMap(file string) (*egressMap, error) {
+	fn, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	egressMaps.Lock()
+	defer egressMaps.Unlock()
+	if m, ok := egressMaps.m[fn]; ok {
+		m.refs++
+		return m, nil
+	}
+
+	m := &egressMap{
+		file:  fn,
+		refs:  1,
+		users: make(map[string][]net.IP),
+		used:  make(map[string]string),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	egressMaps.m[fn] = m
+	return m, nil
+}
+
+// Read the file; a missing file has no assignments
+func (m *egressMap) load() error {
+	b, err := os.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f struct {
+		Users map[string][]string `json:"users"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %s", m.file, err)
+	}
+	for u, v := range f.Users {
+		for _, s := range v {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("%s: user %s: %q is not an IP address", m.file, u, s)
+			}
+			if o, ok := m.used[ip.String()]; ok {
+				return fmt.Errorf("%s: %s is given to %s and %s", m.file, s, o, u)
+			}
+			m.users[u] = append(m.users[u], ip)
+			m.used[ip.String()] = u
+		}
+	}
+	return nil
+}
+
+// Write the file; the caller holds the lock
+func (m *egressMap) save() error {
+	users := make(map[string][]string, len(m.users))
+	for u, v := range m.users {
+		for _, ip := range v {
+			users[u] = append(users[u], ip.String())
+		}
+	}
+
+	b, err := json.MarshalIndent(map[string]interface{}{"users": users}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Return true if 'ip' can be the source of a connection to 'dst'; any
+// address can be if 'dst' is nil.
+func sameFamily(ip, dst net.IP) bool {
+	return dst == nil || (ip.To4() != nil) == (dst.To4() != nil)
+}
+
+func familyOf(dst net.IP) string {
+	switch {
+	case dst == nil:
+		return ""
+	case dst.To4() != nil:
+		return "IPv4 "
+	}
+	return "IPv6 "
+}
+
+// Return true if users that don't authenticate have source addresses
+// of the egress too
+func (e *egress) anyone() bool {
+	return e.temp != nil
+}
+
+// Return the source address of a connection of 'user' to 'dst' (nil for
+// a socket that isn't connected yet); give the user one from the pool
+// if it doesn't have one of the family of 'dst'. IPv6 destinations get
+// a temporary address if there is a prefix.
+func (e *egress) addr(user string, dst net.IP) (net.IP, error) {
+	if v, ok := e.fixed[user]; ok {
+		for _, ip := range v {
+			if sameFamily(ip, dst) {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("egress: no %ssource address for %s", familyOf(dst), user)
+	}
+	if e.temp != nil && dst != nil && dst.To4() == nil {
+		return e.temp.addr(user), nil
+	}
+	if e.m == nil || len(user) == 0 {
+		return nil, nil
+	}
+
+	m := e.m
+	m.Lock()
+	defer m.Unlock()
+	for _, ip := range m.users[user] {
+		if e.inPool[ip.String()] && sameFamily(ip, dst) {
+			return ip, nil
+		}
+	}
+
+	for _, ip := range e.pool {
+		if _, ok := m.used[ip.String()]; ok || !sameFamily(ip, dst) {
+			continue
+		}
+		m.users[user] = append(m.users[user], ip)
+		m.used[ip.String()] = user
+		if err := m.save(); err != nil {
+			v := m.users[user]
+			m.users[user] = v[:len(v)-1]
+			delete(m.used, ip.String())
+			return nil, fmt.Errorf("egress: %s", err)
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("egress: no free %ssource address for %s", familyOf(dst), user)
+}
+
+// Drop the assignments when the last listener with them stops
+func (e *egress) Close() {
+	if e.m == nil {
+		return
+	}
+
+	egressMaps.Lock()
+	defer egressMaps.Unlock()
+	if e.m.refs--; e.m.refs == 0 {
+		delete(egressMaps.m, e.m.file)
+	}
+}
+
+// Egress metrics for the admin listener
+func (e *egress) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", e.name)
+	n := 0
+	if e.m != nil {
+		e.m.Lock()
+		for k := range e.m.used {
+			if e.inPool[k] {
+				n++
+			}
+		}
+		e.m.Unlock()
+	}
+	v := []metric{
+		{"goproxy_egress_pool", "gauge", "Source addresses in the egress pool", l, float64(len(e.pool))},
+		{"goproxy_egress_assigned", "gauge", "Egress pool addresses given to users", l, float64(n)},
+	}
+	if e.temp != nil {
+		v = append(v, metric{"goproxy_egress_temp_total", "counter",
+			"Temporary IPv6 source addresses made", l, float64(atomic.LoadUint64(&e.temp.made))})
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,249 @@
+// egress_test.go -- tests for per user source addresses
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestEgress(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "egress.json")
+	c := &EgressConf{
+		Pool:  []string{"127.0.0.2", "127.0.0.8/30", "127.0.0.20"},
+		File:  fn,
+		Users: map[string]string{"bob": "127.0.0.20, ::1"},
+	}
+	e, err := newEgress(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.pool) != 3 {
+		t.Errorf("pool: %v", e.pool)
+	}
+
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	want := map[string]string{"alice": "127.0.0.2", "carol": "127.0.0.9", "dave": "127.0.0.10"}
+	for _, u := range []string{"alice", "carol", "dave", "alice"} {
+		if ip, err := e.addr(u, v4); err != nil || ip.String() != want[u] {
+			t.Errorf("%s: %v %v", u, ip, err)
+		}
+	}
+	if ip, err := e.addr("erin", v4); err == nil {
+		t.Errorf("pool used up: erin got %s", ip)
+	}
+	if ip, err := e.addr("alice", v6); err == nil {
+		t.Errorf("IPv6 from an IPv4 pool: %s", ip)
+	}
+	if ip, _ := e.addr("bob", v4); ip.String() != "127.0.0.20" {
+		t.Errorf("bob, IPv4: %s", ip)
+	}
+	if ip, _ := e.addr("bob", v6); ip.String() != "::1" {
+		t.Errorf("bob, IPv6: %s", ip)
+	}
+	if ip, _ := e.addr("carol", nil); ip.String() != "127.0.0.9" {
+		t.Errorf("carol, UDP: %s", ip)
+	}
+
+	// The assignments outlive the listener
+	e.Close()
+	c.Pool = []string{"127.0.0.9", "127.0.0.2"}
+	e, err = newEgress(c, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := e.addr("alice", v4); ip.String() != "127.0.0.2" {
+		t.Errorf("alice after a restart: %s", ip)
+	}
+	if ip, err := e.addr("dave", v4); err == nil {
+		t.Errorf("dave's address left the pool; got %s", ip)
+	}
+	e.Close()
+
+	bad := []EgressConf{
+		{Pool: []string{"127.0.0.2"}},
+		{Pool: []string{"127.0.0.300"}, File: fn},
+		{Pool: []string{"10.0.0.0/8"}, File: fn},
+		{Users: map[string]string{"x": "nope"}},
+	}
+	for i := range bad {
+		if _, err := newEgress(&bad[i], "test"); err == nil {
+			t.Errorf("%+v: no error", bad[i])
+		}
+	}
+	if e, err := newEgress(&EgressConf{}, "test"); e != nil || err != nil {
+		t.Errorf("empty: %v %v", e, err)
+	}
+}
+
+func TestEgressTemp(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	_, pfx, _ := net.ParseCIDR("2001:db8:1:2::/64")
+
+	// a new address for each connection
+	e, err := newEgress(&EgressConf{Prefix: pfx.String(), Users: map[string]string{"bob": "2001:db8::b"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := e.addr("alice", v6)
+	b, _ := e.addr("alice", v6)
+	if !pfx.Contains(a) || !pfx.Contains(b) || a.Equal(b) {
+		t.Errorf("per connection: %s %s", a, b)
+	}
+	if ip, err := e.addr("alice", v4); ip != nil || err != nil {
+		t.Errorf("IPv4: %s %v", ip, err)
+	}
+	if ip, _ := e.addr("bob", v6); ip.String() != "2001:db8::b" {
+		t.Errorf("fixed: %s", ip)
+	}
+	if ip, _ := e.addr("", v6); !pfx.Contains(ip) {
+		t.Errorf("no user: %s", ip)
+	}
+	if ip, _ := e.addr("alice", nil); ip != nil {
+		t.Errorf("UDP: %s", ip)
+	}
+	if n := findMetric(e.metrics(), "goproxy_egress_temp_total", `listener="test"`); n != 3 {
+		t.Errorf("metrics: %v", n)
+	}
+
+	// an address for each user, for a while
+	e, err = newEgress(&EgressConf{Prefix: pfx.String(), Rotate: 60, Pool: []string{"127.0.0.2"},
+		File: filepath.Join(t.TempDir(), "egress.json")}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ = e.addr("alice", v6)
+	b, _ = e.addr("bob", v6)
+	if a.Equal(b) {
+		t.Errorf("shared: %s", a)
+	}
+	if ip, _ := e.addr("alice", v6); !ip.Equal(a) {
+		t.Errorf("rotated early: %s %s", ip, a)
+	}
+	if ip, _ := e.addr("alice", v4); ip.String() != "127.0.0.2" {
+		t.Errorf("pool: %s", ip)
+	}
+	e.temp.cur["alice"] = tempAddr{a, time.Now()}
+	if ip, _ := e.addr("alice", v6); ip.Equal(a) || !pfx.Contains(ip) {
+		t.Errorf("not rotated: %s", ip)
+	}
+	e.Close()
+
+	// clients that don't authenticate get them too
+	d, err := newDialer(&ListenConf{Egress: EgressConf{Prefix: pfx.String()}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := d.source("", v6); err != nil || !pfx.Contains(ip) {
+		t.Errorf("dialer: %s %v", ip, err)
+	}
+	if ip, err := d.source("", v4); err != nil || ip != nil {
+		t.Errorf("dialer, IPv4: %s %v", ip, err)
+	}
+	d.Close()
+
+	for _, c := range []EgressConf{
+		{Prefix: "10.0.0.0/8"},
+		{Prefix: "2001:db8::/120"},
+		{Prefix: "2001:db8::1"},
+		{Prefix: "2001:db8::/64", Rotate: -1},
+		{Prefix: "2001:db8::/64", Pool: []string{"2001:db8:2::1"}, File: "x"},
+	} {
+		if _, err := newEgress(&c, "test"); err == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+
+	for s, want := range map[string]bool{
+		"2001:db8::":                       true,
+		"2001:db8::fdff:ffff:ffff:ff90":    true,
+		"2001:db8::200:5efe:a00:1":         true,
+		"2001:db8::1":                      false,
+		"2001:db8::fdff:ffff:ffff:ff7f":    false,
+		"2001:db8:0:0:fdff:ffff:ffff:ff80": true,
+	} {
+		if r := reservedIID(net.ParseIP(s), 64); r != want {
+			t.Errorf("%s: %v", s, r)
+		}
+	}
+	if reservedIID(net.ParseIP("2001:db8::fdff:ffff:ffff:ff90"), 96) || !reservedIID(net.ParseIP("2001:db8::"), 96) {
+		t.Errorf("/96")
+	}
+}
+
+func TestEgressProxy(t *testing.T) {
+	from := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, _, _ := net.SplitHostPort(r.RemoteAddr)
+		from <- h
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+
+	pw := writeHtpasswd(t, "alice:"+bcryptHash(t, "wonder")+"\nbob:"+bcryptHash(t, "builder")+"\n")
+	ac := AuthConf{Type: "htpasswd", Args: map[string]string{"file": pw}}
+	eg := EgressConf{Pool: []string{"127.0.0.2", "127.0.0.3"}, File: filepath.Join(t.TempDir(), "egress.json")}
+	addr := startHTTPProxy(t, &ListenConf{Auth: ac, Egress: eg})
+
+	pu := &url.URL{Scheme: "http", Host: addr}
+	tr := &http.Transport{Proxy: http.ProxyURL(pu)}
+	t.Cleanup(tr.CloseIdleConnections)
+	get := func(user, pass string) string {
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		x := &http.Request{Header: http.Header{}}
+		x.SetBasicAuth(user, pass)
+		req.Header.Set("Proxy-Authorization", x.Header.Get("Authorization"))
+		res, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("%s: %d", user, res.StatusCode)
+		}
+		return <-from
+	}
+
+	// bob's request doesn't reuse alice's connection to the origin
+	for _, u := range []struct{ user, pass, ip string }{
+		{"alice", "wonder", "127.0.0.2"},
+		{"bob", "builder", "127.0.0.3"},
+		{"alice", "wonder", "127.0.0.2"},
+	} {
+		if ip := get(u.user, u.pass); ip != u.ip {
+			t.Errorf("%s: from %s, want %s", u.user, ip, u.ip)
+		}
+	}
+
+	saddr := startSocksProxy(t, &ListenConf{Auth: ac, Egress: eg})
+	d, _ := proxy.SOCKS5("tcp", saddr, &proxy.Auth{User: "bob", Password: "builder"}, proxy.Direct)
+	c := &http.Client{Transport: &http.Transport{Dial: d.Dial}}
+	res, err := c.Get(origin.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ip := <-from; ip != "127.0.0.3" {
+		t.Errorf("socks: bob from %s", ip)
+	}
+
+	if _, err := newDialer(&ListenConf{Egress: eg, Parent: "http://127.0.0.1:1"}, nil); err == nil {
+		t.Errorf("egress with a parent proxy")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,195 @@
+// errors.go -- why sessions fail, and the replies that tell clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The causes of a failed session. The errors of the proxy are (or wrap)
+// one of them, so callers and tests branch with errors.Is; the SOCKS
+// replies and HTTP statuses sent to clients are picked from them here.
+var (
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrDestDenied      = errors.New("destination not allowed")
+	ErrDialTimeout     = errors.New("dial timed out")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrConnRefused     = errors.New("connection refused")
+	ErrHostUnreachable = errors.New("host unreachable")
+	ErrNetUnreachable  = errors.New("network unreachable")
+	ErrDNS             = errors.New("name lookup failed")
+)
+
+// An error with the text 'msg' and the cause 'cause'
+type causeErr struct {
+	msg   string
+	cause error
+}
+
+func (e *causeErr) Error() string {
+	return e.msg
+}
+
+func (e *causeErr) Unwrap() error {
+	return e.cause
+}
+
+// Return an error with the text 'msg' that is the cause 'cause'
+func newError(cause error, msg string) error {
+	return &causeErr{msg: msg, cause: cause}
+}
+
+// Return the cause of 'err' (one of the Err... above); nil if it has
+// none of them
+func errCause(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range []error{ErrAuthFailed, ErrDestDenied, ErrDialTimeout, ErrQuotaExceeded,
+		ErrConnRefused, ErrHostUnreachable, ErrNetUnreachable, ErrDNS} {
+		if errors.Is(err, c) {
+			return c
+		}
+	}
+
+	var de *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.As(err, &de) && !de.IsTimeout:
+		return ErrDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return ErrDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrNetUnreachable
+	}
+	return nil
+}
+
+// SOCKS5 replies (RFC 1928) of the causes
+var socksCodes = map[error]byte{
+	ErrAuthFailed:      0x02,
+	ErrDestDenied:      0x02,
+	ErrQuotaExceeded:   0x02,
+	ErrNetUnreachable:  0x03,
+	ErrHostUnreachable: 0x04,
+	ErrDNS:             0x04,
+	ErrConnRefused:     0x05,
+	ErrDialTimeout:     0x06,
+}
+
+// Return the SOCKS5 reply to a CONNECT that failed with 'err'
+func socksCode(err error) byte {
+	if err == nil {
+		return 0x00
+	}
+	if c, ok := socksCodes[errCause(err)]; ok {
+		return c
+	}
+	return 0x01
+}
+
+// Return the cause of the SOCKS5 reply 'code' of a parent; nil if it
+// is a general failure
+func socksCause(code byte) error {
+	switch code {
+	case 0x02:
+		return ErrDestDenied
+	case 0x03:
+		return ErrNetUnreachable
+	case 0x04:
+		return ErrHostUnreachable
+	case 0x05:
+		return ErrConnRefused
+	case 0x06:
+		return ErrDialTimeout
+	}
+	return nil
+}
+
+// An HTTP answer to a failed request: status, text ("" is the cause)
+// and the error type of its Proxy-Status (RFC 9209)
+type httpReply struct {
+	status int
+	text   string
+	typ    string
+}
+
+var httpReplies = map[error]httpReply{
+	ErrDestDenied:      {http.StatusForbidden, "Destination not allowed", "destination_ip_prohibited"},
+	ErrQuotaExceeded:   {http.StatusTooManyRequests, "Quota exceeded", "http_request_denied"},
+	ErrDialTimeout:     {http.StatusGatewayTimeout, "", "connection_timeout"},
+	ErrConnRefused:     {http.StatusBadGateway, "", "connection_refused"},
+	ErrHostUnreachable: {http.StatusBadGateway, "", "destination_unavailable"},
+	ErrNetUnreachable:  {http.StatusBadGateway, "", "destination_ip_unroutable"},
+	ErrDNS:             {http.StatusBadGateway, "", "dns_error"},
+}
+
+// Answer the request 'r' to 'host' that failed with 'err': the status of
+// its cause, with the error type in a Proxy-Status header
+func (p *HTTPProxy) replyError(w http.ResponseWriter, r *http.Request, err error, host string) {
+	cause := errCause(err)
+	hr, ok := httpReplies[cause]
+	if !ok {
+		hr = httpReply{http.StatusBadGateway, fmt.Sprintf("Can't connect to %s", host), "proxy_internal_error"}
+	}
+	text := hr.text
+	if de := isDNSSEC(err); de != nil {
+		text = de.Error()
+	} else if len(text) == 0 {
+		text = fmt.Sprintf("Can't connect to %s: %s", host, cause)
+	}
+	w.Header().Set("Proxy-Status", "goproxy; error="+hr.typ)
+	if d := retryAfter(err); d > 0 {
+		secs := int((d + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		text = fmt.Sprintf("Too many requests; retry after %d seconds", secs)
+	}
+
+	rule := ""
+	if pe := isDenied(err); pe != nil {
+		rule = pe.rule
+	}
+	p.httpError(w, r, text, hr.status, rule)
+}
+
+// Return how long the client of a request refused by a limit (with
+// 'err') should wait; 0 if it wasn't or the limit doesn't say
+func retryAfter(err error) time.Duration {
+	if pe := isDenied(err); pe != nil {
+		return pe.retry
+	}
+	return 0
+}
+
+// Return the cause of the HTTP status 'code' of a parent's reply; nil
+// if there is none
+func httpCause(code int) error {
+	switch code {
+	case http.StatusForbidden:
+		return ErrDestDenied
+	case http.StatusTooManyRequests:
+		return ErrQuotaExceeded
+	case http.StatusGatewayTimeout:
+		return ErrDialTimeout
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
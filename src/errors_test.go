@@ -0,0 +1,186 @@
+// errors_test.go -- tests for the error causes and their replies
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opencoff/go-proxies/client"
+)
+
+func TestErrCause(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	for _, tc := range []struct {
+		err   error
+		cause error
+		socks byte
+		http  int
+	}{
+		{errAuthFailed, ErrAuthFailed, 0x02, http.StatusBadGateway},
+		{errKeyQuota, ErrQuotaExceeded, 0x02, http.StatusTooManyRequests},
+		{errTunnelLimit, ErrQuotaExceeded, 0x02, http.StatusTooManyRequests},
+		{errFiltered, ErrDestDenied, 0x02, http.StatusForbidden},
+		{&policyErr{dest: "a:1", rule: "r"}, ErrDestDenied, 0x02, http.StatusForbidden},
+		{&policyErr{dest: "a:1", rule: "r", retry: time.Second}, ErrQuotaExceeded, 0x02, http.StatusTooManyRequests},
+		{fmt.Errorf("dial: %w", &dnssecErr{host: "a", reason: "bogus"}), ErrDNS, 0x04, http.StatusBadGateway},
+		{&net.DNSError{Err: "no such host", Name: "a"}, ErrDNS, 0x04, http.StatusBadGateway},
+		{context.DeadlineExceeded, ErrDialTimeout, 0x06, http.StatusGatewayTimeout},
+		{refused, ErrConnRefused, 0x05, http.StatusBadGateway},
+		{syscall.EHOSTUNREACH, ErrHostUnreachable, 0x04, http.StatusBadGateway},
+		{syscall.ENETUNREACH, ErrNetUnreachable, 0x03, http.StatusBadGateway},
+		{newError(socksCause(0x05), "parent: refused"), ErrConnRefused, 0x05, http.StatusBadGateway},
+		{newError(httpCause(http.StatusForbidden), "parent: no"), ErrDestDenied, 0x02, http.StatusForbidden},
+		{errors.New("?"), nil, 0x01, http.StatusBadGateway},
+	} {
+		if got := errCause(tc.err); got != tc.cause {
+			t.Errorf("%v: cause %v, want %v", tc.err, got, tc.cause)
+		}
+		if got := socksCode(tc.err); got != tc.socks {
+			t.Errorf("%v: socks %d, want %d", tc.err, got, tc.socks)
+		}
+		w := httptest.NewRecorder()
+		(&HTTPProxy{}).replyError(w, httptest.NewRequest("CONNECT", "http://a:1", nil), tc.err, "a:1")
+		if w.Code != tc.http || len(w.Header().Get("Proxy-Status")) == 0 {
+			t.Errorf("%v: http %d %q, want %d", tc.err, w.Code, w.Header().Get("Proxy-Status"), tc.http)
+		}
+	}
+	if socksCode(nil) != 0 || errCause(nil) != nil {
+		t.Errorf("nil has a cause")
+	}
+
+	w := httptest.NewRecorder()
+	err := &net.OpError{Op: "dial", Err: &policyErr{dest: "a:1", rule: "guard-scan", retry: 2500 * time.Millisecond}}
+	(&HTTPProxy{}).replyError(w, httptest.NewRequest("CONNECT", "http://a:1", nil), err, "a:1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("retry: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if retryAfter(errAuthFailed) != 0 || retryAfter(&policyErr{}) != 0 {
+		t.Errorf("retry after a denial")
+	}
+}
+
+// Rate limited clients are told when to come back
+func TestRetryAfter(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// connections: plaintext HTTP clients over the limit get a 429
+	addr := startHTTPProxy(t, &ListenConf{Ratelimit: RateLimit{PerHost: 1, Burst: 1}})
+	limited := 0
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if res.StatusCode == http.StatusTooManyRequests {
+			limited++
+			if res.Header.Get("Retry-After") != "1" {
+				t.Errorf("%d: Retry-After %q", i, res.Header.Get("Retry-After"))
+			}
+		}
+	}
+	if limited == 0 {
+		t.Errorf("no connection was limited")
+	}
+
+	// name lookups
+	addr = startHTTPProxy(t, &ListenConf{
+		Ratelimit: RateLimit{Lookups: 1, LookupBurst: 1},
+		Rules:     []RuleConf{{Name: "name", Dest: []string{"localhost"}, Action: "allow"}},
+	})
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "CONNECT localhost:%s HTTP/1.1\r\nHost: localhost:%s\r\n\r\n", port, port)
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		codes = append(codes, res.StatusCode)
+		if res.StatusCode == http.StatusTooManyRequests && res.Header.Get("Retry-After") != "1" {
+			t.Errorf("%d: Retry-After %q", i, res.Header.Get("Retry-After"))
+		}
+	}
+	if codes[0] != 200 || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("lookups: %v", codes)
+	}
+
+	// and the client library hands the wait to its caller
+	d, _ := client.New("http://" + addr)
+	_, err := d.Dial("tcp", "localhost:"+port)
+	var pe *client.ProxyError
+	if !errors.As(err, &pe) || !errors.Is(err, client.ErrQuotaExceeded) || pe.RetryAfter != time.Second {
+		t.Errorf("client: %v", err)
+	}
+}
+
+// The client library sees the causes through both protocols
+func TestErrReplies(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	lc := func() *ListenConf {
+		return &ListenConf{
+			Auth:  authConf(t),
+			Rules: []RuleConf{{Name: "no", Dest: []string{"127.0.0.2/32"}, Action: "deny"}},
+		}
+	}
+
+	for scheme, addr := range map[string]string{
+		"http":   startHTTPProxy(t, lc()),
+		"socks5": startSocksProxy(t, lc()),
+	} {
+		d, err := client.New(scheme + "://alice:wonder@" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+		c.Close()
+
+		for dest, want := range map[string]error{
+			"127.0.0.2:" + port: client.ErrDestDenied,
+			"127.0.0.1:1":       client.ErrConnRefused,
+		} {
+			if _, err := d.Dial("tcp", dest); !errors.Is(err, want) {
+				t.Errorf("%s %s: %v, want %v", scheme, dest, err, want)
+			}
+		}
+
+		d, _ = client.New(scheme + "://alice:rabbit@" + addr)
+		if _, err := d.Dial("tcp", echo.Addr().String()); !errors.Is(err, client.ErrAuthFailed) {
+			t.Errorf("%s: bad password: %v", scheme, err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
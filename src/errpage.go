@@ -0,0 +1,145 @@
+// errpage.go -- HTML error pages of the HTTP proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The data of an error page template
+type errorPage struct {
+	Status  int    // HTTP status
+	Title   string // its text ("Forbidden")
+	Reason  string // why the request failed
+	Host    string // the destination
+	Rule    string // the rule that denied it; "" if none
+	User    string // the authenticated user; "" if none
+	Client  string // the client's address
+	Session string // the session id (for support calls)
+	Time    time.Time
+}
+
+// Templates answering the errors of one listener: the rules' pages
+// first, then the status, then the default
+type errorPages struct {
+	rule   map[string]*template.Template
+	status map[int]*template.Template
+	def    *template.Template
+}
+
+// Return the error pages of 'lc'; nil if it has none
+func newErrorPages(lc *ListenConf) (*errorPages, error) {
+	e := &errorPages{
+		rule:   make(map[string]*template.Template),
+		status: make(map[int]*template.Template),
+	}
+
+	for k, fn := range lc.ErrorPages {
+		t, err := parsePage(fn)
+		if err != nil {
+			return nil, err
+		}
+		if k == "default" {
+			e.def = t
+			continue
+		}
+		code, err := strconv.Atoi(k)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("errorpages: '%s' isn't an error status or 'default'", k)
+		}
+		e.status[code] = t
+	}
+	for i := range lc.Rules {
+		rc := &lc.Rules[i]
+		if len(rc.ErrorPage) == 0 {
+			continue
+		}
+		if rc.Action != "deny" {
+			return nil, fmt.Errorf("rule %s: errorpage on a rule that doesn't deny", rc.Name)
+		}
+		t, err := parsePage(rc.ErrorPage)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rc.Name, err)
+		}
+		e.rule[rc.Name] = t
+	}
+
+	if len(e.rule) == 0 && len(e.status) == 0 && e.def == nil {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func parsePage(fn string) (*template.Template, error) {
+	t, err := template.New(filepath.Base(fn)).ParseFiles(fn)
+	if err != nil {
+		return nil, fmt.Errorf("errorpages: %w", err)
+	}
+	return t, nil
+}
+
+// Return the template for 'status' (or the rule 'rule'); nil if none
+func (e *errorPages) page(status int, rule string) *template.Template {
+	if e == nil {
+		return nil
+	}
+	if t, ok := e.rule[rule]; ok && len(rule) > 0 {
+		return t
+	}
+	if t, ok := e.status[status]; ok {
+		return t
+	}
+	return e.def
+}
+
+// Answer 'r' with the error 'status' and the text 'reason'; 'rule' is the
+// rule that denied it, if any. It is an HTML page if the listener has one
+// for it, else plain text.
+func (p *HTTPProxy) httpError(w http.ResponseWriter, r *http.Request, reason string, status int, rule string) {
+	t := p.pages.page(status, rule)
+	if t == nil {
+		http.Error(w, reason, status)
+		return
+	}
+
+	ctx := r.Context()
+	d := &errorPage{
+		Status:  status,
+		Title:   http.StatusText(status),
+		Reason:  reason,
+		Host:    extractHost(r.URL),
+		Rule:    rule,
+		User:    userOf(ctx),
+		Client:  r.RemoteAddr,
+		Session: sessionOf(ctx),
+		Time:    time.Now().UTC(),
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		logOf(ctx, p.log).Warn("errorpages: %s: %s", t.Name(), err)
+		http.Error(w, reason, status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,116 @@
+// errpage_test.go -- tests for the HTML error pages
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Write the template 'body' to a file; return its name
+func writePage(t *testing.T, name, body string) string {
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestErrorPages(t *testing.T) {
+	pages := map[string]string{
+		"403":     writePage(t, "403.html", `<p>blocked {{.Host}} ({{.Status}} {{.Title}})</p>`),
+		"407":     writePage(t, "407.html", `<p>sign in, {{.Client}}</p>`),
+		"default": writePage(t, "default.html", `<p>oops: {{.Reason}} {{.Status}}</p>`),
+	}
+	rule := writePage(t, "rule.html", `<p>rule {{.Rule}} says no to <{{.Host}}></p>`)
+	lc := func() *ListenConf {
+		return &ListenConf{
+			ErrorPages: pages,
+			Rules: []RuleConf{
+				{Name: "social", Dest: []string{"127.0.0.2/32"}, Action: "deny", ErrorPage: rule},
+				{Name: "other", Dest: []string{"127.0.0.3/32"}, Action: "deny"},
+			},
+		}
+	}
+
+	get := func(addr, target string) (*http.Response, string) {
+		pu, _ := url.Parse("http://" + addr)
+		hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}, Timeout: 5 * time.Second}
+		res, err := hc.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(b)
+	}
+
+	addr := startHTTPProxy(t, lc())
+	for target, want := range map[string]string{
+		"http://127.0.0.2:8080/": "<p>rule social says no to &lt;127.0.0.2:8080></p>",
+		"http://127.0.0.3:8080/": "<p>blocked 127.0.0.3:8080 (403 Forbidden)</p>",
+		"http://127.0.0.1:1/":    "<p>oops: Can&#39;t connect to 127.0.0.1:1: connection refused 502</p>",
+	} {
+		res, body := get(addr, target)
+		if body != want || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Errorf("%s: %d %q %q", target, res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+	}
+
+	alc := lc()
+	alc.Auth = authConf(t)
+	res, body := get(startHTTPProxy(t, alc), "http://127.0.0.2:8080/")
+	if res.StatusCode != http.StatusProxyAuthRequired || len(res.Header.Get("Proxy-Authenticate")) == 0 ||
+		!strings.HasPrefix(body, "<p>sign in, 127.0.0.1:") {
+		t.Errorf("407: %d %q", res.StatusCode, body)
+	}
+
+	// no pages: plain text
+	res, body = get(startHTTPProxy(t, &ListenConf{Rules: []RuleConf{{Name: "x", Dest: []string{"127.0.0.2/32"}, Action: "deny"}}}),
+		"http://127.0.0.2:8080/")
+	if res.StatusCode != http.StatusForbidden || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("plain: %d %q", res.StatusCode, body)
+	}
+}
+
+func TestErrorPagesConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ok := writePage(t, "ok.html", "ok")
+	bad := writePage(t, "bad.html", "{{.Nope")
+	for _, lc := range []*ListenConf{
+		{ErrorPages: map[string]string{"200": ok}},
+		{ErrorPages: map[string]string{"forbidden": ok}},
+		{ErrorPages: map[string]string{"403": bad}},
+		{ErrorPages: map[string]string{"403": ok + ".missing"}},
+		{Rules: []RuleConf{{Name: "a", Dest: []string{"10.0.0.0/8"}, Action: "allow", ErrorPage: ok}}},
+		{Rules: []RuleConf{{Name: "a", Dest: []string{"10.0.0.0/8"}, Action: "deny", ErrorPage: bad}}},
+	} {
+		if _, err := newErrorPages(lc); err == nil {
+			t.Errorf("%+v: no error", lc)
+		}
+	}
+	if e, err := newErrorPages(&ListenConf{}); e != nil || err != nil {
+		t.Errorf("none: %v %v", e, err)
+	}
+
+	if _, err := NewSocksv5Proxy(&ListenConf{Listen: "127.0.0.1:0",
+		ErrorPages: map[string]string{"403": ok}}, log, nil); err == nil {
+		t.Errorf("errorpages on socks: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
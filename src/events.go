@@ -0,0 +1,454 @@
+// events.go -- usage events for billing systems
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Each session that ends and each API key that crosses a threshold of
+// its quota is an event. Events queue (and with a spool, wait on disk)
+// until the endpoint or the list takes them: they are delivered at
+// least once, and a receiver drops the ids it has seen.
+
+const (
+	// Default seconds between deliveries
+	EVENTS_INTERVAL = 5
+
+	// Most events of a delivery
+	EVENTS_BATCH = 500
+
+	// Most events queued; beyond it the oldest are dropped
+	EVENTS_QUEUE = 100000
+
+	// Longest wait between retries of a failed delivery
+	EVENTS_BACKOFF = 5 * time.Minute
+
+	// Time a delivery may take
+	EVENTS_TIMEOUT = 30 * time.Second
+
+	// Default list of a Redis queue
+	EVENTS_LIST = "goproxy:events"
+)
+
+// The sink of the usage events; nil if there is none
+var events *eventSink
+
+// A usage event as the endpoint gets it
+type usageEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"` // "session" or "quota"
+	Time int64  `json:"time"` // unix
+	Node string `json:"node"`
+
+	// a session that ended
+	Session  string `json:"session,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	User     string `json:"user,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Dest     string `json:"dest,omitempty"`
+	Start    int64  `json:"start,omitempty"` // unix
+	In       int64  `json:"in,omitempty"`    // bytes from the client
+	Out      int64  `json:"out,omitempty"`   // bytes to the client
+
+	// an API key whose usage crossed 'Threshold' of its quota
+	Key       string  `json:"key,omitempty"`
+	Used      int64   `json:"used,omitempty"`
+	Quota     int64   `json:"quota,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+type eventSink struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	sent    uint64
+	failed  uint64
+	dropped uint64
+
+	interval time.Duration
+	url      string
+	secret   []byte
+	list     string
+	redis    *redisStore
+	node     string
+	quota    []float64
+	client   *http.Client
+	log      *L.Logger
+
+	sync.Mutex
+	q     []*usageEvent
+	spool string
+	fd    *os.File
+	wr    *bufio.Writer
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Make the sink of 'ec'; nil if it has neither a URL nor a Redis list.
+// Events left in the spool by the last run are queued again.
+func newEventSink(ec *EventsConf, log *L.Logger) (*eventSink, error) {
+	if len(ec.URL) == 0 && len(ec.Redis) == 0 {
+		return nil, nil
+	}
+
+	e := &eventSink{
+		interval: time.Duration(ec.Interval) * time.Second,
+		url:      ec.URL,
+		secret:   []byte(ec.Secret),
+		list:     ec.List,
+		node:     ec.Node,
+		quota:    ec.Quota,
+		client:   &http.Client{Timeout: EVENTS_TIMEOUT},
+		log:      log,
+		spool:    ec.Spool,
+		stop:     make(chan struct{}),
+	}
+	if len(e.url) > 0 {
+		u, err := url.Parse(e.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("events: invalid url %q", e.url)
+		}
+	}
+	if len(ec.Redis) > 0 {
+		r, err := newRedisStore(&SharedConf{Redis: ec.Redis}, log)
+		if err != nil {
+			return nil, fmt.Errorf("events: %w", err)
+		}
+		e.redis = r
+		if len(e.list) == 0 {
+			e.list = EVENTS_LIST
+		}
+	}
+	switch {
+	case ec.Interval < 0:
+		return nil, fmt.Errorf("events: negative interval %d", ec.Interval)
+	case ec.Interval == 0:
+		e.interval = EVENTS_INTERVAL * time.Second
+	}
+	if e.quota == nil {
+		e.quota = []float64{0.8, 1}
+	}
+	for _, f := range e.quota {
+		if f <= 0 || f > 1 {
+			return nil, fmt.Errorf("events: quota threshold %g not in (0, 1]", f)
+		}
+	}
+	if len(e.node) == 0 {
+		e.node, _ = os.Hostname()
+	}
+	if len(e.spool) > 0 {
+		if err := e.load(); err != nil {
+			return nil, fmt.Errorf("events: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// Queue the events of the spool and open it for new ones
+func (e *eventSink) load() error {
+	b, err := os.ReadFile(e.spool)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, ln := range bytes.Split(b, []byte("\n")) {
+		var ev usageEvent
+		if len(ln) > 0 && json.Unmarshal(ln, &ev) == nil && len(ev.ID) > 0 {
+			e.q = append(e.q, &ev)
+		}
+	}
+	if n := len(e.q); n > 0 {
+		e.log.Info("events: %d undelivered events in %s", n, e.spool)
+	}
+	return e.rewrite()
+}
+
+// Write the queue to the spool afresh; the caller holds the lock
+// (or is the only user)
+func (e *eventSink) rewrite() error {
+	if e.fd != nil {
+		e.wr.Flush()
+		e.fd.Close()
+		e.fd = nil
+	}
+
+	tmp := e.spool + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(fd)
+	for _, ev := range e.q {
+		b, _ := json.Marshal(ev)
+		wr.Write(append(b, '\n'))
+	}
+	if err = wr.Flush(); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(tmp, e.spool)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if e.fd, err = os.OpenFile(e.spool, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	e.wr = bufio.NewWriter(e.fd)
+	return nil
+}
+
+// Queue 'ev'
+func (e *eventSink) emit(ev *usageEvent) {
+	var b [12]byte
+	rand.Read(b[:])
+	ev.ID = hex.EncodeToString(b[:])
+	ev.Node = e.node
+
+	e.Lock()
+	defer e.Unlock()
+	if len(e.q) >= EVENTS_QUEUE {
+		e.q = e.q[1:]
+		if atomic.AddUint64(&e.dropped, 1) == 1 {
+			e.log.Warn("events: queue full; dropping the oldest events")
+		}
+	}
+	e.q = append(e.q, ev)
+	if e.wr != nil {
+		b, _ := json.Marshal(ev)
+		e.wr.Write(append(b, '\n'))
+	}
+}
+
+// The session 'id' ended
+func (e *eventSink) session(id, listener, proto, tenant, user string, client net.IP,
+	dest string, start time.Time, in, out int64, now time.Time) {
+	if e == nil {
+		return
+	}
+	ev := &usageEvent{
+		Type:     "session",
+		Time:     now.Unix(),
+		Session:  id,
+		Listener: listener,
+		Proto:    proto,
+		Tenant:   tenant,
+		User:     user,
+		Dest:     dest,
+		Start:    start.Unix(),
+		In:       in,
+		Out:      out,
+	}
+	if client != nil {
+		ev.Client = client.String()
+	}
+	e.emit(ev)
+}
+
+// The API key 'name' of 'tenant' went from 'before' to 'after' bytes of
+// 'quota'
+func (e *eventSink) quotaUsed(tenant, name string, before, after, quota int64) {
+	if e == nil || quota <= 0 {
+		return
+	}
+	for _, f := range e.quota {
+		t := int64(f * float64(quota))
+		if before < t && after >= t {
+			e.emit(&usageEvent{
+				Type:      "quota",
+				Time:      time.Now().Unix(),
+				Tenant:    tenant,
+				Key:       name,
+				Used:      after,
+				Quota:     quota,
+				Threshold: f,
+			})
+		}
+	}
+}
+
+// Deliver every interval until Stop; a failed delivery is retried
+// after a wait that doubles up to EVENTS_BACKOFF
+func (e *eventSink) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		wait := e.interval
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(wait):
+			}
+			if e.deliver() {
+				wait = e.interval
+			} else if wait *= 2; wait > EVENTS_BACKOFF {
+				wait = EVENTS_BACKOFF
+			}
+		}
+	}()
+}
+
+// Stop delivering; the queue gets one more try and what is left stays
+// in the spool
+func (e *eventSink) Stop() {
+	close(e.stop)
+	e.wg.Wait()
+	e.deliver()
+
+	e.Lock()
+	defer e.Unlock()
+	if n := len(e.q); n > 0 {
+		if e.wr != nil {
+			e.log.Warn("events: %d undelivered events kept in %s", n, e.spool)
+		} else {
+			e.log.Warn("events: %d undelivered events lost", n)
+		}
+	}
+	if e.fd != nil {
+		e.wr.Flush()
+		e.fd.Close()
+		e.fd = nil
+	}
+}
+
+// Send the queue in batches, oldest first; return false if a batch
+// failed. The spool is rewritten once without what was sent.
+func (e *eventSink) deliver() bool {
+	e.Lock()
+	if e.wr != nil {
+		e.wr.Flush()
+	}
+	e.Unlock()
+
+	sent := 0
+	defer func() {
+		e.Lock()
+		if sent > 0 && e.wr != nil {
+			if err := e.rewrite(); err != nil {
+				e.log.Warn("events: %s: %s", e.spool, err)
+			}
+		}
+		e.Unlock()
+	}()
+
+	for {
+		e.Lock()
+		n := len(e.q)
+		if n == 0 {
+			e.Unlock()
+			return true
+		}
+		if n > EVENTS_BATCH {
+			n = EVENTS_BATCH
+		}
+		batch := append([]*usageEvent(nil), e.q[:n]...)
+		e.Unlock()
+
+		if err := e.send(batch); err != nil {
+			atomic.AddUint64(&e.failed, 1)
+			e.log.Warn("events: can't deliver %d events: %s", len(batch), err)
+			return false
+		}
+		atomic.AddUint64(&e.sent, uint64(n))
+		sent += n
+
+		// a full queue drops events at its head while we send: cut
+		// up to the last event of the batch
+		e.Lock()
+		for i, ev := range e.q {
+			if i >= n {
+				break
+			}
+			if ev == batch[n-1] {
+				e.q = e.q[i+1:]
+				break
+			}
+		}
+		e.Unlock()
+	}
+}
+
+// Send 'batch' to the endpoint and the list
+func (e *eventSink) send(batch []*usageEvent) error {
+	if e.redis != nil {
+		args := []string{"RPUSH", e.list}
+		for _, ev := range batch {
+			b, _ := json.Marshal(ev)
+			args = append(args, string(b))
+		}
+		if _, err := e.redis.do(args...); err != nil {
+			return err
+		}
+	}
+	if len(e.url) == 0 {
+		return nil
+	}
+
+	b, _ := json.Marshal(batch)
+	r, err := http.NewRequest("POST", e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if len(e.secret) > 0 {
+		m := hmac.New(sha256.New, e.secret)
+		m.Write(b)
+		r.Header.Set("X-Goproxy-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	res, err := e.client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.url, res.Status)
+	}
+	return nil
+}
+
+func (e *eventSink) metrics() []metric {
+	e.Lock()
+	n := len(e.q)
+	e.Unlock()
+	return []metric{
+		{"goproxy_events_sent_total", "counter", "Usage events delivered", "",
+			float64(atomic.LoadUint64(&e.sent))},
+		{"goproxy_events_failures_total", "counter", "Usage event deliveries that failed", "",
+			float64(atomic.LoadUint64(&e.failed))},
+		{"goproxy_events_dropped_total", "counter", "Usage events dropped from a full queue", "",
+			float64(atomic.LoadUint64(&e.dropped))},
+		{"goproxy_events_queued", "gauge", "Usage events waiting for delivery", "",
+			float64(n)},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
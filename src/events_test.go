@@ -0,0 +1,238 @@
+// events_test.go -- tests for the usage events
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// An endpoint that keeps the events it gets; it fails while 'fail' is set
+type eventsRecv struct {
+	sync.Mutex
+	fail bool
+	ev   []usageEvent
+	bad  int
+}
+
+func startEventsRecv(t *testing.T, secret string) (*eventsRecv, string) {
+	e := &eventsRecv{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(b)
+		e.Lock()
+		defer e.Unlock()
+		sig := r.Header.Get("X-Goproxy-Signature")
+		if (len(secret) == 0 && len(sig) > 0) ||
+			(len(secret) > 0 && sig != "sha256="+hex.EncodeToString(m.Sum(nil))) {
+			e.bad++
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if e.fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		var v []usageEvent
+		if err := json.Unmarshal(b, &v); err != nil {
+			e.bad++
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e.ev = append(e.ev, v...)
+	}))
+	t.Cleanup(srv.Close)
+	return e, srv.URL
+}
+
+func (e *eventsRecv) events() []usageEvent {
+	e.Lock()
+	defer e.Unlock()
+	return append([]usageEvent(nil), e.ev...)
+}
+
+func TestEvents(t *testing.T) {
+	recv, u := startEventsRecv(t, "s3cret")
+	recv.fail = true
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	spool := filepath.Join(t.TempDir(), "events.spool")
+	ec := &EventsConf{URL: u, Secret: "s3cret", Spool: spool, Node: "n1"}
+
+	e, err := newEventSink(ec, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = e
+	defer func() { events = nil }()
+
+	// a session, and a key crossing 80% and then 100% of its quota
+	now := time.Now()
+	e.session("abc", "127.0.0.1:3128", "connect", "", "alice", net.ParseIP("10.0.0.1"),
+		"example.com:443", now.Add(-time.Minute), 100, 2000, now)
+	k := newTestKeys(t, filepath.Join(t.TempDir(), "keys.json"))
+	defer k.Close()
+	k.create(&apiKey{Name: "web", Quota: 1000})
+	k.Stop(&Session{User: "web", in: 500, out: 100})
+	k.Stop(&Session{User: "web", in: 250})
+	k.Stop(&Session{User: "web", in: 200})
+	k.Stop(&Session{User: "web", in: 200})
+
+	if e.deliver() {
+		t.Fatalf("delivered to a failing endpoint")
+	}
+	e.Stop()
+
+	// a restart: the spool has them
+	recv.Lock()
+	recv.fail = false
+	recv.Unlock()
+	e, err = newEventSink(ec, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.q) < 3 {
+		t.Fatalf("%d events after a restart", len(e.q))
+	}
+	if !e.deliver() {
+		t.Fatalf("not delivered")
+	}
+	e.Stop()
+
+	// tunnels of other tests may end while events is set
+	var got []usageEvent
+	for _, ev := range recv.events() {
+		if ev.Session == "abc" || ev.Type == "quota" {
+			got = append(got, ev)
+		}
+	}
+	if len(got) != 3 || recv.bad != 0 {
+		t.Fatalf("got %+v; %d bad", got, recv.bad)
+	}
+	s := got[0]
+	if s.Type != "session" || s.Session != "abc" || s.User != "alice" || s.Client != "10.0.0.1" ||
+		s.In != 100 || s.Out != 2000 || s.Node != "n1" || len(s.ID) == 0 {
+		t.Errorf("session: %+v", s)
+	}
+	for i, f := range []float64{0.8, 1} {
+		q := got[i+1]
+		if q.Type != "quota" || q.Key != "web" || q.Quota != 1000 || q.Threshold != f {
+			t.Errorf("quota %g: %+v", f, q)
+		}
+	}
+	if got[1].Used != 850 || got[2].Used != 1050 {
+		t.Errorf("used: %d %d", got[1].Used, got[2].Used)
+	}
+	if b, _ := os.ReadFile(spool); len(b) != 0 {
+		t.Errorf("spool: %q", b)
+	}
+}
+
+func TestEventsProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+	echo := startEcho(t)
+
+	recv, u := startEventsRecv(t, "")
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	e, err := newEventSink(&EventsConf{URL: u}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = e
+	defer func() { events = nil }()
+
+	addr := startHTTPProxy(t, &ListenConf{})
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	res, err := hc.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	c, br := connectTunnel(t, addr, echo.Addr().String(), "", "")
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	io.ReadFull(br, b)
+	c.Close()
+
+	var got []usageEvent
+	for i := 0; i < 50 && len(got) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		e.deliver()
+		got = recv.events()
+	}
+	protos := map[string]usageEvent{}
+	for _, ev := range got {
+		protos[ev.Proto] = ev
+	}
+	if h := protos["http"]; h.Out != 6 || h.Listener != "127.0.0.1:0" || h.Dest != origin.Listener.Addr().String() {
+		t.Errorf("http: %+v", h)
+	}
+	if c := protos["connect"]; c.In != 4 || c.Out != 4 || c.Dest != echo.Addr().String() {
+		t.Errorf("connect: %+v", c)
+	}
+}
+
+func TestEventsRedis(t *testing.T) {
+	addr := startRedis(t, "")
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	e, err := newEventSink(&EventsConf{Redis: "redis://" + addr}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < EVENTS_BATCH+5; i++ {
+		e.session("x", "l", "socks", "", "", nil, "d:1", time.Now(), 1, 1, time.Now())
+	}
+	if !e.deliver() || len(e.q) != 0 {
+		t.Fatalf("not delivered: %d queued", len(e.q))
+	}
+	if n, err := e.redis.do("LLEN", EVENTS_LIST); err != nil || n != int64(EVENTS_BATCH+5) {
+		t.Errorf("list: %v %v", n, err)
+	}
+}
+
+func TestEventsConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if e, err := newEventSink(&EventsConf{}, log); e != nil || err != nil {
+		t.Errorf("off: %v %v", e, err)
+	}
+	for _, ec := range []EventsConf{
+		{URL: "ftp://x"},
+		{Redis: "http://x"},
+		{URL: "http://x", Interval: -1},
+		{URL: "http://x", Quota: []float64{1.5}},
+		{URL: "http://x", Spool: "/nonexistent/dir/spool"},
+	} {
+		if _, err := newEventSink(&ec, log); err == nil {
+			t.Errorf("%+v: no error", ec)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
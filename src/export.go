@@ -0,0 +1,334 @@
+// export.go -- usage aggregates written out for billing and capacity planning
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Every interval the bytes and sessions since the last export are
+// written as one CSV file of rows by day, user and destination: to a
+// directory, a bucket or both. The files hold deltas; a pipeline sums
+// them. The last one is written on shutdown.
+
+const (
+	// Default seconds between exports
+	EXPORT_INTERVAL = 3600
+
+	// Most rows of an export; the rest are counted to destination
+	// TALKERS_OTHER of their user
+	EXPORT_KEYS = 100000
+
+	// Files kept for the bucket while it can't be reached
+	EXPORT_PENDING = 24
+
+	// Time an upload may take
+	EXPORT_TIMEOUT = 60 * time.Second
+)
+
+// The usage exporter; nil if there is none
+var exports *usageExporter
+
+type usageKey struct {
+	day    string // UTC, YYYY-MM-DD
+	tenant string
+	user   string
+	dest   string // host
+}
+
+type usageTally struct {
+	sessions int64
+	bytes    int64
+}
+
+// A written export the bucket doesn't have yet
+type exportFile struct {
+	name string
+	t    time.Time
+	body []byte
+}
+
+type usageExporter struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	files    uint64
+	uploads  uint64
+	failed   uint64
+	dropped  uint64
+	lastRows uint64
+
+	interval time.Duration
+	dir      string
+	gzip     bool
+	node     string
+	bucket   *s3Bucket
+	log      *L.Logger
+
+	sync.Mutex
+	m       map[usageKey]*usageTally
+	pending []exportFile
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Make the exporter of 'ec'; nil if it has neither a directory nor a
+// bucket
+func newUsageExporter(ec *ExportConf, log *L.Logger) (*usageExporter, error) {
+	b, err := newS3Bucket(&ec.S3, EXPORT_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("export: %w", err)
+	}
+	if len(ec.Dir) == 0 && b == nil {
+		return nil, nil
+	}
+	if len(ec.Dir) > 0 {
+		if fi, err := os.Stat(ec.Dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("export: %s isn't a directory", ec.Dir)
+		}
+	}
+
+	u := &usageExporter{
+		interval: time.Duration(ec.Interval) * time.Second,
+		dir:      ec.Dir,
+		gzip:     ec.Gzip,
+		node:     ec.Node,
+		bucket:   b,
+		log:      log,
+		m:        make(map[usageKey]*usageTally),
+		stop:     make(chan struct{}),
+	}
+	switch {
+	case ec.Interval < 0:
+		return nil, fmt.Errorf("export: negative interval %d", ec.Interval)
+	case ec.Interval == 0:
+		u.interval = EXPORT_INTERVAL * time.Second
+	}
+	if len(u.node) == 0 {
+		u.node, _ = os.Hostname()
+	}
+	return u, nil
+}
+
+// Count 'bytes' and 'sessions' of 'user' of 'tenant' to 'dest' (host or
+// host:port) at 'now'
+func (u *usageExporter) add(tenant, user, dest string, bytes, sessions int64, now time.Time) {
+	if u == nil || (bytes == 0 && sessions == 0) {
+		return
+	}
+	if h, _, err := net.SplitHostPort(dest); err == nil {
+		dest = h
+	}
+	k := usageKey{day: now.UTC().Format("2006-01-02"), tenant: tenant, user: user, dest: dest}
+
+	u.Lock()
+	t, ok := u.m[k]
+	if !ok {
+		if len(u.m) >= EXPORT_KEYS {
+			k.dest = TALKERS_OTHER
+			t, ok = u.m[k]
+		}
+		if !ok {
+			t = &usageTally{}
+			u.m[k] = t
+		}
+	}
+	t.bytes += bytes
+	t.sessions += sessions
+	u.Unlock()
+}
+
+// Export every interval until Stop
+func (u *usageExporter) Start() {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		t := time.NewTicker(u.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case now := <-t.C:
+				u.export(now)
+			}
+		}
+	}()
+}
+
+// Stop exporting; the usage since the last export is written out
+func (u *usageExporter) Stop() {
+	close(u.stop)
+	u.wg.Wait()
+	u.export(time.Now())
+}
+
+// Write the usage since the last export, then send the bucket what it
+// doesn't have
+func (u *usageExporter) export(now time.Time) {
+	u.Lock()
+	m := u.m
+	u.m = make(map[usageKey]*usageTally)
+	u.Unlock()
+
+	if len(m) > 0 {
+		f, err := u.write(m, now)
+		if err != nil {
+			u.log.Warn("export: %s", err)
+		} else {
+			atomic.AddUint64(&u.files, 1)
+			atomic.StoreUint64(&u.lastRows, uint64(len(m)))
+			if u.bucket != nil {
+				u.Lock()
+				u.pending = append(u.pending, f)
+				if n := len(u.pending) - EXPORT_PENDING; n > 0 {
+					u.log.Warn("export: dropped %d files the bucket didn't take", n)
+					atomic.AddUint64(&u.dropped, uint64(n))
+					u.pending = u.pending[n:]
+				}
+				u.Unlock()
+			}
+		}
+	}
+	u.upload()
+}
+
+// Return the CSV file of 'm', written to the directory if there is one
+func (u *usageExporter) write(m map[usageKey]*usageTally, now time.Time) (exportFile, error) {
+	keys := make([]usageKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.day != b.day {
+			return a.day < b.day
+		}
+		if a.tenant != b.tenant {
+			return a.tenant < b.tenant
+		}
+		if a.user != b.user {
+			return a.user < b.user
+		}
+		return a.dest < b.dest
+	})
+
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	var w *csv.Writer
+	if u.gzip {
+		gz = gzip.NewWriter(&buf)
+		w = csv.NewWriter(gz)
+	} else {
+		w = csv.NewWriter(&buf)
+	}
+	w.Write([]string{"day", "node", "tenant", "user", "dest", "sessions", "bytes"})
+	for _, k := range keys {
+		t := m[k]
+		w.Write([]string{k.day, u.node, k.tenant, k.user, k.dest,
+			strconv.FormatInt(t.sessions, 10), strconv.FormatInt(t.bytes, 10)})
+	}
+	w.Flush()
+	if gz != nil {
+		gz.Close()
+	}
+
+	f := exportFile{
+		name: fmt.Sprintf("usage-%s-%s.csv", u.node, now.UTC().Format("20060102T150405Z")),
+		t:    now.UTC(),
+		body: buf.Bytes(),
+	}
+	if u.gzip {
+		f.name += ".gz"
+	}
+	if len(u.dir) == 0 {
+		return f, nil
+	}
+
+	fn := filepath.Join(u.dir, f.name)
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, f.body, 0640); err != nil {
+		return f, err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return f, err
+	}
+	return f, nil
+}
+
+// Send the pending files to the bucket, oldest first; stop at the first
+// that fails
+func (u *usageExporter) upload() {
+	if u.bucket == nil {
+		return
+	}
+	typ := "text/csv"
+	if u.gzip {
+		typ = "application/gzip"
+	}
+	for {
+		u.Lock()
+		if len(u.pending) == 0 {
+			u.Unlock()
+			return
+		}
+		f := u.pending[0]
+		u.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), EXPORT_TIMEOUT)
+		err := u.bucket.put(ctx, f.t.Format("2006/01/02/")+f.name, typ, f.body)
+		cancel()
+		if err != nil {
+			atomic.AddUint64(&u.failed, 1)
+			u.log.Warn("export: %s", err)
+			return
+		}
+		atomic.AddUint64(&u.uploads, 1)
+
+		u.Lock()
+		u.pending = u.pending[1:]
+		u.Unlock()
+	}
+}
+
+func (u *usageExporter) metrics() []metric {
+	u.Lock()
+	n := len(u.pending)
+	u.Unlock()
+	return []metric{
+		{"goproxy_export_files_total", "counter", "Usage exports written", "",
+			float64(atomic.LoadUint64(&u.files))},
+		{"goproxy_export_rows", "gauge", "Rows of the last usage export", "",
+			float64(atomic.LoadUint64(&u.lastRows))},
+		{"goproxy_export_uploads_total", "counter", "Usage exports uploaded to the bucket", "",
+			float64(atomic.LoadUint64(&u.uploads))},
+		{"goproxy_export_upload_failures_total", "counter", "Usage export uploads that failed", "",
+			float64(atomic.LoadUint64(&u.failed))},
+		{"goproxy_export_dropped_total", "counter", "Usage exports the bucket never got", "",
+			float64(atomic.LoadUint64(&u.dropped))},
+		{"goproxy_export_pending", "gauge", "Usage exports waiting for the bucket", "",
+			float64(n)},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,364 @@
+// fair.go -- fair shares of a constrained uplink across users
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default bytes a user moves in its turn
+	FAIR_QUANTUM = 16384
+
+	// Milliseconds of the rate an idle uplink saves up
+	FAIR_BURST = 50
+)
+
+var errFairRaw = errors.New("fair: no raw access to a paced connection")
+
+// The fair queue of the process; nil if the uplink isn't shared out
+var fairShare *fairQueue
+
+// Paces the tunnels of the host to a rate and shares it out by deficit
+// round robin: each user with bytes to move gets a quantum in its turn,
+// however many tunnels it has. A user alone has all of the rate; none
+// gets more than its share while others wait.
+type fairQueue struct {
+	byClient bool
+	quantum  int
+	up       *fairSched // to the destinations
+	down     *fairSched // from them
+}
+
+// The scheduler of one direction
+type fairSched struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	bytes uint64
+
+	rate    float64 // bytes/sec
+	burst   float64
+	quantum int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	flows  map[string]*fairFlow
+	ring   []*fairFlow // flows with bytes to move (or just served), in turn order
+	closed bool
+}
+
+// The tunnels of a user in one direction
+type fairFlow struct {
+	key     string
+	refs    int // tunnels
+	deficit int
+	reqs    []*fairReq
+	queued  bool // in the ring
+}
+
+// A read or write waiting for its turn
+type fairReq struct {
+	n    int
+	done chan struct{}
+}
+
+// Start the fair queue of 'fc'; return nil if the uplink isn't shared
+func newFairQueue(fc *FairConf) (*fairQueue, error) {
+	if fc.Rate == 0 {
+		return nil, nil
+	}
+	if fc.Rate < 0 || fc.Quantum < 0 {
+		return nil, fmt.Errorf("fair: rate %d and quantum %d must be positive", fc.Rate, fc.Quantum)
+	}
+
+	q := &fairQueue{quantum: fc.Quantum}
+	if q.quantum == 0 {
+		q.quantum = FAIR_QUANTUM
+	}
+	switch strings.ToLower(fc.By) {
+	case "", "user":
+	case "client":
+		q.byClient = true
+	default:
+		return nil, fmt.Errorf("fair: unknown by %q", fc.By)
+	}
+
+	q.up = newFairSched(fc.Rate, q.quantum)
+	q.down = newFairSched(fc.Rate, q.quantum)
+	return q, nil
+}
+
+func newFairSched(rate, quantum int) *fairSched {
+	s := &fairSched{
+		rate:    float64(rate),
+		burst:   float64(rate) * FAIR_BURST / 1000,
+		quantum: quantum,
+		flows:   make(map[string]*fairFlow),
+	}
+	if s.burst < float64(quantum) {
+		s.burst = float64(quantum)
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Return 'c' paced by the fair queue; tunnels of the same user (or
+// client) share a flow
+func (q *fairQueue) wrap(ctx context.Context, c net.Conn) net.Conn {
+	tc, ok := c.(tcpConn)
+	if q == nil || !ok {
+		return c
+	}
+
+	key := anomalyKeyOf(userOf(ctx), clientOf(ctx))
+	if q.byClient {
+		key = anomalyKeyOf("", clientOf(ctx))
+	}
+	return &fairConn{
+		tcpConn: tc,
+		q:       q,
+		up:      q.up.open(key),
+		down:    q.down.open(key),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Stop the schedulers; waiting tunnels go on unpaced
+func (q *fairQueue) Close() error {
+	q.up.close()
+	q.down.close()
+	return nil
+}
+
+// Return the flow of 'key', with one more tunnel
+func (s *fairSched) open(key string) *fairFlow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.flows[key]
+	if !ok {
+		f = &fairFlow{key: key}
+		s.flows[key] = f
+	}
+	f.refs++
+	return f
+}
+
+// Drop a tunnel of 'f'; the flow goes with the last one
+func (s *fairSched) release(f *fairFlow) {
+	s.mu.Lock()
+	f.refs--
+	if f.refs == 0 && !f.queued {
+		delete(s.flows, f.key)
+	}
+	s.mu.Unlock()
+}
+
+// Wait for the turn of 'f' to move 'n' bytes (at most a quantum) or for
+// 'done' to close
+func (s *fairSched) wait(f *fairFlow, n int, done <-chan struct{}) error {
+	r := &fairReq{n: n, done: make(chan struct{})}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	f.reqs = append(f.reqs, r)
+	if !f.queued {
+		f.queued = true
+		s.ring = append(s.ring, f)
+		s.cond.Signal()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-done:
+	}
+
+	s.mu.Lock()
+	for i, x := range f.reqs {
+		if x == r {
+			f.reqs = append(f.reqs[:i], f.reqs[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	return net.ErrClosed
+}
+
+// Serve the flows in turn: each gets a quantum more to move, and their
+// bytes go out no faster than the rate allows
+func (s *fairSched) run() {
+	tokens := s.burst
+	last := time.Now()
+	for {
+		s.mu.Lock()
+		for len(s.ring) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			for _, f := range s.ring {
+				for _, r := range f.reqs {
+					close(r.done)
+				}
+				f.reqs = nil
+			}
+			s.ring = nil
+			s.mu.Unlock()
+			return
+		}
+
+		f := s.ring[0]
+		s.ring[0] = nil
+		s.ring = s.ring[1:]
+		f.deficit += s.quantum
+
+		var v []*fairReq
+		var n int
+		for len(f.reqs) > 0 && f.reqs[0].n <= f.deficit {
+			r := f.reqs[0]
+			f.reqs = f.reqs[1:]
+			f.deficit -= r.n
+			n += r.n
+			v = append(v, r)
+		}
+		// a flow keeps its place for a turn after it is served, while
+		// its tunnels come back for more
+		if len(f.reqs) == 0 {
+			f.deficit = 0
+		}
+		if len(f.reqs) > 0 || len(v) > 0 {
+			s.ring = append(s.ring, f)
+		} else {
+			f.queued = false
+			if f.refs == 0 {
+				delete(s.flows, f.key)
+			}
+		}
+		s.mu.Unlock()
+
+		now := time.Now()
+		tokens += now.Sub(last).Seconds() * s.rate
+		last = now
+		if tokens > s.burst {
+			tokens = s.burst
+		}
+		tokens -= float64(n)
+		if tokens < 0 {
+			time.Sleep(time.Duration(-tokens / s.rate * float64(time.Second)))
+		}
+
+		for _, r := range v {
+			close(r.done)
+		}
+		atomic.AddUint64(&s.bytes, uint64(n))
+	}
+}
+
+func (s *fairSched) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// A tunnel's connection to its destination, paced by the fair queue.
+// It has no raw access, so the copier relays it through buffers; splice
+// and the sockmap would skip the queue.
+type fairConn struct {
+	tcpConn
+	q        *fairQueue
+	up, down *fairFlow
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Read from the destination and wait for the user's turn to pass it on
+func (c *fairConn) Read(b []byte) (int, error) {
+	if len(b) > c.q.quantum {
+		b = b[:c.q.quantum]
+	}
+	n, err := c.tcpConn.Read(b)
+	if n > 0 {
+		if werr := c.q.down.wait(c.down, n, c.closed); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+// Write to the destination a quantum at a time, each in the user's turn
+func (c *fairConn) Write(b []byte) (int, error) {
+	var nw int
+	for len(b) > 0 {
+		p := b
+		if len(p) > c.q.quantum {
+			p = p[:c.q.quantum]
+		}
+		if err := c.q.up.wait(c.up, len(p), c.closed); err != nil {
+			return nw, err
+		}
+		n, err := c.tcpConn.Write(p)
+		nw += n
+		if err != nil {
+			return nw, err
+		}
+		b = b[n:]
+	}
+	return nw, nil
+}
+
+func (c *fairConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errFairRaw
+}
+
+func (c *fairConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.q.up.release(c.up)
+		c.q.down.release(c.down)
+	})
+	return c.tcpConn.Close()
+}
+
+// Fair queue metrics for the admin listener
+func (q *fairQueue) metrics() []metric {
+	var v []metric
+	for _, d := range []struct {
+		dir string
+		s   *fairSched
+	}{{"up", q.up}, {"down", q.down}} {
+		l := fmt.Sprintf("dir=%q", d.dir)
+		d.s.mu.Lock()
+		flows, waiting := len(d.s.flows), len(d.s.ring)
+		d.s.mu.Unlock()
+		v = append(v,
+			metric{"goproxy_fair_bytes_total", "counter", "Bytes paced by the fair queue",
+				l, float64(atomic.LoadUint64(&d.s.bytes))},
+			metric{"goproxy_fair_flows", "gauge", "Users with tunnels in the fair queue",
+				l, float64(flows)},
+			metric{"goproxy_fair_waiting", "gauge", "Users waiting for their turn",
+				l, float64(waiting)})
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
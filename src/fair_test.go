@@ -0,0 +1,181 @@
+// fair_test.go -- tests for the fair queue
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Move quanta for 'd' from 'conns' goroutines of each flow at once;
+// return the bytes of each
+func fairRun(s *fairSched, d time.Duration, conns ...int) []int {
+	got := make([]int, len(conns))
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, n := range conns {
+		f := s.open(string(rune('a' + i)))
+		for j := 0; j < n; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for s.wait(f, s.quantum, stop) == nil {
+					mu.Lock()
+					got[i] += s.quantum
+					mu.Unlock()
+				}
+			}(i)
+		}
+	}
+	time.Sleep(d)
+	close(stop)
+	wg.Wait()
+	return got
+}
+
+func TestFairQueue(t *testing.T) {
+	const rate = 1 << 20
+	q, err := newFairQueue(&FairConf{Rate: rate, Quantum: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// a user with many tunnels gets no more than one with a single one
+	d := 400 * time.Millisecond
+	got := fairRun(q.up, d, 4, 1, 1)
+	total := got[0] + got[1] + got[2]
+	for i, n := range got {
+		if n < total/4 || n > total/2 {
+			t.Errorf("flow %d: %d of %d", i, n, total)
+		}
+	}
+	if max := int(rate*d.Seconds()) + int(q.up.burst) + 8*4096; total > max || total < max/3 {
+		t.Errorf("total: %d bytes in %s", total, d)
+	}
+
+	// one alone has all of the rate
+	t0 := time.Now()
+	alone := fairRun(q.down, d, 1)[0]
+	if min := int(rate * time.Since(t0).Seconds() / 2); alone < min {
+		t.Errorf("alone: %d bytes in %s", alone, d)
+	}
+	q.up.mu.Lock()
+	if len(q.up.flows) != 3 || len(q.up.ring) > 0 {
+		t.Errorf("flows %d, waiting %d", len(q.up.flows), len(q.up.ring))
+	}
+	q.up.mu.Unlock()
+
+	for _, bad := range []FairConf{
+		{Rate: -1},
+		{Rate: 1000, Quantum: -1},
+		{Rate: 1000, By: "host"},
+	} {
+		if _, err := newFairQueue(&bad); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+	if q, err := newFairQueue(&FairConf{}); q != nil || err != nil {
+		t.Errorf("off: %v %v", q, err)
+	}
+}
+
+func TestFairConn(t *testing.T) {
+	const rate = 256 << 10
+	q, err := newFairQueue(&FairConf{Rate: rate, Quantum: 8192, By: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	ctx := withClient(withUser(context.Background(), "alice"), net.ParseIP("192.0.2.1"))
+	dial := func() *fairConn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.wrap(ctx, c).(*fairConn)
+	}
+
+	c := dial()
+	if c.up.key != "client 192.0.2.1" {
+		t.Errorf("key %q", c.up.key)
+	}
+	if _, err := c.SyscallConn(); err != errFairRaw {
+		t.Errorf("raw: %v", err)
+	}
+
+	t0 := time.Now()
+	if n, err := c.Write(make([]byte, 128<<10)); err != nil || n != 128<<10 {
+		t.Errorf("write: %d %v", n, err)
+	}
+	if d := time.Since(t0); d < 300*time.Millisecond {
+		t.Errorf("unpaced: 128k in %s", d)
+	}
+
+	// a write waiting for its turn ends with the connection
+	c2 := dial()
+	if c2.up != c.up {
+		t.Errorf("not shared")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c2.Close()
+	}()
+	if _, err := c2.Write(make([]byte, 1<<20)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("closed: %v", err)
+	}
+	c.Close()
+
+	flows := func() int {
+		q.up.mu.Lock()
+		defer q.up.mu.Unlock()
+		return len(q.up.flows)
+	}
+	n := flows()
+	for i := 0; i < 100 && n > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = flows()
+	}
+	if n > 0 {
+		t.Errorf("%d flows left", n)
+	}
+
+	var nq *fairQueue
+	if x := nq.wrap(ctx, c); x != net.Conn(c) {
+		t.Errorf("off: wrapped")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,383 @@
+// filter.go -- content filter hooks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Content filters see every request (and HTTP response) of a listener
+// and can veto, modify or annotate it. A filter is compiled in: its file
+// registers a FilterFactory in init() and listeners name it in their
+// "filters" list. See filter_builtin.go for examples.
+
+var errFiltered = newError(ErrDestDenied, "denied by filter")
+
+// What a filter decides
+type FilterAction int
+
+const (
+	FILTER_PASS  FilterAction = iota // no decision; ask the next filter
+	FILTER_ALLOW                     // allow; skip the remaining filters
+	FILTER_DENY                      // refuse the request or response
+)
+
+// A filter's decision
+type Verdict struct {
+	Action FilterAction
+
+	// HTTP status of a denial; default 403
+	Status int
+
+	// Why; logged and sent to HTTP clients
+	Reason string
+}
+
+// A request as filters see it. Filters may change Header and Body.
+type FilterRequest struct {
+	Client net.IP
+	User   string // authenticated user; "" if none
+	Proto  string // "http", "ftp", "connect" or "socks"
+	Dest   string // host:port
+
+	// HTTP only
+	Method string
+	URL    *url.URL
+	Header http.Header
+
+	// The request body if the listener gives filters bodies and it fits
+	// in filterbody bytes; else nil. Setting it replaces the body.
+	Body []byte
+
+	mu    sync.Mutex
+	notes []string
+}
+
+// A response as filters see it. Filters may change all of it.
+type FilterResponse struct {
+	Status int
+	Header http.Header
+
+	// The decoded body if it fits in filterbody bytes; else nil. Setting
+	// it replaces the body the client gets.
+	Body []byte
+}
+
+// Add a note to the logs of request 'r'
+func (r *FilterRequest) Annotate(key, val string) {
+	r.mu.Lock()
+	r.notes = append(r.notes, fmt.Sprintf("%s=%s", key, val))
+	r.mu.Unlock()
+}
+
+// Return the notes of 'r' as one string
+func (r *FilterRequest) Notes() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.notes, " ")
+}
+
+// A content filter. Its methods are called concurrently for different
+// requests.
+type Filter interface {
+	// Called before the request is sent on
+	Request(r *FilterRequest) Verdict
+
+	// Called with an HTTP response before it goes to the client
+	Response(r *FilterRequest, res *FilterResponse) Verdict
+}
+
+// Make a filter from its config args
+type FilterFactory func(args map[string]string) (Filter, error)
+
+var filterTypes = struct {
+	sync.Mutex
+	m map[string]FilterFactory
+}{m: make(map[string]FilterFactory)}
+
+// Make the filter type 'name' available to the config file
+func RegisterFilter(name string, f FilterFactory) {
+	filterTypes.Lock()
+	defer filterTypes.Unlock()
+
+	if _, ok := filterTypes.m[name]; ok {
+		panic("filter " + name + " registered twice")
+	}
+	filterTypes.m[name] = f
+}
+
+// Return the registered filter types
+func filterNames() []string {
+	filterTypes.Lock()
+	defer filterTypes.Unlock()
+
+	v := make([]string, 0, len(filterTypes.m))
+	for k := range filterTypes.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+type namedFilter struct {
+	Filter
+	name    string
+	logonly bool
+}
+
+// The filters of a listener, in order
+type filterChain struct {
+	v        []namedFilter
+	bodySize int64
+}
+
+// Return the filters of 'lc' or nil if it has none
+func newFilterChain(lc *ListenConf) (*filterChain, error) {
+	if len(lc.Filters) == 0 {
+		return nil, nil
+	}
+
+	fc := &filterChain{bodySize: lc.FilterBody}
+	for i := range lc.Filters {
+		c := &lc.Filters[i]
+
+		filterTypes.Lock()
+		mk, ok := filterTypes.m[c.Type]
+		filterTypes.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("filter %d: unknown type %q (have %s)", i+1, c.Type,
+				strings.Join(filterNames(), ", "))
+		}
+
+		f, err := mk(c.Args)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %s", c.Type, err)
+		}
+
+		nm := c.Name
+		if len(nm) == 0 {
+			nm = c.Type
+		}
+		fc.v = append(fc.v, namedFilter{f, nm, c.LogOnly || lc.LogOnly})
+	}
+	return fc, nil
+}
+
+// Run the filters on request 'r'; return the verdict and the filter
+// that made it.
+func (fc *filterChain) request(r *FilterRequest) (Verdict, string) {
+	for _, f := range fc.v {
+		v := fc.call(f, func() Verdict { return f.Request(r) })
+		if v.Action == FILTER_DENY && f.logonly {
+			r.Annotate("logonly", f.name)
+			continue
+		}
+		if v.Action != FILTER_PASS {
+			return v, f.name
+		}
+	}
+	return Verdict{}, ""
+}
+
+// Run the filters on response 'res' to 'r'
+func (fc *filterChain) response(r *FilterRequest, res *FilterResponse) (Verdict, string) {
+	for _, f := range fc.v {
+		v := fc.call(f, func() Verdict { return f.Response(r, res) })
+		if v.Action == FILTER_DENY && f.logonly {
+			r.Annotate("logonly", f.name)
+			continue
+		}
+		if v.Action != FILTER_PASS {
+			return v, f.name
+		}
+	}
+	return Verdict{}, ""
+}
+
+// Call a filter method; a filter that panics denies the request - the
+// filters may be all that keeps it from going through.
+func (fc *filterChain) call(f namedFilter, fn func() Verdict) (v Verdict) {
+	defer func() {
+		if x := recover(); x != nil {
+			v = Verdict{
+				Action: FILTER_DENY,
+				Status: http.StatusInternalServerError,
+				Reason: fmt.Sprintf("filter failed: %v", x),
+			}
+		}
+	}()
+
+	v = fn()
+	if v.Action == FILTER_DENY && v.Status == 0 {
+		v.Status = http.StatusForbidden
+	}
+	return v
+}
+
+// Read up to 'max' bytes of 'rc'. If that is all of it, return the
+// bytes; else return nil and a reader of the whole body.
+func peekBody(rc io.ReadCloser, max int64) ([]byte, io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, rc, err
+	}
+
+	if int64(len(b)) <= max {
+		rc.Close()
+		return b, ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	return nil, &readCloser{io.MultiReader(bytes.NewReader(b), rc), rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Return a context that carries the filtered request 'fr'
+func withFilter(ctx context.Context, fr *FilterRequest) context.Context {
+	return context.WithValue(ctx, ctxFilter, fr)
+}
+
+// Return the filter notes of the request with ctx
+func filterNotes(ctx context.Context) string {
+	if fr, ok := ctx.Value(ctxFilter).(*FilterRequest); ok {
+		return fr.Notes()
+	}
+	return ""
+}
+
+// Run the filters on HTTP request 'r'. Return the request to go on with
+// and true; or false if it was denied and answered.
+func (p *HTTPProxy) filterRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	log := logOf(r.Context(), p.log)
+	fc := p.filters
+
+	proto := "http"
+	dest := extractHost(r.URL)
+	switch {
+	case r.Method == "CONNECT":
+		proto = "connect"
+	case r.URL.Scheme == "ftp":
+		proto = "ftp"
+		if len(r.URL.Port()) == 0 {
+			dest = net.JoinHostPort(r.URL.Hostname(), "21")
+		}
+	}
+
+	fr := &FilterRequest{
+		Client: clientOf(r.Context()),
+		User:   userOf(r.Context()),
+		Proto:  proto,
+		Dest:   dest,
+		Method: r.Method,
+		URL:    r.URL,
+		Header: r.Header,
+	}
+
+	var body []byte
+	if fc.bodySize > 0 && r.Body != nil && r.ContentLength != 0 && r.ContentLength <= fc.bodySize {
+		b, rc, err := peekBody(p.cp.body(w, r, log), fc.bodySize)
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				log.Info("%s: rejected %s %.64q: request body exceeds %d bytes",
+					r.RemoteAddr, r.Method, r.RequestURI, mbe.Limit)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return r, false
+			}
+			log.Debug("%s: can't read request body: %s", r.RemoteAddr, err)
+			http.Error(w, "Can't read request body", http.StatusBadRequest)
+			return r, false
+		}
+		r.Body = rc
+		body, fr.Body = b, b
+	}
+
+	v, name := fc.request(fr)
+	if v.Action == FILTER_DENY {
+		log.Info("%s: %s %.64q denied by filter %s: %s", r.RemoteAddr, r.Method, r.RequestURI,
+			name, v.Reason)
+		p.httpError(w, r, v.Reason, v.Status, "")
+		return r, false
+	}
+
+	if len(fr.Body) != len(body) || !bytes.Equal(fr.Body, body) {
+		r.Body = ioutil.NopCloser(bytes.NewReader(fr.Body))
+		r.ContentLength = int64(len(fr.Body))
+		r.Header.Del("Content-Encoding")
+	}
+
+	return r.WithContext(withFilter(r.Context(), fr)), true
+}
+
+// Run the filters on response 'res' to 'r'. Return false if it was
+// denied and answered.
+func (p *HTTPProxy) filterResponse(w http.ResponseWriter, r *http.Request, res *http.Response) bool {
+	log := logOf(r.Context(), p.log)
+	fc := p.filters
+	fr, ok := r.Context().Value(ctxFilter).(*FilterRequest)
+	if !ok {
+		return true
+	}
+
+	fs := &FilterResponse{
+		Status: res.StatusCode,
+		Header: res.Header,
+	}
+
+	// Filters get the decoded body; the client gets the original unless
+	// a filter changes it.
+	var body []byte
+	if fc.bodySize > 0 && r.Method != "HEAD" && res.ContentLength != 0 && res.ContentLength <= fc.bodySize {
+		raw, rc, err := peekBody(res.Body, fc.bodySize)
+		res.Body = rc
+		if err == nil && raw != nil {
+			if d, err := decodeBody(res.Header.Get("Content-Encoding"), bytes.NewReader(raw)); err == nil {
+				if b, err := ioutil.ReadAll(io.LimitReader(d, fc.bodySize+1)); err == nil &&
+					int64(len(b)) <= fc.bodySize {
+					body, fs.Body = b, b
+				}
+				d.Close()
+			}
+		}
+	}
+
+	v, name := fc.response(fr, fs)
+	if v.Action == FILTER_DENY {
+		res.Body.Close()
+		log.Info("%s: response to %s %.64q denied by filter %s: %s", r.RemoteAddr, r.Method,
+			r.RequestURI, name, v.Reason)
+		p.httpError(w, r, v.Reason, v.Status, "")
+		return false
+	}
+
+	res.StatusCode = fs.Status
+	if len(fs.Body) != len(body) || !bytes.Equal(fs.Body, body) {
+		res.Body = ioutil.NopCloser(bytes.NewReader(fs.Body))
+		res.ContentLength = int64(len(fs.Body))
+		res.Header.Del("Content-Encoding")
+		res.Header.Set("Content-Length", fmt.Sprintf("%d", len(fs.Body)))
+	}
+	return true
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
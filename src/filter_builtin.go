@@ -0,0 +1,307 @@
+// filter_builtin.go -- content filters that come with goproxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds between checks of a urlblock file for changes
+const URLBLOCK_CHECK = 30
+
+func init() {
+	RegisterFilter("urlblock", newURLBlock)
+	RegisterFilter("match", newMatchFilter)
+	RegisterFilter("header", newHeaderFilter)
+}
+
+// Denies destinations on a block list (e.g. a malware URL feed). The
+// file has one entry per line: a domain name (blocks it and its
+// subdomains) or a URL prefix (http://host/path). Blank lines and
+// lines starting with '#' are ignored. The file is read again when it
+// changes.
+type urlBlock struct {
+	file   string
+	reason string
+
+	sync.Mutex
+	domains  map[string]bool
+	prefixes []string
+	mtime    time.Time
+	checked  time.Time
+}
+
+func newURLBlock(args map[string]string) (Filter, error) {
+	u := &urlBlock{
+		file:   args["file"],
+		reason: args["reason"],
+	}
+	if len(u.file) == 0 {
+		return nil, fmt.Errorf("missing 'file'")
+	}
+	if len(u.reason) == 0 {
+		u.reason = "Destination is on a block list"
+	}
+
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Read the block list
+func (u *urlBlock) load() error {
+	fd, err := os.Open(u.file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	domains := make(map[string]bool)
+	var prefixes []string
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		if strings.Contains(s, "://") {
+			prefixes = append(prefixes, strings.ToLower(s))
+		} else {
+			domains[strings.Trim(strings.ToLower(s), ".")] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	u.Lock()
+	u.domains, u.prefixes, u.mtime = domains, prefixes, fi.ModTime()
+	u.Unlock()
+	return nil
+}
+
+// Reload the list if it changed; at most every URLBLOCK_CHECK seconds.
+// If the new list can't be read we keep the old one.
+func (u *urlBlock) refresh() {
+	u.Lock()
+	now := time.Now()
+	if now.Sub(u.checked) < URLBLOCK_CHECK*time.Second {
+		u.Unlock()
+		return
+	}
+	u.checked = now
+	mtime := u.mtime
+	u.Unlock()
+
+	if fi, err := os.Stat(u.file); err == nil && !fi.ModTime().Equal(mtime) {
+		u.load()
+	}
+}
+
+// Return true if 'host' or a parent domain is on the list
+func (u *urlBlock) blockedHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for len(host) > 0 {
+		if u.domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+func (u *urlBlock) Request(r *FilterRequest) Verdict {
+	u.refresh()
+
+	host, _, err := net.SplitHostPort(r.Dest)
+	if err != nil {
+		host = r.Dest
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	if u.blockedHost(host) {
+		return Verdict{Action: FILTER_DENY, Reason: u.reason}
+	}
+
+	if r.URL != nil && len(u.prefixes) > 0 {
+		s := strings.ToLower(r.URL.String())
+		for _, p := range u.prefixes {
+			if strings.HasPrefix(s, p) {
+				return Verdict{Action: FILTER_DENY, Reason: u.reason}
+			}
+		}
+	}
+	return Verdict{}
+}
+
+func (u *urlBlock) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	return Verdict{}
+}
+
+// Looks for a regular expression in the URL, request body or response
+// body (e.g. for DLP) and denies or annotates what matches. Bodies are
+// only seen within the listener's "filterbody" limit.
+type matchFilter struct {
+	re     *regexp.Regexp
+	in     string // "url", "request" or "response"
+	deny   bool
+	reason string
+	name   string
+}
+
+func newMatchFilter(args map[string]string) (Filter, error) {
+	p := args["pattern"]
+	if len(p) == 0 {
+		return nil, fmt.Errorf("missing 'pattern'")
+	}
+
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &matchFilter{
+		re:     re,
+		in:     args["in"],
+		reason: args["reason"],
+		name:   args["note"],
+	}
+
+	switch m.in {
+	case "":
+		m.in = "request"
+	case "url", "request", "response":
+	default:
+		return nil, fmt.Errorf("unknown 'in' %q", m.in)
+	}
+
+	switch args["action"] {
+	case "", "deny":
+		m.deny = true
+	case "note":
+	default:
+		return nil, fmt.Errorf("unknown action %q", args["action"])
+	}
+
+	if len(m.reason) == 0 {
+		m.reason = "Content not allowed"
+	}
+	if len(m.name) == 0 {
+		m.name = "match"
+	}
+	return m, nil
+}
+
+// Return our verdict on a match in request 'r'
+func (m *matchFilter) matched(r *FilterRequest) Verdict {
+	if m.deny {
+		return Verdict{Action: FILTER_DENY, Reason: m.reason}
+	}
+	r.Annotate(m.name, m.in)
+	return Verdict{}
+}
+
+func (m *matchFilter) Request(r *FilterRequest) Verdict {
+	switch m.in {
+	case "url":
+		if r.URL != nil && m.re.MatchString(r.URL.String()) {
+			return m.matched(r)
+		}
+	case "request":
+		if r.Body != nil && m.re.Match(r.Body) {
+			return m.matched(r)
+		}
+	}
+	return Verdict{}
+}
+
+func (m *matchFilter) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	if m.in == "response" && res.Body != nil && m.re.Match(res.Body) {
+		v := m.matched(r)
+		if v.Action == FILTER_DENY {
+			v.Status = http.StatusBadGateway
+		}
+		return v
+	}
+	return Verdict{}
+}
+
+// Sets and removes request headers. 'set' is a list of "Name: value"
+// separated by ';'; 'del' a comma separated list of names.
+type headerFilter struct {
+	set [][2]string
+	del []string
+}
+
+func newHeaderFilter(args map[string]string) (Filter, error) {
+	h := &headerFilter{}
+	if s := args["set"]; len(s) > 0 {
+		for _, kv := range strings.Split(s, ";") {
+			i := strings.IndexByte(kv, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid header %q", kv)
+			}
+			k := strings.TrimSpace(kv[:i])
+			v := strings.TrimSpace(kv[i+1:])
+			h.set = append(h.set, [2]string{k, v})
+		}
+	}
+	if s := args["del"]; len(s) > 0 {
+		for _, k := range strings.Split(s, ",") {
+			if k = strings.TrimSpace(k); len(k) > 0 {
+				h.del = append(h.del, k)
+			}
+		}
+	}
+	if len(h.set) == 0 && len(h.del) == 0 {
+		return nil, fmt.Errorf("nothing to 'set' or 'del'")
+	}
+	return h, nil
+}
+
+func (h *headerFilter) Request(r *FilterRequest) Verdict {
+	if r.Header == nil || r.Method == "CONNECT" {
+		return Verdict{}
+	}
+	for _, k := range h.del {
+		r.Header.Del(k)
+	}
+	for _, kv := range h.set {
+		r.Header.Set(kv[0], kv[1])
+	}
+	return Verdict{}
+}
+
+func (h *headerFilter) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	return Verdict{}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,344 @@
+// filter_test.go -- tests for the content filter hooks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// A filter that does what it's told
+type testFilter struct {
+	req, res Verdict
+	panics   bool
+	calls    int
+}
+
+func (f *testFilter) Request(r *FilterRequest) Verdict {
+	f.calls++
+	if f.panics {
+		panic("boom")
+	}
+	return f.req
+}
+
+func (f *testFilter) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	f.calls++
+	return f.res
+}
+
+func TestFilterChain(t *testing.T) {
+	pass := &testFilter{}
+	allow := &testFilter{req: Verdict{Action: FILTER_ALLOW}}
+	deny := &testFilter{req: Verdict{Action: FILTER_DENY, Reason: "no"}}
+	bad := &testFilter{panics: true}
+
+	fc := &filterChain{v: []namedFilter{{pass, "pass", false}, {allow, "allow", false}, {deny, "deny", false}}}
+	if v, name := fc.request(&FilterRequest{}); v.Action != FILTER_ALLOW || name != "allow" {
+		t.Errorf("allow: %v by %q", v, name)
+	}
+	if deny.calls != 0 {
+		t.Errorf("filter after an allow was called")
+	}
+
+	fc = &filterChain{v: []namedFilter{{pass, "pass", false}, {deny, "deny", false}}}
+	if v, name := fc.request(&FilterRequest{}); v.Action != FILTER_DENY || v.Status != http.StatusForbidden || name != "deny" {
+		t.Errorf("deny: %v by %q", v, name)
+	}
+
+	fc = &filterChain{v: []namedFilter{{pass, "pass", false}}}
+	if v, _ := fc.request(&FilterRequest{}); v.Action != FILTER_PASS {
+		t.Errorf("pass: %v", v)
+	}
+
+	// A filter that panics fails closed
+	fc = &filterChain{v: []namedFilter{{bad, "bad", false}, {allow, "allow", false}}}
+	if v, name := fc.request(&FilterRequest{}); v.Action != FILTER_DENY || v.Status != http.StatusInternalServerError || name != "bad" {
+		t.Errorf("panic: %v by %q", v, name)
+	}
+
+	// A filter that only logs notes what it would deny
+	fc = &filterChain{v: []namedFilter{{deny, "deny", true}, {pass, "pass", false}}}
+	fr := &FilterRequest{}
+	if v, _ := fc.request(fr); v.Action != FILTER_PASS || fr.Notes() != "logonly=deny" {
+		t.Errorf("logonly: %v; notes %q", v, fr.Notes())
+	}
+}
+
+func TestNewFilterChain(t *testing.T) {
+	if fc, err := newFilterChain(&ListenConf{}); fc != nil || err != nil {
+		t.Errorf("no filters: %v, %v", fc, err)
+	}
+
+	lc := &ListenConf{Filters: []FilterConf{{Type: "nonesuch"}}}
+	if _, err := newFilterChain(lc); err == nil {
+		t.Errorf("unknown filter type accepted")
+	}
+
+	lc = &ListenConf{Filters: []FilterConf{{Type: "match"}}}
+	if _, err := newFilterChain(lc); err == nil {
+		t.Errorf("filter with bad args accepted")
+	}
+
+	lc = &ListenConf{
+		Filters: []FilterConf{
+			{Type: "match", Args: map[string]string{"pattern": "x"}},
+			{Type: "match", Name: "second", Args: map[string]string{"pattern": "y"}},
+		},
+		FilterBody: 100,
+	}
+	fc, err := newFilterChain(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.v) != 2 || fc.v[0].name != "match" || fc.v[1].name != "second" || fc.bodySize != 100 {
+		t.Errorf("chain: %+v", fc)
+	}
+}
+
+func mustURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func TestURLBlock(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "block.txt")
+	list := "# malware\nbad.example\n\nhttp://cdn.example/evil/\n"
+	if err := ioutil.WriteFile(fn, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newURLBlock(map[string]string{"file": fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dest string
+		url  string
+		deny bool
+	}{
+		{"bad.example:443", "", true},
+		{"www.bad.example:80", "http://www.bad.example/", true},
+		{"BAD.example.:80", "", true},
+		{"notbad.example:80", "", false},
+		{"cdn.example:80", "http://cdn.example/evil/x.exe", true},
+		{"cdn.example:80", "http://cdn.example/good/x.js", false},
+		{"cdn.example:443", "", false},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, tt := range tests {
+			r := &FilterRequest{Dest: tt.dest}
+			if len(tt.url) > 0 {
+				r.URL = mustURL(tt.url)
+			}
+			if v := f.Request(r); (v.Action == FILTER_DENY) != tt.deny {
+				t.Errorf("%s %s: %v", tt.dest, tt.url, v)
+			}
+		}
+	}
+	check()
+
+	// A changed list is read again
+	u := f.(*urlBlock)
+	ioutil.WriteFile(fn, []byte("other.example\n"), 0600)
+	os.Chtimes(fn, time.Now(), time.Now().Add(time.Minute))
+	u.checked = time.Time{}
+
+	if v := f.Request(&FilterRequest{Dest: "bad.example:443"}); v.Action == FILTER_DENY {
+		t.Errorf("old list still in use")
+	}
+	if v := f.Request(&FilterRequest{Dest: "other.example:443"}); v.Action != FILTER_DENY {
+		t.Errorf("new list not in use")
+	}
+
+	if _, err := newURLBlock(map[string]string{}); err == nil {
+		t.Errorf("urlblock without a file")
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	ssn := map[string]string{"pattern": `\d{3}-\d{2}-\d{4}`}
+	f, err := newMatchFilter(ssn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := f.Request(&FilterRequest{Body: []byte("ssn=123-45-6789")}); v.Action != FILTER_DENY {
+		t.Errorf("request body not matched")
+	}
+	if v := f.Request(&FilterRequest{Body: []byte("nothing here")}); v.Action != FILTER_PASS {
+		t.Errorf("request body matched")
+	}
+
+	// Notes instead of denials
+	f, _ = newMatchFilter(map[string]string{"pattern": `\.exe$`, "in": "url", "action": "note", "note": "exe"})
+	r := &FilterRequest{URL: mustURL("http://example.com/setup.exe")}
+	if v := f.Request(r); v.Action != FILTER_PASS || r.Notes() != "exe=url" {
+		t.Errorf("note: %v %q", v, r.Notes())
+	}
+
+	f, _ = newMatchFilter(map[string]string{"pattern": "secret", "in": "response"})
+	v := f.Response(&FilterRequest{}, &FilterResponse{Body: []byte("top secret")})
+	if v.Action != FILTER_DENY || v.Status != http.StatusBadGateway {
+		t.Errorf("response: %v", v)
+	}
+
+	bad := []map[string]string{
+		{},
+		{"pattern": "("},
+		{"pattern": "x", "in": "cookie"},
+		{"pattern": "x", "action": "drop"},
+	}
+	for _, a := range bad {
+		if _, err := newMatchFilter(a); err == nil {
+			t.Errorf("%v accepted", a)
+		}
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	f, err := newHeaderFilter(map[string]string{"set": "X-Corp: yes; Via: goproxy", "del": "Cookie, X-Debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.Header{"Cookie": {"a=b"}, "X-Debug": {"1"}, "Accept": {"*/*"}}
+	f.Request(&FilterRequest{Method: "GET", Header: h})
+	if h.Get("X-Corp") != "yes" || h.Get("Via") != "goproxy" || len(h.Get("Cookie")) > 0 ||
+		len(h.Get("X-Debug")) > 0 || h.Get("Accept") != "*/*" {
+		t.Errorf("headers: %v", h)
+	}
+
+	if _, err := newHeaderFilter(map[string]string{"set": "novalue"}); err == nil {
+		t.Errorf("bad header accepted")
+	}
+	if _, err := newHeaderFilter(map[string]string{}); err == nil {
+		t.Errorf("empty header filter accepted")
+	}
+}
+
+// A filter that rewrites bodies
+type rewriteFilter struct{}
+
+func (rewriteFilter) Request(r *FilterRequest) Verdict {
+	if r.Body != nil {
+		r.Body = bytes.ToUpper(r.Body)
+	}
+	r.Annotate("seen", "yes")
+	return Verdict{}
+}
+
+func (rewriteFilter) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	if res.Body != nil {
+		res.Body = bytes.Replace(res.Body, []byte("cat"), []byte("dog"), -1)
+	}
+	res.Header.Set("X-Filtered", "1")
+	return Verdict{}
+}
+
+func testProxy(t *testing.T, fc *filterChain) *HTTPProxy {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &HTTPProxy{
+		log:     log,
+		cp:      newClientPolicy(&ClientConf{}),
+		filters: fc,
+	}
+}
+
+func TestFilterHTTP(t *testing.T) {
+	p := testProxy(t, &filterChain{v: []namedFilter{{rewriteFilter{}, "rewrite", false}}, bodySize: 100})
+
+	r := httptest.NewRequest("POST", "http://example.com/x", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	r, ok := p.filterRequest(w, r)
+	if !ok {
+		t.Fatalf("request denied")
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	if string(b) != "HELLO" || r.ContentLength != 5 {
+		t.Errorf("request body %q, length %d", b, r.ContentLength)
+	}
+	if n := filterNotes(r.Context()); n != "seen=yes" {
+		t.Errorf("notes %q", n)
+	}
+
+	// A gzipped response is decoded for the filter and sent decoded
+	// once the filter changes it
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("the cat sat"))
+	zw.Close()
+
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Encoding": {"gzip"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(gz.Bytes())),
+		ContentLength: int64(gz.Len()),
+	}
+	if !p.filterResponse(w, r, res) {
+		t.Fatalf("response denied")
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	if string(b) != "the dog sat" || len(res.Header.Get("Content-Encoding")) > 0 || res.Header.Get("X-Filtered") != "1" {
+		t.Errorf("response %q, headers %v", b, res.Header)
+	}
+
+	// Bodies over the limit aren't given to filters and go through whole
+	big := strings.Repeat("cat ", 100)
+	res = &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(big)),
+		ContentLength: -1,
+	}
+	if !p.filterResponse(w, r, res) {
+		t.Fatalf("response denied")
+	}
+	if b, _ = ioutil.ReadAll(res.Body); string(b) != big {
+		t.Errorf("large response changed: %d bytes", len(b))
+	}
+}
+
+func TestFilterHTTPDeny(t *testing.T) {
+	deny := &testFilter{
+		req: Verdict{Action: FILTER_DENY, Status: 451, Reason: "blocked here"},
+	}
+	p := testProxy(t, &filterChain{v: []namedFilter{{deny, "deny", false}}})
+
+	r := httptest.NewRequest("GET", "http://example.com/x", nil)
+	w := httptest.NewRecorder()
+	if _, ok := p.filterRequest(w, r); ok {
+		t.Fatalf("request allowed")
+	}
+	if w.Code != 451 || !strings.Contains(w.Body.String(), "blocked here") {
+		t.Errorf("denial: %d %q", w.Code, w.Body.String())
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,298 @@
+// fingerprint.go -- JA3 and JA4 fingerprints of TLS clients in tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A tunnel that starts with a TLS ClientHello is fingerprinted from it:
+// JA3 (an MD5 of the version, ciphers, extensions, groups and point
+// formats in the order sent) and JA4 (a readable prefix and truncated
+// SHA-256 of the sorted ciphers and extensions). GREASE values are left
+// out of both.
+
+// The ClientHello fields the fingerprints use
+type clientHello struct {
+	version uint16 // of the handshake
+	ciphers []uint16
+	exts    []uint16
+	groups  []uint16
+	points  []uint8
+	sigalgs []uint16
+	vers    []uint16 // supported_versions
+	alpn    string   // the first one offered
+	sni     bool
+}
+
+// Return true if 'v' is a GREASE value (RFC 8701)
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// Read the rest of the TLS record 'pre' starts from 'c'; return the
+// record or as much of it as came in SNIFF_WAIT
+func readHello(c net.Conn, pre []byte) []byte {
+	if len(pre) < 5 {
+		return pre
+	}
+	n := 5 + int(binary.BigEndian.Uint16(pre[3:]))
+	if n <= len(pre) {
+		return pre
+	}
+
+	b := make([]byte, n)
+	i := copy(b, pre)
+	c.SetReadDeadline(time.Now().Add(SNIFF_WAIT))
+	for i < n {
+		m, err := c.Read(b[i:])
+		i += m
+		if err != nil {
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	return b[:i]
+}
+
+// Parse the ClientHello in the TLS record 'b'
+func parseHello(b []byte) (*clientHello, error) {
+	if len(b) < 5+4 || b[0] != 0x16 || b[5] != 1 {
+		return nil, fmt.Errorf("tls: not a ClientHello")
+	}
+	if n := 5 + int(binary.BigEndian.Uint16(b[3:])); n < len(b) {
+		b = b[:n]
+	}
+	if n := 9 + (int(b[6])<<16 | int(b[7])<<8 | int(b[8])); n < len(b) {
+		b = b[:n]
+	}
+	b = b[9:]
+
+	// take 'n' bytes off the front of 'b'
+	short := false
+	take := func(n int) []byte {
+		if n > len(b) {
+			short = true
+			n = len(b)
+		}
+		v := b[:n]
+		b = b[n:]
+		return v
+	}
+	u8 := func() int {
+		v := take(1)
+		if len(v) < 1 {
+			return 0
+		}
+		return int(v[0])
+	}
+	u16 := func() int {
+		v := take(2)
+		if len(v) < 2 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(v))
+	}
+	list16 := func(v []byte) []uint16 {
+		var r []uint16
+		for ; len(v) >= 2; v = v[2:] {
+			if x := binary.BigEndian.Uint16(v); !grease(x) {
+				r = append(r, x)
+			}
+		}
+		return r
+	}
+
+	h := &clientHello{}
+	h.version = uint16(u16())
+	take(32) // random
+	take(u8())
+	h.ciphers = list16(take(u16()))
+	take(u8())
+	if short {
+		return nil, fmt.Errorf("tls: short ClientHello")
+	}
+
+	// no extensions at all is still a ClientHello
+	ext := take(u16())
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext)
+		n := int(binary.BigEndian.Uint16(ext[2:]))
+		if n > len(ext)-4 {
+			break
+		}
+		v := ext[4 : 4+n]
+		ext = ext[4+n:]
+		if grease(typ) {
+			continue
+		}
+
+		h.exts = append(h.exts, typ)
+		switch typ {
+		case 0x0000:
+			h.sni = true
+		case 0x000a:
+			if len(v) >= 2 {
+				h.groups = list16(v[2:])
+			}
+		case 0x000b:
+			if len(v) >= 1 && int(v[0]) <= len(v)-1 {
+				h.points = v[1 : 1+v[0]]
+			}
+		case 0x000d:
+			if len(v) >= 2 {
+				h.sigalgs = list16(v[2:])
+			}
+		case 0x0010:
+			if len(v) >= 3 && int(v[2]) <= len(v)-3 {
+				h.alpn = string(v[3 : 3+v[2]])
+			}
+		case 0x002b:
+			if len(v) >= 1 {
+				h.vers = list16(v[1:])
+			}
+		}
+	}
+	return h, nil
+}
+
+// Return the JA3 string of 'h'
+func (h *clientHello) ja3String() string {
+	dec := func(v []uint16) string {
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = strconv.Itoa(int(v[i]))
+		}
+		return strings.Join(s, "-")
+	}
+	pts := make([]uint16, len(h.points))
+	for i := range h.points {
+		pts[i] = uint16(h.points[i])
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", h.version, dec(h.ciphers), dec(h.exts), dec(h.groups), dec(pts))
+}
+
+// Return the JA3 fingerprint of 'h'
+func (h *clientHello) ja3() string {
+	sum := md5.Sum([]byte(h.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Return the JA4 fingerprint of 'h' (of a client over TCP)
+func (h *clientHello) ja4() string {
+	// the highest of supported_versions if sent
+	ver := h.version
+	if len(h.vers) > 0 {
+		ver = sorted(h.vers)[len(h.vers)-1]
+	}
+	vs := "00"
+	switch ver {
+	case 0x0304:
+		vs = "13"
+	case 0x0303:
+		vs = "12"
+	case 0x0302:
+		vs = "11"
+	case 0x0301:
+		vs = "10"
+	case 0x0300:
+		vs = "s3"
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	al := "00"
+	if n := len(h.alpn); n > 0 {
+		al = alnum(h.alpn[0], true) + alnum(h.alpn[n-1], false)
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", vs, sni, min(len(h.ciphers), 99), min(len(h.exts), 99), al)
+
+	// SNI and ALPN are in the prefix, not the hash
+	var exts []uint16
+	for _, e := range h.exts {
+		if e != 0x0000 && e != 0x0010 {
+			exts = append(exts, e)
+		}
+	}
+	c := ""
+	if len(exts) > 0 {
+		c = hex16(sorted(exts))
+		if len(h.sigalgs) > 0 {
+			c += "_" + hex16(h.sigalgs)
+		}
+	}
+	return a + "_" + trunc12(hex16(sorted(h.ciphers))) + "_" + trunc12(c)
+}
+
+// Return the ALPN character 'c' as JA4 has it: itself if alphanumeric,
+// else the first or last hex digit of it
+func alnum(c byte, first bool) string {
+	if ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+		return string(c)
+	}
+	x := hex.EncodeToString([]byte{c})
+	if first {
+		return x[:1]
+	}
+	return x[1:]
+}
+
+func sorted(v []uint16) []uint16 {
+	s := append([]uint16(nil), v...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+func hex16(v []uint16) string {
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = fmt.Sprintf("%04x", v[i])
+	}
+	return strings.Join(s, ",")
+}
+
+// The first 12 hex digits of the SHA-256 of 's'; zeros if 's' is empty
+func trunc12(s string) string {
+	if len(s) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Fingerprint the TLS client that sent 'pre' on 'c' if the tunnel is so
+// configured; return all the bytes read and the access log tags
+func fingerprintTunnel(ctx context.Context, tc *TunnelConf, c net.Conn, pre []byte, proto string) ([]byte, string) {
+	if !tc.Fingerprint || proto != "tls" {
+		return pre, ""
+	}
+	pre = readHello(c, pre)
+	h, err := parseHello(pre)
+	if err != nil {
+		return pre, ""
+	}
+	ja3, ja4 := h.ja3(), h.ja4()
+	sp := spanOf(ctx)
+	sp.set("tls.client.ja3", ja3)
+	sp.set("tls.client.ja4", ja4)
+	return pre, fmt.Sprintf(" ja3=%q ja4=%q", ja3, ja4)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
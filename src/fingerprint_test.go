@@ -0,0 +1,166 @@
+// fingerprint_test.go -- tests for the JA3 and JA4 fingerprints
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Return a TLS record with a ClientHello of 'ciphers' and 'exts' (type
+// and body)
+func helloRecord(ver uint16, ciphers []uint16, exts [][2][]byte) []byte {
+	u16 := func(b []byte, v int) []byte { return binary.BigEndian.AppendUint16(b, uint16(v)) }
+
+	var ch []byte
+	ch = u16(ch, int(ver))
+	ch = append(ch, make([]byte, 32)...)
+	ch = append(ch, 0)
+	ch = u16(ch, 2*len(ciphers))
+	for _, c := range ciphers {
+		ch = u16(ch, int(c))
+	}
+	ch = append(ch, 1, 0)
+	var ext []byte
+	for _, e := range exts {
+		ext = append(ext, e[0]...)
+		ext = append(u16(ext, len(e[1])), e[1]...)
+	}
+	ch = append(u16(ch, len(ext)), ext...)
+
+	hs := append([]byte{1, 0, byte(len(ch) >> 8), byte(len(ch))}, ch...)
+	return append([]byte{0x16, 3, 1, byte(len(hs) >> 8), byte(len(hs))}, hs...)
+}
+
+// Return 'v' after a length of 'prefix' bytes (0 or 2)
+func list16(prefix int, v ...uint16) []byte {
+	var b []byte
+	if prefix == 2 {
+		b = binary.BigEndian.AppendUint16(b, uint16(2*len(v)))
+	}
+	for _, x := range v {
+		b = binary.BigEndian.AppendUint16(b, x)
+	}
+	return b
+}
+
+func TestJA3(t *testing.T) {
+	// The example of the JA3 authors
+	h := &clientHello{
+		version: 769,
+		ciphers: []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		exts:    []uint16{0, 10, 11},
+		groups:  []uint16{23, 24, 25},
+		points:  []uint8{0},
+	}
+	if s := h.ja3String(); s != "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0" {
+		t.Errorf("ja3 string: %s", s)
+	}
+	if s := h.ja3(); s != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("ja3: %s", s)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// The example of the JA4 authors, with GREASE
+	ciphers := []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+		0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	id := func(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+	sni := []byte{0, 0}
+	alpn := []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+	exts := [][2][]byte{
+		{id(0x3a3a), nil},
+		{id(0x0000), sni},
+		{id(0x0017), nil},
+		{id(0xff01), {0}},
+		{id(0x000a), list16(2, 0x4a4a, 0x001d, 0x0017, 0x0018)},
+		{id(0x000b), {1, 0}},
+		{id(0x0023), nil},
+		{id(0x0010), alpn},
+		{id(0x0005), {1, 0, 0, 0, 0}},
+		{id(0x000d), list16(2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+		{id(0x0012), nil},
+		{id(0x0033), {0, 0}},
+		{id(0x002d), {1, 1}},
+		{id(0x002b), append([]byte{6}, list16(0, 0x5a5a, 0x0304, 0x0303)...)},
+		{id(0x001b), {2, 0, 2}},
+		{id(0x4469), {0, 0}},
+		{id(0x0015), {0, 0}},
+	}
+	h, err := parseHello(helloRecord(0x0303, ciphers, exts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.alpn != "h2" || !h.sni || len(h.ciphers) != 15 || len(h.exts) != 16 {
+		t.Errorf("parsed: %+v", h)
+	}
+	if s := h.ja4(); s != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("ja4: %s", s)
+	}
+	if s := h.ja3String(); !strings.HasPrefix(s, "771,4865-4866-4867-") || !strings.HasSuffix(s, ",29-23-24,0") {
+		t.Errorf("ja3 string: %s", s)
+	}
+
+	// No SNI, ALPN or extensions
+	h, err = parseHello(helloRecord(0x0301, []uint16{0x002f}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := h.ja4(); s != "t10i010000_"+trunc12("002f")+"_000000000000" {
+		t.Errorf("bare ja4: %s", s)
+	}
+
+	for _, b := range [][]byte{nil, []byte("GET / HTTP/1.1\r\n"), helloRecord(0x0303, ciphers, exts)[:40]} {
+		if _, err := parseHello(b); err == nil {
+			t.Errorf("%q: parsed", b)
+		}
+	}
+}
+
+func TestFingerprintTunnel(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	// The hello of crypto/tls, in two pieces
+	hello := make(chan []byte, 1)
+	go func() {
+		r, w := net.Pipe()
+		go tls.Client(w, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2"}}).Handshake()
+		b := make([]byte, 16384)
+		n, _ := r.Read(b)
+		r.Close()
+		hello <- b[:n]
+	}()
+	b := <-hello
+	go func() {
+		c.Write(b[:100])
+		c.Write(b[100:])
+	}()
+
+	pre := make([]byte, 100)
+	n, _ := s.Read(pre)
+	pre, tags := fingerprintTunnel(context.Background(), &TunnelConf{Fingerprint: true}, s, pre[:n], sniffProto(pre[:n]))
+	if len(pre) != len(b) {
+		t.Errorf("read %d of %d bytes", len(pre), len(b))
+	}
+	if !strings.HasPrefix(tags, ` ja3="`) || !strings.Contains(tags, ` ja4="t13d`) || !strings.Contains(tags, `h2_`) {
+		t.Errorf("tags: %s", tags)
+	}
+
+	if _, tags := fingerprintTunnel(context.Background(), &TunnelConf{}, s, pre, "tls"); len(tags) > 0 {
+		t.Errorf("not configured: %s", tags)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
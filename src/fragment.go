@@ -0,0 +1,185 @@
+// fragment.go -- split ClientHellos for SNI-based DPI
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A rule's fragment splits the TLS ClientHello sent on each connection
+// it allows into several TLS records, each sent in its own write (and
+// so, with TCP_NODELAY, its own segment). Middleboxes that look for the
+// server name in the first record or segment don't find it; the server
+// reassembles the handshake message from its records (RFC 8446, 5.1).
+// The hello itself isn't changed: it is in the handshake transcript,
+// so it can't be padded.
+
+var errFragmentRaw = errors.New("fragment: no raw access before the ClientHello")
+
+// The splitting of a rule
+type fragment struct {
+	sni   bool          // cut the first record inside the server name
+	size  int           // most bytes of hello in a record; 0 is no limit
+	delay time.Duration // between the writes of the records
+}
+
+// Return the fragment of rule 'name' or nil if there is none
+func newFragment(fc *FragmentConf, name string) (*fragment, error) {
+	if *fc == (FragmentConf{}) {
+		return nil, nil
+	}
+	if fc.Size < 0 || fc.Delay < 0 || fc.Delay > 1000 {
+		return nil, fmt.Errorf("rule %s: fragment: bad size %d or delay %d", name, fc.Size, fc.Delay)
+	}
+	if !fc.SNI && fc.Size == 0 {
+		return nil, fmt.Errorf("rule %s: fragment needs sni or a size", name)
+	}
+	return &fragment{sni: fc.SNI, size: fc.Size, delay: time.Duration(fc.Delay) * time.Millisecond}, nil
+}
+
+// Return the offset and length of the server name in the handshake
+// message 'hs' of a ClientHello; 0, 0 if it has none
+func sniRange(hs []byte) (int, int) {
+	off := 4 + 2 + 32
+	skip := func(nlen int) bool {
+		if off+nlen > len(hs) {
+			return false
+		}
+		n := int(hs[off])
+		if nlen == 2 {
+			n = int(binary.BigEndian.Uint16(hs[off:]))
+		}
+		off += nlen + n
+		return off <= len(hs)
+	}
+	if len(hs) < off || !skip(1) || !skip(2) || !skip(1) || off+2 > len(hs) {
+		return 0, 0
+	}
+	off += 2
+	for off+4 <= len(hs) {
+		typ := binary.BigEndian.Uint16(hs[off:])
+		n := int(binary.BigEndian.Uint16(hs[off+2:]))
+		off += 4
+		if off+n > len(hs) {
+			break
+		}
+		// server_name_list, host_name
+		if typ == 0 && n >= 5 {
+			nl := int(binary.BigEndian.Uint16(hs[off+3:]))
+			if off+5+nl <= len(hs) {
+				return off + 5, nl
+			}
+			break
+		}
+		off += n
+	}
+	return 0, 0
+}
+
+// Return the TLS records 'b' is split into; nil if it doesn't start
+// with a ClientHello or there is nothing to split
+func (f *fragment) split(b []byte) [][]byte {
+	if len(b) < 5+4 || b[0] != 0x16 || b[1] != 3 || b[5] != 1 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(b[3:]))
+	if len(b) < 5+n {
+		return nil
+	}
+	hs, rest := b[5:5+n], b[5+n:]
+
+	// where the pieces of the hello end
+	var cuts []int
+	if f.sni {
+		if at, nl := sniRange(hs); nl > 1 {
+			cuts = append(cuts, at+nl/2)
+		}
+	}
+	cuts = append(cuts, len(hs))
+	if f.size > 0 {
+		var v []int
+		i := 0
+		for _, c := range cuts {
+			for ; c-i > f.size; i += f.size {
+				v = append(v, i+f.size)
+			}
+			v = append(v, c)
+			i = c
+		}
+		cuts = v
+	}
+	if len(cuts) < 2 {
+		return nil
+	}
+
+	var recs [][]byte
+	i := 0
+	for _, c := range cuts {
+		r := append([]byte{0x16, b[1], b[2], byte((c - i) >> 8), byte(c - i)}, hs[i:c]...)
+		recs = append(recs, r)
+		i = c
+	}
+	if len(rest) > 0 {
+		recs = append(recs, rest)
+	}
+	return recs
+}
+
+// Return 'c' with its first write split if it is a ClientHello
+func (f *fragment) wrap(c net.Conn) net.Conn {
+	tc, ok := c.(tcpConn)
+	if !ok {
+		return c
+	}
+	return &fragmentConn{tcpConn: tc, f: f}
+}
+
+// A connection whose first write is split. The kernel can't split it,
+// so it has no raw access until then; a sniffed tunnel sends its first
+// bytes before the relay starts (see CancellableCopier.Prelude) and is
+// relayed by the kernel after all.
+type fragmentConn struct {
+	tcpConn
+	f    *fragment
+	sent atomic.Bool
+}
+
+func (c *fragmentConn) Write(b []byte) (int, error) {
+	if c.sent.Swap(true) {
+		return c.tcpConn.Write(b)
+	}
+	recs := c.f.split(b)
+	if recs == nil {
+		return c.tcpConn.Write(b)
+	}
+	for i, r := range recs {
+		if i > 0 && c.f.delay > 0 {
+			time.Sleep(c.f.delay)
+		}
+		if _, err := c.tcpConn.Write(r); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *fragmentConn) SyscallConn() (syscall.RawConn, error) {
+	if !c.sent.Load() {
+		return nil, errFragmentRaw
+	}
+	return c.tcpConn.SyscallConn()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,100 @@
+// fragment_test.go -- tests for the splitting of ClientHellos
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestFragmentConf(t *testing.T) {
+	if f, err := newFragment(&FragmentConf{}, "x"); f != nil || err != nil {
+		t.Errorf("empty: %v %v", f, err)
+	}
+	for _, fc := range []FragmentConf{{Delay: 10}, {SNI: true, Size: -1}, {Size: 10, Delay: 5000}} {
+		if _, err := newFragment(&fc, "x"); err == nil {
+			t.Errorf("%+v: no error", fc)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{Rules: []RuleConf{{Name: "dpi", Dest: []string{"127.0.0.0/8"}, Action: "allow",
+		Fragment: FragmentConf{SNI: true, Size: 100}}}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.sniffs(&TunnelConf{}) {
+		t.Errorf("tunnels not sniffed")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.(tcpConn).SyscallConn(); err == nil {
+		t.Errorf("raw access before the hello")
+	}
+	go tls.Client(c, &tls.Config{ServerName: "www.example.com"}).Handshake()
+
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The records of the hello, none with the whole name
+	var hs []byte
+	nrec := 0
+	for len(hs) < 4 || len(hs) < 4+(int(hs[1])<<16|int(hs[2])<<8|int(hs[3])) {
+		var h [5]byte
+		if _, err := io.ReadFull(s, h[:]); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint16(h[3:]))
+		if _, err := io.ReadFull(s, b); err != nil {
+			t.Fatal(err)
+		}
+		if h[0] != 0x16 || len(b) > 100 || bytes.Contains(b, []byte("www.example.com")) {
+			t.Errorf("record %d: % x (%d bytes)", nrec, h, len(b))
+		}
+		hs = append(hs, b...)
+		nrec++
+	}
+	if at, n := sniRange(hs); nrec < 3 || string(hs[at:at+n]) != "www.example.com" {
+		t.Errorf("%d records; name %q", nrec, hs[at:at+n])
+	}
+	if _, err := c.(tcpConn).SyscallConn(); err != nil {
+		t.Errorf("no raw access after the hello: %s", err)
+	}
+
+	// Not a ClientHello
+	f := &fragment{sni: true}
+	if v := f.split([]byte("GET / HTTP/1.1\r\n\r\n")); v != nil {
+		t.Errorf("http split: %q", v)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,444 @@
+// ftp.go -- ftp:// URLs for the HTTP proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeout for each FTP command/response exchange
+const FTP_CMD_TIMEOUT = 30 * time.Second
+
+// FTP control connection
+type ftpConn struct {
+	*textproto.Conn
+	nc   net.Conn
+	host string // server name
+	user string // authenticated client; "" if none
+	dial *dialer
+	rt   Route // of the control connection; the data connections go its way
+	pool *bufPool
+	cp   *clientPolicy
+	lim  *limits
+
+	// set once the HTTP response header is written
+	sent bool
+}
+
+// Error from the FTP server
+type ftpErr struct {
+	code int
+	msg  string
+}
+
+func (e *ftpErr) Error() string { return fmt.Sprintf("%d %s", e.code, e.msg) }
+
+// Handle a GET or HEAD for an ftp:// URL. We always use passive mode
+// and the data connections are opened by the proxy; the client only ever
+// talks HTTP to us.
+func (p *HTTPProxy) serveFTP(w http.ResponseWriter, r *http.Request) {
+	log := logOf(r.Context(), p.log)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET and HEAD are supported for ftp", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t0 := time.Now()
+
+	u := r.URL
+	host := u.Host
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	user, pass := "anonymous", "goproxy@"
+	if u.User != nil {
+		user = u.User.Username()
+		if pw, ok := u.User.Password(); ok {
+			pass = pw
+		}
+	}
+
+	// Paths are relative to the login directory; a leading %2F in the
+	// URL makes it absolute (RFC 1738).
+	fn := strings.TrimPrefix(u.Path, "/")
+
+	// These are decoded from the URL and go into FTP commands as is
+	if !ftpSafe(user) || !ftpSafe(pass) || !ftpSafe(fn) {
+		log.Info("%s: rejected ftp URL %.64q: CR, LF or NUL in user, password or path",
+			r.RemoteAddr, u.Redacted())
+		http.Error(w, "Invalid characters in ftp URL", http.StatusBadRequest)
+		return
+	}
+
+	var rt Route
+	nc, err := p.dial.DialContext(keepRoute(r.Context(), &rt), "tcp", host)
+	if err != nil {
+		p.cp.respond(w)
+		if pe := isDenied(err); pe != nil {
+			log.Info("%s: %s", r.RemoteAddr, pe)
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			return
+		}
+		log.Debug("can't connect to %s: %s", host, err)
+		http.Error(w, fmt.Sprintf("can't connect to %s", host), http.StatusBadGateway)
+		return
+	}
+
+	f := &ftpConn{
+		Conn: textproto.NewConn(nc),
+		nc:   nc,
+		host: u.Hostname(),
+		user: userOf(r.Context()),
+		dial: p.dial,
+		rt:   rt,
+		pool: p.pool,
+		cp:   p.cp,
+		lim:  p.lim,
+	}
+	defer f.Close()
+
+	if err = f.login(user, pass); err != nil {
+		p.ftpError(w, r, host, err)
+		return
+	}
+
+	var nr int64
+	sw := p.cp.writer(w, r, log)
+	if len(fn) == 0 || strings.HasSuffix(fn, "/") {
+		nr, err = f.list(sw, r, fn)
+	} else {
+		nr, err = f.retr(sw, r, fn)
+	}
+
+	if err != nil {
+		if err == errResponseTooLarge {
+			log.Info("%s: FTP transfer of %s aborted after %d bytes: %s",
+				r.RemoteAddr, u.Redacted(), nr, err)
+			panic(http.ErrAbortHandler)
+		}
+		if f.sent {
+			log.Debug("%s: FTP transfer of %s aborted: %s", host, u.String(), err)
+			return
+		}
+		p.ftpError(w, r, host, err)
+		return
+	}
+
+	f.cmd(221, "QUIT")
+
+	t1 := time.Now()
+	log.Debug("%s: FTP %d %s %s\n", host, nr, t1.Sub(t0), u.String())
+
+	if p.ulog != nil {
+		now := time.Now().UTC().Format(ACCESS_TIME)
+
+		p.ulog.Info("time=%q url=%q status=\"%d\" bytes=\"%d\" upstream=%q downstream=%q method=\"GET\" sent=\"0\" id=%q",
+			now, u.String(), 200, nr, format(t1.Sub(t0)), format(0), sessionOf(r.Context()))
+	}
+}
+
+// Map FTP failures to HTTP responses. Errors after the response
+// headers are written can only be logged.
+func (p *HTTPProxy) ftpError(w http.ResponseWriter, r *http.Request, host string, err error) {
+	log := logOf(r.Context(), p.log)
+	p.cp.respond(w)
+	if pe := isDenied(err); pe != nil {
+		log.Info("%s: FTP data connection: %s", host, pe)
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	log.Debug("%s: FTP %s", host, err)
+
+	fe, ok := err.(*ftpErr)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	switch fe.code {
+	case 530, 532:
+		http.Error(w, fe.Error(), http.StatusForbidden)
+	case 550:
+		http.Error(w, fe.Error(), http.StatusNotFound)
+	case 552:
+		log.Info("%s: FTP %s", host, fe)
+		http.Error(w, fe.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, fe.Error(), http.StatusBadGateway)
+	}
+}
+
+// Return true if 's' can't end an FTP command and start another
+func ftpSafe(s string) bool {
+	return !strings.ContainsAny(s, "\r\n\x00")
+}
+
+// Send a command and read the response; 'expect' is interpreted the way
+// textproto does: 2 means any 2xx code, 331 means exactly 331.
+func (f *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	f.nc.SetDeadline(time.Now().Add(FTP_CMD_TIMEOUT))
+	if _, err := f.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return f.response(expect)
+}
+
+func (f *ftpConn) response(expect int) (int, string, error) {
+	f.nc.SetDeadline(time.Now().Add(FTP_CMD_TIMEOUT))
+	code, msg, err := f.ReadResponse(expect)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); ok {
+			return code, msg, &ftpErr{code, msg}
+		}
+	}
+	return code, msg, err
+}
+
+func (f *ftpConn) login(user, pass string) error {
+	if _, _, err := f.response(2); err != nil {
+		return err
+	}
+
+	code, _, err := f.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case code == 331:
+		if _, _, err = f.cmd(2, "PASS %s", pass); err != nil {
+			return err
+		}
+	case code/100 != 2:
+		return &ftpErr{code, "USER rejected"}
+	}
+
+	_, _, err = f.cmd(2, "TYPE I")
+	return err
+}
+
+// Open a passive data connection. We ask for EPSV first and fall back to
+// PASV. The address in a PASV reply is ignored in favor of the control
+// connection's peer; this prevents the server from pointing us at an
+// arbitrary host (FTP bounce) and handles servers behind NAT.
+func (f *ftpConn) pasv() (net.Conn, error) {
+	var port int
+
+	code, msg, err := f.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+
+	if code == 229 {
+		if port, err = parseEPSV(msg); err != nil {
+			return nil, err
+		}
+	} else {
+		_, msg, err = f.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		if port, err = parsePASV(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	// The data connection goes to the same server, the way the script
+	// or router sent the control connection; its port must pass the
+	// outbound policy too - so a PASV reply can't reach a denied port.
+	ctx, cancel := context.WithTimeout(withUser(context.Background(), f.user), FTP_CMD_TIMEOUT)
+	defer cancel()
+	if len(f.rt.Name) > 0 {
+		return f.dial.dialRouted(ctx, f.rt, f.host, port)
+	}
+	direct := f.rt.Via == "direct"
+
+	if p := f.dial.parent; p != nil && !direct {
+		if err := f.dial.checkDest(ctx, f.host, port); err != nil {
+			return nil, err
+		}
+		return p.connect(ctx, net.JoinHostPort(f.host, strconv.Itoa(port)))
+	}
+
+	if (f.dial.wg != nil || f.dial.jumps != nil) && !direct {
+		if c, ok, err := f.dial.dialVia(ctx, f.host, port); ok {
+			return c, err
+		}
+	}
+
+	ra := f.nc.RemoteAddr().(*net.TCPAddr)
+	if err := f.dial.pol.check(f.user, f.host, ra.IP, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(ra.IP.String(), strconv.Itoa(port))
+
+	src, err := f.dial.source(f.user, ra.IP)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: FTP_CMD_TIMEOUT}
+	if src != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return d.Dial("tcp", addr)
+}
+
+// Fetch file 'fn' and send it to 'w'
+func (f *ftpConn) retr(w http.ResponseWriter, r *http.Request, fn string) (int64, error) {
+	var size int64 = -1
+
+	if _, msg, err := f.cmd(213, "SIZE %s", fn); err == nil {
+		size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	}
+
+	ct := mime.TypeByExtension(path.Ext(fn))
+	if len(ct) == 0 {
+		ct = "application/octet-stream"
+	}
+
+	if max := f.lim.response; max > 0 && size > max {
+		return 0, &ftpErr{552, fmt.Sprintf("%s too large (%d > %d bytes)", fn, size, max)}
+	}
+
+	if r.Method == "HEAD" {
+		if size < 0 {
+			return 0, &ftpErr{550, "can't determine size of " + fn}
+		}
+
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		f.writeHeader(w)
+		return 0, nil
+	}
+
+	dc, err := f.pasv()
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+
+	if _, _, err = f.cmd(1, "RETR %s", fn); err != nil {
+		return 0, err
+	}
+
+	w.Header().Set("Content-Type", ct)
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	f.writeHeader(w)
+
+	return f.transfer(w, dc)
+}
+
+// List directory 'dir' as plain text
+func (f *ftpConn) list(w http.ResponseWriter, r *http.Request, dir string) (int64, error) {
+	if len(dir) > 0 {
+		if _, _, err := f.cmd(2, "CWD %s", dir); err != nil {
+			return 0, err
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == "HEAD" {
+		f.writeHeader(w)
+		return 0, nil
+	}
+
+	dc, err := f.pasv()
+	if err != nil {
+		return 0, err
+	}
+	defer dc.Close()
+
+	if _, _, err = f.cmd(1, "LIST"); err != nil {
+		return 0, err
+	}
+
+	f.writeHeader(w)
+	return f.transfer(w, dc)
+}
+
+func (f *ftpConn) writeHeader(w http.ResponseWriter) {
+	f.cp.respond(w)
+	w.WriteHeader(http.StatusOK)
+	f.sent = true
+}
+
+// Copy the data connection to 'w' and read the completion reply
+func (f *ftpConn) transfer(w io.Writer, dc net.Conn) (int64, error) {
+	// The control connection is idle while the data flows
+	f.nc.SetDeadline(time.Time{})
+
+	b := f.pool.Get()
+	nr, err := io.CopyBuffer(w, f.lim.responseBody(dc), *b)
+	f.pool.Put(b)
+	dc.Close()
+	if err != nil {
+		return nr, err
+	}
+
+	_, _, err = f.response(2)
+	return nr, err
+}
+
+// Return the port of the EPSV reply 'msg':
+// 229 Entering Extended Passive Mode (|||port|)
+func parseEPSV(msg string) (int, error) {
+	i := strings.Index(msg, "(")
+	j := strings.LastIndex(msg, ")")
+	if i < 0 || j <= i+1 {
+		return 0, fmt.Errorf("can't parse EPSV reply: %s", msg)
+	}
+
+	v := strings.Split(msg[i+1:j], msg[i+1:i+2])
+	if len(v) != 5 {
+		return 0, fmt.Errorf("can't parse EPSV reply: %s", msg)
+	}
+	port, err := strconv.Atoi(v[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("can't parse EPSV reply: %s", msg)
+	}
+	return port, nil
+}
+
+// Return the port of the PASV reply 'msg'; the address is ignored, the
+// data connection goes to the server of the control connection:
+// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+func parsePASV(msg string) (int, error) {
+	i := strings.IndexAny(msg, "0123456789")
+	if i < 0 {
+		return 0, fmt.Errorf("can't parse PASV reply: %s", msg)
+	}
+
+	var h [6]int
+	n, _ := fmt.Sscanf(msg[i:], "%d,%d,%d,%d,%d,%d", &h[0], &h[1], &h[2], &h[3], &h[4], &h[5])
+	if n != 6 {
+		return 0, fmt.Errorf("can't parse PASV reply: %s", msg)
+	}
+	for _, x := range h {
+		if x < 0 || x > 255 {
+			return 0, fmt.Errorf("can't parse PASV reply: %s", msg)
+		}
+	}
+	return h[4]<<8 | h[5], nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,178 @@
+// ftp_test.go -- tests for FTP through the proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const ftpHello = "hello from ftp\n"
+
+// An FTP server on the loopback with one file, "hello.txt". It answers
+// EPSV if 'epsv', else only PASV.
+func startFTPServer(t *testing.T, epsv bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTPConn(nc, epsv)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFTPConn(nc net.Conn, epsv bool) {
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+	c.PrintfLine("220 ready")
+
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	listen := func() int {
+		if data != nil {
+			data.Close()
+		}
+		data, _ = net.Listen("tcp", "127.0.0.1:0")
+		return data.Addr().(*net.TCPAddr).Port
+	}
+
+	for {
+		s, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(s, " ")
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			c.PrintfLine("331 password")
+		case "PASS":
+			c.PrintfLine("230 in")
+		case "TYPE":
+			c.PrintfLine("200 ok")
+		case "SIZE":
+			if arg != "hello.txt" {
+				c.PrintfLine("550 no such file")
+				continue
+			}
+			c.PrintfLine("213 %d", len(ftpHello))
+		case "EPSV":
+			if !epsv {
+				c.PrintfLine("500 no EPSV")
+				continue
+			}
+			c.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", listen())
+		case "PASV":
+			p := listen()
+			c.PrintfLine("227 Entering Passive Mode (127,0,0,1,%d,%d)", p>>8, p&0xff)
+		case "RETR":
+			if data == nil || arg != "hello.txt" {
+				c.PrintfLine("550 no")
+				continue
+			}
+			c.PrintfLine("150 sending")
+			dc, err := data.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(dc, ftpHello)
+			dc.Close()
+			c.PrintfLine("226 done")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 %s", cmd)
+		}
+	}
+}
+
+// GET the ftp:// URL 'u' through the HTTP proxy at 'addr'
+func ftpGet(t *testing.T, addr, u string) (int, string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", u)
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res.StatusCode, string(b)
+}
+
+// A script that routes the control connection through a jump host
+// routes the data connection the same way: "internal.test" only
+// resolves there.
+func TestFTPRoute(t *testing.T) {
+	ftp := startFTPServer(t, true)
+	key, kh, pub := jumpFiles(t, "", nil)
+	var conns atomic.Int32
+	ln, hk := startSSHServer(t, pub, &conns)
+	jaddr := ln.Addr().String()
+	os.WriteFile(kh, []byte(knownhosts.Line([]string{knownhosts.Normalize(jaddr)}, hk)+"\n"), 0600)
+
+	fn := writeScript(t, `
+		function route(d)
+			if d.host == "internal.test" then return "jump", "bastion" end
+		end
+	`)
+	addr := startHTTPProxy(t, &ListenConf{
+		Jump:   []JumpConf{{Name: "bastion", Addr: jaddr, User: "jumper", Key: key, KnownHosts: kh}},
+		Script: ScriptConf{File: fn},
+		Rules:  []RuleConf{{Name: "inside", Dest: []string{"internal.test"}, Action: "allow"}},
+	})
+
+	_, port, _ := net.SplitHostPort(ftp)
+	if code, body := ftpGet(t, addr, "ftp://internal.test:"+port+"/hello.txt"); code != 200 || body != ftpHello {
+		t.Errorf("routed: %d %q", code, body)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("ssh connections: %d", n)
+	}
+
+	// a direct server with only PASV
+	ftp = startFTPServer(t, false)
+	if code, body := ftpGet(t, addr, "ftp://"+ftp+"/hello.txt"); code != 200 || body != ftpHello {
+		t.Errorf("direct: %d %q", code, body)
+	}
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
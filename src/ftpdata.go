@@ -0,0 +1,229 @@
+// ftpdata.go -- data connections of FTP tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default port of the FTP servers whose tunnels are watched for the
+	// data connections they announce
+	FTP_PORT = 21
+
+	// Seconds the client has to open an announced data connection
+	FTP_DATA_WINDOW = 30
+
+	// Longest reply line looked at; longer ones pass unread
+	FTP_LINE = 512
+)
+
+var errFTPRaw = errors.New("ftp: no raw access to a watched control connection")
+
+// The data connections announced on the FTP tunnels of a listener's
+// clients. A PASV or EPSV reply on the control connection lets its
+// client open the port it names on the same server for a while; the
+// rules and routes see that connection as the control connection, so it
+// is allowed and sent the same way. Nothing else is opened: not the
+// other clients, not other servers, and not the privileged ports (the
+// SMTP port of the server, say).
+type ftpPasses struct {
+	n int32 // passes in m
+
+	ports map[int]bool // of the servers
+
+	sync.Mutex
+	m map[string]*ftpPass
+}
+
+// An announced data connection: its control connection, and until when
+// it may be opened
+type ftpPass struct {
+	host string
+	port int
+	exp  time.Time
+}
+
+// Make the passes of the tunnels of 'tc'; nil if none are watched
+func newFTPPasses(tc *TunnelConf) (*ftpPasses, error) {
+	ports := tc.FTP
+	if len(ports) == 0 {
+		ports = []int{FTP_PORT}
+	}
+	f := &ftpPasses{ports: make(map[int]bool), m: make(map[string]*ftpPass)}
+	for _, p := range ports {
+		switch {
+		case p == 0:
+			return nil, nil
+		case p < 0 || p > 65535:
+			return nil, fmt.Errorf("tunnel: bad ftp port %d", p)
+		}
+		f.ports[p] = true
+	}
+	return f, nil
+}
+
+func ftpPassKey(client net.IP, host string, port int) string {
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return client.String() + " " + net.JoinHostPort(strings.ToLower(host), strconv.Itoa(port))
+}
+
+// Let 'client' open 'port' on the server it names as any of 'hosts'
+// for FTP_DATA_WINDOW, as the control connection 'ctrl'
+func (f *ftpPasses) add(client net.IP, hosts []string, port int, ctrl ftpPass) {
+	now := time.Now()
+	ctrl.exp = now.Add(FTP_DATA_WINDOW * time.Second)
+
+	f.Lock()
+	for k, p := range f.m {
+		if now.After(p.exp) {
+			delete(f.m, k)
+		}
+	}
+	for _, h := range hosts {
+		p := ctrl
+		f.m[ftpPassKey(client, h, port)] = &p
+	}
+	atomic.StoreInt32(&f.n, int32(len(f.m)))
+	f.Unlock()
+}
+
+// Return the host and port the rules see for a connection of the client
+// in 'ctx' to 'host:port', and true if it is an announced data
+// connection: those of its control connection.
+func (f *ftpPasses) as(ctx context.Context, host string, port int) (string, int, bool) {
+	cl := clientOf(ctx)
+	if f == nil || cl == nil || atomic.LoadInt32(&f.n) == 0 {
+		return host, port, false
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	p, ok := f.m[ftpPassKey(cl, host, port)]
+	if !ok || time.Now().After(p.exp) {
+		return host, port, false
+	}
+	return p.host, p.port, true
+}
+
+// Return the connection 'c' to 'addr' of the client in 'ctx', watched
+// for the data connections its server announces if it is an FTP control
+// connection
+func (d *dialer) watchFTP(ctx context.Context, addr string, c net.Conn) net.Conn {
+	if d.ftp == nil {
+		return c
+	}
+	host, ps, err := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(ps)
+	tc, ok := c.(tcpConn)
+	cl := clientOf(ctx)
+	if err != nil || !d.ftp.ports[port] || !ok || cl == nil {
+		return c
+	}
+
+	// The client may name the server as it did, or (after a PASV reply)
+	// by its address; that is known only if nothing was between us.
+	w := &ftpWatch{
+		tcpConn: tc,
+		ftp:     d.ftp,
+		client:  cl,
+		ctrl:    ftpPass{host: host, port: port},
+		hosts:   []string{host},
+	}
+	if _, up := routeOf(ctx); up == "direct" {
+		if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok && ra.IP.String() != host {
+			w.hosts = append(w.hosts, ra.IP.String())
+		}
+	}
+	return w
+}
+
+// The server's side of an FTP control tunnel; its replies are read for
+// the data connections they announce. It has no raw access, so the
+// copier relays it through buffers.
+type ftpWatch struct {
+	tcpConn
+	ftp    *ftpPasses
+	client net.IP
+	ctrl   ftpPass
+	hosts  []string
+
+	line []byte // of the reply being read
+	skip bool   // the rest of a reply line that is too long
+}
+
+func (c *ftpWatch) Read(b []byte) (int, error) {
+	n, err := c.tcpConn.Read(b)
+	c.scan(b[:n])
+	return n, err
+}
+
+func (c *ftpWatch) SyscallConn() (syscall.RawConn, error) {
+	return nil, errFTPRaw
+}
+
+// Look at the reply lines in 'b'
+func (c *ftpWatch) scan(b []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			c.keep(b)
+			return
+		}
+		c.keep(b[:i])
+		if !c.skip {
+			c.reply(string(bytes.TrimRight(c.line, "\r")))
+		}
+		c.line, c.skip = c.line[:0], false
+		b = b[i+1:]
+	}
+}
+
+func (c *ftpWatch) keep(b []byte) {
+	if c.skip {
+		return
+	}
+	if len(c.line)+len(b) > FTP_LINE {
+		c.line, c.skip = c.line[:0], true
+		return
+	}
+	c.line = append(c.line, b...)
+}
+
+// Let the client open the data connection announced by 's', if it is a
+// PASV or EPSV reply
+func (c *ftpWatch) reply(s string) {
+	var port int
+	var err error
+	switch {
+	case strings.HasPrefix(s, "227 "):
+		port, err = parsePASV(s[4:])
+	case strings.HasPrefix(s, "229 "):
+		port, err = parseEPSV(s[4:])
+	default:
+		return
+	}
+	if err == nil && port >= 1024 {
+		c.ftp.add(c.client, c.hosts, port, c.ctrl)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,192 @@
+// ftpdata_test.go -- tests for the data connections of FTP tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Only the control port of the server is allowed; the data connections
+// its replies announce are let through for the client that got them.
+func TestFTPTunnel(t *testing.T) {
+	ftp := startFTPServer(t, true)
+	host, port, _ := net.SplitHostPort(ftp)
+	pn, _ := strconv.Atoi(port)
+	lc := func() *ListenConf {
+		return &ListenConf{
+			Tunnel: TunnelConf{FTP: []int{pn}},
+			Rules: []RuleConf{
+				{Name: "ftp", Dest: []string{host}, Ports: []string{port}, Action: "allow"},
+				{Name: "rest", Dest: []string{"127.0.0.0/8"}, Action: "deny"},
+			},
+		}
+	}
+
+	// Log in on the control connection 'tc' and ask for a data port
+	// with 'cmd'
+	passive := func(tc *textproto.Conn, cmd string) int {
+		for _, x := range []struct {
+			cmd  string
+			code int
+		}{{"", 220}, {"USER ftp", 331}, {"PASS x", 230}, {cmd, 0}} {
+			if len(x.cmd) > 0 {
+				tc.PrintfLine("%s", x.cmd)
+			}
+			code, msg, err := tc.ReadResponse(x.code)
+			if err != nil {
+				t.Fatalf("%s: %v", x.cmd, err)
+			}
+			switch code {
+			case 227:
+				n, err := parsePASV(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return n
+			case 229:
+				n, err := parseEPSV(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+		}
+		return 0
+	}
+
+	// SOCKS, PASV: the data port opens for this client only
+	sx := startSocksProxy(t, lc())
+	socks := func(src string) proxy.Dialer {
+		nd := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(src)}}
+		d, _ := proxy.SOCKS5("tcp", sx, nil, nd)
+		return d
+	}
+	d := socks("127.0.0.1")
+	c, err := d.Dial("tcp", ftp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := textproto.NewConn(c)
+	data := net.JoinHostPort(host, "1")
+	if _, err := d.Dial("tcp", data); err == nil {
+		t.Errorf("%s before PASV: allowed", data)
+	}
+	data = net.JoinHostPort(host, strconv.Itoa(passive(tc, "PASV")))
+	if _, err := socks("127.0.0.2").Dial("tcp", data); err == nil {
+		t.Errorf("%s from another client: allowed", data)
+	}
+	dc, err := d.Dial("tcp", data)
+	if err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	tc.PrintfLine("RETR hello.txt")
+	b, _ := ioutil.ReadAll(dc)
+	dc.Close()
+	if string(b) != ftpHello {
+		t.Errorf("data: %q", b)
+	}
+
+	// CONNECT, EPSV
+	addr := startHTTPProxy(t, lc())
+	connect := func(to string) (*textproto.Conn, int) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", to, to)
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return textproto.NewConn(struct {
+			io.Reader
+			io.WriteCloser
+		}{br, c}), res.StatusCode
+	}
+	tc, code := connect(ftp)
+	if code != 200 {
+		t.Fatalf("control: %d", code)
+	}
+	data = net.JoinHostPort(host, strconv.Itoa(passive(tc, "EPSV")))
+	dtc, code := connect(data)
+	if code != 200 {
+		t.Fatalf("%s: %d", data, code)
+	}
+	tc.PrintfLine("RETR hello.txt")
+	if b, _ := ioutil.ReadAll(dtc.R); string(b) != ftpHello {
+		t.Errorf("CONNECT data: %q", b)
+	}
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Replies split across reads are seen; long lines and privileged ports
+// aren't
+func TestFTPWatch(t *testing.T) {
+	f, err := newFTPPasses(&TunnelConf{})
+	if err != nil || !f.ports[FTP_PORT] {
+		t.Fatalf("default: %v %v", f, err)
+	}
+	cl := net.ParseIP("192.0.2.1")
+	w := &ftpWatch{ftp: f, client: cl, ctrl: ftpPass{host: "ftp.example", port: 21},
+		hosts: []string{"ftp.example", "198.51.100.7"}}
+
+	w.scan([]byte("220 hi\r\n227 Entering Passive Mode (198,51,100,7,"))
+	w.scan([]byte("19,137)\r\n229 Entering Extended Passive Mode (|||80|)\r\n"))
+	w.scan([]byte("229 " + strings.Repeat("x", FTP_LINE) + " (|||6000|)\r\n229 (|||6001|)"))
+	ctx := withClient(context.Background(), cl)
+	for _, tc := range []struct {
+		host string
+		port int
+		ok   bool
+	}{
+		{"FTP.example", 5001, true},
+		{"198.51.100.7", 5001, true},
+		{"198.51.100.8", 5001, false},
+		{"ftp.example", 80, false},
+		{"ftp.example", 6000, false},
+		{"ftp.example", 6001, false}, // no end of line yet
+	} {
+		h, p, ok := f.as(ctx, tc.host, tc.port)
+		if ok != tc.ok || (ok && (h != "ftp.example" || p != 21)) {
+			t.Errorf("%s:%d: %s:%d %v", tc.host, tc.port, h, p, ok)
+		}
+	}
+	if _, _, ok := f.as(withClient(context.Background(), net.ParseIP("192.0.2.2")), "ftp.example", 5001); ok {
+		t.Errorf("other client: allowed")
+	}
+
+	if f, err := newFTPPasses(&TunnelConf{FTP: []int{0}}); f != nil || err != nil {
+		t.Errorf("off: %v %v", f, err)
+	}
+	if _, err := newFTPPasses(&TunnelConf{FTP: []int{70000}}); err == nil {
+		t.Errorf("bad port: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,197 @@
+// handover.go -- listening sockets a new goproxy takes over from an old one
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+const (
+	// Default seconds an old goproxy lets its sessions finish after a
+	// handover
+	HANDOVER_DRAIN = 300
+
+	// Seconds a handover may take
+	HANDOVER_TIMEOUT = 30
+
+	HANDOVER_HELLO = "goproxy-handover 1\n"
+)
+
+// What the old goproxy tells the new one before it passes the sockets
+type handoverMsg struct {
+	PID      int           `json:"pid"`
+	Keys     []string      `json:"keys"` // of the sockets, in the order they follow
+	Sessions []sessionStat `json:"sessions"`
+}
+
+// A socket that can be passed on
+type filer interface {
+	File() (*os.File, error)
+}
+
+// The sockets of this process, by key ("tcp :8080"), and the ones it got
+// from its predecessor and hasn't used yet
+var sockets = struct {
+	sync.Mutex
+	own       []ownSocket
+	inherited map[string][]*os.File
+}{inherited: make(map[string][]*os.File)}
+
+type ownSocket struct {
+	key string
+	s   filer
+}
+
+// Pass on the socket 's' at the next handover
+func shareSocket(key string, s filer) {
+	sockets.Lock()
+	sockets.own = append(sockets.own, ownSocket{key, s})
+	sockets.Unlock()
+}
+
+// Return the next inherited socket of 'key'; nil if there is none
+func inheritedFile(key string) *os.File {
+	sockets.Lock()
+	defer sockets.Unlock()
+	v := sockets.inherited[key]
+	if len(v) == 0 {
+		return nil
+	}
+	f := v[0]
+	if len(v) == 1 {
+		delete(sockets.inherited, key)
+	} else {
+		sockets.inherited[key] = v[1:]
+	}
+	return f
+}
+
+// Return the next inherited listener of 'key'; nil if there is none
+func inheritTCP(key string) (*net.TCPListener, error) {
+	f := inheritedFile(key)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("handover: %s: %s", key, err)
+	}
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("handover: %s is not a TCP listener", key)
+	}
+	return tl, nil
+}
+
+// Return the next inherited UDP socket of 'key'; nil if there is none
+func inheritUDP(key string) (*net.UDPConn, error) {
+	f := inheritedFile(key)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("handover: %s: %s", key, err)
+	}
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("handover: %s is not a UDP socket", key)
+	}
+	return uc, nil
+}
+
+// Listen on TCP 'addr' (named 'key'), or take over the listener of the
+// predecessor
+func listenShared(key, addr string) (*net.TCPListener, error) {
+	ln, err := inheritTCP(key)
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		la, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = net.ListenTCP("tcp", la); err != nil {
+			return nil, err
+		}
+	}
+	shareSocket(key, ln)
+	return ln, nil
+}
+
+// Close the inherited sockets the config doesn't have any more
+func closeInherited(log *L.Logger) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	for key, v := range sockets.inherited {
+		for _, f := range v {
+			f.Close()
+		}
+		log.Info("handover: %s isn't in the config any more; closed", key)
+	}
+	sockets.inherited = make(map[string][]*os.File)
+}
+
+// Stop the servers of a goproxy that handed its sockets over: all at
+// once, then give their sessions up to 'drain' to finish.
+func drainServers(srv []Proxy, drain time.Duration, log *L.Logger) {
+	var wg sync.WaitGroup
+	for _, s := range srv {
+		wg.Add(1)
+		go func(s Proxy) {
+			defer wg.Done()
+			s.Stop()
+		}(s)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	end := time.After(drain)
+	for {
+		select {
+		case <-end:
+			liveSessions.Lock()
+			n := len(liveSessions.m)
+			liveSessions.Unlock()
+			log.Warn("handover: %d tunnels still open after %s; exiting", n, drain)
+			return
+		case <-stopped:
+			stopped = nil
+		case <-t.C:
+		}
+
+		liveSessions.Lock()
+		n := len(liveSessions.m)
+		liveSessions.Unlock()
+		if stopped == nil && n == 0 {
+			log.Info("handover: all sessions done")
+			return
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
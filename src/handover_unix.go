@@ -0,0 +1,254 @@
+// handover_unix.go -- passing listening sockets over a unix socket
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Sockets passed in one message
+const HANDOVER_BATCH = 64
+
+// Signals that start a new goproxy from the executable on disk
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// The connection of a new goproxy to its predecessor
+type handoverConn struct {
+	*net.UnixConn
+	msg handoverMsg
+}
+
+// Take over the sockets of the goproxy at the handover socket 'path';
+// nil if no goproxy runs there.
+func takeOver(path string, log *L.Logger) (*handoverConn, error) {
+	nc, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("handover: %s", err)
+	}
+
+	c := &handoverConn{UnixConn: nc.(*net.UnixConn)}
+	c.SetDeadline(time.Now().Add(HANDOVER_TIMEOUT * time.Second))
+	if err := c.recv(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("handover: %s", err)
+	}
+	log.Info("handover: took %d sockets from pid %d (%d tunnels open there)",
+		len(c.msg.Keys), c.msg.PID, len(c.msg.Sessions))
+	return c, nil
+}
+
+// Read the sockets of the predecessor into the inherited sockets
+func (c *handoverConn) recv() error {
+	if _, err := io.WriteString(c, HANDOVER_HELLO); err != nil {
+		return err
+	}
+
+	var n uint32
+	if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	if n > 1<<20 {
+		return fmt.Errorf("header of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &c.msg); err != nil {
+		return err
+	}
+
+	var fds []int
+	for len(fds) < len(c.msg.Keys) {
+		var one [1]byte
+		oob := make([]byte, syscall.CmsgSpace(4*HANDOVER_BATCH))
+		_, oobn, _, _, err := c.ReadMsgUnix(one[:], oob)
+		if err != nil {
+			return err
+		}
+		cms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		if len(cms) == 0 {
+			return fmt.Errorf("no sockets in a message")
+		}
+		for i := range cms {
+			v, err := syscall.ParseUnixRights(&cms[i])
+			if err != nil {
+				return err
+			}
+			fds = append(fds, v...)
+		}
+	}
+
+	sockets.Lock()
+	defer sockets.Unlock()
+	for i, key := range c.msg.Keys {
+		if i < len(fds) {
+			syscall.CloseOnExec(fds[i])
+			sockets.inherited[key] = append(sockets.inherited[key], os.NewFile(uintptr(fds[i]), key))
+		}
+	}
+	return nil
+}
+
+// Tell the predecessor that this goproxy serves; it lets go of the
+// handover socket when it's done.
+func (c *handoverConn) ready() error {
+	defer c.Close()
+	if _, err := io.WriteString(c, "ready\n"); err != nil {
+		return fmt.Errorf("handover: %s", err)
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil || string(b[:]) != "bye\n" {
+		return fmt.Errorf("handover: no goodbye from pid %d: %v", c.msg.PID, err)
+	}
+	return nil
+}
+
+// Listen for a successor on the handover socket 'path'. The channel is
+// closed when one took the sockets over.
+func serveHandover(path string, log *L.Logger) (<-chan struct{}, error) {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("handover: %s", err)
+	}
+	// the successor listens on the path before this one is closed
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("handover: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			c, err := ln.AcceptUnix()
+			if err != nil {
+				return
+			}
+			if err := handOver(c); err != nil {
+				log.Warn("handover: %s; still serving", err)
+				c.Close()
+				continue
+			}
+
+			ln.Close()
+			io.WriteString(c, "bye\n")
+			c.Close()
+			close(done)
+			return
+		}
+	}()
+	return done, nil
+}
+
+// Pass the sockets of this goproxy to the successor on 'c'; return when
+// it serves.
+func handOver(c *net.UnixConn) error {
+	c.SetDeadline(time.Now().Add(HANDOVER_TIMEOUT * time.Second))
+
+	b := make([]byte, len(HANDOVER_HELLO))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != HANDOVER_HELLO {
+		return fmt.Errorf("not a goproxy: %v", err)
+	}
+
+	sockets.Lock()
+	own := append([]ownSocket(nil), sockets.own...)
+	sockets.Unlock()
+
+	msg := handoverMsg{PID: os.Getpid(), Sessions: sessionStats("", time.Now())}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range own {
+		// closed listeners have nothing to pass on
+		f, err := s.s.File()
+		if err != nil {
+			continue
+		}
+		files = append(files, f)
+		msg.Keys = append(msg.Keys, s.key)
+	}
+
+	hdr, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, uint32(len(hdr))); err != nil {
+		return err
+	}
+	if _, err := c.Write(hdr); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(files); i += HANDOVER_BATCH {
+		var fds []int
+		for _, f := range files[i:min(i+HANDOVER_BATCH, len(files))] {
+			fds = append(fds, int(f.Fd()))
+		}
+		if _, _, err := c.WriteMsgUnix([]byte{'f'}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+
+	r := make([]byte, 6)
+	if _, err := io.ReadFull(c, r); err != nil || string(r) != "ready\n" {
+		return fmt.Errorf("successor didn't start: %v", err)
+	}
+	return nil
+}
+
+// Start a new goproxy from the executable on disk with the arguments of
+// this one; it takes the sockets over through the handover socket.
+func spawnUpgrade(log *L.Logger) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Error("upgrade: %s", err)
+		return
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Error("upgrade: can't start %s: %s", exe, err)
+		return
+	}
+	log.Info("upgrade: started %s (pid %d)", exe, cmd.Process.Pid)
+
+	// reap it if it fails; it outlives this process if it doesn't
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Warn("upgrade: pid %d: %s", cmd.Process.Pid, err)
+		}
+	}()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,130 @@
+// handover_unix_test.go -- tests for the socket handover
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestHandover(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	if c, err := takeOver(path, log); c != nil || err != nil {
+		t.Fatalf("nobody to take over from: %v %v", c, err)
+	}
+
+	old, err := listenShared("tcp handover-test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	handed, err := serveHandover(path, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := takeOver(path, log)
+	if err != nil || prev == nil {
+		t.Fatalf("take over: %v %v", prev, err)
+	}
+	ln, err := listenShared("tcp handover-test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closeInherited(log)
+
+	if ln.Addr().String() != old.Addr().String() {
+		t.Fatalf("new listener on %s, old on %s", ln.Addr(), old.Addr())
+	}
+
+	// The old listener stops; the new one keeps the port
+	select {
+	case <-handed:
+		t.Fatalf("handed over before the successor was ready")
+	default:
+	}
+	if err := prev.ready(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handed:
+	case <-time.After(time.Second):
+		t.Fatalf("old goproxy didn't let go")
+	}
+	old.Close()
+
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("port dropped: %v", err)
+	}
+	c.Close()
+}
+
+type slowProxy struct {
+	stopped int32
+}
+
+func (p *slowProxy) Start() {}
+
+func (p *slowProxy) Stop() {
+	time.Sleep(100 * time.Millisecond)
+	atomic.AddInt32(&p.stopped, 1)
+}
+
+func TestDrainServers(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	p := []*slowProxy{{}, {}, {}}
+
+	// all servers stop at once
+	t0 := time.Now()
+	drainServers([]Proxy{p[0], p[1], p[2]}, 5*time.Second, log)
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("drain took %s", d)
+	}
+	for i := range p {
+		if p[i].stopped != 1 {
+			t.Errorf("server %d not stopped", i)
+		}
+	}
+
+	// sessions left at the end of the drain don't keep it waiting
+	liveSessions.Lock()
+	liveSessions.m["drain-test"] = &liveSession{}
+	liveSessions.Unlock()
+	defer func() {
+		liveSessions.Lock()
+		delete(liveSessions.m, "drain-test")
+		liveSessions.Unlock()
+	}()
+
+	t0 = time.Now()
+	drainServers(nil, 200*time.Millisecond, log)
+	if d := time.Since(t0); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Errorf("drain with a session took %s", d)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
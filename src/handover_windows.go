@@ -0,0 +1,40 @@
+// handover_windows.go -- no socket handover on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+var errNoHandover = errors.New("handover: not supported on this platform")
+
+var upgradeSignals []os.Signal
+
+type handoverConn struct{}
+
+func takeOver(path string, log *L.Logger) (*handoverConn, error) {
+	return nil, errNoHandover
+}
+
+func (c *handoverConn) ready() error {
+	return errNoHandover
+}
+
+func serveHandover(path string, log *L.Logger) (<-chan struct{}, error) {
+	return nil, errNoHandover
+}
+
+func spawnUpgrade(log *L.Logger) {}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
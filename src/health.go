@@ -0,0 +1,216 @@
+// health.go -- liveness and readiness of the proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A parent that took a connection this recently isn't probed
+	HEALTH_FRESH = 10 * time.Second
+
+	// Time a probe of a parent may take
+	HEALTH_TIMEOUT = time.Second
+)
+
+// What can go wrong with a running proxy. Listeners that closed fail
+// both /healthz and /readyz (a restart brings them back); parents that
+// can't be reached and a config file that no longer parses only fail
+// /readyz, as a restart wouldn't help.
+type healthCheck struct {
+	name  string
+	live  bool // a failure fails liveness too
+	check func() error
+}
+
+var health = struct {
+	sync.Mutex
+	ready   bool // servers started and not stopping
+	cfgfile string
+	checks  map[interface{}]healthCheck
+}{checks: make(map[interface{}]healthCheck)}
+
+// Check the health of 'key' as 'name' until delCheck
+func addCheck(key interface{}, name string, live bool, check func() error) {
+	health.Lock()
+	health.checks[key] = healthCheck{name, live, check}
+	health.Unlock()
+}
+
+func delCheck(key interface{}) {
+	health.Lock()
+	delete(health.checks, key)
+	health.Unlock()
+}
+
+// Mark the proxy ready (once its servers run) or not (once they stop)
+func setReady(ok bool) {
+	health.Lock()
+	health.ready = ok
+	health.Unlock()
+}
+
+// Check that the config file 'fn' still parses; a restart needs it
+func checkConfig(fn string) {
+	health.Lock()
+	health.cfgfile = fn
+	health.Unlock()
+}
+
+// Return an error if any of the listeners 'v' is closed
+func listening(v ...interface{}) func() error {
+	return func() error {
+		for _, x := range v {
+			c, ok := x.(syscall.Conn)
+			if !ok {
+				continue
+			}
+			rc, err := c.SyscallConn()
+			if err == nil {
+				err = rc.Control(func(uintptr) {})
+			}
+			if err != nil {
+				if a, ok := x.(interface{ Addr() net.Addr }); ok {
+					return fmt.Errorf("%s: %s", a.Addr(), err)
+				}
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// The result of a check
+type healthResult struct {
+	name string
+	err  error
+}
+
+// Run the checks (only those of liveness if 'live'); return the results
+// by name and whether all passed.
+func healthReport(live bool) ([]healthResult, bool) {
+	health.Lock()
+	ready, fn := health.ready, health.cfgfile
+	var v []healthCheck
+	for _, c := range health.checks {
+		if c.live || !live {
+			v = append(v, c)
+		}
+	}
+	health.Unlock()
+
+	// parents are probed at the same time
+	res := make([]healthResult, len(v))
+	var wg sync.WaitGroup
+	for i := range v {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i] = healthResult{v[i].name, v[i].check()}
+		}(i)
+	}
+	wg.Wait()
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+
+	if !live {
+		var err error
+		if !ready {
+			err = errors.New("not serving")
+		}
+		res = append([]healthResult{{"servers", err}}, res...)
+		if len(fn) > 0 {
+			_, err := ReadYAML(fn)
+			res = append(res, healthResult{"config", err})
+		}
+	}
+
+	ok := true
+	for _, r := range res {
+		if r.err != nil {
+			ok = false
+		}
+	}
+	return res, ok
+}
+
+// /healthz and /readyz: 200 or 503. With "verbose", an authorized
+// request gets the result of each check.
+func (a *AdminServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, verbose := r.URL.Query()["verbose"]
+	if verbose && !a.authorized(w, r) {
+		return
+	}
+
+	res, ok := healthReport(r.URL.Path == "/healthz")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if verbose {
+		for _, x := range res {
+			if x.err != nil {
+				fmt.Fprintf(w, "[-]%s failed: %s\n", x.name, x.err)
+			} else {
+				fmt.Fprintf(w, "[+]%s ok\n", x.name)
+			}
+		}
+	}
+	if ok {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "failed")
+	}
+}
+
+// Note a connection to the parent that worked
+func (p *parent) seen(err error) {
+	if err == nil {
+		p.Lock()
+		p.okAt = time.Now()
+		p.Unlock()
+	}
+}
+
+// Return nil if the parent took a connection lately or takes one now
+func (p *parent) probe() error {
+	p.Lock()
+	fresh := time.Since(p.okAt) < HEALTH_FRESH
+	p.Unlock()
+	if fresh {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_TIMEOUT)
+	defer cancel()
+	c, err := p.nd.DialContext(ctx, "tcp", p.addr)
+	p.seen(err)
+	if err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,98 @@
+// health_test.go -- tests for the health endpoints
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+	addr := startHTTPProxy(t, &ListenConf{})
+	setReady(true)
+	defer setReady(false)
+
+	get := func(path string, auth bool) (int, string) {
+		req, _ := http.NewRequest("GET", u+path, nil)
+		if auth {
+			req.SetBasicAuth("admin", "adm1n")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	for _, p := range []string{"/healthz", "/readyz"} {
+		if n, s := get(p, false); n != 200 || s != "ok\n" {
+			t.Errorf("%s: %d %q", p, n, s)
+		}
+	}
+	if n, _ := get("/readyz?verbose", false); n != http.StatusUnauthorized {
+		t.Errorf("verbose without password: %d", n)
+	}
+	if n, s := get("/readyz?verbose", true); n != 200 || !strings.Contains(s, "[+]http "+addr+" ok") {
+		t.Errorf("verbose: %d %q", n, s)
+	}
+
+	// A config that no longer parses: not ready, but alive
+	fn := filepath.Join(t.TempDir(), "goproxy.conf")
+	os.WriteFile(fn, []byte("http: [\n"), 0600)
+	checkConfig(fn)
+	if n, s := get("/readyz?verbose", true); n != http.StatusServiceUnavailable || !strings.Contains(s, "[-]config failed") {
+		t.Errorf("bad config: %d %q", n, s)
+	}
+	if n, _ := get("/healthz", false); n != 200 {
+		t.Errorf("bad config, healthz: %d", n)
+	}
+	checkConfig("")
+
+	// A parent that can't be reached
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	startHTTPProxy(t, &ListenConf{Parent: "http://" + ln.Addr().String()})
+	if n, s := get("/readyz?verbose", true); n != http.StatusServiceUnavailable || !strings.Contains(s, "[-]parent "+ln.Addr().String()) {
+		t.Errorf("parent down: %d %q", n, s)
+	}
+	if n, _ := get("/healthz", false); n != 200 {
+		t.Errorf("parent down, healthz: %d", n)
+	}
+}
+
+func TestListening(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	check := listening(ln, pc)
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if err := check(); err == nil || !strings.Contains(err.Error(), ln.Addr().String()) {
+		t.Errorf("closed listener: %v", err)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
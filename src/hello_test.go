@@ -0,0 +1,68 @@
+// hello_test.go -- tests for the ClientHello profiles
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"testing"
+)
+
+// Return the ClientHello crypto/tls sends with 'conf'
+func sentHello(t *testing.T, conf *tls.Config) *clientHello {
+	r, w := net.Pipe()
+	defer r.Close()
+	go tls.Client(w, conf).Handshake()
+	b := make([]byte, 16384)
+	n, _ := r.Read(b)
+	h, err := parseHello(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHelloProfile(t *testing.T) {
+	if f, err := helloProfile("go"); f != nil || err != nil {
+		t.Errorf("go: %v", err)
+	}
+	if _, err := helloProfile("netscape"); err == nil {
+		t.Errorf("unknown profile: no error")
+	}
+
+	tr := newTransport(&dialer{pool: &poolPolicy{hello: helloProfiles["firefox"]}})
+	if n := len(tr.TLSClientConfig.CurvePreferences); n != 4 {
+		t.Errorf("transport: %d groups", n)
+	}
+
+	for name, suites := range map[string][]uint16{"chrome": chromeSuites, "firefox": firefoxSuites, "safari": safariSuites} {
+		c := &tls.Config{ServerName: "example.com"}
+		helloProfiles[name](c)
+		h := sentHello(t, c)
+
+		// the TLS 1.3 suites and those of the profile
+		var tls12 []uint16
+		for _, s := range h.ciphers {
+			if s>>8 != 0x13 {
+				tls12 = append(tls12, s)
+			}
+		}
+		want := sorted(suites)
+		sort.Slice(tls12, func(i, j int) bool { return tls12[i] < tls12[j] })
+		if hex16(tls12) != hex16(want) {
+			t.Errorf("%s: suites %s, want %s", name, hex16(tls12), hex16(want))
+		}
+		if len(h.groups) < len(c.CurvePreferences) || h.groups[0] != uint16(tls.X25519) {
+			t.Errorf("%s: groups %v", name, h.groups)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
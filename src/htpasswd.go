@@ -0,0 +1,261 @@
+// htpasswd.go -- authenticator backed by an htpasswd file
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Seconds between checks of an htpasswd file for changes
+	HTPASSWD_CHECK = 5
+
+	// Verified passwords remembered; bcrypt is slow by design and
+	// HTTP clients send their password with every request
+	HTPASSWD_CACHE = 4096
+)
+
+func init() {
+	RegisterAuth("htpasswd", newHtpasswd)
+}
+
+// Users and password hashes in an htpasswd file ("user:hash" per line,
+// as written by Apache's htpasswd). Hashes are bcrypt ($2y$, $2a$,
+// $2b$), Apache MD5 ($apr1$), MD5 crypt ($1$) or SHA-1 ({SHA}). Blank
+// lines and lines starting with '#' are ignored. The file is read again
+// when it changes; if it can't be read, the old users are kept.
+type htpasswd struct {
+	file string
+
+	sync.Mutex
+	users   map[string]string
+	ok      map[[32]byte]bool // hashes of verified hash+password
+	mtime   time.Time
+	checked time.Time
+}
+
+func newHtpasswd(args map[string]string) (Authenticator, error) {
+	h := &htpasswd{file: args["file"]}
+	if len(h.file) == 0 {
+		return nil, fmt.Errorf("missing 'file'")
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Read the file
+func (h *htpasswd) load() error {
+	fd, err := os.Open(h.file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	sc := bufio.NewScanner(fd)
+	for n := 1; sc.Scan(); n++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexByte(s, ':')
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: not user:hash", h.file, n)
+		}
+		user, hash := s[:i], s[i+1:]
+		if !knownHash(hash) {
+			return fmt.Errorf("%s:%d: %s: unsupported password hash", h.file, n, user)
+		}
+		users[user] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.users, h.mtime = users, fi.ModTime()
+	h.ok = make(map[[32]byte]bool)
+	h.Unlock()
+	return nil
+}
+
+// Reload the file if it changed; at most every HTPASSWD_CHECK seconds
+func (h *htpasswd) refresh() {
+	h.Lock()
+	now := time.Now()
+	if now.Sub(h.checked) < HTPASSWD_CHECK*time.Second {
+		h.Unlock()
+		return
+	}
+	h.checked = now
+	mtime := h.mtime
+	h.Unlock()
+
+	if fi, err := os.Stat(h.file); err == nil && !fi.ModTime().Equal(mtime) {
+		h.load()
+	}
+}
+
+func (h *htpasswd) Authenticate(ctx context.Context, user, pass string) error {
+	h.refresh()
+
+	h.Lock()
+	hash, ok := h.users[user]
+	h.Unlock()
+	if !ok {
+		return errAuthFailed
+	}
+
+	key := sha256.Sum256([]byte(hash + "\x00" + pass))
+	h.Lock()
+	ok = h.ok[key]
+	h.Unlock()
+	if ok {
+		return nil
+	}
+
+	if !checkHash(hash, pass) {
+		return errAuthFailed
+	}
+
+	h.Lock()
+	if len(h.ok) >= HTPASSWD_CACHE {
+		h.ok = make(map[[32]byte]bool)
+	}
+	h.ok[key] = true
+	h.Unlock()
+	return nil
+}
+
+func knownHash(hash string) bool {
+	for _, p := range []string{"$2y$", "$2a$", "$2b$", "$apr1$", "$1$", "{SHA}"} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if 'pass' matches 'hash'
+func checkHash(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+
+	case strings.HasPrefix(hash, "$apr1$"):
+		return equalHash(hash, md5Crypt(pass, hash, "$apr1$"))
+
+	case strings.HasPrefix(hash, "$1$"):
+		return equalHash(hash, md5Crypt(pass, hash, "$1$"))
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return equalHash(hash, "{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return false
+}
+
+func equalHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const cryptB64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// MD5 crypt (FreeBSD's, and Apache's with magic "$apr1$") of 'pass'
+// with the salt of 'hash'
+func md5Crypt(pass, hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	pw := []byte(pass)
+	alt := md5.Sum([]byte(pass + salt + pass))
+
+	d := md5.New()
+	d.Write([]byte(pass + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	// Slow it down
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(pw)
+		}
+		sum = d.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	enc := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(cryptB64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		enc(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	enc(uint(sum[11]), 2)
+	return b.String()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -10,27 +10,34 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
-	L "github.com/opencoff/go-logger"
+	L "github.com/opencoff/go-proxies/logger"
 	"github.com/opencoff/go-ratelimit"
 )
 
 type HTTPProxy struct {
 	*net.TCPListener
 
+	// accept shards after the first (the TCPListener)
+	shards []*net.TCPListener
+
 	// listen address
 	conf *ListenConf
 
 	grl *ratelimit.RateLimiter
-	prl *ratelimit.PerIPRateLimiter
+	prl *srcLimiter
+	crl *connLimiter // nil if conns at once aren't limited
 
 	log  *L.Logger
 	ulog *L.Logger
@@ -38,7 +45,28 @@ type HTTPProxy struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	tr *http.Transport
+	dial *dialer
+	lim  *limits
+	cp   *clientPolicy
+	pool *bufPool
+	tr   *http.Transport
+	h2   *h2Pool
+	utr  *userTransports // users with their own source addresses
+
+	cache   *httpCache
+	comp    *compressor
+	pages   *errorPages // nil if none
+	captive *captive    // nil if off
+	filters *filterChain
+	auth    *clientAuth
+	tls     *listenTLS
+	trans   Transport  // of clients; nil if none
+	cip     *connectIP // nil if off
+
+	// SOCKS clients of a mixed listener and the HTTP connections
+	// sorted from them; nil if not mixed
+	socks *socksProxy
+	conns chan net.Conn
 
 	srv *http.Server
 
@@ -52,54 +80,181 @@ func NewHTTPProxy(lc *ListenConf, log, ulog *L.Logger) (Proxy, error) {
 		die("Can't resolve %s: %s", addr, err)
 	}
 
-	ln, err := net.ListenTCP("tcp", la)
+	ln, err := listenTCP(lc, la, log)
+	if err != nil {
+		die("Can't listen on %s: %s", addr, err)
+	}
+	shards, err := listenShards(lc, ln, log)
 	if err != nil {
 		die("Can't listen on %s: %s", addr, err)
 	}
 
 	// Conf file specifies ratelimit as N conns/sec
 	grl, _ := ratelimit.New(lc.Ratelimit.Global, 1)
-	prl, _ := ratelimit.NewPerIP(lc.Ratelimit.PerHost, 1, 30000)
-
-	ctx, cancel := context.WithCancel(context.Background())
+	prl, err := newSrcLimiter(&lc.Ratelimit, "http:"+lc.Listen)
+	if err != nil {
+		return nil, err
+	}
 
-	d := &net.Dialer{
-		Timeout:   5 * time.Second,
-		KeepAlive: 10 * time.Second,
+	d, err := newDialer(lc, log)
+	if err != nil {
+		return nil, err
 	}
 
+	lim := newLimits(&lc.Limits)
+	cp := newClientPolicy(&lc.Client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	p := &HTTPProxy{
 		TCPListener: ln,
+		shards:      shards,
 		conf:        lc,
-		log:         log.New("http-"+ln.Addr().String(), 0),
+		log:         log.New(logName("http", lc, ln.Addr()), 0),
 		ulog:        ulog,
 		grl:         grl,
 		prl:         prl,
+		crl:         newConnLimiter(&lc.Ratelimit, "http:"+lc.Listen),
 		ctx:         ctx,
 		cancel:      cancel,
+		dial:        d,
+		lim:         lim,
+		cp:          cp,
+		pool:        getPool(lc.Bufsize),
 
-		tr: &http.Transport{
-			Dial:                d.Dial,
-			TLSHandshakeTimeout: 8 * time.Second,
-			MaxIdleConnsPerHost: 32,
-			IdleConnTimeout:     60 * time.Second,
-		},
+		tr:          newTransport(d),
 
 		srv: &http.Server{
-			Addr:           addr,
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+			Addr:              addr,
+			ReadHeaderTimeout: cp.handshake,
+			IdleTimeout:       cp.idle,
+			MaxHeaderBytes:    lim.headerBytes,
 		},
 	}
 
 	p.srv.Handler = p
 
+	if p.cache, err = newHTTPCache(&lc.HTTPCache, ln.Addr().String(), p.log); err != nil {
+		return nil, err
+	}
+	if p.cache != nil {
+		addCollector(p.cache)
+	}
+
+	if d.egress != nil {
+		p.utr = &userTransports{d: d, http2: lc.Pool.HTTP2, m: make(map[string]*http.Transport)}
+		addCollector(d.egress)
+	}
+	if d.chaos != nil {
+		addCollector(d.chaos)
+	}
+	if d.mirrors != nil {
+		addCollector(d.mirrors)
+	}
+	if d.ech != nil {
+		addCollector(d.ech)
+	}
+	if d.wg != nil {
+		addCollector(d.wg)
+	}
+	if d.jumps != nil {
+		addCollector(d.jumps)
+	}
+	if d.script != nil {
+		addCollector(d.script)
+	}
+
+	if lc.Pool.HTTP2 {
+		if p.h2, err = enableHTTP2(p.tr, &lc.Pool, d, ln.Addr().String()); err != nil {
+			return nil, err
+		}
+		addCollector(p.h2)
+	}
+
+	if p.auth, err = newClientAuth(lc, ln.Addr().String()); err != nil {
+		return nil, err
+	}
+	if p.auth != nil {
+		addCollector(p.auth)
+		if p.auth.neg != nil {
+			p.srv.ConnContext = withConnAuth
+		}
+	}
+	d.restrict(p.auth)
+
+	if p.tls, err = newListenTLS(&lc.TLS, p.log); err != nil {
+		return nil, err
+	}
+	if p.trans, err = newStreamTransport(&lc.Transport); err != nil {
+		return nil, err
+	}
+	if len(lc.Trojan.Users) > 0 {
+		return nil, fmt.Errorf("trojan: only on socks listeners")
+	}
+	if p.cip, err = newConnectIP(&lc.ConnectIP, ln.Addr().String()); err != nil {
+		return nil, err
+	}
+	if p.cip != nil {
+		addCollector(p.cip)
+	}
+
+	if p.filters, err = newFilterChain(lc); err != nil {
+		return nil, err
+	}
+
+	if p.comp, err = newCompressor(&lc.Compress, ln.Addr().String()); err != nil {
+		return nil, err
+	}
+	if p.pages, err = newErrorPages(lc); err != nil {
+		return nil, err
+	}
+	if p.captive, err = newCaptive(&lc.Captive, ln.Addr().String(), lc.Tenant); err != nil {
+		return nil, err
+	}
+	if p.captive != nil {
+		addCollector(p.captive)
+	}
+	if p.comp != nil {
+		addCollector(p.comp)
+	}
+
+	if lc.Mixed {
+		if err = p.mixed(); err != nil {
+			return nil, err
+		}
+	}
+	if lc.Mixed || (p.tls != nil && p.tls.plain) {
+		p.conns = make(chan net.Conn)
+	}
+
 	return p, nil
 }
 
 // Start listener
 func (p *HTTPProxy) Start() {
+	lns := []interface{}{p.TCPListener}
+	for _, ln := range p.shards {
+		lns = append(lns, ln)
+	}
+	addCheck(p, "http "+p.Addr().String(), true, listening(lns...))
+
+	if p.conns != nil {
+		if p.socks != nil {
+			p.log.Info("Starting HTTP and SOCKS proxy ..")
+		} else {
+			p.log.Info("Starting HTTP proxy ..")
+		}
+		for _, ln := range append([]*net.TCPListener{p.TCPListener}, p.shards...) {
+			p.wg.Add(1)
+			go p.sortConns(ln)
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.srv.Serve(mixedListener{p})
+		}()
+		return
+	}
 
 	p.wg.Add(1)
 	go func() {
@@ -107,49 +262,216 @@ func (p *HTTPProxy) Start() {
 		p.log.Info("Starting HTTP proxy ..")
 		p.srv.Serve(p)
 	}()
+
+	if len(p.shards) > 0 {
+		p.log.Info("%d accept shards (SO_REUSEPORT)", len(p.shards)+1)
+	}
+	for _, ln := range p.shards {
+		p.wg.Add(1)
+		go func(ln *net.TCPListener) {
+			defer p.wg.Done()
+			p.srv.Serve(&httpShard{ln, p})
+		}(ln)
+	}
 }
 
 // Stop server
-// XXX Hijacked Websocket conns are not shutdown here
 func (p *HTTPProxy) Stop() {
+	delCheck(p)
 	p.cancel()
 	p.TCPListener.Close() // causes Accept() to abort
+	for _, ln := range p.shards {
+		ln.Close()
+	}
 
 	cx, cancel := context.WithTimeout(p.ctx, 10*time.Second)
 	p.srv.Shutdown(cx)
 	cancel()
 
 	p.wg.Wait()
+	if p.socks != nil {
+		p.socks.wg.Wait()
+	}
+	if p.auth != nil {
+		p.auth.Close()
+	}
+	p.tr.CloseIdleConnections()
+	if p.utr != nil {
+		p.utr.Close()
+	}
+	if p.h2 != nil {
+		p.h2.Close()
+	}
+	p.tls.close()
+	p.dial.Close()
 	p.log.Info("HTTP proxy shutdown")
 }
 
-// XXX How do we handle websockets?
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// XXX Error counts written somewhere?
 
+	// Each request is a session; its log lines start with the id. It
+	// ends when the listener stops: the server's Shutdown() doesn't
+	// close hijacked connections.
+	ctx, end := withSession(r.Context(), p.log)
+	defer end()
+	defer context.AfterFunc(p.ctx, end)()
+	r = r.WithContext(ctx)
+	log := logOf(r.Context(), p.log)
+
+	if code, why := p.lim.check(r); code != 0 {
+		log.Info("%s: rejected %s %.64q: %s", r.RemoteAddr, r.Method, r.RequestURI, why)
+		p.httpError(w, r, why, code, "")
+		return
+	}
+
+	// Bodies of unknown length are cut off at the limit
+	if p.lim.body > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, p.lim.body)
+	}
+
+	// Bodies are subject to the client policy (see slowBody and
+	// slowWriter); this bounds the rest of what we write until we wait
+	// on an upstream. Each upstream wait is followed by another respond().
+	p.cp.respond(w)
+
+	// Outbound policy needs to know the client
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		r = r.WithContext(withTenant(withClient(r.Context(), net.ParseIP(host)), p.conf.Tenant))
+	}
+
+	// A span for the request; part of the client's trace if it sent one
+	if ctx, sp := traceSession(r.Context(), r.Method, r.Header.Get("Traceparent")); sp != nil {
+		defer sp.finish()
+		sp.set("client.address", r.RemoteAddr)
+		sp.set("server.address", extractHost(r.URL))
+		sp.set("goproxy.listen", p.conf.Listen)
+		sp.set("goproxy.session", sessionOf(ctx))
+		r = r.WithContext(ctx)
+	}
+
+	// A client certificate names the user; no password is needed
+	certified := false
+	cs := r.TLS
+	if cs == nil {
+		cs = connTLSOf(r.Context())
+	}
+	if cs != nil && p.tls != nil {
+		user, err := p.tls.user(cs)
+		if err != nil {
+			log.Info("%s: %s", r.RemoteAddr, err)
+			p.httpError(w, r, "Client certificate not allowed", http.StatusForbidden, "")
+			return
+		}
+		if len(user) > 0 {
+			r = r.WithContext(withUser(r.Context(), user))
+			certified = true
+		}
+	}
+
+	if p.auth != nil && !certified {
+		var ok bool
+		if r, ok = p.authenticate(w, r); !ok {
+			return
+		}
+	}
+
+	if p.captive != nil && !p.captivePortal(w, r) {
+		return
+	}
+
+	if p.filters != nil {
+		var ok bool
+		if r, ok = p.filterRequest(w, r); !ok {
+			return
+		}
+	}
+
 	if r.Method == "CONNECT" {
 		p.handleConnect(w, r)
 		return
 	}
 
+	if p.cip != nil && isConnectIP(r) {
+		p.handleConnectIP(w, r)
+		return
+	}
+
 	if !r.URL.IsAbs() {
-		p.log.Debug("%s: non-proxy req for %q", r.Host, r.URL.String())
+		log.Debug("%s: non-proxy req for %q", r.Host, r.URL.String())
 		http.Error(w, "No support for non-proxy requests", 500)
 		return
 	}
 
+	// WebSockets and other protocol switches
+	if proto := upgradeType(r.Header); len(proto) > 0 {
+		p.handleUpgrade(w, r, proto)
+		return
+	}
+
+	if p.comp != nil {
+		cw := p.comp.writer(w, r)
+		defer cw.Close()
+		w = cw
+	}
+
+	if r.URL.Scheme == "ftp" {
+		p.serveFTP(w, r)
+		return
+	}
+
 	t0 := time.Now()
 
-	ctx := r.Context()
+	var hit *cacheHit
+	if p.cache != nil {
+		if hit = p.cache.lookup(r); hit != nil {
+			defer hit.Close()
+			if hit.fresh {
+				nr := p.cache.serve(p.cp.writer(w, r, log), r, hit, "HIT")
+				p.logRequest(r, hit.Status, nr, t0, t0, "HIT")
+				return
+			}
+		}
+
+		if onlyIfCached(r) {
+			http.Error(w, "Not in cache", http.StatusGatewayTimeout)
+			return
+		}
+	}
+
+	ctx = r.Context()
 
 	req := r.WithContext(ctx) // includes shallow copy of maps etc.
 	if r.ContentLength == 0 {
 		req.Body = nil
+	} else {
+		req.Body = p.cp.body(w, r, log)
 	}
 
 	req.Header = cloneCleanHeader(r.Header)
 	req.Close = false
 
+	// The origin can log the session id
+	if p.conf.RequestId && len(req.Header.Get("X-Request-Id")) == 0 {
+		req.Header.Set("X-Request-Id", sessionOf(ctx))
+	}
+
+	// The origin's spans are children of ours
+	if sp := spanOf(ctx); sp != nil && sp.t.propagate {
+		req.Header.Set("Traceparent", sp.traceparent())
+	}
+
+	// The script may change the headers or deny the request
+	if err := p.dial.script.request(ctx, r, req); err != nil {
+		log.Info("%s: %s", r.RemoteAddr, err)
+		p.replyError(w, r, err, r.Host)
+		return
+	}
+
+	if hit != nil {
+		hit.condition(req)
+	}
+
 	/* XXX use config file to determine if we want to set XFF
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		// If we aren't the first proxy retain prior
@@ -162,16 +484,121 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	*/
 
-	res, err := p.tr.RoundTrip(r)
+	// A pooled upstream connection that has outlived the pool lifetime
+	// serves this request with "Connection: close"; the transport then
+	// drops it instead of putting it back. The transport copies requests
+	// with a body before it picks a connection, so those can't do this;
+	// the connection is retired by the next request without one.
+	var hs *span
+	var th time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(ci httptrace.GotConnInfo) {
+			if ci.Reused {
+				p.dial.reused(ctx, extractHost(r.URL), ci.Conn)
+				if expired(ci.Conn) {
+					req.Close = true
+				}
+			}
+		},
+		TLSHandshakeStart: func() {
+			th = time.Now()
+			hs = startSpan(ctx, "handshake", _SPAN_CLIENT)
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				hs.set("tls.protocol.version", tls.VersionName(cs.Version))
+				observe("goproxy_tls_handshake_seconds", routeLabels(ctx, p.conf.Listen), time.Since(th))
+			}
+			hs.fail(err)
+			hs.finish()
+		},
+		GotFirstResponseByte: func() {
+			observe("goproxy_ttfb_seconds", routeLabels(ctx, p.conf.Listen), time.Since(t0))
+		},
+	}
+	rs := &retryState{}
+	rs.hook(trace)
+	req = req.WithContext(httptrace.WithClientTrace(withRetry(ctx, rs), trace))
+
+	var res *http.Response
+	err := anomalies.start(ctx, extractHost(r.URL))
+	if err == nil {
+		err = p.dial.Preflight(ctx, extractHost(r.URL))
+	}
+	if err == nil {
+		res, err = p.roundTrip(req, rs)
+	}
+	p.cp.respond(w)
 	if err != nil {
-		p.log.Debug("%s: %s", r.Host, err)
-		http.Error(w, err.Error(), 500)
+		spanOf(ctx).fail(err)
+		if pe := isDenied(err); pe != nil {
+			log.Info("%s: %s", r.RemoteAddr, pe)
+			p.replyError(w, r, err, r.Host)
+			return
+		}
+
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			log.Info("%s: rejected %s %.64q: request body exceeds %d bytes",
+				r.RemoteAddr, r.Method, r.RequestURI, mbe.Limit)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		noteSession(true)
+		if de := isDNSSEC(err); de != nil {
+			log.Info("%s: %s", r.RemoteAddr, de)
+		} else {
+			log.Debug("%s: %s", r.Host, err)
+		}
+		p.replyError(w, r, err, r.Host)
 		return
 	}
 
 	t1 := time.Now()
 
-	copyHeader(w.Header(), res.Header)
+	if max := p.lim.response; max > 0 && res.ContentLength > max {
+		res.Body.Close()
+		log.Info("%s: response to %s %.64q too large (%d > %d bytes)",
+			r.RemoteAddr, r.Method, r.RequestURI, res.ContentLength, max)
+		http.Error(w, "Response too large", http.StatusBadGateway)
+		return
+	}
+
+	// Responses served from the cache were filtered when they were stored
+	if p.filters != nil && !p.filterResponse(w, r, res) {
+		return
+	}
+
+	// The script's changes to the headers are the client's alone; they
+	// aren't in the cache, and hits don't run the script
+	hdr := res.Header
+	if p.dial.script.has(hookResponse) {
+		hdr = res.Header.Clone()
+		if err := p.dial.script.response(ctx, r, res.StatusCode, hdr); err != nil {
+			res.Body.Close()
+			http.Error(w, "Script failed", http.StatusBadGateway)
+			return
+		}
+	}
+
+	var fill *cacheFill
+	if p.cache != nil {
+		if hit != nil && res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+
+			p.cache.refresh(hit, res, t0, t1)
+			nr := p.cache.serve(p.cp.writer(w, r, log), r, hit, "REVALIDATED")
+			p.logRequest(r, hit.Status, nr, t0, t1, "REVALIDATED")
+			return
+		}
+
+		p.cache.invalidate(r, res)
+		if fill = p.cache.fill(r, res, t0, t1); fill != nil {
+			w.Header().Set("X-Cache", "MISS")
+		}
+	}
+
+	copyHeader(w.Header(), hdr)
 
 	// The "Trailer" header isn't included in the Transport's response,
 	// at least for *http.Transport. Build it up from Trailer.
@@ -194,8 +621,30 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	nr, _ := io.Copy(w, res.Body)
+	var dst io.Writer = p.cp.writer(w, r, log)
+	if fill != nil {
+		dst = io.MultiWriter(dst, fill)
+	}
+
+	rl := startSpan(ctx, "relay", _SPAN_INTERNAL)
+	b := p.pool.Get()
+	nr, err := io.CopyBuffer(dst, p.lim.responseBody(res.Body), *b)
+	p.pool.Put(b)
 	res.Body.Close() // close now, instead of defer, to populate res.Trailer
+	rl.set("http.response.body.size", nr)
+	rl.fail(err)
+	rl.finish()
+
+	if fill != nil {
+		fill.commit(err == nil)
+	}
+
+	// The client must not mistake what it got for the whole response
+	if err == errResponseTooLarge {
+		log.Info("%s: response to %s %.64q aborted after %d bytes: %s",
+			r.RemoteAddr, r.Method, r.RequestURI, nr, err)
+		panic(http.ErrAbortHandler)
+	}
 
 	if len(res.Trailer) == announcedTrailers {
 		copyHeader(w.Header(), res.Trailer)
@@ -208,21 +657,91 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	how := ""
+	if fill != nil {
+		how = "MISS"
+	}
+	p.logRequest(r, res.StatusCode, nr, t0, t1, how)
+}
+
+// Log a completed request; upstream took from 't0' to 't1' and the rest
+// was the relay to the client. 'how' is the cache result, if any.
+func (p *HTTPProxy) logRequest(r *http.Request, status int, nr int64, t0, t1 time.Time, how string) {
+	log := logOf(r.Context(), p.log)
+	spanOf(r.Context()).set("http.response.status_code", int64(status))
 	t2 := time.Now()
 
-	p.log.Debug("%s: %d %d %s %s\n", r.Host, res.StatusCode, nr, t2.Sub(t0), r.URL.String())
+	notes := filterNotes(r.Context())
+
+	log.Debug("%s: %d %d %s %s %s %s\n", r.Host, status, nr, t2.Sub(t0), r.URL.String(), how, notes)
+
+	// Upgraded connections are sessions of their own
+	if status != http.StatusSwitchingProtocols {
+		p.auth.request(r, t0, nr)
+
+		ctx := r.Context()
+		n := nr
+		if r.ContentLength > 0 {
+			n += r.ContentLength
+		}
+		tenant, user, dest := p.conf.Tenant, userOf(ctx), extractHost(r.URL)
+		talk(tenantUser(tenant, user), clientOf(ctx), dest, n, 1, t2)
+		exports.add(tenant, user, dest, n, 1, t2)
+		var in int64
+		if r.ContentLength > 0 {
+			in = r.ContentLength
+		}
+		events.session(sessionOf(ctx), p.conf.Listen, "http", tenant, user, clientOf(ctx),
+			dest, t0, in, nr, t2)
+		noteSession(status >= 500)
+		if how != "HIT" {
+			observe("goproxy_session_seconds", routeLabels(ctx, p.conf.Listen)+`,proto="http"`, t2.Sub(t0))
+		}
+	}
+
 	// Timing log
 	if p.ulog != nil {
 		d0 := format(t1.Sub(t0))
 		d1 := format(t2.Sub(t1))
 
-		now := time.Now().UTC().Format(time.RFC3339)
+		now := time.Now().UTC().Format(ACCESS_TIME)
 
-		p.ulog.Info("time=%q url=%q status=\"%d\" bytes=\"%d\" upstream=%q downstream=%q",
-			now, r.URL.String(), res.StatusCode, nr, d0, d1)
+		var sent int64
+		if r.ContentLength > 0 {
+			sent = r.ContentLength
+		}
+		s := fmt.Sprintf("time=%q url=%q status=\"%d\" bytes=\"%d\" upstream=%q downstream=%q cache=%q method=%q sent=\"%d\" id=%q",
+			now, r.URL.String(), status, nr, d0, d1, how, r.Method, sent, sessionOf(r.Context()))
+		if len(notes) > 0 {
+			s += fmt.Sprintf(" notes=%q", notes)
+		}
+		p.ulog.Info(s + anomalies.tags(r.Context()))
 	}
 }
 
+// Tell the rate limited client on 'nc' when to come back and close it.
+// Only plaintext HTTP clients can be answered before their request is
+// read; the rest are just closed.
+func (p *HTTPProxy) tooMany(nc net.Conn) {
+	if p.tls != nil || p.trans != nil || p.conns != nil {
+		nc.Close()
+		return
+	}
+
+	// Closing with the request unread resets the connection, and with
+	// it the reply; read it for a bit first.
+	go func() {
+		nc.SetDeadline(time.Now().Add(RATELIMIT_RETRY * time.Second))
+		fmt.Fprintf(nc, "HTTP/1.1 429 Too Many Requests\r\nRetry-After: %d\r\n"+
+			"Content-Length: 0\r\nConnection: close\r\n\r\n", RATELIMIT_RETRY)
+		if tc, ok := nc.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		io.Copy(io.Discard, io.LimitReader(nc, MAX_HEADER_BYTES))
+		nc.Close()
+	}()
+}
+
 func extractHost(u *url.URL) string {
 	h := u.Host
 
@@ -235,53 +754,120 @@ func extractHost(u *url.URL) string {
 
 // handle HTTP CONNECT
 func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	log := logOf(r.Context(), p.log)
 
 	h, ok := w.(http.Hijacker)
 	if !ok {
-		p.log.Warn("can't do CONNECT: hijack failed")
+		log.Warn("can't do CONNECT: hijack failed")
 		http.Error(w, "Can't support CONNECT", http.StatusNotImplemented)
 		return
 	}
 
-	client, _, err := h.Hijack()
-	if err != nil {
-		// Likely HTTP/2.x -- its OK
-		p.log.Warn("can't do CONNECT: hijack failed: %s", err)
-		http.Error(w, "Can't support CONNECT", http.StatusNotImplemented)
-		client.Close()
-		return
-	}
-
 	host := extractHost(r.URL)
 
 
 	ctx := r.Context()
 
-	dest, err := p.tr.DialContext(ctx, "tcp", host)
+	// Connect before hijacking so that errors can be reported to the
+	// client as HTTP responses.
+	err := anomalies.start(ctx, host)
+	var dest net.Conn
+	if err == nil {
+		dest, err = p.dial.DialContext(ctx, "tcp", host)
+	}
+	p.cp.respond(w)
 	if err != nil {
-		p.log.Debug("can't connect to %s: %s", host, err)
-		http.Error(w, fmt.Sprintf("can't connect to %s", host), http.StatusInternalServerError)
-		client.Close()
+		spanOf(ctx).fail(err)
+		if pe := isDenied(err); pe != nil {
+			log.Info("%s: %s", r.RemoteAddr, pe)
+			p.replyError(w, r, err, host)
+			return
+		}
+		noteSession(true)
+		if de := isDNSSEC(err); de != nil {
+			log.Info("%s: %s", r.RemoteAddr, de)
+		} else {
+			log.Debug("can't connect to %s: %s", host, err)
+		}
+		p.replyError(w, r, err, host)
+		return
+	}
+
+	client, _, err := h.Hijack()
+	if err != nil {
+		// Likely HTTP/2.x -- its OK
+		log.Warn("can't do CONNECT: hijack failed: %s", err)
+		http.Error(w, "Can't support CONNECT", http.StatusNotImplemented)
+		dest.Close()
 		return
 	}
 
+	// The hijacked conn keeps the deadline set by respond()
 	client.Write(_200Ok)
+	spanOf(ctx).set("http.response.status_code", int64(http.StatusOK))
 
-	s := client.(*net.TCPConn)
-	d := dest.(*net.TCPConn)
+	s := clientConn(client)
+	d := fairShare.wrap(ctx, anomalies.wrap(ctx, p.dial.watchFTP(ctx, host, dest))).(tcpConn)
 
-	p.log.Debug("%s: CONNECT %s", s.RemoteAddr().String(), host)
+	log.Debug("%s: CONNECT %s %s", s.RemoteAddr().String(), host, filterNotes(ctx))
+
+	// The protocol in the tunnel, for the log and the rules keyed on it
+	var pre []byte
+	var proto, fp string
+	if p.dial.sniffs(&p.conf.Tunnel) {
+		if pre, proto, err = sniffTunnel(s); err == nil {
+			pre, fp = fingerprintTunnel(ctx, &p.conf.Tunnel, s, pre, proto)
+			err = p.dial.CheckProto(ctx, host, d, proto)
+		}
+		if err != nil {
+			if pe := isDenied(err); pe != nil {
+				log.Info("%s: %s (%s)", r.RemoteAddr, pe, proto)
+			}
+			s.Close()
+			d.Close()
+			return
+		}
+	}
 
 
 	cp := &CancellableCopier{
 		Lhs:          s,
 		Rhs:          d,
-		ReadTimeout:  10,	// XXX Config file
+		ReadTimeout:  p.conf.Tunnel.Idle,
 		WriteTimeout: 15,	// XXX Config file
-		IOBufsize:    16384,
+		Linger:       p.conf.Tunnel.Linger,
+		Sockmap:      p.conf.Tunnel.Sockmap,
+		IOBufsize:    p.conf.Bufsize,
+		MaxBytes:     p.conf.Tunnel.MaxBytes,
+		Prelude:      pre,
+	}
+
+	t0 := time.Now()
+	sess := p.auth.begin(ctx, "connect", host, cp.Moved)
+	live := startSession(ctx, p.conf.Listen, "connect", host, cp, cp.Moved)
+	rl := startSpan(ctx, "relay", _SPAN_INTERNAL)
+	if _, _, err := cp.Copy(ctx); err != nil {
+		log.Info("%s: CONNECT %s closed: %s (limit %d bytes)",
+			s.RemoteAddr().String(), host, err, cp.MaxBytes)
+		rl.fail(err)
+	} else if err := cutShort(ctx); err != nil {
+		log.Info("%s: CONNECT %s closed: %s", s.RemoteAddr().String(), host, err)
+		rl.fail(err)
 	}
+	traceMoved(rl, cp.Moved)
+	live.done()
+	p.auth.end(sess)
 
-	cp.Copy(ctx)
+	if p.ulog != nil {
+		in, out := cp.Moved()
+		now := time.Now().UTC()
+		tags := anomalies.tags(ctx)
+		if len(proto) > 0 {
+			tags = fmt.Sprintf(" proto=%q", proto) + fp + tags
+		}
+		p.ulog.Info("time=%q url=%q status=\"200\" bytes=\"%d\" upstream=%q downstream=%q cache=\"\" method=\"CONNECT\" sent=\"%d\" id=%q%s",
+			now.Format(ACCESS_TIME), host, out, format(now.Sub(t0)), format(0), in, sessionOf(ctx), tags)
+	}
 }
 
 
@@ -292,7 +878,22 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 //   - And, Serve() calls Accept() before starting service
 //     go-routines
 func (p *HTTPProxy) Accept() (net.Conn, error) {
-	ln := p.TCPListener
+	return p.accept(p.TCPListener)
+}
+
+// An accept shard of an HTTP proxy: another socket on its address
+type httpShard struct {
+	*net.TCPListener
+	p *HTTPProxy
+}
+
+func (s *httpShard) Accept() (net.Conn, error) {
+	return s.p.accept(s.TCPListener)
+}
+
+// Return the next connection on 'ln' that passes the rate limits and
+// ACLs
+func (p *HTTPProxy) accept(ln *net.TCPListener) (net.Conn, error) {
 	for {
 		nc, err := ln.Accept()
 		select {
@@ -312,14 +913,16 @@ func (p *HTTPProxy) Accept() (net.Conn, error) {
 		}
 
 		if p.grl.Limit() {
-			nc.Close()
-			p.log.Debug("%s: globally ratelimited", nc.RemoteAddr().String())
+			p.log.Debug("%s: globally ratelimited: limit=global retry-after=%ds",
+				nc.RemoteAddr().String(), RATELIMIT_RETRY)
+			p.tooMany(nc)
 			continue
 		}
 
-		if p.prl.Limit(nc.RemoteAddr()) {
-			nc.Close()
-			p.log.Debug("%s: per-IP ratelimited", nc.RemoteAddr().String())
+		if p.prl.LimitConn(nc) {
+			p.log.Debug("%s: per-IP ratelimited: limit=perhost retry-after=%ds",
+				nc.RemoteAddr().String(), RATELIMIT_RETRY)
+			p.tooMany(nc)
 			continue
 		}
 
@@ -329,6 +932,25 @@ func (p *HTTPProxy) Accept() (net.Conn, error) {
 			continue
 		}
 
+		held, ok := p.crl.hold(nc)
+		if !ok {
+			p.log.Debug("%s: too many conns: limit=maxconns retry-after=%ds",
+				nc.RemoteAddr().String(), RATELIMIT_RETRY)
+			p.tooMany(nc)
+			continue
+		}
+		nc = held
+
+		if p.trans != nil {
+			nc = serverTransport(p.trans, nc)
+		}
+
+		// The server doesn't bound the TLS handshake; requests reset
+		// the deadlines.
+		if p.tls != nil && p.conns == nil {
+			nc.SetDeadline(time.Now().Add(p.cp.handshake))
+			return p.tls.server(nc), nil
+		}
 		return nc, nil
 	}
 }
@@ -0,0 +1,292 @@
+// http2.go -- HTTP/2 to origins with connection coalescing
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// Max HTTP/2 connections remembered for coalescing
+const H2_CONNS = 256
+
+// HTTP/2 to origins. TLS origins that offer h2 (ALPN) get it; others
+// stay on HTTP/1.1. A request for a host we have no connection to
+// reuses a connection to another host if both resolve to the same
+// address and the certificate of the connection covers the new host
+// (RFC 9113, 9.1.1) - one connection serves all the names of a CDN.
+// Origins listed in "h2c" get cleartext HTTP/2 with prior knowledge.
+type h2Pool struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	conns     uint64
+	coalesced uint64
+
+	http2.ClientConnPool
+
+	d        *dialer
+	name     string
+	coalesce bool
+
+	// resolves hosts for coalescing; tests replace it
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	sync.Mutex
+	v     []*h2Conn
+	alias map[string]string // addr -> addr of the connection it uses
+
+	h2c   *http2.Transport
+	hosts map[string]bool // h2c origins: host or host:port
+}
+
+// An HTTP/2 connection we can coalesce onto
+type h2Conn struct {
+	addr string // host:port it was made for
+	ip   net.IP
+	port string
+	cert *x509.Certificate
+	c    *tls.Conn
+}
+
+// Speak HTTP/2 through 'tr' to origins that offer it; 'd' makes the
+// connections to h2c origins. Coalescing is off through a parent proxy:
+// we can't see where its connections go.
+func enableHTTP2(tr *http.Transport, pc *PoolConf, d *dialer, name string) (*h2Pool, error) {
+	t2, err := http2.ConfigureTransports(tr)
+	if err != nil {
+		return nil, fmt.Errorf("http2: %s", err)
+	}
+
+	p := &h2Pool{
+		ClientConnPool: t2.ConnPool,
+		d:              d,
+		name:           name,
+		coalesce:       d.parent == nil,
+		lookup:         d.lookupIP,
+		alias:          make(map[string]string),
+	}
+	t2.ConnPool = p
+
+	// Connections that speak h2 come through here
+	upgrade := tr.TLSNextProto["h2"]
+	tr.TLSNextProto["h2"] = func(authority string, c *tls.Conn) http.RoundTripper {
+		p.add(authority, c)
+		return upgrade(authority, c)
+	}
+
+	if len(pc.H2C) > 0 {
+		p.hosts = make(map[string]bool)
+		for _, h := range pc.H2C {
+			p.hosts[strings.ToLower(h)] = true
+		}
+		p.h2c = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		tr.RegisterProtocol("http", h2cRoundTripper{p})
+	}
+	return p, nil
+}
+
+// Remember the new h2 connection 'c' to 'authority'
+func (p *h2Pool) add(authority string, c *tls.Conn) {
+	atomic.AddUint64(&p.conns, 1)
+
+	cs := c.ConnectionState()
+	ta, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !p.coalesce || !ok || len(cs.PeerCertificates) == 0 {
+		return
+	}
+
+	addr := authority
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	_, port, _ := net.SplitHostPort(addr)
+
+	hc := &h2Conn{
+		addr: strings.ToLower(addr),
+		ip:   ta.IP,
+		port: port,
+		cert: cs.PeerCertificates[0],
+		c:    c,
+	}
+
+	p.Lock()
+	if len(p.v) >= H2_CONNS {
+		p.v = p.v[1:]
+	}
+	p.v = append(p.v, hc)
+	p.Unlock()
+}
+
+// Drop 'hc'; its connection is gone
+func (p *h2Pool) drop(hc *h2Conn) {
+	p.Lock()
+	defer p.Unlock()
+	for i, x := range p.v {
+		if x == hc {
+			p.v = append(p.v[:i], p.v[i+1:]...)
+			break
+		}
+	}
+	for k, v := range p.alias {
+		if v == hc.addr {
+			delete(p.alias, k)
+		}
+	}
+}
+
+// Return a connection for a request to 'addr': one of its own or one we
+// can coalesce onto. ErrNoCachedConn makes the transport dial.
+func (p *h2Pool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	cc, err := p.ClientConnPool.GetClientConn(req, addr)
+	if err != http2.ErrNoCachedConn || !p.coalesce {
+		return cc, err
+	}
+
+	addr = strings.ToLower(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, http2.ErrNoCachedConn
+	}
+
+	p.Lock()
+	a, ok := p.alias[addr]
+	var cand []*h2Conn
+	for _, hc := range p.v {
+		if hc.port == port && hc.addr != addr && hc.cert.VerifyHostname(host) == nil {
+			cand = append(cand, hc)
+		}
+	}
+	p.Unlock()
+
+	if ok {
+		if ip := p.aliasIP(a); ip != nil {
+			if err := p.d.CheckReuse(req.Context(), addr, ip); err != nil {
+				return nil, err
+			}
+			if cc, err := p.ClientConnPool.GetClientConn(req, a); err == nil {
+				atomic.AddUint64(&p.coalesced, 1)
+				return cc, nil
+			}
+		}
+		p.Lock()
+		delete(p.alias, addr)
+		p.Unlock()
+	}
+
+	if len(cand) == 0 {
+		return nil, http2.ErrNoCachedConn
+	}
+
+	ips, err := p.lookup(req.Context(), host)
+	if err != nil {
+		return nil, http2.ErrNoCachedConn
+	}
+
+	for _, hc := range cand {
+		if !hasIP(ips, hc.ip) {
+			continue
+		}
+
+		// No dial, so the outbound rules are checked here
+		if err := p.d.CheckReuse(req.Context(), addr, hc.ip); err != nil {
+			return nil, err
+		}
+
+		cc, err := p.ClientConnPool.GetClientConn(req, hc.addr)
+		if err != nil {
+			p.drop(hc)
+			continue
+		}
+
+		p.Lock()
+		p.alias[addr] = hc.addr
+		p.Unlock()
+		atomic.AddUint64(&p.coalesced, 1)
+		return cc, nil
+	}
+	return nil, http2.ErrNoCachedConn
+}
+
+// Return the address of the connection made for 'addr'
+func (p *h2Pool) aliasIP(addr string) net.IP {
+	p.Lock()
+	defer p.Unlock()
+	for _, hc := range p.v {
+		if hc.addr == addr {
+			return hc.ip
+		}
+	}
+	return nil
+}
+
+func hasIP(v []net.IPAddr, ip net.IP) bool {
+	for i := range v {
+		if v[i].IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close the connections we know of; the transport doesn't close idle
+// HTTP/2 connections of its own accord.
+func (p *h2Pool) Close() {
+	p.Lock()
+	v := p.v
+	p.v = nil
+	p.Unlock()
+
+	for _, hc := range v {
+		hc.c.Close()
+	}
+	if p.h2c != nil {
+		p.h2c.CloseIdleConnections()
+	}
+}
+
+// Sends requests for h2c origins over cleartext HTTP/2; the rest go to
+// the HTTP/1.1 transport.
+type h2cRoundTripper struct {
+	p *h2Pool
+}
+
+func (h h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := strings.ToLower(extractHost(req.URL))
+	host, _, _ := net.SplitHostPort(addr)
+	if !h.p.hosts[addr] && !h.p.hosts[host] {
+		return nil, http.ErrSkipAltProtocol
+	}
+	return h.p.h2c.RoundTrip(req)
+}
+
+// HTTP/2 metrics for the admin listener
+func (p *h2Pool) metrics() []metric {
+	l := fmt.Sprintf("listener=%q", p.name)
+	return []metric{
+		{"goproxy_http2_conns_total", "counter", "HTTP/2 connections to TLS origins", l,
+			float64(atomic.LoadUint64(&p.conns))},
+		{"goproxy_http2_coalesced_total", "counter", "Requests sent on another host's HTTP/2 connection", l,
+			float64(atomic.LoadUint64(&p.coalesced))},
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
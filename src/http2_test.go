@@ -0,0 +1,200 @@
+// http2_test.go -- tests for HTTP/2 to origins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// A TLS origin that offers h2 and counts its connections
+func startH2Origin(t *testing.T, conns *int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.Host)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Return a transport that trusts 'srv' with HTTP/2 enabled; 'rules'
+// go before one that allows loopback.
+func h2Transport(t *testing.T, srv *httptest.Server, pc *PoolConf, rules ...RuleConf) (*http.Transport, *h2Pool) {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc := &ListenConf{
+		Rules: append(rules, RuleConf{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}),
+	}
+	d, err := newDialer(lc, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTransport(d)
+	if srv != nil {
+		tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	}
+
+	pc.HTTP2 = true
+	p, err := enableHTTP2(tr, pc, d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		p.Close()
+	})
+	return tr, p
+}
+
+func get(t *testing.T, tr http.RoundTripper, u string) string {
+	req, _ := http.NewRequest("GET", u, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("%s: %s", u, err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	return string(b)
+}
+
+func TestHTTP2Origin(t *testing.T) {
+	var conns int32
+	srv := startH2Origin(t, &conns)
+	tr, p := h2Transport(t, srv, &PoolConf{})
+
+	for i := 0; i < 3; i++ {
+		if got := get(t, tr, srv.URL+"/"); !strings.HasPrefix(got, "HTTP/2.0 ") {
+			t.Fatalf("got %q", got)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections", n)
+	}
+	if n := atomic.LoadUint64(&p.conns); n != 1 {
+		t.Errorf("%d h2 connections counted", n)
+	}
+}
+
+func TestHTTP2Coalesce(t *testing.T) {
+	var conns int32
+	srv := startH2Origin(t, &conns)
+	tr, p := h2Transport(t, srv, &PoolConf{})
+
+	// The test certificate is for example.com and 127.0.0.1
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "example.com":
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		case "example.net":
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+		}
+		return nil, fmt.Errorf("%s: no such host", host)
+	}
+
+	get(t, tr, srv.URL+"/")
+
+	for i := 0; i < 2; i++ {
+		want := fmt.Sprintf("HTTP/2.0 example.com:%d", port)
+		if got := get(t, tr, fmt.Sprintf("https://example.com:%d/", port)); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections", n)
+	}
+	if n := atomic.LoadUint64(&p.coalesced); n != 2 {
+		t.Errorf("%d coalesced", n)
+	}
+
+	// Not covered by the certificate: never coalesced
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://example.net:%d/", port), nil)
+	cc, err := p.GetClientConn(req, fmt.Sprintf("example.net:%d", port))
+	if cc != nil || err != http2.ErrNoCachedConn {
+		t.Errorf("example.net coalesced: %v", err)
+	}
+}
+
+// Coalesced requests are subject to the outbound rules too
+func TestHTTP2CoalesceDenied(t *testing.T) {
+	var conns int32
+	srv := startH2Origin(t, &conns)
+	deny := RuleConf{Name: "no", Dest: []string{"example.com"}, Action: "deny"}
+	tr, p := h2Transport(t, srv, &PoolConf{}, deny)
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	get(t, tr, srv.URL+"/")
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://example.com:%d/", port), nil)
+	_, err := tr.RoundTrip(req)
+	if isDenied(err) == nil {
+		t.Errorf("denied host coalesced: %v", err)
+	}
+}
+
+func TestHTTP2Fallback(t *testing.T) {
+	// An HTTP/1.1-only TLS origin
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Proto)
+	}))
+	t.Cleanup(srv.Close)
+	tr, _ := h2Transport(t, srv, &PoolConf{})
+
+	if got := get(t, tr, srv.URL+"/"); got != "HTTP/1.1" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Proto)
+	}), &http2.Server{})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Proto)
+	}))
+	t.Cleanup(plain.Close)
+
+	addr := srv.Listener.Addr().String()
+	tr, _ := h2Transport(t, nil, &PoolConf{H2C: []string{addr}})
+
+	if got := get(t, tr, srv.URL+"/"); got != "HTTP/2.0" {
+		t.Errorf("h2c origin: got %q", got)
+	}
+	if got := get(t, tr, plain.URL+"/"); got != "HTTP/1.1" {
+		t.Errorf("other origin: got %q", got)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
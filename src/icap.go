@@ -0,0 +1,580 @@
+// icap.go -- ICAP (RFC 3507) client for content scanners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ICAP_PORT    = "1344"
+	ICAP_TIMEOUT = 30 // seconds
+
+	// Idle connections kept per ICAP service
+	ICAP_IDLE = 8
+
+	// Largest encapsulated header section and body we take from a server
+	ICAP_MAXHDR  = 64 * 1024
+	ICAP_MAXBODY = 16 * 1024 * 1024
+)
+
+func init() {
+	RegisterFilter("icap", newICAPFilter)
+}
+
+// Sends HTTP requests (REQMOD) and responses (RESPMOD) to ICAP servers
+// such as AV or DLP scanners, and does what they say: pass, modify or
+// block. Bodies are sent if the listener gives them to filters
+// ("filterbody"); larger ones are sent as headers only.
+type icapFilter struct {
+	reqmod   *icapService
+	respmod  *icapService
+	failOpen bool
+}
+
+func newICAPFilter(args map[string]string) (Filter, error) {
+	f := &icapFilter{}
+
+	tmo := ICAP_TIMEOUT * time.Second
+	if s := args["timeout"]; len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", s)
+		}
+		tmo = time.Duration(n) * time.Second
+	}
+
+	switch args["failopen"] {
+	case "", "false", "no":
+	case "true", "yes":
+		f.failOpen = true
+	default:
+		return nil, fmt.Errorf("invalid failopen %q", args["failopen"])
+	}
+
+	var err error
+	if s := args["reqmod"]; len(s) > 0 {
+		if f.reqmod, err = newICAPService(s, tmo); err != nil {
+			return nil, err
+		}
+	}
+	if s := args["respmod"]; len(s) > 0 {
+		if f.respmod, err = newICAPService(s, tmo); err != nil {
+			return nil, err
+		}
+	}
+	if f.reqmod == nil && f.respmod == nil {
+		return nil, fmt.Errorf("missing 'reqmod' or 'respmod'")
+	}
+	return f, nil
+}
+
+func (f *icapFilter) Request(r *FilterRequest) Verdict {
+	if f.reqmod == nil || r.URL == nil || r.Method == "CONNECT" {
+		return Verdict{}
+	}
+
+	rep, err := f.reqmod.do("REQMOD", r.Client, icapRequestHead(r), nil, r.Body, r.Body != nil)
+	if err != nil {
+		return f.failed(r, http.StatusServiceUnavailable, err)
+	}
+
+	switch rep.status {
+	case http.StatusNoContent:
+		return Verdict{}
+	case http.StatusOK:
+	default:
+		return f.failed(r, http.StatusServiceUnavailable, fmt.Errorf("ICAP status %d", rep.status))
+	}
+
+	// The server answered in place of the origin: a block page
+	if rep.resHdr != nil {
+		status, _, err := parseHTTPHead(rep.resHdr)
+		if err != nil {
+			return f.failed(r, http.StatusServiceUnavailable, err)
+		}
+		return Verdict{Action: FILTER_DENY, Status: status, Reason: rep.reason()}
+	}
+
+	if rep.reqHdr == nil {
+		return f.failed(r, http.StatusServiceUnavailable, fmt.Errorf("ICAP reply without a request"))
+	}
+
+	_, h, err := parseHTTPHead(rep.reqHdr)
+	if err != nil {
+		return f.failed(r, http.StatusServiceUnavailable, err)
+	}
+	h.Del("Host")
+	h.Del("Content-Length")
+	replaceHeader(r.Header, h)
+
+	if rep.hasBody {
+		r.Body = rep.body
+	} else if r.Body != nil {
+		r.Body = []byte{}
+	}
+	r.Annotate("icap", "reqmod")
+	return Verdict{}
+}
+
+func (f *icapFilter) Response(r *FilterRequest, res *FilterResponse) Verdict {
+	if f.respmod == nil || r.URL == nil {
+		return Verdict{}
+	}
+
+	// Filters see the decoded body
+	h := res.Header.Clone()
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	if res.Body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", res.Status, http.StatusText(res.Status))
+	h.Write(&b)
+	b.WriteString("\r\n")
+
+	req := icapRequestHead(&FilterRequest{Method: r.Method, URL: r.URL, Header: r.Header})
+	rep, err := f.respmod.do("RESPMOD", r.Client, req, b.Bytes(), res.Body, res.Body != nil)
+	if err != nil {
+		return f.failed(r, http.StatusBadGateway, err)
+	}
+
+	switch rep.status {
+	case http.StatusNoContent:
+		return Verdict{}
+	case http.StatusOK:
+	default:
+		return f.failed(r, http.StatusBadGateway, fmt.Errorf("ICAP status %d", rep.status))
+	}
+
+	if rep.resHdr == nil {
+		return f.failed(r, http.StatusBadGateway, fmt.Errorf("ICAP reply without a response"))
+	}
+
+	status, nh, err := parseHTTPHead(rep.resHdr)
+	if err != nil {
+		return f.failed(r, http.StatusBadGateway, err)
+	}
+
+	body := res.Body
+	if rep.hasBody {
+		body = rep.body
+	} else if res.Body != nil {
+		body = []byte{}
+	}
+
+	// An unchanged body goes out as the origin sent it
+	ce, cl := res.Header.Get("Content-Encoding"), res.Header.Get("Content-Length")
+	nh.Del("Content-Length")
+	replaceHeader(res.Header, nh)
+	if bytes.Equal(body, res.Body) && (body == nil) == (res.Body == nil) {
+		if len(ce) > 0 {
+			res.Header.Set("Content-Encoding", ce)
+		}
+		if len(cl) > 0 {
+			res.Header.Set("Content-Length", cl)
+		}
+	}
+
+	res.Status = status
+	res.Body = body
+	r.Annotate("icap", "respmod")
+	return Verdict{}
+}
+
+// Fail open or closed when the ICAP server can't be used
+func (f *icapFilter) failed(r *FilterRequest, status int, err error) Verdict {
+	if f.failOpen {
+		r.Annotate("icap", "failed")
+		return Verdict{}
+	}
+	return Verdict{
+		Action: FILTER_DENY,
+		Status: status,
+		Reason: fmt.Sprintf("Content scanner failed: %s", err),
+	}
+}
+
+// Return the head of HTTP request 'r' as sent to an ICAP server
+func icapRequestHead(r *FilterRequest) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", r.Method, r.URL.String())
+	fmt.Fprintf(&b, "Host: %s\r\n", r.URL.Host)
+
+	h := r.Header.Clone()
+	h.Del("Host")
+	h.Del("Content-Length")
+	if r.Body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// Replace the contents of 'dst' with 'src'
+func replaceHeader(dst, src http.Header) {
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// One ICAP service (icap://host:port/service)
+type icapService struct {
+	url     string
+	host    string
+	addr    string
+	timeout time.Duration
+	idle    chan *icapConn
+}
+
+func newICAPService(s string, tmo time.Duration) (*icapService, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid ICAP URL %q", s)
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = ICAP_PORT
+	}
+
+	is := &icapService{
+		url:     u.String(),
+		host:    u.Host,
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		timeout: tmo,
+		idle:    make(chan *icapConn, ICAP_IDLE),
+	}
+	return is, nil
+}
+
+type icapConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// What an ICAP server said
+type icapReply struct {
+	status int
+	header textproto.MIMEHeader
+	*icapMessage
+}
+
+// Why a server blocked a request
+func (r *icapReply) reason() string {
+	for _, k := range []string{"X-Infection-Found", "X-Violations-Found", "X-Blocked-Reason"} {
+		if v := r.header.Get(k); len(v) > 0 {
+			return v
+		}
+	}
+	return "Blocked by content scanner"
+}
+
+// Send 'method' for the encapsulated HTTP message to the service and
+// return the reply. Idle connections are reused; one that the server
+// closed is retried once on a new connection.
+func (s *icapService) do(method string, client net.IP, reqHdr, resHdr, body []byte, hasBody bool) (*icapReply, error) {
+	h := http.Header{}
+	h.Set("Host", s.host)
+	h.Set("Allow", "204")
+	if client != nil {
+		h.Set("X-Client-IP", client.String())
+	}
+	msg := encodeICAP(fmt.Sprintf("%s %s ICAP/1.0", method, s.url), h, reqHdr, resHdr, body, hasBody)
+
+	for {
+		c, reused, err := s.get()
+		if err != nil {
+			return nil, err
+		}
+
+		rep, keep, err := c.roundTrip(msg, s.timeout)
+		if err == nil {
+			if keep {
+				s.put(c)
+			} else {
+				c.Close()
+			}
+			return rep, nil
+		}
+
+		c.Close()
+		if !reused {
+			return nil, err
+		}
+	}
+}
+
+// Return an idle connection (and true) or a new one
+func (s *icapService) get() (*icapConn, bool, error) {
+	select {
+	case c := <-s.idle:
+		return c, true, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	return &icapConn{nc, bufio.NewReader(nc)}, false, nil
+}
+
+func (s *icapService) put(c *icapConn) {
+	c.SetDeadline(time.Time{})
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Send 'msg' and read the reply; return true if the connection can be
+// used again.
+func (c *icapConn) roundTrip(msg []byte, tmo time.Duration) (*icapReply, bool, error) {
+	c.SetDeadline(time.Now().Add(tmo))
+	if _, err := c.Write(msg); err != nil {
+		return nil, false, err
+	}
+
+	first, h, m, err := readICAP(c.br)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// ICAP/1.0 200 OK
+	v := strings.SplitN(first, " ", 3)
+	if len(v) < 2 || !strings.HasPrefix(v[0], "ICAP/") {
+		return nil, false, fmt.Errorf("invalid ICAP status line %.64q", first)
+	}
+	status, err := strconv.Atoi(v[1])
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid ICAP status line %.64q", first)
+	}
+
+	keep := !strings.EqualFold(h.Get("Connection"), "close")
+	return &icapReply{status, h, m}, keep, nil
+}
+
+// The encapsulated parts of an ICAP message
+type icapMessage struct {
+	reqHdr  []byte
+	resHdr  []byte
+	body    []byte
+	hasBody bool
+}
+
+// Return ICAP message 'first' with headers 'h' and the encapsulated
+// parts. The body goes with the last header section.
+func encodeICAP(first string, h http.Header, reqHdr, resHdr, body []byte, hasBody bool) []byte {
+	var enc []string
+	var off int
+	if reqHdr != nil {
+		enc = append(enc, fmt.Sprintf("req-hdr=%d", off))
+		off += len(reqHdr)
+	}
+	if resHdr != nil {
+		enc = append(enc, fmt.Sprintf("res-hdr=%d", off))
+		off += len(resHdr)
+	}
+
+	kind := "null-body"
+	if hasBody {
+		kind = "req-body"
+		if resHdr != nil {
+			kind = "res-body"
+		}
+	}
+	enc = append(enc, fmt.Sprintf("%s=%d", kind, off))
+
+	var b bytes.Buffer
+	b.WriteString(first)
+	b.WriteString("\r\n")
+	h.Write(&b)
+	fmt.Fprintf(&b, "Encapsulated: %s\r\n\r\n", strings.Join(enc, ", "))
+	b.Write(reqHdr)
+	b.Write(resHdr)
+	if hasBody {
+		if len(body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n", len(body))
+			b.Write(body)
+			b.WriteString("\r\n")
+		}
+		b.WriteString("0\r\n\r\n")
+	}
+	return b.Bytes()
+}
+
+// Read an ICAP message: its first line, headers and encapsulated parts
+func readICAP(br *bufio.Reader) (string, textproto.MIMEHeader, *icapMessage, error) {
+	tp := textproto.NewReader(br)
+	first, err := tp.ReadLine()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	m := &icapMessage{}
+	enc := h.Get("Encapsulated")
+	if len(enc) == 0 {
+		return first, h, m, nil
+	}
+
+	type part struct {
+		name string
+		off  int
+	}
+
+	var parts []part
+	for _, s := range strings.Split(enc, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		if len(kv) != 2 {
+			return "", nil, nil, fmt.Errorf("invalid Encapsulated %.64q", enc)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 || (len(parts) > 0 && n < parts[len(parts)-1].off) {
+			return "", nil, nil, fmt.Errorf("invalid Encapsulated %.64q", enc)
+		}
+		parts = append(parts, part{strings.ToLower(kv[0]), n})
+	}
+
+	for i, p := range parts {
+		switch p.name {
+		case "req-hdr", "res-hdr":
+			if i+1 == len(parts) {
+				return "", nil, nil, fmt.Errorf("Encapsulated %.64q ends with a header", enc)
+			}
+			n := parts[i+1].off - p.off
+			if n > ICAP_MAXHDR {
+				return "", nil, nil, fmt.Errorf("encapsulated header too large (%d bytes)", n)
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return "", nil, nil, err
+			}
+			if p.name == "req-hdr" {
+				m.reqHdr = b
+			} else {
+				m.resHdr = b
+			}
+
+		case "req-body", "res-body", "opt-body":
+			b, err := readChunked(tp, ICAP_MAXBODY)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			m.body, m.hasBody = b, true
+
+		case "null-body":
+
+		default:
+			return "", nil, nil, fmt.Errorf("invalid Encapsulated %.64q", enc)
+		}
+	}
+	return first, h, m, nil
+}
+
+// Read a chunked body of at most 'max' bytes
+func readChunked(tp *textproto.Reader, max int) ([]byte, error) {
+	b := []byte{}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		// chunk extensions such as "; ieof" don't matter to us
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 32)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid chunk size %.32q", line)
+		}
+
+		if n == 0 {
+			// trailers end with an empty line
+			for {
+				s, err := tp.ReadLine()
+				if err != nil {
+					return nil, err
+				}
+				if len(s) == 0 {
+					return b, nil
+				}
+			}
+		}
+
+		if len(b)+int(n) > max {
+			return nil, fmt.Errorf("encapsulated body too large")
+		}
+
+		i := len(b)
+		b = append(b, make([]byte, n)...)
+		if _, err := io.ReadFull(tp.R, b[i:]); err != nil {
+			return nil, err
+		}
+		if s, err := tp.ReadLine(); err != nil || len(s) > 0 {
+			return nil, fmt.Errorf("invalid chunk")
+		}
+	}
+}
+
+// Parse the head of an encapsulated HTTP message; return the status
+// (responses only) and the headers.
+func parseHTTPHead(b []byte) (int, http.Header, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	first, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	h, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+
+	var status int
+	if strings.HasPrefix(first, "HTTP/") {
+		v := strings.SplitN(first, " ", 3)
+		if len(v) < 2 {
+			return 0, nil, fmt.Errorf("invalid status line %.64q", first)
+		}
+		if status, err = strconv.Atoi(v[1]); err != nil || status < 100 || status > 999 {
+			return 0, nil, fmt.Errorf("invalid status line %.64q", first)
+		}
+	}
+	return status, http.Header(h), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,324 @@
+// icap_test.go -- tests for the ICAP client
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A fake ICAP server; 'reply' answers each request
+type icapServer struct {
+	ln      net.Listener
+	conns   int32
+	nreq    int32
+	reply   func(method string, m *icapMessage) []byte
+	lastHdr http.Header
+	once    bool // close connections after one request
+}
+
+func newICAPServer(t *testing.T, reply func(method string, m *icapMessage) []byte) *icapServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &icapServer{ln: ln, reply: reply}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *icapServer) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		first, h, m, err := readICAP(br)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.nreq, 1)
+		s.lastHdr = http.Header(h)
+
+		method := strings.Fields(first)[0]
+		if _, err := c.Write(s.reply(method, m)); err != nil || s.once {
+			return
+		}
+	}
+}
+
+func (s *icapServer) url(svc string) string {
+	return "icap://" + s.ln.Addr().String() + "/" + svc
+}
+
+func icapReplyOf(status string, reqHdr, resHdr, body []byte, hasBody bool, extra ...string) []byte {
+	h := http.Header{}
+	h.Set("ISTag", `"test"`)
+	for i := 0; i+1 < len(extra); i += 2 {
+		h.Set(extra[i], extra[i+1])
+	}
+	return encodeICAP("ICAP/1.0 "+status, h, reqHdr, resHdr, body, hasBody)
+}
+
+func icapRequest(method, u, body string) *FilterRequest {
+	r := &FilterRequest{
+		Client: net.IPv4(10, 1, 2, 3),
+		Proto:  "http",
+		Method: method,
+		URL:    mustURL(u),
+		Header: http.Header{"User-Agent": {"test"}},
+	}
+	if len(body) > 0 {
+		r.Body = []byte(body)
+	}
+	return r
+}
+
+func TestICAPMessage(t *testing.T) {
+	req := []byte("GET http://a/ HTTP/1.1\r\nHost: a\r\n\r\n")
+	res := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+
+	tests := []struct {
+		req, res []byte
+		body     []byte
+		hasBody  bool
+	}{
+		{req, nil, nil, false},
+		{req, nil, []byte("hello"), true},
+		{req, res, big, true},
+		{nil, res, []byte{}, true},
+	}
+
+	for i, tt := range tests {
+		b := encodeICAP("RESPMOD icap://x/y ICAP/1.0", http.Header{"Host": {"x"}}, tt.req, tt.res, tt.body, tt.hasBody)
+		first, h, m, err := readICAP(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if first != "RESPMOD icap://x/y ICAP/1.0" || h.Get("Host") != "x" {
+			t.Errorf("%d: %q %v", i, first, h)
+		}
+		if !bytes.Equal(m.reqHdr, tt.req) || !bytes.Equal(m.resHdr, tt.res) ||
+			m.hasBody != tt.hasBody || !bytes.Equal(m.body, tt.body) {
+			t.Errorf("%d: got %+v", i, m)
+		}
+	}
+
+	// Chunk extensions and trailers
+	msg := "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\n" + "3; x=y\r\nabc\r\n0; ieof\r\nX-T: 1\r\n\r\n"
+	_, _, m, err := readICAP(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil || string(m.body) != "abc" {
+		t.Errorf("extensions: %v %+v", err, m)
+	}
+
+	bad := []string{
+		"ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0\r\n\r\n",
+		"ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=10, res-body=0\r\n\r\n",
+		"ICAP/1.0 200 OK\r\nEncapsulated: bogus=0\r\n\r\n",
+		"ICAP/1.0 200 OK\r\nEncapsulated: res-body=0\r\n\r\nzz\r\n",
+	}
+	for _, s := range bad {
+		if _, _, _, err := readICAP(bufio.NewReader(strings.NewReader(s))); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestICAPReqmod(t *testing.T) {
+	s := newICAPServer(t, func(method string, m *icapMessage) []byte {
+		_, h, _ := parseHTTPHead(m.reqHdr)
+		switch {
+		case strings.Contains(string(m.body), "EICAR"):
+			res := []byte("HTTP/1.1 403 Forbidden\r\nContent-Type: text/html\r\n\r\n")
+			return icapReplyOf("200 OK", nil, res, []byte("<h1>virus</h1>"), true,
+				"X-Infection-Found", "Type=0; Resolution=2; Threat=EICAR;")
+		case h.Get("X-Strip") != "":
+			hdr := []byte("POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Scanned: yes\r\n\r\n")
+			return icapReplyOf("200 OK", hdr, nil, []byte("[redacted]"), true)
+		}
+		return icapReplyOf("204 No Content", nil, nil, nil, false)
+	})
+
+	f, err := newICAPFilter(map[string]string{"reqmod": s.url("reqmod")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := icapRequest("GET", "http://example.com/", "")
+	if v := f.Request(r); v.Action != FILTER_PASS || r.Header.Get("User-Agent") != "test" {
+		t.Errorf("204: %v %v", v, r.Header)
+	}
+	if s.lastHdr.Get("X-Client-IP") != "10.1.2.3" || s.lastHdr.Get("Allow") != "204" {
+		t.Errorf("ICAP headers %v", s.lastHdr)
+	}
+
+	r = icapRequest("POST", "http://example.com/", "X5O!P%@AP EICAR")
+	v := f.Request(r)
+	if v.Action != FILTER_DENY || v.Status != 403 || !strings.Contains(v.Reason, "EICAR") {
+		t.Errorf("blocked: %v", v)
+	}
+
+	r = icapRequest("POST", "http://example.com/", "card 4111111111111111")
+	r.Header.Set("X-Strip", "1")
+	if v := f.Request(r); v.Action != FILTER_PASS {
+		t.Errorf("modified: %v", v)
+	}
+	if string(r.Body) != "[redacted]" || r.Header.Get("X-Scanned") != "yes" ||
+		len(r.Header.Get("X-Strip")) > 0 || len(r.Header.Get("Host")) > 0 || r.Notes() != "icap=reqmod" {
+		t.Errorf("modified request: %q %v %q", r.Body, r.Header, r.Notes())
+	}
+
+	// CONNECT isn't sent
+	n := atomic.LoadInt32(&s.nreq)
+	f.Request(&FilterRequest{Method: "CONNECT", URL: mustURL("//example.com:443")})
+	if atomic.LoadInt32(&s.nreq) != n {
+		t.Errorf("CONNECT sent to ICAP")
+	}
+
+	// One connection for all of them
+	if c := atomic.LoadInt32(&s.conns); c != 1 {
+		t.Errorf("%d connections", c)
+	}
+}
+
+func TestICAPRespmod(t *testing.T) {
+	s := newICAPServer(t, func(method string, m *icapMessage) []byte {
+		if method != "RESPMOD" || m.reqHdr == nil || m.resHdr == nil {
+			return icapReplyOf("400 Bad Request", nil, nil, nil, false)
+		}
+		if !bytes.Contains(m.body, []byte("cat")) {
+			return icapReplyOf("204 No Content", nil, nil, nil, false)
+		}
+		res := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nX-Scanned: yes\r\nContent-Length: 99\r\n\r\n")
+		return icapReplyOf("200 OK", nil, res, bytes.Replace(m.body, []byte("cat"), []byte("dog"), -1), true)
+	})
+
+	f, err := newICAPFilter(map[string]string{"respmod": s.url("respmod")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := icapRequest("GET", "http://example.com/", "")
+	if v := f.Request(r); v.Action != FILTER_PASS || atomic.LoadInt32(&s.nreq) != 0 {
+		t.Errorf("request sent to a respmod service")
+	}
+
+	res := &FilterResponse{
+		Status: 200,
+		Header: http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}},
+		Body:   []byte("the cat sat"),
+	}
+	if v := f.Response(r, res); v.Action != FILTER_PASS {
+		t.Fatalf("respmod: %v", v)
+	}
+	if string(res.Body) != "the dog sat" || res.Header.Get("X-Scanned") != "yes" ||
+		len(res.Header.Get("Content-Length")) > 0 || len(res.Header.Get("Content-Encoding")) > 0 {
+		t.Errorf("modified response: %q %v", res.Body, res.Header)
+	}
+
+	res = &FilterResponse{
+		Status: 200,
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   []byte("nothing to see"),
+	}
+	if v := f.Response(r, res); v.Action != FILTER_PASS || res.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("204: %v %v", v, res.Header)
+	}
+}
+
+func TestICAPFailure(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	f, _ := newICAPFilter(map[string]string{"reqmod": "icap://" + addr + "/x", "timeout": "1"})
+	v := f.Request(icapRequest("GET", "http://example.com/", ""))
+	if v.Action != FILTER_DENY || v.Status != http.StatusServiceUnavailable {
+		t.Errorf("fail closed: %v", v)
+	}
+
+	f, _ = newICAPFilter(map[string]string{"reqmod": "icap://" + addr + "/x", "failopen": "true"})
+	r := icapRequest("GET", "http://example.com/", "")
+	if v := f.Request(r); v.Action != FILTER_PASS || r.Notes() != "icap=failed" {
+		t.Errorf("fail open: %v %q", v, r.Notes())
+	}
+
+	// Errors from the server
+	s := newICAPServer(t, func(string, *icapMessage) []byte {
+		return icapReplyOf("500 Server Error", nil, nil, nil, false)
+	})
+	f, _ = newICAPFilter(map[string]string{"reqmod": s.url("x")})
+	if v := f.Request(icapRequest("GET", "http://example.com/", "")); v.Action != FILTER_DENY {
+		t.Errorf("500: %v", v)
+	}
+
+	bad := []map[string]string{
+		{},
+		{"reqmod": "http://x/y"},
+		{"reqmod": "icap://x/y", "timeout": "-1"},
+		{"reqmod": "icap://x/y", "failopen": "maybe"},
+	}
+	for _, a := range bad {
+		if _, err := newICAPFilter(a); err == nil {
+			t.Errorf("%v accepted", a)
+		}
+	}
+}
+
+// A server that closes idle connections; the client retries
+func TestICAPReconnect(t *testing.T) {
+	s := newICAPServer(t, func(string, *icapMessage) []byte {
+		return icapReplyOf("204 No Content", nil, nil, nil, false, "Connection", "close")
+	})
+	f, _ := newICAPFilter(map[string]string{"reqmod": s.url("x")})
+	for i := 0; i < 3; i++ {
+		if v := f.Request(icapRequest("GET", "http://example.com/", "")); v.Action != FILTER_PASS {
+			t.Fatalf("%d: %v", i, v)
+		}
+	}
+	if c := atomic.LoadInt32(&s.conns); c != 3 {
+		t.Errorf("%d connections", c)
+	}
+
+	// Without telling us
+	s = newICAPServer(t, func(string, *icapMessage) []byte {
+		return icapReplyOf("204 No Content", nil, nil, nil, false)
+	})
+	s.once = true
+	f, _ = newICAPFilter(map[string]string{"reqmod": s.url("x")})
+	for i := 0; i < 3; i++ {
+		if v := f.Request(icapRequest("GET", "http://example.com/", "")); v.Action != FILTER_PASS {
+			t.Fatalf("%d: %v", i, v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := atomic.LoadInt32(&s.conns); c != 3 {
+		t.Errorf("%d connections", c)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,436 @@
+// jump.go -- SSH jump hosts for rules
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A listener's "jump" hosts are SSH servers (bastions); a rule naming
+// one sends the connections it allows through it as direct-tcpip
+// channels, as "ssh -J" does. Each jump host has one SSH connection,
+// made when it is first needed and shared by all the channels; it is
+// kept alive and made again when it breaks.
+
+const (
+	// default seconds between keepalives
+	JUMP_KEEPALIVE = 30
+
+	// bytes read ahead from a channel
+	JUMP_READAHEAD = 256 << 10
+)
+
+// A jump host
+type jumpHost struct {
+	name string
+	addr string
+	conf *ssh.ClientConfig
+	ka   time.Duration
+	nd   *net.Dialer
+
+	mu     sync.Mutex
+	client *ssh.Client
+	wait   chan struct{} // closed when the SSH connection being made is up or failed
+	closed bool
+
+	dials, channels, errs atomic.Uint64
+}
+
+func newJumpHost(jc *JumpConf, nd *net.Dialer) (*jumpHost, error) {
+	if len(jc.Name) == 0 {
+		return nil, fmt.Errorf("jump: needs a name")
+	}
+	j := &jumpHost{name: jc.Name, addr: jc.Addr, nd: nd}
+	if _, _, err := net.SplitHostPort(j.addr); err != nil {
+		j.addr = net.JoinHostPort(j.addr, "22")
+	}
+	if len(jc.Addr) == 0 || len(jc.User) == 0 {
+		return nil, fmt.Errorf("jump %s: needs an addr and a user", j.name)
+	}
+	if len(jc.Key) == 0 || len(jc.KnownHosts) == 0 {
+		return nil, fmt.Errorf("jump %s: needs a key and a knownhosts file", j.name)
+	}
+
+	pem, err := os.ReadFile(jc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("jump %s: %w", j.name, err)
+	}
+	var signer ssh.Signer
+	if len(jc.Passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(jc.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jump %s: key %s: %w", j.name, jc.Key, err)
+	}
+	hk, err := knownhosts.New(jc.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("jump %s: %w", j.name, err)
+	}
+
+	j.conf = &ssh.ClientConfig{
+		User:            jc.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hk,
+		Timeout:         DIAL_TIMEOUT,
+	}
+
+	switch ka := jc.Keepalive; {
+	case ka == 0:
+		j.ka = JUMP_KEEPALIVE * time.Second
+	case ka > 0:
+		j.ka = time.Duration(ka) * time.Second
+	}
+	return j, nil
+}
+
+func (j *jumpHost) Close() {
+	j.mu.Lock()
+	c := j.client
+	j.client, j.closed = nil, true
+	j.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Return the SSH connection, making it if there is none
+func (j *jumpHost) get(ctx context.Context) (*ssh.Client, error) {
+	for {
+		j.mu.Lock()
+		switch {
+		case j.closed:
+			j.mu.Unlock()
+			return nil, net.ErrClosed
+		case j.client != nil:
+			c := j.client
+			j.mu.Unlock()
+			return c, nil
+		case j.wait != nil:
+			w := j.wait
+			j.mu.Unlock()
+			select {
+			case <-w:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		w := make(chan struct{})
+		j.wait = w
+		j.mu.Unlock()
+
+		c, err := j.connect(ctx)
+
+		j.mu.Lock()
+		j.wait = nil
+		if err == nil {
+			if j.closed {
+				c.Close()
+				err = net.ErrClosed
+			} else {
+				j.client = c
+			}
+		}
+		j.mu.Unlock()
+		close(w)
+		return c, err
+	}
+}
+
+// Make an SSH connection to the jump host
+func (j *jumpHost) connect(ctx context.Context) (*ssh.Client, error) {
+	j.dials.Add(1)
+	ctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT)
+	defer cancel()
+
+	nc, err := j.nd.DialContext(ctx, "tcp", j.addr)
+	if err != nil {
+		return nil, err
+	}
+	dl, _ := ctx.Deadline()
+	nc.SetDeadline(dl)
+	sc, chans, reqs, err := ssh.NewClientConn(nc, j.addr, j.conf)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := ssh.NewClient(sc, chans, reqs)
+	go func() {
+		c.Wait()
+		j.drop(c)
+	}()
+	if j.ka > 0 {
+		go j.keepalive(c)
+	}
+	return c, nil
+}
+
+// Forget the SSH connection 'c' and close it
+func (j *jumpHost) drop(c *ssh.Client) {
+	j.mu.Lock()
+	if j.client == c {
+		j.client = nil
+	}
+	j.mu.Unlock()
+	c.Close()
+}
+
+// Drop 'c' when it doesn't answer a keepalive in time
+func (j *jumpHost) keepalive(c *ssh.Client) {
+	t := time.NewTicker(j.ka)
+	defer t.Stop()
+	for range t.C {
+		ch := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			ch <- err
+		}()
+		var err error
+		select {
+		case err = <-ch:
+		case <-time.After(j.ka):
+			err = os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			j.drop(c)
+			return
+		}
+	}
+}
+
+// Open a connection to 'host:port' from the jump host; 'host' is
+// resolved there if it is a name
+func (j *jumpHost) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	for i := 0; ; i++ {
+		c, err := j.get(ctx)
+		if err != nil {
+			j.errs.Add(1)
+			return nil, fmt.Errorf("jump %s: %w", j.name, err)
+		}
+
+		nc, err := c.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			j.channels.Add(1)
+			return newJumpConn(nc, host, port), nil
+		}
+
+		// retry once on a new connection if this one is broken; a
+		// refused channel is the jump host's answer
+		var oe *ssh.OpenChannelError
+		if errors.As(err, &oe) || ctx.Err() != nil || i > 0 {
+			j.errs.Add(1)
+			return nil, fmt.Errorf("jump %s: %s: %w", j.name, addr, err)
+		}
+		j.drop(c)
+	}
+}
+
+// A channel to a destination. Channels have no deadlines, so it is
+// read ahead into a buffer that Read waits on with the deadline; write
+// deadlines aren't kept.
+type jumpConn struct {
+	c     net.Conn
+	raddr *net.TCPAddr
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	err  error
+	shut bool
+	rdl  time.Time
+	dl   *time.Timer
+}
+
+func newJumpConn(nc net.Conn, host string, port int) *jumpConn {
+	c := &jumpConn{c: nc, raddr: &net.TCPAddr{IP: net.ParseIP(host), Port: port}}
+	if c.raddr.IP == nil {
+		c.raddr.IP = net.IPv4zero
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.readAhead()
+	return c
+}
+
+func (c *jumpConn) readAhead() {
+	b := make([]byte, 32<<10)
+	for {
+		n, err := c.c.Read(b)
+
+		c.mu.Lock()
+		c.buf = append(c.buf, b[:n]...)
+		if err != nil {
+			c.err = err
+		}
+		c.cond.Broadcast()
+		for len(c.buf) >= JUMP_READAHEAD && !c.shut {
+			c.cond.Wait()
+		}
+		done := c.err != nil || c.shut
+		c.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (c *jumpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 {
+		switch {
+		case c.shut:
+			return 0, net.ErrClosed
+		case c.err != nil:
+			return 0, c.err
+		case !c.rdl.IsZero() && !time.Now().Before(c.rdl):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	c.cond.Broadcast()
+	return n, nil
+}
+
+func (c *jumpConn) Write(b []byte) (int, error) {
+	return c.c.Write(b)
+}
+
+func (c *jumpConn) CloseWrite() error {
+	if cw, ok := c.c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *jumpConn) Close() error {
+	c.mu.Lock()
+	c.shut = true
+	if c.dl != nil {
+		c.dl.Stop()
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return c.c.Close()
+}
+
+func (c *jumpConn) LocalAddr() net.Addr  { return c.c.LocalAddr() }
+func (c *jumpConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *jumpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *jumpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdl = t
+	if c.dl != nil {
+		c.dl.Stop()
+		c.dl = nil
+	}
+	if !t.IsZero() {
+		c.dl = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *jumpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *jumpConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoRawConn
+}
+
+// The jump hosts of a listener
+type jumpSet struct {
+	listener string
+	m        map[string]*jumpHost
+}
+
+func newJumpSet(v []JumpConf, listen string, nd *net.Dialer) (*jumpSet, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	s := &jumpSet{listener: listen, m: make(map[string]*jumpHost)}
+	for i := range v {
+		if _, ok := s.m[v[i].Name]; ok {
+			return nil, fmt.Errorf("jump %s: defined twice", v[i].Name)
+		}
+		j, err := newJumpHost(&v[i], nd)
+		if err != nil {
+			return nil, err
+		}
+		s.m[j.name] = j
+	}
+	return s, nil
+}
+
+func (s *jumpSet) Close() {
+	for _, j := range s.m {
+		j.Close()
+	}
+}
+
+func (s *jumpSet) metrics() []metric {
+	names := make([]string, 0, len(s.m))
+	for n := range s.m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var v []metric
+	for _, n := range names {
+		j := s.m[n]
+		l := fmt.Sprintf("listener=%q,jump=%q", s.listener, n)
+		j.mu.Lock()
+		up := 0.0
+		if j.client != nil {
+			up = 1
+		}
+		j.mu.Unlock()
+		v = append(v,
+			metric{"goproxy_jump_up", "gauge", "Jump hosts with an SSH connection", l, up},
+			metric{"goproxy_jump_dials_total", "counter", "SSH connections made to jump hosts", l, float64(j.dials.Load())},
+			metric{"goproxy_jump_channels_total", "counter", "Connections opened through jump hosts", l, float64(j.channels.Load())},
+			metric{"goproxy_jump_errors_total", "counter", "Connections that failed through jump hosts", l, float64(j.errs.Load())},
+		)
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
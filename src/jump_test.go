@@ -0,0 +1,242 @@
+// jump_test.go -- tests for SSH jump hosts
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// An SSH server that opens direct-tcpip channels for the key 'user';
+// "internal.test" is its name for the loopback. It counts the SSH
+// connections in 'conns'.
+func startSSHServer(t *testing.T, user ssh.PublicKey, conns *atomic.Int32) (net.Listener, ssh.PublicKey) {
+	_, hk, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(hk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(m ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if m.User() == "jumper" && bytes.Equal(k.Marshal(), user.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	conf.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(nc, conf)
+				if err != nil {
+					return
+				}
+				conns.Add(1)
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					var m struct {
+						Host  string
+						Port  uint32
+						Laddr string
+						Lport uint32
+					}
+					if nch.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nch.ExtraData(), &m) != nil {
+						nch.Reject(ssh.UnknownChannelType, "no")
+						continue
+					}
+					if m.Host == "internal.test" {
+						m.Host = "127.0.0.1"
+					}
+					d, err := net.Dial("tcp", net.JoinHostPort(m.Host, strconv.Itoa(int(m.Port))))
+					if err != nil {
+						nch.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, creqs, _ := nch.Accept()
+					go ssh.DiscardRequests(creqs)
+					go func() {
+						io.Copy(d, ch)
+						d.(*net.TCPConn).CloseWrite()
+					}()
+					go func() {
+						io.Copy(ch, d)
+						ch.CloseWrite()
+						d.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return ln, signer.PublicKey()
+}
+
+// Write a client key and a known_hosts file for the server at 'addr'
+// with the key 'hk'; return the files and the client's public key
+func jumpFiles(t *testing.T, addr string, hk ssh.PublicKey) (string, string, ssh.PublicKey) {
+	dir := t.TempDir()
+	_, k, _ := ed25519.GenerateKey(rand.Reader)
+	b, err := ssh.MarshalPrivateKey(k, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, kh := filepath.Join(dir, "id"), filepath.Join(dir, "known_hosts")
+	os.WriteFile(key, pem.EncodeToMemory(b), 0600)
+	if hk != nil {
+		os.WriteFile(kh, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, hk)+"\n"), 0600)
+	}
+	pub, _ := ssh.NewPublicKey(k.Public())
+	return key, kh, pub
+}
+
+func TestJumpConf(t *testing.T) {
+	key, kh, _ := jumpFiles(t, "127.0.0.1:22", nil)
+	os.WriteFile(kh, nil, 0600)
+	for _, jc := range []JumpConf{
+		{Addr: "127.0.0.1", User: "u", Key: key, KnownHosts: kh},
+		{Name: "a", User: "u", Key: key, KnownHosts: kh},
+		{Name: "a", Addr: "127.0.0.1", User: "u", KnownHosts: kh},
+		{Name: "a", Addr: "127.0.0.1", User: "u", Key: key},
+		{Name: "a", Addr: "127.0.0.1", User: "u", Key: kh, KnownHosts: kh},
+	} {
+		if _, err := newJumpHost(&jc, &net.Dialer{}); err == nil {
+			t.Errorf("%+v: no error", jc)
+		}
+	}
+	j, err := newJumpHost(&JumpConf{Name: "a", Addr: "bastion", User: "u", Key: key, KnownHosts: kh}, &net.Dialer{})
+	if err != nil || j.addr != "bastion:22" || j.ka != JUMP_KEEPALIVE*time.Second {
+		t.Errorf("defaults: %+v %v", j, err)
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	for _, lc := range []ListenConf{
+		{Listen: "j", Rules: []RuleConf{{Name: "a", Action: "allow", Jump: "b"}}},
+		{Listen: "j", Rules: []RuleConf{{Name: "a", Action: "allow", Jump: "b", WireGuard: "wg0"}}},
+	} {
+		if d, err := newDialer(&lc, log); err == nil {
+			d.Close()
+			t.Errorf("%+v: no error", lc)
+		}
+	}
+}
+
+func TestJump(t *testing.T) {
+	echo := startEcho(t)
+	key, kh, pub := jumpFiles(t, "", nil)
+	var conns atomic.Int32
+	ln, hk := startSSHServer(t, pub, &conns)
+	addr := ln.Addr().String()
+	os.WriteFile(kh, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, hk)+"\n"), 0600)
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{
+		Listen: "jump",
+		Jump:   []JumpConf{{Name: "bastion", Addr: addr, User: "jumper", Key: key, KnownHosts: kh}},
+		Rules: []RuleConf{
+			{Name: "inside", Dest: []string{"internal.test", "127.0.0.2"}, Action: "allow", Jump: "bastion"},
+			{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"},
+		},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// the name is resolved by the jump host
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	msg := bytes.Repeat([]byte("jump"), 100000)
+	for i := 0; i < 2; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "internal.test:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		go c.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("echo: %v", err)
+		}
+		c.(tcpConn).CloseWrite()
+		if n, err := c.Read(got); n != 0 || err != io.EOF {
+			t.Errorf("after close: %d %v", n, err)
+		}
+		c.Close()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("ssh connections: %d", n)
+	}
+
+	// read deadlines work on channels
+	c, err := d.DialContext(context.Background(), "tcp", "internal.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("deadline: %v", err)
+	}
+	c.Close()
+
+	// the jump host refuses what it can't reach
+	if _, err := d.DialContext(context.Background(), "tcp", "127.0.0.2:1"); err == nil {
+		t.Errorf("refused: no error")
+	}
+
+	// other rules dial directly
+	c, err = d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Errorf("direct: %T", c)
+	}
+	c.Close()
+
+	// a new SSH connection once the old one is gone
+	j := d.jumps.m["bastion"]
+	j.mu.Lock()
+	j.client.Close()
+	j.mu.Unlock()
+	c, err = d.DialContext(context.Background(), "tcp", "internal.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := conns.Load(); n != 2 {
+		t.Errorf("ssh connections after a break: %d", n)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,612 @@
+// jwt.go -- JSON Web Tokens (RFC 7519) and keys (RFC 7517, 7518)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Only signed tokens in the compact form are understood; "none" and
+// encrypted tokens are refused. An algorithm must suit the type of the
+// key that verifies it, so a public RSA key can't be used as an HMAC
+// secret.
+
+var (
+	errTokenExpired = newError(ErrAuthFailed, "jwt: token expired")
+	errNoTokenKey   = errors.New("jwt: no key for the token")
+)
+
+// A key that verifies tokens, and signs them if we have its private half
+type jwtKey struct {
+	id   string      // "kid"; may be empty
+	alg  string      // the one algorithm allowed; "" for any that suits the key
+	key  interface{} // *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte
+	priv interface{} // *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey or []byte
+}
+
+// A list of strings that may be a single string in JSON ("aud", "scp")
+type jwtStrings []string
+
+func (v *jwtStrings) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = jwtStrings{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(v))
+}
+
+func (v jwtStrings) has(s string) bool {
+	for _, x := range v {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The registered claims we check, and all the claims
+type jwtClaims struct {
+	Issuer    string     `json:"iss"`
+	Subject   string     `json:"sub"`
+	Audience  jwtStrings `json:"aud"`
+	Expires   float64    `json:"exp"`
+	NotBefore float64    `json:"nbf"`
+	Scope     string     `json:"scope"` // space separated (RFC 8693)
+	Scp       jwtStrings `json:"scp"`   // the same, as some issuers send it
+
+	all map[string]interface{}
+}
+
+// Return the string claim 'k'
+func (c *jwtClaims) str(k string) string {
+	s, _ := c.all[k].(string)
+	return s
+}
+
+// Return the scopes of the token
+func (c *jwtClaims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// Return an error unless the token is good at 'now', give or take 'leeway'
+func (c *jwtClaims) valid(now time.Time, leeway time.Duration) error {
+	t := float64(now.Unix())
+	l := leeway.Seconds()
+
+	// Tokens that never expire make poor credentials
+	if c.Expires == 0 {
+		return errors.New("jwt: token has no expiry")
+	}
+	if t-l >= c.Expires {
+		return errTokenExpired
+	}
+	if c.NotBefore != 0 && t+l < c.NotBefore {
+		return errors.New("jwt: token not valid yet")
+	}
+	return nil
+}
+
+// Return an error unless the token is good now and was issued by
+// 'issuer' for 'audience' (if set) with all of 'scopes'.
+func (c *jwtClaims) check(issuer, audience string, scopes []string, leeway time.Duration) error {
+	if err := c.valid(time.Now(), leeway); err != nil {
+		return err
+	}
+	if c.Issuer != issuer {
+		return fmt.Errorf("jwt: token issued by %q", c.Issuer)
+	}
+	if len(audience) > 0 && !c.Audience.has(audience) {
+		return fmt.Errorf("jwt: token not for %q", audience)
+	}
+
+	have := jwtStrings(c.scopes())
+	for _, s := range scopes {
+		if !have.has(s) {
+			return fmt.Errorf("jwt: token lacks scope %q", s)
+		}
+	}
+	return nil
+}
+
+// A token that has been parsed but not verified
+type jwtToken struct {
+	alg    string
+	kid    string
+	signed []byte // header.payload
+	sig    []byte
+	claims jwtClaims
+}
+
+// Parse the token 's' but don't verify it
+func parseJWT(s string) (*jwtToken, error) {
+	p := strings.Split(s, ".")
+	if len(p) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+
+	dec := base64.RawURLEncoding
+	hb, err := dec.DecodeString(p[0])
+	if err != nil {
+		return nil, errors.New("jwt: malformed header")
+	}
+	cb, err := dec.DecodeString(p[1])
+	if err != nil {
+		return nil, errors.New("jwt: malformed claims")
+	}
+	sig, err := dec.DecodeString(p[2])
+	if err != nil {
+		return nil, errors.New("jwt: malformed signature")
+	}
+
+	var h struct {
+		Alg  string          `json:"alg"`
+		Kid  string          `json:"kid"`
+		Crit json.RawMessage `json:"crit"`
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, fmt.Errorf("jwt: header: %s", err)
+	}
+	if len(h.Crit) > 0 {
+		return nil, errors.New("jwt: critical header extensions not supported")
+	}
+
+	t := &jwtToken{
+		alg:    h.Alg,
+		kid:    h.Kid,
+		signed: []byte(s[:len(p[0])+1+len(p[1])]),
+		sig:    sig,
+	}
+	if err := json.Unmarshal(cb, &t.claims); err != nil {
+		return nil, fmt.Errorf("jwt: claims: %s", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(cb))
+	d.UseNumber()
+	if err := d.Decode(&t.claims.all); err != nil {
+		return nil, fmt.Errorf("jwt: claims: %s", err)
+	}
+	return t, nil
+}
+
+// Verify the signature of 't' with one of 'keys': the one named by the
+// token's "kid" if it has one.
+func (t *jwtToken) verify(keys []jwtKey) error {
+	tried := false
+	for i := range keys {
+		k := &keys[i]
+		if len(t.kid) > 0 && k.id != t.kid {
+			continue
+		}
+		if !k.suits(t.alg) {
+			continue
+		}
+		tried = true
+		if k.verify(t.alg, t.signed, t.sig) {
+			return nil
+		}
+	}
+	if !tried {
+		return errNoTokenKey
+	}
+	return errors.New("jwt: bad signature")
+}
+
+// Hashes of the RS, PS, ES and HS algorithms
+func jwtHash(alg string) crypto.Hash {
+	if len(alg) != 5 {
+		return 0
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256
+	case "384":
+		return crypto.SHA384
+	case "512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// Return true if 'alg' can be verified with 'k'
+func (k *jwtKey) suits(alg string) bool {
+	if len(k.alg) > 0 && k.alg != alg {
+		return false
+	}
+	if alg == "EdDSA" {
+		_, ok := k.key.(ed25519.PublicKey)
+		return ok
+	}
+	if jwtHash(alg) == 0 {
+		return false
+	}
+
+	switch alg[:2] {
+	case "RS", "PS":
+		_, ok := k.key.(*rsa.PublicKey)
+		return ok
+	case "ES":
+		pk, ok := k.key.(*ecdsa.PublicKey)
+		return ok && pk.Curve == jwtCurve(alg)
+	case "HS":
+		_, ok := k.key.([]byte)
+		return ok
+	}
+	return false
+}
+
+// The curve of an ES algorithm
+func jwtCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// Return true if 'sig' is a good 'alg' signature of 'msg'; the caller
+// has checked that 'alg' suits 'k'.
+func (k *jwtKey) verify(alg string, msg, sig []byte) bool {
+	if alg == "EdDSA" {
+		return ed25519.Verify(k.key.(ed25519.PublicKey), msg, sig)
+	}
+
+	hf := jwtHash(alg)
+	h := hf.New()
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), hf, sum, sig) == nil
+	case "PS":
+		opt := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		return rsa.VerifyPSS(k.key.(*rsa.PublicKey), hf, sum, sig, opt) == nil
+	case "ES":
+		pk := k.key.(*ecdsa.PublicKey)
+		n := (pk.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*n {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:n])
+		s := new(big.Int).SetBytes(sig[n:])
+		return ecdsa.Verify(pk, sum, r, s)
+	case "HS":
+		m := hmac.New(hf.New, k.key.([]byte))
+		m.Write(msg)
+		return hmac.Equal(m.Sum(nil), sig)
+	}
+	return false
+}
+
+// Sign 'claims' with 'k'; it must have its private half
+func signJWT(k *jwtKey, claims interface{}) (string, error) {
+	alg := k.alg
+	if len(alg) == 0 {
+		alg = defaultAlg(k.key)
+	}
+	if k.priv == nil || !k.suits(alg) {
+		return "", fmt.Errorf("jwt: key %q can't sign %s", k.id, alg)
+	}
+
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if len(k.id) > 0 {
+		h["kid"] = k.id
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	msg := enc.EncodeToString(hb) + "." + enc.EncodeToString(cb)
+
+	var sig []byte
+	if alg == "EdDSA" {
+		sig = ed25519.Sign(k.priv.(ed25519.PrivateKey), []byte(msg))
+		return msg + "." + enc.EncodeToString(sig), nil
+	}
+
+	hf := jwtHash(alg)
+	d := hf.New()
+	d.Write([]byte(msg))
+	sum := d.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.priv.(*rsa.PrivateKey), hf, sum)
+	case "PS":
+		opt := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		sig, err = rsa.SignPSS(rand.Reader, k.priv.(*rsa.PrivateKey), hf, sum, opt)
+	case "ES":
+		pk := k.priv.(*ecdsa.PrivateKey)
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, pk, sum); err == nil {
+			n := (pk.Curve.Params().BitSize + 7) / 8
+			sig = make([]byte, 2*n)
+			r.FillBytes(sig[:n])
+			s.FillBytes(sig[n:])
+		}
+	case "HS":
+		m := hmac.New(hf.New, k.priv.([]byte))
+		m.Write([]byte(msg))
+		sig = m.Sum(nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return msg + "." + enc.EncodeToString(sig), nil
+}
+
+// The algorithm a key signs with when its JWK doesn't say
+func defaultAlg(key interface{}) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return "ES384"
+		case elliptic.P521():
+			return "ES512"
+		}
+		return "ES256"
+	case ed25519.PublicKey:
+		return "EdDSA"
+	case []byte:
+		return "HS256"
+	}
+	return ""
+}
+
+// A JSON Web Key; only the members we use
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	// private members
+	D string `json:"d,omitempty"`
+	P string `json:"p,omitempty"`
+	Q string `json:"q,omitempty"`
+	K string `json:"k,omitempty"`
+}
+
+// Return the signing keys of the JWK set 'b'; keys of types we don't
+// know and (symmetric) "oct" keys are skipped.
+func parseJWKS(b []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %s", err)
+	}
+
+	var keys []jwtKey
+	for i := range set.Keys {
+		j := &set.Keys[i]
+		if len(j.Use) > 0 && j.Use != "sig" {
+			continue
+		}
+		pk, err := j.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %s", j.Kid, err)
+		}
+		if pk != nil {
+			keys = append(keys, jwtKey{id: j.Kid, alg: j.Alg, key: pk})
+		}
+	}
+	return keys, nil
+}
+
+// Return the keys of the JWK set 'b', which may have private keys and
+// HMAC secrets ("oct" keys). Every key must be one we know.
+func parsePrivateJWKS(b []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %s", err)
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for i := range set.Keys {
+		j := &set.Keys[i]
+		k, err := j.privateKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %s", j.Kid, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func jwkNumber(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Return the key of 'j' with its private half, if it has one
+func (j *jwk) privateKey() (jwtKey, error) {
+	k := jwtKey{id: j.Kid, alg: j.Alg}
+	if j.Kty == "oct" {
+		b, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(b) < 32 {
+			return k, errors.New("HMAC secret must be at least 32 bytes")
+		}
+		k.key, k.priv = b, b
+		return k, nil
+	}
+
+	pub, err := j.publicKey()
+	if err != nil {
+		return k, err
+	}
+	if pub == nil {
+		return k, fmt.Errorf("unsupported key type %s %s", j.Kty, j.Crv)
+	}
+	k.key = pub
+	if len(j.D) == 0 {
+		return k, nil
+	}
+
+	switch pk := pub.(type) {
+	case *rsa.PublicKey:
+		var v [3]*big.Int
+		for i, s := range []string{j.D, j.P, j.Q} {
+			if v[i], err = jwkNumber(s); err != nil {
+				return k, errors.New("bad private key")
+			}
+		}
+		rk := &rsa.PrivateKey{PublicKey: *pk, D: v[0], Primes: []*big.Int{v[1], v[2]}}
+		if err := rk.Validate(); err != nil {
+			return k, err
+		}
+		rk.Precompute()
+		k.priv = rk
+
+	case *ecdsa.PublicKey:
+		d, err := jwkNumber(j.D)
+		if err != nil {
+			return k, errors.New("bad private key")
+		}
+		x, y := pk.Curve.ScalarBaseMult(d.Bytes())
+		if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+			return k, errors.New("private key doesn't match the public key")
+		}
+		k.priv = &ecdsa.PrivateKey{PublicKey: *pk, D: d}
+
+	case ed25519.PublicKey:
+		b, err := base64.RawURLEncoding.DecodeString(j.D)
+		if err != nil || len(b) != ed25519.SeedSize {
+			return k, errors.New("bad private key")
+		}
+		ek := ed25519.NewKeyFromSeed(b)
+		if !pk.Equal(ek.Public()) {
+			return k, errors.New("private key doesn't match the public key")
+		}
+		k.priv = ek
+	}
+	return k, nil
+}
+
+// Return the JWK of the public half of 'k'; false for HMAC secrets
+func (k *jwtKey) publicJWK() (jwk, bool) {
+	enc := base64.RawURLEncoding
+	j := jwk{Kid: k.id, Alg: k.alg, Use: "sig"}
+	switch pk := k.key.(type) {
+	case *rsa.PublicKey:
+		j.Kty = "RSA"
+		j.N = enc.EncodeToString(pk.N.Bytes())
+		j.E = enc.EncodeToString(big.NewInt(int64(pk.E)).Bytes())
+	case *ecdsa.PublicKey:
+		n := (pk.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, n), make([]byte, n)
+		pk.X.FillBytes(x)
+		pk.Y.FillBytes(y)
+		j.Kty, j.Crv = "EC", pk.Curve.Params().Name
+		j.X, j.Y = enc.EncodeToString(x), enc.EncodeToString(y)
+	case ed25519.PublicKey:
+		j.Kty, j.Crv, j.X = "OKP", "Ed25519", enc.EncodeToString(pk)
+	default:
+		return j, false
+	}
+	return j, true
+}
+
+// Return the public key of 'j'; nil if it isn't one we know
+func (j *jwk) publicKey() (interface{}, error) {
+	num := jwkNumber
+
+	switch j.Kty {
+	case "RSA":
+		n, err := num(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(j.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+			return nil, errors.New("bad exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA key too short")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var c elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			c = elliptic.P256()
+		case "P-384":
+			c = elliptic.P384()
+		case "P-521":
+			c = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := num(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !c.IsOnCurve(x, y) {
+			return nil, errors.New("point not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, nil
+		}
+		b, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(b), nil
+	}
+	return nil, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,211 @@
+// jwt_test.go -- tests for JSON Web Tokens
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sign 'claims' with 'key' (a private key or an HMAC secret)
+func testToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	k := jwtKey{id: kid, alg: alg, key: key, priv: key}
+	switch pk := key.(type) {
+	case *rsa.PrivateKey:
+		k.key = &pk.PublicKey
+	case *ecdsa.PrivateKey:
+		k.key = &pk.PublicKey
+	case ed25519.PrivateKey:
+		k.key = pk.Public()
+	}
+	s, err := signJWT(&k, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testClaims(d time.Duration) map[string]interface{} {
+	return map[string]interface{}{"sub": "alice", "exp": time.Now().Add(d).Unix()}
+}
+
+func TestJWTVerify(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	e5, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, dk, _ := ed25519.GenerateKey(rand.Reader)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	keys := []jwtKey{
+		{id: "r", key: &rk.PublicKey},
+		{id: "e", key: &ek.PublicKey},
+		{id: "e5", key: &e5.PublicKey},
+		{id: "d", key: dk.Public()},
+		{id: "h", key: secret},
+	}
+
+	good := []struct {
+		alg, kid string
+		key      interface{}
+	}{
+		{"RS256", "r", rk}, {"RS512", "r", rk}, {"PS256", "r", rk},
+		{"ES256", "e", ek}, {"ES512", "e5", e5}, {"EdDSA", "d", dk},
+		{"HS256", "h", secret}, {"HS384", "", secret},
+	}
+	for _, g := range good {
+		tok, err := parseJWT(testToken(t, g.alg, g.kid, g.key, testClaims(time.Hour)))
+		if err != nil {
+			t.Fatalf("%s: %s", g.alg, err)
+		}
+		if err := tok.verify(keys); err != nil {
+			t.Errorf("%s: %s", g.alg, err)
+		}
+		if tok.claims.str("sub") != "alice" || tok.claims.valid(time.Now(), 0) != nil {
+			t.Errorf("%s: claims %+v", g.alg, tok.claims)
+		}
+	}
+
+	// The RSA public key used as an HMAC secret
+	pub, _ := json.Marshal(rk.PublicKey)
+	tok, _ := parseJWT(testToken(t, "HS256", "r", pub, testClaims(time.Hour)))
+	if err := tok.verify(keys); err != errNoTokenKey {
+		t.Errorf("alg confusion: %v", err)
+	}
+
+	// A key pinned to another algorithm
+	tok, _ = parseJWT(testToken(t, "PS256", "r", rk, testClaims(time.Hour)))
+	if err := tok.verify([]jwtKey{{id: "r", alg: "RS256", key: &rk.PublicKey}}); err != errNoTokenKey {
+		t.Errorf("pinned alg: %v", err)
+	}
+
+	// Tampered claims
+	s := testToken(t, "ES256", "e", ek, testClaims(time.Hour))
+	p := strings.Split(s, ".")
+	c, _ := json.Marshal(map[string]interface{}{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()})
+	tok, _ = parseJWT(p[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + p[2])
+	if err := tok.verify(keys); err == nil || err == errNoTokenKey {
+		t.Errorf("tampered token: %v", err)
+	}
+
+	// Unsigned tokens
+	h := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	tok, _ = parseJWT(h + "." + p[1] + ".")
+	if err := tok.verify(keys); err != errNoTokenKey {
+		t.Errorf("alg none: %v", err)
+	}
+
+	for _, bad := range []string{"", "a.b", "a.b.c", h + ".e30.AA.x"} {
+		if _, err := parseJWT(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	now := time.Now()
+	exp := now.Add(time.Minute).Unix()
+	nbf := now.Add(time.Hour).Unix()
+	tests := []struct {
+		c    string
+		want bool
+	}{
+		{fmt.Sprintf(`{"exp": %d}`, exp), true},
+		{`{}`, false},
+		{fmt.Sprintf(`{"exp": %d, "nbf": %d}`, exp, nbf), false},
+	}
+	for _, x := range tests {
+		var c jwtClaims
+		if err := json.Unmarshal([]byte(x.c), &c); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.valid(now, 0); (err == nil) != x.want {
+			t.Errorf("%s: %v", x.c, err)
+		}
+	}
+
+	var c jwtClaims
+	json.Unmarshal([]byte(`{"exp": 1, "aud": "a", "scope": "x y", "scp": ["z"]}`), &c)
+	if err := c.valid(now, 0); err != errTokenExpired {
+		t.Errorf("expired: %v", err)
+	}
+	if err := c.valid(time.Unix(0, 0), 30*time.Second); err != nil {
+		t.Errorf("leeway: %v", err)
+	}
+	if !c.Audience.has("a") || strings.Join(c.scopes(), ",") != "x,y,z" {
+		t.Errorf("aud %v scopes %v", c.Audience, c.scopes())
+	}
+}
+
+// A JWK for the public half of 'k'
+func testJWK(kid string, k crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding
+	switch pk := k.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": enc.EncodeToString(pk.N.Bytes()),
+			"e": enc.EncodeToString(big.NewInt(int64(pk.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		n := (pk.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, n), make([]byte, n)
+		pk.X.FillBytes(x)
+		pk.Y.FillBytes(y)
+		return map[string]string{"kty": "EC", "kid": kid, "crv": pk.Curve.Params().Name,
+			"x": enc.EncodeToString(x), "y": enc.EncodeToString(y)}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": enc.EncodeToString(pk)}
+	}
+	return nil
+}
+
+func TestJWKS(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ek, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	set := []map[string]string{
+		testJWK("r", &rk.PublicKey),
+		testJWK("e", &ek.PublicKey),
+		testJWK("d", pk),
+		{"kty": "oct", "kid": "h", "k": "c2VjcmV0"},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": set})
+	keys, err := parseJWKS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].id != "r" || keys[2].id != "d" {
+		t.Fatalf("keys %v", keys)
+	}
+
+	tok, _ := parseJWT(testToken(t, "ES384", "e", ek, testClaims(time.Hour)))
+	if err := tok.verify(keys); err != nil {
+		t.Errorf("ES384: %s", err)
+	}
+
+	// A point that isn't on the curve
+	bad := testJWK("e", &ek.PublicKey)
+	bad["y"] = bad["x"]
+	b, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{bad}})
+	if _, err := parseJWKS(b); err == nil {
+		t.Errorf("bad EC point accepted")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,320 @@
+// jwtauth.go -- authenticator for locally issued JWTs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds between checks of a key file for changes
+	JWT_CHECK = 5
+
+	// Seconds minted tokens are good for, by default and at most
+	JWT_TTL    = 3600
+	JWT_MAXTTL = 86400
+
+	// Seconds of clock skew allowed when checking expiry
+	JWT_LEEWAY = 60
+)
+
+func init() {
+	RegisterAuth("jwt", newJWTAuth)
+}
+
+// Checks JWTs that we issue ourselves: tokens signed with one of the
+// keys in a JWK set file ("keys"). Every key in the file verifies
+// tokens; the one named by "signkey" (default the first private key)
+// signs the tokens the admin listener mints. To rotate keys, add the new
+// key, make it the signing key, and remove the old one once its tokens
+// have expired. The file is read again when it changes; if the new one
+// is bad, the old keys are kept.
+type jwtAuth struct {
+	file     string
+	issuer   string
+	audience string
+	scopes   []string
+	signKey  string // kid
+	ttl      time.Duration
+	maxTTL   time.Duration
+	leeway   time.Duration
+
+	sync.Mutex
+	keys    []jwtKey
+	signer  *jwtKey // nil if we can't mint
+	mtime   time.Time
+	checked time.Time
+}
+
+// The jwt authenticators, by issuer, for the admin listener to mint
+// tokens with
+var tokenIssuers = struct {
+	sync.Mutex
+	m map[string]*jwtAuth
+}{m: make(map[string]*jwtAuth)}
+
+func newJWTAuth(args map[string]string) (Authenticator, error) {
+	a := &jwtAuth{
+		file:     args["keys"],
+		issuer:   args["issuer"],
+		audience: args["audience"],
+		scopes:   strings.FieldsFunc(args["scopes"], func(r rune) bool { return r == ',' || r == ' ' }),
+		signKey:  args["signkey"],
+		ttl:      JWT_TTL * time.Second,
+		maxTTL:   JWT_MAXTTL * time.Second,
+		leeway:   JWT_LEEWAY * time.Second,
+	}
+	if len(a.file) == 0 {
+		return nil, fmt.Errorf("missing 'keys'")
+	}
+	if len(a.issuer) == 0 {
+		a.issuer = "goproxy"
+	}
+
+	for _, k := range []string{"ttl", "maxttl", "leeway"} {
+		s := args[k]
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || (n == 0 && k != "leeway") {
+			return nil, fmt.Errorf("%s %q: not a number of seconds", k, s)
+		}
+		d := time.Duration(n) * time.Second
+		switch k {
+		case "ttl":
+			a.ttl = d
+		case "maxttl":
+			a.maxTTL = d
+		case "leeway":
+			a.leeway = d
+		}
+	}
+	if a.ttl > a.maxTTL {
+		return nil, fmt.Errorf("ttl %s is more than maxttl %s", a.ttl, a.maxTTL)
+	}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	tokenIssuers.Lock()
+	defer tokenIssuers.Unlock()
+	if b, ok := tokenIssuers.m[a.issuer]; ok && b.file != a.file {
+		return nil, fmt.Errorf("issuer %q already has keys %s", a.issuer, b.file)
+	}
+	tokenIssuers.m[a.issuer] = a
+	return a, nil
+}
+
+// Read the key file
+func (a *jwtAuth) load() error {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	keys, err := parsePrivateJWKS(b)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.file, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys", a.file)
+	}
+
+	var signer *jwtKey
+	for i := range keys {
+		k := &keys[i]
+		if len(k.alg) == 0 {
+			// Each key verifies the one algorithm it signs with
+			k.alg = defaultAlg(k.key)
+		}
+		if signer == nil && k.priv != nil && (len(a.signKey) == 0 || k.id == a.signKey) {
+			signer = k
+		}
+	}
+	if signer == nil && len(a.signKey) > 0 {
+		return fmt.Errorf("%s: no private key %q to sign with", a.file, a.signKey)
+	}
+
+	a.Lock()
+	a.keys, a.signer, a.mtime = keys, signer, fi.ModTime()
+	a.Unlock()
+	return nil
+}
+
+// Reload the key file if it changed; at most every JWT_CHECK seconds
+func (a *jwtAuth) refresh() {
+	a.Lock()
+	now := time.Now()
+	if now.Sub(a.checked) < JWT_CHECK*time.Second {
+		a.Unlock()
+		return
+	}
+	a.checked = now
+	mtime := a.mtime
+	a.Unlock()
+
+	if fi, err := os.Stat(a.file); err == nil && !fi.ModTime().Equal(mtime) {
+		a.load()
+	}
+}
+
+// Basic and SOCKS clients send the token as the password of the user
+// it was issued to.
+func (a *jwtAuth) Authenticate(ctx context.Context, user, pass string) error {
+	u, err := a.AuthenticateToken(ctx, pass)
+	if err != nil {
+		return err
+	}
+	if u != user {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func (a *jwtAuth) AuthenticateToken(ctx context.Context, token string) (string, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return "", err
+	}
+
+	a.refresh()
+	a.Lock()
+	keys := a.keys
+	a.Unlock()
+
+	if err := t.verify(keys); err != nil {
+		return "", err
+	}
+
+	c := &t.claims
+	if err := c.check(a.issuer, a.audience, a.scopes, a.leeway); err != nil {
+		return "", err
+	}
+	if len(c.Subject) == 0 {
+		return "", fmt.Errorf("jwt: token has no subject")
+	}
+	return c.Subject, nil
+}
+
+// Remove this authenticator from the issuers the admin listener knows
+func (a *jwtAuth) Close() error {
+	tokenIssuers.Lock()
+	if tokenIssuers.m[a.issuer] == a {
+		delete(tokenIssuers.m, a.issuer)
+	}
+	tokenIssuers.Unlock()
+	return nil
+}
+
+// Issue a token for 'user' with 'scopes' that is good for 'ttl' (the
+// default if 0); return it and when it expires.
+func (a *jwtAuth) mint(user string, scopes []string, ttl time.Duration) (string, time.Time, error) {
+	if len(user) == 0 {
+		return "", time.Time{}, fmt.Errorf("missing user")
+	}
+	if ttl == 0 {
+		ttl = a.ttl
+	}
+	if ttl < 0 || ttl > a.maxTTL {
+		return "", time.Time{}, fmt.Errorf("ttl must be at most %s", a.maxTTL)
+	}
+
+	a.refresh()
+	a.Lock()
+	k := a.signer
+	a.Unlock()
+	if k == nil {
+		return "", time.Time{}, fmt.Errorf("%s has no private key to sign with", a.file)
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	now := time.Now()
+	exp := now.Add(ttl)
+	c := map[string]interface{}{
+		"iss": a.issuer,
+		"sub": user,
+		"iat": now.Unix(),
+		"exp": exp.Unix(),
+		"jti": hex.EncodeToString(id[:]),
+	}
+	if len(a.audience) > 0 {
+		c["aud"] = a.audience
+	}
+	if len(scopes) > 0 {
+		c["scope"] = strings.Join(scopes, " ")
+	}
+
+	tok, err := signJWT(k, c)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tok, time.Unix(exp.Unix(), 0), nil
+}
+
+// Return the public keys, for those that verify our tokens elsewhere
+func (a *jwtAuth) publicKeys() []jwk {
+	a.refresh()
+	a.Lock()
+	defer a.Unlock()
+
+	v := make([]jwk, 0, len(a.keys))
+	for i := range a.keys {
+		if j, ok := a.keys[i].publicJWK(); ok {
+			v = append(v, j)
+		}
+	}
+	return v
+}
+
+// Return the jwt authenticator of 'issuer'; any one if it is "" and
+// there is only one.
+func tokenIssuer(issuer string) (*jwtAuth, error) {
+	tokenIssuers.Lock()
+	defer tokenIssuers.Unlock()
+
+	if len(issuer) > 0 {
+		if a, ok := tokenIssuers.m[issuer]; ok {
+			return a, nil
+		}
+		return nil, fmt.Errorf("no jwt authenticator for issuer %q", issuer)
+	}
+
+	switch len(tokenIssuers.m) {
+	case 0:
+		return nil, fmt.Errorf("no jwt authenticators")
+	case 1:
+		for _, a := range tokenIssuers.m {
+			return a, nil
+		}
+	}
+
+	v := make([]string, 0, len(tokenIssuers.m))
+	for k := range tokenIssuers.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return nil, fmt.Errorf("pick an issuer: %s", strings.Join(v, ", "))
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,279 @@
+// jwtauth_test.go -- tests for locally issued JWTs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// A JWK with the private half of 'k'
+func testPrivateJWK(kid string, k interface{}) map[string]string {
+	enc := base64.RawURLEncoding
+	switch pk := k.(type) {
+	case ed25519.PrivateKey:
+		j := testJWK(kid, pk.Public())
+		j["d"] = enc.EncodeToString(pk.Seed())
+		return j
+	case *ecdsa.PrivateKey:
+		j := testJWK(kid, &pk.PublicKey)
+		j["d"] = enc.EncodeToString(pk.D.Bytes())
+		return j
+	case *rsa.PrivateKey:
+		j := testJWK(kid, &pk.PublicKey)
+		j["d"] = enc.EncodeToString(pk.D.Bytes())
+		j["p"] = enc.EncodeToString(pk.Primes[0].Bytes())
+		j["q"] = enc.EncodeToString(pk.Primes[1].Bytes())
+		return j
+	case []byte:
+		return map[string]string{"kty": "oct", "kid": kid, "k": enc.EncodeToString(pk)}
+	}
+	return nil
+}
+
+func writeKeys(t *testing.T, fn string, keys ...map[string]string) {
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the change is seen
+	mt := time.Now().Add(time.Duration(len(keys)) * time.Second)
+	os.Chtimes(fn, mt, mt)
+}
+
+func newTestJWT(t *testing.T, args map[string]string) *jwtAuth {
+	a, err := newJWTAuth(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.(*jwtAuth).Close() })
+	return a.(*jwtAuth)
+}
+
+func TestJWTAuth(t *testing.T) {
+	_, k1, _ := ed25519.GenerateKey(rand.Reader)
+	k2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	fn := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, fn, testPrivateJWK("k1", k1))
+
+	a := newTestJWT(t, map[string]string{"keys": fn, "audience": "proxy", "scopes": "egress"})
+	ctx := context.Background()
+
+	tok, exp, err := a.mint("robot", []string{"egress", "other"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(exp); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expires in %s", d)
+	}
+	if u, err := a.AuthenticateToken(ctx, tok); err != nil || u != "robot" {
+		t.Fatalf("minted token: %q %v", u, err)
+	}
+	if err := a.Authenticate(ctx, "robot", tok); err != nil {
+		t.Errorf("as password: %s", err)
+	}
+
+	// Scoped tokens
+	tok2, _, _ := a.mint("robot", []string{"other"}, time.Minute)
+	if _, err := a.AuthenticateToken(ctx, tok2); err == nil {
+		t.Errorf("token without the scope accepted")
+	}
+	if _, _, err := a.mint("robot", nil, 2*JWT_MAXTTL*time.Second); err == nil {
+		t.Errorf("ttl beyond maxttl")
+	}
+
+	// Rotate: the new key signs, the old one still verifies
+	writeKeys(t, fn, testPrivateJWK("k2", k2), testPrivateJWK("k1", k1))
+	a.checked = time.Time{}
+	tok3, _, err := a.mint("robot", []string{"egress"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := parseJWT(tok3); p.kid != "k2" || p.alg != "RS256" {
+		t.Errorf("signed with %s %s", p.kid, p.alg)
+	}
+	for _, x := range []string{tok, tok3} {
+		if _, err := a.AuthenticateToken(ctx, x); err != nil {
+			t.Errorf("after rotation: %s", err)
+		}
+	}
+
+	// The old key is retired
+	writeKeys(t, fn, testPrivateJWK("k2", k2))
+	a.checked = time.Time{}
+	if _, err := a.AuthenticateToken(ctx, tok); err == nil {
+		t.Errorf("token of a retired key accepted")
+	}
+
+	// A bad file keeps the keys we have
+	ioutil.WriteFile(fn, []byte("{"), 0600)
+	os.Chtimes(fn, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	a.checked = time.Time{}
+	if _, err := a.AuthenticateToken(ctx, tok3); err != nil {
+		t.Errorf("after a bad file: %s", err)
+	}
+
+	// Tokens of another issuer
+	fn2 := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, fn2, testPrivateJWK("k2", k2))
+	b := newTestJWT(t, map[string]string{"keys": fn2, "issuer": "other"})
+	tok4, _, _ := b.mint("robot", []string{"egress"}, 0)
+	if _, err := a.AuthenticateToken(ctx, tok4); err == nil {
+		t.Errorf("token of another issuer accepted")
+	}
+}
+
+func TestJWTAuthConf(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "keys.json")
+	pub := filepath.Join(dir, "pub.json")
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeKeys(t, fn, testPrivateJWK("e", ek), testPrivateJWK("h", []byte(strings.Repeat("s", 32))))
+	writeKeys(t, pub, testJWK("e", &ek.PublicKey))
+	short := filepath.Join(dir, "short.json")
+	writeKeys(t, short, testPrivateJWK("h", []byte("short")))
+
+	bad := []map[string]string{
+		{},
+		{"keys": filepath.Join(dir, "none.json")},
+		{"keys": short},
+		{"keys": fn, "signkey": "x"},
+		{"keys": fn, "ttl": "7200", "maxttl": "3600"},
+		{"keys": fn, "ttl": "0"},
+	}
+	for _, args := range bad {
+		if _, err := newJWTAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	// HMAC keys sign too
+	a := newTestJWT(t, map[string]string{"keys": fn, "signkey": "h", "issuer": "hmac"})
+	tok, _, err := a.mint("robot", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := parseJWT(tok); p.alg != "HS256" {
+		t.Errorf("alg %s", p.alg)
+	}
+	if _, err := a.AuthenticateToken(context.Background(), tok); err != nil {
+		t.Errorf("HS256: %s", err)
+	}
+
+	// Public keys only verify
+	b := newTestJWT(t, map[string]string{"keys": pub, "issuer": "pub"})
+	if _, _, err := b.mint("robot", nil, 0); err == nil {
+		t.Errorf("minted without a private key")
+	}
+
+	// One issuer, one key file
+	if _, err := newJWTAuth(map[string]string{"keys": pub, "issuer": "hmac"}); err == nil {
+		t.Errorf("issuer with two key files")
+	}
+}
+
+func startAdmin(t *testing.T, ac *AdminConf) string {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.Listen = "127.0.0.1:0"
+	s, err := NewAdminServer(ac, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return "http://" + s.(*AdminServer).Addr().String()
+}
+
+func TestAdminTokens(t *testing.T) {
+	_, k, _ := ed25519.GenerateKey(rand.Reader)
+	fn := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys(t, fn, testPrivateJWK("k", k))
+	a := newTestJWT(t, map[string]string{"keys": fn, "issuer": "admin-test"})
+
+	mint := func(u, pass string, v url.Values) *http.Response {
+		req, _ := http.NewRequest("POST", u+"/tokens", strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(pass) > 0 {
+			req.SetBasicAuth("admin", pass)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	v := url.Values{"issuer": {"admin-test"}, "user": {"robot"}, "scope": {"a b"}, "ttl": {"600"}}
+
+	// Without a password nothing is minted
+	open := startAdmin(t, &AdminConf{})
+	if res := mint(open, "x", v); res.StatusCode != http.StatusForbidden {
+		t.Errorf("no admin password: %d", res.StatusCode)
+	}
+
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+	if res := mint(u, "wrong", v); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad admin password: %d", res.StatusCode)
+	}
+	res := mint(u, "adm1n", v)
+	if res.StatusCode != 200 {
+		t.Fatalf("mint: %d", res.StatusCode)
+	}
+	var out struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}
+	json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+
+	user, err := a.AuthenticateToken(context.Background(), out.Token)
+	if err != nil || user != "robot" {
+		t.Fatalf("minted token: %q %v", user, err)
+	}
+	p, _ := parseJWT(out.Token)
+	if s := strings.Join(p.claims.scopes(), ","); s != "a,b" || out.Expires-time.Now().Unix() > 600 {
+		t.Errorf("scopes %s expires %d", s, out.Expires)
+	}
+
+	// The public keys verify minted tokens
+	res, err = http.Get(u + "/jwks?issuer=admin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	keys, err := parseJWKS(b)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("jwks: %v %s", err, b)
+	}
+	if err := p.verify(keys); err != nil {
+		t.Errorf("verify with the jwks: %s", err)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,566 @@
+// krb5.go -- Kerberos 5 keytabs, ticket encryption and AP-REQ checks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+// Just enough Kerberos (RFC 4120) for a service to accept a client:
+// read the service keys from a keytab, decrypt the ticket and the
+// authenticator of an AP-REQ and check them. The encryption types are
+// aes128/aes256-cts-hmac-sha1-96 (RFC 3962) and rc4-hmac (RFC 4757).
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Encryption types
+const (
+	KRB5_AES128 = 17
+	KRB5_AES256 = 18
+	KRB5_RC4    = 23
+)
+
+// Key usages (RFC 4120, 7.5.1)
+const (
+	KRB5_USAGE_TICKET = 2
+	KRB5_USAGE_AUTH   = 11
+)
+
+var errKrbIntegrity = errors.New("kerberos: decrypt failed (wrong key?)")
+
+// A key from a keytab or a ticket
+type krbKey struct {
+	Type  int32  `asn1:"explicit,tag:0"`
+	Value []byte `asn1:"explicit,tag:1"`
+}
+
+type krbPrincipal struct {
+	Type  int32           `asn1:"explicit,tag:0"`
+	Names []asn1.RawValue `asn1:"explicit,tag:1"` // GeneralStrings
+}
+
+type krbEncrypted struct {
+	Etype  int32  `asn1:"explicit,tag:0"`
+	Kvno   int    `asn1:"explicit,optional,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+// AP-REQ, [APPLICATION 14]
+type krbAPReq struct {
+	Pvno    int            `asn1:"explicit,tag:0"`
+	MsgType int            `asn1:"explicit,tag:1"`
+	Options asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket  asn1.RawValue  `asn1:"explicit,tag:3"`
+	Auth    krbEncrypted   `asn1:"explicit,tag:4"`
+}
+
+// Ticket, [APPLICATION 1]
+type krbTicket struct {
+	Vno   int           `asn1:"explicit,tag:0"`
+	Realm asn1.RawValue `asn1:"explicit,tag:1"`
+	SName krbPrincipal  `asn1:"explicit,tag:2"`
+	Enc   krbEncrypted  `asn1:"explicit,tag:3"`
+}
+
+// EncTicketPart, [APPLICATION 3]
+type krbEncTicket struct {
+	Flags     asn1.BitString `asn1:"explicit,tag:0"`
+	Key       krbKey         `asn1:"explicit,tag:1"`
+	CRealm    asn1.RawValue  `asn1:"explicit,tag:2"`
+	CName     krbPrincipal   `asn1:"explicit,tag:3"`
+	Transited asn1.RawValue  `asn1:"explicit,tag:4"`
+	AuthTime  time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime time.Time      `asn1:"generalized,explicit,optional,tag:6"`
+	EndTime   time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill time.Time      `asn1:"generalized,explicit,optional,tag:8"`
+	CAddr     asn1.RawValue  `asn1:"explicit,optional,tag:9"`
+	AuthData  asn1.RawValue  `asn1:"explicit,optional,tag:10"`
+}
+
+// Authenticator, [APPLICATION 2]
+type krbAuthenticator struct {
+	Vno      int           `asn1:"explicit,tag:0"`
+	CRealm   asn1.RawValue `asn1:"explicit,tag:1"`
+	CName    krbPrincipal  `asn1:"explicit,tag:2"`
+	Cksum    asn1.RawValue `asn1:"explicit,optional,tag:3"`
+	Cusec    int           `asn1:"explicit,tag:4"`
+	CTime    time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey   asn1.RawValue `asn1:"explicit,optional,tag:6"`
+	SeqNum   int64         `asn1:"explicit,optional,tag:7"`
+	AuthData asn1.RawValue `asn1:"explicit,optional,tag:8"`
+}
+
+// Ticket flag "invalid" (postdated, not yet validated)
+const krbFlagInvalid = 7
+
+// The client of a good AP-REQ
+type krbClient struct {
+	name  string // the principal without the realm
+	realm string
+	ctime time.Time
+	cusec int
+}
+
+// A key of a keytab
+type keytabEntry struct {
+	realm string
+	names []string
+	kvno  int
+	key   krbKey
+}
+
+// Return "name/instance@REALM"
+func (e *keytabEntry) principal() string {
+	return strings.Join(e.names, "/") + "@" + e.realm
+}
+
+// Parse a keytab file (the MIT format, version 2 - what ktutil and
+// ktpass write)
+func parseKeytab(b []byte) ([]keytabEntry, error) {
+	if len(b) < 2 || b[0] != 5 || b[1] != 2 {
+		return nil, fmt.Errorf("not a version 2 keytab")
+	}
+	b = b[2:]
+
+	var v []keytabEntry
+	for len(b) >= 4 {
+		n := int32(binary.BigEndian.Uint32(b))
+		b = b[4:]
+		size := int(n)
+		if n < 0 {
+			size = -size
+		}
+		if size > len(b) {
+			return nil, fmt.Errorf("truncated keytab")
+		}
+		rec := b[:size]
+		b = b[size:]
+		if n <= 0 {
+			// a hole left by a deleted key
+			continue
+		}
+
+		e, err := parseKeytabEntry(rec)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, e)
+	}
+	return v, nil
+}
+
+func parseKeytabEntry(b []byte) (keytabEntry, error) {
+	var e keytabEntry
+	bad := fmt.Errorf("bad keytab entry")
+
+	u16 := func() (int, bool) {
+		if len(b) < 2 {
+			return 0, false
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		return n, true
+	}
+	str := func() ([]byte, bool) {
+		n, ok := u16()
+		if !ok || n > len(b) {
+			return nil, false
+		}
+		s := b[:n]
+		b = b[n:]
+		return s, true
+	}
+
+	nc, ok := u16()
+	if !ok {
+		return e, bad
+	}
+	realm, ok := str()
+	if !ok {
+		return e, bad
+	}
+	e.realm = string(realm)
+	for i := 0; i < nc; i++ {
+		s, ok := str()
+		if !ok {
+			return e, bad
+		}
+		e.names = append(e.names, string(s))
+	}
+
+	// name type, timestamp, 8-bit kvno
+	if len(b) < 9 {
+		return e, bad
+	}
+	e.kvno = int(b[8])
+	b = b[9:]
+
+	kt, ok := u16()
+	if !ok {
+		return e, bad
+	}
+	key, ok := str()
+	if !ok {
+		return e, bad
+	}
+	e.key = krbKey{Type: int32(kt), Value: append([]byte(nil), key...)}
+
+	// a 32-bit kvno, when there is one, replaces the 8-bit one
+	if len(b) >= 4 {
+		if n := binary.BigEndian.Uint32(b); n != 0 {
+			e.kvno = int(n)
+		}
+	}
+	return e, nil
+}
+
+// Return the strings of a principal
+func krbNames(p *krbPrincipal) []string {
+	v := make([]string, len(p.Names))
+	for i := range p.Names {
+		v[i] = string(p.Names[i].Bytes)
+	}
+	return v
+}
+
+// Return the element of an explicitly tagged RawValue; encoding/asn1
+// keeps the tag of those (newer versions) or drops it
+func krbInner(rv *asn1.RawValue) []byte {
+	if rv.Class == asn1.ClassContextSpecific && rv.IsCompound {
+		return rv.Bytes
+	}
+	return rv.FullBytes
+}
+
+// Return the KerberosString (a GeneralString) of an explicitly tagged
+// RawValue
+func krbStr(rv *asn1.RawValue) string {
+	var s asn1.RawValue
+	if _, err := asn1.Unmarshal(krbInner(rv), &s); err != nil {
+		return ""
+	}
+	return string(s.Bytes)
+}
+
+// Check the AP-REQ 'b' with the service keys 'keys' at 'now'; return its
+// client. The caller checks for replays.
+func krbAccept(keys []keytabEntry, b []byte, now time.Time, skew time.Duration) (*krbClient, error) {
+	var req krbAPReq
+	if _, err := asn1.UnmarshalWithParams(b, &req, "application,explicit,tag:14"); err != nil {
+		return nil, fmt.Errorf("kerberos: bad AP-REQ: %s", err)
+	}
+	if req.Pvno != 5 || req.MsgType != 14 {
+		return nil, fmt.Errorf("kerberos: not an AP-REQ")
+	}
+
+	var tkt krbTicket
+	if _, err := asn1.UnmarshalWithParams(krbInner(&req.Ticket), &tkt, "application,explicit,tag:1"); err != nil {
+		return nil, fmt.Errorf("kerberos: bad ticket: %s", err)
+	}
+
+	// the newest key of the service and encryption type, unless the
+	// ticket names its version
+	realm, sname := krbStr(&tkt.Realm), krbNames(&tkt.SName)
+	var key *keytabEntry
+	for i := range keys {
+		e := &keys[i]
+		if e.realm != realm || !sameNames(e.names, sname) || e.key.Type != tkt.Enc.Etype {
+			continue
+		}
+		if tkt.Enc.Kvno != 0 && e.kvno != tkt.Enc.Kvno {
+			continue
+		}
+		if key == nil || e.kvno > key.kvno {
+			key = e
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("kerberos: no key for %s@%s (etype %d, kvno %d)",
+			strings.Join(sname, "/"), realm, tkt.Enc.Etype, tkt.Enc.Kvno)
+	}
+
+	pt, err := krbDecrypt(key.key, KRB5_USAGE_TICKET, tkt.Enc.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	var et krbEncTicket
+	if _, err := asn1.UnmarshalWithParams(pt, &et, "application,explicit,tag:3"); err != nil {
+		return nil, fmt.Errorf("kerberos: bad ticket: %s", err)
+	}
+
+	start := et.StartTime
+	if start.IsZero() {
+		start = et.AuthTime
+	}
+	switch {
+	case et.Flags.At(krbFlagInvalid) == 1:
+		return nil, fmt.Errorf("kerberos: ticket is not valid yet")
+	case now.Add(skew).Before(start):
+		return nil, fmt.Errorf("kerberos: ticket is not valid until %s", start)
+	case now.Add(-skew).After(et.EndTime):
+		return nil, fmt.Errorf("kerberos: ticket expired at %s", et.EndTime)
+	}
+
+	pt, err = krbDecrypt(et.Key, KRB5_USAGE_AUTH, req.Auth.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	var a krbAuthenticator
+	if _, err := asn1.UnmarshalWithParams(pt, &a, "application,explicit,tag:2"); err != nil {
+		return nil, fmt.Errorf("kerberos: bad authenticator: %s", err)
+	}
+
+	cname, crealm := krbNames(&et.CName), krbStr(&et.CRealm)
+	if krbStr(&a.CRealm) != crealm || !sameNames(krbNames(&a.CName), cname) {
+		return nil, fmt.Errorf("kerberos: authenticator is not of the ticket's client")
+	}
+	if d := now.Sub(a.CTime); d > skew || d < -skew {
+		return nil, fmt.Errorf("kerberos: clock skew too great (%s)", d.Round(time.Second))
+	}
+
+	c := &krbClient{
+		name:  strings.Join(cname, "/"),
+		realm: crealm,
+		ctime: a.CTime,
+		cusec: a.Cusec,
+	}
+	return c, nil
+}
+
+// Decrypt 'ct' with 'key' for 'usage'
+func krbDecrypt(key krbKey, usage int, ct []byte) ([]byte, error) {
+	switch key.Type {
+	case KRB5_AES128, KRB5_AES256:
+		return aesDecrypt(key.Value, usage, ct)
+	case KRB5_RC4:
+		return rc4Decrypt(key.Value, usage, ct)
+	}
+	return nil, fmt.Errorf("kerberos: unsupported encryption type %d", key.Type)
+}
+
+// Encrypt 'pt' with 'key' for 'usage'
+func krbEncrypt(key krbKey, usage int, pt []byte) ([]byte, error) {
+	switch key.Type {
+	case KRB5_AES128, KRB5_AES256:
+		return aesEncrypt(key.Value, usage, pt)
+	case KRB5_RC4:
+		return rc4Encrypt(key.Value, usage, pt), nil
+	}
+	return nil, fmt.Errorf("kerberos: unsupported encryption type %d", key.Type)
+}
+
+// The encryption and integrity keys of 'key' for 'usage' (RFC 3961)
+func aesKeys(key []byte, usage int) (ke, ki []byte, err error) {
+	var c [5]byte
+	binary.BigEndian.PutUint32(c[:], uint32(usage))
+	c[4] = 0xaa
+	if ke, err = deriveKey(key, c[:]); err != nil {
+		return
+	}
+	c[4] = 0x55
+	ki, err = deriveKey(key, c[:])
+	return
+}
+
+// DK(key, constant) of RFC 3961 for AES; random-to-key is the identity
+func deriveKey(key, constant []byte) ([]byte, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	in := constant
+	if len(in) != aes.BlockSize {
+		in = nfold(constant, aes.BlockSize)
+	}
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		x := make([]byte, aes.BlockSize)
+		b.Encrypt(x, in)
+		out = append(out, x...)
+		in = x
+	}
+	return out[:len(key)], nil
+}
+
+// n-fold 'in' to 'n' bytes (RFC 3961, 5.1)
+func nfold(in []byte, n int) []byte {
+	k := len(in)
+	a, b := n, k
+	for b != 0 {
+		a, b = b, a%b
+	}
+	lcm := n * k / a
+
+	out := make([]byte, n)
+	carry := 0
+	for i := lcm - 1; i >= 0; i-- {
+		// the msbit in 'in' that is added into this byte
+		msbit := ((k << 3) - 1 + ((k<<3)+13)*(i/k) + ((k - (i % k)) << 3)) % (k << 3)
+		v := (int(in[((k-1)-(msbit>>3))%k])<<8 | int(in[(k-(msbit>>3))%k])) >> ((msbit & 7) + 1)
+		carry += v&0xff + int(out[i%n])
+		out[i%n] = byte(carry)
+		carry >>= 8
+	}
+	for i := n - 1; carry != 0 && i >= 0; i-- {
+		carry += int(out[i])
+		out[i] = byte(carry)
+		carry >>= 8
+	}
+	return out
+}
+
+func aesDecrypt(key []byte, usage int, ct []byte) ([]byte, error) {
+	if len(ct) < aes.BlockSize+12 {
+		return nil, errKrbIntegrity
+	}
+	ke, ki, err := aesKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := aes.NewCipher(ke)
+
+	data, mac := ct[:len(ct)-12], ct[len(ct)-12:]
+	pt := ctsDecrypt(b, data)
+	h := hmac.New(sha1.New, ki)
+	h.Write(pt)
+	if !hmac.Equal(h.Sum(nil)[:12], mac) {
+		return nil, errKrbIntegrity
+	}
+	return pt[aes.BlockSize:], nil
+}
+
+func aesEncrypt(key []byte, usage int, pt []byte) ([]byte, error) {
+	ke, ki, err := aesKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := aes.NewCipher(ke)
+
+	data := make([]byte, aes.BlockSize, aes.BlockSize+len(pt))
+	rand.Read(data)
+	data = append(data, pt...)
+	h := hmac.New(sha1.New, ki)
+	h.Write(data)
+	return append(ctsEncrypt(b, data), h.Sum(nil)[:12]...), nil
+}
+
+// CBC with ciphertext stealing and a zero IV; the last two blocks are
+// swapped even when the last is full (RFC 3962). len(pt) >= block size.
+func ctsEncrypt(b cipher.Block, pt []byte) []byte {
+	bs := b.BlockSize()
+	n := len(pt)
+	m := n % bs
+	if m == 0 {
+		m = bs
+	}
+	x := make([]byte, n+bs-m)
+	copy(x, pt)
+	cipher.NewCBCEncrypter(b, make([]byte, bs)).CryptBlocks(x, x)
+	if n == bs {
+		return x
+	}
+
+	l := len(x)
+	out := append([]byte{}, x[:l-2*bs]...)
+	out = append(out, x[l-bs:]...)
+	return append(out, x[l-2*bs:l-2*bs+m]...)
+}
+
+func ctsDecrypt(b cipher.Block, ct []byte) []byte {
+	bs := b.BlockSize()
+	n := len(ct)
+	out := make([]byte, n)
+	if n == bs {
+		b.Decrypt(out, ct)
+		return out
+	}
+
+	m := n % bs
+	if m == 0 {
+		m = bs
+	}
+	l := n - m - bs // the (swapped) last full block starts here
+	prev := make([]byte, bs)
+	if l > 0 {
+		cipher.NewCBCDecrypter(b, prev).CryptBlocks(out[:l], ct[:l])
+		prev = ct[l-bs : l]
+	}
+
+	// the last block decrypts to the padded plaintext xor the stolen
+	// block, whose tail it gives back
+	d := make([]byte, bs)
+	b.Decrypt(d, ct[l:l+bs])
+	last := append(append([]byte{}, ct[l+bs:]...), d[m:]...)
+	for i := 0; i < m; i++ {
+		out[l+bs+i] = d[i] ^ last[i]
+	}
+	b.Decrypt(d, last)
+	for i := 0; i < bs; i++ {
+		out[l+i] = d[i] ^ prev[i]
+	}
+	return out
+}
+
+// The key of a message of 'usage' with rc4-hmac
+func rc4Key(key []byte, usage int) []byte {
+	var u [4]byte
+	binary.LittleEndian.PutUint32(u[:], uint32(usage))
+	h := hmac.New(md5.New, key)
+	h.Write(u[:])
+	return h.Sum(nil)
+}
+
+func rc4Decrypt(key []byte, usage int, ct []byte) ([]byte, error) {
+	if len(ct) < md5.Size+8 {
+		return nil, errKrbIntegrity
+	}
+	k1 := rc4Key(key, usage)
+	sum := ct[:md5.Size]
+	h := hmac.New(md5.New, k1)
+	h.Write(sum)
+	c, _ := rc4.NewCipher(h.Sum(nil))
+
+	pt := make([]byte, len(ct)-md5.Size)
+	c.XORKeyStream(pt, ct[md5.Size:])
+	h = hmac.New(md5.New, k1)
+	h.Write(pt)
+	if !hmac.Equal(h.Sum(nil), sum) {
+		return nil, errKrbIntegrity
+	}
+	return pt[8:], nil
+}
+
+func rc4Encrypt(key []byte, usage int, pt []byte) []byte {
+	k1 := rc4Key(key, usage)
+	data := make([]byte, 8, 8+len(pt))
+	rand.Read(data)
+	data = append(data, pt...)
+
+	h := hmac.New(md5.New, k1)
+	h.Write(data)
+	sum := h.Sum(nil)
+	h = hmac.New(md5.New, k1)
+	h.Write(sum)
+	c, _ := rc4.NewCipher(h.Sum(nil))
+	c.XORKeyStream(data, data)
+	return append(sum, data...)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,474 @@
+// krb5_test.go -- tests for Kerberos tickets and SPNEGO
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNfold(t *testing.T) {
+	// RFC 3961, A.1
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+		{"kerberos", 168, "8372c236344e5f1550cd0747e15d62ca7a5a3bcea4"},
+		{"kerberos", 256, "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+	for _, tt := range tests {
+		if b := nfold([]byte(tt.in), tt.bits/8); hex.EncodeToString(b) != tt.want {
+			t.Errorf("%d-fold(%q): %x, want %s", tt.bits, tt.in, b, tt.want)
+		}
+	}
+}
+
+func TestCTS(t *testing.T) {
+	// RFC 3962, appendix B
+	key := unhex(t, "636869636b656e207465726979616b69")
+	tests := []struct {
+		in, out string
+	}{
+		{"4920776f756c64206c696b652074686520",
+			"c6353568f2bf8cb4d8a580362da7ff7f 97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			"fc00783e0efdb2c1d445d4c8eff7ed22 97687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			"39312523a78662d5be7fcbcc98ebf5a8 97687268d6ecccc0c07b25e25ecfe584"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c",
+			"97687268d6ecccc0c07b25e25ecfe584 b3fffd940c16a18c1b5549d2f838029e 39312523a78662d5be7fcbcc98ebf5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20",
+			"97687268d6ecccc0c07b25e25ecfe584 9dad8bbb96c4cdc03bc103e1a194bbd8 39312523a78662d5be7fcbcc98ebf5a8"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20616e6420776f6e746f6e20736f75702e",
+			"97687268d6ecccc0c07b25e25ecfe584 39312523a78662d5be7fcbcc98ebf5a8 4807efe836ee89a526730dbc2f7bc840 9dad8bbb96c4cdc03bc103e1a194bbd8"},
+	}
+	b, _ := aes.NewCipher(key)
+	for i, tt := range tests {
+		in, want := unhex(t, tt.in), unhex(t, tt.out)
+		if c := ctsEncrypt(b, in); !bytes.Equal(c, want) {
+			t.Errorf("%d: encrypt %x, want %x", i, c, want)
+		}
+		if p := ctsDecrypt(b, want); !bytes.Equal(p, in) {
+			t.Errorf("%d: decrypt %x, want %x", i, p, in)
+		}
+	}
+
+	// a block or less of plaintext is one block; 16 is the least
+	in := []byte("sixteen bytes!!!")
+	if c := ctsEncrypt(b, in); len(c) != 16 || !bytes.Equal(ctsDecrypt(b, c), in) {
+		t.Errorf("one block: %x", c)
+	}
+}
+
+// The AES key of 'pass' (RFC 3962): DK(PBKDF2(pass, salt), "kerberos")
+func aesStringToKey(t *testing.T, pass, salt string, iter, size int) []byte {
+	tk := pbkdf2.Key([]byte(pass), []byte(salt), iter, size, sha1.New)
+	k, err := deriveKey(tk, []byte("kerberos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestAESKeys(t *testing.T) {
+	// RFC 3962, appendix B; string-to-key checks DK
+	salt := "ATHENA.MIT.EDUraeburn"
+	tests := []struct {
+		iter       int
+		k128, k256 string
+	}{
+		{1, "42263c6e89f4fc28b8df68ee09799f15",
+			"fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{2, "c651bf29e2300ac27fa469d693bdda13",
+			"a2e16d16b36069c135d5e9d2e25f896102685618b95914b467c67622225824ff"},
+		{1200, "4c01cd46d632d01e6dbe230a01ed642a",
+			"55a6ac740ad17b4846941051e1e8b0a7548d93b0ab30a8bc3ff16280382b8c2a"},
+	}
+	for _, tt := range tests {
+		if k := aesStringToKey(t, "password", salt, tt.iter, 16); hex.EncodeToString(k) != tt.k128 {
+			t.Errorf("aes128, %d iterations: %x", tt.iter, k)
+		}
+		if k := aesStringToKey(t, "password", salt, tt.iter, 32); hex.EncodeToString(k) != tt.k256 {
+			t.Errorf("aes256, %d iterations: %x", tt.iter, k)
+		}
+	}
+
+	for _, et := range []int32{KRB5_AES128, KRB5_AES256, KRB5_RC4} {
+		key := testKrbKey(et)
+		msg := []byte("a message of some length, not a multiple of 16")
+		for n := 0; n <= len(msg); n += 7 {
+			ct, err := krbEncrypt(key, KRB5_USAGE_AUTH, msg[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pt, err := krbDecrypt(key, KRB5_USAGE_AUTH, ct); err != nil || !bytes.Equal(pt, msg[:n]) {
+				t.Errorf("etype %d, %d bytes: %q %v", et, n, pt, err)
+			}
+			if _, err := krbDecrypt(key, KRB5_USAGE_TICKET, ct); err != errKrbIntegrity {
+				t.Errorf("etype %d: other usage: %v", et, err)
+			}
+			ct[len(ct)/2] ^= 1
+			if _, err := krbDecrypt(key, KRB5_USAGE_AUTH, ct); err != errKrbIntegrity {
+				t.Errorf("etype %d: corrupt: %v", et, err)
+			}
+		}
+	}
+}
+
+func testKrbKey(etype int32) krbKey {
+	n := 16
+	if etype == KRB5_AES256 {
+		n = 32
+	}
+	k := krbKey{Type: etype, Value: make([]byte, n)}
+	rand.Read(k.Value)
+	return k
+}
+
+// A keytab with the keys 'v' of 'principal' (name/instance@REALM)
+func testKeytab(principal string, kvno int, v ...krbKey) []byte {
+	i := strings.IndexByte(principal, '@')
+	names, realm := strings.Split(principal[:i], "/"), principal[i+1:]
+
+	var out bytes.Buffer
+	out.Write([]byte{5, 2})
+	for _, k := range v {
+		var e bytes.Buffer
+		str := func(s []byte) {
+			binary.Write(&e, binary.BigEndian, uint16(len(s)))
+			e.Write(s)
+		}
+		binary.Write(&e, binary.BigEndian, uint16(len(names)))
+		str([]byte(realm))
+		for _, s := range names {
+			str([]byte(s))
+		}
+		binary.Write(&e, binary.BigEndian, uint32(1)) // KRB5_NT_PRINCIPAL
+		binary.Write(&e, binary.BigEndian, uint32(time.Now().Unix()))
+		e.WriteByte(byte(kvno))
+		binary.Write(&e, binary.BigEndian, uint16(k.Type))
+		str(k.Value)
+		binary.Write(&e, binary.BigEndian, uint32(kvno))
+
+		binary.Write(&out, binary.BigEndian, int32(e.Len()))
+		out.Write(e.Bytes())
+	}
+	// a hole of a deleted key
+	binary.Write(&out, binary.BigEndian, int32(-8))
+	out.Write(make([]byte, 8))
+	return out.Bytes()
+}
+
+func krbString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: 27, Bytes: []byte(s)}
+}
+
+// An explicitly tagged element; encoding/asn1 doesn't tag RawValues
+func krbTagged(tag int, b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: b}
+}
+
+func krbRealm(tag int, s string) asn1.RawValue {
+	b, _ := asn1.Marshal(krbString(s))
+	return krbTagged(tag, b)
+}
+
+func krbName(s string) krbPrincipal {
+	p := krbPrincipal{Type: 1}
+	for _, x := range strings.Split(s, "/") {
+		p.Names = append(p.Names, krbString(x))
+	}
+	return p
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+	b, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// What a KDC and a client make
+type testTicket struct {
+	service    string // "HTTP/proxy@REALM"
+	client     string // "alice@REALM"
+	key        krbKey // of the service
+	kvno       int
+	start, end time.Time
+	ctime      time.Time
+	authName   string // of the authenticator, if not the client
+}
+
+// Return the SPNEGO token of an AP-REQ for 'tt'
+func (tt *testTicket) token(t *testing.T) []byte {
+	now := time.Now().UTC().Truncate(time.Second)
+	if tt.start.IsZero() {
+		tt.start = now.Add(-time.Minute)
+	}
+	if tt.end.IsZero() {
+		tt.end = now.Add(time.Hour)
+	}
+	if tt.ctime.IsZero() {
+		tt.ctime = now
+	}
+	cname, crealm, _ := strings.Cut(tt.client, "@")
+	sname, srealm, _ := strings.Cut(tt.service, "@")
+
+	session := testKrbKey(KRB5_AES256)
+	transited := mustMarshal(t, struct {
+		Type     int    `asn1:"explicit,tag:0"`
+		Contents []byte `asn1:"explicit,tag:1"`
+	}{0, []byte{}}, "")
+	et := krbEncTicket{
+		Flags:     asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32},
+		Key:       session,
+		CRealm:    krbRealm(2, crealm),
+		CName:     krbName(cname),
+		Transited: krbTagged(4, transited),
+		AuthTime:  tt.start,
+		EndTime:   tt.end,
+	}
+	ct, err := krbEncrypt(tt.key, KRB5_USAGE_TICKET, mustMarshal(t, et, "application,explicit,tag:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkt := krbTicket{
+		Vno:   5,
+		Realm: krbRealm(1, srealm),
+		SName: krbName(sname),
+		Enc:   krbEncrypted{Etype: tt.key.Type, Kvno: tt.kvno, Cipher: ct},
+	}
+
+	an := cname
+	if len(tt.authName) > 0 {
+		an = tt.authName
+	}
+	a := krbAuthenticator{
+		Vno:    5,
+		CRealm: krbRealm(1, crealm),
+		CName:  krbName(an),
+		Cusec:  int(time.Now().UnixNano()/1000) % 1000000,
+		CTime:  tt.ctime,
+	}
+	act, err := krbEncrypt(session, KRB5_USAGE_AUTH, mustMarshal(t, a, "application,explicit,tag:2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := krbAPReq{
+		Pvno:    5,
+		MsgType: 14,
+		Options: asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32},
+		Ticket:  krbTagged(3, mustMarshal(t, tkt, "application,explicit,tag:1")),
+		Auth:    krbEncrypted{Etype: session.Type, Cipher: act},
+	}
+
+	mech := append(mustMarshal(t, oidKrb5, ""), 1, 0)
+	mech = append(mech, mustMarshal(t, req, "application,explicit,tag:14")...)
+	mech = mustMarshal(t, asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: mech}, "")
+
+	init := negTokenInit{MechTypes: []asn1.ObjectIdentifier{oidMSKrb5, oidKrb5}, MechToken: mech}
+	inner := append(mustMarshal(t, oidSPNEGO, ""), mustMarshal(t, init, "explicit,tag:0")...)
+	return mustMarshal(t, asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: inner}, "")
+}
+
+func newTestKrb(t *testing.T, keytab []byte, args map[string]string) *krbAuth {
+	fn := filepath.Join(t.TempDir(), "proxy.keytab")
+	ioutil.WriteFile(fn, keytab, 0600)
+	if args == nil {
+		args = map[string]string{}
+	}
+	args["keytab"] = fn
+	a, err := newKerberosAuth(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*krbAuth)
+}
+
+func TestKerberos(t *testing.T) {
+	const svc = "HTTP/proxy.example.com@EXAMPLE.COM"
+	aes, rc4 := testKrbKey(KRB5_AES256), testKrbKey(KRB5_RC4)
+	kt := testKeytab(svc, 3, aes, rc4)
+
+	ents, err := parseKeytab(kt)
+	if err != nil || len(ents) != 2 || ents[0].principal() != svc || ents[1].kvno != 3 {
+		t.Fatalf("keytab: %+v %v", ents, err)
+	}
+	if _, err := parseKeytab(kt[:len(kt)-20]); err == nil {
+		t.Errorf("truncated keytab")
+	}
+
+	k := newTestKrb(t, kt, map[string]string{"service": "HTTP/proxy.example.com"})
+	now := time.Now()
+	for _, key := range []krbKey{aes, rc4} {
+		tok := (&testTicket{service: svc, client: "alice@EXAMPLE.COM", key: key, kvno: 3}).token(t)
+		if u, err := k.accept(tok, now); err != nil || u != "alice@EXAMPLE.COM" {
+			t.Errorf("etype %d: %q %v", key.Type, u, err)
+		}
+		if _, err := k.accept(tok, now); err != errKrbReplay {
+			t.Errorf("etype %d: replay: %v", key.Type, err)
+		}
+	}
+
+	old := now.Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	bad := []*testTicket{
+		{service: svc, client: "a@EXAMPLE.COM", key: testKrbKey(KRB5_AES256)},
+		{service: "HTTP/other@EXAMPLE.COM", client: "a@EXAMPLE.COM", key: aes},
+		{service: svc, client: "a@EXAMPLE.COM", key: aes, kvno: 2},
+		{service: svc, client: "a@EXAMPLE.COM", key: aes, start: old, end: old.Add(time.Hour)},
+		{service: svc, client: "a@EXAMPLE.COM", key: aes, ctime: old},
+		{service: svc, client: "a@EXAMPLE.COM", key: aes, authName: "mallory"},
+	}
+	for i, tt := range bad {
+		if u, err := k.accept(tt.token(t), now); err == nil {
+			t.Errorf("%d: accepted as %q", i, u)
+		}
+	}
+	if _, err := k.accept([]byte("TlRMTVNTUAAB"), now); err == nil {
+		t.Errorf("junk accepted")
+	}
+
+	// Realms and names
+	k = newTestKrb(t, kt, map[string]string{"realms": "EXAMPLE.COM", "striprealm": "true"})
+	tok := (&testTicket{service: svc, client: "bob@EXAMPLE.COM", key: aes}).token(t)
+	if u, err := k.accept(tok, now); err != nil || u != "bob" {
+		t.Errorf("striprealm: %q %v", u, err)
+	}
+	other := testKeytab("HTTP/proxy.example.com@OTHER.ORG", 1, aes)
+	k = newTestKrb(t, append(kt, other[2:]...), map[string]string{"realms": "EXAMPLE.COM"})
+	tok = (&testTicket{service: "HTTP/proxy.example.com@OTHER.ORG", client: "eve@OTHER.ORG", key: aes}).token(t)
+	if _, err := k.accept(tok, now); err == nil {
+		t.Errorf("client of another realm accepted")
+	}
+
+	fn := filepath.Join(t.TempDir(), "kt")
+	ioutil.WriteFile(fn, kt, 0600)
+	for _, args := range []map[string]string{{}, {"keytab": fn, "service": "HTTP/nope"},
+		{"keytab": fn, "skew": "x"}, {"keytab": fn + "x"}} {
+		if _, err := newKerberosAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestKerberosProxy(t *testing.T) {
+	const svc = "HTTP/proxy.example.com@EXAMPLE.COM"
+	key := testKrbKey(KRB5_AES128)
+	fn := filepath.Join(t.TempDir(), "proxy.keytab")
+	ioutil.WriteFile(fn, testKeytab(svc, 1, key), 0600)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+
+	lc := &ListenConf{
+		Auth:  AuthConf{Type: "kerberos", Args: map[string]string{"keytab": fn, "striprealm": "true"}},
+		Rules: []RuleConf{{Name: "no-eve", Dest: []string{"127.0.0.0/8"}, Users: []string{"eve"}, Action: "deny"}},
+	}
+	addr := startHTTPProxy(t, lc)
+
+	pu := &url.URL{Scheme: "http", Host: addr}
+	tr := &http.Transport{Proxy: http.ProxyURL(pu)}
+	t.Cleanup(tr.CloseIdleConnections)
+	c := &http.Client{Transport: tr}
+	get := func(auth string) *http.Response {
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		if len(auth) > 0 {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+	negotiate := func(user string) string {
+		tok := (&testTicket{service: svc, client: user + "@EXAMPLE.COM", key: key}).token(t)
+		return "Negotiate " + base64.StdEncoding.EncodeToString(tok)
+	}
+
+	res := get("")
+	if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") != "Negotiate" {
+		t.Fatalf("no credentials: %d %q", res.StatusCode, res.Header["Proxy-Authenticate"])
+	}
+	if res := get(negotiate("alice")); res.StatusCode != 200 {
+		t.Errorf("alice: %d", res.StatusCode)
+	}
+
+	// The connection stays authenticated
+	if res := get(""); res.StatusCode != 200 {
+		t.Errorf("same connection: %d", res.StatusCode)
+	}
+	tr.CloseIdleConnections()
+	if res := get(""); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("new connection: %d", res.StatusCode)
+	}
+
+	if res := get(negotiate("eve")); res.StatusCode != http.StatusForbidden {
+		t.Errorf("eve: %d", res.StatusCode)
+	}
+	x := &http.Request{Header: http.Header{}}
+	x.SetBasicAuth("alice", "pass")
+	if res := get(x.Header.Get("Authorization")); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("basic: %d", res.StatusCode)
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewSocksv5Proxy(&ListenConf{Listen: "127.0.0.1:0", Auth: lc.Auth}, log, nil); err == nil {
+		t.Errorf("kerberos on a SOCKS listener")
+	}
+
+	if u, err := newTestKrb(t, testKeytab(svc, 1, key), nil).AuthenticateNegotiate(context.Background(),
+		[]byte{0x60, 0}); err == nil {
+		t.Errorf("empty token: %q", u)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
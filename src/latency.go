@@ -0,0 +1,121 @@
+// latency.go -- histograms of the time the proxy spends on each step
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Each step of a session - the lookup of the destination, the dial, the
+// TLS handshake with the origin, the first byte of the response and the
+// whole session - is counted in a Prometheus histogram by the listener,
+// the rule that allowed it and the upstream (a parent proxy or
+// "direct").
+
+// Upper bounds (seconds) of the buckets of the steps and of sessions
+var (
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sessionBuckets = []float64{.01, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600, 14400}
+)
+
+// The histograms and their help
+var latencyHelp = map[string]string{
+	"goproxy_dns_seconds":           "Time to look up the destination",
+	"goproxy_dial_seconds":          "Time to connect to the destination or the parent proxy",
+	"goproxy_tls_handshake_seconds": "Time of the TLS handshake with the origin",
+	"goproxy_ttfb_seconds":          "Time from a request to the first byte of its response",
+	"goproxy_session_seconds":       "Time from the start to the end of a request or tunnel",
+}
+
+type histogram struct {
+	le     []float64
+	counts []uint64 // by bucket; not cumulative
+	sum    float64
+	n      uint64
+}
+
+// The histograms by name and labels
+var latencies = struct {
+	sync.Mutex
+	m map[[2]string]*histogram
+}{m: make(map[[2]string]*histogram)}
+
+// Count 'd' in the histogram 'name' with 'labels'
+func observe(name, labels string, d time.Duration) {
+	le := latencyBuckets
+	if name == "goproxy_session_seconds" {
+		le = sessionBuckets
+	}
+
+	s := d.Seconds()
+	k := [2]string{name, labels}
+
+	latencies.Lock()
+	h, ok := latencies.m[k]
+	if !ok {
+		h = &histogram{le: le, counts: make([]uint64, len(le)+1)}
+		latencies.m[k] = h
+	}
+	i := sort.SearchFloat64s(le, s)
+	h.counts[i]++
+	h.sum += s
+	h.n++
+	latencies.Unlock()
+}
+
+// The labels of the route of the session in 'ctx' through 'listen'
+func routeLabels(ctx context.Context, listen string) string {
+	rule, up := routeOf(ctx)
+	return fmt.Sprintf("listen=%q,rule=%q,upstream=%q", listen, rule, up)
+}
+
+type latencyCollector struct{}
+
+func (latencyCollector) metrics() []metric {
+	latencies.Lock()
+	defer latencies.Unlock()
+
+	keys := make([][2]string, 0, len(latencies.m))
+	for k := range latencies.m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	var v []metric
+	for _, k := range keys {
+		nm, l, h := k[0], k[1], latencies.m[k]
+		help := latencyHelp[nm]
+		var n uint64
+		for i, le := range h.le {
+			n += h.counts[i]
+			v = append(v, metric{nm + "_bucket", "histogram", help,
+				l + `,le="` + strconv.FormatFloat(le, 'f', -1, 64) + `"`, float64(n)})
+		}
+		v = append(v, metric{nm + "_bucket", "histogram", help, l + `,le="+Inf"`, float64(h.n)},
+			metric{nm + "_sum", "histogram", help, l, h.sum},
+			metric{nm + "_count", "histogram", help, l, float64(h.n)})
+	}
+	return v
+}
+
+func init() {
+	addCollector(latencyCollector{})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,105 @@
+// latency_test.go -- tests for the latency histograms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	const l = `listen="test-observe"`
+	observe("goproxy_dns_seconds", l, 250*time.Millisecond)
+	observe("goproxy_dns_seconds", l, 500*time.Millisecond)
+	observe("goproxy_dns_seconds", l, time.Minute)
+
+	w := httptest.NewRecorder()
+	(&AdminServer{}).serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	s := w.Body.String()
+	if n := strings.Count(s, "# TYPE goproxy_dns_seconds histogram\n"); n != 1 {
+		t.Errorf("%d TYPE lines in\n%s", n, s)
+	}
+	for _, want := range []string{
+		`goproxy_dns_seconds_bucket{` + l + `,le="0.1"} 0` + "\n",
+		`goproxy_dns_seconds_bucket{` + l + `,le="0.25"} 1` + "\n",
+		`goproxy_dns_seconds_bucket{` + l + `,le="0.5"} 2` + "\n",
+		`goproxy_dns_seconds_bucket{` + l + `,le="10"} 2` + "\n",
+		`goproxy_dns_seconds_bucket{` + l + `,le="+Inf"} 3` + "\n",
+		`goproxy_dns_seconds_sum{` + l + `} 60.75` + "\n",
+		`goproxy_dns_seconds_count{` + l + `} 3` + "\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("no %q in\n%s", want, s)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	latencies.Lock()
+	latencies.m = make(map[[2]string]*histogram)
+	latencies.Unlock()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	addr := startHTTPProxy(t, &ListenConf{})
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	defer hc.CloseIdleConnections()
+
+	// the second request reuses the pooled connection
+	for i := 0; i < 2; i++ {
+		res, err := hc.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	c, br := connectTunnel(t, addr, "localhost:"+port, "", "")
+	io.WriteString(c, "ping\n")
+	if s, _ := br.ReadString('\n'); s != "ping\n" {
+		t.Errorf("tunnel: %q", s)
+	}
+	c.Close()
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	(&AdminServer{}).serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	s := w.Body.String()
+
+	// "lo" is the allow rule of the test listeners
+	const route = `listen="127.0.0.1:0",rule="lo",upstream="direct"`
+	for _, want := range []string{
+		`goproxy_dns_seconds_count{listen="127.0.0.1:0"} 1`,
+		`goproxy_dial_seconds_count{` + route + `} 2`,
+		`goproxy_ttfb_seconds_count{` + route + `} 2`,
+		`goproxy_session_seconds_count{` + route + `,proto="http"} 2`,
+		`goproxy_session_seconds_count{` + route + `,proto="connect"} 1`,
+	} {
+		if !strings.Contains(s, want+"\n") {
+			t.Errorf("no %q in\n%s", want, s)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
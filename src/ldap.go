@@ -0,0 +1,258 @@
+// ldap.go -- authenticator backed by an LDAP directory
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// Seconds a verified user and password are remembered
+	LDAP_CACHE_TTL = 60
+
+	// Seconds for each exchange with the directory
+	LDAP_TIMEOUT = 10
+)
+
+func init() {
+	RegisterAuth("ldap", newLDAPAuth)
+}
+
+// Checks users against an LDAP directory (or Active Directory). Either
+// binds as the user with a DN made from a template ("userdn"), or
+// searches for the user's entry with a service account ("binddn",
+// "base", "filter") and then binds as that entry. Members of "group"
+// only, if set. A verified user is remembered for "cache" seconds so
+// HTTP clients, which send their password with every request, don't
+// cost a bind each.
+type ldapAuth struct {
+	url      string
+	startTLS bool
+	tls      *tls.Config
+	timeout  time.Duration
+
+	userDN   string // template with %s
+	bindDN   string
+	bindPass string
+	base     string
+	filter   string // template with %s
+
+	group     string
+	groupAttr string
+
+	cache *authCache
+}
+
+func newLDAPAuth(args map[string]string) (Authenticator, error) {
+	a := &ldapAuth{
+		url:       args["url"],
+		userDN:    args["userdn"],
+		bindDN:    args["binddn"],
+		bindPass:  args["bindpassword"],
+		base:      args["base"],
+		filter:    args["filter"],
+		group:     args["group"],
+		groupAttr: args["groupattr"],
+		timeout:   LDAP_TIMEOUT * time.Second,
+		cache:     newAuthCache(LDAP_CACHE_TTL * time.Second),
+	}
+
+	u, err := url.Parse(a.url)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("url %q: want ldap://host[:port] or ldaps://host[:port]", a.url)
+	}
+
+	if s := args["starttls"]; len(s) > 0 {
+		if a.startTLS, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("starttls %q: %s", s, err)
+		}
+		if a.startTLS && u.Scheme == "ldaps" {
+			return nil, fmt.Errorf("starttls needs an ldap:// url")
+		}
+	}
+
+	a.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if fn := args["cafile"]; len(fn) > 0 {
+		pem, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		a.tls.RootCAs = x509.NewCertPool()
+		if !a.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cafile %s: no certificates", fn)
+		}
+	}
+
+	for _, k := range []string{"timeout", "cache"} {
+		s := args[k]
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s %q: not a number of seconds", k, s)
+		}
+		if k == "timeout" && n > 0 {
+			a.timeout = time.Duration(n) * time.Second
+		} else if k == "cache" {
+			a.cache.ttl = time.Duration(n) * time.Second
+		}
+	}
+
+	switch {
+	case len(a.userDN) > 0:
+		if !strings.Contains(a.userDN, "%s") {
+			return nil, fmt.Errorf("userdn %q: needs %%s for the user", a.userDN)
+		}
+	case len(a.base) > 0:
+		if len(a.filter) == 0 {
+			a.filter = "(uid=%s)"
+		}
+		if !strings.Contains(a.filter, "%s") {
+			return nil, fmt.Errorf("filter %q: needs %%s for the user", a.filter)
+		}
+	default:
+		return nil, fmt.Errorf("need 'userdn' or 'base'")
+	}
+
+	if len(a.group) > 0 && len(a.groupAttr) == 0 {
+		a.groupAttr = "member"
+	}
+	return a, nil
+}
+
+func (a *ldapAuth) dial() (*ldap.Conn, error) {
+	nd := &net.Dialer{Timeout: a.timeout}
+	c, err := ldap.DialURL(a.url, ldap.DialWithDialer(nd), ldap.DialWithTLSConfig(a.tls))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(a.timeout)
+
+	if a.startTLS {
+		if err := c.StartTLS(a.tls); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (a *ldapAuth) Authenticate(ctx context.Context, user, pass string) error {
+	// An empty password is an unauthenticated bind: it always succeeds
+	if len(user) == 0 || len(pass) == 0 {
+		return errAuthFailed
+	}
+
+	if a.cache.has(user, pass) {
+		return nil
+	}
+
+	if err := a.verify(user, pass); err != nil {
+		return err
+	}
+	a.cache.add(user, pass)
+	return nil
+}
+
+// Bind as 'user' and check the group; a wrong password or a user that
+// isn't found is errAuthFailed, a directory that can't be reached an
+// error of its own.
+func (a *ldapAuth) verify(user, pass string) error {
+	c, err := a.dial()
+	if err != nil {
+		return fmt.Errorf("ldap: %s", err)
+	}
+	defer c.Close()
+
+	dn := ""
+	if len(a.userDN) > 0 {
+		dn = fmt.Sprintf(a.userDN, ldap.EscapeDN(user))
+	} else {
+		if dn, err = a.search(c, user); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Bind(dn, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return errAuthFailed
+		}
+		return fmt.Errorf("ldap: bind %s: %s", dn, err)
+	}
+
+	if len(a.group) > 0 {
+		return a.member(c, dn)
+	}
+	return nil
+}
+
+// Return the DN of the entry of 'user'
+func (a *ldapAuth) search(c *ldap.Conn, user string) (string, error) {
+	if len(a.bindDN) > 0 {
+		if err := c.Bind(a.bindDN, a.bindPass); err != nil {
+			return "", fmt.Errorf("ldap: bind %s: %s", a.bindDN, err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(a.base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2,
+		int(a.timeout/time.Second), false, fmt.Sprintf(a.filter, ldap.EscapeFilter(user)),
+		[]string{"dn"}, nil)
+	res, err := c.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return "", errAuthFailed
+		}
+		return "", fmt.Errorf("ldap: search %s: %s", a.base, err)
+	}
+
+	// Unknown and ambiguous users are both refused
+	if len(res.Entries) != 1 {
+		return "", errAuthFailed
+	}
+	return res.Entries[0].DN, nil
+}
+
+// Return nil if 'dn' is a member of the group; the service account, if
+// there is one, looks: users may not be allowed to read groups.
+func (a *ldapAuth) member(c *ldap.Conn, dn string) error {
+	if len(a.bindDN) > 0 {
+		if err := c.Bind(a.bindDN, a.bindPass); err != nil {
+			return fmt.Errorf("ldap: bind %s: %s", a.bindDN, err)
+		}
+	}
+
+	filter := fmt.Sprintf("(%s=%s)", a.groupAttr, ldap.EscapeFilter(dn))
+	req := ldap.NewSearchRequest(a.group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1,
+		int(a.timeout/time.Second), false, filter, []string{"dn"}, nil)
+	res, err := c.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return fmt.Errorf("ldap: group %s: no such group", a.group)
+		}
+		return fmt.Errorf("ldap: group %s: %s", a.group, err)
+	}
+	if len(res.Entries) == 0 {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,239 @@
+// ldap_test.go -- tests for the LDAP authenticator
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// A directory with just enough LDAP for binds and searches
+type fakeLDAP struct {
+	binds int32
+
+	// DN -> password
+	users map[string]string
+
+	// search filter -> DNs it finds
+	entries map[string][]string
+
+	// group DN -> member DNs
+	groups map[string][]string
+}
+
+func startFakeLDAP(t *testing.T, d *fakeLDAP) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(c)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func ldapResult(id int64, tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(r)
+	return p
+}
+
+func ldapEntry(id int64, dn string) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	r.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+	p.AppendChild(r)
+	return p
+}
+
+func (d *fakeLDAP) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			atomic.AddInt32(&d.binds, 1)
+			dn := op.Children[1].Value.(string)
+			pass := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if pw, ok := d.users[dn]; ok && pw == pass {
+				code = ldap.LDAPResultSuccess
+			}
+			c.Write(ldapResult(id, ldap.ApplicationBindResponse, int(code)).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+
+			code := ldap.LDAPResultSuccess
+			if m, ok := d.groups[base]; ok {
+				for _, dn := range m {
+					if filter == "(member="+ldap.EscapeFilter(dn)+")" {
+						c.Write(ldapEntry(id, base).Bytes())
+					}
+				}
+			} else if strings.HasPrefix(base, "cn=") {
+				code = ldap.LDAPResultNoSuchObject
+			} else {
+				for _, dn := range d.entries[filter] {
+					c.Write(ldapEntry(id, dn).Bytes())
+				}
+			}
+			c.Write(ldapResult(id, ldap.ApplicationSearchResultDone, int(code)).Bytes())
+
+		default:
+			return
+		}
+	}
+}
+
+func newTestLDAP(t *testing.T, args map[string]string) *ldapAuth {
+	a, err := newLDAPAuth(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*ldapAuth)
+}
+
+func TestLDAPBind(t *testing.T) {
+	d := &fakeLDAP{
+		users: map[string]string{"uid=alice,ou=people,dc=example": "wonder"},
+	}
+	u := startFakeLDAP(t, d)
+	a := newTestLDAP(t, map[string]string{"url": u, "userdn": "uid=%s,ou=people,dc=example"})
+
+	ctx := context.Background()
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Fatalf("alice: %s", err)
+	}
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Fatalf("alice again: %s", err)
+	}
+	if n := atomic.LoadInt32(&d.binds); n != 1 {
+		t.Errorf("%d binds; want 1 (cached)", n)
+	}
+
+	for _, x := range [][2]string{{"alice", "nope"}, {"bob", "wonder"}, {"alice", ""}, {"alice,ou=x", "wonder"}} {
+		if err := a.Authenticate(ctx, x[0], x[1]); err != errAuthFailed {
+			t.Errorf("%q %q: %v", x[0], x[1], err)
+		}
+	}
+}
+
+func TestLDAPSearch(t *testing.T) {
+	d := &fakeLDAP{
+		users: map[string]string{
+			"cn=svc,dc=example":               "svcpw",
+			"cn=Alice A,ou=people,dc=example": "wonder",
+			"cn=Bob B,ou=people,dc=example":   "builder",
+		},
+		entries: map[string][]string{
+			"(sAMAccountName=alice)": {"cn=Alice A,ou=people,dc=example"},
+			"(sAMAccountName=bob)":   {"cn=Bob B,ou=people,dc=example"},
+			"(sAMAccountName=dup)":   {"cn=x,dc=example", "cn=y,dc=example"},
+		},
+		groups: map[string][]string{
+			"cn=proxy,ou=groups,dc=example": {"cn=Alice A,ou=people,dc=example"},
+		},
+	}
+	u := startFakeLDAP(t, d)
+	args := map[string]string{
+		"url":          u,
+		"binddn":       "cn=svc,dc=example",
+		"bindpassword": "svcpw",
+		"base":         "dc=example",
+		"filter":       "(sAMAccountName=%s)",
+		"cache":        "0",
+	}
+	a := newTestLDAP(t, args)
+
+	ctx := context.Background()
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Errorf("alice: %s", err)
+	}
+	if err := a.Authenticate(ctx, "bob", "builder"); err != nil {
+		t.Errorf("bob: %s", err)
+	}
+	if err := a.Authenticate(ctx, "dup", "x"); err != errAuthFailed {
+		t.Errorf("ambiguous user: %v", err)
+	}
+
+	// Group members only
+	args["group"] = "cn=proxy,ou=groups,dc=example"
+	a = newTestLDAP(t, args)
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Errorf("alice in group: %s", err)
+	}
+	if err := a.Authenticate(ctx, "bob", "builder"); err != errAuthFailed {
+		t.Errorf("bob not in group: %v", err)
+	}
+
+	args["group"] = "cn=nogroup,dc=example"
+	a = newTestLDAP(t, args)
+	if err := a.Authenticate(ctx, "alice", "wonder"); err == nil || err == errAuthFailed {
+		t.Errorf("missing group: %v", err)
+	}
+
+	// A wrong service password is a config error, not a bad user
+	args["bindpassword"] = "wrong"
+	a = newTestLDAP(t, args)
+	if err := a.Authenticate(ctx, "alice", "wonder"); err == nil || err == errAuthFailed {
+		t.Errorf("bad service account: %v", err)
+	}
+}
+
+func TestLDAPConf(t *testing.T) {
+	bad := []map[string]string{
+		{"userdn": "uid=%s"},
+		{"url": "http://x", "userdn": "uid=%s"},
+		{"url": "ldap://x"},
+		{"url": "ldap://x", "userdn": "uid=alice"},
+		{"url": "ldaps://x", "userdn": "uid=%s", "starttls": "true"},
+		{"url": "ldap://x", "base": "dc=x", "cache": "-1"},
+	}
+	for _, args := range bad {
+		if _, err := newLDAPAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	a := newTestLDAP(t, map[string]string{"url": "ldap://x", "base": "dc=x", "group": "cn=g"})
+	if a.filter != "(uid=%s)" || a.groupAttr != "member" {
+		t.Errorf("defaults: %q %q", a.filter, a.groupAttr)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
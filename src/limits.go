@@ -0,0 +1,346 @@
+// limits.go -- request limits and slow client protection
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Default request limits
+const (
+	MAX_REQUEST_LINE = 8192
+	MAX_HEADERS      = 100
+	MAX_HEADER_BYTES = 65536
+)
+
+// Default client timeouts (seconds)
+const (
+	CLIENT_HANDSHAKE = 10
+	CLIENT_IDLE      = 60
+	CLIENT_GRACE     = 30
+)
+
+var errResponseTooLarge = errors.New("response body too large")
+
+// Request limits with defaults filled in
+type limits struct {
+	reqLine     int
+	headers     int
+	headerBytes int
+
+	// body limits; 0 is unlimited
+	body     int64
+	response int64
+}
+
+func newLimits(lc *LimitConf) *limits {
+	l := &limits{
+		reqLine:     lc.RequestLine,
+		headers:     lc.Headers,
+		headerBytes: lc.HeaderBytes,
+		body:        lc.Body,
+		response:    lc.Response,
+	}
+
+	if l.reqLine <= 0 {
+		l.reqLine = MAX_REQUEST_LINE
+	}
+	if l.headers <= 0 {
+		l.headers = MAX_HEADERS
+	}
+	if l.headerBytes <= 0 {
+		l.headerBytes = MAX_HEADER_BYTES
+	}
+	return l
+}
+
+// Check the request line and headers of 'r'. Return 0 if the request
+// is acceptable; else return the HTTP status and the reason.
+func (l *limits) check(r *http.Request) (int, string) {
+	// METHOD SP URI SP PROTO
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 2
+	if n > l.reqLine {
+		return http.StatusRequestURITooLong,
+			fmt.Sprintf("request line too long (%d > %d bytes)", n, l.reqLine)
+	}
+
+	nh := 0
+	sz := n + 2
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			// "Key: Value\r\n"
+			sz += len(k) + len(v) + 4
+			nh++
+		}
+	}
+
+	if nh > l.headers {
+		return http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Sprintf("too many headers (%d > %d)", nh, l.headers)
+	}
+
+	if sz > l.headerBytes {
+		return http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Sprintf("request header too large (%d > %d bytes)", sz, l.headerBytes)
+	}
+
+	if l.body > 0 && r.ContentLength > l.body {
+		return http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body too large (%d > %d bytes)", r.ContentLength, l.body)
+	}
+
+	if r.Method == "CONNECT" {
+		if err := checkConnectTarget(r.RequestURI); err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+	}
+
+	return 0, ""
+}
+
+// Return a reader of the response body 'r' that fails with
+// errResponseTooLarge if it is over the limit.
+func (l *limits) responseBody(r io.Reader) io.Reader {
+	if l.response <= 0 {
+		return r
+	}
+	return &maxReader{Reader: r, n: l.response}
+}
+
+// Reads up to 'n' bytes; if there are more, fails with
+// errResponseTooLarge.
+type maxReader struct {
+	io.Reader
+	n int64
+}
+
+func (m *maxReader) Read(b []byte) (int, error) {
+	if m.n <= 0 {
+		var x [1]byte
+		n, err := m.Reader.Read(x[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(b)) > m.n {
+		b = b[:m.n]
+	}
+	n, err := m.Reader.Read(b)
+	m.n -= int64(n)
+	return n, err
+}
+
+// A CONNECT target must be host:port (RFC 7231 authority-form) with a
+// valid hostname or IP address and a non-zero port.
+func checkConnectTarget(s string) error {
+	host, ps, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("malformed CONNECT target '%s'", s)
+	}
+
+	port, err := strconv.Atoi(ps)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port in CONNECT target '%s'", s)
+	}
+
+	if strings.HasPrefix(s, "[") {
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address in CONNECT target '%s'", s)
+		}
+		return nil
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if !validHostname(host) {
+		return fmt.Errorf("invalid host in CONNECT target '%s'", s)
+	}
+	return nil
+}
+
+// Return true if 's' is a syntactically valid DNS hostname
+func validHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+
+	for _, l := range strings.Split(s, ".") {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(l); i++ {
+			c := l[i]
+			switch {
+			case c >= 'a' && c <= 'z':
+			case c >= 'A' && c <= 'Z':
+			case c >= '0' && c <= '9':
+			case c == '-' || c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Client timeouts and transfer rate policy with defaults filled in
+type clientPolicy struct {
+	handshake time.Duration
+	idle      time.Duration
+	grace     time.Duration
+	minRate   int
+}
+
+func newClientPolicy(cc *ClientConf) *clientPolicy {
+	c := &clientPolicy{
+		handshake: time.Duration(cc.Handshake) * time.Second,
+		idle:      time.Duration(cc.Idle) * time.Second,
+		grace:     time.Duration(cc.Grace) * time.Second,
+		minRate:   cc.MinRate,
+	}
+
+	if c.handshake <= 0 {
+		c.handshake = CLIENT_HANDSHAKE * time.Second
+	}
+	if c.idle <= 0 {
+		c.idle = CLIENT_IDLE * time.Second
+	}
+	if c.grace <= 0 {
+		c.grace = CLIENT_GRACE * time.Second
+	}
+	return c
+}
+
+// Tracks the transfer rate of one body
+type rateGuard struct {
+	*clientPolicy
+
+	t0 time.Time
+	n  int64
+}
+
+// Account for 'n' more bytes; return an error if the average rate is
+// below the minimum once the grace period is over.
+func (g *rateGuard) add(n int) error {
+	if g.minRate <= 0 {
+		return nil
+	}
+
+	g.n += int64(n)
+	el := time.Since(g.t0)
+	if el > g.grace {
+		if rate := float64(g.n) / el.Seconds(); rate < float64(g.minRate) {
+			return fmt.Errorf("transfer rate %.0f B/s is below %d B/s", rate, g.minRate)
+		}
+	}
+	return nil
+}
+
+// A request body that must keep up with the client policy: each read
+// must complete within the grace period and the average rate must not
+// drop below the minimum.
+type slowBody struct {
+	io.ReadCloser
+	rateGuard
+
+	rc   *http.ResponseController
+	who  string
+	log  *L.Logger
+	done bool
+}
+
+func (c *clientPolicy) body(w http.ResponseWriter, r *http.Request, log *L.Logger) io.ReadCloser {
+	return &slowBody{
+		ReadCloser: r.Body,
+		rateGuard:  rateGuard{clientPolicy: c, t0: time.Now()},
+		rc:         http.NewResponseController(w),
+		who:        r.RemoteAddr,
+		log:        log,
+	}
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(time.Now().Add(b.grace))
+	n, err := b.ReadCloser.Read(p)
+	if err == nil {
+		if err = b.add(n); err != nil {
+			b.drop(err)
+		}
+	} else if isTimeout(err) {
+		b.drop(fmt.Errorf("request body stalled for %s", b.grace))
+	}
+	return n, err
+}
+
+func (b *slowBody) drop(err error) {
+	if !b.done {
+		b.log.Info("%s: dropping slow client: %s", b.who, err)
+		b.done = true
+	}
+}
+
+// A response writer with the same policy as slowBody
+type slowWriter struct {
+	http.ResponseWriter
+	rateGuard
+
+	rc  *http.ResponseController
+	who string
+	log *L.Logger
+}
+
+// Bound the writes to 'w' that aren't body data: headers, error pages
+// and trailers. Call this when we are about to respond - after waiting
+// on the upstream, not before.
+func (c *clientPolicy) respond(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(c.grace))
+}
+
+func (c *clientPolicy) writer(w http.ResponseWriter, r *http.Request, log *L.Logger) *slowWriter {
+	return &slowWriter{
+		ResponseWriter: w,
+		rateGuard:      rateGuard{clientPolicy: c, t0: time.Now()},
+		rc:             http.NewResponseController(w),
+		who:            r.RemoteAddr,
+		log:            log,
+	}
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	s.rc.SetWriteDeadline(time.Now().Add(s.grace))
+	n, err := s.ResponseWriter.Write(p)
+	if err != nil {
+		if isTimeout(err) {
+			s.log.Info("%s: dropping slow client: response stalled for %s", s.who, s.grace)
+		}
+		return n, err
+	}
+
+	if err = s.add(n); err != nil {
+		s.log.Info("%s: dropping slow client: %s", s.who, err)
+		return n, err
+	}
+	return n, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,70 @@
+// limits_test.go -- tests for request and response limits
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitsBody(t *testing.T) {
+	l := newLimits(&LimitConf{Body: 100})
+
+	tests := []struct {
+		n    int
+		code int
+	}{
+		{0, 0},
+		{100, 0},
+		{101, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://example.com/", strings.NewReader(strings.Repeat("x", tt.n)))
+		if code, why := l.check(r); code != tt.code {
+			t.Errorf("%d byte body: %d %q, want %d", tt.n, code, why, tt.code)
+		}
+	}
+
+	// Unlimited by default
+	l = newLimits(&LimitConf{})
+	r := httptest.NewRequest("POST", "http://example.com/", strings.NewReader(strings.Repeat("x", 1<<20)))
+	if code, why := l.check(r); code != 0 {
+		t.Errorf("default limits: %d %q", code, why)
+	}
+}
+
+func TestLimitsResponse(t *testing.T) {
+	body := strings.Repeat("y", 1000)
+
+	tests := []struct {
+		max  int64
+		n    int
+		fail bool
+	}{
+		{0, 1000, false},
+		{1000, 1000, false},
+		{1001, 1000, false},
+		{999, 999, true},
+		{1, 1, true},
+	}
+
+	for _, tt := range tests {
+		l := newLimits(&LimitConf{Response: tt.max})
+		b, err := ioutil.ReadAll(l.responseBody(strings.NewReader(body)))
+		if len(b) != tt.n || (err == errResponseTooLarge) != tt.fail {
+			t.Errorf("limit %d: read %d bytes, %v; want %d bytes, fail %v", tt.max, len(b), err, tt.n, tt.fail)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,1601 @@
+// lua.go -- a small Lua interpreter for the scripting hooks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A subset of Lua 5.4: nil, booleans, numbers (all floats), strings,
+// tables and functions; the statements and operators of the language
+// without goto, varargs, metatables, coroutines and the integer
+// subtype. The library has no I/O: only what a hook needs to look at
+// strings and tables. Scripts get a budget of steps, time and memory
+// for each call.
+//
+// What the main chunk sets up (globals, top level locals and their
+// tables) is read-only once it has run: calls may run at once on many
+// goroutines and keep nothing between them.
+
+const (
+	// Deepest nesting of calls
+	LUA_DEPTH = 200
+
+	// Steps and time the main chunk of a script may take
+	LUA_LOAD_STEPS   = 10000000
+	LUA_LOAD_TIMEOUT = 5 * time.Second
+
+	// Compiled patterns kept for each script
+	LUA_PATTERNS = 256
+)
+
+var (
+	errLuaSteps   = errors.New("script: step limit exceeded")
+	errLuaTimeout = errors.New("script: time limit exceeded")
+	errLuaMemory  = errors.New("script: memory limit exceeded")
+)
+
+// A runtime or syntax error at a line of a script
+type luaError struct {
+	line int
+	msg  string
+}
+
+func (e *luaError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func luaErrorf(line int, f string, v ...interface{}) error {
+	return &luaError{line: line, msg: fmt.Sprintf(f, v...)}
+}
+
+// Values are nil, bool, float64, string, *luaTable, *luaFunc and
+// *luaBuiltin
+type luaValue interface{}
+
+type luaBuiltin struct {
+	name string
+	fn   func(st *luaState, args []luaValue) ([]luaValue, error)
+}
+
+type luaFunc struct {
+	proto *luaProto
+	env   *luaScope
+}
+
+type luaTable struct {
+	arr    []luaValue // keys 1..len(arr)
+	hash   map[luaValue]luaValue
+	frozen bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{hash: make(map[luaValue]luaValue)}
+}
+
+func (t *luaTable) get(k luaValue) luaValue {
+	if n, ok := k.(float64); ok {
+		if i := int(n); float64(i) == n && i >= 1 && i <= len(t.arr) {
+			return t.arr[i-1]
+		}
+		if n == 0 {
+			k = float64(0) // -0
+		}
+	}
+	if k == nil {
+		return nil
+	}
+	return t.hash[k]
+}
+
+func (t *luaTable) set(k, v luaValue) error {
+	if t.frozen {
+		return errors.New("table is read-only: it was made when the script was loaded")
+	}
+	switch x := k.(type) {
+	case nil:
+		return errors.New("table index is nil")
+	case float64:
+		if math.IsNaN(x) {
+			return errors.New("table index is NaN")
+		}
+		if x == 0 {
+			k = float64(0)
+		}
+		if i := int(x); float64(i) == x && i >= 1 && i <= len(t.arr)+1 {
+			switch {
+			case i <= len(t.arr):
+				t.arr[i-1] = v
+				for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+					t.arr = t.arr[:len(t.arr)-1]
+				}
+			case v != nil:
+				t.arr = append(t.arr, v)
+				delete(t.hash, k)
+				// move what follows out of the hash
+				for {
+					nk := float64(len(t.arr) + 1)
+					nv, ok := t.hash[nk]
+					if !ok {
+						break
+					}
+					t.arr = append(t.arr, nv)
+					delete(t.hash, nk)
+				}
+			}
+			return nil
+		}
+	}
+	if v == nil {
+		delete(t.hash, k)
+	} else {
+		t.hash[k] = v
+	}
+	return nil
+}
+
+// The border of the table: #t
+func (t *luaTable) length() int {
+	return len(t.arr)
+}
+
+// The keys of the table: the array part in order, then the rest sorted
+// so that iterations don't depend on the map
+func (t *luaTable) keys() []luaValue {
+	v := make([]luaValue, 0, len(t.arr)+len(t.hash))
+	for i := range t.arr {
+		if t.arr[i] != nil {
+			v = append(v, float64(i+1))
+		}
+	}
+	h := make([]luaValue, 0, len(t.hash))
+	for k := range t.hash {
+		h = append(h, k)
+	}
+	sort.Slice(h, func(i, j int) bool {
+		a, b := h[i], h[j]
+		ta, tb := luaType(a), luaType(b)
+		if ta != tb {
+			return ta < tb
+		}
+		switch x := a.(type) {
+		case float64:
+			return x < b.(float64)
+		case string:
+			return x < b.(string)
+		case bool:
+			return !x && b.(bool)
+		}
+		return fmt.Sprintf("%p", a) < fmt.Sprintf("%p", b)
+	})
+	return append(v, h...)
+}
+
+// Variables of a block
+type luaScope struct {
+	vars   map[string]luaValue
+	parent *luaScope
+	frozen bool
+}
+
+func (sc *luaScope) find(name string) *luaScope {
+	for ; sc != nil; sc = sc.parent {
+		if _, ok := sc.vars[name]; ok {
+			return sc
+		}
+	}
+	return nil
+}
+
+// A compiled script
+type luaScript struct {
+	name    string
+	main    *luaProto
+	globals *luaTable
+
+	// print() goes here
+	print func(string)
+
+	pmu      sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// A call (or the main chunk) running
+type luaState struct {
+	s        *luaScript
+	overlay  map[string]luaValue // globals set by this call; nil while loading
+	steps    int
+	limit    int
+	memory   int
+	maxmem   int
+	deadline time.Time
+	depth    int
+
+	// scopes and tables made while loading; frozen after
+	made   []*luaScope
+	tables []*luaTable
+}
+
+// Compile and run the script 'src'; 'print' gets what it prints
+func loadLua(name, src string, print func(string)) (*luaScript, error) {
+	main, err := parseLua(src)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &luaScript{name: name, main: main, print: print, patterns: make(map[string]*regexp.Regexp)}
+	s.globals = luaLibrary()
+
+	st := &luaState{s: s, limit: LUA_LOAD_STEPS, maxmem: 1 << 30,
+		deadline: time.Now().Add(LUA_LOAD_TIMEOUT)}
+	sc := st.scope(nil)
+	if _, _, err := st.exec(main.body, sc); err != nil {
+		return nil, err
+	}
+
+	for _, sc := range st.made {
+		sc.frozen = true
+	}
+	for _, t := range st.tables {
+		t.frozen = true
+	}
+	s.globals.frozen = true
+	return s, nil
+}
+
+// Return true if the script defines the function 'name'
+func (s *luaScript) has(name string) bool {
+	_, ok := s.globals.get(name).(*luaFunc)
+	return ok
+}
+
+// Call the function 'name' with a budget of 'steps', 'mem' bytes and
+// 'timeout'
+func (s *luaScript) call(name string, args []luaValue, steps, mem int, timeout time.Duration) ([]luaValue, error) {
+	st := &luaState{s: s, overlay: make(map[string]luaValue), limit: steps, maxmem: mem,
+		deadline: time.Now().Add(timeout)}
+	fn := s.globals.get(name)
+	if fn == nil {
+		return nil, nil
+	}
+	return st.call(fn, args, 0)
+}
+
+func (st *luaState) step() error {
+	st.steps++
+	if st.steps > st.limit {
+		return errLuaSteps
+	}
+	if st.steps&1023 == 0 && time.Now().After(st.deadline) {
+		return errLuaTimeout
+	}
+	return nil
+}
+
+// Count 'n' bytes allocated
+func (st *luaState) alloc(n int) error {
+	st.memory += n
+	if st.memory > st.maxmem {
+		return errLuaMemory
+	}
+	return nil
+}
+
+func (st *luaState) scope(parent *luaScope) *luaScope {
+	sc := &luaScope{vars: make(map[string]luaValue), parent: parent}
+	if st.overlay == nil {
+		st.made = append(st.made, sc)
+	}
+	return sc
+}
+
+func (st *luaState) table() (*luaTable, error) {
+	if err := st.alloc(64); err != nil {
+		return nil, err
+	}
+	t := newLuaTable()
+	if st.overlay == nil {
+		st.tables = append(st.tables, t)
+	}
+	return t, nil
+}
+
+func (st *luaState) getVar(name string, sc *luaScope) luaValue {
+	if s := sc.find(name); s != nil {
+		return s.vars[name]
+	}
+	if st.overlay != nil {
+		if v, ok := st.overlay[name]; ok {
+			return v
+		}
+	}
+	return st.s.globals.get(name)
+}
+
+func (st *luaState) setVar(name string, v luaValue, sc *luaScope, line int) error {
+	if s := sc.find(name); s != nil {
+		if s.frozen {
+			return luaErrorf(line, "'%s' is read-only: it was set when the script was loaded", name)
+		}
+		s.vars[name] = v
+		return nil
+	}
+	if st.overlay != nil {
+		st.overlay[name] = v
+		return nil
+	}
+	return st.s.globals.set(name, v)
+}
+
+// Control flow out of a block
+const (
+	luaNext = iota
+	luaBreak
+	luaReturn
+)
+
+func (st *luaState) exec(b []luaStmt, sc *luaScope) (int, []luaValue, error) {
+	for _, s := range b {
+		if err := st.step(); err != nil {
+			return 0, nil, err
+		}
+		ctl, vals, err := st.stmt(s, sc)
+		if err != nil || ctl != luaNext {
+			return ctl, vals, err
+		}
+	}
+	return luaNext, nil, nil
+}
+
+func (st *luaState) stmt(s luaStmt, sc *luaScope) (int, []luaValue, error) {
+	switch s := s.(type) {
+	case *luaLocal:
+		vals, err := st.evalList(s.exprs, sc)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, n := range s.names {
+			var v luaValue
+			if i < len(vals) {
+				v = vals[i]
+			}
+			sc.vars[n] = v
+		}
+
+	case *luaLocalFunc:
+		sc.vars[s.name] = nil
+		sc.vars[s.name] = &luaFunc{proto: s.f, env: sc}
+
+	case *luaAssign:
+		return luaNext, nil, st.assign(s, sc)
+
+	case *luaCallStmt:
+		_, err := st.evalCall(s.call, sc)
+		return luaNext, nil, err
+
+	case *luaDo:
+		return st.exec(s.body, st.scope(sc))
+
+	case *luaWhile:
+		for {
+			c, err := st.eval(s.cond, sc)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !luaTrue(c) {
+				break
+			}
+			ctl, vals, err := st.exec(s.body, st.scope(sc))
+			if err != nil || ctl == luaReturn {
+				return ctl, vals, err
+			}
+			if ctl == luaBreak {
+				break
+			}
+			if err := st.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaRepeat:
+		for {
+			bs := st.scope(sc)
+			ctl, vals, err := st.exec(s.body, bs)
+			if err != nil || ctl == luaReturn {
+				return ctl, vals, err
+			}
+			if ctl == luaBreak {
+				break
+			}
+			// the condition sees the locals of the body
+			c, err := st.eval(s.cond, bs)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaTrue(c) {
+				break
+			}
+			if err := st.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaIf:
+		for i, c := range s.conds {
+			v, err := st.eval(c, sc)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaTrue(v) {
+				return st.exec(s.blocks[i], st.scope(sc))
+			}
+		}
+		if s.els != nil {
+			return st.exec(s.els, st.scope(sc))
+		}
+
+	case *luaNumFor:
+		var v [3]float64
+		v[2] = 1
+		for i, e := range []luaExpr{s.start, s.stop, s.step} {
+			if e == nil {
+				continue
+			}
+			x, err := st.eval(e, sc)
+			if err != nil {
+				return 0, nil, err
+			}
+			n, ok := luaNumber(x)
+			if !ok {
+				return 0, nil, luaErrorf(s.line, "'for' limit must be a number")
+			}
+			v[i] = n
+		}
+		if v[2] == 0 {
+			return 0, nil, luaErrorf(s.line, "'for' step is zero")
+		}
+		for i := v[0]; (v[2] > 0 && i <= v[1]) || (v[2] < 0 && i >= v[1]); i += v[2] {
+			bs := st.scope(sc)
+			bs.vars[s.name] = i
+			ctl, vals, err := st.exec(s.body, bs)
+			if err != nil || ctl == luaReturn {
+				return ctl, vals, err
+			}
+			if ctl == luaBreak {
+				break
+			}
+			if err := st.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaGenFor:
+		vals, err := st.evalList(s.exprs, sc)
+		if err != nil {
+			return 0, nil, err
+		}
+		vals = append(vals, nil, nil, nil)
+		fn, state, ctl := vals[0], vals[1], vals[2]
+		for {
+			rs, err := st.call(fn, []luaValue{state, ctl}, s.line)
+			if err != nil {
+				return 0, nil, err
+			}
+			if len(rs) == 0 || rs[0] == nil {
+				break
+			}
+			ctl = rs[0]
+			bs := st.scope(sc)
+			for i, n := range s.names {
+				var v luaValue
+				if i < len(rs) {
+					v = rs[i]
+				}
+				bs.vars[n] = v
+			}
+			c, vals, err := st.exec(s.body, bs)
+			if err != nil || c == luaReturn {
+				return c, vals, err
+			}
+			if c == luaBreak {
+				break
+			}
+		}
+
+	case *luaReturnStmt:
+		vals, err := st.evalList(s.exprs, sc)
+		return luaReturn, vals, err
+
+	case *luaBreakStmt:
+		return luaBreak, nil, nil
+	}
+	return luaNext, nil, nil
+}
+
+func (st *luaState) assign(s *luaAssign, sc *luaScope) error {
+	// the keys and values are evaluated before anything is assigned
+	type slot struct {
+		t *luaTable
+		k luaValue
+	}
+	slots := make([]slot, len(s.targets))
+	for i, t := range s.targets {
+		x, ok := t.(*luaIndex)
+		if !ok {
+			continue
+		}
+		o, err := st.eval(x.obj, sc)
+		if err != nil {
+			return err
+		}
+		tb, ok := o.(*luaTable)
+		if !ok {
+			return luaErrorf(x.line, "attempt to index a %s value", luaType(o))
+		}
+		k, err := st.eval(x.key, sc)
+		if err != nil {
+			return err
+		}
+		slots[i] = slot{tb, k}
+	}
+	vals, err := st.evalList(s.exprs, sc)
+	if err != nil {
+		return err
+	}
+
+	for i, t := range s.targets {
+		var v luaValue
+		if i < len(vals) {
+			v = vals[i]
+		}
+		switch x := t.(type) {
+		case *luaName:
+			if err := st.setVar(x.name, v, sc, x.line); err != nil {
+				return err
+			}
+		case *luaIndex:
+			if err := st.alloc(16); err != nil {
+				return err
+			}
+			if err := slots[i].t.set(slots[i].k, v); err != nil {
+				return luaErrorf(x.line, "%s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate 'es'; the last one may give many values
+func (st *luaState) evalList(es []luaExpr, sc *luaScope) ([]luaValue, error) {
+	var vals []luaValue
+	for i, e := range es {
+		if c, ok := e.(*luaCall); ok && i == len(es)-1 {
+			rs, err := st.evalCall(c, sc)
+			if err != nil {
+				return nil, err
+			}
+			return append(vals, rs...), nil
+		}
+		v, err := st.eval(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func (st *luaState) eval(e luaExpr, sc *luaScope) (luaValue, error) {
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+
+	switch e := e.(type) {
+	case *luaConst:
+		return e.v, nil
+
+	case *luaName:
+		return st.getVar(e.name, sc), nil
+
+	case *luaIndex:
+		o, err := st.eval(e.obj, sc)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := o.(*luaTable)
+		if !ok {
+			return nil, luaErrorf(e.line, "attempt to index a %s value", luaType(o))
+		}
+		k, err := st.eval(e.key, sc)
+		if err != nil {
+			return nil, err
+		}
+		return t.get(k), nil
+
+	case *luaCall:
+		rs, err := st.evalCall(e, sc)
+		if err != nil || len(rs) == 0 {
+			return nil, err
+		}
+		return rs[0], nil
+
+	case *luaFuncExpr:
+		return &luaFunc{proto: e.f, env: sc}, nil
+
+	case *luaTableExpr:
+		t, err := st.table()
+		if err != nil {
+			return nil, err
+		}
+		n := 1
+		for i, it := range e.items {
+			if it.key == nil {
+				// the last positional item may give many values
+				var vals []luaValue
+				if c, ok := it.val.(*luaCall); ok && i == len(e.items)-1 {
+					vals, err = st.evalCall(c, sc)
+				} else {
+					var v luaValue
+					v, err = st.eval(it.val, sc)
+					vals = []luaValue{v}
+				}
+				if err != nil {
+					return nil, err
+				}
+				for _, v := range vals {
+					if err := st.alloc(16); err != nil {
+						return nil, err
+					}
+					t.set(float64(n), v)
+					n++
+				}
+				continue
+			}
+			k, err := st.eval(it.key, sc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := st.eval(it.val, sc)
+			if err != nil {
+				return nil, err
+			}
+			if err := st.alloc(16); err != nil {
+				return nil, err
+			}
+			if err := t.set(k, v); err != nil {
+				return nil, luaErrorf(e.line, "%s", err)
+			}
+		}
+		return t, nil
+
+	case *luaParen:
+		return st.eval(e.e, sc)
+
+	case *luaUnop:
+		a, err := st.eval(e.a, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "not":
+			return !luaTrue(a), nil
+		case "-":
+			n, ok := luaNumber(a)
+			if !ok {
+				return nil, luaErrorf(e.line, "attempt to perform arithmetic on a %s value", luaType(a))
+			}
+			return -n, nil
+		case "#":
+			switch x := a.(type) {
+			case string:
+				return float64(len(x)), nil
+			case *luaTable:
+				return float64(x.length()), nil
+			}
+			return nil, luaErrorf(e.line, "attempt to get length of a %s value", luaType(a))
+		}
+
+	case *luaBinop:
+		a, err := st.eval(e.a, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "and":
+			if !luaTrue(a) {
+				return a, nil
+			}
+			return st.eval(e.b, sc)
+		case "or":
+			if luaTrue(a) {
+				return a, nil
+			}
+			return st.eval(e.b, sc)
+		}
+		b, err := st.eval(e.b, sc)
+		if err != nil {
+			return nil, err
+		}
+		return st.binop(e.op, a, b, e.line)
+	}
+	return nil, fmt.Errorf("script: bad expression %T", e)
+}
+
+func (st *luaState) binop(op string, a, b luaValue, line int) (luaValue, error) {
+	switch op {
+	case "==":
+		return luaEqual(a, b), nil
+	case "~=":
+		return !luaEqual(a, b), nil
+	case "<", "<=", ">", ">=":
+		if op == ">" || op == ">=" {
+			a, b = b, a
+			op = strings.Replace(op, ">", "<", 1)
+		}
+		switch x := a.(type) {
+		case float64:
+			if y, ok := b.(float64); ok {
+				return x < y || (op == "<=" && x == y), nil
+			}
+		case string:
+			if y, ok := b.(string); ok {
+				return x < y || (op == "<=" && x == y), nil
+			}
+		}
+		return nil, luaErrorf(line, "attempt to compare %s with %s", luaType(a), luaType(b))
+	case "..":
+		x, ok1 := luaConcatable(a)
+		y, ok2 := luaConcatable(b)
+		if !ok1 || !ok2 {
+			bad := a
+			if ok1 {
+				bad = b
+			}
+			return nil, luaErrorf(line, "attempt to concatenate a %s value", luaType(bad))
+		}
+		if err := st.alloc(len(x) + len(y)); err != nil {
+			return nil, err
+		}
+		return x + y, nil
+	}
+
+	x, ok1 := luaNumber(a)
+	y, ok2 := luaNumber(b)
+	if !ok1 || !ok2 {
+		bad := a
+		if ok1 {
+			bad = b
+		}
+		return nil, luaErrorf(line, "attempt to perform arithmetic on a %s value", luaType(bad))
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		return x / y, nil
+	case "//":
+		return math.Floor(x / y), nil
+	case "%":
+		if math.IsInf(y, 0) && !math.IsInf(x, 0) {
+			if (x >= 0) == (y > 0) {
+				return x, nil
+			}
+			return y, nil
+		}
+		return x - math.Floor(x/y)*y, nil
+	case "^":
+		return math.Pow(x, y), nil
+	}
+	return nil, luaErrorf(line, "bad operator %s", op)
+}
+
+func (st *luaState) evalCall(c *luaCall, sc *luaScope) ([]luaValue, error) {
+	var fn luaValue
+	var args []luaValue
+	if len(c.method) > 0 {
+		o, err := st.eval(c.fn, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch x := o.(type) {
+		case string:
+			lib, _ := st.s.globals.get("string").(*luaTable)
+			if lib != nil {
+				fn = lib.get(c.method)
+			}
+		case *luaTable:
+			fn = x.get(c.method)
+		default:
+			return nil, luaErrorf(c.line, "attempt to index a %s value", luaType(o))
+		}
+		if fn == nil {
+			return nil, luaErrorf(c.line, "no method '%s'", c.method)
+		}
+		args = append(args, o)
+	} else {
+		var err error
+		if fn, err = st.eval(c.fn, sc); err != nil {
+			return nil, err
+		}
+	}
+
+	vals, err := st.evalList(c.args, sc)
+	if err != nil {
+		return nil, err
+	}
+	return st.call(fn, append(args, vals...), c.line)
+}
+
+func (st *luaState) call(fn luaValue, args []luaValue, line int) ([]luaValue, error) {
+	if st.depth >= LUA_DEPTH {
+		return nil, luaErrorf(line, "stack overflow")
+	}
+	st.depth++
+	defer func() { st.depth-- }()
+
+	switch f := fn.(type) {
+	case *luaBuiltin:
+		rs, err := f.fn(st, args)
+		if err != nil {
+			if _, ok := err.(*luaError); !ok && !isLuaLimit(err) {
+				err = luaErrorf(line, "%s: %s", f.name, err)
+			}
+		}
+		return rs, err
+	case *luaFunc:
+		sc := st.scope(f.env)
+		for i, p := range f.proto.params {
+			var v luaValue
+			if i < len(args) {
+				v = args[i]
+			}
+			sc.vars[p] = v
+		}
+		ctl, vals, err := st.exec(f.proto.body, sc)
+		if err != nil || ctl != luaReturn {
+			return nil, err
+		}
+		return vals, nil
+	}
+	return nil, luaErrorf(line, "attempt to call a %s value", luaType(fn))
+}
+
+func isLuaLimit(err error) bool {
+	return err == errLuaSteps || err == errLuaTimeout || err == errLuaMemory
+}
+
+func luaTrue(v luaValue) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	return true
+}
+
+func luaEqual(a, b luaValue) bool {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	}
+	return a == b
+}
+
+func luaType(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	}
+	return "function"
+}
+
+// Numbers; strings that are numbers too
+func luaNumber(v luaValue) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return luaParseNumber(x)
+	}
+	return 0, false
+}
+
+func luaParseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	t := s
+	if strings.HasPrefix(t, "-") {
+		neg, t = true, t[1:]
+	}
+	if strings.HasPrefix(t, "0x") || strings.HasPrefix(t, "0X") {
+		n, err := strconv.ParseUint(t[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if strings.ContainsAny(strings.ToLower(t), "in") {
+		// no "inf" or "nan"
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func luaConcatable(v luaValue) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64:
+		return luaNumString(x), true
+	}
+	return "", false
+}
+
+func luaNumString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func luaString(v luaValue) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return luaNumString(x)
+	case string:
+		return x
+	case *luaTable:
+		return fmt.Sprintf("table: %p", x)
+	case *luaFunc:
+		return fmt.Sprintf("function: %p", x)
+	case *luaBuiltin:
+		return "function: builtin: " + x.name
+	}
+	return "?"
+}
+
+// The library of a script
+func luaLibrary() *luaTable {
+	g := newLuaTable()
+	lib := func(name string, fns map[string]func(*luaState, []luaValue) ([]luaValue, error)) {
+		t := newLuaTable()
+		for k, f := range fns {
+			n := k
+			if len(name) > 0 {
+				n = name + "." + k
+			}
+			t.set(k, &luaBuiltin{name: n, fn: f})
+		}
+		t.frozen = true
+		if len(name) == 0 {
+			for _, k := range t.keys() {
+				g.set(k, t.get(k))
+			}
+		} else {
+			g.set(name, t)
+		}
+	}
+
+	lib("", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"print":    luaPrint,
+		"type":     func(st *luaState, a []luaValue) ([]luaValue, error) { return []luaValue{luaType(luaArg(a, 0))}, nil },
+		"tostring": luaToString,
+		"tonumber": luaToNumber,
+		"ipairs":   luaIpairs,
+		"pairs":    luaPairs,
+		"error":    luaErrorFn,
+		"assert":   luaAssert,
+		"select":   luaSelect,
+	})
+	lib("string", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"len":    luaStrLen,
+		"sub":    luaStrSub,
+		"lower":  luaStrCase(strings.ToLower),
+		"upper":  luaStrCase(strings.ToUpper),
+		"rep":    luaStrRep,
+		"find":   luaStrFind,
+		"match":  luaStrMatch,
+		"gsub":   luaStrGsub,
+		"format": luaStrFormat,
+	})
+	lib("table", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"insert": luaTabInsert,
+		"remove": luaTabRemove,
+		"concat": luaTabConcat,
+	})
+	lib("math", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"floor": luaMath(math.Floor),
+		"ceil":  luaMath(math.Ceil),
+		"abs":   luaMath(math.Abs),
+		"max":   luaMinMax(func(a, b float64) bool { return a > b }),
+		"min":   luaMinMax(func(a, b float64) bool { return a < b }),
+	})
+	m := g.get("math").(*luaTable)
+	m.frozen = false
+	m.set("huge", math.Inf(1))
+	m.frozen = true
+
+	lib("os", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"time": func(st *luaState, a []luaValue) ([]luaValue, error) {
+			return []luaValue{float64(time.Now().Unix())}, nil
+		},
+	})
+	lib("net", map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"contains": luaNetContains,
+	})
+	return g
+}
+
+func luaArg(a []luaValue, i int) luaValue {
+	if i < len(a) {
+		return a[i]
+	}
+	return nil
+}
+
+func luaStrArg(a []luaValue, i int) (string, error) {
+	s, ok := luaConcatable(luaArg(a, i))
+	if !ok {
+		return "", fmt.Errorf("bad argument #%d (string expected, got %s)", i+1, luaType(luaArg(a, i)))
+	}
+	return s, nil
+}
+
+func luaNumArg(a []luaValue, i int, def float64) (float64, error) {
+	v := luaArg(a, i)
+	if v == nil {
+		return def, nil
+	}
+	n, ok := luaNumber(v)
+	if !ok {
+		return 0, fmt.Errorf("bad argument #%d (number expected, got %s)", i+1, luaType(v))
+	}
+	return n, nil
+}
+
+func luaTabArg(a []luaValue, i int) (*luaTable, error) {
+	t, ok := luaArg(a, i).(*luaTable)
+	if !ok {
+		return nil, fmt.Errorf("bad argument #%d (table expected, got %s)", i+1, luaType(luaArg(a, i)))
+	}
+	return t, nil
+}
+
+func luaPrint(st *luaState, a []luaValue) ([]luaValue, error) {
+	v := make([]string, len(a))
+	for i := range a {
+		v[i] = luaString(a[i])
+	}
+	if st.s.print != nil {
+		st.s.print(strings.Join(v, "\t"))
+	}
+	return nil, nil
+}
+
+func luaToString(st *luaState, a []luaValue) ([]luaValue, error) {
+	s := luaString(luaArg(a, 0))
+	return []luaValue{s}, st.alloc(len(s))
+}
+
+func luaToNumber(st *luaState, a []luaValue) ([]luaValue, error) {
+	v := luaArg(a, 0)
+	if len(a) > 1 {
+		base, err := luaNumArg(a, 1, 10)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := v.(string)
+		if !ok {
+			return []luaValue{nil}, nil
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), int(base), 64)
+		if err != nil {
+			return []luaValue{nil}, nil
+		}
+		return []luaValue{float64(n)}, nil
+	}
+	if n, ok := luaNumber(v); ok {
+		return []luaValue{n}, nil
+	}
+	return []luaValue{nil}, nil
+}
+
+func luaIpairs(st *luaState, a []luaValue) ([]luaValue, error) {
+	t, err := luaTabArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	iter := &luaBuiltin{name: "ipairs", fn: func(st *luaState, a []luaValue) ([]luaValue, error) {
+		i, _ := luaArg(a, 1).(float64)
+		v := t.get(i + 1)
+		if v == nil {
+			return []luaValue{nil}, nil
+		}
+		return []luaValue{i + 1, v}, nil
+	}}
+	return []luaValue{iter, t, float64(0)}, nil
+}
+
+func luaPairs(st *luaState, a []luaValue) ([]luaValue, error) {
+	t, err := luaTabArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := t.keys()
+	if err := st.alloc(16 * len(keys)); err != nil {
+		return nil, err
+	}
+	i := 0
+	iter := &luaBuiltin{name: "pairs", fn: func(st *luaState, a []luaValue) ([]luaValue, error) {
+		for ; i < len(keys); i++ {
+			if v := t.get(keys[i]); v != nil {
+				i++
+				return []luaValue{keys[i-1], v}, nil
+			}
+		}
+		return []luaValue{nil}, nil
+	}}
+	return []luaValue{iter, t, nil}, nil
+}
+
+func luaErrorFn(st *luaState, a []luaValue) ([]luaValue, error) {
+	return nil, errors.New(luaString(luaArg(a, 0)))
+}
+
+func luaAssert(st *luaState, a []luaValue) ([]luaValue, error) {
+	if !luaTrue(luaArg(a, 0)) {
+		msg := "assertion failed!"
+		if len(a) > 1 {
+			msg = luaString(a[1])
+		}
+		return nil, errors.New(msg)
+	}
+	return a, nil
+}
+
+func luaSelect(st *luaState, a []luaValue) ([]luaValue, error) {
+	if s, ok := luaArg(a, 0).(string); ok && s == "#" {
+		return []luaValue{float64(len(a) - 1)}, nil
+	}
+	n, err := luaNumArg(a, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	i := int(n)
+	if i < 0 {
+		i = len(a) + i
+	}
+	if i < 1 {
+		return nil, fmt.Errorf("bad argument #1 (index out of range)")
+	}
+	if i >= len(a) {
+		return nil, nil
+	}
+	return a[i:], nil
+}
+
+func luaStrLen(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	return []luaValue{float64(len(s))}, err
+}
+
+// Lua's string positions: 1 is the first byte, -1 the last
+func luaStrPos(n float64, l int) int {
+	i := int(n)
+	if i < 0 {
+		i = l + i + 1
+	}
+	return i
+}
+
+func luaStrSub(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	i, err := luaNumArg(a, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := luaNumArg(a, 2, -1)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := max(luaStrPos(i, len(s)), 1), min(luaStrPos(j, len(s)), len(s))
+	if lo > hi {
+		return []luaValue{""}, nil
+	}
+	return []luaValue{s[lo-1 : hi]}, nil
+}
+
+func luaStrCase(f func(string) string) func(*luaState, []luaValue) ([]luaValue, error) {
+	return func(st *luaState, a []luaValue) ([]luaValue, error) {
+		s, err := luaStrArg(a, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []luaValue{f(s)}, st.alloc(len(s))
+	}
+}
+
+func luaStrRep(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := luaNumArg(a, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 || len(s) == 0 {
+		return []luaValue{""}, nil
+	}
+	if float64(len(s))*n > float64(st.maxmem-st.memory) {
+		return nil, errLuaMemory
+	}
+	if err := st.alloc(len(s) * int(n)); err != nil {
+		return nil, err
+	}
+	return []luaValue{strings.Repeat(s, int(n))}, nil
+}
+
+// The compiled regular expression 'p' (patterns are RE2, not Lua's)
+func (st *luaState) pattern(p string) (*regexp.Regexp, error) {
+	s := st.s
+	s.pmu.Lock()
+	re, ok := s.patterns[p]
+	s.pmu.Unlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	s.pmu.Lock()
+	if len(s.patterns) < LUA_PATTERNS {
+		s.patterns[p] = re
+	}
+	s.pmu.Unlock()
+	return re, nil
+}
+
+// string.find(s, pattern [, init [, plain]])
+func luaStrFind(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	p, err := luaStrArg(a, 1)
+	if err != nil {
+		return nil, err
+	}
+	n, err := luaNumArg(a, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	init := max(luaStrPos(n, len(s)), 1)
+	if init > len(s)+1 {
+		return []luaValue{nil}, nil
+	}
+	if luaTrue(luaArg(a, 3)) {
+		i := strings.Index(s[init-1:], p)
+		if i < 0 {
+			return []luaValue{nil}, nil
+		}
+		return []luaValue{float64(init + i), float64(init + i + len(p) - 1)}, nil
+	}
+	re, err := st.pattern(p)
+	if err != nil {
+		return nil, err
+	}
+	m := re.FindStringSubmatchIndex(s[init-1:])
+	if m == nil {
+		return []luaValue{nil}, nil
+	}
+	r := []luaValue{float64(init + m[0]), float64(init + m[1] - 1)}
+	for i := 2; i+1 < len(m); i += 2 {
+		if m[i] < 0 {
+			r = append(r, nil)
+		} else {
+			r = append(r, s[init-1+m[i]:init-1+m[i+1]])
+		}
+	}
+	return r, nil
+}
+
+// string.match(s, pattern): the captures, or the whole match
+func luaStrMatch(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	p, err := luaStrArg(a, 1)
+	if err != nil {
+		return nil, err
+	}
+	re, err := st.pattern(p)
+	if err != nil {
+		return nil, err
+	}
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return []luaValue{nil}, nil
+	}
+	if len(m) == 1 {
+		return []luaValue{m[0]}, nil
+	}
+	r := make([]luaValue, len(m)-1)
+	for i := range r {
+		r[i] = m[i+1]
+	}
+	return r, nil
+}
+
+// string.gsub(s, pattern, repl): repl has $1 for the captures; return
+// the string and the number of matches
+func luaStrGsub(st *luaState, a []luaValue) ([]luaValue, error) {
+	s, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	p, err := luaStrArg(a, 1)
+	if err != nil {
+		return nil, err
+	}
+	repl, err := luaStrArg(a, 2)
+	if err != nil {
+		return nil, err
+	}
+	re, err := st.pattern(p)
+	if err != nil {
+		return nil, err
+	}
+	n := len(re.FindAllStringIndex(s, -1))
+	if err := st.alloc(len(s) + n*len(repl)); err != nil {
+		return nil, err
+	}
+	return []luaValue{re.ReplaceAllString(s, repl), float64(n)}, nil
+}
+
+// string.format with %s, %q, %d, %x, %f and %g (with flags and widths)
+func luaStrFormat(st *luaState, a []luaValue) ([]luaValue, error) {
+	f, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	n := 1
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		j := i + 1
+		for j < len(f) && strings.IndexByte("-+ #0123456789.", f[j]) >= 0 {
+			j++
+		}
+		if j >= len(f) {
+			return nil, fmt.Errorf("invalid format '%s'", f[i:])
+		}
+		spec, verb := f[i+1:j], f[j]
+		i = j
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if n >= len(a) {
+			return nil, fmt.Errorf("bad argument #%d (no value)", n+1)
+		}
+		v := a[n]
+		n++
+		switch verb {
+		case 's':
+			fmt.Fprintf(&b, "%"+spec+"s", luaString(v))
+		case 'q':
+			fmt.Fprintf(&b, "%q", luaString(v))
+		case 'd', 'x', 'X':
+			x, ok := luaNumber(v)
+			if !ok || x != math.Trunc(x) {
+				return nil, fmt.Errorf("bad argument #%d (number has no integer representation)", n)
+			}
+			fmt.Fprintf(&b, "%"+spec+string(verb), int64(x))
+		case 'f', 'g', 'e':
+			x, ok := luaNumber(v)
+			if !ok {
+				return nil, fmt.Errorf("bad argument #%d (number expected, got %s)", n, luaType(v))
+			}
+			fmt.Fprintf(&b, "%"+spec+string(verb), x)
+		default:
+			return nil, fmt.Errorf("invalid conversion '%%%c'", verb)
+		}
+		if err := st.alloc(b.Len()); err != nil {
+			return nil, err
+		}
+	}
+	return []luaValue{b.String()}, nil
+}
+
+// table.insert(t, [pos,] v)
+func luaTabInsert(st *luaState, a []luaValue) ([]luaValue, error) {
+	t, err := luaTabArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.alloc(16); err != nil {
+		return nil, err
+	}
+	n := t.length()
+	switch len(a) {
+	case 2:
+		return nil, t.set(float64(n+1), a[1])
+	case 3:
+		p, err := luaNumArg(a, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		pos := int(p)
+		if pos < 1 || pos > n+1 {
+			return nil, fmt.Errorf("bad argument #2 (position out of bounds)")
+		}
+		for i := n; i >= pos; i-- {
+			if err := t.set(float64(i+1), t.get(float64(i))); err != nil {
+				return nil, err
+			}
+		}
+		return nil, t.set(float64(pos), a[2])
+	}
+	return nil, fmt.Errorf("wrong number of arguments")
+}
+
+// table.remove(t [, pos])
+func luaTabRemove(st *luaState, a []luaValue) ([]luaValue, error) {
+	t, err := luaTabArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	n := t.length()
+	p, err := luaNumArg(a, 1, float64(n))
+	if err != nil {
+		return nil, err
+	}
+	pos := int(p)
+	if n == 0 && (pos == 0 || pos == n) {
+		return []luaValue{nil}, nil
+	}
+	if pos < 1 || pos > n+1 {
+		return nil, fmt.Errorf("bad argument #2 (position out of bounds)")
+	}
+	v := t.get(float64(pos))
+	for i := pos; i < n; i++ {
+		if err := t.set(float64(i), t.get(float64(i+1))); err != nil {
+			return nil, err
+		}
+	}
+	if pos <= n {
+		if err := t.set(float64(n), nil); err != nil {
+			return nil, err
+		}
+	}
+	return []luaValue{v}, nil
+}
+
+// table.concat(t [, sep])
+func luaTabConcat(st *luaState, a []luaValue) ([]luaValue, error) {
+	t, err := luaTabArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	sep := ""
+	if len(a) > 1 {
+		if sep, err = luaStrArg(a, 1); err != nil {
+			return nil, err
+		}
+	}
+	v := make([]string, t.length())
+	for i := range v {
+		s, ok := luaConcatable(t.get(float64(i + 1)))
+		if !ok {
+			return nil, fmt.Errorf("invalid value (at index %d) in table for 'concat'", i+1)
+		}
+		v[i] = s
+	}
+	s := strings.Join(v, sep)
+	return []luaValue{s}, st.alloc(len(s))
+}
+
+func luaMath(f func(float64) float64) func(*luaState, []luaValue) ([]luaValue, error) {
+	return func(st *luaState, a []luaValue) ([]luaValue, error) {
+		x, ok := luaNumber(luaArg(a, 0))
+		if !ok {
+			return nil, fmt.Errorf("bad argument #1 (number expected, got %s)", luaType(luaArg(a, 0)))
+		}
+		return []luaValue{f(x)}, nil
+	}
+}
+
+func luaMinMax(better func(a, b float64) bool) func(*luaState, []luaValue) ([]luaValue, error) {
+	return func(st *luaState, a []luaValue) ([]luaValue, error) {
+		if len(a) == 0 {
+			return nil, fmt.Errorf("bad argument #1 (number expected, got no value)")
+		}
+		var r float64
+		for i := range a {
+			x, ok := luaNumber(a[i])
+			if !ok {
+				return nil, fmt.Errorf("bad argument #%d (number expected, got %s)", i+1, luaType(a[i]))
+			}
+			if i == 0 || better(x, r) {
+				r = x
+			}
+		}
+		return []luaValue{r}, nil
+	}
+}
+
+// net.contains(cidr, ip): true if the address is in the prefix
+func luaNetContains(st *luaState, a []luaValue) ([]luaValue, error) {
+	c, err := luaStrArg(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := luaStrArg(a, 1)
+	if err != nil {
+		return nil, err
+	}
+	_, n, err := net.ParseCIDR(c)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(s)
+	return []luaValue{ip != nil && n.Contains(ip)}, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,221 @@
+// lua_test.go -- tests for the Lua interpreter of the scripting hooks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Load 'src' and call its function f; return the results as strings
+func runLua(t *testing.T, src string, args ...luaValue) (string, error) {
+	s, err := loadLua("test", src, nil)
+	if err != nil {
+		return "", err
+	}
+	rs, err := s.call("f", args, 100000, 1<<20, time.Second)
+	v := make([]string, len(rs))
+	for i := range rs {
+		v[i] = luaString(rs[i])
+	}
+	return strings.Join(v, ","), err
+}
+
+func TestLua(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"function f() return 2 + 3 * 4 ^ 2 / 8, -2 ^ 2, 7 // 2, 7 % 3, -7 % 3 end", "8,-4,3,1,2"},
+		{"function f() return 1 < 2, 'a' < 'b', 1 == 1.0, 'x' ~= 'x', not nil end", "true,true,true,false,true"},
+		{"function f() return 'a' .. 'b' .. 1, 10 / 4, '10' + 1, 2^10 end", "ab1,2.5,11,1024"},
+		{"function f() return nil or 'd', false and error('no') or 1, 0 and 'zero' end", "d,1,zero"},
+		{`function f() local s = "Hello, World" return s:lower(), s:sub(1, 5), s:sub(-5), #s, s:upper():len() end`,
+			"hello, world,Hello,World,12,12"},
+		{`function f() return string.find("a.b.c", ".", 1, true), string.find("abc", "x"), string.find("abc", "b(c)") end`,
+			"2,nil,2,3,c"},
+		{`function f() return string.match("user=bob; x", "user=(\\w+)"), ("abc"):match("b.") end`, "bob,bc"},
+		{`function f() return (string.gsub("a-b-c", "-", "+")), string.gsub("k=v", "(\\w)=(\\w)", "${2}=${1}") end`,
+			"a+b+c,v=k,1"},
+		{`function f() return string.format("%s-%d-%5.2f-%x-%q-%%", "x", 3, 1.5, 255, "q") end`, `x-3- 1.50-ff-"q"-%`},
+		{`function f() return string.rep("ab", 3), tostring(nil), tostring(1.5), tonumber("0x10"), tonumber("z", 36), tonumber("x") end`,
+			"ababab,nil,1.5,16,35,nil"},
+		{`function f()
+			local t = {10, 20, 30, n = "x", [5] = 50}
+			local sum = 0
+			for i, v in ipairs(t) do sum = sum + i * v end
+			local keys = {}
+			for k, v in pairs(t) do keys[#keys + 1] = tostring(k) end
+			return sum, #t, table.concat(keys, " "), t.n, t[5]
+		end`, "140,3,1 2 3 5 n,x,50"},
+		{`function f()
+			local t = {}
+			table.insert(t, "b")
+			table.insert(t, 1, "a")
+			table.insert(t, "c")
+			local r = table.remove(t, 2)
+			return table.concat(t, ","), r, #t, table.remove(t), #t
+		end`, "a,c,b,2,c,1"},
+		{`function f()
+			local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local c = counter()
+			c() c()
+			return c(), counter()()
+		end`, "3,1"},
+		{`function f()
+			local n, i = 0, 0
+			while true do i = i + 1 if i > 10 then break end n = n + i end
+			repeat local j = i i = i - 1 until j < 5
+			for k = 10, 1, -3 do n = n + k end
+			for k = 1, 0 do n = n + 1000 end
+			return n, i
+		end`, "77,3"},
+		{`function f()
+			local x = 1
+			do local x = 2 end
+			if x == 2 then return "inner" elseif x == 1 then return "outer" else return "none" end
+		end`, "outer"},
+		{`function g() return 1, 2, 3 end
+		function f() local t = {g()} local u = {g(), g()} return #t, #u, (g()), select("#", g()), select(2, g()) end`,
+			"3,4,1,3,2,3"},
+		{`obj = {name = "o"}
+		function obj:hello(x) return self.name .. x end
+		function obj.plain(x) return x end
+		function f() return obj:hello("!"), obj.plain("p") end`, "o!,p"},
+		{"-- a comment\n--[[ a long\ncomment ]] function f() return [[long\nstring]], [==[a]]b]==], '\\65\\x42\\n' end",
+			"long\nstring,a]]b,AB\n"},
+		{`function f() return net.contains("10.0.0.0/8", "10.1.2.3"), net.contains("10.0.0.0/8", "192.0.2.1"),
+			net.contains("2001:db8::/32", "2001:db8::1"), math.max(1, 5, 3), math.floor(-1.5), math.huge > 1 end`,
+			"true,false,true,5,-2,true"},
+		{`function f(a, b) return type(a), type(b), type(f), type({}) end`, "string,nil,function,table"},
+	}
+	for _, tc := range tests {
+		got, err := runLua(t, tc.src, "arg")
+		if err != nil || got != tc.want {
+			t.Errorf("%s:\n got %q, %v\nwant %q", tc.src, got, err, tc.want)
+		}
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"function f()\n  return 1 +\nend", "line 3: unexpected symbol near 'end'"},
+		{"function f() x = 'unfinished end", "line 1: unfinished string"},
+		{"function f(...) end", "varargs"},
+		{"goto x", "goto"},
+		{"function f() return 1 end x", "syntax error"},
+		{"function f()\n\n  return nofunc()\nend", "line 3: attempt to call a nil value"},
+		{"function f() return {} < 1 end", "attempt to compare table with number"},
+		{"function f() return 'a' + 1 end", "arithmetic on a string value"},
+		{"function f() local t = nil return t.x end", "attempt to index a nil value"},
+		{"function f() error('boom') end", "boom"},
+		{"function f() assert(false, 'bad') end", "bad"},
+		{"function f() return string.rep() end", "string.rep: bad argument #1"},
+		{"function f() return ('x'):nosuch() end", "no method 'nosuch'"},
+	}
+	for _, tc := range tests {
+		_, err := runLua(t, tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: %v, want %q", tc.src, err, tc.want)
+		}
+	}
+}
+
+func TestLuaLimits(t *testing.T) {
+	s, err := loadLua("test", `
+		function spin() while true do end end
+		function grow() local s = "x" for i = 1, 40 do s = s .. s end return s end
+		function deep(n) return deep(n + 1) end
+		function big() local t = {} for i = 1, 1e6 do t[i] = i end end
+		function rep() return string.rep("x", 1e12) end
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.call("spin", nil, 10000, 1<<20, time.Minute); err != errLuaSteps {
+		t.Errorf("steps: %v", err)
+	}
+	t0 := time.Now()
+	if _, err := s.call("spin", nil, 1<<30, 1<<20, 20*time.Millisecond); err != errLuaTimeout ||
+		time.Since(t0) > time.Second {
+		t.Errorf("timeout: %v after %s", err, time.Since(t0))
+	}
+	for _, fn := range []string{"grow", "big", "rep"} {
+		if _, err := s.call(fn, nil, 1<<30, 1<<20, time.Minute); err != errLuaMemory {
+			t.Errorf("%s: %v", fn, err)
+		}
+	}
+	if _, err := s.call("deep", []luaValue{float64(0)}, 1<<30, 1<<20, time.Minute); err == nil ||
+		!strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("deep: %v", err)
+	}
+
+	// the main chunk has a budget too
+	if _, err := loadLua("test", "while true do end", nil); err != errLuaSteps {
+		t.Errorf("load: %v", err)
+	}
+}
+
+func TestLuaFrozen(t *testing.T) {
+	var printed []string
+	s, err := loadLua("test", `
+		allowed = {alice = true}
+		local n = 0
+		print("loaded", 1)
+		function count() n = n + 1 return n end
+		function add() allowed.bob = true end
+		function set(v) x = v local t = {} t.v = v return x, t.v end
+		function get() return x, allowed.alice end
+	`, func(m string) { printed = append(printed, m) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) != 1 || printed[0] != "loaded\t1" {
+		t.Errorf("print: %q", printed)
+	}
+
+	call := func(fn string, args ...luaValue) ([]luaValue, error) {
+		return s.call(fn, args, 10000, 1<<20, time.Second)
+	}
+	if _, err := call("count"); err == nil || !strings.Contains(err.Error(), "'n' is read-only") {
+		t.Errorf("upvalue: %v", err)
+	}
+	if _, err := call("add"); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("table: %v", err)
+	}
+
+	// globals set by a call are its own; calls run at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rs, err := call("set", float64(i))
+			if err != nil || rs[0] != float64(i) || rs[1] != float64(i) {
+				t.Errorf("set %d: %v %v", i, rs, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rs, err := call("get"); err != nil || rs[0] != nil || rs[1] != true {
+		t.Errorf("get: %v %v", rs, err)
+	}
+	if !s.has("get") || s.has("nothere") || s.has("allowed") {
+		t.Errorf("has")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,824 @@
+// luaparse.go -- lexer and parser of the Lua subset
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Expressions
+type luaExpr interface{}
+
+type luaConst struct{ v luaValue }
+
+type luaName struct {
+	name string
+	line int
+}
+
+type luaIndex struct {
+	obj, key luaExpr
+	line     int
+}
+
+type luaCall struct {
+	fn     luaExpr
+	method string // obj:method(args)
+	args   []luaExpr
+	line   int
+}
+
+type luaFuncExpr struct{ f *luaProto }
+
+type luaTableItem struct {
+	key luaExpr // nil for positional items
+	val luaExpr
+}
+
+type luaTableExpr struct {
+	items []luaTableItem
+	line  int
+}
+
+// (e): one value of a call
+type luaParen struct{ e luaExpr }
+
+type luaUnop struct {
+	op   string
+	a    luaExpr
+	line int
+}
+
+type luaBinop struct {
+	op   string
+	a, b luaExpr
+	line int
+}
+
+// Statements
+type luaStmt interface{}
+
+type luaLocal struct {
+	names []string
+	exprs []luaExpr
+}
+
+type luaLocalFunc struct {
+	name string
+	f    *luaProto
+}
+
+type luaAssign struct {
+	targets []luaExpr // *luaName or *luaIndex
+	exprs   []luaExpr
+}
+
+type luaCallStmt struct{ call *luaCall }
+
+type luaDo struct{ body []luaStmt }
+
+type luaWhile struct {
+	cond luaExpr
+	body []luaStmt
+}
+
+type luaRepeat struct {
+	body []luaStmt
+	cond luaExpr
+}
+
+type luaIf struct {
+	conds  []luaExpr
+	blocks [][]luaStmt
+	els    []luaStmt
+}
+
+type luaNumFor struct {
+	name              string
+	start, stop, step luaExpr
+	body              []luaStmt
+	line              int
+}
+
+type luaGenFor struct {
+	names []string
+	exprs []luaExpr
+	body  []luaStmt
+	line  int
+}
+
+type luaReturnStmt struct{ exprs []luaExpr }
+
+type luaBreakStmt struct{}
+
+// A function: the main chunk too
+type luaProto struct {
+	name   string
+	params []string
+	body   []luaStmt
+}
+
+// Tokens
+const (
+	luaEOF = iota
+	luaTokName
+	luaTokNumber
+	luaTokString
+	luaTokOp // keywords and punctuation
+)
+
+type luaTok struct {
+	kind int
+	s    string
+	n    float64
+	line int
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+// Punctuation, longest first
+var luaOps = []string{
+	"...", "..", "==", "~=", "<=", ">=", "//", "::",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}",
+	"[", "]", ";", ":", ",", ".",
+}
+
+func luaLex(src string) ([]luaTok, error) {
+	var toks []luaTok
+	line := 1
+	i := 0
+
+	// a long bracket at src[i:]: [[...]] or [==[...]==]
+	long := func() (string, bool, error) {
+		j := i + 1
+		for j < len(src) && src[j] == '=' {
+			j++
+		}
+		if j >= len(src) || src[j] != '[' {
+			return "", false, nil
+		}
+		end := "]" + strings.Repeat("=", j-i-1) + "]"
+		k := strings.Index(src[j+1:], end)
+		if k < 0 {
+			return "", false, luaErrorf(line, "unfinished long string")
+		}
+		s := src[j+1 : j+1+k]
+		line += strings.Count(s, "\n")
+		i = j + 1 + k + len(end)
+		// a newline right after the opening bracket is skipped
+		if strings.HasPrefix(s, "\r\n") {
+			s = s[2:]
+		} else if strings.HasPrefix(s, "\n") {
+			s = s[1:]
+		}
+		return s, true, nil
+	}
+
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "--"):
+			i += 2
+			if i < len(src) && src[i] == '[' {
+				_, ok, err := long()
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					continue
+				}
+			}
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '[' && i+1 < len(src) && (src[i+1] == '[' || src[i+1] == '='):
+			s, ok, err := long()
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				toks = append(toks, luaTok{kind: luaTokString, s: s, line: line})
+				continue
+			}
+		case c == '_' || isLuaAlpha(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || isLuaAlpha(src[j]) || isLuaDigit(src[j])) {
+				j++
+			}
+			w := src[i:j]
+			i = j
+			if luaKeywords[w] {
+				toks = append(toks, luaTok{kind: luaTokOp, s: w, line: line})
+			} else {
+				toks = append(toks, luaTok{kind: luaTokName, s: w, line: line})
+			}
+			continue
+		case isLuaDigit(c) || (c == '.' && i+1 < len(src) && isLuaDigit(src[i+1])):
+			j := i
+			hex := strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X")
+			if hex {
+				j += 2
+			}
+			for j < len(src) {
+				d := src[j]
+				if isLuaDigit(d) || d == '.' || (hex && strings.IndexByte("abcdefABCDEF", d) >= 0) {
+					j++
+				} else if !hex && (d == 'e' || d == 'E') {
+					j++
+					if j < len(src) && (src[j] == '+' || src[j] == '-') {
+						j++
+					}
+				} else {
+					break
+				}
+			}
+			var n float64
+			var err error
+			if hex {
+				var u uint64
+				u, err = strconv.ParseUint(src[i+2:j], 16, 64)
+				n = float64(u)
+			} else {
+				n, err = strconv.ParseFloat(src[i:j], 64)
+			}
+			if err != nil {
+				return nil, luaErrorf(line, "malformed number near '%s'", src[i:j])
+			}
+			toks = append(toks, luaTok{kind: luaTokNumber, n: n, line: line})
+			i = j
+			continue
+		case c == '"' || c == '\'':
+			s, err := luaLexString(src, &i, &line)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, luaTok{kind: luaTokString, s: s, line: line})
+			continue
+		}
+
+		op := ""
+		for _, o := range luaOps {
+			if strings.HasPrefix(src[i:], o) {
+				op = o
+				break
+			}
+		}
+		if len(op) == 0 {
+			return nil, luaErrorf(line, "unexpected symbol near '%c'", c)
+		}
+		toks = append(toks, luaTok{kind: luaTokOp, s: op, line: line})
+		i += len(op)
+	}
+	return append(toks, luaTok{kind: luaEOF, line: line}), nil
+}
+
+// A quoted string at src[*i:]
+func luaLexString(src string, i *int, line *int) (string, error) {
+	q := src[*i]
+	var b strings.Builder
+	j := *i + 1
+	for {
+		if j >= len(src) || src[j] == '\n' {
+			return "", luaErrorf(*line, "unfinished string")
+		}
+		c := src[j]
+		if c == q {
+			*i = j + 1
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			j++
+			continue
+		}
+		j++
+		if j >= len(src) {
+			return "", luaErrorf(*line, "unfinished string")
+		}
+		e := src[j]
+		j++
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(e)
+		case '\n':
+			b.WriteByte('\n')
+			*line++
+		case 'x':
+			if j+2 > len(src) {
+				return "", luaErrorf(*line, "hexadecimal digit expected")
+			}
+			n, err := strconv.ParseUint(src[j:j+2], 16, 8)
+			if err != nil {
+				return "", luaErrorf(*line, "hexadecimal digit expected")
+			}
+			b.WriteByte(byte(n))
+			j += 2
+		case 'z':
+			for j < len(src) && strings.IndexByte(" \t\r\n\f\v", src[j]) >= 0 {
+				if src[j] == '\n' {
+					*line++
+				}
+				j++
+			}
+		default:
+			if !isLuaDigit(e) {
+				return "", luaErrorf(*line, "invalid escape sequence '\\%c'", e)
+			}
+			k := j - 1
+			for j < len(src) && j-k < 3 && isLuaDigit(src[j]) {
+				j++
+			}
+			n, _ := strconv.Atoi(src[k:j])
+			if n > 255 {
+				return "", luaErrorf(*line, "decimal escape too large")
+			}
+			b.WriteByte(byte(n))
+		}
+	}
+}
+
+func isLuaAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLuaDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type luaParser struct {
+	toks []luaTok
+	pos  int
+}
+
+// Parse the script 'src' into its main chunk
+func parseLua(src string) (f *luaProto, err error) {
+	toks, err := luaLex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &luaParser{toks: toks}
+	defer func() {
+		if r := recover(); r != nil {
+			le, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			f, err = nil, le
+		}
+	}()
+
+	body := p.block()
+	if t := p.tok(); t.kind != luaEOF {
+		p.fail("'<eof>' expected near '%s'", p.desc(t))
+	}
+	return &luaProto{name: "main chunk", body: body}, nil
+}
+
+func (p *luaParser) tok() luaTok {
+	return p.toks[p.pos]
+}
+
+func (p *luaParser) next() luaTok {
+	t := p.toks[p.pos]
+	if t.kind != luaEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *luaParser) is(s string) bool {
+	t := p.toks[p.pos]
+	return t.kind == luaTokOp && t.s == s
+}
+
+func (p *luaParser) accept(s string) bool {
+	if p.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(s string) {
+	if !p.accept(s) {
+		p.fail("'%s' expected near '%s'", s, p.desc(p.tok()))
+	}
+}
+
+func (p *luaParser) name() string {
+	t := p.tok()
+	if t.kind != luaTokName {
+		p.fail("<name> expected near '%s'", p.desc(t))
+	}
+	p.pos++
+	return t.s
+}
+
+func (p *luaParser) desc(t luaTok) string {
+	switch t.kind {
+	case luaEOF:
+		return "<eof>"
+	case luaTokNumber:
+		return luaNumString(t.n)
+	}
+	return t.s
+}
+
+func (p *luaParser) fail(f string, v ...interface{}) {
+	panic(luaErrorf(p.tok().line, f, v...))
+}
+
+// The end of a block
+func (p *luaParser) blockEnd() bool {
+	t := p.tok()
+	if t.kind == luaEOF {
+		return true
+	}
+	if t.kind != luaTokOp {
+		return false
+	}
+	switch t.s {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) block() []luaStmt {
+	var b []luaStmt
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+		if p.is("return") {
+			p.next()
+			var r luaReturnStmt
+			if !p.blockEnd() && !p.is(";") {
+				r.exprs = p.exprList()
+			}
+			p.accept(";")
+			if !p.blockEnd() {
+				p.fail("'end' expected near '%s'", p.desc(p.tok()))
+			}
+			return append(b, &r)
+		}
+		b = append(b, p.stmt())
+	}
+	return b
+}
+
+func (p *luaParser) stmt() luaStmt {
+	t := p.tok()
+	if t.kind == luaTokOp {
+		switch t.s {
+		case "if":
+			p.next()
+			var s luaIf
+			s.conds = append(s.conds, p.expr(0))
+			p.expect("then")
+			s.blocks = append(s.blocks, p.block())
+			for p.accept("elseif") {
+				s.conds = append(s.conds, p.expr(0))
+				p.expect("then")
+				s.blocks = append(s.blocks, p.block())
+			}
+			if p.accept("else") {
+				s.els = p.block()
+				if s.els == nil {
+					s.els = []luaStmt{}
+				}
+			}
+			p.expect("end")
+			return &s
+
+		case "while":
+			p.next()
+			c := p.expr(0)
+			p.expect("do")
+			b := p.block()
+			p.expect("end")
+			return &luaWhile{cond: c, body: b}
+
+		case "do":
+			p.next()
+			b := p.block()
+			p.expect("end")
+			return &luaDo{body: b}
+
+		case "repeat":
+			p.next()
+			b := p.block()
+			p.expect("until")
+			return &luaRepeat{body: b, cond: p.expr(0)}
+
+		case "for":
+			p.next()
+			n := p.name()
+			if p.accept("=") {
+				s := &luaNumFor{name: n, line: t.line}
+				s.start = p.expr(0)
+				p.expect(",")
+				s.stop = p.expr(0)
+				if p.accept(",") {
+					s.step = p.expr(0)
+				}
+				p.expect("do")
+				s.body = p.block()
+				p.expect("end")
+				return s
+			}
+			s := &luaGenFor{names: []string{n}, line: t.line}
+			for p.accept(",") {
+				s.names = append(s.names, p.name())
+			}
+			p.expect("in")
+			s.exprs = p.exprList()
+			p.expect("do")
+			s.body = p.block()
+			p.expect("end")
+			return s
+
+		case "function":
+			p.next()
+			n := p.name()
+			var target luaExpr = &luaName{name: n, line: t.line}
+			full := n
+			method := false
+			for p.is(".") || p.is(":") {
+				method = p.is(":")
+				p.next()
+				k := p.name()
+				full += "." + k
+				target = &luaIndex{obj: target, key: &luaConst{k}, line: t.line}
+				if method {
+					break
+				}
+			}
+			f := p.funcBody(full, method)
+			return &luaAssign{targets: []luaExpr{target}, exprs: []luaExpr{&luaFuncExpr{f}}}
+
+		case "local":
+			p.next()
+			if p.accept("function") {
+				n := p.name()
+				return &luaLocalFunc{name: n, f: p.funcBody(n, false)}
+			}
+			s := &luaLocal{names: []string{p.name()}}
+			for p.accept(",") {
+				s.names = append(s.names, p.name())
+			}
+			if p.accept("=") {
+				s.exprs = p.exprList()
+			}
+			return s
+
+		case "break":
+			p.next()
+			return &luaBreakStmt{}
+
+		case "goto", "::":
+			p.fail("goto isn't supported")
+		}
+	}
+
+	// an assignment or a call
+	e := p.suffixed()
+	if p.is("=") || p.is(",") {
+		targets := []luaExpr{p.target(e)}
+		for p.accept(",") {
+			targets = append(targets, p.target(p.suffixed()))
+		}
+		p.expect("=")
+		return &luaAssign{targets: targets, exprs: p.exprList()}
+	}
+	c, ok := e.(*luaCall)
+	if !ok {
+		p.fail("syntax error near '%s'", p.desc(p.tok()))
+	}
+	return &luaCallStmt{call: c}
+}
+
+func (p *luaParser) target(e luaExpr) luaExpr {
+	switch e.(type) {
+	case *luaName, *luaIndex:
+		return e
+	}
+	p.fail("syntax error near '%s'", p.desc(p.tok()))
+	return nil
+}
+
+// (params) body end
+func (p *luaParser) funcBody(name string, method bool) *luaProto {
+	f := &luaProto{name: name}
+	if method {
+		f.params = append(f.params, "self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.is("...") {
+				p.fail("varargs aren't supported")
+			}
+			f.params = append(f.params, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	f.body = p.block()
+	p.expect("end")
+	return f
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	v := []luaExpr{p.expr(0)}
+	for p.accept(",") {
+		v = append(v, p.expr(0))
+	}
+	return v
+}
+
+// Priorities of the binary operators: left and right
+var luaPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {9, 8},
+	"+":  {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const luaUnaryPriority = 12
+
+// An expression of operators that bind tighter than 'limit'
+func (p *luaParser) expr(limit int) luaExpr {
+	var e luaExpr
+	t := p.tok()
+	if t.kind == luaTokOp && (t.s == "not" || t.s == "-" || t.s == "#") {
+		p.next()
+		e = &luaUnop{op: t.s, a: p.expr(luaUnaryPriority), line: t.line}
+	} else {
+		e = p.simple()
+	}
+
+	for {
+		t := p.tok()
+		pri, ok := luaPriority[t.s]
+		if t.kind != luaTokOp || !ok || pri[0] <= limit {
+			return e
+		}
+		p.next()
+		e = &luaBinop{op: t.s, a: e, b: p.expr(pri[1]), line: t.line}
+	}
+}
+
+func (p *luaParser) simple() luaExpr {
+	t := p.tok()
+	switch t.kind {
+	case luaTokNumber:
+		p.next()
+		return &luaConst{t.n}
+	case luaTokString:
+		p.next()
+		return &luaConst{t.s}
+	case luaTokOp:
+		switch t.s {
+		case "nil":
+			p.next()
+			return &luaConst{nil}
+		case "true":
+			p.next()
+			return &luaConst{true}
+		case "false":
+			p.next()
+			return &luaConst{false}
+		case "function":
+			p.next()
+			return &luaFuncExpr{p.funcBody("anonymous", false)}
+		case "{":
+			return p.table()
+		case "...":
+			p.fail("varargs aren't supported")
+		}
+	}
+	return p.suffixed()
+}
+
+// Name or (expr), then indexes and calls
+func (p *luaParser) suffixed() luaExpr {
+	var e luaExpr
+	t := p.tok()
+	switch {
+	case t.kind == luaTokName:
+		p.next()
+		e = &luaName{name: t.s, line: t.line}
+	case p.accept("("):
+		e = &luaParen{p.expr(0)}
+		p.expect(")")
+	default:
+		p.fail("unexpected symbol near '%s'", p.desc(t))
+	}
+
+	for {
+		t := p.tok()
+		switch {
+		case p.accept("."):
+			e = &luaIndex{obj: e, key: &luaConst{p.name()}, line: t.line}
+		case p.accept("["):
+			k := p.expr(0)
+			p.expect("]")
+			e = &luaIndex{obj: e, key: k, line: t.line}
+		case p.accept(":"):
+			m := p.name()
+			e = &luaCall{fn: e, method: m, args: p.args(), line: t.line}
+		case p.is("(") || p.is("{") || t.kind == luaTokString:
+			e = &luaCall{fn: e, args: p.args(), line: t.line}
+		default:
+			return e
+		}
+	}
+}
+
+// (args), {table} or "string"
+func (p *luaParser) args() []luaExpr {
+	t := p.tok()
+	switch {
+	case t.kind == luaTokString:
+		p.next()
+		return []luaExpr{&luaConst{t.s}}
+	case p.is("{"):
+		return []luaExpr{p.table()}
+	}
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	v := p.exprList()
+	p.expect(")")
+	return v
+}
+
+func (p *luaParser) table() luaExpr {
+	t := p.tok()
+	p.expect("{")
+	e := &luaTableExpr{line: t.line}
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.next()
+			k := p.expr(0)
+			p.expect("]")
+			p.expect("=")
+			e.items = append(e.items, luaTableItem{key: k, val: p.expr(0)})
+		case p.tok().kind == luaTokName && p.toks[p.pos+1].kind == luaTokOp && p.toks[p.pos+1].s == "=":
+			k := p.name()
+			p.next()
+			e.items = append(e.items, luaTableItem{key: &luaConst{k}, val: p.expr(0)})
+		default:
+			e.items = append(e.items, luaTableItem{val: p.expr(0)})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return e
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -9,20 +9,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"syscall"
 	"time"
 
 	flag "github.com/opencoff/pflag"
-	yaml "gopkg.in/yaml.v2"
 
-	L "github.com/opencoff/go-logger"
+	"github.com/opencoff/go-proxies/config"
+
+	L "github.com/opencoff/go-proxies/logger"
 )
 
 // This will be filled in by "build"
@@ -40,55 +43,60 @@ type Proxy interface {
 	Stop()
 }
 
-// List of config entries
-type Conf struct {
-	Logging  string `yaml:"log"`
-	LogLevel string `yaml:"loglevel"`
-	URLlog   string `yaml:"urllog"`
-	Uid      string `yaml:"uid"`
-	Gid      string `yaml:"gid"`
-	Http     []ListenConf
-	Socks    []ListenConf
-}
-
-type ListenConf struct {
-	Listen string   `yaml:"listen"`
-	Bind   string   `yaml:"bind"`
-	Allow  []subnet `yaml:"allow"`
-	Deny   []subnet `yaml:"deny"`
-
-	// rate limit -- perhost and global
-	Ratelimit RateLimit `yaml:"ratelimit"`
-}
-
-type RateLimit struct {
-	Global  uint `yaml:"global"`
-	PerHost uint `yaml:"perhost"`
-}
-
-// An IP/Subnet
-type subnet struct {
-	net.IPNet
-}
-
-// Custom unmarshaler for IPNet
-func (ipn *subnet) UnmarshalYAML(unm func(v interface{}) error) error {
-	var s string
-
-	// First unpack the bytes as a string. We then parse the string
-	// as a CIDR
-	err := unm(&s)
-	if err != nil {
-		return err
-	}
-
-	_, net, err := net.ParseCIDR(s)
-	if err == nil {
-		ipn.IP = net.IP
-		ipn.Mask = net.Mask
-	}
-	return err
-}
+// The config file; its types are in the config package for tools that
+// write or check configs
+type (
+	Conf              = config.Conf
+	TenantConf        = config.TenantConf
+	ExportConf        = config.ExportConf
+	EventsConf        = config.EventsConf
+	S3Conf            = config.S3Conf
+	SharedConf        = config.SharedConf
+	DaemonConf        = config.DaemonConf
+	TraceConf         = config.TraceConf
+	AlertConf         = config.AlertConf
+	AlertRuleConf     = config.AlertRuleConf
+	AnomalyConf       = config.AnomalyConf
+	FairConf          = config.FairConf
+	SidecarConf       = config.SidecarConf
+	SandboxConf       = config.SandboxConf
+	AdminConf         = config.AdminConf
+	ClusterConf       = config.ClusterConf
+	ListenConf        = config.ListenConf
+	TunnelConf        = config.TunnelConf
+	PoolConf          = config.PoolConf
+	ECHConf           = config.ECHConf
+	CacheConf         = config.CacheConf
+	CompressConf      = config.CompressConf
+	CaptiveConf       = config.CaptiveConf
+	MPTCPConf         = config.MPTCPConf
+	ClientConf        = config.ClientConf
+	LimitConf         = config.LimitConf
+	RuleConf          = config.RuleConf
+	JumpConf          = config.JumpConf
+	WireGuardConf     = config.WireGuardConf
+	WireGuardPeerConf = config.WireGuardPeerConf
+	FragmentConf      = config.FragmentConf
+	ChaosConf         = config.ChaosConf
+	TLSConf           = config.TLSConf
+	ACMEConf          = config.ACMEConf
+	EgressConf        = config.EgressConf
+	AuthConf          = config.AuthConf
+	FilterConf        = config.FilterConf
+	ScriptConf        = config.ScriptConf
+	RouterConf        = config.RouterConf
+	TrojanConf        = config.TrojanConf
+	ConnectIPConf     = config.ConnectIPConf
+	TransportConf     = config.TransportConf
+	GuardConf         = config.GuardConf
+	DNSSECConf        = config.DNSSECConf
+	ScanConf          = config.ScanConf
+	RateLimit         = config.RateLimit
+	DNSConf           = config.DNSConf
+	ECSConf           = config.ECSConf
+	UDPConf           = config.UDPConf
+	subnet            = config.Subnet
+)
 
 // Parse config file in YAML format and return
 func ReadYAML(fn string) (*Conf, error) {
@@ -97,29 +105,64 @@ func ReadYAML(fn string) (*Conf, error) {
 		return nil, fmt.Errorf("can't read config file %s: %s", fn, err)
 	}
 
-	var cfg Conf
-	err = yaml.Unmarshal(yml, &cfg)
+	cfg, err := config.Parse(yml)
 	if err != nil {
 		return nil, fmt.Errorf("can't parse config file %s: %s", fn, err)
 	}
+	if err = checkTenants(cfg); err != nil {
+		return nil, fmt.Errorf("config file %s: %s", fn, err)
+	}
 
-	return &cfg, nil
+	return cfg, nil
 }
 
 func main() {
 	// maxout concurrency
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// Make sure any files we create are readable ONLY by us
-	syscall.Umask(0077)
+	// Make sure any files we create are readable ONLY by us; windows
+	// has no umask
+	setUmask(0077)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "top":
+			topCommand(os.Args[2:])
+			os.Exit(0)
+		case "replay":
+			replayCommand(os.Args[2:])
+			os.Exit(0)
+		case "simulate":
+			simulateCommand(os.Args[2:])
+			os.Exit(0)
+		case "bench":
+			benchCommand(os.Args[2:])
+			os.Exit(0)
+		case "schema":
+			b, _ := json.MarshalIndent(config.Schema(), "", "  ")
+			os.Stdout.Write(append(b, '\n'))
+			os.Exit(0)
+		case "service":
+			// returns only to run as the service
+			os.Args = append(os.Args[:1], serviceCommand(os.Args[2:])...)
+		}
+	}
 
 	debugFlag := flag.BoolP("debug", "d", false, "Run in debug mode")
+	daemonFlag := flag.BoolP("daemon", "D", false, "Run in the background")
+	sidecarFlag := flag.BoolP("sidecar", "k", false, "Run as a kubernetes sidecar")
 	verFlag := flag.BoolP("version", "v", false, "Show version info and quit")
 
-	usage := fmt.Sprintf("%s [options] config-file", os.Args[0])
+	usage := fmt.Sprintf("%s [options] config-file\n       %s top [options] [admin-url]\n"+
+		"       %s replay [options] access-log...\n"+
+		"       %s simulate [options] config-file access-log...\n"+
+		"       %s bench [options]\n"+
+		"       %s schema\n"+
+		"       %s service install|remove|start|stop|run [options]",
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 
 	flag.Usage = func() {
-		fmt.Printf("goproxy - A simple HTTP/SOCKSv5 Proxy\nUsage: %s\n", usage)
+		fmt.Printf("goproxy - A simple HTTP/SOCKSv5/DNS Proxy\nUsage: %s\n", usage)
 		flag.PrintDefaults()
 	}
 
@@ -141,10 +184,56 @@ func main() {
 		die("Can't read config file %s: %s", cfgfile, err)
 	}
 
+	// the daemon and the watcher read it from elsewhere
+	if fn, err := filepath.Abs(cfgfile); err == nil {
+		cfgfile = fn
+	}
+
+	sc := &cfg.Sidecar
+	sc.Enable = sc.Enable || *sidecarFlag
+	logname := "goproxy"
+	if sc.Enable {
+		logname, podLabels, err = podIdentity(sc.Labels)
+		if err != nil {
+			die("%s", err)
+		}
+		sidecarAdmin(&cfg.Admin)
+	}
+
+	dc := &cfg.Daemon
+	if len(dc.Umask) > 0 {
+		m, err := strconv.ParseUint(dc.Umask, 8, 32)
+		if err != nil || m > 0777 {
+			die("Invalid umask %s", dc.Umask)
+		}
+		if err := setUmask(int(m)); err != nil {
+			die("%s", err)
+		}
+	}
+
+	// debug mode stays in the foreground
+	if (dc.Detach || *daemonFlag) && !*debugFlag {
+		if err := daemonize(); err != nil {
+			die("%s", err)
+		}
+		if len(dc.Dir) == 0 {
+			dc.Dir = "/"
+		}
+	}
+	if len(dc.Dir) > 0 {
+		if err := os.Chdir(dc.Dir); err != nil {
+			die("Can't change directory to %s: %s", dc.Dir, err)
+		}
+	}
+
 	prio, ok := L.ToPriority(cfg.LogLevel)
 	if !ok {
 		die("Invalid log-level %s", cfg.LogLevel)
 	}
+	logfmt, ok := L.ToFormat(cfg.LogFormat)
+	if !ok {
+		die("Invalid log format %s", cfg.LogFormat)
+	}
 
 	// We want microsecond timestamps and debug logs to have short
 	// filenames
@@ -156,88 +245,345 @@ func main() {
 		logf = "STDOUT"
 	}
 
-	log, err := L.NewLogger(logf, prio, "goproxy", logflags)
-	if err != nil {
-		die("Can't create logger: %s", err)
-	}
+	var log *L.Logger
+	if logf == "EVENTLOG" {
+		w, err := newEventLog()
+		if err != nil {
+			die("Can't create logger: %s", err)
+		}
+		log, _ = L.New(w, prio, logname, logflags)
+		log.SetFormat(logfmt)
+	} else {
+		log, err = L.NewLogger(logf, prio, logname, logflags)
+		if err != nil {
+			die("Can't create logger: %s", err)
+		}
+		log.SetFormat(logfmt)
 
-	err = log.EnableRotation(00, 01, 00, 7)
-	if err != nil {
-		warn("Can't enable log rotation: %s", err)
+		err = log.EnableRotation(00, 01, 00, 7)
+		if err != nil {
+			warn("Can't enable log rotation: %s", err)
+		}
 	}
 
 	var ulog *L.Logger
 
+	// URL logs, closed at exit so their last records are written
+	var ulogs []*L.Logger
+
 	if len(cfg.URLlog) > 0 {
-		ulog, err := L.NewFilelog(cfg.URLlog, L.LOG_INFO, "", 0)
+		ulog, err = L.NewFilelog(cfg.URLlog, L.LOG_INFO, "", 0)
 		if err != nil {
 			die("Can't create URL logger: %s", err)
 		}
 
 		ulog.EnableRotation(00, 00, 01, 01)
+		ulogs = append(ulogs, ulog)
 	}
 
 	log.Info("goproxy - %s [%s - built on %s] starting up (logging at %s)...",
 		ProductVersion, RepoVersion, Buildtime, log.Prio())
 
+	shared, err = newRedisStore(&cfg.Shared, log)
+	if err != nil {
+		die("%s", err)
+	}
+	if shared != nil {
+		addCollector(shared)
+	}
+
+	tracing, err = newTracer(&cfg.Tracing, log)
+	if err != nil {
+		die("%s", err)
+	}
+	if tracing != nil {
+		addCollector(tracing)
+	}
+
+	anomalies, err = newAnomalyDetector(&cfg.Anomaly, log)
+	if err != nil {
+		die("%s", err)
+	}
+	if anomalies != nil {
+		addCollector(anomalies)
+	}
+
+	fairShare, err = newFairQueue(&cfg.Fair)
+	if err != nil {
+		die("%s", err)
+	}
+	if fairShare != nil {
+		addCollector(fairShare)
+	}
+
+	alerts, err := newAlerter(&cfg.Alerts, log)
+	if err != nil {
+		die("%s", err)
+	}
+	var alertExit <-chan int
+	if alerts != nil {
+		addCollector(alerts)
+		alertExit = alerts.Exit()
+	}
+
+	exports, err = newUsageExporter(&cfg.Export, log)
+	if err != nil {
+		die("%s", err)
+	}
+	if exports != nil {
+		addCollector(exports)
+	}
+
+	events, err = newEventSink(&cfg.Events, log)
+	if err != nil {
+		die("%s", err)
+	}
+	if events != nil {
+		addCollector(events)
+	}
+
+	// Take over the listeners of a running goproxy, if there is one
+	var prev *handoverConn
+	if len(cfg.Handover) > 0 {
+		if prev, err = takeOver(cfg.Handover, log); err != nil {
+			die("%s", err)
+		}
+	}
+
+	// A successor gets the pid file when its predecessor exits
+	if len(dc.Pidfile) > 0 && prev == nil {
+		if err := lockPidfile(dc.Pidfile, false); err != nil {
+			die("%s", err)
+		}
+	}
+
 	var srv []Proxy
 
-	for _, v := range cfg.Http {
+	for i := range cfg.Http {
+		v := &cfg.Http[i]
 		if len(v.Listen) == 0 {
 			die("http listen address is empty?")
 		}
-		s, err := NewHTTPProxy(&v, log, ulog)
+		s, err := NewHTTPProxy(v, log, ulog)
 		if err != nil {
-			die("Can't create http listener on %s: %s", v, err)
+			die("Can't create http listener on %s: %s", v.Listen, err)
 		}
 
 		srv = append(srv, s)
 	}
 
-	for _, v := range cfg.Socks {
+	for i := range cfg.Socks {
+		v := &cfg.Socks[i]
 		if len(v.Listen) == 0 {
 			die("SOCKSv5 listen address is empty?")
 		}
-		s, err := NewSocksv5Proxy(&v, log, ulog)
+		s, err := NewSocksv5Proxy(v, log, ulog)
+		if err != nil {
+			die("Can't create socks listener on %s: %s", v.Listen, err)
+		}
+
+		srv = append(srv, s)
+	}
+
+	for i := range cfg.Tenants {
+		t := &cfg.Tenants[i]
+		var tlog *L.Logger
+		if len(t.URLlog) > 0 {
+			tlog, err = L.NewFilelog(t.URLlog, L.LOG_INFO, "", 0)
+			if err != nil {
+				die("tenant %s: Can't create URL logger: %s", t.Name, err)
+			}
+			tlog.EnableRotation(00, 00, 01, 01)
+			ulogs = append(ulogs, tlog)
+		}
+
+		for j := range t.Http {
+			v := &t.Http[j]
+			if len(v.Listen) == 0 {
+				die("tenant %s: http listen address is empty?", t.Name)
+			}
+			s, err := NewHTTPProxy(v, log, tlog)
+			if err != nil {
+				die("tenant %s: Can't create http listener on %s: %s", t.Name, v.Listen, err)
+			}
+			srv = append(srv, s)
+		}
+		for j := range t.Socks {
+			v := &t.Socks[j]
+			if len(v.Listen) == 0 {
+				die("tenant %s: SOCKSv5 listen address is empty?", t.Name)
+			}
+			s, err := NewSocksv5Proxy(v, log, tlog)
+			if err != nil {
+				die("tenant %s: Can't create socks listener on %s: %s", t.Name, v.Listen, err)
+			}
+			srv = append(srv, s)
+		}
+	}
+
+	for i := range cfg.Dns {
+		v := &cfg.Dns[i]
+		if len(v.Listen) == 0 {
+			die("DNS listen address is empty?")
+		}
+		s, err := NewDNSProxy(v, log)
 		if err != nil {
-			die("Can't create socks listener on %s: %s", v, err)
+			die("Can't create DNS listener on %s: %s", v.Listen, err)
 		}
 
 		srv = append(srv, s)
 	}
 
+	if len(cfg.Admin.Listen) > 0 {
+		s, err := NewAdminServer(&cfg.Admin, log)
+		if err != nil {
+			die("Can't create admin listener on %s: %s", cfg.Admin.Listen, err)
+		}
+
+		srv = append(srv, s)
+	}
+
+	closeInherited(log)
+
 	// Drop privileges before starting the servers
-	DropPrivilege(cfg.Uid, cfg.Gid)
+	DropPrivilege(cfg.Uid, cfg.Gid, cfg.Chroot)
 
 	for _, s := range srv {
 		s.Start()
 	}
+	checkConfig(cfgfile)
+	setReady(true)
+
+	// The predecessor drains once this one serves; its successor
+	// (after SIGUSR2) takes over through the same socket.
+	var handed <-chan struct{}
+	if len(cfg.Handover) > 0 {
+		if prev != nil {
+			if err := prev.ready(); err != nil {
+				warn("%s", err)
+			}
+			if len(dc.Pidfile) > 0 {
+				go func() {
+					if err := lockPidfile(dc.Pidfile, true); err != nil {
+						log.Warn("%s", err)
+					}
+				}()
+			}
+		}
+		if handed, err = serveHandover(cfg.Handover, log); err != nil {
+			die("%s", err)
+		}
+	}
+
+	// exec stays for upgrades on SIGUSR2
+	if err := applySandbox(&cfg.Sandbox, len(cfg.Handover) > 0); err != nil {
+		die("%s", err)
+	}
+
+	// rules of the mounted config change in place
+	var watch *configWatch
+	if sc.Enable {
+		if watch, err = newConfigWatch(cfgfile, log, handed != nil); err != nil {
+			die("%s", err)
+		}
+		watch.Start(sc.Watch)
+	}
+
+	if alerts != nil {
+		alerts.Start()
+	}
+	if exports != nil {
+		exports.Start()
+	}
+	if events != nil {
+		events.Start()
+	}
+
+	daemonReady()
+	serviceReady()
 
 	// Setup signal handlers
 	sigchan := make(chan os.Signal, 4)
 	signal.Notify(sigchan,
 		syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	signal.Notify(sigchan, upgradeSignals...)
+	serviceNotify(sigchan)
 
 	signal.Ignore(syscall.SIGPIPE, syscall.SIGFPE)
 
 	// Now wait for signals to arrive
+	drain := false
+	status := 0
+wait:
 	for {
-		s := <-sigchan
-		t := s.(syscall.Signal)
+		select {
+		case s := <-sigchan:
+			t := s.(syscall.Signal)
+			if len(upgradeSignals) > 0 && s == upgradeSignals[0] {
+				if handed == nil {
+					log.Warn("Caught signal %d; no handover socket to upgrade with", int(t))
+				} else {
+					spawnUpgrade(log)
+				}
+				continue
+			}
+
+			log.Info("Caught signal %d; Terminating ..\n", int(t))
+			break wait
+
+		case <-handed:
+			log.Info("Handed the listeners over; draining ..")
+			drain = true
+			break wait
+
+		case status = <-alertExit:
+			log.Info("Terminating on an alert ..")
+			break wait
+		}
+	}
 
-		log.Info("Caught signal %d; Terminating ..\n", int(t))
-		break
+	// load balancers stop sending new clients
+	setReady(false)
+	if watch != nil {
+		watch.Stop()
 	}
 
-	for _, s := range srv {
-		s.Stop()
+	if drain {
+		d := time.Duration(cfg.Drain) * time.Second
+		if d <= 0 {
+			d = HANDOVER_DRAIN * time.Second
+		}
+		drainServers(srv, d, log)
+	} else {
+		for _, s := range srv {
+			s.Stop()
+		}
+	}
+	unlockPidfile(!drain)
+	if alerts != nil {
+		alerts.Stop()
+	}
+	if exports != nil {
+		exports.Stop()
+	}
+	if events != nil {
+		events.Stop()
+	}
+	if tracing != nil {
+		tracing.Stop()
 	}
 
 	log.Info("Shutdown complete!")
+	serviceStopped()
 
 	// Finally, close the logging subsystem
+	for _, u := range ulogs {
+		if err := u.Close(); err != nil {
+			log.Warn("can't close URL log: %s", err)
+		}
+	}
 	log.Close()
-	os.Exit(0)
+	os.Exit(status)
 }
 
 // Profiler
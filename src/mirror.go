@@ -0,0 +1,188 @@
+// mirror.go -- copies of the bytes sent upstream to a shadow destination
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Seconds to connect to and to write to a mirror
+	MIRROR_TIMEOUT = 5
+
+	// Most bytes of a connection waiting for its mirror; a mirror
+	// that falls further behind is dropped.
+	MIRROR_QUEUE = 1048576
+)
+
+var errMirrorRaw = errors.New("mirror: no raw access to a mirrored connection")
+
+// The mirror of a rule: each connection the rule allows gets a
+// connection to 'addr' that is sent a copy of what goes upstream. It is
+// best effort; the mirror never slows down or breaks the connection.
+type mirror struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	conns     uint64
+	bytes     uint64
+	failures  uint64 // dials and writes that failed
+	overflows uint64 // mirrors that fell behind
+
+	rule string
+	addr string
+}
+
+// The mirrors of a listener's rules, for the admin listener
+type mirrorSet struct {
+	listener string
+	v        []*mirror
+}
+
+// Return the mirror at 'addr' for rule 'name' or nil if there is none
+func newMirror(addr, name string) (*mirror, error) {
+	if len(addr) == 0 {
+		return nil, nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("rule %s: mirror %s: %s", name, addr, err)
+	}
+	return &mirror{rule: name, addr: addr}, nil
+}
+
+// Return 'c' with the bytes written to it copied to the mirror
+func (m *mirror) wrap(c net.Conn) net.Conn {
+	tc, ok := c.(tcpConn)
+	if !ok {
+		return c
+	}
+
+	atomic.AddUint64(&m.conns, 1)
+	x := &mirrorConn{tcpConn: tc, m: m, ch: make(chan []byte, 256)}
+	go x.run()
+	return x
+}
+
+// A mirrored connection. It has no raw access, so the copier relays it
+// through buffers where the mirror sees the bytes.
+type mirrorConn struct {
+	tcpConn
+	m  *mirror
+	ch chan []byte
+
+	mu     sync.Mutex
+	queued int
+	closed bool
+}
+
+func (c *mirrorConn) Write(b []byte) (int, error) {
+	n, err := c.tcpConn.Write(b)
+	if n > 0 {
+		c.send(b[:n])
+	}
+	return n, err
+}
+
+// Queue a copy of 'b' for the mirror; a mirror that is too far behind
+// is closed rather than sent a stream with a hole in it.
+func (c *mirrorConn) send(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.queued+len(b) > MIRROR_QUEUE {
+		atomic.AddUint64(&c.m.overflows, 1)
+		c.stop()
+		return
+	}
+
+	c.queued += len(b)
+	select {
+	case c.ch <- append([]byte(nil), b...):
+	default:
+		atomic.AddUint64(&c.m.overflows, 1)
+		c.stop()
+	}
+}
+
+// Stop queueing; the caller holds the lock.
+func (c *mirrorConn) stop() {
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+// Connect to the mirror and send it the queued bytes until the
+// connection closes; on errors, drain the queue.
+func (c *mirrorConn) run() {
+	m := c.m
+	d := net.Dialer{Timeout: MIRROR_TIMEOUT * time.Second}
+	mc, err := d.Dial("tcp", m.addr)
+	if err != nil {
+		atomic.AddUint64(&m.failures, 1)
+	} else {
+		defer mc.Close()
+	}
+
+	for b := range c.ch {
+		c.mu.Lock()
+		c.queued -= len(b)
+		c.mu.Unlock()
+		if mc == nil {
+			continue
+		}
+
+		mc.SetWriteDeadline(time.Now().Add(MIRROR_TIMEOUT * time.Second))
+		if _, err := mc.Write(b); err != nil {
+			atomic.AddUint64(&m.failures, 1)
+			mc.Close()
+			mc = nil
+			continue
+		}
+		atomic.AddUint64(&m.bytes, uint64(len(b)))
+	}
+}
+
+func (c *mirrorConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errMirrorRaw
+}
+
+func (c *mirrorConn) Close() error {
+	c.mu.Lock()
+	c.stop()
+	c.mu.Unlock()
+	return c.tcpConn.Close()
+}
+
+// Mirror metrics for the admin listener
+func (s *mirrorSet) metrics() []metric {
+	var v []metric
+	for _, m := range s.v {
+		l := fmt.Sprintf("listener=%q,rule=%q", s.listener, m.rule)
+		v = append(v,
+			metric{"goproxy_mirror_connections_total", "counter", "Connections mirrored",
+				l, float64(atomic.LoadUint64(&m.conns))},
+			metric{"goproxy_mirror_bytes_total", "counter", "Bytes sent to mirrors",
+				l, float64(atomic.LoadUint64(&m.bytes))},
+			metric{"goproxy_mirror_failures_total", "counter", "Mirror dials and writes that failed",
+				l, float64(atomic.LoadUint64(&m.failures))},
+			metric{"goproxy_mirror_overflows_total", "counter", "Mirrors dropped for falling behind",
+				l, float64(atomic.LoadUint64(&m.overflows))})
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,110 @@
+// mirror_test.go -- tests for mirrored connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	if m, err := newMirror("", "r"); m != nil || err != nil {
+		t.Errorf("empty: %v %v", m, err)
+	}
+	if _, err := newPolicy(&ListenConf{Rules: []RuleConf{{Action: "allow", Mirror: "nope"}}}); err == nil {
+		t.Errorf("rule with a bad mirror")
+	}
+
+	// the mirror hands over what each connection sent it
+	ml, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ml.Close() })
+	got := make(chan string, 4)
+	go func() {
+		for {
+			c, err := ml.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b, _ := io.ReadAll(c)
+				c.Close()
+				got <- string(b)
+			}()
+		}
+	}()
+
+	ln := startEcho(t)
+	lc := &ListenConf{Rules: []RuleConf{{Name: "shadow", Dest: []string{"127.0.0.0/8"}, Action: "allow",
+		Mirror: ml.Addr().String()}}}
+	addr := startHTTPProxy(t, lc)
+
+	c, br := connectTunnel(t, addr, ln.Addr().String(), "", "")
+	want := "hello" + strings.Repeat("m", 100000)
+	go io.WriteString(c, want)
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != want {
+		t.Fatalf("echo: %d bytes %v", len(b), err)
+	}
+	c.Close()
+
+	select {
+	case s := <-got:
+		if s != want {
+			t.Errorf("mirror got %d bytes, want %d", len(s), len(want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing mirrored")
+	}
+
+	// A mirror that is down doesn't break the tunnel
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	da := dead.Addr().String()
+	dead.Close()
+	m, _ := newMirror(da, "dead")
+	lc = &ListenConf{Rules: []RuleConf{{Name: "dead", Dest: []string{"127.0.0.0/8"}, Action: "allow", Mirror: da}}}
+	addr = startHTTPProxy(t, lc)
+	c, br = connectTunnel(t, addr, ln.Addr().String(), "", "")
+	io.WriteString(c, "ping")
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("dead mirror: %q %v", b, err)
+	}
+	c.Close()
+
+	// A connection that writes faster than the mirror takes drops it
+	a, z := net.Pipe()
+	defer z.Close()
+	mc := &mirrorConn{tcpConn: &fakeTCP{a}, m: m, ch: make(chan []byte, 256)}
+	go io.Copy(io.Discard, z)
+	for i := 0; i < 3; i++ {
+		mc.Write(make([]byte, MIRROR_QUEUE/2))
+	}
+	if !mc.closed || atomic.LoadUint64(&m.overflows) != 1 {
+		t.Errorf("overflow: closed %v, %d overflows", mc.closed, m.overflows)
+	}
+}
+
+// A net.Pipe end that passes for a TCP connection
+type fakeTCP struct {
+	net.Conn
+}
+
+func (*fakeTCP) CloseWrite() error { return nil }
+
+func (*fakeTCP) SyscallConn() (syscall.RawConn, error) { return nil, errMirrorRaw }
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
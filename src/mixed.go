@@ -0,0 +1,159 @@
+// mixed.go -- SOCKS and HTTP clients on one port
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// An HTTP listener with "mixed" set serves SOCKS clients too. Each
+// connection is told apart by its first byte: the version of a SOCKS4
+// or SOCKS5 request, else the start of an HTTP request; for TLS clients
+// it is the first byte inside the TLS. The SOCKS clients get the
+// listener's rules, auth and tunnel settings as on a SOCKS listener.
+
+// A connection whose first bytes were read to tell its protocol; Read
+// returns them first
+type peekConn struct {
+	tcpConn
+	pre []byte
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	if len(c.pre) > 0 {
+		n := copy(b, c.pre)
+		c.pre = c.pre[n:]
+		return n, nil
+	}
+	return c.tcpConn.Read(b)
+}
+
+// Read the first byte of 'c'; return it and a connection that reads it
+// again
+func peekByte(c net.Conn) (byte, *peekConn, error) {
+	pc := &peekConn{tcpConn: clientConn(c)}
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return 0, nil, err
+	}
+	pc.pre = b[:]
+	return b[0], pc, nil
+}
+
+// Make the SOCKS side of the mixed listener 'p'
+func (p *HTTPProxy) mixed() error {
+	lc := p.conf
+	if p.auth != nil && p.auth.neg != nil {
+		return fmt.Errorf("mixed: auth %s is not for SOCKS clients", lc.Auth.Type)
+	}
+	nat, err := parseNat(lc.UDP.Nat)
+	if err != nil {
+		return err
+	}
+
+	p.socks = &socksProxy{
+		TCPListener: p.TCPListener,
+		cfg:         lc,
+		dial:        p.dial,
+		log:         p.log,
+		ulog:        p.ulog,
+		grl:         p.grl,
+		prl:         p.prl,
+		nat:         nat,
+		cp:          p.cp,
+		filters:     p.filters,
+		captive:     p.captive,
+		auth:        p.auth,
+		trans:       p.trans,
+		tls:         p.tls,
+		ctx:         p.ctx,
+		cancel:      p.cancel,
+	}
+
+	// HTTP requests of TLS clients come on connections that aren't a
+	// tls.Conn: their first byte (inside the TLS) was read
+	if p.tls != nil {
+		p.srv.ConnContext = withConnTLS
+	}
+	return nil
+}
+
+// Sort the connections of 'ln': TLS clients from plaintext ones if the
+// listener takes both, SOCKS clients from HTTP ones if it is mixed.
+// SOCKS clients are served here, the rest go to the HTTP server.
+func (p *HTTPProxy) sortConns(ln *net.TCPListener) {
+	defer p.wg.Done()
+	for {
+		nc, err := p.accept(ln)
+		if err != nil {
+			if p.ctx.Err() == nil {
+				p.log.Error("Failed to accept new connection: %s", err)
+			}
+			return
+		}
+		p.wg.Add(1)
+		go p.sortConn(nc)
+	}
+}
+
+func (p *HTTPProxy) sortConn(nc net.Conn) {
+	defer p.wg.Done()
+	nc.SetDeadline(time.Now().Add(p.cp.handshake))
+	c, err := nc, error(nil)
+	if p.tls != nil {
+		c, err = p.tls.accept(nc)
+	}
+
+	// The protocol of a TLS client is that inside the TLS
+	var b byte
+	var pc *peekConn
+	if err == nil && p.socks != nil {
+		if _, err = tlsState(c); err == nil {
+			b, pc, err = peekByte(c)
+			c = pc
+		}
+	}
+	nc.SetDeadline(time.Time{})
+	if err != nil {
+		p.log.Debug("%s: %s", nc.RemoteAddr().String(), err)
+		nc.Close()
+		return
+	}
+
+	switch b {
+	case 4, 5:
+		p.socks.wg.Add(1)
+		p.socks.Proxy(c)
+	default:
+		select {
+		case p.conns <- c:
+		case <-p.ctx.Done():
+			nc.Close()
+		}
+	}
+}
+
+// The HTTP connections of a mixed listener
+type mixedListener struct {
+	*HTTPProxy
+}
+
+func (ml mixedListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ml.conns:
+		return c, nil
+	case <-ml.ctx.Done():
+		return nil, &errShutdown
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,163 @@
+// mixed_test.go -- tests for SOCKS and HTTP clients on one port
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/net/proxy"
+)
+
+// Send the SOCKS4 request 'req' to 'addr'; return the connection and
+// the reply
+func socks4(t *testing.T, addr string, req []byte) (net.Conn, []byte) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(req)
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return nil, nil
+	}
+	return c, b
+}
+
+// A SOCKS4 CONNECT to 'ip:port'; a SOCKS4a one if 'host' isn't ""
+func socks4Req(ip net.IP, port int, host string) []byte {
+	b := []byte{4, 1, byte(port >> 8), byte(port)}
+	if len(host) > 0 {
+		ip = net.IPv4(0, 0, 0, 1)
+	}
+	b = append(b, ip.To4()...)
+	b = append(b, "me\x00"...)
+	if len(host) > 0 {
+		b = append(b, host+"\x00"...)
+	}
+	return b
+}
+
+func TestMixed(t *testing.T) {
+	echo := startEcho(t)
+	ep := echo.Addr().(*net.TCPAddr)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain http")
+	}))
+	defer origin.Close()
+
+	addr := startHTTPProxy(t, &ListenConf{Mixed: true})
+	ping := func(what string, c net.Conn) {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, "ping")
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+			t.Errorf("%s: %q %v", what, got, err)
+		}
+		c.Close()
+	}
+
+	// SOCKS5
+	d, _ := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("socks5: %s", err)
+	}
+	ping("socks5", c)
+
+	// SOCKS4 and SOCKS4a
+	for _, host := range []string{"", "localhost"} {
+		c, b := socks4(t, addr, socks4Req(ep.IP, ep.Port, host))
+		if c == nil || b[0] != 0 || b[1] != 90 {
+			t.Fatalf("socks4 %q: %v", host, b)
+		}
+		ping("socks4 "+host, c)
+	}
+
+	// HTTP CONNECT
+	c, br := connectTunnel(t, addr, echo.Addr().String(), "", "")
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Errorf("connect: %q %v", got, err)
+	}
+	c.Close()
+
+	// plain HTTP
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}, Timeout: 5 * time.Second}
+	res, err := hc.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "plain http" {
+		t.Errorf("http: %q", body)
+	}
+}
+
+func TestSocks4(t *testing.T) {
+	echo := startEcho(t)
+	ep := echo.Addr().(*net.TCPAddr)
+	addr := startSocksProxy(t, &ListenConf{
+		Rules: []RuleConf{{Name: "no", Dest: []string{"127.0.0.2/32"}, Action: "deny"}},
+	})
+
+	c, b := socks4(t, addr, socks4Req(ep.IP, ep.Port, ""))
+	if c == nil || !bytes.Equal(b[:2], []byte{0, 90}) {
+		t.Fatalf("connect: %v", b)
+	}
+	c.Close()
+
+	// denied, BIND and bad requests are rejected
+	for _, req := range [][]byte{
+		socks4Req(net.IPv4(127, 0, 0, 2), ep.Port, ""),
+		append([]byte{4, 2}, socks4Req(ep.IP, ep.Port, "")[2:]...),
+	} {
+		if c, b := socks4(t, addr, req); c == nil || b[1] != 91 {
+			t.Errorf("%x: %v", req, b)
+		} else {
+			c.Close()
+		}
+	}
+	if c, _ := socks4(t, addr, append([]byte{4, 1, 0, 80, 0, 0, 0, 1}, bytes.Repeat([]byte{'a'}, 300)...)); c != nil {
+		t.Errorf("long user id: no error")
+		c.Close()
+	}
+
+	// SOCKS4 can't authenticate
+	addr = startSocksProxy(t, &ListenConf{Auth: AuthConf{Type: "htpasswd", Args: map[string]string{"file": writeHtpasswd(t, "")}}})
+	if c, b := socks4(t, addr, socks4Req(ep.IP, ep.Port, "")); c == nil || b[1] != 91 {
+		t.Errorf("auth: %v", b)
+	} else {
+		c.Close()
+	}
+}
+
+func TestMixedConf(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewSocksv5Proxy(&ListenConf{Listen: "127.0.0.1:0",
+		ConnectIP: ConnectIPConf{Pool: []string{"10.0.0.0/24"}}}, log, nil); err == nil {
+		t.Errorf("connectip on socks: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,302 @@
+// oidc.go -- authenticator for OAuth2/OIDC bearer tokens
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds between fetches of the issuer's keys
+	OIDC_REFRESH = 3600
+
+	// Seconds between fetches for tokens signed with a key we don't
+	// have (the issuer rotated its keys)
+	OIDC_REFETCH = 30
+
+	// Seconds for each request to the issuer
+	OIDC_TIMEOUT = 10
+
+	// Seconds of clock skew allowed when checking expiry
+	OIDC_LEEWAY = 60
+
+	// Bytes of a discovery document or key set we read
+	OIDC_MAXDOC = 1 << 20
+)
+
+func init() {
+	RegisterAuth("oidc", newOIDCAuth)
+}
+
+// Checks access tokens (JWTs) issued by an OpenID Connect provider. The
+// issuer's signing keys are found with OIDC discovery (or given as
+// "jwks") and fetched again every "refresh" seconds, or sooner when a
+// token names a key we don't have. Tokens must be for "audience" and
+// have all of "scopes". The user is the token's "userclaim" (default
+// "sub").
+type oidcAuth struct {
+	issuer    string
+	jwksURL   string
+	audience  string
+	scopes    []string
+	userClaim string
+	leeway    time.Duration
+	refresh   time.Duration
+	client    *http.Client
+
+	fetch sync.Mutex // one fetch at a time
+
+	sync.Mutex
+	keys    []jwtKey
+	fetched time.Time // last fetch, good or not
+	good    time.Time // last good fetch
+}
+
+func newOIDCAuth(args map[string]string) (Authenticator, error) {
+	a := &oidcAuth{
+		issuer:    strings.TrimSuffix(args["issuer"], "/"),
+		jwksURL:   args["jwks"],
+		audience:  args["audience"],
+		scopes:    strings.FieldsFunc(args["scopes"], func(r rune) bool { return r == ',' || r == ' ' }),
+		userClaim: args["userclaim"],
+		leeway:    OIDC_LEEWAY * time.Second,
+		refresh:   OIDC_REFRESH * time.Second,
+		client:    &http.Client{Timeout: OIDC_TIMEOUT * time.Second},
+	}
+
+	if len(a.issuer) == 0 {
+		return nil, fmt.Errorf("missing 'issuer'")
+	}
+	if err := secureURL(a.issuer); err != nil {
+		return nil, fmt.Errorf("issuer: %s", err)
+	}
+	if len(a.jwksURL) > 0 {
+		if err := secureURL(a.jwksURL); err != nil {
+			return nil, fmt.Errorf("jwks: %s", err)
+		}
+	}
+
+	// Tokens for other services must not open the proxy
+	if len(a.audience) == 0 {
+		return nil, fmt.Errorf("missing 'audience'")
+	}
+	if len(a.userClaim) == 0 {
+		a.userClaim = "sub"
+	}
+
+	for _, k := range []string{"refresh", "leeway", "timeout"} {
+		s := args[k]
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s %q: not a number of seconds", k, s)
+		}
+		d := time.Duration(n) * time.Second
+		switch k {
+		case "refresh":
+			if n > 0 {
+				a.refresh = d
+			}
+		case "leeway":
+			a.leeway = d
+		case "timeout":
+			if n > 0 {
+				a.client.Timeout = d
+			}
+		}
+	}
+	return a, nil
+}
+
+// Return an error unless 's' is an https URL; http is allowed for the
+// loopback address.
+func secureURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("%q: not a URL", s)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); u.Scheme == "http" && (u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return fmt.Errorf("%q: must be https", s)
+}
+
+// Basic clients (and SOCKS clients) send the token as the password of
+// the user it was issued to.
+func (a *oidcAuth) Authenticate(ctx context.Context, user, pass string) error {
+	u, err := a.AuthenticateToken(ctx, pass)
+	if err != nil {
+		return err
+	}
+	if u != user {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func (a *oidcAuth) AuthenticateToken(ctx context.Context, token string) (string, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return "", err
+	}
+
+	keys, err := a.getKeys(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	err = t.verify(keys)
+	if err == errNoTokenKey {
+		// The issuer may have a new key
+		if keys, err = a.getKeys(ctx, true); err != nil {
+			return "", err
+		}
+		err = t.verify(keys)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c := &t.claims
+	if err := c.check(a.issuer, a.audience, a.scopes, a.leeway); err != nil {
+		return "", err
+	}
+
+	user := c.str(a.userClaim)
+	if len(user) == 0 {
+		return "", fmt.Errorf("oidc: token has no %q", a.userClaim)
+	}
+	return user, nil
+}
+
+// Return the issuer's keys; fetch them if they are old, or if 'again'
+// and we haven't fetched them in a while.
+func (a *oidcAuth) getKeys(ctx context.Context, again bool) ([]jwtKey, error) {
+	stale := func(now time.Time) bool {
+		if again {
+			return now.Sub(a.fetched) >= OIDC_REFETCH*time.Second
+		}
+		return a.keys == nil || now.Sub(a.good) >= a.refresh
+	}
+
+	a.Lock()
+	if !stale(time.Now()) {
+		k := a.keys
+		a.Unlock()
+		return k, nil
+	}
+	a.Unlock()
+
+	a.fetch.Lock()
+	defer a.fetch.Unlock()
+
+	// Someone else may have just fetched them
+	a.Lock()
+	if !stale(time.Now()) {
+		k := a.keys
+		a.Unlock()
+		return k, nil
+	}
+	a.fetched = time.Now()
+	a.Unlock()
+
+	keys, err := a.fetchKeys(ctx)
+
+	a.Lock()
+	defer a.Unlock()
+	if err != nil {
+		// Keep using the keys we have until they are fetched again
+		if a.keys != nil {
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	a.keys = keys
+	a.good = time.Now()
+	return keys, nil
+}
+
+func (a *oidcAuth) fetchKeys(ctx context.Context) ([]jwtKey, error) {
+	if len(a.jwksURL) == 0 {
+		var d struct {
+			Issuer  string `json:"issuer"`
+			JwksURI string `json:"jwks_uri"`
+		}
+		if err := a.get(ctx, a.issuer+"/.well-known/openid-configuration", &d); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(d.Issuer, "/") != a.issuer {
+			return nil, fmt.Errorf("oidc: discovery names issuer %q", d.Issuer)
+		}
+		if err := secureURL(d.JwksURI); err != nil {
+			return nil, fmt.Errorf("oidc: jwks_uri: %s", err)
+		}
+		a.jwksURL = d.JwksURI
+	}
+
+	var raw json.RawMessage
+	if err := a.get(ctx, a.jwksURL, &raw); err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %s", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("oidc: issuer has no signing keys")
+	}
+	return keys, nil
+}
+
+// GET the JSON document at 'u' into 'v'
+func (a *oidcAuth) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s: %s", u, res.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, OIDC_MAXDOC))
+	if err != nil {
+		return fmt.Errorf("oidc: %s: %s", u, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("oidc: %s: %s", u, err)
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,206 @@
+// oidc_test.go -- tests for the OIDC token authenticator
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An OIDC issuer with a key set we can change
+type fakeIssuer struct {
+	*httptest.Server
+	fetches int32
+
+	sync.Mutex
+	keys []map[string]string
+}
+
+func startFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": f.URL, "jwks_uri": f.URL + "/keys"})
+		case "/keys":
+			atomic.AddInt32(&f.fetches, 1)
+			f.Lock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": f.keys})
+			f.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeIssuer) setKeys(keys ...map[string]string) {
+	f.Lock()
+	f.keys = keys
+	f.Unlock()
+}
+
+func (f *fakeIssuer) claims(user string, scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   f.URL,
+		"aud":   []string{"other", "goproxy"},
+		"sub":   user,
+		"scope": scope,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	f := startFakeIssuer(t)
+	k1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	k2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.setKeys(testJWK("k1", &k1.PublicKey))
+
+	a, err := newOIDCAuth(map[string]string{"issuer": f.URL, "audience": "goproxy", "scopes": "proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := a.(*oidcAuth)
+	ctx := context.Background()
+
+	tok := testToken(t, "ES256", "k1", k1, f.claims("alice", "openid proxy"))
+	if u, err := ta.AuthenticateToken(ctx, tok); err != nil || u != "alice" {
+		t.Fatalf("alice: %q %v", u, err)
+	}
+	if err := ta.Authenticate(ctx, "alice", tok); err != nil {
+		t.Errorf("token as password: %s", err)
+	}
+	if err := ta.Authenticate(ctx, "bob", tok); err != errAuthFailed {
+		t.Errorf("token of another user: %v", err)
+	}
+
+	bad := []map[string]interface{}{
+		f.claims("alice", "openid"),
+		func() map[string]interface{} { c := f.claims("alice", "proxy"); c["aud"] = "other"; return c }(),
+		func() map[string]interface{} { c := f.claims("alice", "proxy"); c["iss"] = "https://evil"; return c }(),
+		func() map[string]interface{} { c := f.claims("alice", "proxy"); c["exp"] = 1; return c }(),
+		f.claims("", "proxy"),
+	}
+	for _, c := range bad {
+		if _, err := ta.AuthenticateToken(ctx, testToken(t, "ES256", "k1", k1, c)); err == nil {
+			t.Errorf("%v: accepted", c)
+		}
+	}
+	if n := atomic.LoadInt32(&f.fetches); n != 1 {
+		t.Errorf("%d fetches; want 1", n)
+	}
+
+	// The issuer rotates to a new key, a while later
+	ta.fetched = time.Time{}
+	f.setKeys(testJWK("k1", &k1.PublicKey), testJWK("k2", &k2.PublicKey))
+	tok2 := testToken(t, "ES256", "k2", k2, f.claims("bob", "proxy"))
+	if u, err := ta.AuthenticateToken(ctx, tok2); err != nil || u != "bob" {
+		t.Errorf("new key: %q %v", u, err)
+	}
+
+	// Unknown keys don't make us fetch again and again
+	tok3 := testToken(t, "ES256", "k3", k2, f.claims("bob", "proxy"))
+	for i := 0; i < 3; i++ {
+		if _, err := ta.AuthenticateToken(ctx, tok3); err != errNoTokenKey {
+			t.Errorf("unknown key: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&f.fetches); n != 2 {
+		t.Errorf("%d fetches; want 2", n)
+	}
+
+	// The issuer goes away: the keys we have still work
+	f.Close()
+	ta.good = time.Time{}
+	ta.fetched = time.Time{}
+	if _, err := ta.AuthenticateToken(ctx, tok); err != nil {
+		t.Errorf("issuer down: %s", err)
+	}
+}
+
+func TestOIDCConf(t *testing.T) {
+	bad := []map[string]string{
+		{"audience": "x"},
+		{"issuer": "http://idp.example.com", "audience": "x"},
+		{"issuer": "https://idp.example.com"},
+		{"issuer": "https://idp.example.com", "audience": "x", "jwks": "http://idp.example.com/keys"},
+		{"issuer": "https://idp.example.com", "audience": "x", "refresh": "often"},
+	}
+	for _, args := range bad {
+		if _, err := newOIDCAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestOIDCProxy(t *testing.T) {
+	f := startFakeIssuer(t)
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f.setKeys(testJWK("k", &k.PublicKey))
+	tok := testToken(t, "ES256", "k", k, f.claims("alice", ""))
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+
+	ac := AuthConf{Type: "oidc", Realm: "sso", Args: map[string]string{"issuer": f.URL, "audience": "goproxy"}}
+	addr := startHTTPProxy(t, &ListenConf{Auth: ac})
+	do := func(auth string) *http.Response {
+		pu := &url.URL{Scheme: "http", Host: addr}
+		hdr := http.Header{}
+		if len(auth) > 0 {
+			hdr.Set("Proxy-Authorization", auth)
+		}
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), ProxyConnectHeader: hdr}}
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		req.Header = hdr
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := do("Bearer " + tok); res.StatusCode != 200 {
+		t.Errorf("bearer: %d", res.StatusCode)
+	}
+	res := do("Bearer " + tok + "x")
+	ch := res.Header.Values("Proxy-Authenticate")
+	if res.StatusCode != http.StatusProxyAuthRequired || len(ch) != 2 || ch[1] != `Bearer realm="sso", error="invalid_token"` {
+		t.Errorf("bad token: %d %q", res.StatusCode, ch)
+	}
+
+	// Basic clients send the token as the password
+	pu := &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("alice", tok)}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	res, err := c.Get(origin.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("basic: %d", res.StatusCode)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
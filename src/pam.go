@@ -0,0 +1,369 @@
+// pam.go -- authenticator backed by PAM
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build pam,cgo,!windows
+
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// libpam is loaded when the first "pam" authenticator is made; we don't
+// need its headers or a link-time dependency. The ABI is stable; only
+// the constants differ between Linux-PAM and OpenPAM.
+
+typedef struct pam_handle pam_handle_t;
+
+struct pam_message {
+	int msg_style;
+	const char *msg;
+};
+
+struct pam_response {
+	char *resp;
+	int resp_retcode;
+};
+
+struct pam_conv {
+	int (*conv)(int, const struct pam_message **, struct pam_response **, void *);
+	void *appdata_ptr;
+};
+
+enum {
+	PAM_PROMPT_ECHO_OFF = 1,
+	PAM_PROMPT_ECHO_ON = 2,
+	PAM_ERROR_MSG = 3,
+	PAM_TEXT_INFO = 4,
+
+	PAM_RHOST = 4,
+	PAM_DISALLOW_NULL_AUTHTOK = 1,
+};
+
+#ifdef __linux__
+enum {
+	PAM_SUCCESS = 0,
+	PAM_BUF_ERR = 5,
+	PAM_PERM_DENIED = 6,
+	PAM_AUTH_ERR = 7,
+	PAM_CRED_INSUFFICIENT = 8,
+	PAM_USER_UNKNOWN = 10,
+	PAM_MAXTRIES = 11,
+	PAM_NEW_AUTHTOK_REQD = 12,
+	PAM_ACCT_EXPIRED = 13,
+	PAM_CONV_ERR = 19,
+	PAM_AUTHTOK_EXPIRED = 27,
+};
+#define PAM_SILENT 0x8000
+#else
+enum {
+	PAM_SUCCESS = 0,
+	PAM_BUF_ERR = 5,
+	PAM_CONV_ERR = 6,
+	PAM_PERM_DENIED = 7,
+	PAM_MAXTRIES = 8,
+	PAM_AUTH_ERR = 9,
+	PAM_NEW_AUTHTOK_REQD = 10,
+	PAM_CRED_INSUFFICIENT = 11,
+	PAM_USER_UNKNOWN = 13,
+	PAM_ACCT_EXPIRED = 17,
+	PAM_AUTHTOK_EXPIRED = 18,
+};
+#define PAM_SILENT 0x80000000
+#endif
+
+static int (*p_start)(const char *, const char *, const struct pam_conv *, pam_handle_t **);
+static int (*p_start_confdir)(const char *, const char *, const struct pam_conv *, const char *,
+			      pam_handle_t **);
+static int (*p_set_item)(pam_handle_t *, int, const void *);
+static int (*p_authenticate)(pam_handle_t *, int);
+static int (*p_acct_mgmt)(pam_handle_t *, int);
+static int (*p_end)(pam_handle_t *, int);
+static const char *(*p_strerror)(pam_handle_t *, int);
+
+// Load libpam; return NULL or an error
+static const char *
+pam_load(void)
+{
+	static const char *lib[] = {
+		"libpam.so.0", "libpam.so", "libpam.so.6", "libpam.2.dylib", "libpam.dylib", NULL,
+	};
+	void *h = NULL;
+	int i;
+
+	for (i = 0; lib[i] != NULL && h == NULL; i++)
+		h = dlopen(lib[i], RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL)
+		return "can't load libpam";
+
+	p_start = dlsym(h, "pam_start");
+	p_start_confdir = dlsym(h, "pam_start_confdir");
+	p_set_item = dlsym(h, "pam_set_item");
+	p_authenticate = dlsym(h, "pam_authenticate");
+	p_acct_mgmt = dlsym(h, "pam_acct_mgmt");
+	p_end = dlsym(h, "pam_end");
+	p_strerror = dlsym(h, "pam_strerror");
+	if (!p_start || !p_set_item || !p_authenticate || !p_acct_mgmt || !p_end || !p_strerror)
+		return "libpam lacks the functions we need";
+	return NULL;
+}
+
+static int
+pam_has_confdir(void)
+{
+	return p_start_confdir != NULL;
+}
+
+struct cred {
+	const char *user;
+	const char *pass;
+	int asked;
+};
+
+// Answer the modules' prompts: the user name when it is echoed, the
+// password the first time it isn't. Anything else - a second secret, as
+// with one-time passwords - can't be relayed to a proxy client.
+static int
+pam_conversation(int n, const struct pam_message **msg, struct pam_response **resp, void *arg)
+{
+	struct cred *c = arg;
+	struct pam_response *r;
+	const char *s;
+	int i;
+
+	if (n <= 0 || n > 32)
+		return PAM_CONV_ERR;
+	if ((r = calloc(n, sizeof *r)) == NULL)
+		return PAM_BUF_ERR;
+
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_ON:
+			s = c->user;
+			break;
+		case PAM_PROMPT_ECHO_OFF:
+			if (c->asked++ > 0)
+				goto fail;
+			s = c->pass;
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			continue;
+		default:
+			goto fail;
+		}
+		if ((r[i].resp = strdup(s)) == NULL)
+			goto fail;
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < n; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+// Authenticate 'user' with 'service' (and check the account if 'acct');
+// return the PAM status and its text in 'msg'.
+static int
+pam_check(const char *service, const char *confdir, const char *user, const char *pass,
+	  const char *rhost, int acct, char *msg, size_t msglen)
+{
+	struct cred c = { user, pass, 0 };
+	struct pam_conv conv = { pam_conversation, &c };
+	pam_handle_t *h = NULL;
+	int rc;
+
+	if (confdir != NULL)
+		rc = p_start_confdir(service, user, &conv, confdir, &h);
+	else
+		rc = p_start(service, user, &conv, &h);
+	if (rc != PAM_SUCCESS) {
+		strncpy(msg, p_strerror(h, rc), msglen - 1);
+		return rc;
+	}
+
+	if (rhost != NULL)
+		rc = p_set_item(h, PAM_RHOST, rhost);
+	if (rc == PAM_SUCCESS)
+		rc = p_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc == PAM_SUCCESS && acct)
+		rc = p_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+
+	strncpy(msg, p_strerror(h, rc), msglen - 1);
+	p_end(h, rc);
+	return rc;
+}
+
+// Return true if 'rc' means the user or password is no good, rather
+// than that PAM or a module doesn't work.
+static int
+pam_refused(int rc)
+{
+	switch (rc) {
+	case PAM_AUTH_ERR:
+	case PAM_USER_UNKNOWN:
+	case PAM_PERM_DENIED:
+	case PAM_MAXTRIES:
+	case PAM_CRED_INSUFFICIENT:
+	case PAM_ACCT_EXPIRED:
+	case PAM_NEW_AUTHTOK_REQD:
+	case PAM_AUTHTOK_EXPIRED:
+	case PAM_CONV_ERR:
+		return 1;
+	}
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Seconds a verified user and password are remembered
+	PAM_CACHE_TTL = 60
+
+	// Conversations at a time; each holds a thread while PAM works
+	PAM_PARALLEL = 16
+)
+
+var pamLoad struct {
+	sync.Once
+	err error
+}
+
+func init() {
+	RegisterAuth("pam", newPAMAuth)
+}
+
+// Checks users with PAM, i.e., against the accounts of the host or
+// whatever the PAM service is configured for. The password is given to
+// the modules that ask for one; prompts for anything more (one-time
+// passwords) fail the authentication. The account is checked too
+// (expiry, access rules) unless "account" is false.
+type pamAuth struct {
+	service string
+	confdir string
+	account bool
+
+	sem   chan struct{}
+	cache *authCache
+}
+
+func newPAMAuth(args map[string]string) (Authenticator, error) {
+	pamLoad.Do(func() {
+		if s := C.pam_load(); s != nil {
+			pamLoad.err = errors.New(C.GoString(s))
+		}
+	})
+	if pamLoad.err != nil {
+		return nil, pamLoad.err
+	}
+
+	a := &pamAuth{
+		service: args["service"],
+		confdir: args["confdir"],
+		account: true,
+		sem:     make(chan struct{}, PAM_PARALLEL),
+		cache:   newAuthCache(PAM_CACHE_TTL * time.Second),
+	}
+	if len(a.service) == 0 {
+		a.service = "goproxy"
+	}
+	if len(a.confdir) > 0 && C.pam_has_confdir() == 0 {
+		return nil, fmt.Errorf("confdir: libpam can't use another config directory")
+	}
+
+	var err error
+	if s := args["account"]; len(s) > 0 {
+		if a.account, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("account %q: %s", s, err)
+		}
+	}
+	if s := args["cache"]; len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("cache %q: not a number of seconds", s)
+		}
+		a.cache.ttl = time.Duration(n) * time.Second
+	}
+	return a, nil
+}
+
+func (a *pamAuth) Authenticate(ctx context.Context, user, pass string) error {
+	if len(user) == 0 || len(pass) == 0 {
+		return errAuthFailed
+	}
+	if a.cache.has(user, pass) {
+		return nil
+	}
+
+	select {
+	case a.sem <- struct{}{}:
+		defer func() { <-a.sem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	cs := C.CString(a.service)
+	cu := C.CString(user)
+	cp := C.CString(pass)
+	defer func() {
+		C.memset(unsafe.Pointer(cp), 0, C.size_t(len(pass)))
+		C.free(unsafe.Pointer(cp))
+		C.free(unsafe.Pointer(cu))
+		C.free(unsafe.Pointer(cs))
+	}()
+
+	var cd, ch *C.char
+	if len(a.confdir) > 0 {
+		cd = C.CString(a.confdir)
+		defer C.free(unsafe.Pointer(cd))
+	}
+	if ip := clientOf(ctx); ip != nil {
+		ch = C.CString(ip.String())
+		defer C.free(unsafe.Pointer(ch))
+	}
+
+	var acct C.int
+	if a.account {
+		acct = 1
+	}
+
+	var msg [128]C.char
+	rc := C.pam_check(cs, cd, cu, cp, ch, acct, &msg[0], C.size_t(len(msg)))
+	switch {
+	case rc == C.PAM_SUCCESS:
+	case C.pam_refused(rc) != 0:
+		return errAuthFailed
+	default:
+		return fmt.Errorf("pam %s: %s", a.service, C.GoString(&msg[0]))
+	}
+
+	a.cache.add(user, pass)
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
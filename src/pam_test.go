@@ -0,0 +1,106 @@
+// pam_test.go -- tests for the PAM authenticator
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build pam,cgo,!windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Write PAM services to a config directory of their own. The password
+// is checked by a script that pam_exec gives it to; pam_exec fails with
+// a system error, so a failure skips to pam_deny.
+func pamConfDir(t *testing.T) string {
+	dir := t.TempDir()
+	check := filepath.Join(dir, "check")
+	script := "#!/bin/sh\nread -r pw\n[ \"$PAM_USER\" = alice ] && [ \"$pw\" = wonder ]\n"
+	auth := "auth [success=1 default=ignore] pam_exec.so quiet expose_authtok " + check + "\n" +
+		"auth requisite pam_deny.so\n" +
+		"auth required pam_permit.so\n"
+
+	services := map[string]string{
+		"test":    auth + "account required pam_permit.so\n",
+		"expired": auth + "account required pam_deny.so\n",
+		"broken":  "auth required pam_no_such_module.so\n",
+	}
+	for k, v := range services {
+		if err := ioutil.WriteFile(filepath.Join(dir, k), []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(check, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestPAM(t *testing.T, args map[string]string) *pamAuth {
+	a, err := newPAMAuth(args)
+	if err != nil {
+		if pamLoad.err != nil {
+			t.Skipf("pam: %s", err)
+		}
+		t.Fatal(err)
+	}
+	return a.(*pamAuth)
+}
+
+func TestPAM(t *testing.T) {
+	dir := pamConfDir(t)
+	a := newTestPAM(t, map[string]string{"service": "test", "confdir": dir, "cache": "0"})
+
+	ctx := context.Background()
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Fatalf("alice: %s", err)
+	}
+	for _, x := range [][2]string{{"alice", "nope"}, {"bob", "wonder"}, {"alice", ""}} {
+		if err := a.Authenticate(ctx, x[0], x[1]); err != errAuthFailed {
+			t.Errorf("%q %q: %v", x[0], x[1], err)
+		}
+	}
+
+	// The account must be good too
+	b := newTestPAM(t, map[string]string{"service": "expired", "confdir": dir})
+	if err := b.Authenticate(ctx, "alice", "wonder"); err != errAuthFailed {
+		t.Errorf("account denied: %v", err)
+	}
+	b = newTestPAM(t, map[string]string{"service": "expired", "confdir": dir, "account": "false"})
+	if err := b.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Errorf("account not checked: %v", err)
+	}
+
+	// A broken service is an error of its own
+	b = newTestPAM(t, map[string]string{"service": "broken", "confdir": dir})
+	if err := b.Authenticate(ctx, "alice", "wonder"); err == nil || err == errAuthFailed {
+		t.Errorf("broken service: %v", err)
+	}
+}
+
+func TestPAMConf(t *testing.T) {
+	bad := []map[string]string{
+		{"account": "maybe"},
+		{"cache": "-1"},
+	}
+	for _, args := range bad {
+		if _, err := newPAMAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	a := newTestPAM(t, map[string]string{})
+	if a.service != "goproxy" || !a.account {
+		t.Errorf("defaults: %q %v", a.service, a.account)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
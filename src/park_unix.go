@@ -0,0 +1,50 @@
+// park_unix.go -- wait for an idle connection without a buffer
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// Wait until 's' is readable, at EOF or in error. The goroutine sleeps
+// in the runtime netpoller; the read deadline of 's' applies.
+func park(s tcpConn) error {
+	rc, err := s.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var b [1]byte
+	return rc.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return err != syscall.EAGAIN
+	})
+}
+
+// Return true if the idle connection 's' is still usable: nothing to
+// read and no EOF or error pending.
+func alive(s tcpConn) bool {
+	rc, err := s.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var b [1]byte
+	ok := false
+	rc.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		ok = err == syscall.EAGAIN
+		return true
+	})
+	return ok
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,23 @@
+// park_windows.go -- no connection parking on windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build windows
+
+package main
+
+// Read directly; connections don't wait for readability first.
+func park(s tcpConn) error {
+	return nil
+}
+
+// Idle connections are assumed usable
+func alive(s tcpConn) bool {
+	return true
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
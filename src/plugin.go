@@ -0,0 +1,331 @@
+// plugin.go -- authenticators and routers that are programs of their own
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/go-proxies/plugin"
+)
+
+const (
+	// Milliseconds a call to a plugin may take
+	PLUGIN_TIMEOUT = 2000
+
+	// Seconds a verified user and password are remembered
+	PLUGIN_CACHE_TTL = 60
+)
+
+func init() {
+	RegisterAuth("plugin", newPluginAuth)
+	RegisterRouter("plugin", newPluginRouter)
+}
+
+// The "plugin" authenticator and router run a program ("cmd", with the
+// space separated "args") and ask it; see package plugin for what the
+// program speaks. One program may do both: listeners and uses that
+// name the same command share its process. What it writes to stderr
+// goes to the log.
+
+// Told the listener and log of an authenticator or router when the
+// listener is set up
+type attacher interface {
+	attach(listen string, log *L.Logger)
+}
+
+// A running plugin, shared by those that name the same command
+type pluginProc struct {
+	*plugin.Client
+	key  string
+	refs int // guarded by pluginProcs
+
+	mu  sync.Mutex
+	log *L.Logger // nil until attached; stderr until then
+}
+
+var pluginProcs = struct {
+	sync.Mutex
+	m map[string]*pluginProc
+}{m: make(map[string]*pluginProc)}
+
+// Start the plugin of 'args' or share the one that runs
+func openPlugin(args map[string]string) (*pluginProc, error) {
+	cmd := args["cmd"]
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("need 'cmd'")
+	}
+	argv := strings.Fields(args["args"])
+	key := strings.Join(append([]string{cmd}, argv...), "\x00")
+
+	pluginProcs.Lock()
+	defer pluginProcs.Unlock()
+
+	if p, ok := pluginProcs.m[key]; ok {
+		p.refs++
+		return p, nil
+	}
+
+	p := &pluginProc{key: key, refs: 1}
+	c, err := plugin.Start(&plugin.Config{Cmd: cmd, Args: argv, Log: p.stderr})
+	if err != nil {
+		return nil, err
+	}
+	p.Client = c
+	pluginProcs.m[key] = p
+	return p, nil
+}
+
+// Drop a use of the plugin; the last one stops it
+func (p *pluginProc) Close() error {
+	pluginProcs.Lock()
+	p.refs--
+	last := p.refs == 0
+	if last {
+		delete(pluginProcs.m, p.key)
+	}
+	pluginProcs.Unlock()
+
+	if last {
+		return p.Client.Close()
+	}
+	return nil
+}
+
+func (p *pluginProc) setLog(log *L.Logger) {
+	p.mu.Lock()
+	p.log = log
+	p.mu.Unlock()
+}
+
+// Log a line the plugin wrote to stderr
+func (p *pluginProc) stderr(s string) {
+	p.mu.Lock()
+	log := p.log
+	p.mu.Unlock()
+
+	cmd := p.key
+	if i := strings.IndexByte(cmd, 0); i >= 0 {
+		cmd = cmd[:i]
+	}
+	if log == nil {
+		fmt.Fprintf(os.Stderr, "plugin %s: %s\n", cmd, s)
+		return
+	}
+	log.Info("plugin %s: %s", cmd, s)
+}
+
+// Return the timeout of calls in 'args'
+func pluginTimeout(args map[string]string) (time.Duration, error) {
+	s := args["timeout"]
+	if len(s) == 0 {
+		return PLUGIN_TIMEOUT * time.Millisecond, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// Checks users and passwords with a plugin. A verified user is
+// remembered for "cache" seconds, as with ldap.
+type pluginAuth struct {
+	p       *pluginProc
+	timeout time.Duration
+	cache   *authCache
+	listen  string
+}
+
+// A pluginAuth whose plugin also takes bearer tokens
+type pluginTokenAuth struct {
+	*pluginAuth
+}
+
+func newPluginAuth(args map[string]string) (Authenticator, error) {
+	tmo, err := pluginTimeout(args)
+	if err != nil {
+		return nil, err
+	}
+	ttl := PLUGIN_CACHE_TTL
+	if s := args["cache"]; len(s) > 0 {
+		if ttl, err = strconv.Atoi(s); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("cache %q: not a number of seconds", s)
+		}
+	}
+
+	p, err := openPlugin(args)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Has(plugin.SVC_AUTH) && !p.Has(plugin.SVC_TOKEN) {
+		p.Close()
+		return nil, fmt.Errorf("%s: no auth service", args["cmd"])
+	}
+
+	a := &pluginAuth{
+		p:       p,
+		timeout: tmo,
+		cache:   newAuthCache(time.Duration(ttl) * time.Second),
+	}
+	if p.Has(plugin.SVC_TOKEN) {
+		return &pluginTokenAuth{a}, nil
+	}
+	return a, nil
+}
+
+func (a *pluginAuth) attach(listen string, log *L.Logger) {
+	a.listen = listen
+	a.p.setLog(log)
+}
+
+func (a *pluginAuth) Authenticate(ctx context.Context, user, pass string) error {
+	if !a.p.Has(plugin.SVC_AUTH) {
+		return errAuthFailed
+	}
+	if a.cache.has(user, pass) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	r, err := a.p.Authenticate(ctx, &plugin.AuthArgs{
+		User:     user,
+		Password: pass,
+		Client:   ipString(clientOf(ctx)),
+		Listener: a.listen,
+	})
+	if err != nil {
+		return fmt.Errorf("plugin: %s", err)
+	}
+	if !r.OK {
+		return pluginRefused(r)
+	}
+	a.cache.add(user, pass)
+	return nil
+}
+
+func (a *pluginTokenAuth) AuthenticateToken(ctx context.Context, token string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	r, err := a.p.AuthenticateToken(ctx, &plugin.TokenArgs{
+		Token:    token,
+		Client:   ipString(clientOf(ctx)),
+		Listener: a.listen,
+	})
+	if err != nil {
+		return "", fmt.Errorf("plugin: %s", err)
+	}
+	if !r.OK || len(r.User) == 0 {
+		return "", pluginRefused(r)
+	}
+	return r.User, nil
+}
+
+func (a *pluginAuth) Close() error {
+	return a.p.Close()
+}
+
+// The error of credentials a plugin refused
+func pluginRefused(r *plugin.AuthReply) error {
+	if len(r.Reason) == 0 {
+		return errAuthFailed
+	}
+	return newError(ErrAuthFailed, "plugin: "+r.Reason)
+}
+
+// Asks a plugin for the routes of connections. If "failopen", a call
+// that fails leaves the listener's own route; the default is to refuse
+// the connection.
+type pluginRouter struct {
+	p        *pluginProc
+	timeout  time.Duration
+	failOpen bool
+	listen   string
+	log      *L.Logger
+}
+
+func newPluginRouter(args map[string]string) (Router, error) {
+	r := &pluginRouter{}
+
+	var err error
+	if r.timeout, err = pluginTimeout(args); err != nil {
+		return nil, err
+	}
+	switch args["failopen"] {
+	case "", "false", "no":
+	case "true", "yes":
+		r.failOpen = true
+	default:
+		return nil, fmt.Errorf("invalid failopen %q", args["failopen"])
+	}
+
+	if r.p, err = openPlugin(args); err != nil {
+		return nil, err
+	}
+	if !r.p.Has(plugin.SVC_ROUTE) {
+		r.p.Close()
+		return nil, fmt.Errorf("%s: no route service", args["cmd"])
+	}
+	return r, nil
+}
+
+func (r *pluginRouter) attach(listen string, log *L.Logger) {
+	r.listen = listen
+	r.log = log
+	r.p.setLog(log)
+}
+
+func (r *pluginRouter) Route(ctx context.Context, host string, port int) (Route, error) {
+	cctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	v, err := r.p.Route(cctx, &plugin.RouteArgs{
+		User:     userOf(ctx),
+		Client:   ipString(clientOf(ctx)),
+		Host:     host,
+		Port:     port,
+		Listener: r.listen,
+	})
+
+	var rt Route
+	if err == nil {
+		if v.Action == plugin.ROUTE_DENY {
+			rule := ROUTER_RULE
+			if len(v.Name) > 0 {
+				rule = v.Name
+			}
+			return rt, &policyErr{rule: rule, dest: net.JoinHostPort(host, strconv.Itoa(port))}
+		}
+		rt = Route{Via: v.Action, Name: v.Name}
+		err = rt.check()
+	}
+	if err != nil {
+		if !r.failOpen {
+			return Route{}, fmt.Errorf("plugin: %s", err)
+		}
+		if r.log != nil {
+			r.log.Warn("router: %s:%d: plugin: %s; using the listener's route", host, port, err)
+		}
+		return Route{}, nil
+	}
+	return rt, nil
+}
+
+func (r *pluginRouter) Close() error {
+	return r.p.Close()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
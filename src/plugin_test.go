@@ -0,0 +1,216 @@
+// plugin_test.go -- tests for the plugin authenticator and router
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/go-proxies/plugin"
+)
+
+// The test process is the plugin when GOPROXY_PLUGIN_TEST is set
+func TestPluginMain(t *testing.T) {
+	if len(os.Getenv("GOPROXY_PLUGIN_TEST")) == 0 {
+		return
+	}
+	if err := plugin.Serve(testPlugin{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+type testPlugin struct{}
+
+func (testPlugin) Authenticate(a *plugin.AuthArgs) (*plugin.AuthReply, error) {
+	switch {
+	case a.User == "down":
+		return nil, errors.New("directory down")
+	case a.User == "alice" && a.Password == "wonder":
+		return &plugin.AuthReply{OK: true}, nil
+	}
+	return &plugin.AuthReply{Reason: "unknown to " + a.Listener}, nil
+}
+
+func (testPlugin) AuthenticateToken(a *plugin.TokenArgs) (*plugin.AuthReply, error) {
+	if a.Token == "t1" {
+		return &plugin.AuthReply{OK: true, User: "bob"}, nil
+	}
+	return &plugin.AuthReply{}, nil
+}
+
+func (testPlugin) Route(a *plugin.RouteArgs) (*plugin.RouteReply, error) {
+	switch a.Host {
+	case "tunnel.example":
+		return &plugin.RouteReply{Action: plugin.ROUTE_WIREGUARD, Name: "wg0"}, nil
+	case "bad.example":
+		return &plugin.RouteReply{Action: "teleport"}, nil
+	case "down.example":
+		return nil, errors.New("no routes")
+	}
+	if os.Getenv("GOPROXY_PLUGIN_TEST") == strconv.Itoa(a.Port) {
+		return &plugin.RouteReply{Action: plugin.ROUTE_DENY, Name: "no-" + a.User}, nil
+	}
+	return nil, nil
+}
+
+func pluginArgs(deny string) map[string]string {
+	os.Setenv("GOPROXY_PLUGIN_TEST", deny)
+	return map[string]string{"cmd": os.Args[0], "args": "-test.run=^TestPluginMain$"}
+}
+
+func TestPluginAuth(t *testing.T) {
+	defer os.Unsetenv("GOPROXY_PLUGIN_TEST")
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ctx := context.Background()
+
+	args := pluginArgs("1")
+	args["cache"] = "0"
+	a, err := newPluginAuth(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.(attacher).attach("l1", log)
+
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Errorf("alice: %v", err)
+	}
+	if err := a.Authenticate(ctx, "alice", "nope"); !errors.Is(err, ErrAuthFailed) || err.Error() != "plugin: unknown to l1" {
+		t.Errorf("bad password: %v", err)
+	}
+	if err := a.Authenticate(ctx, "down", "x"); err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Errorf("down: %v", err)
+	}
+	tok, ok := a.(TokenAuthenticator)
+	if !ok {
+		t.Fatalf("no tokens: %T", a)
+	}
+	if u, err := tok.AuthenticateToken(ctx, "t1"); err != nil || u != "bob" {
+		t.Errorf("token: %q %v", u, err)
+	}
+	if _, err := tok.AuthenticateToken(ctx, "t2"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("bad token: %v", err)
+	}
+
+	// the router shares the process
+	rt, err := newPluginRouter(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.(attacher).attach("l1", log)
+	if p := rt.(*pluginRouter).p; p != a.(*pluginTokenAuth).p || p.refs != 2 {
+		t.Errorf("not shared: %d", p.refs)
+	}
+
+	uctx := withUser(ctx, "carol")
+	if r, err := rt.Route(uctx, "tunnel.example", 443); err != nil || r.Via != "wireguard" || r.Name != "wg0" {
+		t.Errorf("tunnel: %+v %v", r, err)
+	}
+	if r, err := rt.Route(uctx, "x.example", 443); err != nil || len(r.Via) > 0 {
+		t.Errorf("default: %+v %v", r, err)
+	}
+	if _, err := rt.Route(uctx, "x.example", 1); isDenied(err) == nil || isDenied(err).rule != "no-carol" {
+		t.Errorf("deny: %v", err)
+	}
+	for _, h := range []string{"bad.example", "down.example"} {
+		if _, err := rt.Route(uctx, h, 443); err == nil || isDenied(err) != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+	rt.(*pluginRouter).failOpen = true
+	if r, err := rt.Route(uctx, "down.example", 443); err != nil || len(r.Via) > 0 {
+		t.Errorf("failopen: %+v %v", r, err)
+	}
+
+	rt.(*pluginRouter).Close()
+	if r, err := rt.Route(uctx, "tunnel.example", 443); err != nil || r.Via != "wireguard" {
+		t.Errorf("after one close: %+v %v", r, err)
+	}
+	a.(*pluginTokenAuth).Close()
+	if len(pluginProcs.m) > 0 {
+		t.Errorf("plugin left: %v", pluginProcs.m)
+	}
+	if err := a.Authenticate(ctx, "alice", "wonder"); err == nil {
+		t.Errorf("closed: no error")
+	}
+
+	for _, bad := range []map[string]string{
+		{},
+		{"cmd": "/nonexistent/plugin"},
+		{"cmd": os.Args[0], "timeout": "soon"},
+		{"cmd": os.Args[0], "cache": "-1"},
+	} {
+		if _, err := newPluginAuth(bad); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+	if _, err := newPluginRouter(map[string]string{"cmd": os.Args[0], "failopen": "maybe"}); err == nil {
+		t.Errorf("failopen: no error")
+	}
+}
+
+func TestPluginProxy(t *testing.T) {
+	defer os.Unsetenv("GOPROXY_PLUGIN_TEST")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("denied origin: %s", r.URL)
+	}))
+	t.Cleanup(denied.Close)
+
+	_, dport, _ := net.SplitHostPort(denied.Listener.Addr().String())
+	args := pluginArgs(dport)
+	addr := startHTTPProxy(t, &ListenConf{
+		Auth:   AuthConf{Type: "plugin", Realm: "test", Args: args},
+		Router: RouterConf{Type: "plugin", Args: args},
+	})
+
+	get := func(u string, user *url.Userinfo) int {
+		pu := &url.URL{Scheme: "http", Host: addr, User: user}
+		hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+		res, err := hc.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	alice := url.UserPassword("alice", "wonder")
+	if s := get(origin.URL+"/", alice); s != 200 {
+		t.Errorf("alice: %d", s)
+	}
+	if s := get(origin.URL+"/", url.UserPassword("alice", "nope")); s != http.StatusProxyAuthRequired {
+		t.Errorf("bad password: %d", s)
+	}
+	if s := get(denied.URL+"/", alice); s != http.StatusForbidden {
+		t.Errorf("routed: %d", s)
+	}
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,608 @@
+// policy.go -- outbound destination policy and abuse guards
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"github.com/opencoff/golang-lru"
+)
+
+// Scan detection defaults: more than SCAN_MAX distinct destinations in
+// SCAN_WINDOW seconds bans the client for SCAN_BAN seconds.
+const (
+	SCAN_MAX    = 100
+	SCAN_WINDOW = 10
+	SCAN_BAN    = 300
+)
+
+// Destinations blocked by the built-in guards unless a rule allows them
+var guardNets = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // RFC 1918
+	"100.64.0.0/10",  // carrier grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local; includes cloud metadata services
+	"172.16.0.0/12",  // RFC 1918
+	"192.168.0.0/16", // RFC 1918
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved & broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// Ports blocked by the built-in guards unless a rule allows them
+var guardPorts = []int{
+	25, // SMTP; prevents the proxy from being an open mail relay
+}
+
+// A port range
+type portRange struct {
+	lo, hi int
+}
+
+// A single destination rule
+type rule struct {
+	name    string
+	nets    []*net.IPNet
+	domains []string
+	ports   []portRange
+	users   map[string]bool // nil matches all clients
+	protos  map[string]bool // protocols in the tunnel; nil matches all
+	allow   bool
+	logonly bool // a deny that is only logged
+
+	fastopen   bool
+	congestion string
+	chaos      *chaos        // nil if none
+	mirror     *mirror       // nil if none
+	fragment   *fragment     // nil if none
+	wireguard  string        // WireGuard tunnel; "" is none
+	jump       string        // jump host; "" is none
+	deadline   time.Duration // longest session; 0 is none
+}
+
+// Outbound policy for a listener: user rules followed by the
+// built-in guards.
+type policy struct {
+	mu    sync.RWMutex
+	rules []*rule
+	conf  []*rule // the rules of the config; pushed rules replace them
+
+	// limits of the authenticator's users; nil if none
+	users DestChecker
+
+	guard bool
+	nets  []*net.IPNet
+	ports map[int]bool
+
+	scan *scanGuard
+
+	// deny rules that only log what they would deny
+	listen  string
+	logonly bool // all of them
+	log     *L.Logger
+
+	wmu    sync.Mutex
+	would  map[string]uint64 // rule -> destinations it would have denied
+	last   string            // the last one logged, and when
+	lastAt time.Time
+}
+
+// Error returned when a destination is denied
+type policyErr struct {
+	rule string
+	dest string
+
+	// a limit, not a denial: the client may try again after this
+	retry time.Duration
+}
+
+func (e *policyErr) Error() string {
+	if e.retry > 0 {
+		return fmt.Sprintf("%s denied by rule '%s'; retry after %s", e.dest, e.rule,
+			e.retry.Round(time.Second))
+	}
+	return fmt.Sprintf("%s denied by rule '%s'", e.dest, e.rule)
+}
+
+func (e *policyErr) Unwrap() error {
+	if e.retry > 0 {
+		return ErrQuotaExceeded
+	}
+	return ErrDestDenied
+}
+
+// Return the policy error if 'err' is (or wraps) one
+func isDenied(err error) *policyErr {
+	switch e := err.(type) {
+	case *policyErr:
+		return e
+	case *net.OpError:
+		return isDenied(e.Err)
+	}
+	return nil
+}
+
+// Make a policy from the listener config
+func newPolicy(lc *ListenConf) (*policy, error) {
+	p := &policy{
+		guard:   !lc.Guard.Disable,
+		ports:   make(map[int]bool),
+		listen:  lc.Listen,
+		logonly: lc.LogOnly,
+		would:   make(map[string]uint64),
+	}
+
+	for i := range lc.Rules {
+		r, err := newRule(&lc.Rules[i], i)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, r)
+	}
+	p.conf = p.rules
+
+	if !p.guard {
+		return p, nil
+	}
+
+	for _, s := range guardNets {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		p.nets = append(p.nets, n)
+	}
+
+	for _, v := range guardPorts {
+		p.ports[v] = true
+	}
+
+	sc := &lc.Guard.Scan
+	if sc.Max >= 0 {
+		s, err := newScanGuard(sc)
+		if err != nil {
+			return nil, err
+		}
+		if len(lc.Tenant) > 0 {
+			s.skey += lc.Tenant + ":"
+		}
+		p.scan = s
+	}
+
+	return p, nil
+}
+
+func newRule(rc *RuleConf, i int) (*rule, error) {
+	r := &rule{name: rc.Name, fastopen: rc.Fastopen, congestion: rc.Congestion,
+		wireguard: rc.WireGuard, jump: rc.Jump, deadline: time.Duration(rc.Deadline) * time.Second,
+		logonly: rc.LogOnly}
+	if len(r.name) == 0 {
+		r.name = fmt.Sprintf("rule-%d", i+1)
+	}
+	if rc.Deadline < 0 {
+		return nil, fmt.Errorf("rule %s: negative deadline", r.name)
+	}
+
+	if len(r.congestion) > 0 {
+		if err := checkCongestion(r.congestion); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.name, err)
+		}
+	}
+	if len(r.wireguard) > 0 && len(r.jump) > 0 {
+		return nil, fmt.Errorf("rule %s: wireguard and jump can't both be used", r.name)
+	}
+
+	c, err := newChaos(&rc.Chaos, r.name)
+	if err != nil {
+		return nil, err
+	}
+	r.chaos = c
+
+	if r.mirror, err = newMirror(rc.Mirror, r.name); err != nil {
+		return nil, err
+	}
+	if r.fragment, err = newFragment(&rc.Fragment, r.name); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(rc.Action) {
+	case "allow":
+		r.allow = true
+		if r.logonly {
+			return nil, fmt.Errorf("rule %s: logonly is for deny rules", r.name)
+		}
+	case "deny":
+	default:
+		return nil, fmt.Errorf("rule %s: unknown action '%s'", r.name, rc.Action)
+	}
+
+	for _, s := range rc.Dest {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			r.nets = append(r.nets, n)
+		} else if ip := net.ParseIP(s); ip != nil {
+			m := net.CIDRMask(8*len(ip.To16()), 128)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, m = ip4, net.CIDRMask(32, 32)
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: m})
+		} else {
+			r.domains = append(r.domains, strings.Trim(strings.ToLower(s), "."))
+		}
+	}
+
+	for _, s := range rc.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.name, err)
+		}
+		r.ports = append(r.ports, pr)
+	}
+
+	if len(rc.Users) > 0 {
+		r.users = make(map[string]bool)
+		for _, u := range rc.Users {
+			r.users[u] = true
+		}
+	}
+
+	if len(rc.Proto) > 0 {
+		r.protos = make(map[string]bool)
+		for _, pr := range rc.Proto {
+			pr = strings.ToLower(pr)
+			if !sniffProtos[pr] {
+				return nil, fmt.Errorf("rule %s: unknown protocol '%s'", r.name, pr)
+			}
+			r.protos[pr] = true
+		}
+	}
+
+	return r, nil
+}
+
+// Parse "N" or "N-M"
+func parsePortRange(s string) (pr portRange, err error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+
+	if pr.lo, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return pr, fmt.Errorf("invalid port '%s'", s)
+	}
+	if pr.hi, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return pr, fmt.Errorf("invalid port '%s'", s)
+	}
+	if pr.lo < 0 || pr.hi > 65535 || pr.lo > pr.hi {
+		return pr, fmt.Errorf("invalid port range '%s'", s)
+	}
+	return pr, nil
+}
+
+// Return true if the rule matches. 'user' is the authenticated client
+// ("" if none), 'host' is the destination as named by the client and
+// 'ip' is the resolved address. A rule matches if its users (if any),
+// its destinations (if any) and its ports (if any) match. Rules with
+// protocols don't match until the protocol is known (see evalProto).
+func (r *rule) match(user, host string, ip net.IP, port int) bool {
+	return r.protos == nil && r.matches(user, host, ip, port)
+}
+
+func (r *rule) matches(user, host string, ip net.IP, port int) bool {
+	if r.users != nil && !r.users[user] {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if port >= pr.lo && port <= pr.hi {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.nets) == 0 && len(r.domains) == 0 {
+		return true
+	}
+
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	// "example.com." is the same name as "example.com"
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the policy isn't the same for all users
+func (p *policy) byUser() bool {
+	if p.users != nil {
+		return true
+	}
+	for _, r := range p.ruleSet() {
+		if r.users != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if a rule depends on the protocol in a tunnel
+func (p *policy) byProto() bool {
+	for _, r := range p.ruleSet() {
+		if r.protos != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if a rule splits ClientHellos
+func (p *policy) byFragment() bool {
+	for _, r := range p.ruleSet() {
+		if r.fragment != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a tunnel to 'ip:port' again once 'proto' is known to be in it:
+// the first rule that matches, with its protocols, decides. The guards
+// passed when it was dialed.
+func (p *policy) evalProto(user, host string, ip net.IP, port int, proto string) error {
+	for _, r := range p.ruleSet() {
+		if r.protos != nil && !r.protos[proto] {
+			continue
+		}
+		if r.matches(user, host, ip, port) {
+			if r.allow {
+				return nil
+			}
+			if p.logOnly(r, user, host, ip, port) {
+				continue
+			}
+			if ip == nil {
+				return &policyErr{rule: r.name, dest: net.JoinHostPort(host, strconv.Itoa(port))}
+			}
+			return p.deny(r.name, ip, port)
+		}
+	}
+	return nil
+}
+
+// Check the connection to 'ip:port' made on behalf of a request by
+// 'user' for 'host'. This is called after name resolution - so rules and
+// guards see the address that is actually connected to.
+func (p *policy) check(user, host string, ip net.IP, port int) error {
+	_, err := p.eval(user, host, ip, port)
+	return err
+}
+
+// Like check() - but also return the allow rule that matched (if any)
+func (p *policy) eval(user, host string, ip net.IP, port int) (*rule, error) {
+	if p.users != nil && len(user) > 0 {
+		if err := p.users.CheckDest(user, host, ip, port); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range p.ruleSet() {
+		if r.match(user, host, ip, port) {
+			if r.allow {
+				return r, nil
+			}
+			if p.logOnly(r, user, host, ip, port) {
+				continue
+			}
+			return nil, p.deny(r.name, ip, port)
+		}
+	}
+
+	if !p.guard {
+		return nil, nil
+	}
+
+	if p.ports[port] {
+		return nil, p.deny("guard-port", ip, port)
+	}
+
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return nil, p.deny("guard-private", ip, port)
+		}
+	}
+	return nil, nil
+}
+
+// Return the rules in force
+func (p *policy) ruleSet() []*rule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules
+}
+
+// Replace the rules; nil goes back to those of the config
+func (p *policy) setRules(v []*rule) {
+	p.mu.Lock()
+	if v == nil {
+		v = p.conf
+	}
+	p.rules = v
+	p.mu.Unlock()
+}
+
+// Replace the rules of the config; those in force too unless 'pushed'
+func (p *policy) setConf(v []*rule, pushed bool) {
+	p.mu.Lock()
+	p.conf = v
+	if !pushed {
+		p.rules = v
+	}
+	p.mu.Unlock()
+}
+
+func (p *policy) deny(name string, ip net.IP, port int) error {
+	return &policyErr{rule: name, dest: net.JoinHostPort(ip.String(), strconv.Itoa(port))}
+}
+
+// If the deny rule 'r' only logs, log and count what it would deny and
+// return true: the rules after it decide. A dial checks its destination
+// more than once (before and after resolving it); the same denial in a
+// row is logged once a second.
+func (p *policy) logOnly(r *rule, user, host string, ip net.IP, port int) bool {
+	if !r.logonly && !p.logonly {
+		return false
+	}
+
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	if ip != nil && ip.String() != host {
+		dest += " at " + ip.String()
+	}
+	key := r.name + "\x00" + user + "\x00" + host + "\x00" + strconv.Itoa(port)
+	now := time.Now()
+
+	p.wmu.Lock()
+	dup := key == p.last && now.Sub(p.lastAt) < time.Second
+	p.last, p.lastAt = key, now
+	if !dup {
+		p.would[r.name]++
+	}
+	p.wmu.Unlock()
+
+	if !dup && p.log != nil {
+		if len(user) == 0 {
+			user = "-"
+		}
+		p.log.Info("logonly: %s for %s would be denied by rule '%s'", dest, user, r.name)
+	}
+	return true
+}
+
+func (p *policy) metrics() []metric {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	var m []metric
+	for name, n := range p.would {
+		m = append(m, metric{"goproxy_rule_logonly_total", "counter",
+			"Destinations deny rules that only log would have denied",
+			fmt.Sprintf("listener=%q,rule=%q", p.listen, name), float64(n)})
+	}
+	return m
+}
+
+// Per-client scan detection: track the distinct destinations each
+// client connects to in a fixed window.
+type scanGuard struct {
+	max    int
+	window time.Duration
+	ban    time.Duration
+	skey   string // prefix of the bans in the shared state
+
+	cl *lru.TwoQueueCache
+}
+
+// Scan state of a client
+type scanState struct {
+	sync.Mutex
+	t0     time.Time
+	seen   map[string]bool
+	banned time.Time
+}
+
+func newScanGuard(sc *ScanConf) (*scanGuard, error) {
+	s := &scanGuard{
+		max:    sc.Max,
+		window: time.Duration(sc.Window) * time.Second,
+		ban:    time.Duration(sc.Ban) * time.Second,
+		skey:   "ban:scan:",
+	}
+
+	if s.max == 0 {
+		s.max = SCAN_MAX
+	}
+	if s.window <= 0 {
+		s.window = SCAN_WINDOW * time.Second
+	}
+	if s.ban <= 0 {
+		s.ban = SCAN_BAN * time.Second
+	}
+
+	cl, err := lru.New2Q(30000)
+	if err != nil {
+		return nil, err
+	}
+	s.cl = cl
+	return s, nil
+}
+
+// Record a connection from 'client' to 'dest'. Return an error if the
+// client is (or just became) banned.
+func (s *scanGuard) check(client net.IP, dest string) error {
+	key := s.skey + client.String()
+	if shared != nil {
+		if ok, _ := shared.banned(key); ok {
+			return &policyErr{rule: "guard-scan", dest: dest, retry: s.ban}
+		}
+	}
+
+	v, _ := s.cl.Probe(client.String(), func(_ interface{}) interface{} {
+		return &scanState{seen: make(map[string]bool)}
+	})
+
+	st := v.(*scanState)
+	now := time.Now()
+
+	st.Lock()
+	defer st.Unlock()
+
+	if now.Before(st.banned) {
+		return &policyErr{rule: "guard-scan", dest: dest, retry: st.banned.Sub(now)}
+	}
+
+	if now.Sub(st.t0) > s.window {
+		st.t0 = now
+		st.seen = make(map[string]bool)
+	}
+
+	st.seen[dest] = true
+	if len(st.seen) > s.max {
+		st.banned = now.Add(s.ban)
+		st.seen = make(map[string]bool)
+		if shared != nil {
+			shared.ban(key, s.ban)
+		}
+		return &policyErr{rule: "guard-scan", dest: dest, retry: s.ban}
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
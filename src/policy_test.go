@@ -0,0 +1,431 @@
+// policy_test.go -- tests for destination rules and abuse guards
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		lo, hi int
+		ok     bool
+	}{
+		{"80", 80, 80, true},
+		{"0", 0, 0, true},
+		{"65535", 65535, 65535, true},
+		{"8000-8080", 8000, 8080, true},
+		{" 8000 - 8080 ", 8000, 8080, true},
+		{"443-443", 443, 443, true},
+
+		{"", 0, 0, false},
+		{"http", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"8080-8000", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"1-", 0, 0, false},
+		{"1-2-3", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		pr, err := parsePortRange(tt.s)
+		if tt.ok != (err == nil) {
+			t.Errorf("%q: err = %v, want ok %v", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && (pr.lo != tt.lo || pr.hi != tt.hi) {
+			t.Errorf("%q: got %d-%d, want %d-%d", tt.s, pr.lo, pr.hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+func mustRule(t *testing.T, rc RuleConf) *rule {
+	r, err := newRule(&rc, 0)
+	if err != nil {
+		t.Fatalf("rule %v: %s", rc, err)
+	}
+	return r
+}
+
+func TestRuleMatch(t *testing.T) {
+	rules := map[string]*rule{
+		"any":    mustRule(t, RuleConf{Action: "allow"}),
+		"domain": mustRule(t, RuleConf{Action: "deny", Dest: []string{"Example.COM."}}),
+		"cidr":   mustRule(t, RuleConf{Action: "deny", Dest: []string{"203.0.113.0/24", "2001:db8::/32"}}),
+		"ip":     mustRule(t, RuleConf{Action: "deny", Dest: []string{"198.51.100.7", "::ffff:192.0.2.1", "2001:db8::1"}}),
+		"ports":  mustRule(t, RuleConf{Action: "allow", Ports: []string{"443", "8000-8080"}}),
+		"both":   mustRule(t, RuleConf{Action: "allow", Dest: []string{"example.net"}, Ports: []string{"22"}}),
+	}
+
+	v4 := net.ParseIP("203.0.113.9")
+	other := net.ParseIP("192.0.2.200")
+
+	tests := []struct {
+		rule string
+		host string
+		ip   net.IP
+		port int
+		want bool
+	}{
+		{"any", "anything", other, 1, true},
+
+		{"domain", "example.com", other, 80, true},
+		{"domain", "EXAMPLE.com", other, 80, true},
+		{"domain", "www.example.com", other, 80, true},
+		{"domain", "a.b.example.com", other, 80, true},
+		{"domain", "example.com.", other, 80, true},
+		{"domain", "www.example.com.", other, 80, true},
+		{"domain", "badexample.com", other, 80, false},
+		{"domain", "example.com.evil.net", other, 80, false},
+		{"domain", "com", other, 80, false},
+		{"domain", "192.0.2.200", other, 80, false},
+
+		{"cidr", "x", v4, 80, true},
+		{"cidr", "x", net.ParseIP("::ffff:203.0.113.9"), 80, true},
+		{"cidr", "x", net.ParseIP("203.0.114.1"), 80, false},
+		{"cidr", "x", net.ParseIP("2001:db8:1::5"), 80, true},
+		{"cidr", "x", net.ParseIP("2001:db9::5"), 80, false},
+
+		{"ip", "x", net.ParseIP("198.51.100.7"), 80, true},
+		{"ip", "x", net.ParseIP("::ffff:198.51.100.7"), 80, true},
+		{"ip", "x", net.ParseIP("198.51.100.8"), 80, false},
+		{"ip", "x", net.ParseIP("192.0.2.1"), 80, true},
+		{"ip", "x", net.ParseIP("2001:db8::1"), 80, true},
+		{"ip", "x", net.ParseIP("2001:db8::2"), 80, false},
+
+		{"ports", "x", other, 443, true},
+		{"ports", "x", other, 8000, true},
+		{"ports", "x", other, 8080, true},
+		{"ports", "x", other, 8081, false},
+		{"ports", "x", other, 80, false},
+
+		{"both", "ssh.example.net", other, 22, true},
+		{"both", "ssh.example.net", other, 2222, false},
+		{"both", "ssh.example.org", other, 22, false},
+	}
+
+	for _, tt := range tests {
+		if got := rules[tt.rule].match("", tt.host, tt.ip, tt.port); got != tt.want {
+			t.Errorf("%s: match(%q, %s, %d) = %v, want %v", tt.rule, tt.host, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestRuleUsers(t *testing.T) {
+	lc := &ListenConf{
+		Rules: []RuleConf{
+			{Name: "ops", Action: "allow", Dest: []string{"10.0.0.0/8"}, Users: []string{"ops", "backup"}},
+			{Name: "no-ssh", Action: "deny", Ports: []string{"22"}, Users: []string{"guest"}},
+		},
+	}
+	p, err := newPolicy(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user string
+		ip   string
+		port int
+		deny string
+	}{
+		{"ops", "10.1.2.3", 80, ""},
+		{"backup", "10.1.2.3", 22, ""},
+		{"alice", "10.1.2.3", 80, "guard-private"},
+		{"", "10.1.2.3", 80, "guard-private"},
+		{"guest", "192.0.2.1", 22, "no-ssh"},
+		{"alice", "192.0.2.1", 22, ""},
+	}
+	for _, tt := range tests {
+		err := p.check(tt.user, "x", net.ParseIP(tt.ip), tt.port)
+		pe := isDenied(err)
+		switch {
+		case len(tt.deny) == 0 && err != nil:
+			t.Errorf("%q %s:%d: denied: %s", tt.user, tt.ip, tt.port, err)
+		case len(tt.deny) > 0 && (pe == nil || pe.rule != tt.deny):
+			t.Errorf("%q %s:%d: %v, want denied by %s", tt.user, tt.ip, tt.port, err, tt.deny)
+		}
+	}
+}
+
+func TestRuleLogOnly(t *testing.T) {
+	lc := &ListenConf{
+		Rules: []RuleConf{
+			{Name: "new-block", Action: "deny", Dest: []string{"ads.example"}, LogOnly: true},
+			{Name: "no-ssh", Action: "deny", Ports: []string{"22"}},
+		},
+	}
+	lc.Guard.Scan.Max = -1
+	p, err := newPolicy(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+
+	// the rules after it decide; the same dial checked before and after
+	// the name is resolved is logged once
+	p.check("alice", "ads.example", nil, 443)
+	if err := p.check("alice", "ads.example", ip, 443); err != nil {
+		t.Errorf("443: %s", err)
+	}
+	if pe := isDenied(p.check("alice", "ads.example", ip, 22)); pe == nil || pe.rule != "no-ssh" {
+		t.Errorf("22: %v", pe)
+	}
+	if err := p.evalProto("alice", "cdn.ads.example", ip, 443, "tls"); err != nil {
+		t.Errorf("proto: %s", err)
+	}
+
+	if n := p.would["new-block"]; n != 3 {
+		t.Errorf("%d logged", n)
+	}
+
+	// the listener's logonly makes all deny rules only log; guards
+	// still deny
+	lc.LogOnly = true
+	p, _ = newPolicy(lc)
+	if err := p.check("", "x", ip, 22); err != nil {
+		t.Errorf("listener logonly: %s", err)
+	}
+	if pe := isDenied(p.check("", "x", net.ParseIP("10.0.0.1"), 80)); pe == nil || pe.rule != "guard-private" {
+		t.Errorf("guard: %v", pe)
+	}
+
+	if _, err := newRule(&RuleConf{Action: "allow", LogOnly: true}, 0); err == nil {
+		t.Errorf("logonly allow: no error")
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	bad := []RuleConf{
+		{Action: "permit"},
+		{Action: "allow", Ports: []string{"http"}},
+		{Action: "allow", Ports: []string{"10-1"}},
+	}
+	for _, rc := range bad {
+		if _, err := newRule(&rc, 0); err == nil {
+			t.Errorf("rule %v: no error", rc)
+		}
+	}
+
+	r := mustRule(t, RuleConf{Action: "DENY"})
+	if r.allow || r.name != "rule-1" {
+		t.Errorf("rule: allow %v name %q", r.allow, r.name)
+	}
+}
+
+func TestPolicyGuard(t *testing.T) {
+	lc := &ListenConf{
+		Rules: []RuleConf{
+			{Name: "lan-mail", Action: "allow", Dest: []string{"10.1.1.25"}, Ports: []string{"25"}},
+			{Name: "lan-web", Action: "allow", Dest: []string{"10.1.1.0/24"}, Ports: []string{"80"}},
+			{Name: "no-evil", Action: "deny", Dest: []string{"evil.example"}},
+		},
+	}
+	lc.Guard.Scan.Max = -1
+
+	p, err := newPolicy(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		ip   string
+		port int
+		deny string // rule that denies; "" if allowed
+	}{
+		{"public", "93.184.216.34", 443, ""},
+		{"public", "2606:2800:220:1:248:1893:25c8:1946", 443, ""},
+		{"www.evil.example", "93.184.216.34", 443, "no-evil"},
+
+		{"mail", "93.184.216.34", 25, "guard-port"},
+		{"lan", "10.1.1.25", 25, ""},
+		{"lan", "10.1.1.9", 80, ""},
+		{"lan", "10.1.1.9", 22, "guard-private"},
+
+		{"x", "0.1.2.3", 80, "guard-private"},
+		{"x", "10.200.0.1", 80, "guard-private"},
+		{"x", "100.64.0.1", 80, "guard-private"},
+		{"x", "100.128.0.1", 80, ""},
+		{"x", "127.0.0.1", 80, "guard-private"},
+		{"x", "169.254.169.254", 80, "guard-private"},
+		{"x", "172.16.0.1", 80, "guard-private"},
+		{"x", "172.31.255.255", 80, "guard-private"},
+		{"x", "172.32.0.1", 80, ""},
+		{"x", "192.168.1.1", 80, "guard-private"},
+		{"x", "224.0.0.1", 80, "guard-private"},
+		{"x", "255.255.255.255", 80, "guard-private"},
+		{"x", "::", 80, "guard-private"},
+		{"x", "::1", 80, "guard-private"},
+		{"x", "fd00::1", 80, "guard-private"},
+		{"x", "fe80::1", 80, "guard-private"},
+		{"x", "ff02::1", 80, "guard-private"},
+
+		// v4-mapped IPv6 must not get around the v4 guards
+		{"x", "::ffff:127.0.0.1", 80, "guard-private"},
+		{"x", "::ffff:169.254.169.254", 80, "guard-private"},
+		{"x", "::ffff:10.1.1.9", 80, ""},
+		{"x", "::ffff:93.184.216.34", 80, ""},
+	}
+
+	for _, tt := range tests {
+		err := p.check("", tt.host, net.ParseIP(tt.ip), tt.port)
+		pe := isDenied(err)
+		switch {
+		case len(tt.deny) == 0 && err != nil:
+			t.Errorf("%s %s:%d: denied: %s", tt.host, tt.ip, tt.port, err)
+		case len(tt.deny) > 0 && pe == nil:
+			t.Errorf("%s %s:%d: allowed, want denied by %s", tt.host, tt.ip, tt.port, tt.deny)
+		case pe != nil && pe.rule != tt.deny:
+			t.Errorf("%s %s:%d: denied by %s, want %s", tt.host, tt.ip, tt.port, pe.rule, tt.deny)
+		}
+	}
+
+	// Without the guards only the rules apply
+	lc.Guard.Disable = true
+	if p, err = newPolicy(lc); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check("", "x", net.ParseIP("127.0.0.1"), 25); err != nil {
+		t.Errorf("guards disabled: %s", err)
+	}
+	if p.scan != nil {
+		t.Errorf("guards disabled: scan guard enabled")
+	}
+}
+
+func TestIsDenied(t *testing.T) {
+	pe := &policyErr{rule: "r", dest: "d"}
+	if isDenied(pe) != pe {
+		t.Errorf("policyErr not found")
+	}
+	if isDenied(&net.OpError{Op: "dial", Err: pe}) != pe {
+		t.Errorf("wrapped policyErr not found")
+	}
+	if isDenied(fmt.Errorf("other")) != nil {
+		t.Errorf("other error is a policyErr")
+	}
+}
+
+func TestScanGuard(t *testing.T) {
+	s, err := newScanGuard(&ScanConf{Max: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.window != SCAN_WINDOW*time.Second || s.ban != SCAN_BAN*time.Second {
+		t.Errorf("defaults: window %s ban %s", s.window, s.ban)
+	}
+	s.window = 200 * time.Millisecond
+	s.ban = 300 * time.Millisecond
+
+	a := net.ParseIP("192.0.2.1")
+	b := net.ParseIP("192.0.2.2")
+
+	ok := func(cl net.IP, dest string) {
+		t.Helper()
+		if err := s.check(cl, dest); err != nil {
+			t.Errorf("%s -> %s: %s", cl, dest, err)
+		}
+	}
+	banned := func(cl net.IP, dest string) {
+		t.Helper()
+		if pe := isDenied(s.check(cl, dest)); pe == nil || pe.rule != "guard-scan" {
+			t.Errorf("%s -> %s: not banned", cl, dest)
+		}
+	}
+
+	// repeat destinations don't count
+	for i := 0; i < 10; i++ {
+		ok(a, "h1:80")
+	}
+	ok(a, "h2:80")
+	ok(a, "h3:80")
+
+	// other clients are tracked separately
+	ok(b, "h4:80")
+
+	// the 4th distinct destination bans 'a'; the v4-mapped form is the
+	// same client
+	banned(a, "h4:80")
+	banned(a, "h1:80")
+	banned(net.ParseIP("::ffff:192.0.2.1"), "h1:80")
+	ok(b, "h5:80")
+
+	// the ban expires and the count starts over
+	time.Sleep(s.ban + 50*time.Millisecond)
+	ok(a, "h1:80")
+	ok(a, "h2:80")
+	ok(a, "h3:80")
+
+	// a new window starts over too
+	time.Sleep(s.window + 50*time.Millisecond)
+	ok(a, "h4:80")
+	ok(a, "h5:80")
+	ok(a, "h6:80")
+	banned(a, "h7:80")
+}
+
+func TestLookupLimit(t *testing.T) {
+	ln := startEcho(t)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	lc := &ListenConf{
+		Ratelimit: RateLimit{Lookups: 1, LookupBurst: 2},
+		Rules:     []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8", "localhost"}, Action: "allow"}},
+	}
+	d, err := newDialer(lc, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	dial := func(ctx context.Context, host string) error {
+		c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	// a burst of two names, then denied; addresses aren't lookups
+	cl := withClient(context.Background(), net.ParseIP("192.0.2.1"))
+	for i := 0; i < 2; i++ {
+		if err := dial(cl, "localhost"); err != nil {
+			t.Fatalf("lookup %d: %s", i, err)
+		}
+	}
+	if err := dial(cl, "localhost"); !errors.Is(err, ErrQuotaExceeded) || retryAfter(err) != time.Second {
+		t.Errorf("third lookup: %v", err)
+	}
+	if err := dial(cl, "127.0.0.1"); err != nil {
+		t.Errorf("address: %s", err)
+	}
+
+	// other clients and users have their own budgets
+	u := withUser(cl, "alice")
+	if err := dial(u, "localhost"); err != nil {
+		t.Errorf("user: %s", err)
+	}
+	if err := dial(withClient(context.Background(), net.ParseIP("192.0.2.2")), "localhost"); err != nil {
+		t.Errorf("other client: %s", err)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,62 @@
+// pool.go -- pooled I/O buffers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"sync"
+)
+
+// Default size of relay buffers
+const IO_BUFSIZE = 16384
+
+// A pool of fixed size buffers. Buffers are handed out as pointers so
+// that Put() doesn't allocate.
+type bufPool struct {
+	sync.Pool
+	size int
+}
+
+// One pool per buffer size; listeners with the same size share it
+var pools = struct {
+	sync.Mutex
+	m map[int]*bufPool
+}{m: make(map[int]*bufPool)}
+
+// Return the pool for buffers of 'size' bytes (default if <= 0)
+func getPool(size int) *bufPool {
+	if size <= 0 {
+		size = IO_BUFSIZE
+	}
+
+	pools.Lock()
+	defer pools.Unlock()
+
+	p, ok := pools.m[size]
+	if !ok {
+		p = &bufPool{size: size}
+		p.New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+		pools.m[size] = p
+	}
+	return p
+}
+
+// Get a buffer from the pool
+func (p *bufPool) Get() *[]byte {
+	return p.Pool.Get().(*[]byte)
+}
+
+// Return a buffer to the pool
+func (p *bufPool) Put(b *[]byte) {
+	p.Pool.Put(b)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,193 @@
+// pool_test.go -- relay buffer benchmarks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Concurrent tunnels in BenchmarkTunnelChurn
+const benchTunnels = 50000
+
+// Tunnels in BenchmarkCopyBuf and BenchmarkRelay; each takes 4
+// descriptors.
+const benchCopiers = 1000
+
+// Bytes relayed per tunnel wakeup; a typical MTU sized segment
+const benchChunk = 1460
+
+// Return both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	ch := make(chan *net.TCPConn, 1)
+	go func() {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			ch <- nil
+			return
+		}
+		ch <- c
+	}()
+
+	a, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b := <-ch
+	if b == nil {
+		tb.Fatal("accept failed")
+	}
+	return a, b
+}
+
+// A pool private to one tunnel: it holds that tunnel's buffer for the
+// life of the tunnel - the same as allocating one per connection.
+func ownPool(size int) *bufPool {
+	p := &bufPool{size: size}
+	p.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Report the live heap and the GC work done since 'ms0'
+func reportGC(b *testing.B, ms0 *runtime.MemStats) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	b.ReportMetric(float64(ms.HeapInuse)/(1<<20), "heap-MB")
+	b.ReportMetric(float64(ms.NumGC-ms0.NumGC)/float64(b.N), "gc/op")
+	b.ReportMetric(float64(ms.PauseTotalNs-ms0.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+}
+
+// Relay chunks through benchCopiers live copyBuf tunnels, round robin.
+// "pool" is how tunnels run; "alloc" gives each tunnel its own buffer.
+func BenchmarkCopyBuf(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		pool := getPool(IO_BUFSIZE)
+		benchRelay(b, (*CancellableCopier).copyBuf, func() *bufPool { return pool })
+	})
+	b.Run("alloc", func(b *testing.B) {
+		benchRelay(b, (*CancellableCopier).copyBuf, func() *bufPool { return ownPool(IO_BUFSIZE) })
+	})
+}
+
+// Relay chunks through benchCopiers tunnels that use 'relay'
+func benchRelay(b *testing.B, relay relayFunc, newPool func() *bufPool) {
+	type tunnel struct {
+		in, out io.ReadWriteCloser // our ends
+	}
+
+	v := make([]tunnel, benchCopiers)
+	done := make(chan bool, benchCopiers)
+	for i := range v {
+		in, s := tcpPair(b)
+		d, out := tcpPair(b)
+
+		c := &CancellableCopier{WriteTimeout: 15}
+		atomic.StoreInt64(&c.idle, int64(time.Minute))
+		c.touch()
+
+		pool := newPool()
+		go func() {
+			relay(c, d, s, pool)
+			s.Close()
+			d.Close()
+			done <- true
+		}()
+		v[i] = tunnel{in, out}
+	}
+
+	buf := make([]byte, benchChunk)
+	rd := make([]byte, benchChunk)
+
+	runtime.GC()
+	var ms0 runtime.MemStats
+	runtime.ReadMemStats(&ms0)
+
+	b.SetBytes(benchChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := &v[i%len(v)]
+		if _, err := t.in.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(t.out, rd); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	reportGC(b, &ms0)
+
+	for i := range v {
+		v[i].in.Close()
+	}
+	for i := range v {
+		<-done
+		v[i].out.Close()
+	}
+}
+
+// A model of benchTunnels concurrent tunnels, most of them idle: each
+// op closes the oldest tunnel, opens a new one in its place and relays a
+// chunk on it. With the pool, a buffer is held only during the relay
+// (as copyBuf does); "alloc" gives every tunnel a buffer for its life.
+func BenchmarkTunnelChurn(b *testing.B) {
+	src := make([]byte, benchChunk)
+
+	b.Run("pool", func(b *testing.B) {
+		pool := getPool(IO_BUFSIZE)
+		benchChurn(b, func() []byte { return nil }, func(_ []byte) {
+			p := pool.Get()
+			copy(*p, src)
+			pool.Put(p)
+		})
+	})
+	b.Run("alloc", func(b *testing.B) {
+		benchChurn(b, func() []byte { return make([]byte, IO_BUFSIZE) }, func(buf []byte) {
+			copy(buf, src)
+		})
+	})
+}
+
+func benchChurn(b *testing.B, open func() []byte, relay func([]byte)) {
+	v := make([][]byte, benchTunnels)
+	for i := range v {
+		v[i] = open()
+	}
+
+	runtime.GC()
+	var ms0 runtime.MemStats
+	runtime.ReadMemStats(&ms0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(v)
+		v[j] = open()
+		relay(v[j])
+	}
+	b.StopTimer()
+	reportGC(b, &ms0)
+	runtime.KeepAlive(v)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -7,61 +7,113 @@
 // suitability for any purpose.
 
 // +build !windows
+
 package main
 
 import (
+	"fmt"
 	u "os/user"
 	"strconv"
 	"syscall"
 )
 
-
-// DropPrivilege changes the uid/gid. It dies if it cannot.
-func DropPrivilege(uids, gids string) {
+// DropPrivilege changes the root directory to 'root' (if set) and the
+// uid/gid. Without a group, the user's own group is used; the
+// supplementary groups are the user's. It dies if it cannot.
+func DropPrivilege(uids, gids, root string) {
 
 	if me := syscall.Getuid(); me != 0 {
+		if len(root) > 0 {
+			die("Not running as 'root'; can't chroot to %s", root)
+		}
 		warn("Not running as 'root'; can't change uid/gid")
 		return
 	}
 
-	if len(gids) > 0 {
-		gi, err := u.LookupGroup(gids)
-		if err != nil {
-			gi, err = u.LookupGroupId(gids)
-			if err != nil {
-				die("can't find group '%s' to drop privilege: %s", gids, err)
-			}
-		}
+	if len(uids) == 0 && len(gids) == 0 && len(root) == 0 {
+		return
+	}
 
-		gid, err := strconv.Atoi(gi.Gid)
-		if err != nil {
-			die("can't parse integer gid %s: %s", gi.Gid, err)
+	// Users and groups are looked up before /etc goes away
+	uid, gid, groups, err := lookupIds(uids, gids)
+	if err != nil {
+		die("can't drop privilege: %s", err)
+	}
+
+	if len(root) > 0 {
+		if err = syscall.Chroot(root); err != nil {
+			die("can't chroot to %s: %s", root, err)
+		}
+		if err = syscall.Chdir("/"); err != nil {
+			die("can't chdir to / in %s: %s", root, err)
 		}
+	}
 
+	if gid >= 0 {
+		if err = syscall.Setgroups(groups); err != nil {
+			die("can't set the groups to %v: %s", groups, err)
+		}
 		if err = syscall.Setgid(gid); err != nil {
 			die("can't change Gid to %d: %s", gid, err)
 		}
 	}
 
+	if uid >= 0 {
+		if err = syscall.Setuid(uid); err != nil {
+			die("can't change Uid to %d: %s", uid, err)
+		}
+
+		// Make sure there's no way back
+		if uid != 0 && syscall.Setuid(0) == nil {
+			die("could regain root after changing Uid to %d", uid)
+		}
+	}
+}
+
+// Find the uid, gid and supplementary groups of the user 'uids' and the
+// group 'gids' (names or numbers); -1 if not given.
+func lookupIds(uids, gids string) (uid, gid int, groups []int, err error) {
+	uid, gid = -1, -1
 
 	if len(uids) > 0 {
 		ui, err := u.Lookup(uids)
 		if err != nil {
 			ui, err = u.LookupId(uids)
 			if err != nil {
-				die("can't find user '%s' to drop privilege: %s", uids, err)
+				return -1, -1, nil, fmt.Errorf("can't find user '%s': %s", uids, err)
 			}
 		}
-		uid, err := strconv.Atoi(ui.Uid)
-		if err != nil {
-			die("can't parse integer uid %s: %s", ui.Uid, err)
+		if uid, err = strconv.Atoi(ui.Uid); err != nil {
+			return -1, -1, nil, fmt.Errorf("can't parse integer uid %s: %s", ui.Uid, err)
+		}
+		if gid, err = strconv.Atoi(ui.Gid); err != nil {
+			return -1, -1, nil, fmt.Errorf("can't parse integer gid %s: %s", ui.Gid, err)
 		}
 
-
-		if err = syscall.Setuid(uid); err != nil {
-			die("can't change Uid to %d: %s", uid, err)
+		// a user in no supplementary groups is fine
+		v, _ := ui.GroupIds()
+		for _, s := range v {
+			if g, err := strconv.Atoi(s); err == nil {
+				groups = append(groups, g)
+			}
 		}
 	}
-}
 
+	if len(gids) > 0 {
+		gi, err := u.LookupGroup(gids)
+		if err != nil {
+			gi, err = u.LookupGroupId(gids)
+			if err != nil {
+				return -1, -1, nil, fmt.Errorf("can't find group '%s': %s", gids, err)
+			}
+		}
+		if gid, err = strconv.Atoi(gi.Gid); err != nil {
+			return -1, -1, nil, fmt.Errorf("can't parse integer gid %s: %s", gi.Gid, err)
+		}
+	}
 
+	if gid >= 0 && len(groups) == 0 {
+		groups = []int{gid}
+	}
+	return uid, gid, groups, nil
+}
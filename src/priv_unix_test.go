@@ -0,0 +1,43 @@
+// priv_unix_test.go -- tests for privilege dropping
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"testing"
+)
+
+func TestLookupIds(t *testing.T) {
+	uid, gid, groups, err := lookupIds("", "")
+	if err != nil || uid != -1 || gid != -1 || groups != nil {
+		t.Errorf("nothing: %d %d %v %v", uid, gid, groups, err)
+	}
+
+	// by name and number; the user's group is the default
+	for _, s := range []string{"root", "0"} {
+		uid, gid, groups, err = lookupIds(s, "")
+		if err != nil || uid != 0 || gid != 0 || len(groups) == 0 {
+			t.Errorf("%s: %d %d %v %v", s, uid, gid, groups, err)
+		}
+	}
+
+	uid, gid, groups, err = lookupIds("", "0")
+	if err != nil || uid != -1 || gid != 0 || len(groups) != 1 || groups[0] != 0 {
+		t.Errorf("group only: %d %d %v %v", uid, gid, groups, err)
+	}
+
+	for _, v := range [][2]string{{"no-such-user-x", ""}, {"", "no-such-group-x"}} {
+		if _, _, _, err := lookupIds(v[0], v[1]); err == nil {
+			t.Errorf("%v: no error", v)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
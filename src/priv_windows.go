@@ -7,8 +7,12 @@
 // suitability for any purpose.
 
 // +build windows
+
 package main
 
-func DropPrivilege(uids, guids string) {
+func DropPrivilege(uids, guids, root string) {
+	if len(root) > 0 {
+		die("can't chroot to %s on this platform", root)
+	}
 	warn("can't change uid/gid on this platform")
 }
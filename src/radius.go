@@ -0,0 +1,568 @@
+// radius.go -- RADIUS authentication and accounting
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RADIUS_AUTH_PORT = "1812"
+	RADIUS_ACCT_PORT = "1813"
+
+	// Seconds to wait for a reply, and how often to ask again
+	RADIUS_TIMEOUT = 3
+	RADIUS_RETRIES = 2
+
+	// Seconds a verified user and password are remembered
+	RADIUS_CACHE_TTL = 60
+
+	// Accounting records waiting to be sent; more are dropped
+	RADIUS_QUEUE = 4096
+)
+
+// RADIUS packet codes (RFC 2865, 2866)
+const (
+	radAccessRequest   = 1
+	radAccessAccept    = 2
+	radAccessReject    = 3
+	radAcctRequest     = 4
+	radAcctResponse    = 5
+	radAccessChallenge = 11
+)
+
+// RADIUS attributes
+const (
+	radUserName         = 1
+	radUserPassword     = 2
+	radServiceType      = 6
+	radCalledStation    = 30
+	radCallingStation   = 31
+	radNASIdentifier    = 32
+	radAcctStatusType   = 40
+	radAcctInputOctets  = 42
+	radAcctOutputOctets = 43
+	radAcctSessionID    = 44
+	radAcctSessionTime  = 46
+	radAcctInputGiga    = 52
+	radAcctOutputGiga   = 53
+	radEventTimestamp   = 55
+	radMsgAuthenticator = 80
+)
+
+// Acct-Status-Type values
+const (
+	radAcctStart   = 1
+	radAcctStop    = 2
+	radAcctInterim = 3
+)
+
+var errRadiusTimeout = errors.New("radius: no reply from server")
+
+func init() {
+	RegisterAuth("radius", newRadiusAuth)
+}
+
+// Checks users with a RADIUS server (Access-Request with PAP) and, if
+// an accounting server is set, reports their sessions to it:
+// Accounting-Start when a tunnel opens, Interim-Update every "interim"
+// seconds and Accounting-Stop with the byte counts when it closes. An
+// HTTP request is a session that starts and stops when it is done.
+// Accounting records are sent in the background; if the server falls
+// behind, records past RADIUS_QUEUE are dropped (and counted).
+type radiusAuth struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	sent    uint64
+	dropped uint64
+	failed  uint64
+
+	server  string
+	acct    string
+	secret  []byte
+	nasID   string
+	timeout time.Duration
+	retries int
+	interim time.Duration
+	cache   *authCache
+
+	id uint32 // packet identifiers
+
+	sync.Mutex
+	running map[*Session]chan struct{} // sessions with interim updates
+
+	q    chan *radRecord
+	quit chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// An accounting record waiting to be sent
+type radRecord struct {
+	status int
+	s      *Session
+	in     int64
+	out    int64
+	now    time.Time
+}
+
+func newRadiusAuth(args map[string]string) (Authenticator, error) {
+	a := &radiusAuth{
+		secret:  []byte(args["secret"]),
+		nasID:   args["nasid"],
+		timeout: RADIUS_TIMEOUT * time.Second,
+		retries: RADIUS_RETRIES,
+		cache:   newAuthCache(RADIUS_CACHE_TTL * time.Second),
+		running: make(map[*Session]chan struct{}),
+	}
+
+	var err error
+	if a.server, err = radiusAddr(args["server"], RADIUS_AUTH_PORT); err != nil {
+		return nil, fmt.Errorf("server: %s", err)
+	}
+	if len(args["accounting"]) > 0 {
+		if a.acct, err = radiusAddr(args["accounting"], RADIUS_ACCT_PORT); err != nil {
+			return nil, fmt.Errorf("accounting: %s", err)
+		}
+	}
+	if len(a.secret) == 0 {
+		return nil, fmt.Errorf("missing 'secret'")
+	}
+	if len(a.nasID) == 0 {
+		a.nasID, _ = os.Hostname()
+	}
+
+	for _, k := range []string{"timeout", "retries", "interim", "cache"} {
+		s := args[k]
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s %q: not a number", k, s)
+		}
+		switch k {
+		case "timeout":
+			if n > 0 {
+				a.timeout = time.Duration(n) * time.Second
+			}
+		case "retries":
+			a.retries = n
+		case "interim":
+			a.interim = time.Duration(n) * time.Second
+		case "cache":
+			a.cache.ttl = time.Duration(n) * time.Second
+		}
+	}
+
+	if len(a.acct) > 0 {
+		a.q = make(chan *radRecord, RADIUS_QUEUE)
+		a.quit = make(chan struct{})
+		a.wg.Add(1)
+		go a.sender()
+	}
+	return a, nil
+}
+
+// Return 's' as host:port, with 'port' if it has none
+func radiusAddr(s, port string) (string, error) {
+	if len(s) == 0 {
+		return "", fmt.Errorf("missing address")
+	}
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s, nil
+	}
+	return net.JoinHostPort(s, port), nil
+}
+
+func (a *radiusAuth) Authenticate(ctx context.Context, user, pass string) error {
+	if len(user) == 0 || len(pass) == 0 || len(pass) > 128 {
+		return errAuthFailed
+	}
+
+	if a.cache.has(user, pass) {
+		return nil
+	}
+
+	p := a.newPacket(radAccessRequest)
+	p.addString(radUserName, user)
+	p.add(radUserPassword, a.hidePassword(pass, p.auth[:]))
+	p.addInt(radServiceType, 8) // Authenticate-Only
+	p.addString(radNASIdentifier, a.nasID)
+	if ip := clientOf(ctx); ip != nil {
+		p.addString(radCallingStation, ip.String())
+	}
+
+	rep, err := a.exchange(ctx, a.server, p)
+	if err != nil {
+		return err
+	}
+
+	switch rep.code {
+	case radAccessAccept:
+	case radAccessReject, radAccessChallenge:
+		// We can't relay challenges to proxy clients
+		return errAuthFailed
+	default:
+		return fmt.Errorf("radius: unexpected reply code %d", rep.code)
+	}
+
+	a.cache.add(user, pass)
+	return nil
+}
+
+// Accounting-Start for 's', and interim updates if configured
+func (a *radiusAuth) Start(s *Session) {
+	if a.q == nil {
+		return
+	}
+	a.queue(radAcctStart, s)
+
+	if a.interim > 0 && s.moved != nil {
+		stop := make(chan struct{})
+		a.Lock()
+		select {
+		case <-a.quit:
+			a.Unlock()
+			return
+		default:
+		}
+		a.running[s] = stop
+		a.wg.Add(1)
+		a.Unlock()
+
+		go func() {
+			defer a.wg.Done()
+			t := time.NewTicker(a.interim)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					a.queue(radAcctInterim, s)
+				case <-stop:
+					return
+				case <-a.quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Accounting-Stop for 's'
+func (a *radiusAuth) Stop(s *Session) {
+	if a.q == nil {
+		return
+	}
+
+	a.Lock()
+	if stop, ok := a.running[s]; ok {
+		close(stop)
+		delete(a.running, s)
+	}
+	a.Unlock()
+	a.queue(radAcctStop, s)
+}
+
+func (a *radiusAuth) queue(status int, s *Session) {
+	in, out := s.Bytes()
+	r := &radRecord{status: status, s: s, in: in, out: out, now: time.Now()}
+
+	select {
+	case <-a.quit:
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	default:
+	}
+
+	select {
+	case a.q <- r:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Send queued accounting records until closed; what is queued then is
+// still sent.
+func (a *radiusAuth) sender() {
+	defer a.wg.Done()
+	for {
+		select {
+		case r := <-a.q:
+			a.send(r)
+		case <-a.quit:
+			for {
+				select {
+				case r := <-a.q:
+					a.send(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *radiusAuth) send(r *radRecord) {
+	s := r.s
+	p := a.newPacket(radAcctRequest)
+	p.addInt(radAcctStatusType, uint32(r.status))
+	p.addString(radAcctSessionID, s.ID)
+	p.addString(radUserName, s.User)
+	p.addString(radNASIdentifier, a.nasID)
+	if s.Client != nil {
+		p.addString(radCallingStation, s.Client.String())
+	}
+	p.addString(radCalledStation, s.Dest)
+	p.addInt(radEventTimestamp, uint32(r.now.Unix()))
+	if r.status != radAcctStart {
+		p.addInt(radAcctInputOctets, uint32(r.in))
+		p.addInt(radAcctInputGiga, uint32(r.in>>32))
+		p.addInt(radAcctOutputOctets, uint32(r.out))
+		p.addInt(radAcctOutputGiga, uint32(r.out>>32))
+		p.addInt(radAcctSessionTime, uint32(r.now.Sub(s.Start)/time.Second))
+	}
+
+	rep, err := a.exchange(context.Background(), a.acct, p)
+	if err != nil || rep.code != radAcctResponse {
+		atomic.AddUint64(&a.failed, 1)
+		return
+	}
+	atomic.AddUint64(&a.sent, 1)
+}
+
+// Stop interim updates and send what is queued
+func (a *radiusAuth) Close() error {
+	if a.q != nil {
+		a.Lock()
+		a.once.Do(func() { close(a.quit) })
+		a.Unlock()
+		a.wg.Wait()
+	}
+	return nil
+}
+
+// RADIUS metrics for the admin listener
+func (a *radiusAuth) metrics() []metric {
+	l := fmt.Sprintf("server=%q", a.acct)
+	if a.q == nil {
+		return nil
+	}
+	return []metric{
+		{"goproxy_radius_acct_sent_total", "counter", "RADIUS accounting records sent", l,
+			float64(atomic.LoadUint64(&a.sent))},
+		{"goproxy_radius_acct_failed_total", "counter", "RADIUS accounting records not acknowledged", l,
+			float64(atomic.LoadUint64(&a.failed))},
+		{"goproxy_radius_acct_dropped_total", "counter", "RADIUS accounting records dropped", l,
+			float64(atomic.LoadUint64(&a.dropped))},
+	}
+}
+
+// A RADIUS packet
+type radPacket struct {
+	code  byte
+	id    byte
+	auth  [16]byte
+	attrs []byte
+}
+
+func (a *radiusAuth) newPacket(code byte) *radPacket {
+	p := &radPacket{code: code, id: byte(atomic.AddUint32(&a.id, 1))}
+	if code == radAccessRequest {
+		rand.Read(p.auth[:])
+	}
+	return p
+}
+
+func (p *radPacket) add(typ byte, v []byte) {
+	for len(v) > 0 {
+		n := len(v)
+		if n > 253 {
+			n = 253
+		}
+		p.attrs = append(p.attrs, typ, byte(n+2))
+		p.attrs = append(p.attrs, v[:n]...)
+		v = v[n:]
+	}
+}
+
+func (p *radPacket) addString(typ byte, s string) {
+	if len(s) > 0 {
+		p.add(typ, []byte(s))
+	}
+}
+
+func (p *radPacket) addInt(typ byte, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	p.add(typ, b[:])
+}
+
+// Return the offset of the value of attribute 'typ' in 'attrs' and its
+// length; -1 if it isn't there.
+func radAttr(attrs []byte, typ byte) (int, int) {
+	for i := 0; i+2 <= len(attrs); {
+		n := int(attrs[i+1])
+		if n < 2 || i+n > len(attrs) {
+			return -1, 0
+		}
+		if attrs[i] == typ {
+			return i + 2, n - 2
+		}
+		i += n
+	}
+	return -1, 0
+}
+
+// Encode 'p' for the wire. Access-Requests carry a Message-Authenticator
+// (RFC 3579); accounting requests get their authenticator (RFC 2866).
+func (p *radPacket) encode(secret []byte) []byte {
+	var mpos int
+	if p.code == radAccessRequest {
+		mpos = 20 + len(p.attrs) + 2
+		p.attrs = append(p.attrs, radMsgAuthenticator, 18)
+		p.attrs = append(p.attrs, make([]byte, 16)...)
+	}
+
+	b := make([]byte, 20+len(p.attrs))
+	b[0], b[1] = p.code, p.id
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	copy(b[20:], p.attrs)
+
+	if p.code == radAccessRequest {
+		copy(b[4:20], p.auth[:])
+		m := hmac.New(md5.New, secret)
+		m.Write(b)
+		copy(b[mpos:], m.Sum(nil))
+		return b
+	}
+
+	h := md5.New()
+	h.Write(b)
+	h.Write(secret)
+	copy(b[4:20], h.Sum(nil))
+	copy(p.auth[:], b[4:20])
+	return b
+}
+
+// Hide a password as in RFC 2865, 5.2
+func (a *radiusAuth) hidePassword(pass string, ra []byte) []byte {
+	b := []byte(pass)
+	if n := len(b) % 16; n > 0 || len(b) == 0 {
+		b = append(b, make([]byte, 16-n)...)
+	}
+
+	prev := ra
+	for i := 0; i < len(b); i += 16 {
+		h := md5.New()
+		h.Write(a.secret)
+		h.Write(prev)
+		x := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			b[i+j] ^= x[j]
+		}
+		prev = b[i : i+16]
+	}
+	return b
+}
+
+// Send 'p' to 'server' and return the verified reply; ask again on
+// timeouts.
+func (a *radiusAuth) exchange(ctx context.Context, server string, p *radPacket) (*radPacket, error) {
+	nd := &net.Dialer{Timeout: a.timeout}
+	c, err := nd.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("radius: %s", err)
+	}
+	defer c.Close()
+
+	req := p.encode(a.secret)
+	buf := make([]byte, 4096)
+	for i := 0; i <= a.retries; i++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, fmt.Errorf("radius: %s", err)
+		}
+
+		deadline := time.Now().Add(a.timeout)
+		for {
+			c.SetReadDeadline(deadline)
+			n, err := c.Read(buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, fmt.Errorf("radius: %s", err)
+			}
+			if rep := a.verify(buf[:n], p); rep != nil {
+				return rep, nil
+			}
+			// Stray or forged reply; wait for the real one
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errRadiusTimeout
+}
+
+// Return the reply in 'b' if it answers 'req' and is signed with our
+// secret
+func (a *radiusAuth) verify(b []byte, req *radPacket) *radPacket {
+	if len(b) < 20 || b[1] != req.id {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if n < 20 || n > len(b) {
+		return nil
+	}
+	b = b[:n]
+
+	// Response Authenticator: MD5(code+id+length+request auth+attrs+secret)
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(req.auth[:])
+	h.Write(b[20:])
+	h.Write(a.secret)
+	if !hmac.Equal(h.Sum(nil), b[4:20]) {
+		return nil
+	}
+
+	rep := &radPacket{code: b[0], id: b[1], attrs: b[20:]}
+	copy(rep.auth[:], b[4:20])
+
+	// A Message-Authenticator, if the server sends one, must check out
+	if i, m := radAttr(rep.attrs, radMsgAuthenticator); i >= 0 {
+		if m != 16 {
+			return nil
+		}
+		x := make([]byte, n)
+		copy(x, b)
+		copy(x[4:20], req.auth[:])
+		copy(x[20+i:20+i+16], make([]byte, 16))
+		mac := hmac.New(md5.New, a.secret)
+		mac.Write(x)
+		if !hmac.Equal(mac.Sum(nil), b[20+i:20+i+16]) {
+			return nil
+		}
+	}
+	return rep
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,335 @@
+// radius_test.go -- tests for RADIUS authentication and accounting
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const testSecret = "s3cret"
+
+// An accounting record as the server got it
+type acctRec struct {
+	status  uint32
+	user    string
+	id      string
+	in, out uint32
+}
+
+// A RADIUS server that knows a few users and keeps accounting records
+type fakeRadius struct {
+	users map[string]string
+
+	mu    sync.Mutex
+	recs  []acctRec
+	auths int
+	drop  int // requests ignored before answering
+}
+
+func (f *fakeRadius) records() []acctRec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]acctRec(nil), f.recs...)
+}
+
+func startFakeRadius(t *testing.T, f *fakeRadius) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if rep := f.answer(t, b[:n]); rep != nil {
+				c.WriteTo(rep, addr)
+			}
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func attr(attrs []byte, typ byte) []byte {
+	i, n := radAttr(attrs, typ)
+	if i < 0 {
+		return nil
+	}
+	return attrs[i : i+n]
+}
+
+func (f *fakeRadius) answer(t *testing.T, b []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.drop > 0 {
+		f.drop--
+		return nil
+	}
+
+	attrs := b[20:]
+	var ra [16]byte
+	copy(ra[:], b[4:20])
+	code := byte(radAcctResponse)
+
+	switch b[0] {
+	case radAccessRequest:
+		f.auths++
+
+		// Check the Message-Authenticator
+		i, _ := radAttr(attrs, radMsgAuthenticator)
+		x := append([]byte(nil), b...)
+		copy(x[20+i:20+i+16], make([]byte, 16))
+		m := hmac.New(md5.New, []byte(testSecret))
+		m.Write(x)
+		if i < 0 || !hmac.Equal(m.Sum(nil), attrs[i:i+16]) {
+			t.Errorf("bad Message-Authenticator")
+			return nil
+		}
+
+		// Unhide the password
+		hidden := attr(attrs, radUserPassword)
+		pass := make([]byte, len(hidden))
+		prev := ra[:]
+		for i := 0; i < len(hidden); i += 16 {
+			h := md5.New()
+			h.Write([]byte(testSecret))
+			h.Write(prev)
+			x := h.Sum(nil)
+			for j := 0; j < 16; j++ {
+				pass[i+j] = hidden[i+j] ^ x[j]
+			}
+			prev = hidden[i : i+16]
+		}
+
+		user := string(attr(attrs, radUserName))
+		code = radAccessReject
+		if pw, ok := f.users[user]; ok && pw == string(bytes.TrimRight(pass, "\x00")) {
+			code = radAccessAccept
+		}
+
+	case radAcctRequest:
+		// Check the request authenticator
+		x := append([]byte(nil), b...)
+		copy(x[4:20], make([]byte, 16))
+		h := md5.New()
+		h.Write(x)
+		h.Write([]byte(testSecret))
+		if !hmac.Equal(h.Sum(nil), ra[:]) {
+			t.Errorf("bad accounting request authenticator")
+			return nil
+		}
+
+		u32 := func(typ byte) uint32 {
+			if v := attr(attrs, typ); len(v) == 4 {
+				return binary.BigEndian.Uint32(v)
+			}
+			return 0
+		}
+		f.recs = append(f.recs, acctRec{
+			status: u32(radAcctStatusType),
+			user:   string(attr(attrs, radUserName)),
+			id:     string(attr(attrs, radAcctSessionID)),
+			in:     u32(radAcctInputOctets),
+			out:    u32(radAcctOutputOctets),
+		})
+
+	default:
+		return nil
+	}
+
+	rep := make([]byte, 20)
+	rep[0], rep[1] = code, b[1]
+	binary.BigEndian.PutUint16(rep[2:], 20)
+	h := md5.New()
+	h.Write(rep[:4])
+	h.Write(ra[:])
+	h.Write([]byte(testSecret))
+	copy(rep[4:20], h.Sum(nil))
+	return rep
+}
+
+func newTestRadius(t *testing.T, args map[string]string) *radiusAuth {
+	a, err := newRadiusAuth(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.(*radiusAuth).Close() })
+	return a.(*radiusAuth)
+}
+
+func TestRadiusAuth(t *testing.T) {
+	f := &fakeRadius{users: map[string]string{"alice": "wonder", "long": strings.Repeat("x", 40)}}
+	srv := startFakeRadius(t, f)
+	a := newTestRadius(t, map[string]string{"server": srv, "secret": testSecret, "timeout": "1"})
+
+	ctx := context.Background()
+	for _, x := range [][2]string{{"alice", "wonder"}, {"alice", "wonder"}, {"long", strings.Repeat("x", 40)}} {
+		if err := a.Authenticate(ctx, x[0], x[1]); err != nil {
+			t.Errorf("%s: %s", x[0], err)
+		}
+	}
+	f.mu.Lock()
+	n := f.auths
+	f.mu.Unlock()
+	if n != 2 {
+		t.Errorf("%d requests; want 2 (cached)", n)
+	}
+
+	for _, x := range [][2]string{{"alice", "nope"}, {"bob", "wonder"}, {"alice", ""}} {
+		if err := a.Authenticate(ctx, x[0], x[1]); err != errAuthFailed {
+			t.Errorf("%q %q: %v", x[0], x[1], err)
+		}
+	}
+
+	// Lost requests are sent again
+	f.mu.Lock()
+	f.drop = 1
+	f.mu.Unlock()
+	a.cache.ttl = 0
+	if err := a.Authenticate(ctx, "alice", "wonder"); err != nil {
+		t.Errorf("after a lost request: %s", err)
+	}
+
+	// A server with another secret is not believed
+	b := newTestRadius(t, map[string]string{"server": srv, "secret": "other", "timeout": "1", "retries": "0"})
+	if err := b.Authenticate(ctx, "alice", "wonder"); err != errRadiusTimeout {
+		t.Errorf("wrong secret: %v", err)
+	}
+}
+
+func TestRadiusConf(t *testing.T) {
+	bad := []map[string]string{
+		{"secret": "x"},
+		{"server": "127.0.0.1"},
+		{"server": "127.0.0.1", "secret": "x", "interim": "soon"},
+	}
+	for _, args := range bad {
+		if _, err := newRadiusAuth(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	a := newTestRadius(t, map[string]string{"server": "10.0.0.1", "accounting": "10.0.0.1", "secret": "x"})
+	if a.server != "10.0.0.1:1812" || a.acct != "10.0.0.1:1813" {
+		t.Errorf("addresses %s %s", a.server, a.acct)
+	}
+}
+
+// Wait until the server has 'n' records
+func waitRecords(t *testing.T, f *fakeRadius, n int) []acctRec {
+	for i := 0; i < 200; i++ {
+		if v := f.records(); len(v) >= n {
+			return v
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v := f.records()
+	t.Fatalf("%d accounting records, want %d: %v", len(v), n, v)
+	return nil
+}
+
+func radiusConf(srv string, interim string) AuthConf {
+	return AuthConf{Type: "radius", Args: map[string]string{
+		"server":     srv,
+		"accounting": srv,
+		"secret":     testSecret,
+		"interim":    interim,
+	}}
+}
+
+func TestRadiusAccountingSOCKS(t *testing.T) {
+	f := &fakeRadius{users: map[string]string{"alice": "wonder"}}
+	srv := startFakeRadius(t, f)
+
+	// An origin that reads 5 bytes and answers with 11
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 5)
+		io.ReadFull(c, b)
+		time.Sleep(1500 * time.Millisecond)
+		c.Write([]byte("hello world"))
+		c.Close()
+	}()
+
+	addr := startSocksProxy(t, &ListenConf{Auth: radiusConf(srv, "1")})
+	d, _ := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "wonder"}, proxy.Direct)
+	c, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("howdy"))
+	io.Copy(io.Discard, c)
+	c.Close()
+
+	v := waitRecords(t, f, 3)
+	start, stop := v[0], v[len(v)-1]
+	if start.status != radAcctStart || start.user != "alice" || len(start.id) == 0 {
+		t.Errorf("start %+v", start)
+	}
+	if v[1].status != radAcctInterim || v[1].in != 5 || v[1].id != start.id {
+		t.Errorf("interim %+v", v[1])
+	}
+	if stop.status != radAcctStop || stop.in != 5 || stop.out != 11 || stop.id != start.id {
+		t.Errorf("stop %+v", stop)
+	}
+}
+
+func TestRadiusAccountingHTTP(t *testing.T) {
+	f := &fakeRadius{users: map[string]string{"alice": "wonder"}}
+	srv := startFakeRadius(t, f)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "0123456789")
+	}))
+	t.Cleanup(origin.Close)
+
+	addr := startHTTPProxy(t, &ListenConf{Auth: radiusConf(srv, "0")})
+	pu := &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("alice", "wonder")}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	res, err := c.Post(origin.URL+"/", "text/plain", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	v := waitRecords(t, f, 2)
+	if v[0].status != radAcctStart || v[1].status != radAcctStop || v[1].in != 3 || v[1].out != 10 ||
+		v[1].user != "alice" {
+		t.Errorf("records %+v", v)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,319 @@
+// redis.go -- quotas, rate limits and bans shared by a fleet via Redis
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+const (
+	// Default milliseconds a command may take
+	SHARED_TIMEOUT = 250
+
+	// Idle connections kept to the server
+	SHARED_CONNS = 8
+
+	SHARED_PREFIX = "goproxy:"
+)
+
+// The shared state of the fleet; nil if there is none. Everything that
+// uses it falls back to the local state of the node when the server
+// can't be reached.
+var shared *redisStore
+
+// An error reply of the server
+type redisErr string
+
+func (e redisErr) Error() string { return "redis: " + string(e) }
+
+// A Redis server holding the counters and bans of the fleet
+type redisStore struct {
+	ops    uint64
+	errors uint64
+
+	addr    string
+	pass    string
+	db      int
+	prefix  string
+	timeout time.Duration
+	log     *L.Logger
+
+	down int32 // the last command failed
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// Make the shared store of 'c'; nil if there is none
+func newRedisStore(c *SharedConf, log *L.Logger) (*redisStore, error) {
+	if len(c.Redis) == 0 {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("shared: %s", err)
+	}
+	if u.Scheme != "redis" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("shared: %s: want redis://[:password@]host[:port][/db]", c.Redis)
+	}
+
+	r := &redisStore{
+		addr:    u.Host,
+		prefix:  c.Prefix,
+		timeout: time.Duration(c.Timeout) * time.Millisecond,
+		log:     log,
+		idle:    make(chan *redisConn, SHARED_CONNS),
+	}
+	if _, _, err := net.SplitHostPort(r.addr); err != nil {
+		r.addr = net.JoinHostPort(r.addr, "6379")
+	}
+	if u.User != nil {
+		r.pass, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); len(p) > 0 {
+		if r.db, err = strconv.Atoi(p); err != nil || r.db < 0 {
+			return nil, fmt.Errorf("shared: %s: bad database '%s'", c.Redis, p)
+		}
+	}
+	if len(r.prefix) == 0 {
+		r.prefix = SHARED_PREFIX
+	}
+	if r.timeout <= 0 {
+		r.timeout = SHARED_TIMEOUT * time.Millisecond
+	}
+	return r, nil
+}
+
+// Run a command; the reply is a string, int64, []byte (nil for a nil
+// bulk string) or []interface{}.
+func (r *redisStore) do(args ...string) (interface{}, error) {
+	atomic.AddUint64(&r.ops, 1)
+	v, err := r.exchange(args)
+	if err != nil {
+		atomic.AddUint64(&r.errors, 1)
+		var re redisErr
+		if errors.As(err, &re) {
+			return nil, err
+		}
+		if atomic.SwapInt32(&r.down, 1) == 0 {
+			r.log.Warn("shared: %s: %s; using local state", r.addr, err)
+		}
+		return nil, err
+	}
+	if atomic.SwapInt32(&r.down, 0) == 1 {
+		r.log.Info("shared: %s is back", r.addr)
+	}
+	return v, nil
+}
+
+func (r *redisStore) exchange(args []string) (interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(r.timeout))
+	v, err := c.do(args)
+	var re redisErr
+	if err != nil && !errors.As(err, &re) {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case r.idle <- c:
+	default:
+		c.Close()
+	}
+	return v, err
+}
+
+// Return an idle connection or a new one
+func (r *redisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+	c.SetDeadline(time.Now().Add(r.timeout))
+	if len(r.pass) > 0 {
+		if _, err := c.do([]string{"AUTH", r.pass}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.db > 0 {
+		if _, err := c.do([]string{"SELECT", strconv.Itoa(r.db)}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Add 'n' to the counter 'key' and return its new value; a new counter
+// lives for 'ttl' (forever if 0).
+func (r *redisStore) incr(key string, n int64, ttl time.Duration) (int64, error) {
+	v, err := r.do("INCRBY", r.prefix+key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	x, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: INCRBY: unexpected reply %v", v)
+	}
+	if x == n && ttl > 0 {
+		r.do("PEXPIRE", r.prefix+key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return x, nil
+}
+
+// Make 'key' live for 'd' from now
+func (r *redisStore) expire(key string, d time.Duration) error {
+	_, err := r.do("PEXPIRE", r.prefix+key, strconv.FormatInt(d.Milliseconds(), 10))
+	return err
+}
+
+// Return the counter 'key'; 0 if there is none
+func (r *redisStore) get(key string) (int64, error) {
+	v, err := r.do("GET", r.prefix+key)
+	if err != nil {
+		return 0, err
+	}
+	b, _ := v.([]byte)
+	if b == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// Ban 'key' for 'd'
+func (r *redisStore) ban(key string, d time.Duration) error {
+	_, err := r.do("SET", r.prefix+key, "1", "PX", strconv.FormatInt(d.Milliseconds(), 10))
+	return err
+}
+
+// Remove 'key'
+func (r *redisStore) del(key string) error {
+	_, err := r.do("DEL", r.prefix+key)
+	return err
+}
+
+// Return true if 'key' is banned
+func (r *redisStore) banned(key string) (bool, error) {
+	v, err := r.do("EXISTS", r.prefix+key)
+	if err != nil {
+		return false, err
+	}
+	return v == int64(1), nil
+}
+
+// Return true if the 'n'th event of 'key' in this second (of the fleet)
+// is over 'max'
+func (r *redisStore) overRate(key string, max uint) (bool, error) {
+	sec := time.Now().Unix()
+	n, err := r.incr(fmt.Sprintf("rate:%s:%d", key, sec), 1, 2*time.Second)
+	if err != nil {
+		return false, err
+	}
+	return n > int64(max), nil
+}
+
+func (r *redisStore) metrics() []metric {
+	l := fmt.Sprintf("server=%q", r.addr)
+	up := float64(1 - atomic.LoadInt32(&r.down))
+	return []metric{
+		{"goproxy_shared_ops_total", "counter", "Commands sent to the shared store",
+			l, float64(atomic.LoadUint64(&r.ops))},
+		{"goproxy_shared_errors_total", "counter", "Commands to the shared store that failed",
+			l, float64(atomic.LoadUint64(&r.errors))},
+		{"goproxy_shared_up", "gauge", "1 if the last command to the shared store worked",
+			l, up},
+	}
+}
+
+// Send a command and read its reply
+func (c *redisConn) do(args []string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.rd)
+}
+
+// Read a reply in the Redis serialization protocol
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	s, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(s) < 3 || s[len(s)-2] != '\r' {
+		return nil, fmt.Errorf("redis: bad reply %q", s)
+	}
+	s = s[:len(s)-2]
+
+	switch s[0] {
+	case '+':
+		return s[1:], nil
+	case '-':
+		return nil, redisErr(s[1:])
+	case ':':
+		return strconv.ParseInt(s[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 0 {
+			return []byte(nil), err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 0 {
+			return []interface{}(nil), err
+		}
+		v := make([]interface{}, n)
+		for i := range v {
+			if v[i], err = readRESP(rd); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", s)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
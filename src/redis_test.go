@@ -0,0 +1,323 @@
+// redis_test.go -- tests for the state shared by a fleet
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// An in-memory server that speaks enough of the Redis protocol for the
+// shared store
+type fakeRedis struct {
+	sync.Mutex
+	pass string
+	v    map[string]int64
+	exp  map[string]time.Time
+	l    map[string][]string
+}
+
+func startRedis(t *testing.T, pass string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeRedis{pass: pass, v: make(map[string]int64), exp: make(map[string]time.Time),
+		l: make(map[string][]string)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	authed := len(f.pass) == 0
+	for {
+		v, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]interface{}) {
+			args = append(args, string(a.([]byte)))
+		}
+		if !authed && args[0] != "AUTH" {
+			io.WriteString(c, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		if args[0] == "AUTH" {
+			authed = args[1] == f.pass
+		}
+		io.WriteString(c, f.command(args))
+	}
+}
+
+func (f *fakeRedis) command(args []string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	for k, t := range f.exp {
+		if time.Now().After(t) {
+			delete(f.v, k)
+			delete(f.exp, k)
+		}
+	}
+
+	switch args[0] {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "INCRBY":
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		f.v[args[1]] += n
+		return fmt.Sprintf(":%d\r\n", f.v[args[1]])
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		f.exp[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SET":
+		ms, _ := strconv.Atoi(args[4])
+		f.v[args[1]], _ = strconv.ParseInt(args[2], 10, 64)
+		f.exp[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "GET":
+		n, ok := f.v[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		s := strconv.FormatInt(n, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	case "RPUSH":
+		f.l[args[1]] = append(f.l[args[1]], args[2:]...)
+		return fmt.Sprintf(":%d\r\n", len(f.l[args[1]]))
+	case "LLEN":
+		return fmt.Sprintf(":%d\r\n", len(f.l[args[1]]))
+	case "EXISTS", "DEL":
+		_, ok := f.v[args[1]]
+		if args[0] == "DEL" {
+			delete(f.v, args[1])
+		}
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// Use the fake server as the shared state of the test
+func useShared(t *testing.T, url string) *redisStore {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	r, err := newRedisStore(&SharedConf{Redis: url}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared = r
+	t.Cleanup(func() { shared = nil })
+	return r
+}
+
+func TestRedisStore(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	for _, s := range []string{"http://a:1", "redis:///0", "redis://a:1/x", "redis://a:1/-2"} {
+		if _, err := newRedisStore(&SharedConf{Redis: s}, log); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+	r, err := newRedisStore(&SharedConf{Redis: "redis://:pw@cache/3"}, log)
+	if err != nil || r.addr != "cache:6379" || r.pass != "pw" || r.db != 3 || r.prefix != SHARED_PREFIX {
+		t.Errorf("url: %+v %v", r, err)
+	}
+
+	addr := startRedis(t, "sekrit")
+	r = useShared(t, "redis://:nope@"+addr+"/1")
+	if _, err := r.incr("x", 1, 0); err == nil {
+		t.Errorf("bad password: no error")
+	}
+
+	r = useShared(t, "redis://:sekrit@"+addr+"/1")
+	if n, err := r.incr("x", 5, 0); err != nil || n != 5 {
+		t.Fatalf("incr: %d %v", n, err)
+	}
+	r.incr("x", 2, 0)
+	if n, err := r.get("x"); err != nil || n != 7 {
+		t.Errorf("get: %d %v", n, err)
+	}
+	if n, err := r.get("none"); err != nil || n != 0 {
+		t.Errorf("get missing: %d %v", n, err)
+	}
+	if _, err := r.do("FLUSHALL"); err == nil || r.down != 0 {
+		t.Errorf("error reply: %v, down %d", err, r.down)
+	}
+
+	r.ban("b", 50*time.Millisecond)
+	if ok, err := r.banned("b"); !ok || err != nil {
+		t.Errorf("banned: %v %v", ok, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := r.banned("b"); ok {
+		t.Errorf("ban didn't expire")
+	}
+
+	// A server that went away
+	r = useShared(t, "redis://127.0.0.1:1")
+	if _, err := r.get("x"); err == nil || r.down != 1 {
+		t.Errorf("no server: %v, down %d", err, r.down)
+	}
+}
+
+func TestSharedLimits(t *testing.T) {
+	useShared(t, "redis://"+startRedis(t, ""))
+
+	// Two nodes' listeners limit a source together
+	a, _ := newSrcLimiter(&RateLimit{PerHost: 1, Burst: 3}, "http:x")
+	b, _ := newSrcLimiter(&RateLimit{PerHost: 1, Burst: 3}, "http:x")
+	ip := net.ParseIP("192.0.2.1")
+	for time.Now().Nanosecond() > 500e6 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	n := 0
+	for i := 0; i < 3; i++ {
+		for _, l := range []*srcLimiter{a, b} {
+			if !l.Limit(ip) {
+				n++
+			}
+		}
+	}
+	if n != 3 {
+		t.Errorf("fleet let %d conns in, want 3", n)
+	}
+
+	// A scanner banned by one node is banned by the others
+	g1, _ := newScanGuard(&ScanConf{Max: 2})
+	g2, _ := newScanGuard(&ScanConf{Max: 2})
+	for port := 1; port <= 3; port++ {
+		g1.check(ip, fmt.Sprintf("192.0.2.9:%d", port))
+	}
+	if err := g2.check(ip, "192.0.2.9:80"); isDenied(err) == nil {
+		t.Errorf("scan ban not shared: %v", err)
+	}
+	if err := g2.check(net.ParseIP("192.0.2.2"), "192.0.2.9:80"); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+
+	// Failed logins on two nodes ban on both; a login that works forgets
+	// the user's
+	a1, _ := newAuthGuard(&AuthConf{Fails: 2}, "x")
+	a2, _ := newAuthGuard(&AuthConf{Fails: 2}, "x")
+	ctx := withClient(context.Background(), ip)
+	a1.fail(ctx, "mallory")
+	a2.fail(withClient(context.Background(), net.ParseIP("192.0.2.3")), "mallory")
+	for _, g := range []*authGuard{a1, a2} {
+		if err := g.check(context.Background(), "mallory"); isDenied(err) == nil {
+			t.Errorf("user ban not shared: %v", err)
+		}
+	}
+	if err := a2.check(ctx, "alice"); err != nil {
+		t.Errorf("one failure of the client: %v", err)
+	}
+	a1.fail(ctx, "alice")
+	a2.ok("alice")
+	a2.fail(withClient(context.Background(), net.ParseIP("192.0.2.4")), "alice")
+	if err := a1.check(context.Background(), "alice"); err != nil {
+		t.Errorf("alice after a login: %v", err)
+	}
+
+	// Conns held through one node count toward the max on the others
+	c1 := newConnLimiter(&RateLimit{MaxConns: 2}, "socks:x")
+	c2 := newConnLimiter(&RateLimit{MaxConns: 2}, "socks:x")
+	r1, ok1 := c1.acquire(ip)
+	r2, ok2 := c2.acquire(ip)
+	if _, ok := c1.acquire(ip); !ok1 || !ok2 || ok {
+		t.Errorf("fleet conns: %v %v %v", ok1, ok2, ok)
+	}
+	r1()
+	r3, ok := c2.acquire(ip)
+	if !ok {
+		t.Errorf("released conn still counted")
+	}
+	r2()
+	r3()
+	if n, _ := shared.get("conns:socks:x:" + srcKey(ip)); n != 0 {
+		t.Errorf("fleet count left at %d", n)
+	}
+
+	// Bytes used through one node count toward the quota on the others
+	dir := t.TempDir()
+	k1 := newTestKeys(t, filepath.Join(dir, "a.json"))
+	key, err := k1.create(&apiKey{Name: "fleet", Quota: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1.Close()
+	b1, _ := os.ReadFile(filepath.Join(dir, "a.json"))
+	os.WriteFile(filepath.Join(dir, "b.json"), b1, 0600)
+	k1 = newTestKeys(t, filepath.Join(dir, "a.json"))
+	k2 := newTestKeys(t, filepath.Join(dir, "b.json"))
+	defer k1.Close()
+	defer k2.Close()
+
+	k1.Stop(&Session{User: "fleet", in: 300, out: 300})
+	if _, err := k2.AuthenticateToken(context.Background(), key); err != nil {
+		t.Fatalf("under quota: %v", err)
+	}
+	k2.Stop(&Session{User: "fleet", in: 500})
+	for _, k := range []*apiKeys{k1, k2} {
+		if _, err := k.AuthenticateToken(context.Background(), key); err != errKeyQuota {
+			t.Errorf("fleet quota: %v", err)
+		}
+	}
+
+	// Failed logins on two admin listeners lock both
+	pw := bcryptHash(t, "adm1n")
+	u1 := startAdmin(t, &AdminConf{Password: pw})
+	u2 := startAdmin(t, &AdminConf{Password: pw})
+	login := func(u, pass string) int {
+		req, _ := http.NewRequest("POST", u+"/login", nil)
+		req.SetBasicAuth("admin", pass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for i := 0; i < ADMIN_MAXFAIL; i++ {
+		login([]string{u1, u2}[i%2], "wrong")
+	}
+	for _, u := range []string{u1, u2} {
+		if n := login(u, "adm1n"); n != http.StatusTooManyRequests {
+			t.Errorf("%s after %d fleet failures: %d", u, ADMIN_MAXFAIL, n)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,621 @@
+// replay.go -- replay access logs against a proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// Time stamps of the access log (RFC 3339 with milliseconds)
+	ACCESS_TIME = "2006-01-02T15:04:05.000Z07:00"
+
+	// Default replays at once and seconds for each
+	REPLAY_CONC    = 64
+	REPLAY_TIMEOUT = 60
+)
+
+// A request or tunnel from the access log
+type logRecord struct {
+	Start  time.Time
+	Method string // HTTP method, "CONNECT" or "SOCKS"
+	URL    string // URL or host:port
+	Status int
+	Sent   int64 // bytes from the client
+	Recv   int64 // bytes to the client
+	Dur    time.Duration
+	Proto  string // protocol seen in a tunnel, if noted
+	Client string // address of the client; SOCKS only
+}
+
+// Return the records in the access log 'r' in the order they started
+// and the number of lines that aren't records.
+func parseAccessLog(r io.Reader) ([]logRecord, int, error) {
+	var v []logRecord
+	var skipped int
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 65536), 1048576)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		// the logger's "<prio>:" prefix
+		if line[0] == '<' {
+			if i := strings.IndexByte(line, ':'); i > 0 {
+				line = strings.TrimSpace(line[i+1:])
+			}
+		}
+
+		var rec logRecord
+		var ok bool
+		if strings.HasPrefix(line, "time=") {
+			rec, ok = parseHTTPLog(line)
+		} else {
+			rec, ok = parseSocksLog(line)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		v = append(v, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(v, func(i, j int) bool { return v[i].Start.Before(v[j].Start) })
+	return v, skipped, nil
+}
+
+// A line of the HTTP proxy: key="value" pairs; the time is when the
+// request ended.
+func parseHTTPLog(line string) (logRecord, bool) {
+	var rec logRecord
+
+	f := logFields(line)
+	t, err := time.Parse(time.RFC3339, f["time"])
+	if err != nil || len(f["url"]) == 0 {
+		return rec, false
+	}
+	up, err := logDuration(f["upstream"])
+	if err != nil {
+		return rec, false
+	}
+	down, _ := logDuration(f["downstream"])
+
+	rec.URL = f["url"]
+	rec.Method = f["method"]
+	if len(rec.Method) == 0 {
+		rec.Method = "GET"
+	}
+	rec.Status, _ = strconv.Atoi(f["status"])
+	rec.Recv, _ = strconv.ParseInt(f["bytes"], 10, 64)
+	rec.Sent, _ = strconv.ParseInt(f["sent"], 10, 64)
+	rec.Dur = up + down
+	rec.Start = t.Add(-rec.Dur)
+	rec.Proto = f["proto"]
+	return rec, true
+}
+
+// A line of the SOCKS proxy: client, date and time (when the tunnel
+// ended), destination, [its address] and key=value pairs
+func parseSocksLog(line string) (logRecord, bool) {
+	var rec logRecord
+
+	v := strings.Fields(line)
+	if len(v) < 5 || !strings.HasPrefix(v[4], "[") {
+		return rec, false
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999", v[1]+" "+v[2])
+	if err != nil {
+		return rec, false
+	}
+
+	f := logFields(strings.Join(v[5:], " "))
+	rec.Method = "SOCKS"
+	rec.URL = v[3]
+	rec.Status = 200
+	rec.Sent, _ = strconv.ParseInt(f["in"], 10, 64)
+	rec.Recv, _ = strconv.ParseInt(f["out"], 10, 64)
+	rec.Dur, _ = logDuration(f["dur"])
+	rec.Start = t.Add(-rec.Dur)
+	rec.Proto = f["proto"]
+	if h, _, err := net.SplitHostPort(v[0]); err == nil {
+		rec.Client = h
+	}
+	return rec, true
+}
+
+// Return the key=value pairs of 's'; values may be quoted
+func logFields(s string) map[string]string {
+	m := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ")
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			break
+		}
+		k := s[:i]
+		s = s[i+1:]
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			q, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				break
+			}
+			val, _ = strconv.Unquote(q)
+			s = s[len(q):]
+		} else {
+			j := strings.IndexByte(s, ' ')
+			if j < 0 {
+				j = len(s)
+			}
+			val, s = s[:j], s[j:]
+		}
+		m[k] = val
+	}
+	return m
+}
+
+// Parse a duration as format() writes it: "12.345 ms" or "678 us"
+func logDuration(s string) (time.Duration, error) {
+	v := strings.Fields(s)
+	if len(v) != 2 {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	x, err := strconv.ParseFloat(v[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	switch v[1] {
+	case "ms":
+		return time.Duration(x * float64(time.Millisecond)), nil
+	case "us":
+		return time.Duration(x * float64(time.Microsecond)), nil
+	}
+	return 0, fmt.Errorf("bad duration %q", s)
+}
+
+// Replays of access log records against a proxy
+type replayer struct {
+	http    *url.URL // HTTP proxy; nil skips HTTP and CONNECT records
+	socks   *url.URL // SOCKS proxy; nil skips SOCKS records
+	speed   float64  // 1 is the recorded pace; 0 is as fast as possible
+	conc    int
+	timeout time.Duration
+
+	// address of a server that stands in for all destinations; "" to
+	// use the recorded ones
+	sink string
+
+	tr *http.Transport
+}
+
+// The result of a replay
+type replayResult struct {
+	rec    *logRecord
+	status int
+	dur    time.Duration
+	err    error
+}
+
+// Replay 'recs' at their recorded pace (scaled by the speed); return
+// their results.
+func (rp *replayer) run(recs []logRecord) []replayResult {
+	defer rp.setup()()
+
+	res := make([]replayResult, len(recs))
+	slots := make(chan struct{}, rp.conc)
+	var wg sync.WaitGroup
+
+	t0 := time.Now()
+	for i := range recs {
+		rec := &recs[i]
+		if rp.speed > 0 {
+			at := time.Duration(float64(rec.Start.Sub(recs[0].Start)) / rp.speed)
+			if d := at - time.Since(t0); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(r *replayResult) {
+			defer wg.Done()
+			*r = rp.one(rec)
+			<-slots
+		}(&res[i])
+	}
+	wg.Wait()
+	return res
+}
+
+// Make the transport of HTTP requests through the proxy; return the
+// func that closes its connections
+func (rp *replayer) setup() func() {
+	if rp.http == nil {
+		return func() {}
+	}
+	rp.tr = &http.Transport{
+		Proxy:               http.ProxyURL(rp.http),
+		MaxIdleConnsPerHost: rp.conc,
+		DisableCompression:  true,
+	}
+	return rp.tr.CloseIdleConnections
+}
+
+// Replay 'rec'
+func (rp *replayer) one(rec *logRecord) replayResult {
+	r := replayResult{rec: rec}
+	ctx, cancel := context.WithTimeout(context.Background(), rp.timeout)
+	defer cancel()
+
+	t0 := time.Now()
+	switch {
+	case rec.Method == "SOCKS" && rp.socks != nil:
+		r.status, r.err = rp.tunnel(ctx, rec, rp.dialSocks)
+	case rec.Method == "CONNECT" && rp.http != nil:
+		r.status, r.err = rp.tunnel(ctx, rec, rp.dialConnect)
+	case rec.Method != "SOCKS" && rec.Method != "CONNECT" && rp.http != nil:
+		r.status, r.err = rp.request(ctx, rec)
+	default:
+		r.err = errReplaySkip
+	}
+	r.dur = time.Since(t0)
+	return r
+}
+
+var errReplaySkip = fmt.Errorf("replay: no proxy for this record")
+
+// Replay an HTTP request: to the sink with the recorded body and
+// response sizes, else GET and HEAD to the recorded URL
+func (rp *replayer) request(ctx context.Context, rec *logRecord) (int, error) {
+	u := rec.URL
+	var body io.Reader
+	if len(rp.sink) > 0 {
+		u = fmt.Sprintf("http://%s/replay?n=%d", rp.sink, rec.Recv)
+		if rec.Sent > 0 {
+			body = io.LimitReader(zeros{}, rec.Sent)
+		}
+	} else if rec.Method != "GET" && rec.Method != "HEAD" {
+		return 0, errReplaySkip
+	}
+
+	req, err := http.NewRequestWithContext(ctx, rec.Method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.ContentLength = rec.Sent
+	}
+	res, err := rp.tr.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, err
+}
+
+// Replay a tunnel opened by 'dial': through the sink, send and receive
+// the recorded bytes; else hold the tunnel to the recorded destination
+// for as long as it was open.
+func (rp *replayer) tunnel(ctx context.Context, rec *logRecord, dial func(context.Context, string) (net.Conn, error)) (int, error) {
+	dest := rec.URL
+	if len(rp.sink) > 0 {
+		dest = rp.sink
+	}
+	c, err := dial(ctx, dest)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	if len(rp.sink) == 0 {
+		if rp.speed > 0 {
+			select {
+			case <-time.After(time.Duration(float64(rec.Dur) / rp.speed)):
+			case <-ctx.Done():
+			}
+		}
+		return 200, nil
+	}
+
+	// the sink speaks HTTP in the tunnel too
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/replay?n=%d", rp.sink, rec.Recv),
+		io.LimitReader(zeros{}, rec.Sent))
+	req.ContentLength = rec.Sent
+	req.Close = true
+	if err := req.Write(c); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return 0, err
+	}
+	return 200, nil
+}
+
+// Open a CONNECT tunnel to 'dest' through the HTTP proxy
+func (rp *replayer) dialConnect(ctx context.Context, dest string) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", rp.http.Host)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", dest, dest)
+	if u := rp.http.User; u != nil {
+		p, _ := u.Password()
+		req += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)) + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Read the response a byte at a time: the tunnel's bytes follow it
+	br := bufio.NewReaderSize(c, 1)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		c.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", dest, res.Status)
+	}
+	return c, nil
+}
+
+// Open a tunnel to 'dest' through the SOCKS proxy
+func (rp *replayer) dialSocks(ctx context.Context, dest string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := rp.socks.User; u != nil {
+		p, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: p}
+	}
+	d, err := proxy.SOCKS5("tcp", rp.socks.Host, auth, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", dest)
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// Stand in for the destinations: answer each request with the number
+// of bytes it asks for in "n" and drop what it sends.
+func serveSink(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	n, _ := strconv.ParseInt(r.FormValue("n"), 10, 64)
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	io.Copy(w, io.LimitReader(zeros{}, n))
+}
+
+// Percentiles of durations in milliseconds
+type durStats struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+func newDurStats(v []time.Duration) durStats {
+	if len(v) == 0 {
+		return durStats{}
+	}
+	sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+	at := func(p float64) float64 {
+		return float64(v[int(p*float64(len(v)-1))]) / float64(time.Millisecond)
+	}
+	return durStats{at(0.5), at(0.9), at(0.99), at(1)}
+}
+
+// The outcome of a replay
+type replaySummary struct {
+	Records  int      `json:"records"`
+	Skipped  int      `json:"skipped"`
+	OK       int      `json:"ok"`
+	Errors   int      `json:"errors"`
+	Mismatch int      `json:"status_mismatch"` // status other than the recorded one
+	Sent     int64    `json:"sent"`
+	Recv     int64    `json:"recv"`
+	Wall     float64  `json:"wall_seconds"`
+	Recorded durStats `json:"recorded"`
+	Replayed durStats `json:"replayed"`
+}
+
+func summarize(res []replayResult, wall time.Duration) replaySummary {
+	s := replaySummary{Records: len(res), Wall: wall.Seconds()}
+	var rec, rep []time.Duration
+	for i := range res {
+		r := &res[i]
+		switch {
+		case r.err == errReplaySkip:
+			s.Skipped++
+			continue
+		case r.err != nil:
+			s.Errors++
+		default:
+			s.OK++
+			s.Sent += r.rec.Sent
+			s.Recv += r.rec.Recv
+		}
+		if r.err == nil && r.status != r.rec.Status {
+			s.Mismatch++
+		}
+		rec = append(rec, r.rec.Dur)
+		rep = append(rep, r.dur)
+	}
+	s.Recorded = newDurStats(rec)
+	s.Replayed = newDurStats(rep)
+	return s
+}
+
+// Write the summary 's', and how it compares with 'base' if that isn't
+// nil.
+func (s *replaySummary) print(w io.Writer, base *replaySummary) {
+	fmt.Fprintf(w, "records %d: %d ok, %d errors, %d skipped, %d with another status\n",
+		s.Records, s.OK, s.Errors, s.Skipped, s.Mismatch)
+	fmt.Fprintf(w, "bytes: %d sent, %d received in %.1fs\n", s.Sent, s.Recv, s.Wall)
+	line := func(name string, d durStats) {
+		fmt.Fprintf(w, "%-10s p50 %9.1f ms  p90 %9.1f ms  p99 %9.1f ms  max %9.1f ms\n",
+			name, d.P50, d.P90, d.P99, d.Max)
+	}
+	line("recorded", s.Recorded)
+	line("replayed", s.Replayed)
+	if base != nil {
+		line("baseline", base.Replayed)
+		pct := func(a, b float64) float64 {
+			if b == 0 {
+				return 0
+			}
+			return 100 * (a - b) / b
+		}
+		fmt.Fprintf(w, "vs baseline: p50 %+.1f%%, p99 %+.1f%%, errors %d -> %d\n",
+			pct(s.Replayed.P50, base.Replayed.P50), pct(s.Replayed.P99, base.Replayed.P99),
+			base.Errors, s.Errors)
+	}
+}
+
+// The "replay" command: replay access logs against a proxy
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	hp := fs.StringP("http", "H", "", "HTTP proxy `URL` (http://[user:pass@]host:port)")
+	sp := fs.StringP("socks", "S", "", "SOCKS proxy `URL` (socks5://[user:pass@]host:port)")
+	speed := fs.Float64P("speed", "s", 1, "Replay at `N` times the recorded pace; 0 is as fast as possible")
+	conc := fs.IntP("concurrency", "c", REPLAY_CONC, "Replay at most `N` records at once")
+	tmo := fs.IntP("timeout", "t", REPLAY_TIMEOUT, "Give each record at most `N` seconds")
+	sink := fs.String("sink", "", "Serve the destinations on `ADDR` instead of using the recorded ones")
+	limit := fs.IntP("limit", "n", 0, "Replay only the first `N` records")
+	out := fs.String("json", "", "Write the summary to `FILE` as JSON")
+	bl := fs.String("baseline", "", "Compare with the summary in `FILE`")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s replay [options] access-log...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || (len(*hp) == 0 && len(*sp) == 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	rp := &replayer{speed: *speed, conc: *conc, timeout: time.Duration(*tmo) * time.Second}
+	if rp.conc <= 0 {
+		rp.conc = 1
+	}
+	var err error
+	if len(*hp) > 0 {
+		if rp.http, err = url.Parse(*hp); err != nil || rp.http.Scheme != "http" {
+			die("replay: %s: not an http:// URL", *hp)
+		}
+	}
+	if len(*sp) > 0 {
+		if rp.socks, err = url.Parse(*sp); err != nil || rp.socks.Scheme != "socks5" {
+			die("replay: %s: not a socks5:// URL", *sp)
+		}
+	}
+
+	var base *replaySummary
+	if len(*bl) > 0 {
+		b, err := os.ReadFile(*bl)
+		if err != nil {
+			die("replay: %s", err)
+		}
+		base = &replaySummary{}
+		if err := json.Unmarshal(b, base); err != nil {
+			die("replay: %s: %s", *bl, err)
+		}
+	}
+
+	var recs []logRecord
+	for _, fn := range fs.Args() {
+		fd, err := os.Open(fn)
+		if err != nil {
+			die("replay: %s", err)
+		}
+		v, skipped, err := parseAccessLog(fd)
+		fd.Close()
+		if err != nil {
+			die("replay: %s: %s", fn, err)
+		}
+		if skipped > 0 {
+			warn("replay: %s: %d lines aren't requests or tunnels", fn, skipped)
+		}
+		recs = append(recs, v...)
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+	if *limit > 0 && len(recs) > *limit {
+		recs = recs[:*limit]
+	}
+	if len(recs) == 0 {
+		die("replay: no records")
+	}
+
+	if len(*sink) > 0 {
+		ln, err := net.Listen("tcp", *sink)
+		if err != nil {
+			die("replay: sink: %s", err)
+		}
+		go http.Serve(ln, http.HandlerFunc(serveSink))
+		rp.sink = ln.Addr().String()
+	}
+
+	t0 := time.Now()
+	s := summarize(rp.run(recs), time.Since(t0))
+	s.print(os.Stdout, base)
+	if len(*out) > 0 {
+		b, _ := json.MarshalIndent(&s, "", "  ")
+		if err := os.WriteFile(*out, append(b, '\n'), 0644); err != nil {
+			die("replay: %s", err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,180 @@
+// replay_test.go -- tests for access log replays
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestReplayParse(t *testing.T) {
+	log := `<6>: time="2024-05-01T10:00:02.500Z" url="http://a.example/x" status="200" bytes="1234" upstream="400.000 ms" downstream="100.000 ms" cache="" method="POST" sent="99"
+<6>: time="2024-05-01T10:00:01Z" url="http://b.example/" status="404" bytes="10" upstream="250 us" downstream="0 us" cache="miss"
+192.0.2.1:5555 2024-05-01 10:00:05.000000 c.example:443 [198.51.100.7:443] in=300 out=7000 dur="3000.000 ms"
+garbage
+`
+	recs, skipped, err := parseAccessLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 || skipped != 1 {
+		t.Fatalf("%d records, %d skipped: %+v", len(recs), skipped, recs)
+	}
+
+	// in the order they started
+	r := recs[0]
+	if r.URL != "http://b.example/" || r.Method != "GET" || r.Status != 404 || r.Recv != 10 || r.Dur != 250*time.Microsecond {
+		t.Errorf("old line: %+v", r)
+	}
+	r = recs[1]
+	start := time.Date(2024, 5, 1, 10, 0, 2, 0, time.UTC)
+	if r.Method != "POST" || r.Sent != 99 || r.Recv != 1234 || r.Dur != 500*time.Millisecond || !r.Start.Equal(start) {
+		t.Errorf("http: %+v", r)
+	}
+	r = recs[2]
+	start = time.Date(2024, 5, 1, 10, 0, 2, 0, time.UTC)
+	if r.Method != "SOCKS" || r.URL != "c.example:443" || r.Sent != 300 || r.Recv != 7000 || !r.Start.Equal(start) {
+		t.Errorf("socks: %+v", r)
+	}
+
+	for _, s := range []string{"", "12 ms extra", "x ms", "12 s"} {
+		if _, err := logDuration(s); err == nil {
+			t.Errorf("duration %q: no error", s)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// Record a request, a POST and a tunnel through a proxy with an
+	// access log
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "access.log")
+	ulog, err := L.NewFilelog(fn, L.LOG_INFO, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	lc := &ListenConf{Listen: "127.0.0.1:0",
+		Rules: []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}}}
+	px, err := NewHTTPProxy(lc, log, ulog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Start()
+	addr := px.(*HTTPProxy).Addr().String()
+
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	go http.Serve(sink, http.HandlerFunc(serveSink))
+	sa := sink.Addr().String()
+
+	tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}
+	c := &http.Client{Transport: tr}
+	get := func(res *http.Response, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	get(c.Get(fmt.Sprintf("http://%s/replay?n=5000", sa)))
+	get(c.Post(fmt.Sprintf("http://%s/replay?n=10", sa), "text/plain", strings.NewReader("hello")))
+	tr.CloseIdleConnections()
+
+	tc, br := connectTunnel(t, addr, sa, "", "")
+	fmt.Fprintf(tc, "POST /replay?n=700 HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nConnection: close\r\n\r\nabc")
+	io.Copy(io.Discard, br)
+	tc.Close()
+
+	// the tunnel is logged when the proxy sees it close
+	for i := 0; i < 100; i++ {
+		if len(sessionStats("", time.Now())) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	px.Stop()
+	ulog.Close()
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, skipped, err := parseAccessLog(fd)
+	fd.Close()
+	if err != nil || skipped != 0 || len(recs) != 3 {
+		t.Fatalf("%d records, %d skipped, %v", len(recs), skipped, err)
+	}
+	want := map[string]int64{"GET": 5000, "POST": 10, "CONNECT": 0}
+	for _, r := range recs {
+		w, ok := want[r.Method]
+		if !ok || (r.Method != "CONNECT" && r.Recv != w) || r.Status != 200 {
+			t.Errorf("record: %+v", r)
+		}
+		if r.Method == "POST" && r.Sent != 5 {
+			t.Errorf("post: sent %d", r.Sent)
+		}
+		if r.Method == "CONNECT" && (r.URL != sa || r.Recv < 700 || r.Sent < 3) {
+			t.Errorf("tunnel: %+v", r)
+		}
+	}
+
+	// Replay them against a new proxy with a new sink
+	addr = startHTTPProxy(t, &ListenConf{})
+	sx := startSocksProxy(t, &ListenConf{})
+	recs = append(recs, logRecord{Start: recs[2].Start, Method: "SOCKS", URL: "x.example:443",
+		Status: 200, Sent: 50, Recv: 60000})
+	recs = append(recs, logRecord{Start: recs[2].Start, Method: "PUT", URL: "http://y.example/",
+		Status: 201, Sent: 1, Recv: 1})
+
+	s2, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { s2.Close() })
+	go http.Serve(s2, http.HandlerFunc(serveSink))
+
+	rp := &replayer{http: &url.URL{Scheme: "http", Host: addr}, socks: &url.URL{Scheme: "socks5", Host: sx},
+		speed: 0, conc: 2, timeout: 5 * time.Second, sink: s2.Addr().String()}
+	res := rp.run(recs)
+	sum := summarize(res, time.Second)
+	if sum.Records != 5 || sum.OK != 5 || sum.Errors != 0 || sum.Mismatch != 1 {
+		for _, r := range res {
+			t.Logf("%s %s: %d %v", r.rec.Method, r.rec.URL, r.status, r.err)
+		}
+		t.Fatalf("summary: %+v", sum)
+	}
+
+	// Without a sink: only GETs and tunnels to the recorded places;
+	// the socks record has no proxy.
+	rp = &replayer{http: &url.URL{Scheme: "http", Host: addr}, conc: 4, timeout: 5 * time.Second}
+	sum = summarize(rp.run(recs[:3]), time.Second)
+	if sum.OK != 2 || sum.Skipped != 1 {
+		t.Errorf("no sink: %+v", sum)
+	}
+
+	var b strings.Builder
+	sum.print(&b, &sum)
+	if !strings.Contains(b.String(), "vs baseline: p50 +0.0%") {
+		t.Errorf("print: %s", b.String())
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,168 @@
+// retry.go -- retries of idempotent upstream requests
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+)
+
+// The upstream addresses a request failed on; its retries dial the
+// others (see dialer.DialContext).
+type retryState struct {
+	sync.Mutex
+	failed map[string]bool // IP addresses
+	conn   string          // address of the connection in use
+}
+
+// Return a context that carries the retry state 'rs'
+func withRetry(ctx context.Context, rs *retryState) context.Context {
+	return context.WithValue(ctx, ctxRetry, rs)
+}
+
+// Return the retry state in ctx (or nil)
+func retryOf(ctx context.Context) *retryState {
+	rs, _ := ctx.Value(ctxRetry).(*retryState)
+	return rs
+}
+
+// Note that 'addr' (host:port) failed
+func (rs *retryState) fail(addr string) {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	rs.Lock()
+	if rs.failed == nil {
+		rs.failed = make(map[string]bool)
+	}
+	rs.failed[h] = true
+	rs.Unlock()
+}
+
+// The connection the last attempt used failed
+func (rs *retryState) failConn() {
+	rs.Lock()
+	c := rs.conn
+	rs.conn = ""
+	rs.Unlock()
+	if len(c) > 0 {
+		rs.fail(c)
+	}
+}
+
+// Return the addresses of 'host' (looked up with 'lookup') that haven't
+// failed; nil if none failed or all of them did, in which case all are
+// tried again.
+func (rs *retryState) untried(ctx context.Context, host string,
+	lookup func(context.Context, string) ([]net.IPAddr, error)) []net.IP {
+	rs.Lock()
+	n := len(rs.failed)
+	rs.Unlock()
+	if n == 0 {
+		return nil
+	}
+
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil
+	}
+
+	var v []net.IP
+	rs.Lock()
+	for _, a := range addrs {
+		if !rs.failed[a.IP.String()] {
+			v = append(v, a.IP)
+		}
+	}
+	rs.Unlock()
+
+	if len(v) == len(addrs) {
+		return nil
+	}
+	return v
+}
+
+// Add the hooks that track failed addresses to 't'
+func (rs *retryState) hook(t *httptrace.ClientTrace) {
+	t.ConnectDone = func(network, addr string, err error) {
+		if err != nil {
+			rs.fail(addr)
+		}
+	}
+
+	got := t.GotConn
+	t.GotConn = func(ci httptrace.GotConnInfo) {
+		if got != nil {
+			got(ci)
+		}
+		rs.Lock()
+		rs.conn = ci.Conn.RemoteAddr().String()
+		rs.Unlock()
+	}
+}
+
+// Return true if 'req' can be sent again after it failed with 'err':
+// it is idempotent, has no body and never reached the upstream or was
+// cut off before an answer.
+func retryable(req *http.Request, err error) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+	default:
+		return false
+	}
+
+	if (req.Body != nil && req.Body != http.NoBody) || req.Context().Err() != nil {
+		return false
+	}
+	if isDenied(err) != nil || isDNSSEC(err) != nil {
+		return false
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return true
+	}
+
+	for _, e := range []error{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send 'req' upstream. An idempotent request is sent again, up to
+// pool.retries times, if the upstream can't be reached or drops the
+// connection before it answers; retries avoid the addresses that
+// failed.
+func (p *HTTPProxy) roundTrip(req *http.Request, rs *retryState) (*http.Response, error) {
+	log := logOf(req.Context(), p.log)
+	tr := p.tr
+	if p.utr != nil {
+		tr = p.utr.get(userOf(req.Context()), tr)
+	}
+
+	res, err := tr.RoundTrip(req)
+	for i := 0; err != nil && i < p.dial.pool.retries && retryable(req, err); i++ {
+		rs.failConn()
+		log.Debug("%s: retrying %s %.64q: %s", req.Host, req.Method, req.URL.String(), err)
+		res, err = tr.RoundTrip(req)
+	}
+	return res, err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,168 @@
+// retry_test.go -- tests for retries of idempotent requests
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	denied := &net.OpError{Op: "dial", Net: "tcp", Err: &policyErr{}}
+
+	tests := []struct {
+		method string
+		body   bool
+		err    error
+		want   bool
+	}{
+		{"GET", false, dial, true},
+		{"HEAD", false, reset, true},
+		{"GET", false, fmt.Errorf("broken: %w", io.EOF), true},
+		{"OPTIONS", false, io.ErrUnexpectedEOF, true},
+		{"GET", false, errors.New("malformed HTTP response"), false},
+		{"GET", false, denied, false},
+		{"GET", true, dial, false},
+		{"POST", false, dial, false},
+		{"PUT", false, reset, false},
+		{"DELETE", false, reset, false},
+	}
+
+	for _, tt := range tests {
+		var body io.Reader
+		if tt.body {
+			body = strings.NewReader("x")
+		}
+		req, _ := http.NewRequest(tt.method, "http://example.com/", body)
+		if got := retryable(req, tt.err); got != tt.want {
+			t.Errorf("%s %v (body %v): got %v", tt.method, tt.err, tt.body, got)
+		}
+	}
+}
+
+func TestRetryState(t *testing.T) {
+	rs := &retryState{}
+	if v := rs.untried(nil, "localhost", net.DefaultResolver.LookupIPAddr); v != nil {
+		t.Errorf("untried with no failures: %v", v)
+	}
+
+	rs.conn = "10.0.0.1:80"
+	rs.failConn()
+	rs.fail("10.0.0.2:80")
+	rs.fail("bogus")
+	if !rs.failed["10.0.0.1"] || !rs.failed["10.0.0.2"] || len(rs.failed) != 2 || len(rs.conn) > 0 {
+		t.Errorf("failed %v, conn %q", rs.failed, rs.conn)
+	}
+}
+
+// An origin that resets the first 'bad' connections and answers the rest
+func startFlakyOrigin(t *testing.T, bad int32) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var n int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				if atomic.AddInt32(&n, 1) <= bad {
+					c.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+				io.Copy(ioutil.Discard, r.Body)
+			}(c)
+		}
+	}()
+	return ln.Addr().String(), &n
+}
+
+func proxyRequest(t *testing.T, proxy, method, u string) int {
+	pu, _ := url.Parse("http://" + proxy)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), DisableKeepAlives: true}}
+
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader("data")
+	}
+	req, _ := http.NewRequest(method, u, body)
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestRetryRequest(t *testing.T) {
+	origin, n := startFlakyOrigin(t, 1)
+	proxy := startHTTPProxy(t, &ListenConf{})
+
+	if code := proxyRequest(t, proxy, "GET", "http://"+origin+"/"); code != 200 {
+		t.Errorf("GET: %d", code)
+	}
+	if c := atomic.LoadInt32(n); c != 2 {
+		t.Errorf("GET: %d attempts", c)
+	}
+
+	// Not idempotent: the error goes to the client
+	origin, n = startFlakyOrigin(t, 1)
+	if code := proxyRequest(t, proxy, "POST", "http://"+origin+"/"); code == 200 {
+		t.Errorf("POST retried")
+	}
+	if c := atomic.LoadInt32(n); c != 1 {
+		t.Errorf("POST: %d attempts", c)
+	}
+
+	// Retries exhausted
+	origin, n = startFlakyOrigin(t, 5)
+	if code := proxyRequest(t, proxy, "GET", "http://"+origin+"/"); code == 200 {
+		t.Errorf("GET succeeded")
+	}
+	if c := atomic.LoadInt32(n); c != 1+POOL_RETRIES {
+		t.Errorf("GET: %d attempts", c)
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	origin, n := startFlakyOrigin(t, 1)
+	proxy := startHTTPProxy(t, &ListenConf{Pool: PoolConf{Retries: -1}})
+
+	if code := proxyRequest(t, proxy, "GET", "http://"+origin+"/"); code == 200 {
+		t.Errorf("GET retried")
+	}
+	if c := atomic.LoadInt32(n); c != 1 {
+		t.Errorf("%d attempts", c)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
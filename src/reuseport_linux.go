@@ -0,0 +1,16 @@
+// reuseport_linux.go -- SO_REUSEPORT on linux
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package main
+
+// Not in package syscall on all architectures
+const _SO_REUSEPORT = 0xf
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,15 @@
+// reuseport_mipsx.go -- SO_REUSEPORT on linux/mips
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package main
+
+const _SO_REUSEPORT = 0x200
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
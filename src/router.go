@@ -0,0 +1,113 @@
+// router.go -- routers: pick the route of each connection
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A listener with a "router" asks it where each connection goes: the
+// listener's own route, directly, through one of its WireGuard tunnels
+// or jump hosts - or nowhere. The script's route hook, if any, is asked
+// first. Like authenticators, a router type is compiled in and
+// registers a RouterFactory in init(); see plugin.go for one that asks
+// a program outside goproxy.
+
+// The rule named in the logs and denials of a router
+const ROUTER_RULE = "router"
+
+// The route of a connection
+type Route struct {
+	Via  string // "" (the listener's own), "direct", "wireguard" or "jump"
+	Name string // of the tunnel or jump host
+
+	rule string // that picked it: SCRIPT_RULE or ROUTER_RULE
+}
+
+// Picks the routes of a listener's connections. It is called
+// concurrently; the client and user are in the context (clientOf,
+// userOf).
+type Router interface {
+	// Return the route of 'host:port'; an error (a *policyErr) denies
+	// the connection
+	Route(ctx context.Context, host string, port int) (Route, error)
+}
+
+// Make a router from its config args
+type RouterFactory func(args map[string]string) (Router, error)
+
+var routerTypes = struct {
+	sync.Mutex
+	m map[string]RouterFactory
+}{m: make(map[string]RouterFactory)}
+
+// Make the router type 'name' available to the config file
+func RegisterRouter(name string, f RouterFactory) {
+	routerTypes.Lock()
+	defer routerTypes.Unlock()
+
+	if _, ok := routerTypes.m[name]; ok {
+		panic("router " + name + " registered twice")
+	}
+	routerTypes.m[name] = f
+}
+
+// Return the registered router types
+func routerNames() []string {
+	routerTypes.Lock()
+	defer routerTypes.Unlock()
+
+	v := make([]string, 0, len(routerTypes.m))
+	for k := range routerTypes.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Return the router of 'rc' or nil if it has none
+func newRouter(rc *RouterConf) (Router, error) {
+	if len(rc.Type) == 0 {
+		return nil, nil
+	}
+
+	routerTypes.Lock()
+	mk, ok := routerTypes.m[rc.Type]
+	routerTypes.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("router: unknown type %q (have %s)", rc.Type,
+			strings.Join(routerNames(), ", "))
+	}
+
+	r, err := mk(rc.Args)
+	if err != nil {
+		return nil, fmt.Errorf("router %s: %s", rc.Type, err)
+	}
+	return r, nil
+}
+
+// Check the route 'r' a router picked
+func (r *Route) check() error {
+	switch r.Via {
+	case "", "direct":
+	case "wireguard", "jump":
+		if len(r.Name) == 0 {
+			return fmt.Errorf("%s without a name", r.Via)
+		}
+	default:
+		return fmt.Errorf("unknown route %.64q", r.Via)
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
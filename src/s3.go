@@ -0,0 +1,180 @@
+// s3.go -- uploads to S3 compatible buckets
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Region of buckets whose config names none
+const S3_REGION = "us-east-1"
+
+// A bucket written with path style URLs (endpoint/bucket/key), which
+// AWS, MinIO, Ceph and the rest all take
+type s3Bucket struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	prefix   string
+	access   string
+	secret   string
+	client   *http.Client
+}
+
+// Return the bucket of 'sc'; nil if it names none
+func newS3Bucket(sc *S3Conf, timeout time.Duration) (*s3Bucket, error) {
+	if len(sc.Bucket) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(sc.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", sc.Endpoint)
+	}
+	b := &s3Bucket{
+		endpoint: u,
+		bucket:   sc.Bucket,
+		region:   sc.Region,
+		prefix:   strings.TrimPrefix(sc.Prefix, "/"),
+		access:   sc.AccessKey,
+		secret:   sc.SecretKey,
+		client:   &http.Client{Timeout: timeout},
+	}
+	if len(b.region) == 0 {
+		b.region = S3_REGION
+	}
+	if len(b.access) == 0 {
+		b.access, b.secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(b.access) == 0 || len(b.secret) == 0 {
+		return nil, fmt.Errorf("s3: bucket %s: no access key", b.bucket)
+	}
+	return b, nil
+}
+
+// Write 'body' to the object 'key' (below the prefix) of the bucket
+func (b *s3Bucket) put(ctx context.Context, key, typ string, body []byte) error {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket + "/" + b.prefix + key
+	u.RawPath = ""
+	r, err := http.NewRequestWithContext(ctx, "PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", typ)
+	sum := sha256.Sum256(body)
+	b.sign(r, hex.EncodeToString(sum[:]), time.Now())
+
+	res, err := b.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("s3: %s: %w", key, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("s3: %s: %s: %s", key, res.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// Sign 'r' (AWS signature version 4) with the hash of its body at 'now';
+// every header it has is signed
+func (b *s3Bucket) sign(r *http.Request, hash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", hash)
+
+	host := r.Host
+	if len(host) == 0 {
+		host = r.URL.Host
+	}
+	hdrs := map[string]string{"host": host}
+	for k, vv := range r.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vv, ","))
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + hdrs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := r.URL.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	creq := strings.Join([]string{r.Method, awsEscape(path, true), canonicalQuery(r.URL.Query()),
+		ch.String(), signed, hash}, "\n")
+
+	scope := day + "/" + b.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(creq))
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + b.secret)
+	for _, s := range []string{day, b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.access, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// Escape 's' the way signatures want: all but the unreserved characters
+// of RFC 3986 (and '/' in paths)
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vv := range q {
+		for _, v := range vv {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
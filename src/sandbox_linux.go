@@ -0,0 +1,274 @@
+// sandbox_linux.go -- seccomp and landlock restrictions of a running proxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Once the servers run, a seccomp filter fails the syscalls a proxy
+// never makes (mounts, modules, ptrace, exec, ...) with EPERM, and
+// landlock limits the files it may open to a few trees. Both apply to
+// every thread and can't be undone.
+
+const (
+	_PR_SET_NO_NEW_PRIVS = 38
+
+	_SECCOMP_SET_MODE_FILTER   = 1
+	_SECCOMP_FILTER_FLAG_TSYNC = 1
+
+	_SECCOMP_RET_KILL_PROCESS = 0x80000000
+	_SECCOMP_RET_ERRNO        = 0x00050000
+	_SECCOMP_RET_ALLOW        = 0x7fff0000
+
+	_LANDLOCK_CREATE_RULESET_VERSION = 1
+	_LANDLOCK_RULE_PATH_BENEATH      = 1
+
+	_O_PATH = 0x200000
+)
+
+// landlock access rights
+const (
+	_LL_EXECUTE = 1 << iota
+	_LL_WRITE_FILE
+	_LL_READ_FILE
+	_LL_READ_DIR
+	_LL_REMOVE_DIR
+	_LL_REMOVE_FILE
+	_LL_MAKE_CHAR
+	_LL_MAKE_DIR
+	_LL_MAKE_REG
+	_LL_MAKE_SOCK
+	_LL_MAKE_FIFO
+	_LL_MAKE_BLOCK
+	_LL_MAKE_SYM
+	_LL_REFER    // ABI 2
+	_LL_TRUNCATE // ABI 3
+
+	_LL_V1   = _LL_MAKE_SYM<<1 - 1
+	_LL_FILE = _LL_EXECUTE | _LL_WRITE_FILE | _LL_READ_FILE | _LL_TRUNCATE
+)
+
+// Per arch: audit arch of seccomp_data, and the syscalls package
+// syscall doesn't have everywhere
+type sandboxArch struct {
+	audit    uint32
+	x32      bool // a second syscall table above 0x40000000
+	seccomp  uintptr
+	execveat uintptr
+	finit    uintptr
+	landlock uintptr // landlock_create_ruleset; add_rule, restrict_self follow
+}
+
+var sandboxArchs = map[string]sandboxArch{
+	"amd64":    {0xc000003e, true, 317, 322, 313, 444},
+	"386":      {0x40000003, false, 354, 358, 350, 444},
+	"arm":      {0x40000028, false, 383, 387, 379, 444},
+	"arm64":    {0xc00000b7, false, 277, 281, 273, 444},
+	"loong64":  {0xc0000102, false, 277, 281, 273, 444},
+	"mips":     {0x00000008, false, 4352, 4356, 4348, 4444},
+	"mipsle":   {0x40000008, false, 4352, 4356, 4348, 4444},
+	"mips64":   {0x80000008, false, 5312, 5316, 5307, 5444},
+	"mips64le": {0xc0000008, false, 5312, 5316, 5307, 5444},
+	"ppc64":    {0x80000015, false, 358, 362, 353, 444},
+	"ppc64le":  {0xc0000015, false, 358, 362, 353, 444},
+	"riscv64":  {0xc00000f3, false, 277, 281, 273, 444},
+	"s390x":    {0x80000016, false, 348, 354, 344, 444},
+}
+
+// Syscalls the seccomp filter fails
+var sandboxDenied = []uintptr{
+	syscall.SYS_PTRACE,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_CLOCK_SETTIME,
+	syscall.SYS_SETHOSTNAME,
+	syscall.SYS_SETDOMAINNAME,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_PERF_EVENT_OPEN,
+}
+
+// Enter the sandbox of 'sc'; 'exec' keeps execve(2) for upgrades.
+func applySandbox(sc *SandboxConf, exec bool) error {
+	if !sc.Seccomp && !sc.Landlock {
+		return nil
+	}
+
+	arch, ok := sandboxArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("sandbox: not supported on %s", runtime.GOARCH)
+	}
+
+	if sc.Landlock {
+		if err := landlock(&arch, append([]string{"/etc"}, sc.Read...), sc.Write); err != nil {
+			return fmt.Errorf("sandbox: landlock: %s", err)
+		}
+	}
+	if sc.Seccomp {
+		if err := seccomp(&arch, exec); err != nil {
+			return fmt.Errorf("sandbox: seccomp: %s", err)
+		}
+	}
+	return nil
+}
+
+// The classic BPF program of the seccomp filter
+func seccompFilter(arch *sandboxArch, exec bool) []syscall.SockFilter {
+	deny := append([]uintptr(nil), sandboxDenied...)
+	deny = append(deny, arch.finit)
+	if !exec {
+		deny = append(deny, syscall.SYS_EXECVE, arch.execveat)
+	}
+
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+
+	// seccomp_data: nr at 0, arch at 4
+	p := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: arch.audit},
+		stmt(syscall.BPF_RET|syscall.BPF_K, _SECCOMP_RET_KILL_PROCESS),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+
+	// the checks jump to the last insn (EPERM)
+	n := len(deny)
+	if arch.x32 {
+		p = append(p, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K,
+			Jt: uint8(n + 1), K: 0x40000000})
+	}
+	for _, nr := range deny {
+		p = append(p, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			Jt: uint8(n), K: uint32(nr)})
+		n--
+	}
+	return append(p,
+		stmt(syscall.BPF_RET|syscall.BPF_K, _SECCOMP_RET_ALLOW),
+		stmt(syscall.BPF_RET|syscall.BPF_K, _SECCOMP_RET_ERRNO|uint32(syscall.EPERM)))
+}
+
+func seccomp(arch *sandboxArch, exec bool) error {
+	p := seccompFilter(arch, exec)
+	prog := syscall.SockFprog{Len: uint16(len(p)), Filter: &p[0]}
+
+	// no_new_privs and the filter on this thread; TSYNC puts both on
+	// the others
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, _PR_SET_NO_NEW_PRIVS, 1, 0); e != 0 {
+		return fmt.Errorf("no_new_privs: %s", e)
+	}
+	r, _, e := syscall.RawSyscall(arch.seccomp, _SECCOMP_SET_MODE_FILTER,
+		_SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(p)
+	if e != 0 {
+		return e
+	}
+	if r != 0 {
+		return fmt.Errorf("thread %d can't take the filter", r)
+	}
+	return nil
+}
+
+// struct landlock_path_beneath_attr (packed; the kernel reads 12 bytes)
+type landlockPath struct {
+	allowed uint64
+	fd      int32
+}
+
+// Allow reading below 'read' and all file operations below 'write';
+// deny everything else landlock knows of.
+func landlock(arch *sandboxArch, read, write []string) error {
+	abi, _, e := syscall.RawSyscall(arch.landlock, 0, 0, _LANDLOCK_CREATE_RULESET_VERSION)
+	if e != 0 {
+		return fmt.Errorf("not available in this kernel: %s", e)
+	}
+
+	handled := uint64(_LL_V1)
+	if abi >= 2 {
+		handled |= _LL_REFER
+	}
+	if abi >= 3 {
+		handled |= _LL_TRUNCATE
+	}
+
+	fd, _, e := syscall.RawSyscall(arch.landlock, uintptr(unsafe.Pointer(&handled)), 8, 0)
+	if e != 0 {
+		return fmt.Errorf("create ruleset: %s", e)
+	}
+	defer syscall.Close(int(fd))
+
+	add := func(path string, allow uint64) error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			allow &= _LL_FILE
+		}
+		pfd, err := syscall.Open(path, _O_PATH|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		defer syscall.Close(pfd)
+
+		pb := landlockPath{allowed: allow & handled, fd: int32(pfd)}
+		_, _, e := syscall.RawSyscall6(arch.landlock+1, fd, _LANDLOCK_RULE_PATH_BENEATH,
+			uintptr(unsafe.Pointer(&pb)), 0, 0, 0)
+		if e != 0 {
+			return fmt.Errorf("%s: %s", path, e)
+		}
+		return nil
+	}
+	for _, p := range read {
+		if err := add(p, _LL_READ_FILE|_LL_READ_DIR); err != nil {
+			return err
+		}
+	}
+	for _, p := range write {
+		if err := add(p, handled&^_LL_EXECUTE); err != nil {
+			return err
+		}
+	}
+
+	// landlock_restrict_self only binds the calling thread
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, _PR_SET_NO_NEW_PRIVS, 1, 0); e != 0 {
+		if e == syscall.ENOTSUP {
+			return fmt.Errorf("needs a goproxy built with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("no_new_privs: %s", e)
+	}
+	if _, _, e := syscall.AllThreadsSyscall(arch.landlock+2, fd, 0, 0); e != 0 {
+		return fmt.Errorf("restrict: %s", e)
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,141 @@
+// sandbox_linux_test.go -- tests for the seccomp and landlock sandbox
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	for _, name := range []string{"amd64", "arm64"} {
+		arch := sandboxArchs[name]
+		for _, ex := range []bool{false, true} {
+			p := seccompFilter(&arch, ex)
+			last := len(p) - 1
+			if p[last].K != _SECCOMP_RET_ERRNO|uint32(syscall.EPERM) || p[last-1].K != _SECCOMP_RET_ALLOW {
+				t.Fatalf("%s: doesn't end in allow, EPERM: %+v", name, p[last-1:])
+			}
+
+			// every check after the arch lands on EPERM
+			denied := map[uint32]bool{}
+			for i := 4; i < last-1; i++ {
+				if i+1+int(p[i].Jt) != last || p[i].Jf != 0 {
+					t.Errorf("%s: insn %d jumps to %d", name, i, i+1+int(p[i].Jt))
+				}
+				denied[p[i].K] = true
+			}
+			if denied[uint32(arch.execveat)] == ex || denied[syscall.SYS_PTRACE] != true {
+				t.Errorf("%s exec %v: denied %v", name, ex, denied)
+			}
+			if denied[0x40000000] != arch.x32 {
+				t.Errorf("%s: x32 check %v", name, denied[0x40000000])
+			}
+		}
+	}
+}
+
+// The sandbox can't be left; the checks run in a child test process.
+func TestSandbox(t *testing.T) {
+	if m := os.Getenv("GOPROXY_SANDBOX"); len(m) > 0 {
+		if err := sandboxChild(m); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if _, ok := sandboxArchs[runtime.GOARCH]; !ok {
+		t.Skipf("no sandbox on %s", runtime.GOARCH)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0600)
+	os.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0600)
+
+	for _, m := range []string{"seccomp", "seccomp-exec", "landlock:" + dir} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+		cmd.Env = append(os.Environ(), "GOPROXY_SANDBOX="+m)
+		out, err := cmd.CombinedOutput()
+		s := strings.TrimSpace(string(out))
+		switch {
+		case strings.HasPrefix(s, "skip:"):
+			t.Logf("%s: %s", m, s)
+		case err != nil:
+			t.Errorf("%s: %s %s", m, err, s)
+		}
+	}
+}
+
+func sandboxChild(m string) error {
+	probe := func() error {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("can't listen in the sandbox: %s", err)
+		}
+		return ln.Close()
+	}
+
+	switch {
+	case m == "seccomp" || m == "seccomp-exec":
+		ex := m == "seccomp-exec"
+		if err := applySandbox(&SandboxConf{Seccomp: true}, ex); err != nil {
+			return err
+		}
+		if err := probe(); err != nil {
+			return err
+		}
+		if err := syscall.Unshare(0); !errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("unshare: %v", err)
+		}
+		err := exec.Command("/bin/sh", "-c", "exit 0").Run()
+		if ex && err != nil {
+			return fmt.Errorf("exec kept, but: %s", err)
+		}
+		if !ex && !errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("exec: %v", err)
+		}
+
+	case strings.HasPrefix(m, "landlock:"):
+		dir := m[len("landlock:"):]
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		err := applySandbox(&SandboxConf{Landlock: true, Read: []string{a}}, false)
+		if err != nil {
+			if strings.Contains(err.Error(), "not available") || strings.Contains(err.Error(), "CGO_ENABLED") {
+				fmt.Println("skip:", err)
+				return nil
+			}
+			return err
+		}
+		if err := probe(); err != nil {
+			return err
+		}
+		if _, err := os.ReadFile(a); err != nil {
+			return fmt.Errorf("read allowed file: %s", err)
+		}
+		if _, err := os.ReadFile(b); !errors.Is(err, syscall.EACCES) {
+			return fmt.Errorf("read other file: %v", err)
+		}
+		if err := os.WriteFile(a, nil, 0600); !errors.Is(err, syscall.EACCES) {
+			return fmt.Errorf("write read-only file: %v", err)
+		}
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
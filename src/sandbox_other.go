@@ -0,0 +1,24 @@
+// sandbox_other.go -- no sandbox on non-linux platforms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func applySandbox(sc *SandboxConf, exec bool) error {
+	if sc.Seccomp || sc.Landlock {
+		return errors.New("sandbox: seccomp and landlock are only available on linux")
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
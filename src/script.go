@@ -0,0 +1,479 @@
+// script.go -- scripting hooks of a listener
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+const (
+	// Default milliseconds and steps of a call
+	SCRIPT_TIMEOUT = 50
+	SCRIPT_STEPS   = 100000
+
+	// Bytes of strings and tables a call may make
+	SCRIPT_MEMORY = 16 << 20
+
+	// Seconds between checks of a script for changes
+	SCRIPT_CHECK = 5
+
+	// Rule name of destinations or requests a script denies
+	SCRIPT_RULE = "script"
+)
+
+// The hooks, in the order of the metrics
+const (
+	hookAuth = iota
+	hookRoute
+	hookRequest
+	hookResponse
+	nHooks
+)
+
+var hookNames = [nHooks]string{"auth", "route", "request", "response"}
+
+// A listener's Lua script. Its functions are called at decision points:
+//
+//	auth(user, client)  after a client authenticates: nil or true keeps
+//	                    the user, a string renames them, false (and a
+//	                    reason) refuses them
+//	route(dest)         before a destination is dialed: nil as the rules
+//	                    say, "deny" (and a rule name), "direct",
+//	                    "wireguard", name or "jump", name
+//	request(req)        before a plain HTTP request goes out: changes to
+//	                    req.headers are sent; "deny" (and a rule name)
+//	                    refuses it
+//	response(res)       before a response goes to the client: changes to
+//	                    res.headers are sent
+//
+// Each call has a budget of time, steps and memory; a call that fails or
+// runs out of it refuses the client (or goes on without the script if
+// failopen is set). The file is read again when it changes; if it
+// doesn't compile, the old script is kept.
+type scriptHooks struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	calls    [nHooks]uint64
+	errors   [nHooks]uint64
+	timeouts [nHooks]uint64
+
+	file     string
+	listen   string
+	steps    int
+	timeout  time.Duration
+	failOpen bool
+	log      *L.Logger
+
+	sync.Mutex
+	s       *luaScript
+	mtime   time.Time
+	checked time.Time
+}
+
+// Return the script of 'sc'; nil if there is none
+func newScriptHooks(sc *ScriptConf, listen string, log *L.Logger) (*scriptHooks, error) {
+	if len(sc.File) == 0 {
+		return nil, nil
+	}
+
+	h := &scriptHooks{
+		file:     sc.File,
+		listen:   listen,
+		steps:    sc.Steps,
+		timeout:  time.Duration(sc.Timeout) * time.Millisecond,
+		failOpen: sc.FailOpen,
+		log:      log,
+	}
+	if sc.Timeout < 0 || sc.Steps < 0 {
+		return nil, fmt.Errorf("script: timeout and steps can't be negative")
+	}
+	if h.steps == 0 {
+		h.steps = SCRIPT_STEPS
+	}
+	if h.timeout == 0 {
+		h.timeout = SCRIPT_TIMEOUT * time.Millisecond
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Read and compile the file
+func (h *scriptHooks) load() error {
+	fi, err := os.Stat(h.file)
+	if err != nil {
+		return fmt.Errorf("script: %s", err)
+	}
+	b, err := os.ReadFile(h.file)
+	if err != nil {
+		return fmt.Errorf("script: %s", err)
+	}
+
+	s, err := loadLua(h.file, string(b), func(m string) {
+		h.log.Info("script %s: %s", h.file, m)
+	})
+	if err != nil {
+		return fmt.Errorf("script %s: %s", h.file, err)
+	}
+
+	var have []string
+	for _, n := range hookNames {
+		if s.has(n) {
+			have = append(have, n)
+		}
+	}
+	if len(have) == 0 {
+		return fmt.Errorf("script %s: defines none of %s", h.file, strings.Join(hookNames[:], ", "))
+	}
+
+	h.Lock()
+	h.s, h.mtime = s, fi.ModTime()
+	h.Unlock()
+	h.log.Info("script %s: hooks %s", h.file, strings.Join(have, ", "))
+	return nil
+}
+
+// Return the script, reloaded if the file changed; at most every
+// SCRIPT_CHECK seconds
+func (h *scriptHooks) script() *luaScript {
+	h.Lock()
+	s := h.s
+	now := time.Now()
+	if now.Sub(h.checked) < SCRIPT_CHECK*time.Second {
+		h.Unlock()
+		return s
+	}
+	h.checked = now
+	mtime := h.mtime
+	h.Unlock()
+
+	if fi, err := os.Stat(h.file); err == nil && !fi.ModTime().Equal(mtime) {
+		if err := h.load(); err != nil {
+			h.log.Warn("%s; keeping the old script", err)
+			// don't try again until it changes
+			h.Lock()
+			h.mtime = fi.ModTime()
+			h.Unlock()
+		}
+		h.Lock()
+		s = h.s
+		h.Unlock()
+	}
+	return s
+}
+
+// Return true if the script has the hook 'n'
+func (h *scriptHooks) has(n int) bool {
+	return h != nil && h.script().has(hookNames[n])
+}
+
+// Call the hook 'n'; nil if the script doesn't define it. An error
+// means the call failed; it is nil if failopen is set.
+func (h *scriptHooks) call(n int, args ...luaValue) ([]luaValue, error) {
+	s := h.script()
+	if !s.has(hookNames[n]) {
+		return nil, nil
+	}
+
+	atomic.AddUint64(&h.calls[n], 1)
+	rs, err := s.call(hookNames[n], args, h.steps, SCRIPT_MEMORY, h.timeout)
+	if err != nil {
+		return nil, h.failed(n, err)
+	}
+	return rs, nil
+}
+
+// Count and log the failed call of hook 'n'
+func (h *scriptHooks) failed(n int, err error) error {
+	atomic.AddUint64(&h.errors[n], 1)
+	if err == errLuaTimeout || err == errLuaSteps {
+		atomic.AddUint64(&h.timeouts[n], 1)
+	}
+	h.log.Warn("script %s: %s: %s", h.file, hookNames[n], err)
+	if h.failOpen {
+		return nil
+	}
+	return fmt.Errorf("script %s: %s: %s", h.file, hookNames[n], err)
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Return the user 'user' of the client in 'ctx' is known as; an error
+// refuses them
+func (h *scriptHooks) auth(ctx context.Context, user string) (string, error) {
+	rs, err := h.call(hookAuth, user, ipString(clientOf(ctx)))
+	if err != nil {
+		return "", newError(ErrAuthFailed, err.Error())
+	}
+
+	switch v := luaArg(rs, 0).(type) {
+	case nil:
+	case bool:
+		if !v {
+			why := "refused by script"
+			if r := luaArg(rs, 1); r != nil {
+				why += ": " + luaString(r)
+			}
+			return "", newError(ErrAuthFailed, why)
+		}
+	case string:
+		if len(v) == 0 {
+			return "", newError(ErrAuthFailed, "refused by script")
+		}
+		return v, nil
+	default:
+		if err := h.failed(hookAuth, fmt.Errorf("returned a %s", luaType(v))); err != nil {
+			return "", newError(ErrAuthFailed, err.Error())
+		}
+	}
+	return user, nil
+}
+
+// Return the route of 'host:port' for the client and user in 'ctx'; an
+// error denies it
+func (h *scriptHooks) route(ctx context.Context, host string, port int) (Route, error) {
+	sr := Route{rule: SCRIPT_RULE}
+	if !h.has(hookRoute) {
+		return sr, nil
+	}
+
+	dest := newLuaTable()
+	dest.set("user", userOf(ctx))
+	dest.set("client", ipString(clientOf(ctx)))
+	dest.set("host", host)
+	dest.set("port", float64(port))
+	dest.set("listener", h.listen)
+
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	rs, err := h.call(hookRoute, dest)
+	if err != nil {
+		return sr, &policyErr{rule: SCRIPT_RULE, dest: addr}
+	}
+
+	switch v := luaArg(rs, 0); v {
+	case nil:
+	case "deny":
+		rule := SCRIPT_RULE
+		if r, ok := luaArg(rs, 1).(string); ok && len(r) > 0 {
+			rule = r
+		}
+		return sr, &policyErr{rule: rule, dest: addr}
+	case "direct":
+		sr.Via = "direct"
+	case "wireguard", "jump":
+		name, ok := luaArg(rs, 1).(string)
+		if !ok || len(name) == 0 {
+			err = fmt.Errorf("returned %s without a name", v)
+			break
+		}
+		sr.Via, sr.Name = v.(string), name
+	default:
+		err = fmt.Errorf("returned %.64q", luaString(v))
+	}
+	if err != nil {
+		if err = h.failed(hookRoute, err); err != nil {
+			return Route{}, &policyErr{rule: SCRIPT_RULE, dest: addr}
+		}
+		return Route{}, nil
+	}
+	return sr, nil
+}
+
+// A table of the headers 'hdr': names in canonical form, values joined
+// with ", "
+func headerTable(hdr http.Header) (*luaTable, map[string]string) {
+	t := newLuaTable()
+	was := make(map[string]string, len(hdr))
+	for k, v := range hdr {
+		s := strings.Join(v, ", ")
+		t.set(k, s)
+		was[k] = s
+	}
+	return t, was
+}
+
+// Apply the changes the script made to the headers in 't' to 'hdr'; a
+// value is a string, a list of strings or nil (deleted)
+func applyHeaders(hdr http.Header, t *luaTable, was map[string]string) error {
+	for k := range was {
+		if t.get(k) == nil {
+			hdr.Del(k)
+			if k == "User-Agent" {
+				// else the transport sends its own
+				hdr[k] = nil
+			}
+		}
+	}
+	for _, kv := range t.keys() {
+		k, ok := kv.(string)
+		if !ok || !validHeaderName(k) {
+			return fmt.Errorf("bad header name %.64q", luaString(kv))
+		}
+
+		var vals []string
+		switch v := t.get(k).(type) {
+		case string:
+			if old, ok := was[k]; ok && old == v {
+				continue
+			}
+			vals = []string{v}
+		case float64:
+			vals = []string{luaNumString(v)}
+		case *luaTable:
+			for i := 1; i <= v.length(); i++ {
+				s, ok := v.get(float64(i)).(string)
+				if !ok {
+					return fmt.Errorf("header %s: not a list of strings", k)
+				}
+				vals = append(vals, s)
+			}
+		default:
+			return fmt.Errorf("header %s: a %s value", k, luaType(v))
+		}
+		for _, s := range vals {
+			if strings.ContainsAny(s, "\r\n\x00") {
+				return fmt.Errorf("header %s: bad value %.64q", k, s)
+			}
+		}
+		hdr.Del(k)
+		for _, s := range vals {
+			hdr.Add(k, s)
+		}
+	}
+	return nil
+}
+
+func validHeaderName(k string) bool {
+	if len(k) == 0 {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A table of the request 'r' for the hooks
+func (h *scriptHooks) requestTable(ctx context.Context, r *http.Request) *luaTable {
+	t := newLuaTable()
+	t.set("method", r.Method)
+	t.set("url", r.URL.String())
+	t.set("host", r.Host)
+	t.set("user", userOf(ctx))
+	t.set("client", ipString(clientOf(ctx)))
+	t.set("listener", h.listen)
+	return t
+}
+
+// Run the request hook on 'req' (a copy of the client's request 'r');
+// an error denies it
+func (h *scriptHooks) request(ctx context.Context, r, req *http.Request) error {
+	if !h.has(hookRequest) {
+		return nil
+	}
+
+	t := h.requestTable(ctx, r)
+	hdr, was := headerTable(req.Header)
+	t.set("headers", hdr)
+
+	deny := &policyErr{rule: SCRIPT_RULE, dest: r.Host}
+	rs, err := h.call(hookRequest, t)
+	if err != nil {
+		return deny
+	}
+	switch v := luaArg(rs, 0); v {
+	case nil:
+	case "deny":
+		if rn, ok := luaArg(rs, 1).(string); ok && len(rn) > 0 {
+			deny.rule = rn
+		}
+		return deny
+	default:
+		err = fmt.Errorf("returned %.64q", luaString(v))
+	}
+	if err == nil {
+		if x, ok := t.get("headers").(*luaTable); ok {
+			err = applyHeaders(req.Header, x, was)
+		} else {
+			err = fmt.Errorf("req.headers isn't a table")
+		}
+	}
+	if err != nil {
+		if h.failed(hookRequest, err) != nil {
+			return deny
+		}
+	}
+	return nil
+}
+
+// Run the response hook on the headers 'hdr' of the response with
+// 'status' to 'r'; an error means the response can't be sent
+func (h *scriptHooks) response(ctx context.Context, r *http.Request, status int, hdr http.Header) error {
+	if !h.has(hookResponse) {
+		return nil
+	}
+
+	t := h.requestTable(ctx, r)
+	t.set("status", float64(status))
+	ht, was := headerTable(hdr)
+	t.set("headers", ht)
+
+	if _, err := h.call(hookResponse, t); err != nil {
+		return err
+	}
+	x, ok := t.get("headers").(*luaTable)
+	if !ok {
+		return h.failed(hookResponse, fmt.Errorf("res.headers isn't a table"))
+	}
+	if err := applyHeaders(hdr, x, was); err != nil {
+		return h.failed(hookResponse, err)
+	}
+	return nil
+}
+
+// Script metrics for the admin listener
+func (h *scriptHooks) metrics() []metric {
+	var v []metric
+	for n := 0; n < nHooks; n++ {
+		if !h.script().has(hookNames[n]) {
+			continue
+		}
+		l := fmt.Sprintf("listener=%q,hook=%q", h.listen, hookNames[n])
+		v = append(v,
+			metric{"goproxy_script_calls_total", "counter", "Calls of script hooks", l,
+				float64(atomic.LoadUint64(&h.calls[n]))},
+			metric{"goproxy_script_errors_total", "counter", "Script hook calls that failed", l,
+				float64(atomic.LoadUint64(&h.errors[n]))},
+			metric{"goproxy_script_timeouts_total", "counter",
+				"Script hook calls that ran out of time or steps", l,
+				float64(atomic.LoadUint64(&h.timeouts[n]))})
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,227 @@
+// script_test.go -- tests for the scripting hooks of listeners
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func writeScript(t *testing.T, src string) string {
+	fn := filepath.Join(t.TempDir(), "hooks.lua")
+	if err := os.WriteFile(fn, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestScriptProxy(t *testing.T) {
+	hdrs := make(chan http.Header, 4)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdrs <- r.Header
+		w.Header().Set("X-Origin", "yes")
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("denied origin: %s", r.URL)
+	}))
+	t.Cleanup(denied.Close)
+	echo := startEcho(t)
+
+	_, dport, _ := net.SplitHostPort(denied.Listener.Addr().String())
+	fn := writeScript(t, `
+		function auth(user, client)
+			return user .. "@" .. client
+		end
+		function route(d)
+			if d.port == `+dport+` then return "deny", "no-port" end
+		end
+		function request(r)
+			r.headers["X-User"] = r.user
+			r.headers["User-Agent"] = nil
+			if r.url:find("/forbidden", 1, true) then return "deny" end
+		end
+		function response(r)
+			r.headers["X-Status"] = r.status
+			r.headers["X-Origin"] = nil
+		end
+	`)
+	addr := startHTTPProxy(t, &ListenConf{Auth: authConf(t), Script: ScriptConf{File: fn}})
+
+	pu := &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("alice", "wonder")}
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	get := func(u string) *http.Response {
+		res, err := hc.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	// the user is renamed and sent; the response headers are changed
+	res := get(origin.URL + "/")
+	h := <-hdrs
+	if res.StatusCode != 200 || h.Get("X-User") != "alice@127.0.0.1" || len(h.Get("User-Agent")) > 0 {
+		t.Errorf("request: %d %v", res.StatusCode, h)
+	}
+	if res.Header.Get("X-Status") != "200" || len(res.Header.Get("X-Origin")) > 0 {
+		t.Errorf("response: %v", res.Header)
+	}
+
+	if res = get(origin.URL + "/forbidden"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("forbidden: %d", res.StatusCode)
+	}
+	if res = get(denied.URL + "/"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("route: %d", res.StatusCode)
+	}
+
+	// tunnels are routed by the script too
+	c, br := connectTunnel(t, addr, echo.Addr().String(), "alice", "wonder")
+	io.WriteString(c, "ping\n")
+	if s, err := br.ReadString('\n'); err != nil || s != "ping\n" {
+		t.Errorf("tunnel: %q %v", s, err)
+	}
+	c.Close()
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func findMetric(v []metric, name, label string) float64 {
+	for _, m := range v {
+		if m.name == name && strings.Contains(m.labels, label) {
+			return m.value
+		}
+	}
+	return -1
+}
+
+func TestScriptHooks(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ctx := withClient(context.Background(), net.ParseIP("192.0.2.7"))
+
+	if _, err := newScriptHooks(&ScriptConf{File: writeScript(t, "x = 1")}, "l", log); err == nil {
+		t.Errorf("no hooks: no error")
+	}
+	if _, err := newScriptHooks(&ScriptConf{File: writeScript(t, "function auth( end")}, "l", log); err == nil {
+		t.Errorf("syntax: no error")
+	}
+	if h, err := newScriptHooks(&ScriptConf{}, "l", log); h != nil || err != nil {
+		t.Errorf("none: %v %v", h, err)
+	}
+
+	fn := writeScript(t, `
+		staff = {alice = true}
+		function auth(user, client)
+			if user == "spin" then while true do end end
+			if user == "odd" then return {} end
+			if not staff[user] then return false, "not staff" end
+			if net.contains("192.0.2.0/24", client) then return user .. "-lan" end
+		end
+		function route(d)
+			if d.host == "tunnel.example" then return "wireguard", "wg9" end
+			if d.host == "bad.example" then return "teleport" end
+		end
+	`)
+	h, err := newScriptHooks(&ScriptConf{File: fn, Steps: 5000}, "l", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := h.auth(ctx, "alice"); err != nil || u != "alice-lan" {
+		t.Errorf("alice: %q %v", u, err)
+	}
+	if u, err := h.auth(context.Background(), "alice"); err != nil || u != "alice" {
+		t.Errorf("no client: %q %v", u, err)
+	}
+	for _, u := range []string{"bob", "spin", "odd"} {
+		if _, err := h.auth(ctx, u); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: %v", u, err)
+		}
+	}
+	m := h.metrics()
+	if findMetric(m, "goproxy_script_calls_total", `hook="auth"`) != 5 ||
+		findMetric(m, "goproxy_script_errors_total", `hook="auth"`) != 2 ||
+		findMetric(m, "goproxy_script_timeouts_total", `hook="auth"`) != 1 ||
+		findMetric(m, "goproxy_script_calls_total", `hook="request"`) != -1 {
+		t.Errorf("metrics: %+v", m)
+	}
+
+	if sr, err := h.route(ctx, "tunnel.example", 443); err != nil || sr.Via != "wireguard" || sr.Name != "wg9" {
+		t.Errorf("route: %+v %v", sr, err)
+	}
+	if _, err := h.route(ctx, "bad.example", 443); isDenied(err) == nil {
+		t.Errorf("bad route: %v", err)
+	}
+
+	// failopen: a failing call is as if there was no script
+	h.failOpen = true
+	if u, err := h.auth(ctx, "spin"); err != nil || u != "spin" {
+		t.Errorf("failopen: %q %v", u, err)
+	}
+	if sr, err := h.route(ctx, "bad.example", 443); err != nil || len(sr.Via) > 0 {
+		t.Errorf("failopen route: %+v %v", sr, err)
+	}
+	h.failOpen = false
+
+	// a changed file is read again; one that doesn't compile is not
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(fn, []byte(`function auth(user) return "new-" .. user end`), 0600)
+	os.Chtimes(fn, later, later)
+	h.checked = time.Time{}
+	if u, _ := h.auth(ctx, "alice"); u != "new-alice" {
+		t.Errorf("reload: %q", u)
+	}
+	os.WriteFile(fn, []byte(`function auth(`), 0600)
+	os.Chtimes(fn, later.Add(time.Minute), later.Add(time.Minute))
+	h.checked = time.Time{}
+	if u, _ := h.auth(ctx, "alice"); u != "new-alice" {
+		t.Errorf("bad reload: %q", u)
+	}
+	if h.has(hookRoute) {
+		t.Errorf("route after reload")
+	}
+
+	// header changes
+	hdr := http.Header{"Set-Cookie": {"a=1", "b=2"}, "X-Drop": {"x"}}
+	ht, was := headerTable(hdr)
+	ht.set("X-Drop", nil)
+	list := newLuaTable()
+	list.set(float64(1), "one")
+	list.set(float64(2), "two")
+	ht.set("x-list", list)
+	if err := applyHeaders(hdr, ht, was); err != nil || len(hdr["Set-Cookie"]) != 2 ||
+		len(hdr.Get("X-Drop")) > 0 || strings.Join(hdr.Values("X-List"), " ") != "one two" {
+		t.Errorf("headers: %v %v", hdr, err)
+	}
+	for k, v := range map[string]string{"X-Bad": "a\r\nb", "Bad Name": "x"} {
+		ht, was := headerTable(http.Header{})
+		ht.set(k, v)
+		if err := applyHeaders(http.Header{}, ht, was); err == nil {
+			t.Errorf("%q: no error", k)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
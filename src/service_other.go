@@ -0,0 +1,34 @@
+// service_other.go -- windows services on other platforms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func serviceCommand(args []string) []string {
+	die("service: windows services are only available on windows")
+	return nil
+}
+
+func serviceNotify(c chan<- os.Signal) {}
+
+func serviceReady() {}
+
+func serviceStopped() {}
+
+func newEventLog() (io.Writer, error) {
+	return nil, errors.New("the event log is only available on windows")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
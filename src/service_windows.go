@@ -0,0 +1,460 @@
+// service_windows.go -- running as a windows service
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	flag "github.com/opencoff/pflag"
+)
+
+// "goproxy service install" registers goproxy with the service control
+// manager, its config path in the registry and an event log source.
+// The SCM starts "goproxy service run"; that connects to the SCM, and
+// goproxy then runs as usual until the SCM stops it.
+
+const (
+	SERVICE_NAME = "goproxy"
+
+	_SERVICE_WIN32_OWN_PROCESS  = 0x10
+	_SERVICE_AUTO_START         = 2
+	_SERVICE_ERROR_NORMAL       = 1
+	_SERVICE_CONFIG_DESCRIPTION = 1
+
+	_SC_MANAGER_ALL_ACCESS = 0xf003f
+	_SERVICE_ALL_ACCESS    = 0xf01ff
+
+	_SERVICE_STOPPED       = 1
+	_SERVICE_START_PENDING = 2
+	_SERVICE_STOP_PENDING  = 3
+	_SERVICE_RUNNING       = 4
+
+	_SERVICE_ACCEPT_STOP     = 1
+	_SERVICE_ACCEPT_SHUTDOWN = 4
+
+	_SERVICE_CONTROL_STOP        = 1
+	_SERVICE_CONTROL_INTERROGATE = 4
+	_SERVICE_CONTROL_SHUTDOWN    = 5
+
+	_ERROR_CALL_NOT_IMPLEMENTED = 120
+
+	_EVENTLOG_ERROR_TYPE       = 1
+	_EVENTLOG_WARNING_TYPE     = 2
+	_EVENTLOG_INFORMATION_TYPE = 4
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procOpenSCManager          = advapi32.NewProc("OpenSCManagerW")
+	procCreateService          = advapi32.NewProc("CreateServiceW")
+	procOpenService            = advapi32.NewProc("OpenServiceW")
+	procDeleteService          = advapi32.NewProc("DeleteService")
+	procStartService           = advapi32.NewProc("StartServiceW")
+	procControlService         = advapi32.NewProc("ControlService")
+	procCloseServiceHandle     = advapi32.NewProc("CloseServiceHandle")
+	procChangeServiceConfig2   = advapi32.NewProc("ChangeServiceConfig2W")
+	procStartServiceDispatcher = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceHandler = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus       = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource    = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent            = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx         = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx          = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKey           = advapi32.NewProc("RegDeleteKeyW")
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	serviceType  uint32
+	state        uint32
+	accepts      uint32
+	exitCode     uint32
+	specificExit uint32
+	checkPoint   uint32
+	waitHint     uint32
+}
+
+// The service this process runs as; empty name if it doesn't
+var service = struct {
+	sync.Mutex
+	name   string
+	handle uintptr
+	status serviceStatus
+	sig    chan<- os.Signal
+	done   chan struct{}
+}{name: SERVICE_NAME}
+
+func utf16(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
+
+// Call an advapi32 function that returns a handle or BOOL
+func advapi(p *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := p.Call(args...)
+	if r == 0 {
+		return 0, fmt.Errorf("%s: %s", p.Name, err)
+	}
+	return r, nil
+}
+
+func serviceCommand(args []string) []string {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.StringP("name", "n", SERVICE_NAME, "Service `name`")
+	cfg := fs.StringP("config", "c", "", "Config `file` (run: default from the registry)")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s service install|remove|start|stop|run [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cmd := args[0]
+	fs.Parse(args[1:])
+
+	var err error
+	switch cmd {
+	case "install":
+		err = installService(*name, *cfg)
+	case "remove":
+		err = removeService(*name)
+	case "start", "stop":
+		err = controlService(*name, cmd)
+	case "run":
+		if len(*cfg) == 0 {
+			if *cfg, err = serviceConfig(*name); err != nil {
+				die("service %s: %s", *name, err)
+			}
+		}
+		if err = runService(*name); err != nil {
+			die("service %s: %s", *name, err)
+		}
+		return []string{*cfg}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		die("service %s: %s", *name, err)
+	}
+	os.Exit(0)
+	return nil
+}
+
+// Register the service 'name' that runs goproxy with the config 'cfg'
+func installService(name, cfg string) error {
+	if len(cfg) == 0 {
+		return errors.New("no config file (-c)")
+	}
+	cfg, err := filepath.Abs(cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := ReadYAML(cfg); err != nil {
+		return fmt.Errorf("can't read config file %s: %s", cfg, err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	scm, err := advapi(procOpenSCManager, 0, 0, _SC_MANAGER_ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	bin := fmt.Sprintf(`"%s" service run -n "%s"`, exe, name)
+	h, err := advapi(procCreateService, scm, uintptr(unsafe.Pointer(utf16(name))),
+		uintptr(unsafe.Pointer(utf16("goproxy "+name))), _SERVICE_ALL_ACCESS,
+		_SERVICE_WIN32_OWN_PROCESS, _SERVICE_AUTO_START, _SERVICE_ERROR_NORMAL,
+		uintptr(unsafe.Pointer(utf16(bin))), 0, 0, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(h)
+
+	desc := utf16("HTTP/SOCKSv5/DNS proxy")
+	procChangeServiceConfig2.Call(h, _SERVICE_CONFIG_DESCRIPTION, uintptr(unsafe.Pointer(&desc)))
+
+	if err := setRegString(`SYSTEM\CurrentControlSet\Services\`+name+`\Parameters`,
+		"ConfigFile", syscall.REG_SZ, cfg); err != nil {
+		return err
+	}
+
+	// event log messages are the strings goproxy gives
+	ev := `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + name
+	if err := setRegString(ev, "EventMessageFile", syscall.REG_EXPAND_SZ,
+		`%SystemRoot%\System32\EventCreate.exe`); err != nil {
+		return err
+	}
+	if err := setRegDword(ev, "TypesSupported",
+		_EVENTLOG_ERROR_TYPE|_EVENTLOG_WARNING_TYPE|_EVENTLOG_INFORMATION_TYPE); err != nil {
+		return err
+	}
+	fmt.Printf("installed service %s: %s (config %s)\n", name, bin, cfg)
+	return nil
+}
+
+func removeService(name string) error {
+	h, scm, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	defer procCloseServiceHandle.Call(h)
+
+	if _, err := advapi(procDeleteService, h); err != nil {
+		return err
+	}
+	procRegDeleteKey.Call(uintptr(syscall.HKEY_LOCAL_MACHINE),
+		uintptr(unsafe.Pointer(utf16(`SYSTEM\CurrentControlSet\Services\EventLog\Application\`+name))))
+	return nil
+}
+
+func controlService(name, cmd string) error {
+	h, scm, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	defer procCloseServiceHandle.Call(h)
+
+	if cmd == "start" {
+		_, err = advapi(procStartService, h, 0, 0)
+		return err
+	}
+	var st serviceStatus
+	_, err = advapi(procControlService, h, _SERVICE_CONTROL_STOP, uintptr(unsafe.Pointer(&st)))
+	return err
+}
+
+func openService(name string) (h, scm uintptr, err error) {
+	if scm, err = advapi(procOpenSCManager, 0, 0, _SC_MANAGER_ALL_ACCESS); err != nil {
+		return 0, 0, err
+	}
+	if h, err = advapi(procOpenService, scm, uintptr(unsafe.Pointer(utf16(name))),
+		_SERVICE_ALL_ACCESS); err != nil {
+		procCloseServiceHandle.Call(scm)
+		return 0, 0, err
+	}
+	return h, scm, nil
+}
+
+// The config file of the service 'name' in the registry
+func serviceConfig(name string) (string, error) {
+	var k syscall.Handle
+	key := `SYSTEM\CurrentControlSet\Services\` + name + `\Parameters`
+	if err := syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, utf16(key), 0,
+		syscall.KEY_READ, &k); err != nil {
+		return "", fmt.Errorf("no config file (-c) and no HKLM\\%s: %s", key, err)
+	}
+	defer syscall.RegCloseKey(k)
+
+	var typ uint32
+	buf := make([]uint16, syscall.MAX_PATH)
+	n := uint32(len(buf) * 2)
+	if err := syscall.RegQueryValueEx(k, utf16("ConfigFile"), nil, &typ,
+		(*byte)(unsafe.Pointer(&buf[0])), &n); err != nil {
+		return "", fmt.Errorf("HKLM\\%s\\ConfigFile: %s", key, err)
+	}
+	return syscall.UTF16ToString(buf), nil
+}
+
+func setRegValue(key, name string, typ uint32, data *byte, n int) error {
+	var k syscall.Handle
+	var disp uint32
+	r, _, _ := procRegCreateKeyEx.Call(uintptr(syscall.HKEY_LOCAL_MACHINE),
+		uintptr(unsafe.Pointer(utf16(key))), 0, 0, 0, syscall.KEY_WRITE, 0,
+		uintptr(unsafe.Pointer(&k)), uintptr(unsafe.Pointer(&disp)))
+	if r != 0 {
+		return fmt.Errorf("HKLM\\%s: %s", key, syscall.Errno(r))
+	}
+	defer syscall.RegCloseKey(k)
+
+	r, _, _ = procRegSetValueEx.Call(uintptr(k), uintptr(unsafe.Pointer(utf16(name))), 0,
+		uintptr(typ), uintptr(unsafe.Pointer(data)), uintptr(n))
+	if r != 0 {
+		return fmt.Errorf("HKLM\\%s\\%s: %s", key, name, syscall.Errno(r))
+	}
+	return nil
+}
+
+func setRegString(key, name string, typ uint32, v string) error {
+	s, err := syscall.UTF16FromString(v)
+	if err != nil {
+		return err
+	}
+	return setRegValue(key, name, typ, (*byte)(unsafe.Pointer(&s[0])), len(s)*2)
+}
+
+func setRegDword(key, name string, v uint32) error {
+	return setRegValue(key, name, syscall.REG_DWORD, (*byte)(unsafe.Pointer(&v)), 4)
+}
+
+// Connect to the SCM as the service 'name'; return when it started the
+// service, which runs until serviceStopped.
+func runService(name string) error {
+	started := make(chan error, 1)
+	service.Lock()
+	service.name = name
+	service.done = make(chan struct{})
+	service.Unlock()
+
+	handler := syscall.NewCallback(func(ctl, evtype uint32, data, ctx uintptr) uintptr {
+		switch ctl {
+		case _SERVICE_CONTROL_STOP, _SERVICE_CONTROL_SHUTDOWN:
+			setServiceState(_SERVICE_STOP_PENDING)
+			service.Lock()
+			c := service.sig
+			service.Unlock()
+			if c != nil {
+				select {
+				case c <- syscall.SIGTERM:
+				default:
+				}
+			}
+		case _SERVICE_CONTROL_INTERROGATE:
+			service.Lock()
+			st := service.status
+			service.Unlock()
+			setServiceState(st.state)
+		default:
+			return _ERROR_CALL_NOT_IMPLEMENTED
+		}
+		return 0
+	})
+
+	svcMain := syscall.NewCallback(func(argc uint32, argv **uint16) uintptr {
+		h, err := advapi(procRegisterServiceHandler, uintptr(unsafe.Pointer(utf16(name))), handler, 0)
+		if err != nil {
+			started <- err
+			return 0
+		}
+		service.Lock()
+		service.handle = h
+		service.Unlock()
+		setServiceState(_SERVICE_START_PENDING)
+		started <- nil
+
+		// the dispatcher returns when this does
+		<-service.done
+		return 0
+	})
+
+	table := []struct {
+		name *uint16
+		proc uintptr
+	}{{utf16(name), svcMain}, {nil, 0}}
+
+	go func() {
+		runtime.LockOSThread()
+		if _, err := advapi(procStartServiceDispatcher, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+			started <- fmt.Errorf("not started by the service manager: %s", err)
+		}
+	}()
+	return <-started
+}
+
+func setServiceState(state uint32) {
+	service.Lock()
+	defer service.Unlock()
+	if service.handle == 0 {
+		return
+	}
+	service.status = serviceStatus{serviceType: _SERVICE_WIN32_OWN_PROCESS, state: state}
+	if state == _SERVICE_RUNNING {
+		service.status.accepts = _SERVICE_ACCEPT_STOP | _SERVICE_ACCEPT_SHUTDOWN
+	}
+	if state == _SERVICE_START_PENDING || state == _SERVICE_STOP_PENDING {
+		service.status.checkPoint++
+		service.status.waitHint = 30000
+	}
+	procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&service.status)))
+}
+
+// Stop requests of the SCM arrive on 'c' as SIGTERM
+func serviceNotify(c chan<- os.Signal) {
+	service.Lock()
+	service.sig = c
+	service.Unlock()
+}
+
+// Tell the SCM the service runs
+func serviceReady() {
+	setServiceState(_SERVICE_RUNNING)
+}
+
+// Tell the SCM the service stopped
+func serviceStopped() {
+	setServiceState(_SERVICE_STOPPED)
+	service.Lock()
+	defer service.Unlock()
+	if service.done != nil {
+		close(service.done)
+		service.done = nil
+	}
+}
+
+// The windows event log of the service as the destination of a logger
+type eventLog struct {
+	sync.Mutex
+	h uintptr
+}
+
+func newEventLog() (io.Writer, error) {
+	service.Lock()
+	name := service.name
+	service.Unlock()
+
+	h, err := advapi(procRegisterEventSource, 0, uintptr(unsafe.Pointer(utf16(name))))
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{h: h}, nil
+}
+
+// Lines of the logger start with "<prio>:"
+func (e *eventLog) Write(b []byte) (int, error) {
+	s := strings.TrimRight(string(b), "\r\n")
+	typ := uintptr(_EVENTLOG_INFORMATION_TYPE)
+	if len(s) > 3 && s[0] == '<' && s[2] == '>' {
+		switch {
+		case s[1] >= '4':
+			typ = _EVENTLOG_ERROR_TYPE
+		case s[1] == '3':
+			typ = _EVENTLOG_WARNING_TYPE
+		}
+		s = strings.TrimPrefix(s[3:], ":")
+	}
+
+	p := utf16(s)
+	e.Lock()
+	defer e.Unlock()
+	if _, err := advapi(procReportEvent, e.h, typ, 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&p)), 0); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,447 @@
+// sessions.go -- live tunnels and their transfer rates
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Least time between two samples of a tunnel's rates
+const SESSION_SAMPLE = time.Second
+
+// Why a session was cut short
+var (
+	errSessionKilled = errors.New("killed on the admin listener")
+	errRuleDeadline  = errors.New("rule deadline reached")
+)
+
+// A tunnel (CONNECT, UPGRADE or SOCKS) that is open now
+type liveSession struct {
+	id       string
+	listener string
+	proto    string
+	tenant   string
+	user     string
+	client   net.IP
+	dest     string
+	start    time.Time
+	cp       *CancellableCopier // nil in tests
+	moved    func() (in, out int64)
+	route    string      // labels of the latency histograms
+	kill     func(error) // cancels the session's context; nil if none
+
+	// the last sample and the rates since the one before it; under
+	// the lock of liveSessions
+	t           time.Time
+	in, out     int64
+	inBs, outBs float64
+
+	// bytes counted in the top talkers so far
+	told int64
+}
+
+// The tunnels that are open, by id
+var liveSessions = struct {
+	sync.Mutex
+	m map[string]*liveSession
+}{m: make(map[string]*liveSession)}
+
+// A tunnel as the admin listener shows it
+type sessionStat struct {
+	ID       string  `json:"id"`
+	Listener string  `json:"listener"`
+	Proto    string  `json:"proto"`
+	Tenant   string  `json:"tenant,omitempty"`
+	User     string  `json:"user,omitempty"`
+	Client   string  `json:"client"`
+	Dest     string  `json:"dest"`
+	Start    int64   `json:"start"` // unix time
+	Age      float64 `json:"age"`   // seconds
+	In       int64   `json:"in"`    // bytes from the client
+	Out      int64   `json:"out"`   // bytes to the client
+	InRate   float64 `json:"in_rate"`
+	OutRate  float64 `json:"out_rate"` // bytes/sec
+}
+
+// The id of a session (a request, tunnel or SOCKS connection) and its
+// logger, which starts each line with the id
+type sessionCtx struct {
+	id     string
+	log    *L.Logger
+	cancel context.CancelCauseFunc
+
+	// the rule that allowed the destination and the upstream it was
+	// reached through; set when it is dialed
+	sync.Mutex
+	rule     string
+	upstream string
+	deadline *time.Timer // of the rule; nil if none
+}
+
+// Return a new session id
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Return a context for a new session logged through 'log', and the func
+// that ends it. The resolves, dials and relays of the session stop when
+// the context ends: with the session, on the deadline of the rule that
+// allowed it or when it is killed on the admin listener.
+func withSession(ctx context.Context, log *L.Logger) (context.Context, func()) {
+	id := newSessionID()
+	s := &sessionCtx{id: id, log: log.New(id, 0)}
+	ctx, s.cancel = context.WithCancelCause(ctx)
+	return context.WithValue(ctx, ctxSession, s), s.end
+}
+
+// End the session
+func (s *sessionCtx) end() {
+	s.Lock()
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+	s.Unlock()
+	s.cancel(nil)
+}
+
+// Return why the session of 'ctx' was cut short - it was killed or its
+// rule's deadline passed; nil if it wasn't
+func cutShort(ctx context.Context) error {
+	switch err := context.Cause(ctx); err {
+	case errSessionKilled, errRuleDeadline:
+		return err
+	}
+	return nil
+}
+
+// Return the session id in 'ctx' (or "")
+func sessionOf(ctx context.Context) string {
+	if s, ok := ctx.Value(ctxSession).(*sessionCtx); ok {
+		return s.id
+	}
+	return ""
+}
+
+// Return the logger of the session in 'ctx'; 'log' if there is none
+func logOf(ctx context.Context, log *L.Logger) *L.Logger {
+	if s, ok := ctx.Value(ctxSession).(*sessionCtx); ok {
+		return s.log
+	}
+	return log
+}
+
+// Note the rule 'r' (nil if none matched) and the upstream of the
+// session in 'ctx'
+func setRoute(ctx context.Context, r *rule, upstream string) {
+	s, ok := ctx.Value(ctxSession).(*sessionCtx)
+	if !ok {
+		return
+	}
+	name := "default"
+	if r != nil {
+		name = r.name
+	}
+	s.Lock()
+	s.rule, s.upstream = name, upstream
+	if r != nil && r.deadline > 0 && s.deadline == nil && s.cancel != nil {
+		s.deadline = time.AfterFunc(r.deadline, func() {
+			s.cancel(errRuleDeadline)
+		})
+	}
+	s.Unlock()
+}
+
+// Return the rule and upstream of the session in 'ctx'; empty if it
+// hasn't been dialed
+func routeOf(ctx context.Context) (string, string) {
+	s, ok := ctx.Value(ctxSession).(*sessionCtx)
+	if !ok {
+		return "", ""
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.rule, s.upstream
+}
+
+// Track the tunnel 'cp' of the client in 'ctx' to 'dest' until done() is
+// called; 'moved' returns the bytes from and to the client so far. A
+// capture waiting for the tunnel starts.
+func startSession(ctx context.Context, listener, proto, dest string, cp *CancellableCopier,
+	moved func() (int64, int64)) *liveSession {
+	id := sessionOf(ctx)
+	if len(id) == 0 {
+		id = newSessionID()
+	}
+	now := time.Now()
+	s := &liveSession{
+		id:       id,
+		listener: listener,
+		proto:    proto,
+		tenant:   tenantOf(ctx),
+		user:     userOf(ctx),
+		client:   clientOf(ctx),
+		dest:     dest,
+		start:    now,
+		cp:       cp,
+		moved:    moved,
+		route:    routeLabels(ctx, listener),
+		t:        now,
+	}
+	if sc, ok := ctx.Value(ctxSession).(*sessionCtx); ok && sc.cancel != nil {
+		s.kill = sc.cancel
+	}
+
+	liveSessions.Lock()
+	liveSessions.m[s.id] = s
+	liveSessions.Unlock()
+
+	if cp == nil {
+		return s
+	}
+	if t := s.wanted(now); t != nil {
+		t.start(cp)
+		cp.Tap(t)
+	}
+	return s
+}
+
+// The tunnel is closed
+func (s *liveSession) done() {
+	now := time.Now()
+	liveSessions.Lock()
+	delete(liveSessions.m, s.id)
+	s.count(1, now)
+	liveSessions.Unlock()
+	if events != nil {
+		in, out := s.moved()
+		events.session(s.id, s.listener, s.proto, s.tenant, s.user, s.client, s.dest, s.start,
+			in, out, now)
+	}
+	noteSession(false)
+	observe("goproxy_session_seconds", fmt.Sprintf("%s,proto=%q", s.route, s.proto), now.Sub(s.start))
+
+	if s.cp != nil {
+		if t := s.cp.tap.Load(); t != nil {
+			t.Close()
+		}
+	}
+}
+
+// Capture the tunnel from now on to 't'
+func (s *liveSession) capture(t *capture) error {
+	if s.cp == nil {
+		return fmt.Errorf("capture: tunnel %s can't be captured", s.id)
+	}
+	t.start(s.cp)
+	return s.cp.Tap(t)
+}
+
+// Return the open tunnel 'id' or nil
+func findSession(id string) *liveSession {
+	liveSessions.Lock()
+	defer liveSessions.Unlock()
+	return liveSessions.m[id]
+}
+
+// Kill the open tunnel 'id', or those of 'user' of 'tenant' if 'id' is
+// ""; return how many were killed
+func killSessions(id, tenant, user string) int {
+	var kill []func(error)
+	liveSessions.Lock()
+	for _, s := range liveSessions.m {
+		if s.kill == nil || (len(id) > 0 && s.id != id) ||
+			(len(id) == 0 && (s.tenant != tenant || s.user != user)) {
+			continue
+		}
+		kill = append(kill, s.kill)
+	}
+	liveSessions.Unlock()
+
+	for _, k := range kill {
+		k(errSessionKilled)
+	}
+	return len(kill)
+}
+
+// Count the bytes moved since the last count and 'n' sessions in the
+// top talkers; the caller holds the lock of liveSessions.
+func (s *liveSession) count(n int64, now time.Time) {
+	in, out := s.moved()
+	talk(tenantUser(s.tenant, s.user), s.client, s.dest, in+out-s.told, n, now)
+	exports.add(s.tenant, s.user, s.dest, in+out-s.told, n, now)
+	s.told = in + out
+}
+
+// Count the bytes of the open tunnels in the top talkers, so that long
+// tunnels show up in the windows they move data in.
+func countSessions(now time.Time) {
+	liveSessions.Lock()
+	for _, s := range liveSessions.m {
+		s.count(0, now)
+	}
+	liveSessions.Unlock()
+}
+
+// Return the stats of the open tunnels of 'user' (all if it is ""), the
+// busiest first. The rates are those between the last two samples; a
+// tunnel is sampled when it is looked at, at most every SESSION_SAMPLE.
+func sessionStats(user string, now time.Time) []sessionStat {
+	liveSessions.Lock()
+	defer liveSessions.Unlock()
+
+	v := make([]sessionStat, 0, len(liveSessions.m))
+	for _, s := range liveSessions.m {
+		if len(user) > 0 && s.user != user {
+			continue
+		}
+		var client string
+		if s.client != nil {
+			client = s.client.String()
+		}
+
+		in, out := s.moved()
+		if dt := now.Sub(s.t); dt >= SESSION_SAMPLE {
+			sec := dt.Seconds()
+			s.inBs = float64(in-s.in) / sec
+			s.outBs = float64(out-s.out) / sec
+			s.t, s.in, s.out = now, in, out
+		}
+		v = append(v, sessionStat{
+			ID:       s.id,
+			Listener: s.listener,
+			Proto:    s.proto,
+			Tenant:   s.tenant,
+			User:     s.user,
+			Client:   client,
+			Dest:     s.dest,
+			Start:    s.start.Unix(),
+			Age:      now.Sub(s.start).Round(time.Millisecond).Seconds(),
+			In:       in,
+			Out:      out,
+			InRate:   s.inBs,
+			OutRate:  s.outBs,
+		})
+	}
+
+	sort.Slice(v, func(i, j int) bool {
+		ri, rj := v[i].InRate+v[i].OutRate, v[j].InRate+v[j].OutRate
+		if ri != rj {
+			return ri > rj
+		}
+		return v[i].Start < v[j].Start
+	})
+	return v
+}
+
+// Tunnel counts for the admin listener
+type sessionCollector struct{}
+
+func (sessionCollector) metrics() []metric {
+	n := make(map[[2]string]int) // listener, proto
+	liveSessions.Lock()
+	for _, s := range liveSessions.m {
+		n[[2]string{s.listener, s.proto}]++
+	}
+	liveSessions.Unlock()
+
+	keys := make([][2]string, 0, len(n))
+	for k := range n {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	v := make([]metric, 0, len(keys))
+	for _, k := range keys {
+		v = append(v, metric{"goproxy_tunnels_open", "gauge", "Tunnels open now",
+			fmt.Sprintf("listener=%q,proto=%q", k[0], k[1]), float64(n[k])})
+	}
+	return v
+}
+
+func init() {
+	addCollector(sessionCollector{})
+}
+
+// The page of /dashboard: the open tunnels, busiest first, refreshed
+// every two seconds from /sessions
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>goproxy tunnels</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 2px 8px; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+<h3>Open tunnels <span id="n"></span></h3>
+<table>
+<thead><tr><th>User</th><th>Client</th><th>Destination</th><th>Proto</th><th>Listener</th>
+<th>Age</th><th>In/s</th><th>Out/s</th><th>In</th><th>Out</th></tr></thead>
+<tbody id="rows"></tbody>
+</table>
+<script>
+function size(b) {
+	var u = ["B", "KB", "MB", "GB", "TB"], i = 0;
+	while (b >= 1024 && i < u.length - 1) { b /= 1024; i++; }
+	return b.toFixed(i ? 1 : 0) + " " + u[i];
+}
+function age(s) {
+	var h = Math.floor(s / 3600), m = Math.floor(s % 3600 / 60);
+	return (h ? h + "h" : "") + (h || m ? m + "m" : "") + Math.floor(s % 60) + "s";
+}
+function cell(tr, s, n) {
+	var td = document.createElement("td");
+	td.textContent = s;
+	if (n) td.className = "n";
+	tr.appendChild(td);
+}
+function load() {
+	fetch("sessions", {credentials: "same-origin"}).then(function(r) { return r.json(); }).then(function(d) {
+		var rows = document.getElementById("rows");
+		rows.textContent = "";
+		document.getElementById("n").textContent = "(" + d.sessions.length + ")";
+		d.sessions.forEach(function(s) {
+			var tr = document.createElement("tr");
+			cell(tr, s.user || "-"); cell(tr, s.client); cell(tr, s.dest); cell(tr, s.proto);
+			cell(tr, s.listener); cell(tr, age(s.age), 1);
+			cell(tr, size(s.in_rate), 1); cell(tr, size(s.out_rate), 1);
+			cell(tr, size(s.in), 1); cell(tr, size(s.out), 1);
+			rows.appendChild(tr);
+		});
+	});
+}
+load();
+setInterval(load, 2000);
+</script>
+</body>
+</html>
+`
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,362 @@
+// sessions_test.go -- tests for live tunnel stats
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/net/proxy"
+)
+
+func TestSessionStats(t *testing.T) {
+	var in, out int64
+	moved := func() (int64, int64) { return atomic.LoadInt64(&in), atomic.LoadInt64(&out) }
+	idle := func() (int64, int64) { return 10, 10 }
+
+	ctx := withUser(withClient(context.Background(), net.ParseIP("192.0.2.7")), "alice")
+	a := startSession(ctx, "l1", "connect", "example.com:443", nil, moved)
+	b := startSession(withUser(context.Background(), "bob"), "l1", "socks", "example.net:22", nil, idle)
+	defer b.done()
+
+	now := a.start
+	atomic.StoreInt64(&in, 1000)
+	atomic.StoreInt64(&out, 4000)
+	v := sessionStats("", now.Add(2*time.Second))
+	if len(v) != 2 {
+		t.Fatalf("%d sessions", len(v))
+	}
+	s := v[0]
+	if s.ID != a.id || s.User != "alice" || s.Client != "192.0.2.7" || s.Dest != "example.com:443" {
+		t.Errorf("busiest: %+v", s)
+	}
+	if s.InRate != 500 || s.OutRate != 2000 || s.In != 1000 || s.Out != 4000 {
+		t.Errorf("rates: %+v", s)
+	}
+	if s.Age < 2 {
+		t.Errorf("age: %v", s.Age)
+	}
+
+	// No new sample before SESSION_SAMPLE; the rates stay
+	atomic.StoreInt64(&in, 5000)
+	if s := sessionStats("alice", now.Add(2500*time.Millisecond)); len(s) != 1 || s[0].InRate != 500 || s[0].In != 5000 {
+		t.Errorf("between samples: %+v", s)
+	}
+	if s := sessionStats("alice", now.Add(4*time.Second)); s[0].InRate != 2000 || s[0].OutRate != 0 {
+		t.Errorf("next sample: %+v", s[0])
+	}
+
+	m := sessionCollector{}.metrics()
+	if len(m) != 2 || m[0].labels != `listener="l1",proto="connect"` || m[0].value != 1 {
+		t.Errorf("metrics: %+v", m)
+	}
+
+	a.done()
+	if s := sessionStats("alice", now); len(s) != 0 {
+		t.Errorf("after done: %+v", s)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	ln := startEcho(t)
+	pw := writeHtpasswd(t, "alice:"+bcryptHash(t, "wonder")+"\n")
+	addr := startHTTPProxy(t, &ListenConf{Auth: AuthConf{Type: "htpasswd", Args: map[string]string{"file": pw}}})
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+
+	c, br := connectTunnel(t, addr, ln.Addr().String(), "alice", "wonder")
+	defer c.Close()
+	io.WriteString(c, "hello")
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, pass string) *http.Response {
+		req, _ := http.NewRequest("GET", u+path, nil)
+		req.SetBasicAuth("admin", pass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := get("/sessions?user=alice", "adm1n")
+	var out struct {
+		Sessions []sessionStat `json:"sessions"`
+	}
+	json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if res.StatusCode != 200 || len(out.Sessions) != 1 {
+		t.Fatalf("sessions: %d %+v", res.StatusCode, out)
+	}
+	s := out.Sessions[0]
+	if s.Proto != "connect" || s.Dest != ln.Addr().String() || s.Client != "127.0.0.1" || s.In != 5 || s.Out != 5 {
+		t.Errorf("session: %+v", s)
+	}
+
+	if res = get("/sessions?user=bob", "adm1n"); res.StatusCode != 200 {
+		t.Errorf("bob: %d", res.StatusCode)
+	} else {
+		json.NewDecoder(res.Body).Decode(&out)
+		if len(out.Sessions) != 0 {
+			t.Errorf("bob: %+v", out.Sessions)
+		}
+	}
+	res.Body.Close()
+
+	for _, tt := range []struct {
+		path, pass string
+		code       int
+	}{
+		{"/sessions", "nope", 401},
+		{"/sessions?limit=x", "adm1n", 400},
+		{"/dashboard", "nope", 401},
+		{"/dashboard", "adm1n", 200},
+	} {
+		res := get(tt.path, tt.pass)
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s: %d, want %d", tt.path, res.StatusCode, tt.code)
+		}
+		if tt.code == 200 && !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Errorf("%s: %s", tt.path, res.Header.Get("Content-Type"))
+		}
+	}
+
+	// The tunnel leaves the list when it closes
+	c.Close()
+	for i := 0; i < 100; i++ {
+		if len(sessionStats("alice", time.Now())) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("tunnel still listed after close")
+}
+
+// Wait for the tunnel 'c' to be closed by the proxy; return how long it
+// took
+func waitClosed(t *testing.T, what string, c net.Conn, br io.Reader) time.Duration {
+	t0 := time.Now()
+	c.SetReadDeadline(t0.Add(5 * time.Second))
+	if _, err := br.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("%s: tunnel still open: %v", what, err)
+	}
+	return time.Since(t0)
+}
+
+// Tunnels end when they are killed, on their rule's deadline and when
+// the listener stops
+func TestSessionKill(t *testing.T) {
+	ln := startEcho(t)
+	dest := ln.Addr().String()
+	addr := startHTTPProxy(t, &ListenConf{Auth: authConf(t)})
+	saddr := startSocksProxy(t, &ListenConf{Auth: authConf(t)})
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n")})
+
+	kill := func(q string) int {
+		req, _ := http.NewRequest("DELETE", u+"/sessions?"+q, nil)
+		req.SetBasicAuth("admin", "adm1n")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if n := kill(""); n != 400 {
+		t.Errorf("no id: %d", n)
+	}
+	if n := kill("id=nope"); n != 404 {
+		t.Errorf("no session: %d", n)
+	}
+
+	c, br := connectTunnel(t, addr, dest, "alice", "wonder")
+	defer c.Close()
+	d, _ := proxy.SOCKS5("tcp", saddr, &proxy.Auth{User: "alice", Password: "wonder"}, proxy.Direct)
+	sc, err := d.Dial("tcp", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	for len(sessionStats("alice", time.Now())) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	v := sessionStats("alice", time.Now())
+	if n := kill("id=" + v[0].ID); n != 200 {
+		t.Errorf("kill %s: %d", v[0].ID, n)
+	}
+	if n := kill("user=alice"); n != 200 {
+		t.Errorf("kill alice: %d", n)
+	}
+	waitClosed(t, "connect", c, br)
+	waitClosed(t, "socks", sc, sc)
+
+	// the rule's deadline
+	addr = startHTTPProxy(t, &ListenConf{
+		Rules: []RuleConf{{Name: "short", Dest: []string{"127.0.0.0/8"}, Action: "allow", Deadline: 1}},
+	})
+	c, br = connectTunnel(t, addr, dest, "", "")
+	defer c.Close()
+	if dt := waitClosed(t, "deadline", c, br); dt < 500*time.Millisecond {
+		t.Errorf("deadline: closed after %s", dt)
+	}
+
+	// hijacked tunnels close when the listener stops
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	px, err := NewHTTPProxy(&ListenConf{Listen: "127.0.0.1:0",
+		Rules: []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}}}, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Start()
+	c, br = connectTunnel(t, px.(*HTTPProxy).Addr().String(), dest, "", "")
+	defer c.Close()
+	go px.Stop()
+	if dt := waitClosed(t, "stop", c, br); dt > 2*time.Second {
+		t.Errorf("stop: closed after %s", dt)
+	}
+
+	if _, err := newRule(&RuleConf{Dest: []string{"127.0.0.1"}, Action: "allow", Deadline: -1}, 0); err == nil {
+		t.Errorf("negative deadline: no error")
+	}
+}
+
+// Start an origin that echoes what it reads
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// Open a CONNECT tunnel to 'dest' through the HTTP proxy at 'addr'
+func connectTunnel(t *testing.T, addr, dest, user, pass string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &http.Request{Header: http.Header{}}
+	x.SetBasicAuth(user, pass)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n",
+		dest, dest, x.Header.Get("Authorization"))
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 200 {
+		c.Close()
+		t.Fatalf("CONNECT: %v %v", res, err)
+	}
+	return c, br
+}
+
+func TestSessionID(t *testing.T) {
+	var lb, ub bytes.Buffer
+	log, _ := L.New(&lb, L.LOG_DEBUG, "goproxy", 0)
+	ulog, _ := L.New(&ub, L.LOG_INFO, "", 0)
+
+	got := make(chan string, 2)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("X-Request-Id")
+	}))
+	defer origin.Close()
+	echo := startEcho(t)
+
+	lc := &ListenConf{Listen: "127.0.0.1:0", RequestId: true,
+		Rules: []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}}}
+	px, err := NewHTTPProxy(lc, log, ulog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Start()
+	addr := px.(*HTTPProxy).Addr().String()
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+
+	// two requests on one connection are two sessions; a client's own
+	// X-Request-Id is kept
+	var ids []string
+	for _, h := range []string{"", "mine"} {
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		if len(h) > 0 {
+			req.Header.Set("X-Request-Id", h)
+		}
+		res, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ids = append(ids, <-got)
+	}
+	if len(ids[0]) != 16 || ids[1] != "mine" {
+		t.Errorf("X-Request-Id: %q", ids)
+	}
+	hc.CloseIdleConnections()
+
+	// the tunnel's id is that of its live session
+	c, br := connectTunnel(t, addr, echo.Addr().String(), "", "")
+	io.WriteString(c, "ping\n")
+	br.ReadString('\n')
+	ss := sessionStats("", time.Now())
+	if len(ss) != 1 {
+		t.Fatalf("sessions: %+v", ss)
+	}
+	c.Close()
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	px.Stop()
+	log.Close()
+	ulog.Close()
+
+	access := regexp.MustCompile(`method="(GET|CONNECT)".* id="([0-9a-f]{16})"`).FindAllStringSubmatch(ub.String(), -1)
+	if len(access) != 3 || access[0][2] != ids[0] || access[2][1] != "CONNECT" || access[2][2] != ss[0].ID {
+		t.Fatalf("access log: %q\n%s", access, ub.String())
+	}
+	for _, a := range access {
+		if !strings.Contains(lb.String(), "-"+a[2]+": ") {
+			t.Errorf("no log line of session %s:\n%s", a[2], lb.String())
+		}
+	}
+	if access[0][2] == access[1][2] {
+		t.Errorf("two requests, one id: %q", access)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,294 @@
+// sidecar.go -- running as a sidecar of a kubernetes pod
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Admin listener of a sidecar; only the pod reaches it
+	SIDECAR_ADMIN = "127.0.0.1:9090"
+
+	// Seconds between checks of the mounted config
+	SIDECAR_WATCH = 10
+)
+
+// Labels of the pod put on every metric: `pod="..",namespace=".."`
+var podLabels string
+
+// Return the identity of the pod from the downward API: the prefix of
+// the log lines and the labels of the metrics. The pod, namespace and
+// node come from POD_NAME, POD_NAMESPACE and NODE_NAME; the labels of
+// the pod from the file 'fn', if any.
+func podIdentity(fn string) (string, string, error) {
+	var names []string
+	vals := make(map[string]string)
+	for _, e := range [][2]string{{"pod", "POD_NAME"}, {"namespace", "POD_NAMESPACE"}, {"node", "NODE_NAME"}} {
+		if v := os.Getenv(e[1]); len(v) > 0 {
+			names = append(names, e[0])
+			vals[e[0]] = v
+		}
+	}
+
+	if len(fn) > 0 {
+		m, err := readPodLabels(fn)
+		if err != nil {
+			return "", "", err
+		}
+		var keys []string
+		for k := range m {
+			if _, ok := vals[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			names = append(names, k)
+			vals[k] = m[k]
+		}
+	}
+
+	prefix := "goproxy"
+	if pod, ok := vals["pod"]; ok {
+		if ns, ok := vals["namespace"]; ok {
+			pod = ns + "/" + pod
+		}
+		prefix = fmt.Sprintf("goproxy[%s]", pod)
+	}
+
+	var lv []string
+	for _, k := range names {
+		lv = append(lv, fmt.Sprintf("%s=%q", k, vals[k]))
+	}
+	return prefix, strings.Join(lv, ","), nil
+}
+
+// Read the labels file of the downward API: a key="value" per line. Keys
+// are made into metric label names.
+func readPodLabels(fn string) (map[string]string, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("sidecar: %s", err)
+	}
+	defer fd.Close()
+
+	m := make(map[string]string)
+	sc := bufio.NewScanner(fd)
+	for n := 1; sc.Scan(); n++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 {
+			continue
+		}
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("sidecar: %s:%d: not key=\"value\"", fn, n)
+		}
+		v, err := strconv.Unquote(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("sidecar: %s:%d: %s", fn, n, err)
+		}
+		m[labelName(s[:i])] = v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("sidecar: %s: %s", fn, err)
+	}
+	return m, nil
+}
+
+// Map a kubernetes label key (app.kubernetes.io/name) to a metric label
+// name (app_kubernetes_io_name)
+func labelName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Keep the admin listener of a sidecar on the loopback unless an address
+// is given
+func sidecarAdmin(ac *AdminConf) {
+	if len(ac.Listen) == 0 {
+		ac.Listen = SIDECAR_ADMIN
+		return
+	}
+	if host, port, err := net.SplitHostPort(ac.Listen); err == nil && len(host) == 0 {
+		ac.Listen = net.JoinHostPort("127.0.0.1", port)
+	}
+}
+
+// Watch the config file (a mounted ConfigMap) and put changed rules in
+// force. Other changes need a restart: an upgrade through the handover
+// socket if there is one.
+type configWatch struct {
+	fn  string
+	log *L.Logger
+
+	// with a handover socket, other changes start a new goproxy
+	handover bool
+
+	sync.Mutex
+	sum  [sha256.Size]byte // of the config in force
+	conf *Conf
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newConfigWatch(fn string, log *L.Logger, handover bool) (*configWatch, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("sidecar: %s", err)
+	}
+	var cfg Conf
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("sidecar: can't parse config file %s: %s", fn, err)
+	}
+	w := &configWatch{
+		fn:       fn,
+		log:      log,
+		handover: handover,
+		sum:      sha256.Sum256(b),
+		conf:     &cfg,
+		stop:     make(chan struct{}),
+	}
+	return w, nil
+}
+
+// Check the config every 'secs' seconds until Stop
+func (w *configWatch) Start(secs int) {
+	if secs <= 0 {
+		secs = SIDECAR_WATCH
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		t := time.NewTicker(time.Duration(secs) * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+			}
+
+			restart, err := w.check()
+			switch {
+			case err != nil:
+				w.log.Warn("%s", err)
+			case restart && w.handover:
+				w.log.Info("sidecar: %s changed; upgrading ..", w.fn)
+				spawnUpgrade(w.log)
+			case restart:
+				w.log.Warn("sidecar: %s changed; restart goproxy to use it", w.fn)
+			}
+		}
+	}()
+}
+
+func (w *configWatch) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// Read the config again; put changed rules in force and return true if
+// anything else changed. A config that doesn't parse, or rules that don't
+// compile, keep the ones in force.
+func (w *configWatch) check() (bool, error) {
+	b, err := os.ReadFile(w.fn)
+	if err != nil {
+		return false, fmt.Errorf("sidecar: %s", err)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	sum := sha256.Sum256(b)
+	if sum == w.sum {
+		return false, nil
+	}
+	var cfg Conf
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return false, fmt.Errorf("sidecar: can't parse config file %s: %s; keeping the old one", w.fn, err)
+	}
+
+	// rules can change in place, the rest can't
+	was, wasRules := withoutRules(w.conf)
+	now, nowRules := withoutRules(&cfg)
+	if !bytes.Equal(was, now) {
+		w.sum, w.conf = sum, &cfg
+		return true, nil
+	}
+
+	changed := make(map[string][]RuleConf)
+	for listen, v := range nowRules {
+		if !reflect.DeepEqual(v, wasRules[listen]) {
+			changed[listen] = v
+		}
+	}
+	if len(changed) == 0 {
+		w.sum, w.conf = sum, &cfg
+		return false, nil
+	}
+	m, err := compileRules(changed)
+	switch {
+	case errors.Is(err, errRulesRestart):
+		w.sum, w.conf = sum, &cfg
+		return true, nil
+	case err != nil:
+		return false, fmt.Errorf("sidecar: %s: %s; keeping the rules in force", w.fn, err)
+	}
+	w.sum, w.conf = sum, &cfg
+	reloadRules(m)
+	for listen := range m {
+		w.log.Info("sidecar: new rules for %s from %s", listen, w.fn)
+	}
+	return false, nil
+}
+
+// Return the config without the rules of the listeners, and those rules
+// by listen address
+func withoutRules(c *Conf) ([]byte, map[string][]RuleConf) {
+	cfg := *c
+	cfg.Http = append([]ListenConf(nil), c.Http...)
+	cfg.Socks = append([]ListenConf(nil), c.Socks...)
+
+	m := make(map[string][]RuleConf)
+	for _, v := range [][]ListenConf{cfg.Http, cfg.Socks} {
+		for i := range v {
+			m[v[i].Listen] = v[i].Rules
+			v[i].Rules = nil
+		}
+	}
+	b, _ := yaml.Marshal(&cfg)
+	return b, m
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,155 @@
+// sidecar_test.go -- tests for the kubernetes sidecar mode
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestPodIdentity(t *testing.T) {
+	t.Setenv("POD_NAME", "web-0")
+	t.Setenv("POD_NAMESPACE", "shop")
+	t.Setenv("NODE_NAME", "")
+
+	fn := filepath.Join(t.TempDir(), "labels")
+	os.WriteFile(fn, []byte("app.kubernetes.io/name=\"web\"\npod=\"other\"\n9tier=\"a \\\"b\\\"\"\n"), 0600)
+
+	prefix, labels, err := podIdentity(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "goproxy[shop/web-0]" {
+		t.Errorf("prefix %q", prefix)
+	}
+	want := `pod="web-0",namespace="shop",_tier="a \"b\"",app_kubernetes_io_name="web"`
+	if labels != want {
+		t.Errorf("labels:\n%s\nwant\n%s", labels, want)
+	}
+
+	os.WriteFile(fn, []byte("app=web\n"), 0600)
+	if _, _, err := podIdentity(fn); err == nil {
+		t.Errorf("unquoted label: no error")
+	}
+
+	for in, want := range map[string]string{"": SIDECAR_ADMIN, ":9100": "127.0.0.1:9100", "10.1.2.3:9090": "10.1.2.3:9090"} {
+		ac := &AdminConf{Listen: in}
+		if sidecarAdmin(ac); ac.Listen != want {
+			t.Errorf("admin %q: %s", in, ac.Listen)
+		}
+	}
+}
+
+// Metrics with and without labels of their own
+type podMetrics struct{}
+
+func (podMetrics) metrics() []metric {
+	return []metric{
+		{"goproxy_test_pod", "gauge", "test", "", 1},
+		{"goproxy_test_pod", "gauge", "test", `listen="a"`, 2},
+	}
+}
+
+func TestPodMetrics(t *testing.T) {
+	addCollector(podMetrics{})
+	podLabels = `pod="web-0"`
+	defer func() { podLabels = "" }()
+
+	w := httptest.NewRecorder()
+	(&AdminServer{}).serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	s := w.Body.String()
+	for _, want := range []string{"goproxy_test_pod{pod=\"web-0\"} 1\n", "goproxy_test_pod{pod=\"web-0\",listen=\"a\"} 2\n"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("no %q in\n%s", want, s)
+		}
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	fn := filepath.Join(t.TempDir(), "goproxy.conf")
+	write := func(s string) {
+		if err := os.WriteFile(fn, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const allow = "http:\n  - listen: 127.0.0.1:3128\n    rules:\n      - action: allow\n"
+	write(allow)
+
+	pol, _ := newPolicy(&ListenConf{Rules: []RuleConf{{Action: "allow"}}})
+	addPolicy("127.0.0.1:3128", pol)
+	defer delPolicy("127.0.0.1:3128", pol)
+	ip := net.ParseIP("192.0.2.1")
+
+	w, err := newConfigWatch(fn, log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restart, err := w.check(); restart || err != nil {
+		t.Fatalf("unchanged: %v %v", restart, err)
+	}
+
+	// new rules are in force at once
+	write("http:\n  - listen: 127.0.0.1:3128\n    rules:\n      - name: nope\n        dest: [192.0.2.0/24]\n        action: deny\n")
+	if restart, err := w.check(); restart || err != nil {
+		t.Fatalf("rules: %v %v", restart, err)
+	}
+	if _, err := pol.eval("", "", ip, 80); isDenied(err) == nil {
+		t.Errorf("new rule not in force: %v", err)
+	}
+
+	// a broken config keeps the rules in force
+	write("http: [\n")
+	if _, err := w.check(); err == nil || !strings.Contains(err.Error(), "keeping") {
+		t.Errorf("bad config: %v", err)
+	}
+	if _, err := pol.eval("", "", ip, 80); isDenied(err) == nil {
+		t.Errorf("bad config changed the rules: %v", err)
+	}
+
+	// rules that don't compile keep those in force, without a restart
+	write("http:\n  - listen: 127.0.0.1:3128\n    rules:\n      - action: maybe\n")
+	if restart, err := w.check(); restart || err == nil || !strings.Contains(err.Error(), "keeping") {
+		t.Errorf("bad rules: %v %v", restart, err)
+	}
+	if _, err := pol.eval("", "", ip, 80); isDenied(err) == nil {
+		t.Errorf("bad rules changed the rules: %v", err)
+	}
+
+	// pushed rules stay in force over those of the config
+	applyRules(map[string][]*rule{"127.0.0.1:3128": pol.ruleSet()})
+	write(allow)
+	w.check()
+	if _, err := pol.eval("", "", ip, 80); isDenied(err) == nil {
+		t.Errorf("config replaced pushed rules: %v", err)
+	}
+	applyRules(nil)
+	if _, err := pol.eval("", "", ip, 80); err != nil {
+		t.Errorf("back to the config: %v", err)
+	}
+
+	// anything else needs a restart
+	write(allow + "loglevel: debug\n")
+	if restart, err := w.check(); !restart || err != nil {
+		t.Errorf("loglevel: %v %v", restart, err)
+	}
+	write("loglevel: debug\n" + allow + "      - action: deny\n        chaos: {latency: 10}\n")
+	if restart, _ := w.check(); !restart {
+		t.Errorf("chaos rule: no restart")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
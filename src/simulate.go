@@ -0,0 +1,444 @@
+// simulate.go -- replay access logs against a candidate config offline
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+)
+
+// The outcome of a record under a config
+type simOutcome struct {
+	Denied   string `json:"denied,omitempty"`   // the rule or "acl"
+	Route    string `json:"route,omitempty"`    // "direct", "parent ..", "wireguard .." or "jump .."
+	Throttle string `json:"throttle,omitempty"` // the limit that slows or cuts it
+}
+
+// A record whose outcome differs between the configs
+type simChange struct {
+	Start  time.Time  `json:"start"`
+	Method string     `json:"method"`
+	URL    string     `json:"url"`
+	Change string     `json:"change"` // "denied", "rerouted", "throttled" or "allowed"
+	Was    simOutcome `json:"was"`
+	Now    simOutcome `json:"now"`
+}
+
+// The outcome of a simulation
+type simSummary struct {
+	Records   int         `json:"records"`
+	Skipped   int         `json:"skipped"` // no listener for them or no destination
+	Denied    int         `json:"denied"`
+	Rerouted  int         `json:"rerouted"`
+	Throttled int         `json:"throttled"`
+	Allowed   int         `json:"allowed"` // no longer denied
+	Changes   []simChange `json:"changes"`
+}
+
+// A token bucket in log time
+type simBucket struct {
+	rate, burst float64
+	tokens      float64
+	at          time.Time
+}
+
+func newSimBucket(rate, burst uint) *simBucket {
+	if burst == 0 {
+		burst = rate
+	}
+	return &simBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// Return true if a connection at 'now' is within the rate
+func (b *simBucket) take(now time.Time) bool {
+	if !b.at.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.at).Seconds()*b.rate)
+	}
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// The rules and limits of a listener
+type simListener struct {
+	lc      *ListenConf
+	pol     *policy
+	global  *simBucket // nil if unlimited
+	perhost map[string]*simBucket
+}
+
+func newSimListener(lc *ListenConf) (*simListener, error) {
+	pol, err := newPolicy(lc)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %s", lc.Listen, err)
+	}
+	l := &simListener{lc: lc, pol: pol, perhost: make(map[string]*simBucket)}
+	if rl := lc.Ratelimit.Global; rl > 0 {
+		l.global = newSimBucket(rl, 1)
+	}
+	return l, nil
+}
+
+// The listeners of a config that the records of the access log went
+// through: one for HTTP requests and CONNECT tunnels, one for SOCKS
+// tunnels.
+type simulator struct {
+	http, socks *simListener
+
+	// address of a destination name; nil if unknown
+	lookup func(string) net.IP
+}
+
+// Make a simulator with the listener on 'listen' (or the first HTTP and
+// SOCKS ones if empty) of 'cfg'
+func newSimulator(cfg *Conf, listen string) (*simulator, error) {
+	hv, sv := append([]ListenConf{}, cfg.Http...), append([]ListenConf{}, cfg.Socks...)
+	for i := range cfg.Tenants {
+		hv = append(hv, cfg.Tenants[i].Http...)
+		sv = append(sv, cfg.Tenants[i].Socks...)
+	}
+
+	s := &simulator{lookup: func(string) net.IP { return nil }}
+	pick := func(v []ListenConf) (*simListener, error) {
+		for i := range v {
+			if len(listen) == 0 || v[i].Listen == listen {
+				return newSimListener(&v[i])
+			}
+		}
+		return nil, nil
+	}
+	var err error
+	if s.http, err = pick(hv); err != nil {
+		return nil, err
+	}
+	if s.socks, err = pick(sv); err != nil {
+		return nil, err
+	}
+	if len(listen) > 0 {
+		// one listener takes all records
+		switch {
+		case s.http != nil:
+			s.socks = s.http
+		case s.socks != nil:
+			s.http = s.socks
+		default:
+			return nil, fmt.Errorf("no listener on %s", listen)
+		}
+	}
+	return s, nil
+}
+
+// Forget the connections seen by the rate limits
+func (s *simulator) reset() {
+	for _, l := range []*simListener{s.http, s.socks} {
+		if l == nil {
+			continue
+		}
+		l.perhost = make(map[string]*simBucket)
+		if l.global != nil {
+			l.global = newSimBucket(l.lc.Ratelimit.Global, 1)
+		}
+	}
+}
+
+// Return the outcome of 'rec' for 'user'; false if no listener takes it
+// or it has no destination. Records must come in the order they started:
+// rate limits are applied in log time.
+func (s *simulator) eval(rec *logRecord, user string) (simOutcome, bool) {
+	var o simOutcome
+
+	l := s.http
+	if rec.Method == "SOCKS" {
+		l = s.socks
+	}
+	host, port, ok := recordDest(rec)
+	if l == nil || !ok {
+		return o, false
+	}
+
+	// connections are rate limited before anything else
+	if l.global != nil && !l.global.take(rec.Start) {
+		o.Throttle = "ratelimit global"
+		return o, true
+	}
+	if len(rec.Client) > 0 && l.lc.Ratelimit.PerHost > 0 {
+		b, ok := l.perhost[rec.Client]
+		if !ok {
+			b = newSimBucket(l.lc.Ratelimit.PerHost, l.lc.Ratelimit.Burst)
+			l.perhost[rec.Client] = b
+		}
+		if !b.take(rec.Start) {
+			o.Throttle = "ratelimit perhost"
+			return o, true
+		}
+	}
+	if ip := net.ParseIP(rec.Client); ip != nil && !AclIP(l.lc, ip) {
+		o.Denied = "acl"
+		return o, true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = s.lookup(host)
+	}
+	r, err := l.pol.eval(user, host, ip, port)
+	if err == nil && len(rec.Proto) > 0 && l.pol.byProto() {
+		err = l.pol.evalProto(user, host, ip, port, rec.Proto)
+	}
+	if pe := isDenied(err); pe != nil {
+		o.Denied = pe.rule
+		return o, true
+	}
+
+	o.Route = "direct"
+	switch {
+	case r != nil && len(r.wireguard) > 0:
+		o.Route = "wireguard " + r.wireguard
+	case r != nil && len(r.jump) > 0:
+		o.Route = "jump " + r.jump
+	case len(l.lc.Parent) > 0:
+		o.Route = "parent " + l.lc.Parent
+		if u, err := url.Parse(l.lc.Parent); err == nil {
+			o.Route = "parent " + u.Scheme + "://" + u.Host
+		}
+	}
+
+	tunnel := rec.Method == "SOCKS" || rec.Method == "CONNECT"
+	switch {
+	case r != nil && r.deadline > 0 && rec.Dur > r.deadline:
+		o.Throttle = fmt.Sprintf("deadline %s", r.deadline)
+	case tunnel && l.lc.Tunnel.MaxBytes > 0 && rec.Sent+rec.Recv > l.lc.Tunnel.MaxBytes:
+		o.Throttle = fmt.Sprintf("maxbytes %d", l.lc.Tunnel.MaxBytes)
+	case !tunnel && l.lc.Limits.Body > 0 && rec.Sent > l.lc.Limits.Body:
+		o.Throttle = fmt.Sprintf("body %d", l.lc.Limits.Body)
+	case !tunnel && l.lc.Limits.Response > 0 && rec.Recv > l.lc.Limits.Response:
+		o.Throttle = fmt.Sprintf("response %d", l.lc.Limits.Response)
+	}
+	return o, true
+}
+
+// Return the host and port 'rec' went to
+func recordDest(rec *logRecord) (string, int, bool) {
+	hp := rec.URL
+	if rec.Method != "SOCKS" && rec.Method != "CONNECT" {
+		u, err := url.Parse(rec.URL)
+		if err != nil || len(u.Host) == 0 {
+			return "", 0, false
+		}
+		hp = u.Host
+		if len(u.Port()) == 0 {
+			switch u.Scheme {
+			case "https":
+				hp = net.JoinHostPort(u.Hostname(), "443")
+			case "ftp":
+				hp = net.JoinHostPort(u.Hostname(), "21")
+			default:
+				hp = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+	}
+	h, p, err := net.SplitHostPort(hp)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, false
+	}
+	return h, port, true
+}
+
+// The outcome the access log recorded: denied sessions aren't logged,
+// so all were allowed; the log doesn't say how they went out.
+func recordedOutcome(rec *logRecord) simOutcome {
+	return simOutcome{Route: "direct"}
+}
+
+// Return how 'now' differs from 'was'; "" if it doesn't
+func compareOutcome(was, now simOutcome) string {
+	switch {
+	case len(now.Denied) > 0 && len(was.Denied) == 0:
+		return "denied"
+	case len(now.Denied) == 0 && len(was.Denied) > 0:
+		return "allowed"
+	case len(now.Denied) > 0:
+		return ""
+	case len(now.Route) > 0 && len(was.Route) > 0 && now.Route != was.Route:
+		return "rerouted"
+	case len(now.Throttle) > 0 && now.Throttle != was.Throttle:
+		return "throttled"
+	}
+	return ""
+}
+
+// Run 'recs' (in the order they started) through 'cand' and compare
+// each outcome with the one of 'cur'; nil 'cur' compares with what the
+// log recorded.
+func simulate(recs []logRecord, cand, cur *simulator, user string) simSummary {
+	s := simSummary{Records: len(recs)}
+	cand.reset()
+	if cur != nil {
+		cur.reset()
+	}
+	for i := range recs {
+		rec := &recs[i]
+		now, ok := cand.eval(rec, user)
+		if !ok {
+			s.Skipped++
+			continue
+		}
+		was := recordedOutcome(rec)
+		if cur != nil {
+			if was, ok = cur.eval(rec, user); !ok {
+				was = recordedOutcome(rec)
+			}
+		}
+
+		ch := compareOutcome(was, now)
+		switch ch {
+		case "":
+			continue
+		case "denied":
+			s.Denied++
+		case "allowed":
+			s.Allowed++
+		case "throttled":
+			s.Throttled++
+		case "rerouted":
+			s.Rerouted++
+		}
+		s.Changes = append(s.Changes, simChange{Start: rec.Start, Method: rec.Method,
+			URL: rec.URL, Change: ch, Was: was, Now: now})
+	}
+	return s
+}
+
+func (o simOutcome) String() string {
+	switch {
+	case len(o.Denied) > 0:
+		return fmt.Sprintf("denied by rule '%s'", o.Denied)
+	case len(o.Route) == 0:
+		return o.Throttle
+	case len(o.Throttle) > 0:
+		return fmt.Sprintf("%s (%s)", o.Route, o.Throttle)
+	}
+	return o.Route
+}
+
+// Write the changed records (unless 'quiet') and the counts
+func (s *simSummary) print(w io.Writer, quiet bool) {
+	if !quiet {
+		for i := range s.Changes {
+			c := &s.Changes[i]
+			fmt.Fprintf(w, "%s %-9s %s %s: %s -> %s\n", c.Start.UTC().Format(ACCESS_TIME),
+				c.Change, c.Method, c.URL, c.Was, c.Now)
+		}
+	}
+	fmt.Fprintf(w, "records %d: %d denied, %d rerouted, %d throttled, %d allowed, %d skipped\n",
+		s.Records, s.Denied, s.Rerouted, s.Throttled, s.Allowed, s.Skipped)
+}
+
+// The "simulate" command: run access logs through a candidate config
+// and report the sessions it would treat differently
+func simulateCommand(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	cf := fs.StringP("current", "C", "", "Compare with the config in `FILE` instead of the recorded outcomes")
+	ln := fs.StringP("listener", "l", "", "Use the listener on `ADDR` for all records (default the first HTTP and SOCKS ones)")
+	user := fs.StringP("user", "u", "", "Evaluate the records as user `NAME`")
+	resolve := fs.BoolP("resolve", "r", false, "Resolve destination names for the address rules and guards")
+	quiet := fs.BoolP("quiet", "q", false, "Only print the counts")
+	out := fs.String("json", "", "Write the summary and the changed records to `FILE` as JSON")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s simulate [options] config-file access-log...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	load := func(fn string) *simulator {
+		cfg, err := ReadYAML(fn)
+		if err != nil {
+			die("simulate: %s", err)
+		}
+		s, err := newSimulator(cfg, *ln)
+		if err != nil {
+			die("simulate: %s: %s", fn, err)
+		}
+		return s
+	}
+	cand := load(fs.Arg(0))
+	var cur *simulator
+	if len(*cf) > 0 {
+		cur = load(*cf)
+	}
+	if *resolve {
+		cache := make(map[string]net.IP)
+		lookup := func(h string) net.IP {
+			ip, ok := cache[h]
+			if !ok {
+				if v, err := net.LookupIP(h); err == nil && len(v) > 0 {
+					ip = v[0]
+				}
+				cache[h] = ip
+			}
+			return ip
+		}
+		cand.lookup = lookup
+		if cur != nil {
+			cur.lookup = lookup
+		}
+	}
+
+	var recs []logRecord
+	for _, fn := range fs.Args()[1:] {
+		fd, err := os.Open(fn)
+		if err != nil {
+			die("simulate: %s", err)
+		}
+		v, skipped, err := parseAccessLog(fd)
+		fd.Close()
+		if err != nil {
+			die("simulate: %s: %s", fn, err)
+		}
+		if skipped > 0 {
+			warn("simulate: %s: %d lines aren't requests or tunnels", fn, skipped)
+		}
+		recs = append(recs, v...)
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+	if len(recs) == 0 {
+		die("simulate: no records")
+	}
+
+	s := simulate(recs, cand, cur, *user)
+	s.print(os.Stdout, *quiet)
+	if len(*out) > 0 {
+		b, _ := json.MarshalIndent(&s, "", "  ")
+		if err := os.WriteFile(*out, append(b, '\n'), 0644); err != nil {
+			die("simulate: %s", err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
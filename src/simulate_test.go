@@ -0,0 +1,129 @@
+// simulate_test.go -- tests for policy simulations against access logs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	log := `time="2024-05-01T10:00:01.000Z" url="http://a.example/x" status="200" bytes="10" upstream="1.000 ms" downstream="1.000 ms" method="GET" sent="0"
+time="2024-05-01T10:00:02.000Z" url="http://d.example/up" status="200" bytes="10" upstream="1.000 ms" downstream="1.000 ms" method="POST" sent="5000"
+time="2024-05-01T10:01:00.000Z" url="b.example:443" status="200" bytes="9000" upstream="60000.000 ms" downstream="0 us" method="CONNECT" sent="100" proto="tls"
+192.0.2.1:5555 2024-05-01 10:00:05.000000 c.example:22 [198.51.100.7:22] in=300 out=7000 dur="1.000 ms"
+192.0.2.1:5556 2024-05-01 10:00:05.100000 c.example:22 [198.51.100.7:22] in=300 out=7000 dur="1.000 ms"
+192.0.2.2:5555 2024-05-01 10:00:06.000000 10.1.2.3:80 [10.1.2.3:80] in=1 out=1 dur="1.000 ms"
+192.0.2.9:5555 2024-05-01 10:00:07.000000 e.example:80 [198.51.100.8:80] in=1 out=1 dur="1.000 ms"
+`
+	recs, _, err := parseAccessLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tunnel to b started first
+	if r := recs[0]; r.Proto != "tls" || r.Method != "CONNECT" {
+		t.Fatalf("connect: %+v", r)
+	}
+	if r := recs[3]; r.Client != "192.0.2.1" {
+		t.Fatalf("socks: %+v", r)
+	}
+
+	cur, err := newSimulator(&Conf{
+		Http:  []ListenConf{{Listen: "127.0.0.1:3128"}},
+		Socks: []ListenConf{{Listen: "127.0.0.1:1080", Guard: GuardConf{Disable: true}}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cand, err := newSimulator(&Conf{
+		Http: []ListenConf{{Listen: "127.0.0.1:3128",
+			Limits: LimitConf{Body: 1024},
+			Rules: []RuleConf{
+				{Name: "no-a", Dest: []string{"a.example"}, Action: "deny"},
+				{Name: "tls-b", Dest: []string{"b.example"}, Proto: []string{"tls"}, Action: "deny", LogOnly: true},
+				{Name: "b", Dest: []string{"b.example"}, Action: "allow", WireGuard: "wg0", Deadline: 30},
+			}}},
+		Socks: []ListenConf{{Listen: "127.0.0.1:1080",
+			Ratelimit: RateLimit{PerHost: 1},
+			Deny:      []subnet{{IPNet: net.IPNet{IP: net.IPv4(192, 0, 2, 9), Mask: net.CIDRMask(32, 32)}}}}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := simulate(recs, cand, cur, "")
+	want := map[string]string{
+		"http://a.example/x":  "denied",
+		"http://d.example/up": "throttled",
+		"b.example:443":       "rerouted",
+		"c.example:22":        "throttled",
+		"10.1.2.3:80":         "denied",
+		"e.example:80":        "denied",
+	}
+	for _, c := range s.Changes {
+		if want[c.URL] != c.Change {
+			t.Errorf("%s: %s, not %s (%s -> %s)", c.URL, c.Change, want[c.URL], c.Was, c.Now)
+		}
+		delete(want, c.URL)
+	}
+	if len(want) > 0 {
+		t.Errorf("not changed: %v", want)
+	}
+	if s.Records != 7 || s.Denied != 3 || s.Rerouted != 1 || s.Throttled != 2 || s.Allowed != 0 {
+		t.Errorf("summary: %+v", s)
+	}
+
+	// the tunnel to b is cut by the deadline too; the first SOCKS
+	// tunnel is within the rate
+	for _, c := range s.Changes {
+		if c.URL == "b.example:443" && c.Now.Throttle != "deadline 30s" {
+			t.Errorf("b: %+v", c.Now)
+		}
+	}
+
+	// back: the denied ones are allowed again
+	back := func() *simulator {
+		v, err := newSimulator(&Conf{Http: []ListenConf{{Listen: "127.0.0.1:3128"}},
+			Socks: []ListenConf{{Listen: "127.0.0.1:1080", Guard: GuardConf{Disable: true}}}}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if s = simulate(recs, back(), cand, ""); s.Allowed != 3 {
+		t.Errorf("reverse: %+v", s)
+	}
+
+	// against the log
+	s = simulate(recs, cand, nil, "")
+	var buf bytes.Buffer
+	s.print(&buf, false)
+	if !strings.Contains(buf.String(), "denied by rule 'no-a'") ||
+		!strings.Contains(buf.String(), "records 7: 3 denied, 1 rerouted, 2 throttled, 0 allowed, 0 skipped") {
+		t.Errorf("report:\n%s", buf.String())
+	}
+
+	// one listener for all records
+	one, err := newSimulator(&Conf{Http: []ListenConf{{Listen: "127.0.0.1:3128"}},
+		Socks: []ListenConf{{Listen: "127.0.0.1:1080"}}}, "127.0.0.1:3128")
+	if err != nil || one.socks != one.http {
+		t.Errorf("listener: %v", err)
+	}
+	if _, err := newSimulator(&Conf{}, "127.0.0.1:9"); err == nil {
+		t.Errorf("no listener: no error")
+	}
+	if s = simulate(recs, &simulator{}, nil, ""); s.Skipped != 7 {
+		t.Errorf("no listeners: %+v", s)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
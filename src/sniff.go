@@ -0,0 +1,120 @@
+// sniff.go -- the application protocol inside raw tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The first bytes a client sends into a CONNECT or SOCKS tunnel name
+// its protocol. They are read before the relay starts and sent on by the
+// copier (see CancellableCopier.Prelude). A client that waits for the
+// server to speak first (SMTP, FTP) is "unknown" after SNIFF_WAIT.
+
+const (
+	// Time the client has to send its first bytes
+	SNIFF_WAIT = 500 * time.Millisecond
+
+	// Most bytes read for sniffing
+	SNIFF_BYTES = 2048
+)
+
+// The protocols known by their first bytes
+var sniffProtos = map[string]bool{
+	"tls":        true,
+	"http":       true,
+	"ssh":        true,
+	"bittorrent": true,
+	"dns":        true,
+	"unknown":    true,
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+	[]byte("PRI * HTTP/2.0"),
+}
+
+// Return the protocol that starts with 'b'
+func sniffProto(b []byte) string {
+	switch {
+	// a TLS handshake record: ClientHello, or SSLv3 and later
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 3 && b[2] <= 4:
+		return "tls"
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return "ssh"
+	case bytes.HasPrefix(b, []byte("\x13BitTorrent protocol")):
+		return "bittorrent"
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return "http"
+		}
+	}
+
+	// DNS over TCP: a length and a standard query with one question
+	if len(b) >= 2+12 {
+		n := int(binary.BigEndian.Uint16(b))
+		h := b[2:]
+		qd, an, ns := binary.BigEndian.Uint16(h[4:]), binary.BigEndian.Uint16(h[6:]), binary.BigEndian.Uint16(h[8:])
+		if n >= 12+5 && len(b) <= n+2 && h[2]&0xf8 == 0 && qd == 1 && an == 0 && ns == 0 {
+			return "dns"
+		}
+	}
+	return "unknown"
+}
+
+// Read the first bytes of the client 'c' in a tunnel; return them and
+// their protocol. A client that sends nothing for SNIFF_WAIT is
+// "unknown".
+func sniffTunnel(c net.Conn) ([]byte, string, error) {
+	b := make([]byte, SNIFF_BYTES)
+	c.SetReadDeadline(time.Now().Add(SNIFF_WAIT))
+	n, err := c.Read(b)
+	c.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return b[:n], sniffProto(b[:n]), nil
+	}
+	if isTimeout(err) {
+		return nil, "unknown", nil
+	}
+	return nil, "", err
+}
+
+// Return true if tunnels of this dialer are sniffed; those of rules that
+// split ClientHellos are, to send the hello before the relay starts
+func (d *dialer) sniffs(tc *TunnelConf) bool {
+	return tc.Sniff || tc.Fingerprint || d.pol.byProto() || d.pol.byFragment()
+}
+
+// Check the tunnel 'c' to 'addr' again once it is known to carry
+// 'proto'; rules with protocols apply now
+func (d *dialer) CheckProto(ctx context.Context, addr string, c net.Conn, proto string) error {
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(ps)
+
+	// through a parent, the address is the parent's
+	ip := net.ParseIP(host)
+	if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok && d.parent == nil {
+		ip = ta.IP
+	}
+	spanOf(ctx).set("goproxy.proto", proto)
+	host, port, _ = d.ftp.as(ctx, host, port)
+	return d.pol.evalProto(userOf(ctx), host, ip, port, proto)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,72 @@
+// sniff_test.go -- tests for the protocol sniffing of tunnels
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSniffProto(t *testing.T) {
+	dns := []byte{0, 29, 0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	for in, want := range map[string]string{
+		"\x16\x03\x01\x02\x00\x01":               "tls",
+		"SSH-2.0-OpenSSH_9.6\r\n":                "ssh",
+		"\x13BitTorrent protocol\x00\x00":        "bittorrent",
+		"GET / HTTP/1.1\r\n":                     "http",
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n":       "http",
+		string(dns):                              "dns",
+		"EHLO mail.example.com\r\n":              "unknown",
+		"\x16\x03\x09":                           "unknown",
+		"":                                       "unknown",
+		string(append([]byte{0, 9}, dns[2:]...)): "unknown",
+	} {
+		if got := sniffProto([]byte(in)); got != want {
+			t.Errorf("%q: %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestSniffTunnel(t *testing.T) {
+	echo := startEcho(t)
+	addr := startHTTPProxy(t, &ListenConf{Rules: []RuleConf{{Name: "no-bt", Proto: []string{"bittorrent"}, Action: "deny"}}})
+
+	// The sniffed bytes go through
+	c, br := connectTunnel(t, addr, echo.Addr().String(), "", "")
+	io.WriteString(c, "SSH-2.0-test\n")
+	if s, _ := br.ReadString('\n'); s != "SSH-2.0-test\n" {
+		t.Errorf("ssh: %q", s)
+	}
+	c.Close()
+
+	// So do those of a client that waits
+	c, br = connectTunnel(t, addr, echo.Addr().String(), "", "")
+	time.Sleep(SNIFF_WAIT + 100*time.Millisecond)
+	io.WriteString(c, "hello\n")
+	if s, _ := br.ReadString('\n'); s != "hello\n" {
+		t.Errorf("late client: %q", s)
+	}
+	c.Close()
+
+	// BitTorrent is denied
+	c, br = connectTunnel(t, addr, echo.Addr().String(), "", "")
+	io.WriteString(c, "\x13BitTorrent protocol\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if s, err := br.ReadString('\n'); err == nil {
+		t.Errorf("bittorrent relayed: %q", s)
+	}
+	c.Close()
+
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
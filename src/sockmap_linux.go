@@ -0,0 +1,524 @@
+// sockmap_linux.go -- relay tunnels in the kernel with a BPF sockmap
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,!386
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Both sockets of a tunnel go into a SOCKHASH keyed by socket cookie;
+// the entry for each socket holds its peer. A stream verdict program
+// redirects every skb a tunnel socket receives to its peer's egress, so
+// payload never comes up to userspace. The relays just wait for EOF or
+// an error and keep the idle timeouts.
+
+// Max sockets in the map (2 per tunnel); tunnels past this use the
+// usual relay.
+const SOCKMAP_ENTRIES = 65536
+
+// bpf(2) commands and types
+const (
+	_BPF_MAP_CREATE      = 0
+	_BPF_MAP_UPDATE_ELEM = 2
+	_BPF_PROG_LOAD       = 5
+	_BPF_PROG_ATTACH     = 8
+
+	_BPF_MAP_TYPE_SOCKHASH     = 18
+	_BPF_PROG_TYPE_SK_SKB      = 14
+	_BPF_SK_SKB_STREAM_VERDICT = 5
+
+	_BPF_FUNC_get_socket_cookie = 46
+	_BPF_FUNC_sk_redirect_hash  = 72
+)
+
+const (
+	_SO_COOKIE = 57
+)
+
+// bpf(2) isn't in package syscall on every arch
+var sysBPF = map[string]uintptr{
+	"amd64":    321,
+	"arm":      386,
+	"arm64":    280,
+	"loong64":  280,
+	"mips":     4355,
+	"mipsle":   4355,
+	"mips64":   5315,
+	"mips64le": 5315,
+	"ppc64":    361,
+	"ppc64le":  361,
+	"riscv64":  280,
+	"s390x":    351,
+}
+
+// struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst | src << 4
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// The stream verdict program:
+//
+//		if skb->len == 0 goto pass
+//		r6 = r1
+//		r0 = get_socket_cookie(r1)
+//		*(u64 *)(r10 - 8) = r0
+//		r0 = sk_redirect_hash(r6, map, r10 - 8, 0)
+//		if r0 != 0 goto out
+//	pass:
+//		r0 = SK_PASS
+//	out:
+//		exit
+//
+// A socket whose peer isn't in the map (yet, or any more) keeps its
+// data: SK_PASS queues it for userspace. So does an empty skb (a bare
+// FIN): the kernel can't send it and would flag an error on the peer.
+// We forward FINs ourselves.
+func verdictProg(mapfd int) []bpfInsn {
+	return []bpfInsn{
+		insn(0x61, 2, 1, 0, 0),                           // ldxw r2, [r1+0] (len)
+		insn(0x15, 2, 0, 11, 0),                          // jeq r2, 0, pass
+		insn(0xbf, 6, 1, 0, 0),                           // mov64 r6, r1
+		insn(0x85, 0, 0, 0, _BPF_FUNC_get_socket_cookie), // call
+		insn(0x7b, 10, 0, -8, 0),                         // stxdw [r10-8], r0
+		insn(0xbf, 1, 6, 0, 0),                           // mov64 r1, r6
+		insn(0x18, 2, 1, 0, int32(mapfd)),                // lddw r2, map (BPF_PSEUDO_MAP_FD)
+		insn(0x00, 0, 0, 0, 0),                           //
+		insn(0xbf, 3, 10, 0, 0),                          // mov64 r3, r10
+		insn(0x07, 3, 0, 0, -8),                          // add64 r3, -8
+		insn(0xb7, 4, 0, 0, 0),                           // mov64 r4, 0
+		insn(0x85, 0, 0, 0, _BPF_FUNC_sk_redirect_hash),  // call
+		insn(0x55, 0, 0, 1, 0),                           // jne r0, 0, +1
+		insn(0xb7, 0, 0, 0, 1),                           // mov64 r0, SK_PASS
+		insn(0x95, 0, 0, 0, 0),                           // exit
+	}
+}
+
+type bpfMapAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+type bpfProgAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	name        [16]byte
+}
+
+type bpfElemAttr struct {
+	mapFd uint32
+	pad   uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	nr, ok := sysBPF[runtime.GOARCH]
+	if !ok {
+		return -1, syscall.ENOSYS
+	}
+
+	r, _, e := syscall.Syscall(nr, uintptr(cmd), uintptr(attr), size)
+	if e != 0 {
+		return -1, e
+	}
+	return int(r), nil
+}
+
+// The process wide sockmap; set up on first use. That has to be before
+// we drop privileges: creating the map and loading the program need
+// CAP_BPF (or root).
+var sockmap struct {
+	sync.Once
+	fd  int
+	err error
+}
+
+func getSockmap() (int, error) {
+	sockmap.Do(func() {
+		sockmap.fd, sockmap.err = newSockmap()
+	})
+	return sockmap.fd, sockmap.err
+}
+
+func newSockmap() (int, error) {
+	ma := bpfMapAttr{
+		mapType:    _BPF_MAP_TYPE_SOCKHASH,
+		keySize:    8,
+		valueSize:  8,
+		maxEntries: SOCKMAP_ENTRIES,
+	}
+	mfd, err := bpf(_BPF_MAP_CREATE, unsafe.Pointer(&ma), unsafe.Sizeof(ma))
+	if err != nil {
+		return -1, fmt.Errorf("sockmap: can't create map: %w", err)
+	}
+
+	prog := verdictProg(mfd)
+	lic := []byte("GPL\x00")
+	pa := bpfProgAttr{
+		progType: _BPF_PROG_TYPE_SK_SKB,
+		insnCnt:  uint32(len(prog)),
+		insns:    uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&lic[0]))),
+	}
+	copy(pa.name[:], "goproxy_relay")
+
+	pfd, err := bpf(_BPF_PROG_LOAD, unsafe.Pointer(&pa), unsafe.Sizeof(pa))
+	runtime.KeepAlive(prog)
+	runtime.KeepAlive(lic)
+	if err != nil {
+		syscall.Close(mfd)
+		return -1, fmt.Errorf("sockmap: can't load program: %w", err)
+	}
+
+	// The map holds a reference to the program; we don't need its fd
+	aa := bpfAttachAttr{
+		targetFd:    uint32(mfd),
+		attachBpfFd: uint32(pfd),
+		attachType:  _BPF_SK_SKB_STREAM_VERDICT,
+	}
+	_, err = bpf(_BPF_PROG_ATTACH, unsafe.Pointer(&aa), unsafe.Sizeof(aa))
+	syscall.Close(pfd)
+	if err != nil {
+		syscall.Close(mfd)
+		return -1, fmt.Errorf("sockmap: can't attach program: %w", err)
+	}
+	return mfd, nil
+}
+
+func mapUpdate(mfd int, key uint64, fd int) error {
+	val := uint64(fd)
+	ea := bpfElemAttr{
+		mapFd: uint32(mfd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&val))),
+	}
+	_, err := bpf(_BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&ea), unsafe.Sizeof(ea))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&val)
+	return err
+}
+
+func getsockopt(fd, level, opt int, p unsafe.Pointer, n int) error {
+	sz := uint32(n)
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(p), uintptr(unsafe.Pointer(&sz)), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func sockCookie(fd int) (uint64, error) {
+	var v uint64
+	err := getsockopt(fd, syscall.SOL_SOCKET, _SO_COOKIE, unsafe.Pointer(&v), 8)
+	return v, err
+}
+
+// SIOCINQ; it differs only on mips and powerpc
+func siocinq() uintptr {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le":
+		return 0x467f
+	case "ppc64", "ppc64le":
+		return 0x4004667f
+	}
+	return 0x541b
+}
+
+func ioctlInt(fd int, req uintptr) (uint64, error) {
+	var v int32
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&v)))
+	if e != 0 {
+		return 0, e
+	}
+	return uint64(v), nil
+}
+
+// What we need of struct tcp_info
+type sockStat struct {
+	state uint8
+	idle  time.Duration // since data was last received
+	inq   uint64        // bytes waiting to be read
+	rx    uint64        // bytes read from the socket (by us or the kernel)
+	tx    uint64        // bytes written to it
+}
+
+// offsets in struct tcp_info
+const (
+	_TCPI_STATE          = 0
+	_TCPI_LAST_DATA_RECV = 52
+	_TCPI_BYTES_ACKED    = 120
+	_TCPI_BYTES_RECEIVED = 128
+	_TCPI_LEN            = 136
+)
+
+// TCP states of a socket whose peer has sent a FIN (or is gone)
+var peerClosed = map[uint8]bool{
+	6:  true, // TIME_WAIT
+	7:  true, // CLOSE
+	8:  true, // CLOSE_WAIT
+	9:  true, // LAST_ACK
+	11: true, // CLOSING
+}
+
+func stat(fd int) (sockStat, error) {
+	var b [_TCPI_LEN]byte
+	var st sockStat
+
+	if err := getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, unsafe.Pointer(&b[0]), len(b)); err != nil {
+		return st, err
+	}
+	inq, err := ioctlInt(fd, siocinq())
+	if err != nil {
+		return st, err
+	}
+	outq, err := ioctlInt(fd, syscall.TIOCOUTQ)
+	if err != nil {
+		return st, err
+	}
+
+	u32 := func(off int) uint32 { return *(*uint32)(unsafe.Pointer(&b[off])) }
+	u64 := func(off int) uint64 { return *(*uint64)(unsafe.Pointer(&b[off])) }
+
+	st.state = b[_TCPI_STATE]
+	st.idle = time.Duration(u32(_TCPI_LAST_DATA_RECV)) * time.Millisecond
+	st.inq = inq
+	st.rx = u64(_TCPI_BYTES_RECEIVED) - inq
+	st.tx = u64(_TCPI_BYTES_ACKED) + outq
+	return st, nil
+}
+
+// stat() of the socket 'rc'
+func rawStat(rc syscall.RawConn) (st sockStat, err error) {
+	cerr := rc.Control(func(fd uintptr) {
+		st, err = stat(int(fd))
+	})
+	if cerr != nil {
+		return st, cerr
+	}
+	return st, err
+}
+
+// A tunnel socket in the sockmap
+type sockEnd struct {
+	rc syscall.RawConn
+	st sockStat // counts when it went in
+}
+
+// Both sockets of a tunnel in the sockmap
+type sockPair struct {
+	lhs, rhs sockEnd
+}
+
+// Put the tunnel's sockets in the sockmap; from here on the kernel moves
+// the data. Return the relay to use: sockRelay() if both went in, else
+// the usual relay. If only one went in, its peer isn't in the map and
+// the kernel queues what it receives for us; only copyBuf() reads that
+// queue, so the tunnel uses copyBuf().
+func (c *CancellableCopier) redirect() relayFunc {
+	mfd, err := getSockmap()
+	if err != nil {
+		return (*CancellableCopier).relay
+	}
+
+	var ends [2]sockEnd
+	var ck [2]uint64
+	var fds [2]int
+	for i, s := range []tcpConn{c.Lhs, c.Rhs} {
+		rc, err := s.SyscallConn()
+		if err != nil {
+			return (*CancellableCopier).relay
+		}
+		ends[i].rc = rc
+	}
+
+	// The fds stay valid: nobody closes the sockets until Copy() is done
+	for i := range ends {
+		err = ends[i].rc.Control(func(fd uintptr) {
+			fds[i] = int(fd)
+			if ck[i], err = sockCookie(fds[i]); err == nil {
+				ends[i].st, err = stat(fds[i])
+			}
+		})
+		if err != nil {
+			return (*CancellableCopier).relay
+		}
+	}
+
+	// Each socket is keyed by its peer's cookie: what comes in on one
+	// socket goes out on the other.
+	if err = mapUpdate(mfd, ck[1], fds[0]); err != nil {
+		return (*CancellableCopier).relay
+	}
+	if err = mapUpdate(mfd, ck[0], fds[1]); err != nil {
+		return (*CancellableCopier).copyBuf
+	}
+	runtime.KeepAlive(c.Lhs)
+	runtime.KeepAlive(c.Rhs)
+
+	// Data that came in before the sockets were in the map is still in
+	// their receive queues; get the kernel to look at it now.
+	for _, fd := range fds {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, 1)
+	}
+
+	c.kern = &sockPair{lhs: ends[0], rhs: ends[1]}
+	return (*CancellableCopier).sockRelay
+}
+
+// Wait while the kernel moves data from 's' to 'd'; return at EOF or
+// error with the bytes written to 'd'. Idle and linger timeouts are the
+// same as copyBuf(); the kernel tells us when data last came in.
+func (c *CancellableCopier) sockRelay(d, s tcpConn, pool *bufPool) (int, error) {
+	src, dst := &c.kern.rhs, &c.kern.lhs
+	if s == c.Lhs {
+		src, dst = dst, src
+	}
+
+	sent := func() (int, error) {
+		st, err := rawStat(dst.rc)
+		if err != nil {
+			return 0, err
+		}
+		return int(st.tx - dst.st.tx), nil
+	}
+
+	for {
+		last := time.Unix(0, atomic.LoadInt64(&c.last))
+		s.SetReadDeadline(last.Add(c.timeout()))
+
+		var st sockStat
+		var serr error
+		err := src.rc.Read(func(fd uintptr) bool {
+			if st, serr = stat(int(fd)); serr != nil {
+				return true
+			}
+			if n, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR); n != 0 {
+				serr = syscall.Errno(n)
+				return true
+			}
+			return peerClosed[st.state]
+		})
+		if err == nil {
+			err = serr
+		}
+
+		switch {
+		case err == nil:
+			// EOF: the FIN goes to 'd' after the data
+			if err = c.drain(src, dst); err != nil {
+				n, _ := sent()
+				return n, err
+			}
+			return sent()
+
+		case isTimeout(err):
+			// Either direction's traffic keeps the tunnel alive
+			if c.kernelIdle() < c.timeout() {
+				continue
+			}
+			n, _ := sent()
+			return n, err
+		}
+
+		n, _ := sent()
+		return n, err
+	}
+}
+
+// Time since either socket of the tunnel last received data; note it
+// as the tunnel's last activity.
+func (c *CancellableCopier) kernelIdle() time.Duration {
+	idle := c.timeout()
+	for _, e := range []*sockEnd{&c.kern.lhs, &c.kern.rhs} {
+		if st, err := rawStat(e.rc); err == nil && st.idle < idle {
+			idle = st.idle
+		}
+	}
+
+	t := time.Now().Add(-idle).UnixNano()
+	if t > atomic.LoadInt64(&c.last) {
+		atomic.StoreInt64(&c.last, t)
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
+// Wait until everything 'src' received has been written to 'dst'; give
+// up if that doesn't move for the write timeout.
+func (c *CancellableCopier) drain(src, dst *sockEnd) error {
+	wto := time.Duration(c.WriteTimeout) * time.Second
+	pause := time.Millisecond
+
+	var last uint64
+	t0 := time.Now()
+	for {
+		in, err := rawStat(src.rc)
+		if err != nil {
+			return err
+		}
+		out, err := rawStat(dst.rc)
+		if err != nil {
+			return err
+		}
+
+		// 'src' is at EOF: its count includes the FIN
+		tx := out.tx - dst.st.tx
+		if in.inq == 0 && tx >= in.rx-src.st.rx-1 {
+			return nil
+		}
+
+		if tx != last {
+			last = tx
+			t0 = time.Now()
+		} else if time.Since(t0) > wto {
+			return os.ErrDeadlineExceeded
+		}
+
+		time.Sleep(pause)
+		if pause < 50*time.Millisecond {
+			pause *= 2
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,106 @@
+// sockmap_linux_test.go -- tests for the sockmap relay
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,!386
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Bulk data both ways through a kernel relayed tunnel, with a
+// half-close in between. Needs root (or CAP_BPF).
+func TestSockmapRelay(t *testing.T) {
+	if _, err := getSockmap(); err != nil {
+		t.Skipf("no sockmap: %s", err)
+	}
+
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// The server greets before the tunnel is up: that is in the receive
+	// queue when the sockets go in the map.
+	hello := []byte("220 hello\r\n")
+	if _, err := server.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	c := &CancellableCopier{
+		Lhs:         lhs,
+		Rhs:         rhs,
+		ReadTimeout: 10,
+		Linger:      5,
+		Sockmap:     true,
+	}
+
+	type result struct {
+		nl, nr int
+	}
+	done := make(chan result, 1)
+	go func() {
+		nl, nr, _ := c.Copy(context.Background())
+		done <- result{nl, nr}
+	}()
+
+	up := make([]byte, 4<<20)
+	down := make([]byte, 3<<20)
+	rand.Read(up)
+	rand.Read(down)
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+
+	b := make([]byte, len(hello))
+	if _, err := io.ReadFull(client, b); err != nil || !bytes.Equal(b, hello) {
+		t.Fatalf("greeting: %q, %v", b, err)
+	}
+
+	// client -> server, then the client's FIN
+	go func() {
+		client.Write(up)
+		client.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("upload: %d of %d bytes, %v", len(got), len(up), err)
+	}
+
+	// the other direction still works
+	go func() {
+		server.Write(down)
+		server.Close()
+	}()
+	got, err = ioutil.ReadAll(client)
+	if err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("download: %d of %d bytes, %v", len(got), len(down), err)
+	}
+
+	select {
+	case r := <-done:
+		if c.kern == nil {
+			t.Fatalf("tunnel wasn't relayed in the kernel")
+		}
+		if r.nl != len(hello)+len(down) || r.nr != len(up) {
+			t.Errorf("counts %d, %d; want %d, %d", r.nl, r.nr, len(hello)+len(down), len(up))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel didn't end")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,28 @@
+// sockmap_other.go -- no sockmap relay on this platform
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !linux linux,386
+
+package main
+
+import (
+	"errors"
+)
+
+type sockPair struct{}
+
+func getSockmap() (int, error) {
+	return -1, errors.New("sockmap: not supported on this platform")
+}
+
+// Tunnels always use the usual relay
+func (c *CancellableCopier) redirect() relayFunc {
+	return (*CancellableCopier).relay
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
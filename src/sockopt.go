@@ -0,0 +1,92 @@
+// sockopt.go -- listeners and socket options
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Listen on 'la' with the socket options in the listener config, or
+// take over the listener of the predecessor (see handover.go).
+// Options the platform doesn't support are logged and skipped.
+func listenTCP(lc *ListenConf, la *net.TCPAddr, log *L.Logger) (*net.TCPListener, error) {
+	key := "tcp " + lc.Listen
+	ln, err := inheritTCP(key)
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		if ln, err = bindTCP(lc, la, log); err != nil {
+			return nil, err
+		}
+	}
+	shareSocket(key, ln)
+
+	// This has to happen before we drop privileges
+	if lc.Tunnel.Sockmap {
+		if _, err := getSockmap(); err != nil {
+			log.Warn("%s: can't relay tunnels in the kernel: %s", la, err)
+		}
+	}
+	return ln, nil
+}
+
+func bindTCP(lc *ListenConf, la *net.TCPAddr, log *L.Logger) (*net.TCPListener, error) {
+	var reuse error
+	lcfg := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			err := c.Control(func(fd uintptr) {
+				if lc.ReusePort || lc.Shards > 1 {
+					reuse = setReusePort(fd)
+				}
+				if lc.Fastopen > 0 {
+					if err := setFastOpen(fd, lc.Fastopen); err != nil {
+						log.Warn("%s: can't enable TCP fast open: %s", address, err)
+					}
+				}
+			})
+			if err == nil && reuse != nil {
+				err = fmt.Errorf("can't share the port: %s", reuse)
+			}
+			return err
+		},
+	}
+	lcfg.SetMultipathTCP(lc.MPTCP.Listen)
+
+	ln, err := lcfg.Listen(context.Background(), "tcp", la.String())
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// Return the accept shards of 'lc' other than 'ln' (the first): more
+// sockets on the address of 'ln', each with its own accept queue.
+func listenShards(lc *ListenConf, ln *net.TCPListener, log *L.Logger) ([]*net.TCPListener, error) {
+	var v []*net.TCPListener
+	la := ln.Addr().(*net.TCPAddr)
+	for i := 1; i < lc.Shards; i++ {
+		s, err := listenTCP(lc, la, log)
+		if err != nil {
+			for _, s := range v {
+				s.Close()
+			}
+			return nil, fmt.Errorf("shard %d: %s", i, err)
+		}
+		v = append(v, s)
+	}
+	return v, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
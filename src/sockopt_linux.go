@@ -0,0 +1,60 @@
+// sockopt_linux.go -- socket options on linux
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Not in package syscall
+const (
+	_TCP_FASTOPEN         = 23
+	_TCP_FASTOPEN_CONNECT = 30
+)
+
+// Accept TFO connections on the listener 'fd'; 'qlen' is the max
+// number of pending TFO requests.
+func setFastOpen(fd uintptr, qlen int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, _TCP_FASTOPEN, qlen)
+}
+
+// Use the TCP congestion control algorithm 'name' on 'fd'
+func setCongestion(fd uintptr, name string) error {
+	return syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+}
+
+// Return an error if the kernel doesn't have congestion control 'name'
+func checkCongestion(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err = setCongestion(uintptr(fd), name); err != nil {
+		return fmt.Errorf("congestion control '%s': %s", name, err)
+	}
+	return nil
+}
+
+// Let other sockets bind the address of 'fd'; the kernel spreads the
+// connections among them.
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, _SO_REUSEPORT, 1)
+}
+
+// Send the first write with the SYN on the (unconnected) socket 'fd'
+func setFastOpenConnect(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, _TCP_FASTOPEN_CONNECT, 1)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,79 @@
+// sockopt_linux_test.go -- tests for linux socket options
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestReusePort(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	la := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	a, err := listenTCP(&ListenConf{ReusePort: true}, la, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	la = a.Addr().(*net.TCPAddr)
+	b, err := listenTCP(&ListenConf{ReusePort: true}, la, log)
+	if err != nil {
+		t.Fatalf("second socket: %s", err)
+	}
+	b.Close()
+	if c, err := listenTCP(&ListenConf{}, la, log); err == nil {
+		c.Close()
+		t.Errorf("a socket without SO_REUSEPORT took the port")
+	}
+
+	// Every shard of a proxy serves
+	lc := &ListenConf{Shards: 4}
+	addr := startHTTPProxy(t, lc)
+	ln := startEcho(t)
+	for i := 0; i < 32; i++ {
+		c, br := connectTunnel(t, addr, ln.Addr().String(), "", "")
+		io.WriteString(c, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+			t.Fatalf("conn %d: %q %v", i, b, err)
+		}
+		c.Close()
+	}
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	px, err := NewHTTPProxy(&ListenConf{Listen: "127.0.0.1:0", Shards: 3}, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := px.(*HTTPProxy)
+	if len(p.shards) != 2 {
+		t.Fatalf("%d shards", len(p.shards))
+	}
+	for _, s := range p.shards {
+		if s.Addr().String() != p.Addr().String() {
+			t.Errorf("shard on %s, proxy on %s", s.Addr(), p.Addr())
+		}
+	}
+	px.Start()
+	px.Stop()
+	if c, err := net.Dial("tcp", p.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("a shard still accepts after Stop")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
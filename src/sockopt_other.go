@@ -0,0 +1,43 @@
+// sockopt_other.go -- socket options on non-linux platforms
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+var (
+	errNoFastOpen   = errors.New("TCP fast open is not supported on this platform")
+	errNoCongestion = errors.New("TCP congestion control selection is not supported on this platform")
+	errNoReusePort  = errors.New("SO_REUSEPORT load balancing is not supported on this platform")
+)
+
+func setFastOpen(fd uintptr, qlen int) error {
+	return errNoFastOpen
+}
+
+func setFastOpenConnect(fd uintptr) error {
+	return errNoFastOpen
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return errNoCongestion
+}
+
+func checkCongestion(name string) error {
+	return errNoCongestion
+}
+
+func setReusePort(fd uintptr) error {
+	return errNoReusePort
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
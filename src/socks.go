@@ -13,12 +13,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 	"context"
 	//"encoding/hex"
 
-	L "github.com/opencoff/go-logger"
+	L "github.com/opencoff/go-proxies/logger"
 	"github.com/opencoff/go-ratelimit"
 )
 
@@ -33,14 +34,42 @@ type Methods struct {
 type socksProxy struct {
 	*net.TCPListener
 
+	// accept shards after the first (the TCPListener)
+	shards []*net.TCPListener
+
 	cfg  *ListenConf // config block
 
-	bind net.Addr    // address to bind to when connect to remote
+	dial *dialer     // outbound connections
 	log  *L.Logger   // Shortcut to logger
 	ulog *L.Logger   // URL Logger
 
 	grl  *ratelimit.RateLimiter
-	prl  *ratelimit.PerIPRateLimiter
+	prl  *srcLimiter
+	crl  *connLimiter // nil if conns at once aren't limited
+
+	// NAT behavior of the UDP relay
+	nat  int
+
+	// Client timeouts
+	cp   *clientPolicy
+
+	// Content filters; nil if none
+	filters *filterChain
+
+	// Terms of use of a mixed listener; nil if none
+	captive *captive
+
+	// Client authentication; nil if none
+	auth *clientAuth
+
+	// TLS for clients; nil if none
+	tls *listenTLS
+
+	// stream transport of clients; nil if none
+	trans Transport
+
+	// Trojan instead of SOCKS; nil if none
+	trojan *trojanServer
 
 	ctx  context.Context
 	cancel context.CancelFunc
@@ -55,36 +84,114 @@ func NewSocksv5Proxy(cfg *ListenConf, log, ulog *L.Logger) (px *socksProxy, err
 		die("Can't resolve %s: %s", cfg.Listen, err)
 	}
 
-	ln, err := net.ListenTCP("tcp", la)
+	ln, err := listenTCP(cfg, la, log)
 	if err != nil {
 		return nil, err
 	}
-
-	var addr net.Addr
+	shards, err := listenShards(cfg, ln, log)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
 
 	if len(cfg.Bind) > 0 {
 		log.Info("Binding to %s ..\n", cfg.Bind)
-		addr, err = net.ResolveTCPAddr("tcp", cfg.Bind)
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	dial, err := newDialer(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	if dial.egress != nil {
+		addCollector(dial.egress)
+	}
+	if dial.chaos != nil {
+		addCollector(dial.chaos)
+	}
+	if dial.mirrors != nil {
+		addCollector(dial.mirrors)
+	}
+	if dial.wg != nil {
+		addCollector(dial.wg)
+	}
+	if dial.jumps != nil {
+		addCollector(dial.jumps)
+	}
+	if dial.script != nil {
+		addCollector(dial.script)
+	}
+
+	nat, err := parseNat(cfg.UDP.Nat)
+	if err != nil {
+		return nil, err
 	}
 
-	log = log.New("socks-"+ln.Addr().String(), 0)
+	filters, err := newFilterChain(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newClientAuth(cfg, ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil && auth.neg != nil {
+		auth.Close()
+		return nil, fmt.Errorf("auth %s: not for SOCKS listeners", cfg.Auth.Type)
+	}
+	if auth != nil {
+		addCollector(auth)
+	}
+	dial.restrict(auth)
+
+	lt, err := newListenTLS(&cfg.TLS, log)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := newStreamTransport(&cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	trojan, err := newTrojan(&cfg.Trojan, lt)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.ConnectIP.Pool) > 0 {
+		return nil, fmt.Errorf("connectip: only on http listeners")
+	}
+	if len(cfg.ErrorPages) > 0 {
+		return nil, fmt.Errorf("errorpages: only on http listeners")
+	}
+	if cfg.Captive.Enable {
+		return nil, fmt.Errorf("captive: only on http (or mixed) listeners")
+	}
+
+	log = log.New(logName("socks", cfg, ln.Addr()), 0)
 
 	grl, _ := ratelimit.New(cfg.Ratelimit.Global, 1)
-	prl, _ := ratelimit.NewPerIP(cfg.Ratelimit.PerHost, 1, 30000)
+	prl, err := newSrcLimiter(&cfg.Ratelimit, "socks:"+cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	px = &socksProxy{
 		TCPListener:  ln,
+		shards:       shards,
 		cfg:          cfg,
-		bind:         addr,
+		dial:         dial,
 		log:          log,
 		ulog:         ulog,
 		grl:          grl,
 		prl:          prl,
+		crl:          newConnLimiter(&cfg.Ratelimit, "socks:"+cfg.Listen),
+		nat:          nat,
+		cp:           newClientPolicy(&cfg.Client),
+		filters:      filters,
+		auth:         auth,
+		tls:          lt,
+		trans:        trans,
+		trojan:       trojan,
 		ctx:          ctx,
 		cancel:       cancel,
 	}
@@ -93,28 +200,53 @@ func NewSocksv5Proxy(cfg *ListenConf, log, ulog *L.Logger) (px *socksProxy, err
 }
 
 func (px *socksProxy) Start() {
+	lns := []interface{}{px.TCPListener}
+	for _, ln := range px.shards {
+		lns = append(lns, ln)
+	}
+	addCheck(px, "socks "+px.Addr().String(), true, listening(lns...))
+
 	px.wg.Add(1)
 	go func() {
 		defer px.wg.Done()
 		px.log.Info("Starting SOCKS proxy ..")
-		px.accept()
+		px.accept(px.TCPListener)
 	}()
+
+	if len(px.shards) > 0 {
+		px.log.Info("%d accept shards (SO_REUSEPORT)", len(px.shards)+1)
+	}
+	for _, ln := range px.shards {
+		px.wg.Add(1)
+		go func(ln *net.TCPListener) {
+			defer px.wg.Done()
+			px.accept(ln)
+		}(ln)
+	}
 }
 
 func (px *socksProxy) Stop() {
+	delCheck(px)
 	px.cancel()
 	px.TCPListener.Close()
+	for _, ln := range px.shards {
+		ln.Close()
+	}
 	px.wg.Wait()
+	if px.auth != nil {
+		px.auth.Close()
+	}
+	px.tls.close()
+	px.dial.Close()
 
 	px.log.Info("SOCKS proxy shutdown")
 }
 
 
-// start the proxy
+// start the proxy on the shard 'ln'
 // Caller is expected to kick this off as a go-routine
 // XXX Also need a global limit on total concurrent connections?
-func (px *socksProxy) accept() {
-	ln := px.TCPListener
+func (px *socksProxy) accept(ln *net.TCPListener) {
 	log := px.log
 	nerr := 0
 
@@ -148,13 +280,13 @@ func (px *socksProxy) accept() {
 		// Ratelimit before anything else we do
 		if px.grl.Limit() {
 			conn.Close()
-			log.Debug("global ratelimit reached: %s", rem)
+			log.Debug("global ratelimit reached: %s: limit=global", rem)
 			continue
 		}
 
-		if px.prl.Limit(conn.RemoteAddr()) {
+		if px.prl.LimitConn(conn) {
 			conn.Close()
-			log.Debug("per-host ratelimit reached: %s", rem)
+			log.Debug("per-host ratelimit reached: %s: limit=perhost", rem)
 			continue
 		}
 
@@ -168,37 +300,156 @@ func (px *socksProxy) accept() {
 			continue
 		}
 
+		held, ok := px.crl.hold(conn)
+		if !ok {
+			conn.Close()
+			log.Debug("too many conns: %s: limit=maxconns", rem)
+			continue
+		}
+		conn = held
+
 		log.Debug("Accepted connection from %s", rem)
 
+		if px.trans != nil {
+			conn = serverTransport(px.trans, conn)
+		}
+
 		// Fork off a handler for this new connection
 		px.wg.Add(1)
-		go px.Proxy(conn)
+		if px.tls != nil {
+			go px.serveTLS(conn)
+		} else {
+			go px.Proxy(conn)
+		}
 	}
 }
 
+// Serve 'c' of a TLS listener; a listener that takes plaintext clients
+// tells them apart first
+func (px *socksProxy) serveTLS(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(px.cp.handshake))
+	lhs, err := px.tls.accept(c)
+	if err != nil {
+		px.log.Debug("%s: %s", c.RemoteAddr().String(), err)
+		c.Close()
+		px.wg.Done()
+		return
+	}
+	px.Proxy(lhs)
+}
+
 // goroutine to handle a proxy request from 'lhs'
 func (px *socksProxy) Proxy(lhs net.Conn) {
 
 	defer px.wg.Done()
+	defer lhs.Close()
+
+	// Each connection is a session; its log lines start with the id
+	ctx, end := withSession(px.ctx, px.log)
+	defer end()
+	ctx, sp := traceSession(ctx, "socks", "")
+	log := logOf(ctx, px.log)
+	defer sp.finish()
+	sp.set("client.address", lhs.RemoteAddr().String())
+	sp.set("goproxy.listen", px.cfg.Listen)
+	sp.set("goproxy.session", sessionOf(ctx))
+
+	// negotiation, authentication and the request
+	hs := startSpan(ctx, "handshake", _SPAN_SERVER)
+	defer hs.finish()
+
+	// The negotiation and request must arrive within the handshake
+	// timeout; slow clients can't hold on to a handler forever.
+	lhs.SetDeadline(time.Now().Add(px.cp.handshake))
+
+	// A client certificate names the user
+	certUser := ""
+	if px.tls != nil {
+		rem := lhs.RemoteAddr().String()
+		cs, err := tlsState(lhs)
+		if err != nil {
+			log.Debug("%s: TLS handshake: %s", rem, err)
+			hs.fail(err)
+			return
+		}
+		if cs != nil {
+			u, err := px.tls.user(cs)
+			if err != nil {
+				log.Info("%s: %s", rem, err)
+				return
+			}
+			certUser = u
+		}
+	}
 
-	// We expect to get some bytes within 10 seconds.
-	//lhs.SetReadDeadline(deadLine(10000))
+	var req *socksReq
+	var err error
+	if px.trojan != nil {
+		// the password names the user
+		var c net.Conn
+		if req, c, err = px.trojan.request(ctx, lhs); err != nil {
+			log.Debug("%s: %s", lhs.RemoteAddr().String(), err)
+			hs.fail(err)
+			return
+		}
+		lhs = c
+	} else {
+		// SOCKS4 clients send their request at once
+		var ver byte
+		var pc *peekConn
+		if ver, pc, err = peekByte(lhs); err != nil {
+			hs.fail(err)
+			return
+		}
+		lhs = pc
+		if ver == 4 {
+			if req, err = px.readSocks4(ctx, lhs, certUser); err != nil {
+				hs.fail(err)
+				return
+			}
+		} else {
+			var m Methods
+			m, err = px.readMethods(ctx, lhs)
 
-	_, err := px.readMethods(lhs)
+			if err != nil {
+				hs.fail(err)
+				return
+			}
 
-	if err != nil {
-		return
+			user, ok := px.authenticate(ctx, lhs, &m, certUser)
+			if !ok {
+				return
+			}
+
+			// Now we expect to read the request
+			req, err = px.readRequest(ctx, lhs)
+			if err != nil {
+				hs.fail(err)
+				return
+			}
+			req.user = user
+		}
 	}
+	hs.finish()
+	sp.set("server.address", req.Addr())
+
+	lhs.SetDeadline(time.Time{})
+
+	switch {
+	case req.cmd == 1:
+	case req.cmd == 3 && !req.v4:
+		px.associate(ctx, lhs, req)
+		return
 
-	// Hard coded response: "We have no need for auth"
-	buf := make([]byte, 2)
-	buf[0] = 5
-	buf[1] = 0
-	lhs.Write(buf)
+	default:
+		log.Debug("%s unsupported command %d", lhs.RemoteAddr().String(), req.cmd)
+		px.replyTo(lhs, req, 7, nil)
+		return
+	}
 
-	// Now we expect to read URL and connect
-	rhs, s, err := px.doConnect(lhs)
+	rhs, s, notes, err := px.doConnect(ctx, lhs, req)
 	if err != nil {
+		sp.fail(err)
 		return
 	}
 
@@ -215,18 +466,57 @@ func (px *socksProxy) Proxy(lhs net.Conn) {
 	   rhs.SetDeadline(dl)
 	*/
 
-	lx := lhs.(*net.TCPConn)
-	rx := rhs.(*net.TCPConn)
+	lx := clientConn(lhs)
+	rx := rhs.(tcpConn)
+	actx := withUser(withClient(ctx, lx.RemoteAddr().(*net.TCPAddr).IP), req.user)
+	actx = withTenant(actx, px.cfg.Tenant)
+
+	// The protocol in the tunnel, for the log and the rules keyed on it
+	var pre []byte
+	var proto, fp string
+	if px.dial.sniffs(&px.cfg.Tunnel) {
+		if pre, proto, err = sniffTunnel(lx); err == nil {
+			pre, fp = fingerprintTunnel(ctx, &px.cfg.Tunnel, lx, pre, proto)
+			err = px.dial.CheckProto(actx, s, rx, proto)
+		}
+		if err != nil {
+			if pe := isDenied(err); pe != nil {
+				log.Info("%s %s (%s)", lx.RemoteAddr().String(), pe, proto)
+			}
+			sp.fail(err)
+			lx.Close()
+			rx.Close()
+			return
+		}
+	}
 
 	cp := &CancellableCopier{
 		Lhs:          lx,
 		Rhs:          rx,
-		ReadTimeout:  10,	// XXX Config file
+		ReadTimeout:  px.cfg.Tunnel.Idle,
 		WriteTimeout: 15,	// XXX Config file
-		IOBufsize:    16384,
+		Linger:       px.cfg.Tunnel.Linger,
+		Sockmap:      px.cfg.Tunnel.Sockmap,
+		IOBufsize:    px.cfg.Bufsize,
+		MaxBytes:     px.cfg.Tunnel.MaxBytes,
+		Prelude:      pre,
 	}
 
-	cp.Copy(px.ctx)
+	t0 := time.Now()
+	sess := px.auth.begin(actx, "socks", s, cp.Moved)
+	live := startSession(actx, px.cfg.Listen, "socks", s, cp, cp.Moved)
+	rl := startSpan(ctx, "relay", _SPAN_INTERNAL)
+	if _, _, err := cp.Copy(ctx); err != nil {
+		log.Info("%s: tunnel to %s closed: %s (limit %d bytes)",
+			lx.RemoteAddr().String(), rx.RemoteAddr().String(), err, cp.MaxBytes)
+		rl.fail(err)
+	} else if err := cutShort(ctx); err != nil {
+		log.Info("%s: tunnel to %s closed: %s", lx.RemoteAddr().String(), rx.RemoteAddr().String(), err)
+		rl.fail(err)
+	}
+	traceMoved(rl, cp.Moved)
+	live.done()
+	px.auth.end(sess)
 
 	if px.ulog != nil {
 		now := time.Now().UTC()
@@ -236,27 +526,49 @@ func (px *socksProxy) Proxy(lhs net.Conn) {
 
 		ls := lx.RemoteAddr().String()
 		rs := rx.RemoteAddr().String()
-		s := fmt.Sprintf("%s %04d-%02d-%02d %02d:%02d:%02d.%06d %s [%s]",
-			ls, yy, mm, dd, hh, m, ss, us, s, rs)
+		in, out := cp.Moved()
+		s := fmt.Sprintf("%s %04d-%02d-%02d %02d:%02d:%02d.%06d %s [%s] in=%d out=%d dur=%q id=%s",
+			ls, yy, mm, dd, hh, m, ss, us, s, rs, in, out, format(now.Sub(t0)), sessionOf(ctx))
+		if len(proto) > 0 {
+			s += " proto=" + proto + fp
+		}
+		if len(notes) > 0 {
+			s += " " + notes
+		}
 
-		px.ulog.Info(s)
+		px.ulog.Info(s + anomalies.tags(actx))
 	}
 }
 
 // Read the advertised methods from the client and respond
-func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
+func (px *socksProxy) readMethods(ctx context.Context, conn net.Conn) (m Methods, err error) {
+	log := logOf(ctx, px.log)
 	rem := conn.RemoteAddr().String()
 	b := make([]byte, 300)
-	n, err := conn.Read(b)
-	if err != nil && err != io.EOF {
-		px.log.Error("%s Unable to read version info: %s", rem, err)
+	n, err := io.ReadAtLeast(conn, b, 2)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if isTimeout(err) {
+			log.Info("%s handshake timed out after %s", rem, px.cp.handshake)
+		} else {
+			log.Error("%s Unable to read version info: %s", rem, err)
+		}
 		return
 	}
+	if n >= 2 && n-2 < int(b[1]) {
+		var k int
+		k, err = io.ReadFull(conn, b[n:2+int(b[1])])
+		n += k
+		if err != nil && isTimeout(err) {
+			log.Info("%s handshake timed out after %s", rem, px.cp.handshake)
+			return
+		}
+		err = nil
+	}
 
 	if n < 2 {
 		errs := fmt.Sprintf("%s Insufficient data while reading version: Saw only %d bytes\n",
 			rem, n)
-		px.log.Error(errs)
+		log.Error(errs)
 		err = errors.New(errs)
 		return
 	}
@@ -267,11 +579,11 @@ func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
 	if n-2 < int(m.nmethods) {
 		errs := fmt.Sprintf("%s insufficient data while reading methods; exp %d bytes, saw %d",
 			rem, m.nmethods, n-2)
-		px.log.Error(errs)
+		log.Error(errs)
 		err = fmt.Errorf(errs)
 	}
 
-	//px.log.Debug("%s Methods: %d bytes [%d tot auth meth]\n%s\n", rem, n, int(m.nmethods),
+	//log.Debug("%s Methods: %d bytes [%d tot auth meth]\n%s\n", rem, n, int(m.nmethods),
 	//            hex.Dump(b[0:n]))
 
 	m.methods = b[2 : 2+int(m.nmethods)]
@@ -279,17 +591,32 @@ func (px *socksProxy) readMethods(conn net.Conn) (m Methods, err error) {
 	return
 }
 
-// Read the connect request and return a successful connection to
-// the other side
-func (px *socksProxy) doConnect(lhs net.Conn) (rhs net.Conn, s string, err error) {
+// SOCKSv5 client request
+type socksReq struct {
+	cmd  uint8
+	host string // domain name or IP address
+	port int
+	user string // authenticated user; "" if none
+	v4   bool   // a SOCKS4 or SOCKS4a request
+}
+
+// Return the destination as a host:port string
+func (r *socksReq) Addr() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+// Read the client request and decode the destination address
+func (px *socksProxy) readRequest(ctx context.Context, lhs net.Conn) (r *socksReq, err error) {
 	ls := lhs.RemoteAddr().String()
 
 	buf := make([]byte, 512)
-	log := px.log
+	log := logOf(ctx, px.log)
 
 	n, err := lhs.Read(buf)
 	if err != nil {
-		if err != io.EOF {
+		if isTimeout(err) {
+			log.Info("%s handshake timed out after %s", ls, px.cp.handshake)
+		} else if err != io.EOF {
 			log.Error("%s Unable to read version info: %s", ls, err)
 		}
 		return
@@ -323,91 +650,258 @@ func (px *socksProxy) doConnect(lhs net.Conn) (rhs net.Conn, s string, err error
 		return
 	}
 
-	var t string
-	var i int
+	host, port, _, err := parseAddr(buf[3:n])
+	if err != nil {
+		log.Error("%s %s", ls, err)
+		return
+	}
 
-	switch buf[3] {
-	case 0x1:
-		if n-4 < 4 {
-			errs := fmt.Sprintf("%s Insufficient data for IPv4 addr: saw %d, want 4\n",
-				ls, n-4)
-			log.Error(errs)
-			err = errors.New(errs)
+	r = &socksReq{
+		cmd:  buf[1],
+		host: host,
+		port: port,
+	}
+	return
+}
+
+// Connect to the destination in 'r' and return a successful connection to
+// the other side
+// Connect to the destination of request 'r'; return the connection, its
+// address and the notes of the content filters.
+func (px *socksProxy) doConnect(ctx context.Context, lhs net.Conn, r *socksReq) (rhs net.Conn, s, notes string, err error) {
+	ls := lhs.RemoteAddr().String()
+	log := logOf(ctx, px.log)
+
+	s = r.Addr()
+
+	//log.Debug("Connecting to %s ..\n", s)
+
+	/*
+	   tout := time.Duration(px.cfg.Conn_tout) * time.Second
+	   if tout <= 0 {
+	       tout, _ = time.ParseDuration("4s")
+	   }
+	*/
+	ip := lhs.RemoteAddr().(*net.TCPAddr).IP
+	ctx = withTenant(withClient(ctx, ip), px.cfg.Tenant)
+	if len(r.user) > 0 {
+		ctx = withUser(ctx, r.user)
+	}
+
+	if px.captive != nil && !px.captive.ok(captiveKey(r.user, ip)) {
+		log.Info("%s CONNECT %s: terms of use not accepted", ls, s)
+		err = errTerms
+		px.replyTo(lhs, r, socksCode(err), nil)
+		return
+	}
+
+	if px.filters != nil {
+		fr := &FilterRequest{Client: ip, User: r.user, Proto: "socks", Dest: s}
+		if v, name := px.filters.request(fr); v.Action == FILTER_DENY {
+			log.Info("%s CONNECT %s denied by filter %s: %s", ls, s, name, v.Reason)
+			err = errFiltered
+			px.replyTo(lhs, r, socksCode(err), nil)
 			return
 		}
-		s += fmt.Sprintf("%d", buf[4])
-		s += fmt.Sprintf(".%d", buf[5])
-		s += fmt.Sprintf(".%d", buf[6])
-		s += fmt.Sprintf(".%d", buf[7])
+		notes = fr.Notes()
+	}
 
-	case 0x3:
-		m := int(buf[4])
-		if n-4 < m {
-			errs := fmt.Sprintf("%s Insufficient data for domain: saw %d, want %d\n",
-				ls, n-4, m)
-			log.Error(errs)
-			err = errors.New(errs)
+	if err = anomalies.start(ctx, s); err == nil {
+		rhs, err = px.dial.DialContext(ctx, "tcp", s)
+	}
+	if err != nil {
+		if pe := isDenied(err); pe != nil {
+			log.Info("%s %s", ls, pe)
+			px.replyTo(lhs, r, socksCode(err), nil)
 			return
 		}
+		noteSession(true)
+		if de := isDNSSEC(err); de != nil {
+			log.Info("%s %s", ls, de)
+		} else {
+			log.Error("%s failed to connect to %s: %s", ls, s, err)
+		}
+		px.replyTo(lhs, r, socksCode(err), nil)
+		return
+	}
+
+	px.replyTo(lhs, r, 0, rhs.LocalAddr())
+	rhs = fairShare.wrap(ctx, anomalies.wrap(ctx, px.dial.watchFTP(ctx, s, rhs)))
+
+	log.Debug("%s connected to %s [%s]", ls, s, rhs.RemoteAddr().String())
+
+	//log.Info("%s CONNECT %s %s\n", ls, s, rhs.RemoteAddr().String())
 
-		for i = 0; i < m; i++ {
-			s += fmt.Sprintf("%c", buf[i+5])
+	return rhs, s, notes, nil
+}
+
+// Read a SOCKS4 request, or a SOCKS4a one with a name; there is no
+// negotiation. SOCKS4 has no passwords: with auth, only clients with a
+// certificate are served.
+func (px *socksProxy) readSocks4(ctx context.Context, lhs net.Conn, certUser string) (*socksReq, error) {
+	ls := lhs.RemoteAddr().String()
+	log := logOf(ctx, px.log)
+
+	// VN CD DSTPORT DSTIP USERID NUL [HOST NUL]
+	var b [8]byte
+	_, err := io.ReadFull(lhs, b[:])
+	if err == nil {
+		_, err = readNul(lhs)
+	}
+	if err != nil {
+		if isTimeout(err) {
+			log.Info("%s handshake timed out after %s", ls, px.cp.handshake)
+		} else {
+			log.Debug("%s bad SOCKS4 request: %s", ls, err)
 		}
+		return nil, err
+	}
 
-	case 0x4:
-		m := 16
-		if n-4 < m {
-			errs := fmt.Sprintf("%s Insufficient data for IPv6 addr: saw %d, want 16\n",
-				ls, n-4)
-			log.Error(errs)
-			err = errors.New(errs)
-			return
+	r := &socksReq{
+		cmd:  b[1],
+		host: net.IP(b[4:8]).String(),
+		port: int(b[2])<<8 | int(b[3]),
+		user: certUser,
+		v4:   true,
+	}
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		if r.host, err = readNul(lhs); err != nil || len(r.host) == 0 {
+			log.Debug("%s bad SOCKS4a request: %v", ls, err)
+			return nil, errSocks4
+		}
+	}
+	if px.auth != nil && len(certUser) == 0 {
+		log.Info("%s: SOCKS4 client can't authenticate", ls)
+		px.replyTo(lhs, r, 2, nil)
+		return nil, errSocks4
+	}
+	return r, nil
+}
+
+var errSocks4 = errors.New("bad SOCKS4 request")
+
+// Read a NUL terminated string of at most 255 bytes
+func readNul(c net.Conn) (string, error) {
+	var s []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
 		}
-		s = fmt.Sprintf("[%02x", buf[5])
-		for i = 1; i < m; i++ {
-			s += fmt.Sprintf(":%02x", buf[i+5])
+		if len(s) == 255 {
+			return "", errSocks4
 		}
-		s += "]"
+		s = append(s, b[0])
 	}
+}
 
-	var port uint16 = uint16(buf[n-2])<<8 + uint16(buf[n-1])
+// Reply to the request 'r' as the client's SOCKS version does; SOCKS4
+// has no codes for the errors, nor IPv6 bound addresses
+func (px *socksProxy) replyTo(conn net.Conn, r *socksReq, code uint8, a net.Addr) {
+	if !r.v4 {
+		px.reply(conn, code, a)
+		return
+	}
 
-	s += fmt.Sprintf(":%d", port)
+	b := []byte{0, 90, 0, 0, 0, 0, 0, 0}
+	if code != 0 {
+		b[1] = 91
+	}
+	if ta, ok := a.(*net.TCPAddr); ok {
+		b[2], b[3] = byte(ta.Port>>8), byte(ta.Port)
+		if ip4 := ta.IP.To4(); ip4 != nil {
+			copy(b[4:], ip4)
+		}
+	}
+	conn.Write(b)
+}
 
-	switch buf[1] {
-	case 1:
-		t = "tcp"
-	case 2: // bind
-	case 3:
-		t = "udp"
+// Send a reply with status 'code' and bound address 'a' (which may be nil)
+func (px *socksProxy) reply(conn net.Conn, code uint8, a net.Addr) {
+	// Trojan clients get no replies
+	if px.trojan != nil {
+		return
 	}
 
-	//log.Debug("Connecting to %s ..\n", s)
+	ip := net.IPv4zero
+	port := 0
 
-	/*
-	   tout := time.Duration(px.cfg.Conn_tout) * time.Second
-	   if tout <= 0 {
-	       tout, _ = time.ParseDuration("4s")
-	   }
-	*/
-	d := &net.Dialer{LocalAddr: px.bind, Timeout: 5 * time.Second}
+	switch x := a.(type) {
+	case *net.TCPAddr:
+		ip, port = x.IP, x.Port
+	case *net.UDPAddr:
+		ip, port = x.IP, x.Port
+	}
 
-	rhs, err = d.Dial(t, s)
-	if err != nil {
-		log.Error("%s failed to connect to %s: %s", ls, s, err)
-		buf[1] = 4
-		lhs.Write(buf[:n])
+	b := []byte{5, code, 0}
+	b = encodeAddr(b, ip, port)
+	conn.Write(b)
+}
+
+// Decode a SOCKSv5 address (ATYP, ADDR, PORT) at the start of 'b'.
+// Return the host, port and the number of bytes consumed.
+func parseAddr(b []byte) (host string, port int, n int, err error) {
+	if len(b) < 1 {
+		err = errors.New("missing address type")
 		return
 	}
 
-	buf[1] = 0
-	lhs.Write(buf[:n])
+	switch b[0] {
+	case 0x1:
+		n = 1 + 4
+		if len(b) < n+2 {
+			err = fmt.Errorf("Insufficient data for IPv4 addr: saw %d, want %d", len(b), n+2)
+			return
+		}
+		host = net.IP(b[1:n]).String()
 
-	log.Debug("%s connected to %s [%s]", ls, s, rhs.RemoteAddr().String())
+	case 0x3:
+		if len(b) < 2 {
+			err = errors.New("Insufficient data for domain")
+			return
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			err = fmt.Errorf("Insufficient data for domain: saw %d, want %d", len(b), n+2)
+			return
+		}
+		host = string(b[2:n])
 
-	//log.Info("%s CONNECT %s %s\n", ls, s, rhs.RemoteAddr().String())
+	case 0x4:
+		n = 1 + 16
+		if len(b) < n+2 {
+			err = fmt.Errorf("Insufficient data for IPv6 addr: saw %d, want %d", len(b), n+2)
+			return
+		}
+		host = net.IP(b[1:n]).String()
 
-	return rhs, s, nil
+	default:
+		err = fmt.Errorf("unknown address type %d", b[0])
+		return
+	}
+
+	port = int(b[n])<<8 | int(b[n+1])
+	n += 2
+	return
+}
+
+// Append the SOCKSv5 encoding of ip:port to 'b'
+func encodeAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x1)
+		b = append(b, ip4...)
+	} else {
+		ip6 := ip.To16()
+		if ip6 == nil {
+			ip6 = net.IPv6zero
+		}
+		b = append(b, 0x4)
+		b = append(b, ip6...)
+	}
+	return append(b, byte(port>>8), byte(port))
 }
 
 // vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
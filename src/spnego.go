@@ -0,0 +1,279 @@
+// spnego.go -- Kerberos (SPNEGO "Negotiate") authentication of HTTP clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds of clock skew allowed between clients and us
+	KRB5_SKEW = 300
+
+	// Seconds between checks of the keytab for changes
+	KRB5_CHECK = 5
+)
+
+var (
+	oidSPNEGO  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKrb5    = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	oidMSKrb5  = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+	oidNTLMSSP = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+
+	errNegotiate = errors.New("kerberos: clients must use Negotiate")
+	errKrbReplay = errors.New("kerberos: authenticator replayed")
+)
+
+// An Authenticator for HTTP clients that authenticate with a GSS-API
+// token: Proxy-Authorization: Negotiate (RFC 4559).
+type NegotiateAuthenticator interface {
+	// Return the user of the SPNEGO 'token' if it is good
+	AuthenticateNegotiate(ctx context.Context, token []byte) (string, error)
+}
+
+func init() {
+	RegisterAuth("kerberos", newKerberosAuth)
+}
+
+// Kerberos tickets of HTTP clients, checked with the keys of a keytab
+// ("keytab") - the clients of a Windows domain or any Kerberos realm
+// authenticate without typing a password. "service" is the principal
+// clients get tickets for (HTTP/proxy.example.com; default: any in the
+// keytab), "realms" limits the realms of clients, "striprealm" makes
+// users of names without the realm and "skew" is the clock skew
+// allowed in seconds.
+type krbAuth struct {
+	file    string
+	service string
+	realms  map[string]bool
+	strip   bool
+	skew    time.Duration
+
+	sync.Mutex
+	keys    []keytabEntry
+	mtime   time.Time
+	checked time.Time
+	seen    map[string]time.Time // authenticators, until they are too old
+}
+
+func newKerberosAuth(args map[string]string) (Authenticator, error) {
+	k := &krbAuth{
+		file:    args["keytab"],
+		service: args["service"],
+		skew:    KRB5_SKEW * time.Second,
+		seen:    make(map[string]time.Time),
+	}
+	if len(k.file) == 0 {
+		return nil, fmt.Errorf("missing 'keytab'")
+	}
+	if s := args["realms"]; len(s) > 0 {
+		k.realms = make(map[string]bool)
+		for _, r := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+			k.realms[r] = true
+		}
+	}
+	if s := args["striprealm"]; len(s) > 0 {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("striprealm: %s", err)
+		}
+		k.strip = b
+	}
+	if s := args["skew"]; len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("skew: %q is not seconds", s)
+		}
+		k.skew = time.Duration(n) * time.Second
+	}
+
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	k.checked = time.Now()
+	return k, nil
+}
+
+// Read the keys of our service from the keytab
+func (k *krbAuth) load() error {
+	fi, err := os.Stat(k.file)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(k.file)
+	if err != nil {
+		return err
+	}
+	all, err := parseKeytab(b)
+	if err != nil {
+		return fmt.Errorf("%s: %s", k.file, err)
+	}
+
+	var keys []keytabEntry
+	for _, e := range all {
+		if len(k.service) > 0 && !k.isService(&e) {
+			continue
+		}
+		keys = append(keys, e)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys for %q", k.file, k.service)
+	}
+
+	k.Lock()
+	k.keys, k.mtime = keys, fi.ModTime()
+	k.Unlock()
+	return nil
+}
+
+// Return true if 'e' is a key of the service; without a realm, the
+// service is in any realm.
+func (k *krbAuth) isService(e *keytabEntry) bool {
+	if strings.IndexByte(k.service, '@') >= 0 {
+		return e.principal() == k.service
+	}
+	return strings.Join(e.names, "/") == k.service
+}
+
+// Reload the keytab if it changed (new keys after a password change);
+// at most every KRB5_CHECK seconds
+func (k *krbAuth) refresh() {
+	k.Lock()
+	now := time.Now()
+	if now.Sub(k.checked) < KRB5_CHECK*time.Second {
+		k.Unlock()
+		return
+	}
+	k.checked = now
+	mtime := k.mtime
+	k.Unlock()
+
+	if fi, err := os.Stat(k.file); err == nil && !fi.ModTime().Equal(mtime) {
+		k.load()
+	}
+}
+
+// Passwords can't be checked with a keytab
+func (k *krbAuth) Authenticate(ctx context.Context, user, pass string) error {
+	return errNegotiate
+}
+
+func (k *krbAuth) AuthenticateNegotiate(ctx context.Context, token []byte) (string, error) {
+	return k.accept(token, time.Now())
+}
+
+func (k *krbAuth) accept(token []byte, now time.Time) (string, error) {
+	req, err := spnegoAPReq(token)
+	if err != nil {
+		return "", err
+	}
+
+	k.refresh()
+	k.Lock()
+	keys := k.keys
+	k.Unlock()
+
+	c, err := krbAccept(keys, req, now, k.skew)
+	if err != nil {
+		return "", err
+	}
+	if k.realms != nil && !k.realms[c.realm] {
+		return "", fmt.Errorf("kerberos: realm %s not allowed", c.realm)
+	}
+
+	// An authenticator is good once; remember those within the skew
+	id := fmt.Sprintf("%s@%s %d.%06d", c.name, c.realm, c.ctime.Unix(), c.cusec)
+	k.Lock()
+	defer k.Unlock()
+	for s, t := range k.seen {
+		if now.After(t) {
+			delete(k.seen, s)
+		}
+	}
+	if _, ok := k.seen[id]; ok {
+		return "", errKrbReplay
+	}
+	k.seen[id] = c.ctime.Add(k.skew)
+
+	if k.strip {
+		return c.name, nil
+	}
+	return c.name + "@" + c.realm, nil
+}
+
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"explicit,optional,tag:1"`
+	MechToken   []byte                  `asn1:"explicit,optional,tag:2"`
+	MechListMIC []byte                  `asn1:"explicit,optional,tag:3"`
+}
+
+// Return the Kerberos AP-REQ in the SPNEGO (or bare Kerberos) GSS-API
+// token 'b' (RFC 4178, RFC 1964)
+func spnegoAPReq(b []byte) ([]byte, error) {
+	oid, inner, err := gssUnwrap(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if oid.Equal(oidSPNEGO) {
+		var init negTokenInit
+		if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+			return nil, fmt.Errorf("spnego: bad NegTokenInit: %s", err)
+		}
+		if len(init.MechToken) == 0 {
+			return nil, fmt.Errorf("spnego: no mechanism token")
+		}
+		if oid, inner, err = gssUnwrap(init.MechToken); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case oid.Equal(oidKrb5), oid.Equal(oidMSKrb5):
+	case oid.Equal(oidNTLMSSP):
+		return nil, fmt.Errorf("spnego: NTLM is not supported")
+	default:
+		return nil, fmt.Errorf("spnego: unsupported mechanism %s", oid)
+	}
+
+	// TOK_ID of an AP-REQ
+	if len(inner) < 2 || inner[0] != 1 || inner[1] != 0 {
+		return nil, fmt.Errorf("spnego: not a Kerberos AP-REQ")
+	}
+	return inner[2:], nil
+}
+
+// Split a GSS-API InitialContextToken into its mechanism and the rest
+func gssUnwrap(b []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &v); err != nil {
+		return nil, nil, fmt.Errorf("spnego: bad token: %s", err)
+	}
+	if v.Class != asn1.ClassApplication || v.Tag != 0 {
+		return nil, nil, fmt.Errorf("spnego: not an initial token")
+	}
+
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.Unmarshal(v.Bytes, &oid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("spnego: bad mechanism: %s", err)
+	}
+	return oid, rest, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
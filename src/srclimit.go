@@ -0,0 +1,229 @@
+// srclimit.go -- per-source connection rate limiting
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/opencoff/go-ratelimit"
+	"github.com/opencoff/golang-lru"
+)
+
+// Max number of sources tracked by a per-source limiter
+const RATELIMIT_SOURCES = 30000
+
+// IPv6 clients usually get a whole /64; they are limited as one source.
+const RATELIMIT_V6_PREFIX = 64
+
+// The "rule" that denies clients that make too many name lookups
+const LOOKUP_RULE = "ratelimit-lookups"
+
+// Seconds a rate limited client is told to wait; the limits are per
+// second
+const RATELIMIT_RETRY = 1
+
+// Seconds the fleet's count of the conns of a source lives after its
+// last new one: the conns of a node that died stop counting then.
+const CONNLIMIT_TTL = 600
+
+// Token bucket (with burst) per source address. Sources are kept in a
+// LRU; the least recently seen are forgotten.
+type srcLimiter struct {
+	rate  uint
+	burst uint
+	name  string // of the limit shared by the fleet; none if empty
+
+	src *lru.TwoQueueCache
+}
+
+// Make a per-source limiter for 'rl.PerHost' conns/sec with bursts of
+// up to 'rl.Burst' conns. With shared state, sources are limited across
+// the fleet by the listener 'name'.
+func newSrcLimiter(rl *RateLimit, name string) (*srcLimiter, error) {
+	s, err := newKeyLimiter(rl.PerHost, rl.Burst)
+	if err != nil {
+		return nil, err
+	}
+	s.name = name
+	return s, nil
+}
+
+// Make a limiter for 'rl.Lookups' name lookups/sec per client with
+// bursts of up to 'rl.LookupBurst'.
+func newLookupLimiter(rl *RateLimit) (*srcLimiter, error) {
+	return newKeyLimiter(rl.Lookups, rl.LookupBurst)
+}
+
+func newKeyLimiter(rate, burst uint) (*srcLimiter, error) {
+	s := &srcLimiter{
+		rate:  rate,
+		burst: burst,
+	}
+
+	// Unlimited
+	if s.rate == 0 {
+		return s, nil
+	}
+
+	if _, err := ratelimit.NewBurst(s.rate, 1, s.burst); err != nil {
+		return nil, err
+	}
+
+	src, err := lru.New2Q(RATELIMIT_SOURCES)
+	if err != nil {
+		return nil, err
+	}
+	s.src = src
+	return s, nil
+}
+
+// Return true if the source 'ip' must be rate limited
+func (s *srcLimiter) Limit(ip net.IP) bool {
+	if s.src == nil || ip == nil {
+		return false
+	}
+
+	key := srcKey(ip)
+	if shared != nil && len(s.name) > 0 {
+		// the fleet counts conns in one second windows
+		max := s.rate
+		if s.burst > max {
+			max = s.burst
+		}
+		if over, err := shared.overRate(s.name+":"+key, max); err == nil {
+			return over
+		}
+	}
+	return s.LimitKey(key)
+}
+
+// Return true if the source named 'key' must be rate limited
+func (s *srcLimiter) LimitKey(key string) bool {
+	if s.src == nil {
+		return false
+	}
+
+	v, _ := s.src.Probe(key, func(_ interface{}) interface{} {
+		r, _ := ratelimit.NewBurst(s.rate, 1, s.burst)
+		return r
+	})
+	return v.(*ratelimit.RateLimiter).Limit()
+}
+
+// Return true if the peer of 'c' must be rate limited
+func (s *srcLimiter) LimitConn(c net.Conn) bool {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return s.Limit(a.IP)
+	}
+	return false
+}
+
+// Conns held at once per source. With shared state, the conns of a
+// source on all the nodes count.
+type connLimiter struct {
+	max  int64
+	name string // of the count shared by the fleet; none if empty
+
+	sync.Mutex
+	n map[string]int64
+}
+
+// Make a limiter for 'rl.MaxConns' conns at once per source; nil if
+// there is no limit. With shared state, sources are counted across the
+// fleet by the listener 'name'.
+func newConnLimiter(rl *RateLimit, name string) *connLimiter {
+	if rl.MaxConns == 0 {
+		return nil
+	}
+	return &connLimiter{
+		max:  int64(rl.MaxConns),
+		name: name,
+		n:    make(map[string]int64),
+	}
+}
+
+// Count a new conn of the source 'ip'; return the func that gives it
+// back and true, or false if the source holds its max already.
+func (l *connLimiter) acquire(ip net.IP) (func(), bool) {
+	key := srcKey(ip)
+	l.Lock()
+	n := l.n[key] + 1
+	l.n[key] = n
+	l.Unlock()
+
+	skey := ""
+	if shared != nil && len(l.name) > 0 {
+		k := "conns:" + l.name + ":" + key
+		if x, err := shared.incr(k, 1, 0); err == nil {
+			shared.expire(k, CONNLIMIT_TTL*time.Second)
+			skey, n = k, x
+		}
+	}
+
+	release := func() {
+		l.Lock()
+		if l.n[key]--; l.n[key] <= 0 {
+			delete(l.n, key)
+		}
+		l.Unlock()
+
+		// the count may have expired under us
+		if len(skey) > 0 {
+			if x, err := shared.incr(skey, -1, 0); err == nil && x <= 0 {
+				shared.del(skey)
+			}
+		}
+	}
+	if n > l.max {
+		release()
+		return nil, false
+	}
+	return release, true
+}
+
+// Return the accepted conn 'c', counted until it is closed, and true;
+// or false if its peer holds its max.
+func (l *connLimiter) hold(c net.Conn) (net.Conn, bool) {
+	a, ok := c.RemoteAddr().(*net.TCPAddr)
+	tc, isTCP := c.(tcpConn)
+	if l == nil || !ok || !isTCP {
+		return c, true
+	}
+	release, ok := l.acquire(a.IP)
+	if !ok {
+		return c, false
+	}
+	return &heldConn{tcpConn: tc, release: release}, true
+}
+
+// An accepted conn that counts toward the max of its source until it is
+// closed
+type heldConn struct {
+	tcpConn
+	once    sync.Once
+	release func()
+}
+
+func (c *heldConn) Close() error {
+	c.once.Do(c.release)
+	return c.tcpConn.Close()
+}
+
+// Key for a source address: the address itself for IPv4 and its prefix
+// for IPv6.
+func srcKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(RATELIMIT_V6_PREFIX, 128)).String()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,88 @@
+// srclimit_test.go -- tests for the per-source limits
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A source holds no more than its max conns at once; closing one makes
+// room for another
+func TestConnLimit(t *testing.T) {
+	echo := startEcho(t)
+	rl := RateLimit{MaxConns: 2}
+
+	// conns over the max are closed before anything is read
+	addr := startSocksProxy(t, &ListenConf{Ratelimit: rl})
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	open := func(c net.Conn) bool {
+		c.Write([]byte{5, 1, SOCKS_NOAUTH})
+		var b [2]byte
+		_, err := c.Read(b[:])
+		return err == nil
+	}
+	a, b := dial(), dial()
+	defer a.Close()
+	if !open(a) || !open(b) {
+		t.Fatalf("under the max: refused")
+	}
+	if c := dial(); open(c) {
+		t.Errorf("over the max: accepted")
+	}
+	b.Close()
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(10 * time.Millisecond)
+		c := dial()
+		ok = open(c)
+		c.Close()
+	}
+	if !ok {
+		t.Errorf("a closed conn wasn't given back")
+	}
+
+	// plaintext HTTP clients get a 429
+	addr = startHTTPProxy(t, &ListenConf{Ratelimit: RateLimit{MaxConns: 1}})
+	connect := func(c net.Conn) int {
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+	a = dial()
+	defer a.Close()
+	if n := connect(a); n != 200 {
+		t.Fatalf("first: %d", n)
+	}
+	c := dial()
+	defer c.Close()
+	if n := connect(c); n != http.StatusTooManyRequests {
+		t.Errorf("second: %d", n)
+	}
+
+	if l := newConnLimiter(&RateLimit{}, "x"); l != nil {
+		t.Errorf("off: %v", l)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,306 @@
+// talkers.go -- rolling totals of the busiest destinations, users and clients
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/opencoff/pflag"
+)
+
+const (
+	// Length of a slot of the rolling totals and the number of slots:
+	// the longest window is a day
+	TALKERS_SLOT  = time.Minute
+	TALKERS_SLOTS = 1440
+
+	// Most names of a kind in a slot; the rest are counted as
+	// TALKERS_OTHER
+	TALKERS_KEYS  = 4096
+	TALKERS_OTHER = "(other)"
+)
+
+// Seconds of the windows the admin listener shows by default
+var talkDefault = []int{300, 3600, 86400}
+
+// What the totals are kept by
+const (
+	TALK_DEST = iota
+	TALK_USER
+	TALK_CLIENT
+	TALK_KINDS
+)
+
+var talkKinds = [TALK_KINDS]string{"dest", "user", "client"}
+
+// Bytes (both ways) and sessions (requests and tunnels) of a name
+type tally struct {
+	bytes    int64
+	sessions int64
+}
+
+// The totals of one TALKERS_SLOT
+type talkSlot struct {
+	n int64 // slot number: unix time / TALKERS_SLOT
+	m [TALK_KINDS]map[string]*tally
+}
+
+// The last TALKERS_SLOTS slots; kept only when an admin listener shows
+// them.
+var talkers = struct {
+	sync.Mutex
+	on    bool
+	slots [TALKERS_SLOTS]*talkSlot
+}{}
+
+// A name and its totals in a window
+type talker struct {
+	Name     string `json:"name"`
+	Bytes    int64  `json:"bytes"`
+	Sessions int64  `json:"sessions"`
+}
+
+// The top talkers of a window, as /top shows them
+type topWindow struct {
+	Window int      `json:"window"` // seconds
+	Dest   []talker `json:"dest"`
+	User   []talker `json:"user"`
+	Client []talker `json:"client"`
+}
+
+// Start keeping the totals
+func enableTalkers() {
+	talkers.Lock()
+	talkers.on = true
+	talkers.Unlock()
+}
+
+// Count 'bytes' and 'sessions' of 'user' at 'client' to 'dest' (host or
+// host:port) at 'now'.
+func talk(user string, client net.IP, dest string, bytes, sessions int64, now time.Time) {
+	if bytes == 0 && sessions == 0 {
+		return
+	}
+	anomalies.moved(user, client, bytes, now)
+	if h, _, err := net.SplitHostPort(dest); err == nil {
+		dest = h
+	}
+	var names [TALK_KINDS]string
+	names[TALK_DEST] = dest
+	names[TALK_USER] = user
+	if client != nil {
+		names[TALK_CLIENT] = client.String()
+	}
+
+	talkers.Lock()
+	defer talkers.Unlock()
+	if !talkers.on {
+		return
+	}
+
+	n := now.UnixNano() / int64(TALKERS_SLOT)
+	i := n % TALKERS_SLOTS
+	s := talkers.slots[i]
+	if s == nil || s.n != n {
+		s = &talkSlot{n: n}
+		for k := range s.m {
+			s.m[k] = make(map[string]*tally)
+		}
+		talkers.slots[i] = s
+	}
+
+	for k, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		m := s.m[k]
+		t, ok := m[name]
+		if !ok {
+			if len(m) >= TALKERS_KEYS {
+				name = TALKERS_OTHER
+			}
+			if t, ok = m[name]; !ok {
+				t = &tally{}
+				m[name] = t
+			}
+		}
+		t.bytes += bytes
+		t.sessions += sessions
+	}
+}
+
+// Return the 'n' names of each kind with the most bytes (or sessions if
+// 'bySessions') in the 'window' before 'now'.
+func topTalkers(window time.Duration, n int, bySessions bool, now time.Time) map[string][]talker {
+	last := now.UnixNano() / int64(TALKERS_SLOT)
+	first := last - int64((window+TALKERS_SLOT-1)/TALKERS_SLOT) + 1
+
+	var sum [TALK_KINDS]map[string]*talker
+	for k := range sum {
+		sum[k] = make(map[string]*talker)
+	}
+
+	talkers.Lock()
+	for _, s := range talkers.slots {
+		if s == nil || s.n < first || s.n > last {
+			continue
+		}
+		for k, m := range s.m {
+			for name, t := range m {
+				x, ok := sum[k][name]
+				if !ok {
+					x = &talker{Name: name}
+					sum[k][name] = x
+				}
+				x.Bytes += t.bytes
+				x.Sessions += t.sessions
+			}
+		}
+	}
+	talkers.Unlock()
+
+	r := make(map[string][]talker, TALK_KINDS)
+	for k, m := range sum {
+		v := make([]talker, 0, len(m))
+		for _, x := range m {
+			v = append(v, *x)
+		}
+		sort.Slice(v, func(i, j int) bool {
+			a, b := v[i], v[j]
+			if bySessions && a.Sessions != b.Sessions {
+				return a.Sessions > b.Sessions
+			}
+			if a.Bytes != b.Bytes {
+				return a.Bytes > b.Bytes
+			}
+			if a.Sessions != b.Sessions {
+				return a.Sessions > b.Sessions
+			}
+			return a.Name < b.Name
+		})
+		if n > 0 && len(v) > n {
+			v = v[:n]
+		}
+		r[talkKinds[k]] = v
+	}
+	return r
+}
+
+// Return the windows of 'secs'; the default ones if it is empty
+func talkWindows(secs []int) ([]time.Duration, error) {
+	if len(secs) == 0 {
+		secs = talkDefault
+	}
+	v := make([]time.Duration, 0, len(secs))
+	for _, s := range secs {
+		d := time.Duration(s) * time.Second
+		if s <= 0 || d > TALKERS_SLOTS*TALKERS_SLOT {
+			return nil, fmt.Errorf("top talkers: window %ds is not between 1s and %s", s,
+				TALKERS_SLOTS*TALKERS_SLOT)
+		}
+		v = append(v, d)
+	}
+	return v, nil
+}
+
+// The "top" command: print the top talkers of a running goproxy from its
+// admin listener.
+func topCommand(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	window := fs.IntP("window", "w", 0, "Show only the last `N` seconds (default: all windows)")
+	n := fs.IntP("count", "n", 10, "Show the top `N` of each")
+	by := fs.StringP("by", "b", "bytes", "Rank by `bytes` or sessions")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s top [options] [admin-url]\n"+
+			"The admin password or session token is in $GOPROXY_ADMIN_PASSWORD or\n"+
+			"$GOPROXY_ADMIN_TOKEN; the admin-url is http://127.0.0.1:9090 by default.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	u := "http://127.0.0.1:9090"
+	if fs.NArg() > 0 {
+		u = fs.Arg(0)
+	}
+	q := url.Values{"n": {strconv.Itoa(*n)}, "by": {*by}}
+	if *window > 0 {
+		q.Set("window", strconv.Itoa(*window))
+	}
+
+	err := topReport(os.Stdout, strings.TrimSuffix(u, "/")+"/top?"+q.Encode(),
+		os.Getenv("GOPROXY_ADMIN_PASSWORD"), os.Getenv("GOPROXY_ADMIN_TOKEN"))
+	if err != nil {
+		die("top: %s", err)
+	}
+}
+
+// Fetch the top talkers from 'u' with the admin password 'pass' or the
+// session 'token' and write them to 'w' as tables.
+func topReport(w io.Writer, u, pass, token string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(token) > 0:
+		req.Header.Set("Authorization", "Bearer "+token)
+	case len(pass) > 0:
+		req.SetBasicAuth("admin", pass)
+	}
+
+	c := &http.Client{Timeout: 30 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+
+	var top struct {
+		Windows []topWindow `json:"windows"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&top); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for i, t := range top.Windows {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Last %s\t\t\t\n", time.Duration(t.Window)*time.Second)
+		for _, k := range []struct {
+			title string
+			v     []talker
+		}{{"Destination", t.Dest}, {"User", t.User}, {"Client", t.Client}} {
+			fmt.Fprintf(tw, "%s\tBytes\tSessions\t\n", k.title)
+			for _, x := range k.v {
+				fmt.Fprintf(tw, "%s\t%d\t%d\t\n", x.Name, x.Bytes, x.Sessions)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,147 @@
+// talkers_test.go -- tests for the top talkers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTalkers(t *testing.T) {
+	enableTalkers()
+
+	// far from the slots other tests fill
+	now := time.Unix(4000000000, 0)
+	ip := net.ParseIP("192.0.2.9")
+	talk("alice", ip, "a.example:443", 1000, 1, now.Add(-2*time.Hour))
+	talk("alice", ip, "a.example:443", 100, 1, now.Add(-30*time.Minute))
+	talk("bob", nil, "b.example", 500, 1, now.Add(-2*time.Minute))
+	talk("bob", nil, "b.example", 10, 1, now)
+	talk("bob", nil, "b.example", 10, 1, now)
+
+	top := topTalkers(5*time.Minute, 10, false, now)
+	if d := top["dest"]; len(d) != 1 || d[0] != (talker{"b.example", 520, 3}) {
+		t.Errorf("5m dest: %+v", d)
+	}
+	if c := top["client"]; len(c) != 0 {
+		t.Errorf("5m client: %+v", c)
+	}
+
+	top = topTalkers(time.Hour, 10, false, now)
+	if u := top["user"]; len(u) != 2 || u[0] != (talker{"bob", 520, 3}) || u[1] != (talker{"alice", 100, 1}) {
+		t.Errorf("1h user: %+v", u)
+	}
+	top = topTalkers(time.Hour, 10, true, now)
+	if u := top["user"]; u[0].Name != "bob" {
+		t.Errorf("1h by sessions: %+v", u)
+	}
+
+	top = topTalkers(24*time.Hour, 1, false, now)
+	if u := top["user"]; len(u) != 1 || u[0] != (talker{"alice", 1100, 2}) {
+		t.Errorf("1d user: %+v", u)
+	}
+	if c := top["client"]; len(c) != 1 || c[0].Name != "192.0.2.9" {
+		t.Errorf("1d client: %+v", c)
+	}
+
+	// A slot a day old is reused
+	talk("carol", nil, "c.example", 1, 1, now.Add(24*time.Hour-30*time.Minute))
+	top = topTalkers(24*time.Hour, 10, false, now.Add(24*time.Hour))
+	if u := top["user"]; len(u) != 1 || u[0].Name != "carol" {
+		t.Errorf("a day later: %+v", u)
+	}
+
+	// Names past TALKERS_KEYS in a slot are folded
+	later := now.Add(48 * time.Hour)
+	for i := 0; i < TALKERS_KEYS+5; i++ {
+		talk("", nil, fmt.Sprintf("h%d.example", i), 1, 1, later)
+	}
+	top = topTalkers(time.Minute, 1, false, later)
+	if d := top["dest"]; len(d) != 1 || d[0] != (talker{TALKERS_OTHER, 5, 5}) {
+		t.Errorf("overflow: %+v", d)
+	}
+
+	if v, err := talkWindows(nil); err != nil || len(v) != 3 || v[2] != 24*time.Hour {
+		t.Errorf("default windows: %v %v", v, err)
+	}
+	for _, w := range [][]int{{0}, {86401}, {60, -1}} {
+		if _, err := talkWindows(w); err == nil {
+			t.Errorf("windows %v: no error", w)
+		}
+	}
+}
+
+func TestAdminTop(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	t.Cleanup(origin.Close)
+
+	// only this test's requests
+	talkers.Lock()
+	talkers.slots = [TALKERS_SLOTS]*talkSlot{}
+	talkers.Unlock()
+
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n"), Windows: []int{60, 600}})
+	addr := startHTTPProxy(t, &ListenConf{})
+
+	tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}
+	t.Cleanup(tr.CloseIdleConnections)
+	for i := 0; i < 3; i++ {
+		res, err := (&http.Client{Transport: tr}).Get(origin.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	var b bytes.Buffer
+	if err := topReport(&b, u+"/top?window=60", "adm1n", ""); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if !strings.Contains(out, "Last 1m0s") || strings.Contains(out, "Last 10m0s") {
+		t.Errorf("windows:\n%s", out)
+	}
+	h, _, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+	var line string
+	for _, l := range strings.Split(out, "\n") {
+		if f := strings.Fields(l); len(f) == 3 && f[0] == h {
+			line = l
+			break
+		}
+	}
+	if f := strings.Fields(line); len(f) != 3 || f[2] != "3" {
+		t.Errorf("no line for %s with 3 sessions:\n%s", h, out)
+	}
+
+	b.Reset()
+	if err := topReport(&b, u+"/top", "adm1n", ""); err != nil || !strings.Contains(b.String(), "Last 10m0s") {
+		t.Errorf("all windows: %v\n%s", err, b.String())
+	}
+	if err := topReport(&b, u+"/top", "nope", ""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("bad password: %v", err)
+	}
+	for _, q := range []string{"window=0", "window=x", "n=0", "by=time"} {
+		if err := topReport(&b, u+"/top?"+q, "adm1n", ""); err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("%s: %v", q, err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,144 @@
+// tempaddr.go -- temporary IPv6 source addresses from a prefix
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Longest prefix temporary addresses are made from; shorter ones
+	// leave more random bits
+	TEMPADDR_PREFIX = 96
+
+	// Users whose current temporary address is remembered
+	TEMPADDR_USERS = 4096
+)
+
+// Random source addresses in an IPv6 prefix that is routed to this host,
+// in the manner of RFC 8981: each user has one for 'rotate' and then
+// gets a new one, or each connection has its own if 'rotate' is 0.
+// Clients that don't authenticate share the address of the user "".
+// Connections keep the address they were made with.
+type tempAddrs struct {
+	// 64-bit atomics first (alignment on 32-bit platforms)
+	made uint64
+
+	prefix *net.IPNet
+	ones   int
+	rotate time.Duration
+
+	sync.Mutex
+	cur map[string]tempAddr
+}
+
+type tempAddr struct {
+	ip  net.IP
+	exp time.Time
+}
+
+func newTempAddrs(prefix string, rotate int) (*tempAddrs, error) {
+	ip, n, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("egress: prefix %q is not an IPv6 CIDR", prefix)
+	}
+	ones, _ := n.Mask.Size()
+	if ones > TEMPADDR_PREFIX {
+		return nil, fmt.Errorf("egress: prefix %s: longer than /%d", prefix, TEMPADDR_PREFIX)
+	}
+	if rotate < 0 {
+		return nil, fmt.Errorf("egress: invalid rotate %d", rotate)
+	}
+	return &tempAddrs{
+		prefix: n,
+		ones:   ones,
+		rotate: time.Duration(rotate) * time.Second,
+		cur:    make(map[string]tempAddr),
+	}, nil
+}
+
+// Return the source address of a connection of 'user'
+func (t *tempAddrs) addr(user string) net.IP {
+	if t.rotate <= 0 {
+		return t.random()
+	}
+
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	if a, ok := t.cur[user]; ok && now.Before(a.exp) {
+		return a.ip
+	}
+	if len(t.cur) >= TEMPADDR_USERS {
+		for k, a := range t.cur {
+			if !now.Before(a.exp) {
+				delete(t.cur, k)
+			}
+		}
+		if len(t.cur) >= TEMPADDR_USERS {
+			t.cur = make(map[string]tempAddr)
+		}
+	}
+	a := tempAddr{t.random(), now.Add(t.rotate)}
+	t.cur[user] = a
+	return a.ip
+}
+
+// Make an address with random host bits; never a reserved interface
+// identifier
+func (t *tempAddrs) random() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for {
+		rand.Read(ip)
+		for i := range ip {
+			ip[i] = ip[i]&^t.prefix.Mask[i] | t.prefix.IP[i]&t.prefix.Mask[i]
+		}
+		if !reservedIID(ip, t.ones) {
+			break
+		}
+	}
+	atomic.AddUint64(&t.made, 1)
+	return ip
+}
+
+// Return true if the host part of 'ip' (after 'ones' bits) is all zero
+// (the subnet-router anycast address) or, in a /64 or shorter prefix,
+// one of the interface identifiers reserved by RFC 5453.
+func reservedIID(ip net.IP, ones int) bool {
+	zero := true
+	for i := ones; i < 128; i++ {
+		if ip[i/8]&(0x80>>uint(i%8)) != 0 {
+			zero = false
+			break
+		}
+	}
+	if zero {
+		return true
+	}
+	if ones > 64 {
+		return false
+	}
+
+	iid := binary.BigEndian.Uint64(ip[8:])
+	switch {
+	case iid >= 0xfdffffffffffff80 && iid <= 0xfdffffffffffffff:
+		return true
+	case iid >= 0x02005efe00000000 && iid <= 0x02005efeffffffff:
+		return true
+	}
+	return false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,128 @@
+// tenant.go -- listeners of customers kept apart from each other
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// A tenant is a set of listeners with their own users, rules, quotas,
+// egress addresses and access log. Everything a listener keeps is its
+// own already; what tenants add is a name in every session, in the
+// state shared by a fleet and in the usage counts, so that two tenants
+// with a user "alice" don't add up, and checks that no two tenants share
+// a file of credentials or addresses.
+
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Return a context that carries the tenant of the listener
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if len(tenant) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxTenant, tenant)
+}
+
+// Return the tenant of ctx; "" if there is none
+func tenantOf(ctx context.Context) string {
+	s, _ := ctx.Value(ctxTenant).(string)
+	return s
+}
+
+// Return the name 'user' of 'tenant' has where users of all tenants
+// are counted together (top talkers, anomalies)
+func tenantUser(tenant, user string) string {
+	if len(tenant) == 0 || len(user) == 0 {
+		return user
+	}
+	return tenant + "/" + user
+}
+
+// Return the name of the log of the listener 'lc' of 'kind' on 'addr'
+func logName(kind string, lc *ListenConf, addr net.Addr) string {
+	if len(lc.Tenant) == 0 {
+		return kind + "-" + addr.String()
+	}
+	return kind + "-" + lc.Tenant + "-" + addr.String()
+}
+
+// Check the tenants of 'cfg' and name them in their listeners. The
+// listeners outside tenants count as the tenant "".
+func checkTenants(cfg *Conf) error {
+	// file -> the tenant that uses it
+	files := make(map[string]string)
+	use := func(tenant, what, fn string) error {
+		if len(fn) == 0 {
+			return nil
+		}
+		if t, ok := files[fn]; ok && t != tenant {
+			return fmt.Errorf("tenants %q and %q share %s %s", t, tenant, what, fn)
+		}
+		files[fn] = tenant
+		return nil
+	}
+	listeners := func(tenant string, v []ListenConf) error {
+		for i := range v {
+			lc := &v[i]
+			lc.Tenant = tenant
+			if err := use(tenant, "auth file", lc.Auth.Args["file"]); err != nil {
+				return err
+			}
+			if err := use(tenant, "egress file", lc.Egress.File); err != nil {
+				return err
+			}
+			for _, a := range lc.Egress.Pool {
+				if err := use(tenant, "egress address", a); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := listeners("", cfg.Http); err != nil {
+		return err
+	}
+	if err := listeners("", cfg.Socks); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Tenants {
+		t := &cfg.Tenants[i]
+		if !tenantName.MatchString(t.Name) {
+			return fmt.Errorf("tenant %q: want a name of a-z, 0-9, - and _", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenant %q: defined twice", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Http) == 0 && len(t.Socks) == 0 {
+			return fmt.Errorf("tenant %q: no listeners", t.Name)
+		}
+		if len(t.URLlog) > 0 && t.URLlog == cfg.URLlog {
+			return fmt.Errorf("tenant %q: urllog %s is the main access log", t.Name, t.URLlog)
+		}
+		if err := use(t.Name, "urllog", t.URLlog); err != nil {
+			return err
+		}
+		if err := listeners(t.Name, t.Http); err != nil {
+			return err
+		}
+		if err := listeners(t.Name, t.Socks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
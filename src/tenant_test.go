@@ -0,0 +1,119 @@
+// tenant_test.go -- tests for the tenants
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenants(t *testing.T) {
+	echo := startEcho(t)
+
+	// two tenants, each with a user alice
+	a := startHTTPProxy(t, &ListenConf{Auth: authConf(t), Tenant: "acme"})
+	b := startHTTPProxy(t, &ListenConf{Auth: authConf(t), Tenant: "globex"})
+	ca, _ := connectTunnel(t, a, echo.Addr().String(), "alice", "wonder")
+	defer ca.Close()
+	cb, _ := connectTunnel(t, b, echo.Addr().String(), "alice", "wonder")
+	defer cb.Close()
+
+	tenants := func() map[string]int {
+		m := map[string]int{}
+		for _, s := range sessionStats("alice", time.Now()) {
+			m[s.Tenant]++
+		}
+		return m
+	}
+	for i := 0; i < 100 && len(tenants()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := tenants(); m["acme"] != 1 || m["globex"] != 1 {
+		t.Fatalf("sessions by tenant: %v", m)
+	}
+
+	// a kill of acme's alice leaves globex's alone
+	if n := killSessions("", "acme", "alice"); n != 1 {
+		t.Fatalf("killed %d", n)
+	}
+	ca.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(ca); err != nil {
+		t.Errorf("acme: %s", err)
+	}
+	io.WriteString(cb, "ping")
+	buf := make([]byte, 4)
+	cb.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cb, buf); err != nil {
+		t.Errorf("globex: %s", err)
+	}
+}
+
+func TestTenantRealm(t *testing.T) {
+	ac := authConf(t)
+	ac.Realm = ""
+	addr := startHTTPProxy(t, &ListenConf{Auth: ac, Tenant: "acme"})
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(mustURL("http://" + addr))}}
+	res, err := c.Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if h := res.Header.Get("Proxy-Authenticate"); res.StatusCode != 407 || h != `Basic realm="acme"` {
+		t.Errorf("%d %q", res.StatusCode, h)
+	}
+}
+
+func TestTenantConf(t *testing.T) {
+	lc := func(fn string) ListenConf {
+		return ListenConf{Listen: "127.0.0.1:0", Auth: AuthConf{Type: "htpasswd",
+			Args: map[string]string{"file": fn}}}
+	}
+	cfg := &Conf{
+		Http: []ListenConf{lc("/etc/goproxy/main.htpasswd")},
+		Tenants: []TenantConf{
+			{Name: "acme", Http: []ListenConf{lc("/etc/goproxy/acme.htpasswd")}},
+			{Name: "globex", Socks: []ListenConf{lc("/etc/goproxy/globex.htpasswd")},
+				URLlog: "/var/log/goproxy/globex.log"},
+		},
+	}
+	if err := checkTenants(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Http[0].Tenant != "" || cfg.Tenants[0].Http[0].Tenant != "acme" ||
+		cfg.Tenants[1].Socks[0].Tenant != "globex" {
+		t.Errorf("tenants not set")
+	}
+
+	eg := ListenConf{Listen: "127.0.0.1:0", Egress: EgressConf{Pool: []string{"192.0.2.0/28"}}}
+	for _, c := range []*Conf{
+		{Tenants: []TenantConf{{Name: "Acme", Http: []ListenConf{lc("a")}}}},
+		{Tenants: []TenantConf{{Name: "acme"}}},
+		{Tenants: []TenantConf{{Name: "acme", Http: []ListenConf{lc("a")}},
+			{Name: "acme", Http: []ListenConf{lc("b")}}}},
+		{Tenants: []TenantConf{{Name: "acme", Http: []ListenConf{lc("a")}},
+			{Name: "globex", Socks: []ListenConf{lc("a")}}}},
+		{Http: []ListenConf{lc("a")}, Tenants: []TenantConf{{Name: "acme", Http: []ListenConf{lc("a")}}}},
+		{Http: []ListenConf{eg}, Tenants: []TenantConf{{Name: "acme", Http: []ListenConf{eg}}}},
+		{URLlog: "/var/log/goproxy/url.log", Tenants: []TenantConf{{Name: "acme",
+			URLlog: "/var/log/goproxy/url.log", Http: []ListenConf{lc("a")}}}},
+	} {
+		if err := checkTenants(c); err == nil {
+			t.Errorf("%+v: no error", c.Tenants)
+		} else if !strings.Contains(err.Error(), "tenant") {
+			t.Errorf("%+v: %s", c.Tenants, err)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
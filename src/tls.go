@@ -0,0 +1,271 @@
+// tls.go -- TLS listeners and client certificates
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+var errNoRawConn = errors.New("tls: no raw socket")
+
+// TLS of a listener and the users its client certificates name
+type listenTLS struct {
+	conf     *tls.Config
+	identity []string
+	users    map[string]string // nil: the certificate name is the user
+	plain    bool              // plaintext clients too
+	cert     *certFile         // certificate from files; nil if none
+	acme     *acmeCerts        // certificates from an ACME CA; nil if none
+}
+
+// Return the TLS of a listener or nil if it has none
+func newListenTLS(tc *TLSConf, log *L.Logger) (*listenTLS, error) {
+	if len(tc.Cert) > 0 && len(tc.ACME.Domains) > 0 {
+		return nil, fmt.Errorf("tls: 'cert' and 'acme' can't go together")
+	}
+	if len(tc.Cert) == 0 && len(tc.ACME.Domains) == 0 {
+		if tc.Plain {
+			return nil, fmt.Errorf("tls: 'plain' needs a 'cert'")
+		}
+		if len(tc.ClientCA) > 0 || len(tc.Users) > 0 {
+			return nil, fmt.Errorf("tls: client certificates need a 'cert'")
+		}
+		if _, err := newACMECerts(&tc.ACME, log); err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		return nil, nil
+	}
+
+	t := &listenTLS{
+		conf: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+		identity: []string{"dns", "email", "uri", "cn"},
+		plain:    tc.Plain,
+	}
+	if err := t.clientAuth(tc); err != nil {
+		return nil, err
+	}
+	if tc.OCSP && len(tc.Cert) == 0 {
+		return nil, fmt.Errorf("tls: 'ocsp' needs a 'cert'")
+	}
+	if len(tc.Cert) > 0 {
+		c, err := newCertFile(tc.Cert, tc.Key, tc.OCSP, log)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		t.conf.GetCertificate = c.get
+		t.cert = c
+	}
+
+	if len(tc.ACME.Domains) > 0 {
+		a, err := newACMECerts(&tc.ACME, log)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		a.use(t.conf)
+		t.acme = a
+	}
+	return t, nil
+}
+
+// Set up the client certificates of 'tc'
+func (t *listenTLS) clientAuth(tc *TLSConf) error {
+
+	how := strings.ToLower(tc.ClientAuth)
+	if len(how) == 0 {
+		how = "none"
+		if len(tc.ClientCA) > 0 {
+			how = "require"
+		}
+	}
+	switch how {
+	case "none":
+		if len(tc.Users) > 0 {
+			return fmt.Errorf("tls: 'users' needs client certificates")
+		}
+		return nil
+	case "optional":
+		t.conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		if tc.Plain {
+			return fmt.Errorf("tls: 'plain' can't go with clientauth require")
+		}
+		t.conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("tls: unknown clientauth %q", tc.ClientAuth)
+	}
+
+	if len(tc.ClientCA) == 0 {
+		return fmt.Errorf("tls: clientauth %s needs a 'clientca'", how)
+	}
+	pem, err := os.ReadFile(tc.ClientCA)
+	if err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("tls: %s: no certificates", tc.ClientCA)
+	}
+	t.conf.ClientCAs = pool
+
+	if len(tc.Identity) > 0 {
+		t.identity = nil
+		for _, s := range tc.Identity {
+			s = strings.ToLower(s)
+			switch s {
+			case "dns", "email", "uri", "cn":
+				t.identity = append(t.identity, s)
+			default:
+				return fmt.Errorf("tls: unknown identity %q", s)
+			}
+		}
+	}
+	if len(tc.Users) > 0 {
+		t.users = tc.Users
+	}
+	return nil
+}
+
+// Stop renewing the certificates of the listener
+func (t *listenTLS) close() {
+	if t == nil {
+		return
+	}
+	if t.cert != nil {
+		t.cert.close()
+	}
+	if t.acme != nil {
+		t.acme.close()
+	}
+}
+
+// Return the server side of the TLS connection 'nc'
+func (t *listenTLS) server(nc net.Conn) net.Conn {
+	return tls.Server(nc, t.conf)
+}
+
+// Return the server side of the accepted connection 'nc': TLS, or 'nc'
+// itself if the listener takes plaintext clients and the first byte
+// isn't that of a TLS handshake record (a ClientHello). The caller
+// bounds the read with a deadline.
+func (t *listenTLS) accept(nc net.Conn) (net.Conn, error) {
+	if !t.plain {
+		return t.server(nc), nil
+	}
+	b, pc, err := peekByte(nc)
+	if err != nil {
+		return nil, err
+	}
+	if b == 0x16 {
+		return t.server(pc), nil
+	}
+	return pc, nil
+}
+
+// Finish the TLS handshake of the client connection 'c' if it is one;
+// return its state, or nil for a plaintext client
+func tlsState(c net.Conn) (*tls.ConnectionState, error) {
+	switch v := c.(type) {
+	case *tls.Conn:
+		if err := v.Handshake(); err != nil {
+			return nil, err
+		}
+		cs := v.ConnectionState()
+		return &cs, nil
+	case *tlsConn:
+		return tlsState(v.Conn)
+	case *peekConn:
+		return tlsState(v.tcpConn)
+	}
+	return nil, nil
+}
+
+// Return a context for a new connection 'c' of an http.Server that
+// carries its TLS state, if it has one
+func withConnTLS(ctx context.Context, c net.Conn) context.Context {
+	if cs, _ := tlsState(c); cs != nil {
+		return context.WithValue(ctx, ctxConnTLS, cs)
+	}
+	return ctx
+}
+
+// Return the TLS state of the connection of ctx (or nil)
+func connTLSOf(ctx context.Context) *tls.ConnectionState {
+	cs, _ := ctx.Value(ctxConnTLS).(*tls.ConnectionState)
+	return cs
+}
+
+// Return the user named by the verified client certificate of 'cs'; ""
+// if the client didn't send one.
+func (t *listenTLS) user(cs *tls.ConnectionState) (string, error) {
+	if len(cs.VerifiedChains) == 0 {
+		return "", nil
+	}
+
+	c := cs.PeerCertificates[0]
+	for _, id := range t.identity {
+		var names []string
+		switch id {
+		case "dns":
+			names = c.DNSNames
+		case "email":
+			names = c.EmailAddresses
+		case "uri":
+			for _, u := range c.URIs {
+				names = append(names, u.String())
+			}
+		case "cn":
+			if len(c.Subject.CommonName) > 0 {
+				names = []string{c.Subject.CommonName}
+			}
+		}
+
+		for _, s := range names {
+			if t.users == nil {
+				return s, nil
+			}
+			if u, ok := t.users[s]; ok {
+				return u, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("client certificate %q names no user", c.Subject.String())
+}
+
+// A TLS client connection for the copier. The bytes must go through
+// tls.Conn - so there is no raw socket, and tunnels of TLS clients use
+// copyBuf() instead of the zero-copy relays.
+type tlsConn struct {
+	*tls.Conn
+}
+
+func (c *tlsConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoRawConn
+}
+
+// Return the accepted client connection 'c' for the copier
+func clientConn(c net.Conn) tcpConn {
+	if t, ok := c.(*tls.Conn); ok {
+		return &tlsConn{t}
+	}
+	return c.(tcpConn)
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
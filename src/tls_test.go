@@ -0,0 +1,375 @@
+// tls_test.go -- tests for TLS listeners and client certificates
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+	"golang.org/x/net/proxy"
+)
+
+// A test CA that issues server and client certificates
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string // PEM of the CA certificate
+	n    int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{dir: t.TempDir(), pool: x509.NewCertPool()}
+	ca.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.pool.AddCert(ca.cert)
+	ca.file = filepath.Join(ca.dir, "ca.pem")
+	ioutil.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ca.n = 1
+	return ca
+}
+
+// Issue a certificate from 'tmpl'; return it and the name of a PEM file
+// with the certificate and its key.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (tls.Certificate, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.n++
+	tmpl.SerialNumber = big.NewInt(ca.n)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})...)
+	fn := filepath.Join(ca.dir, fmt.Sprintf("cert%d.pem", ca.n))
+	ioutil.WriteFile(fn, b, 0600)
+
+	c, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fn
+}
+
+func (ca *testCA) server(t *testing.T) string {
+	_, fn := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return fn
+}
+
+func (ca *testCA) client(t *testing.T, cn string, dns ...string) tls.Certificate {
+	c, _ := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    dns,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return c
+}
+
+// A verified connection state with the client certificate 'c'
+func certState(c tls.Certificate) *tls.ConnectionState {
+	x, _ := x509.ParseCertificate(c.Certificate[0])
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{x},
+		VerifiedChains: [][]*x509.Certificate{{x}}}
+}
+
+func TestListenTLS(t *testing.T) {
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	ca := newTestCA(t)
+	cert := ca.server(t)
+
+	bad := []TLSConf{
+		{ClientCA: ca.file},
+		{Cert: filepath.Join(ca.dir, "none.pem")},
+		{Cert: cert, ClientAuth: "require"},
+		{Cert: cert, ClientAuth: "maybe", ClientCA: ca.file},
+		{Cert: cert, ClientCA: cert + "x"},
+		{Cert: cert, Users: map[string]string{"a": "b"}},
+		{Cert: cert, ClientCA: ca.file, Identity: []string{"ip"}},
+		{Plain: true},
+		{Cert: cert, ClientCA: ca.file, Plain: true},
+	}
+	for i := range bad {
+		if _, err := newListenTLS(&bad[i], log); err == nil {
+			t.Errorf("%+v: no error", bad[i])
+		}
+	}
+	if lt, err := newListenTLS(&TLSConf{}, log); lt != nil || err != nil {
+		t.Errorf("no cert: %v %v", lt, err)
+	}
+
+	lt, err := newListenTLS(&TLSConf{Cert: cert, ClientCA: ca.file}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt.conf.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("clientauth %v", lt.conf.ClientAuth)
+	}
+
+	robot := ca.client(t, "robot", "robot.example.com")
+	tests := []struct {
+		identity []string
+		users    map[string]string
+		want     string
+		ok       bool
+	}{
+		{nil, nil, "robot.example.com", true},
+		{[]string{"cn"}, nil, "robot", true},
+		{[]string{"email"}, nil, "", false},
+		{nil, map[string]string{"robot": "build"}, "build", true},
+		{nil, map[string]string{"other": "build"}, "", false},
+	}
+	for _, tt := range tests {
+		lt, err := newListenTLS(&TLSConf{Cert: cert, ClientCA: ca.file, Identity: tt.identity, Users: tt.users}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := lt.user(certState(robot))
+		if u != tt.want || (err == nil) != tt.ok {
+			t.Errorf("%v %v: %q %v", tt.identity, tt.users, u, err)
+		}
+	}
+
+	// No certificate is no user
+	if u, err := lt.user(&tls.ConnectionState{}); u != "" || err != nil {
+		t.Errorf("no certificate: %q %v", u, err)
+	}
+}
+
+func TestTLSProxy(t *testing.T) {
+	ca := newTestCA(t)
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	dest := echo.Addr().String()
+
+	// guests may not reach the echo server; every name is a user
+	lc := &ListenConf{
+		TLS:   TLSConf{Cert: ca.server(t), ClientCA: ca.file, ClientAuth: "optional", Identity: []string{"cn"}},
+		Auth:  authConf(t),
+		Rules: []RuleConf{{Name: "no-guest", Dest: []string{"127.0.0.0/8"}, Users: []string{"guest"}, Action: "deny"}},
+	}
+	addr := startHTTPProxy(t, lc)
+
+	connect := func(certs ...tls.Certificate) int {
+		c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool, Certificates: certs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode == 200 {
+			io.WriteString(c, "ping")
+			var b [4]byte
+			if _, err := io.ReadFull(br, b[:]); err != nil || string(b[:]) != "ping" {
+				t.Errorf("tunnel: %q %v", b, err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	if n := connect(ca.client(t, "robot")); n != 200 {
+		t.Errorf("robot: %d", n)
+	}
+	if n := connect(ca.client(t, "guest")); n != http.StatusForbidden {
+		t.Errorf("guest: %d", n)
+	}
+	if n := connect(); n != http.StatusProxyAuthRequired {
+		t.Errorf("no certificate: %d", n)
+	}
+
+	// Passwords still work for clients without certificates
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+	pu := &url.URL{Scheme: "https", Host: addr, User: url.UserPassword("alice", "wonder")}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{RootCAs: ca.pool}}}
+	res, err := c.Get(origin.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("password over TLS: %d", res.StatusCode)
+	}
+
+	// A certificate from another CA is refused; TLS 1.3 clients learn
+	// of it on their first read
+	other := newTestCA(t)
+	tc, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool,
+		Certificates: []tls.Certificate{other.client(t, "robot")}})
+	if err == nil {
+		fmt.Fprintf(tc, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+		_, err = http.ReadResponse(bufio.NewReader(tc), nil)
+		tc.Close()
+	}
+	if err == nil {
+		t.Errorf("certificate of another CA accepted")
+	}
+}
+
+// A dialer for SOCKS over TLS
+type tlsDialer tls.Config
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return tls.Dial(network, addr, (*tls.Config)(d))
+}
+
+func TestTLSSOCKS(t *testing.T) {
+	ca := newTestCA(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(origin.Close)
+
+	lc := &ListenConf{
+		TLS:  TLSConf{Cert: ca.server(t), ClientCA: ca.file, Users: map[string]string{"robot.example.com": "robot"}},
+		Auth: authConf(t),
+	}
+	addr := startSocksProxy(t, lc)
+
+	dial := func(a *proxy.Auth, certs ...tls.Certificate) error {
+		fwd := &tlsDialer{RootCAs: ca.pool, Certificates: certs}
+		d, _ := proxy.SOCKS5("tcp", addr, a, fwd)
+		c, err := d.Dial("tcp", origin.Listener.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(nil, ca.client(t, "x", "robot.example.com")); err != nil {
+		t.Errorf("robot: %s", err)
+	}
+	if err := dial(nil, ca.client(t, "x", "other.example.com")); err == nil {
+		t.Errorf("unmapped certificate accepted")
+	}
+	if err := dial(&proxy.Auth{User: "alice", Password: "wonder"}); err == nil {
+		t.Errorf("no certificate accepted")
+	}
+}
+
+// TLS and plaintext clients on one port
+func TestTLSPlain(t *testing.T) {
+	ca := newTestCA(t)
+	dest := startEcho(t).Addr().String()
+	tc := TLSConf{Cert: ca.server(t), ClientCA: ca.file, ClientAuth: "optional", Identity: []string{"cn"}, Plain: true}
+	robot := []tls.Certificate{ca.client(t, "robot")}
+	alice := &proxy.Auth{User: "alice", Password: "wonder"}
+
+	mixed := startHTTPProxy(t, &ListenConf{TLS: tc, Auth: authConf(t), Mixed: true})
+	socks := startSocksProxy(t, &ListenConf{TLS: tc, Auth: authConf(t)})
+	for _, addr := range []string{mixed, socks} {
+		// a certificate over TLS or a password in the clear
+		for _, v := range []struct {
+			fwd  proxy.Dialer
+			auth *proxy.Auth
+			ok   bool
+		}{
+			{&tlsDialer{RootCAs: ca.pool, Certificates: robot}, nil, true},
+			{proxy.Direct, alice, true},
+			{proxy.Direct, nil, false},
+		} {
+			d, _ := proxy.SOCKS5("tcp", addr, v.auth, v.fwd)
+			c, err := d.Dial("tcp", dest)
+			if (err == nil) != v.ok {
+				t.Errorf("%s: socks %T %v: %v", addr, v.fwd, v.auth, err)
+			}
+			if err == nil {
+				c.Close()
+			}
+		}
+	}
+
+	// The certificate names the user of HTTP requests over TLS; on a
+	// mixed listener too
+	plain := startHTTPProxy(t, &ListenConf{TLS: tc, Auth: authConf(t)})
+	for _, addr := range []string{mixed, plain} {
+		c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool, Certificates: robot})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+		if res, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || res.StatusCode != 200 {
+			t.Errorf("%s: tls: %v %v", addr, res, err)
+		}
+		c.Close()
+
+		pc, _ := connectTunnel(t, addr, dest, "alice", "wonder")
+		pc.Close()
+	}
+
+	// Trojan clients must use TLS
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewSocksv5Proxy(&ListenConf{Listen: "127.0.0.1:0", TLS: tc,
+		Trojan: TrojanConf{Users: map[string]string{"u": "p"}}}, log, nil); err == nil {
+		t.Errorf("trojan: no error")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
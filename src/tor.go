@@ -0,0 +1,220 @@
+// tor.go -- SOCKS5 parents and Tor stream isolation
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A "socks5" parent is a SOCKS5 proxy (RFC 1928) that tunnels are
+// opened through; names are sent to it unresolved. A "tor" parent is a
+// Tor SOCKS port: Tor puts streams with different SOCKS credentials on
+// different circuits (IsolateSOCKSAuth, on by default), so each stream
+// authenticates with credentials made from its user and/or destination,
+// and users don't share circuits. Destinations are not resolved here
+// either, so lookups don't leak outside Tor.
+
+// Isolation of the streams of a Tor parent
+const (
+	isolateUser = "user" // by user, or client address
+	isolateDest = "dest" // by destination host
+	isolateBoth = "both" // by user and destination host
+	isolateNone = "none" // Tor's own isolation only
+)
+
+// credentials when a stream isn't isolated by one or the other
+const torAnon = "goproxy"
+
+// SOCKS5 reply codes
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Set up a socks5 or tor parent from its URL
+func (p *parent) setSocks(s string) error {
+	u := p.url
+	p.proto = "socks5"
+	if u.User != nil {
+		p.suser = u.User.Username()
+		p.spass, _ = u.User.Password()
+		if len(p.suser) == 0 || len(p.suser) > 255 || len(p.spass) > 255 {
+			return fmt.Errorf("parent %s: bad credentials", s)
+		}
+	}
+	if u.Scheme != "tor" {
+		return nil
+	}
+	if u.User != nil {
+		return fmt.Errorf("parent %s: tor sets its own credentials", s)
+	}
+
+	p.tor = true
+	switch iso := u.Query().Get("isolate"); iso {
+	case "":
+		p.isolate = isolateUser
+	case isolateUser, isolateDest, isolateBoth, isolateNone:
+		p.isolate = iso
+	default:
+		return fmt.Errorf("parent %s: unsupported isolate '%s'", s, iso)
+	}
+	return nil
+}
+
+// Return the SOCKS credentials of a stream to 'host'; none if user is ""
+func (p *parent) socksAuth(ctx context.Context, host string) (user, pass string) {
+	if !p.tor {
+		return p.suser, p.spass
+	}
+
+	user, pass = torAnon, torAnon
+	if p.isolate == isolateUser || p.isolate == isolateBoth {
+		if u := userOf(ctx); len(u) > 0 {
+			user = "user:" + u
+		} else if cl := clientOf(ctx); cl != nil {
+			user = "client:" + cl.String()
+		}
+	}
+	if p.isolate == isolateDest || p.isolate == isolateBoth {
+		pass = "dest:" + host
+	}
+	if len(user) > 255 {
+		user = user[:255]
+	}
+	if len(pass) > 255 {
+		pass = pass[:255]
+	}
+	return user, pass
+}
+
+// Ask the SOCKS5 parent on 'c' for a tunnel to 'addr'; the reply is read
+// without reading past it.
+func (p *parent) socks(ctx context.Context, c net.Conn, addr string) error {
+	host, ps, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(ps)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("parent %s: name too long: %s", p.addr, host)
+	}
+
+	c.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	user, pass := p.socksAuth(ctx, host)
+	if err := p.socksMethod(c, user, pass); err != nil {
+		return fmt.Errorf("parent %s: %w", p.addr, err)
+	}
+
+	req := []byte{0x5, 0x1, 0x0}
+	if ip := net.ParseIP(host); ip != nil {
+		req = encodeAddr(req, ip, port)
+	} else {
+		req = append(req, 0x3, byte(len(host)))
+		req = append(req, host...)
+		req = append(req, byte(port>>8), byte(port))
+	}
+	if _, err := c.Write(req); err != nil {
+		return fmt.Errorf("parent %s: %w", p.addr, err)
+	}
+
+	var b [262]byte
+	if _, err := io.ReadFull(c, b[:5]); err != nil {
+		return fmt.Errorf("parent %s: %w", p.addr, err)
+	}
+	if b[0] != 0x5 {
+		return fmt.Errorf("parent %s: not a SOCKS5 proxy", p.addr)
+	}
+	if b[1] != 0 {
+		why, ok := socksReplies[b[1]]
+		if !ok {
+			why = fmt.Sprintf("error %d", b[1])
+		}
+		msg := fmt.Sprintf("parent %s: CONNECT %s: %s", p.addr, addr, why)
+		if cause := socksCause(b[1]); cause != nil {
+			return newError(cause, msg)
+		}
+		return errors.New(msg)
+	}
+
+	// the rest of the bound address
+	var n int
+	switch b[3] {
+	case 0x1:
+		n = 4 - 1 + 2
+	case 0x4:
+		n = 16 - 1 + 2
+	case 0x3:
+		n = int(b[4]) + 2
+	default:
+		return fmt.Errorf("parent %s: bad address type %d", p.addr, b[3])
+	}
+	if _, err := io.ReadFull(c, b[:n]); err != nil {
+		return fmt.Errorf("parent %s: %w", p.addr, err)
+	}
+	return nil
+}
+
+// Agree on the method; authenticate with 'user' and 'pass' (RFC 1929) if
+// there is a user.
+func (p *parent) socksMethod(c net.Conn, user, pass string) error {
+	hello := []byte{0x5, 0x1, 0x0}
+	if len(user) > 0 {
+		hello = []byte{0x5, 0x1, 0x2}
+	}
+	if _, err := c.Write(hello); err != nil {
+		return err
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	switch {
+	case b[0] != 0x5:
+		return errors.New("not a SOCKS5 proxy")
+	case b[1] != hello[2]:
+		return fmt.Errorf("method %d not accepted", hello[2])
+	case b[1] == 0x0:
+		return nil
+	}
+
+	req := []byte{0x1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
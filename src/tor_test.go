@@ -0,0 +1,234 @@
+// tor_test.go -- tests for SOCKS5 and Tor parents
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestTorConf(t *testing.T) {
+	for _, s := range []string{
+		"tor://u:p@127.0.0.1:9050",
+		"tor://127.0.0.1?isolate=circuit",
+		"socks5://:p@127.0.0.1",
+		"socks5://" + strings.Repeat("u", 256) + "@127.0.0.1",
+	} {
+		if _, err := newParent(s, "", newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+	if _, err := newParent("socks5://127.0.0.1", "cdn.example.net", newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+		t.Errorf("front: no error")
+	}
+
+	for s, want := range map[string]string{
+		"tor://127.0.0.1":                   "127.0.0.1:9050 user",
+		"tor://127.0.0.1:9150?isolate=both": "127.0.0.1:9150 both",
+		"socks5://127.0.0.1":                "127.0.0.1:1080 ",
+	} {
+		p, err := newParent(s, "", newPoolPolicy(&PoolConf{}), &net.Dialer{})
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if got := p.addr + " " + p.isolate; got != want || p.proto != "socks5" || len(p.auth) > 0 {
+			t.Errorf("%s: %q %q", s, got, p.auth)
+		}
+	}
+}
+
+// A SOCKS5 server that notes the credentials of each stream, maps the
+// name "internal.test" to the loopback and refuses "refused.test"
+type socksRecorder struct {
+	net.Listener
+	mu    sync.Mutex
+	creds []string
+	hosts []string
+}
+
+func startSocksRecorder(t *testing.T) *socksRecorder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksRecorder{Listener: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksRecorder) serve(c net.Conn) {
+	defer c.Close()
+
+	// spares are closed unused
+	var b [262]byte
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	methods := b[:b[1]]
+	io.ReadFull(c, methods)
+	cred := "-"
+	if len(methods) == 1 && methods[0] == 0x2 {
+		c.Write([]byte{0x5, 0x2})
+		io.ReadFull(c, b[:2])
+		user := make([]byte, b[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(c, pass)
+		c.Write([]byte{0x1, 0x0})
+		cred = string(user) + "/" + string(pass)
+	} else {
+		c.Write([]byte{0x5, 0x0})
+	}
+
+	if _, err := io.ReadFull(c, b[:3]); err != nil {
+		return
+	}
+	n, err := io.ReadAtLeast(c, b[:], 2)
+	if err != nil {
+		return
+	}
+	host, port, _, err := parseAddr(b[:n])
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.creds = append(s.creds, cred)
+	s.hosts = append(s.hosts, host)
+	s.mu.Unlock()
+
+	// the bound address is a name, to check it is read to its end
+	reply := []byte{0x5, 0x0, 0x0, 0x3, 4, 'b', 'n', 'd', 'x', 0, 0}
+	to := host
+	switch host {
+	case "refused.test":
+		reply[1] = 0x5
+		c.Write(reply)
+		return
+	case "internal.test":
+		to = "127.0.0.1"
+	}
+	r, err := net.Dial("tcp", net.JoinHostPort(to, strconv.Itoa(port)))
+	if err != nil {
+		reply[1] = 0x4
+		c.Write(reply)
+		return
+	}
+	defer r.Close()
+	c.Write(reply)
+	go io.Copy(r, c)
+	io.Copy(c, r)
+}
+
+func (s *socksRecorder) last() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.creds) == 0 {
+		return "", ""
+	}
+	return s.creds[len(s.creds)-1], s.hosts[len(s.hosts)-1]
+}
+
+func TestTorParent(t *testing.T) {
+	echo := startEcho(t)
+	_, ps, _ := net.SplitHostPort(echo.Addr().String())
+	srv := startSocksRecorder(t)
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+
+	newD := func(parent string) *dialer {
+		d, err := newDialer(&ListenConf{
+			Listen: "tor",
+			Parent: parent,
+			Rules:  []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}},
+		}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(d.Close)
+		return d
+	}
+	dial := func(d *dialer, ctx context.Context, addr string) (string, string) {
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: %s", addr, err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, "ping")
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+			t.Errorf("%s: echo: %q %v", addr, got, err)
+		}
+		return srv.last()
+	}
+
+	alice := withUser(context.Background(), "alice")
+	bob := withUser(context.Background(), "bob")
+	anon := withClient(context.Background(), net.IPv4(127, 0, 0, 9))
+	a1 := echo.Addr().String()
+	a2 := "internal.test:" + ps
+
+	for iso, want := range map[string][]string{
+		"user": {"user:alice/goproxy", "user:alice/goproxy", "user:bob/goproxy", "client:127.0.0.9/goproxy"},
+		"dest": {"goproxy/dest:127.0.0.1", "goproxy/dest:internal.test", "goproxy/dest:127.0.0.1", "goproxy/dest:127.0.0.1"},
+		"both": {"user:alice/dest:127.0.0.1", "user:alice/dest:internal.test", "user:bob/dest:127.0.0.1", "client:127.0.0.9/dest:127.0.0.1"},
+		"none": {"goproxy/goproxy", "goproxy/goproxy", "goproxy/goproxy", "goproxy/goproxy"},
+	} {
+		d := newD("tor://" + srv.Addr().String() + "?isolate=" + iso)
+		for i, v := range []struct {
+			ctx  context.Context
+			addr string
+		}{{alice, a1}, {alice, a2}, {bob, a1}, {anon, a1}} {
+			if cred, _ := dial(d, v.ctx, v.addr); cred != want[i] {
+				t.Errorf("%s %d: %s, want %s", iso, i, cred, want[i])
+			}
+		}
+	}
+
+	// Tor gets the name as it is; the socks5 parent has its own
+	// credentials
+	d := newD("tor://" + srv.Addr().String())
+	if _, host := dial(d, alice, a2); host != "internal.test" {
+		t.Errorf("tor: sent %s", host)
+	}
+	d = newD("socks5://me:secret@" + srv.Addr().String())
+	if cred, _ := dial(d, alice, a1); cred != "me/secret" {
+		t.Errorf("socks5: %s", cred)
+	}
+	d = newD("socks5://" + srv.Addr().String())
+	if cred, _ := dial(d, alice, a1); cred != "-" {
+		t.Errorf("socks5, no auth: %s", cred)
+	}
+
+	d = newD("tor://" + srv.Addr().String())
+	_, err := d.DialContext(alice, "tcp", "refused.test:80")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("refused: %v", err)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
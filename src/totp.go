@@ -0,0 +1,96 @@
+// totp.go -- time-based one-time passwords (RFC 6238)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds each code is good for
+	TOTP_STEP = 30
+
+	// Digits of a code
+	TOTP_DIGITS = 6
+
+	// Steps of clock skew allowed either way
+	TOTP_SKEW = 1
+)
+
+// One-time codes from a shared secret: HMAC-SHA1, 6 digits and 30
+// second steps - what authenticator apps use by default. A code is
+// accepted once; so is every code before it.
+type totp struct {
+	key []byte
+
+	sync.Mutex
+	last uint64 // step of the last code accepted
+}
+
+// Make a TOTP from a base32 secret (spaces and padding are optional)
+func newTOTP(secret string) (*totp, error) {
+	s := strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	s = strings.TrimRight(s, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("totp: secret is not base32")
+	}
+	if len(key) < 10 {
+		return nil, fmt.Errorf("totp: secret must be at least 80 bits")
+	}
+	return &totp{key: key}, nil
+}
+
+// Return the code of step 'n' (RFC 4226)
+func (t *totp) code(n uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	m := hmac.New(sha1.New, t.key)
+	m.Write(b[:])
+	h := m.Sum(nil)
+
+	off := h[len(h)-1] & 0xf
+	v := binary.BigEndian.Uint32(h[off:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, v%mod)
+}
+
+// Return true if 'code' is good at 'now' and wasn't used before
+func (t *totp) check(code string, now time.Time) bool {
+	if len(code) != TOTP_DIGITS {
+		return false
+	}
+
+	n := uint64(now.Unix()) / TOTP_STEP
+	t.Lock()
+	defer t.Unlock()
+	for i := n - TOTP_SKEW; i <= n+TOTP_SKEW; i++ {
+		if i <= t.last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.code(i)), []byte(code)) == 1 {
+			t.last = i
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
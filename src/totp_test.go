@@ -0,0 +1,150 @@
+// totp_test.go -- tests for one-time passwords and admin logins
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// base32 of the RFC 6238 SHA-1 secret "12345678901234567890"
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	o, err := newTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 6238, appendix B; the last 6 digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for ts, want := range vectors {
+		if c := o.code(uint64(ts) / TOTP_STEP); c != want {
+			t.Errorf("%d: %s, want %s", ts, c, want)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	prev := o.code(uint64(now.Unix())/TOTP_STEP - 1)
+	if !o.check(prev, now) {
+		t.Errorf("code of the previous step refused")
+	}
+	if o.check(prev, now) {
+		t.Errorf("code used twice")
+	}
+	if !o.check("005924", now) {
+		t.Errorf("current code refused")
+	}
+	if o.check(o.code(uint64(now.Unix())/TOTP_STEP+5), now) || o.check("00592", now) {
+		t.Errorf("bad code accepted")
+	}
+
+	for _, s := range []string{"not base32!", "GEZDGNBV"} {
+		if _, err := newTOTP(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestAdminTOTP(t *testing.T) {
+	u := startAdmin(t, &AdminConf{Password: bcryptHash(t, "adm1n"), TOTP: testTOTPSecret})
+	o, _ := newTOTP(testTOTPSecret)
+
+	post := func(path, pass, session string, v url.Values) *http.Response {
+		req, _ := http.NewRequest("POST", u+path, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(pass) > 0 {
+			req.SetBasicAuth("admin", pass)
+		}
+		if len(session) > 0 {
+			req.Header.Set("Authorization", "Bearer "+session)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	login := func(pass, code string) (string, int) {
+		req, _ := http.NewRequest("POST", u+"/login", strings.NewReader(url.Values{"otp": {code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", pass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out struct {
+			Session string `json:"session"`
+		}
+		json.NewDecoder(res.Body).Decode(&out)
+		return out.Session, res.StatusCode
+	}
+
+	// The password alone isn't enough; no issuer is a 404 once past
+	// authorization.
+	if res := post("/tokens", "adm1n", "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("password without a session: %d", res.StatusCode)
+	}
+
+	code := o.code(uint64(time.Now().Unix()) / TOTP_STEP)
+	if _, n := login("wrong", code); n != http.StatusUnauthorized {
+		t.Errorf("bad password: %d", n)
+	}
+	if _, n := login("adm1n", "000000x"); n != http.StatusUnauthorized {
+		t.Errorf("bad code: %d", n)
+	}
+	s, n := login("adm1n", code)
+	if n != 200 || len(s) == 0 {
+		t.Fatalf("login: %d %q", n, s)
+	}
+	if _, n := login("adm1n", code); n != http.StatusUnauthorized {
+		t.Errorf("code used twice: %d", n)
+	}
+
+	if res := post("/tokens", "", s, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("with a session: %d", res.StatusCode)
+	}
+	if res := post("/tokens", "", s+"x", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad session: %d", res.StatusCode)
+	}
+
+	post("/logout", "", s, nil)
+	if res := post("/tokens", "", s, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("after logout: %d", res.StatusCode)
+	}
+
+	// Guessing codes locks logins; the reused code was one failure
+	for i := 0; i < ADMIN_MAXFAIL-1; i++ {
+		login("adm1n", "123456")
+	}
+	if _, n := login("adm1n", o.code(uint64(time.Now().Unix())/TOTP_STEP+1)); n != http.StatusTooManyRequests {
+		t.Errorf("after %d failures: %d", ADMIN_MAXFAIL, n)
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := NewAdminServer(&AdminConf{Listen: "127.0.0.1:0", TOTP: testTOTPSecret}, log); err == nil {
+		t.Errorf("totp without a password")
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
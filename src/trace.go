@@ -0,0 +1,395 @@
+// trace.go -- OpenTelemetry traces of proxied sessions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Each session is a span with children for the lookup of the
+// destination, the dial, the handshakes and the relay. Spans are sent
+// in batches to an OTLP/HTTP collector in its JSON encoding; when the
+// collector can't keep up they are dropped, never the sessions.
+
+const (
+	// Spans sent in one request
+	TRACE_BATCH = 512
+
+	// Spans waiting to be sent; more are dropped
+	TRACE_QUEUE = 4096
+
+	// Spans are sent at least this often
+	TRACE_FLUSH = 5 * time.Second
+
+	// Time a request to the collector may take
+	TRACE_TIMEOUT = 10 * time.Second
+)
+
+// Kinds of spans in OTLP
+const (
+	_SPAN_INTERNAL = 1
+	_SPAN_SERVER   = 2
+	_SPAN_CLIENT   = 3
+)
+
+// The tracer of the process; nil if sessions aren't traced
+var tracing *tracer
+
+type tracer struct {
+	url       string
+	service   string
+	sample    uint64 // of 1<<63; sessions with a lower trace id are traced
+	propagate bool
+	headers   map[string]string
+	log       *L.Logger
+	client    *http.Client
+
+	q    chan *span
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	sent, dropped, failed atomic.Uint64
+}
+
+// An attribute of a span; the value is a string, int64 or bool
+type spanAttr struct {
+	key string
+	val interface{}
+}
+
+type span struct {
+	t      *tracer
+	trace  [16]byte
+	id     [8]byte
+	parent [8]byte // zero for the root
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  []spanAttr
+	err    string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// Start tracing to the collector of 'tc'; return nil if no tracing
+func newTracer(tc *TraceConf, log *L.Logger) (*tracer, error) {
+	if len(tc.Endpoint) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(tc.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("tracing: invalid endpoint %q", tc.Endpoint)
+	}
+	if tc.Sample < 0 || tc.Sample > 1 {
+		return nil, fmt.Errorf("tracing: sample %g not between 0 and 1", tc.Sample)
+	}
+
+	s := tc.Sample
+	if s == 0 {
+		s = 1
+	}
+	t := &tracer{
+		url:       tc.Endpoint,
+		service:   tc.Service,
+		sample:    uint64(s * (1 << 63)),
+		propagate: tc.Propagate,
+		headers:   tc.Headers,
+		log:       log,
+		client:    &http.Client{Timeout: TRACE_TIMEOUT},
+		q:         make(chan *span, TRACE_QUEUE),
+		stop:      make(chan struct{}),
+	}
+	if len(t.service) == 0 {
+		t.service = "goproxy"
+	}
+
+	t.wg.Add(1)
+	go t.export()
+	return t, nil
+}
+
+// Send the spans that are left and stop
+func (t *tracer) Stop() {
+	close(t.stop)
+	t.wg.Wait()
+}
+
+// Send spans in batches until Stop
+func (t *tracer) export() {
+	defer t.wg.Done()
+	tick := time.NewTicker(TRACE_FLUSH)
+	defer tick.Stop()
+
+	var v []*span
+	for {
+		select {
+		case s := <-t.q:
+			if v = append(v, s); len(v) < TRACE_BATCH {
+				continue
+			}
+		case <-tick.C:
+		case <-t.stop:
+			for len(t.q) > 0 {
+				v = append(v, <-t.q)
+			}
+			for len(v) > 0 {
+				n := len(v)
+				if n > TRACE_BATCH {
+					n = TRACE_BATCH
+				}
+				t.send(v[:n])
+				v = v[n:]
+			}
+			return
+		}
+		if len(v) > 0 {
+			t.send(v)
+			v = nil
+		}
+	}
+}
+
+// POST 'v' to the collector
+func (t *tracer) send(v []*span) {
+	b, _ := json.Marshal(t.request(v))
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(b))
+	if err != nil {
+		t.failed.Add(uint64(len(v)))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, h := range t.headers {
+		req.Header.Set(k, h)
+	}
+
+	res, err := t.client.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s", res.Status)
+		}
+	}
+	if err != nil {
+		t.failed.Add(uint64(len(v)))
+		t.log.Warn("tracing: can't send %d spans to %s: %s", len(v), t.url, err)
+		return
+	}
+	t.sent.Add(uint64(len(v)))
+}
+
+// The OTLP export request of 'v'
+func (t *tracer) request(v []*span) interface{} {
+	type kv map[string]interface{}
+
+	attrs := func(v []spanAttr) []kv {
+		r := make([]kv, 0, len(v))
+		for _, a := range v {
+			var val kv
+			switch x := a.val.(type) {
+			case int64:
+				val = kv{"intValue": strconv.FormatInt(x, 10)}
+			case bool:
+				val = kv{"boolValue": x}
+			default:
+				val = kv{"stringValue": fmt.Sprint(x)}
+			}
+			r = append(r, kv{"key": a.key, "value": val})
+		}
+		return r
+	}
+
+	spans := make([]kv, 0, len(v))
+	for _, s := range v {
+		m := kv{
+			"traceId":           hex.EncodeToString(s.trace[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if len(s.err) > 0 {
+			m["status"] = kv{"code": 2, "message": s.err}
+		}
+		spans = append(spans, m)
+	}
+
+	res := []spanAttr{{"service.name", t.service}, {"service.version", ProductVersion}}
+	return kv{"resourceSpans": []kv{{
+		"resource": kv{"attributes": attrs(res)},
+		"scopeSpans": []kv{{
+			"scope": kv{"name": "goproxy", "version": ProductVersion},
+			"spans": spans,
+		}},
+	}}}
+}
+
+func (t *tracer) metrics() []metric {
+	const help = "Spans of sessions by what became of them"
+	return []metric{
+		{"goproxy_trace_spans_total", "counter", help, `result="sent"`, float64(t.sent.Load())},
+		{"goproxy_trace_spans_total", "counter", help, `result="dropped"`, float64(t.dropped.Load())},
+		{"goproxy_trace_spans_total", "counter", help, `result="failed"`, float64(t.failed.Load())},
+	}
+}
+
+// Start the span of a session named 'name'. With propagation, a valid
+// W3C 'traceparent' makes it part of the caller's trace. Return nil if
+// the session isn't traced.
+func traceSession(ctx context.Context, name, traceparent string) (context.Context, *span) {
+	t := tracing
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{t: t, name: name, kind: _SPAN_SERVER, start: time.Now()}
+	rand.Read(s.id[:])
+	if tr, id, sampled, ok := parseTraceparent(traceparent); ok && t.propagate {
+		if !sampled {
+			return ctx, nil
+		}
+		s.trace, s.parent = tr, id
+	} else {
+		rand.Read(s.trace[:])
+		if binary.BigEndian.Uint64(s.trace[8:])>>1 >= t.sample {
+			return ctx, nil
+		}
+	}
+	return context.WithValue(ctx, ctxSpan, s), s
+}
+
+// Start a child of the session span in 'ctx'; nil if it isn't traced
+func startSpan(ctx context.Context, name string, kind int) *span {
+	p := spanOf(ctx)
+	if p == nil {
+		return nil
+	}
+	s := &span{t: p.t, trace: p.trace, parent: p.id, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.id[:])
+	return s
+}
+
+// Return the span in 'ctx' (or nil)
+func spanOf(ctx context.Context) *span {
+	s, _ := ctx.Value(ctxSpan).(*span)
+	return s
+}
+
+// Set the attribute 'key'
+func (s *span) set(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].val = val
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.attrs = append(s.attrs, spanAttr{key, val})
+	s.mu.Unlock()
+}
+
+// Mark the span failed with 'err', if it isn't nil
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End the span and queue it; later calls do nothing
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.t.q <- s:
+	default:
+		s.t.dropped.Add(1)
+	}
+}
+
+// End the relay span 'rl' with the bytes 'moved' each way
+func traceMoved(rl *span, moved func() (int64, int64)) {
+	if rl == nil {
+		return
+	}
+	in, out := moved()
+	rl.set("goproxy.bytes_in", in)
+	rl.set("goproxy.bytes_out", out)
+	rl.finish()
+}
+
+// Return the W3C traceparent naming 's' as the parent
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.trace[:], s.id[:])
+}
+
+// Parse a W3C traceparent: version-traceid-parentid-flags
+func parseTraceparent(h string) (tr [16]byte, id [8]byte, sampled, ok bool) {
+	v := strings.Split(strings.TrimSpace(h), "-")
+	if len(v) < 4 || len(v[0]) != 2 || v[0] == "ff" || len(v[1]) != 32 || len(v[2]) != 16 || len(v[3]) != 2 {
+		return
+	}
+	if v[0] == "00" && len(v) != 4 {
+		return
+	}
+	var fl [1]byte
+	if _, err := hex.Decode(tr[:], []byte(v[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(id[:], []byte(v[2])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(fl[:], []byte(v[3])); err != nil {
+		return
+	}
+	if tr == [16]byte{} || id == [8]byte{} {
+		return
+	}
+	return tr, id, fl[0]&1 == 1, true
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
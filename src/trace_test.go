@@ -0,0 +1,227 @@
+// trace_test.go -- tests for the tracing of sessions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestTraceparent(t *testing.T) {
+	good := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tr, id, sampled, ok := parseTraceparent(good)
+	if !ok || !sampled || tr[0] != 0x4b || id[7] != 0xb7 {
+		t.Fatalf("%s: %x %x %v %v", good, tr, id, sampled, ok)
+	}
+	if _, _, sampled, ok := parseTraceparent(good[:len(good)-1] + "0"); !ok || sampled {
+		t.Errorf("not sampled: %v %v", sampled, ok)
+	}
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		good + "-extra",
+	} {
+		if _, _, _, ok := parseTraceparent(h); ok {
+			t.Errorf("%q: parsed", h)
+		}
+	}
+	if _, _, _, ok := parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Errorf("later version: not parsed")
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	for _, tc := range []TraceConf{{Endpoint: "collector:4318"}, {Endpoint: "http://c/v1/traces", Sample: 2}} {
+		if _, err := newTracer(&tc, log); err == nil {
+			t.Errorf("%+v: no error", tc)
+		}
+	}
+}
+
+// A span as the collector gets it
+type otlpSpan struct {
+	TraceID    string `json:"traceId"`
+	SpanID     string `json:"spanId"`
+	Parent     string `json:"parentSpanId"`
+	Name       string `json:"name"`
+	Kind       int    `json:"kind"`
+	Start      string `json:"startTimeUnixNano"`
+	End        string `json:"endTimeUnixNano"`
+	Attributes []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s *otlpSpan) attr(k string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == k {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	var service string
+	col := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string            `json:"key"`
+						Value map[string]string `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.Header.Get("X-Api-Key") != "k" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad export", 400)
+			return
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			service = rs.Resource.Attributes[0].Value["stringValue"]
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer col.Close()
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	tr, err := newTracer(&TraceConf{Endpoint: col.URL, Service: "px", Propagate: true,
+		Headers: map[string]string{"X-Api-Key": "k"}}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracing = tr
+	defer func() { tracing = nil }()
+
+	got := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("Traceparent")
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	addr := startHTTPProxy(t, &ListenConf{})
+	pu, _ := url.Parse("http://" + addr)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Traceparent", parent)
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	up := <-got
+
+	// A tunnel to a name: it is looked up, dialed and relayed
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	c, br := connectTunnel(t, addr, "localhost:"+port, "", "")
+	io.WriteString(c, "ping\n")
+	if s, _ := br.ReadString('\n'); s != "ping\n" {
+		t.Errorf("tunnel: %q", s)
+	}
+	c.Close()
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// an unsampled trace isn't traced
+	req, _ = http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Traceparent", parent[:len(parent)-1]+"0")
+	if res, err := hc.Do(req); err == nil {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	if h := <-got; h != parent[:len(parent)-1]+"0" {
+		t.Errorf("unsampled traceparent changed: %q", h)
+	}
+
+	hc.CloseIdleConnections()
+	tr.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if service != "px" {
+		t.Errorf("service %q", service)
+	}
+	byName := make(map[string]*otlpSpan)
+	for i := range spans {
+		byName[spans[i].Name] = &spans[i]
+	}
+
+	get := byName["GET"]
+	if get == nil || get.TraceID != parent[3:35] || get.Parent != parent[36:52] || get.Kind != _SPAN_SERVER {
+		t.Fatalf("GET span: %+v in %+v", get, spans)
+	}
+	if s, _ := get.attr("http.response.status_code").(string); s != "200" {
+		t.Errorf("GET status: %v", get.attr("http.response.status_code"))
+	}
+	if up != "00-"+get.TraceID+"-"+get.SpanID+"-01" {
+		t.Errorf("origin got traceparent %q for %+v", up, get)
+	}
+
+	cn := byName["CONNECT"]
+	if cn == nil || cn.TraceID == get.TraceID || len(cn.Parent) > 0 {
+		t.Fatalf("CONNECT span: %+v", cn)
+	}
+	kids := make(map[string]*otlpSpan)
+	for i, s := range spans {
+		if s.TraceID == cn.TraceID && s.Parent == cn.SpanID {
+			kids[s.Name] = &spans[i]
+		}
+	}
+	for _, n := range []string{"resolve", "dial", "relay"} {
+		if kids[n] == nil {
+			t.Errorf("no %s span of CONNECT: %+v", n, spans)
+		}
+	}
+	if r := kids["relay"]; r != nil && r.attr("goproxy.bytes_in") != "5" {
+		t.Errorf("relay span: %+v", r)
+	}
+	if n := len(spans); n > 8 {
+		t.Errorf("%d spans", n)
+	}
+	if tr.sent.Load() != uint64(len(spans)) || tr.failed.Load() != 0 {
+		t.Errorf("sent %d, failed %d", tr.sent.Load(), tr.failed.Load())
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,137 @@
+// transport.go -- pluggable stream transports (obfuscation)
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A stream transport wraps the bytes of a connection: a scrambler, a
+// framing or any other obfuscation both ends agree on. A listener's
+// "transport" wraps the connections it accepts from clients; its
+// "parenttransport" wraps those it makes to the parent proxy. Like
+// filters, a transport is compiled in: its file registers a
+// TransportFactory in init(). See transport_builtin.go for an example.
+
+var errTransportRaw = errors.New("transport: no raw socket")
+
+// A stream transport. Server and Client must not block: a handshake of
+// the transport is done on the first Read or Write (as crypto/tls does).
+type Transport interface {
+	// Wrap a connection accepted from a client
+	Server(c net.Conn) net.Conn
+
+	// Wrap a connection made to the parent proxy
+	Client(c net.Conn) net.Conn
+}
+
+// Make a transport from its config args
+type TransportFactory func(args map[string]string) (Transport, error)
+
+var transportTypes = struct {
+	sync.Mutex
+	m map[string]TransportFactory
+}{m: make(map[string]TransportFactory)}
+
+// Make the transport type 'name' available to the config file
+func RegisterTransport(name string, f TransportFactory) {
+	transportTypes.Lock()
+	defer transportTypes.Unlock()
+
+	if _, ok := transportTypes.m[name]; ok {
+		panic("transport " + name + " registered twice")
+	}
+	transportTypes.m[name] = f
+}
+
+// Return the registered transport types
+func transportNames() []string {
+	transportTypes.Lock()
+	defer transportTypes.Unlock()
+
+	v := make([]string, 0, len(transportTypes.m))
+	for k := range transportTypes.m {
+		v = append(v, k)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// Return the transport of 'tc' or nil if it has none
+func newStreamTransport(tc *TransportConf) (Transport, error) {
+	if len(tc.Type) == 0 {
+		return nil, nil
+	}
+
+	transportTypes.Lock()
+	mk, ok := transportTypes.m[tc.Type]
+	transportTypes.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("transport: unknown type %q (have %s)", tc.Type,
+			strings.Join(transportNames(), ", "))
+	}
+
+	t, err := mk(tc.Args)
+	if err != nil {
+		return nil, fmt.Errorf("transport %s: %s", tc.Type, err)
+	}
+	return t, nil
+}
+
+// A connection wrapped by a transport, for the copier. Its addresses
+// are those of the socket under it; it has no raw access, so tunnels
+// are relayed through buffers. A half-close goes to the transport if it
+// has CloseWrite, else to the socket.
+type transportConn struct {
+	net.Conn
+	raw net.Conn
+}
+
+// Return 'c' wrapped by the server side of 't'
+func serverTransport(t Transport, c net.Conn) net.Conn {
+	return &transportConn{Conn: t.Server(c), raw: c}
+}
+
+// Return 'c' wrapped by the client side of 't'
+func clientTransport(t Transport, c net.Conn) net.Conn {
+	return &transportConn{Conn: t.Client(c), raw: c}
+}
+
+func (c *transportConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+func (c *transportConn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+func (c *transportConn) CloseWrite() error {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	if cw, ok := c.raw.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *transportConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errTransportRaw
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,108 @@
+// transport_builtin.go -- stream transports that come with goproxy
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+func init() {
+	RegisterTransport("scramble", newScramble)
+}
+
+// Scrambles the stream so a middlebox sees no plaintext (an HTTP
+// request line, a TLS ClientHello) to match on. Each direction starts
+// with a random 16 byte IV and is AES-256-CTR with the SHA-256 of the
+// shared 'secret' as the key. It hides the bytes, it doesn't protect
+// them: there is no integrity and anyone with the secret can read
+// them. Put TLS inside it for that.
+type scramble struct {
+	key []byte
+}
+
+func newScramble(args map[string]string) (Transport, error) {
+	s := args["secret"]
+	if len(s) < 16 {
+		return nil, fmt.Errorf("'secret' needs at least 16 characters")
+	}
+	k := sha256.Sum256([]byte(s))
+	return &scramble{key: k[:]}, nil
+}
+
+func (s *scramble) Server(c net.Conn) net.Conn {
+	return &scrambleConn{Conn: c, key: s.key}
+}
+
+func (s *scramble) Client(c net.Conn) net.Conn {
+	return &scrambleConn{Conn: c, key: s.key}
+}
+
+// Both ends are the same: each sends its IV with its first write and
+// reads the other's before its first read.
+type scrambleConn struct {
+	net.Conn
+	key []byte
+
+	rmu sync.Mutex
+	dec cipher.Stream
+
+	wmu sync.Mutex
+	enc cipher.Stream
+}
+
+func (c *scrambleConn) stream(iv []byte) cipher.Stream {
+	b, _ := aes.NewCipher(c.key)
+	return cipher.NewCTR(b, iv)
+}
+
+func (c *scrambleConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.dec == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(c.Conn, iv); err != nil {
+			return 0, err
+		}
+		c.dec = c.stream(iv)
+	}
+	n, err := c.Conn.Read(b)
+	c.dec.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *scrambleConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var out []byte
+	if c.enc == nil {
+		iv := make([]byte, aes.BlockSize, aes.BlockSize+len(b))
+		if _, err := rand.Read(iv); err != nil {
+			return 0, err
+		}
+		c.enc = c.stream(iv)
+		out = iv
+	}
+	n := len(out)
+	out = append(out, b...)
+	c.enc.XORKeyStream(out[n:], out[n:])
+
+	// a short write leaves the stream out of step; it's broken anyway
+	m, err := c.Conn.Write(out)
+	return max(m-n, 0), err
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
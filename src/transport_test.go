@@ -0,0 +1,149 @@
+// transport_test.go -- tests for stream transports
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+var testScramble = TransportConf{Type: "scramble", Args: map[string]string{"secret": "0123456789abcdef"}}
+
+func TestTransportConf(t *testing.T) {
+	if tr, err := newStreamTransport(&TransportConf{}); tr != nil || err != nil {
+		t.Errorf("none: %v %v", tr, err)
+	}
+	for _, tc := range []TransportConf{
+		{Type: "obfs9"},
+		{Type: "scramble"},
+		{Type: "scramble", Args: map[string]string{"secret": "short"}},
+	} {
+		if _, err := newStreamTransport(&tc); err == nil {
+			t.Errorf("%+v: no error", tc)
+		}
+	}
+	if !sameNames(transportNames(), []string{"scramble"}) {
+		t.Errorf("names: %v", transportNames())
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if _, err := newDialer(&ListenConf{Listen: "test", ParentTransport: testScramble}, log); err == nil {
+		t.Errorf("parenttransport without a parent: no error")
+	}
+}
+
+func TestScramble(t *testing.T) {
+	tr, err := newStreamTransport(&testScramble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := testScramble
+	bad.Args = map[string]string{"secret": "fedcba9876543210"}
+	other, _ := newStreamTransport(&bad)
+
+	msg := []byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+	for _, v := range []struct {
+		peer Transport
+		same bool
+	}{{tr, true}, {other, false}} {
+		a, b := net.Pipe()
+		c := clientTransport(tr, a)
+		s := serverTransport(v.peer, b)
+
+		// what the wire carries
+		wire := make(chan []byte, 1)
+		go func() {
+			c.Write(msg)
+			c.Close()
+		}()
+		go func() {
+			got, _ := io.ReadAll(s)
+			wire <- got
+		}()
+		select {
+		case got := <-wire:
+			if bytes.Equal(got, msg) != v.same {
+				t.Errorf("same secret %v: read %q", v.same, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("same secret %v: timeout", v.same)
+		}
+		s.Close()
+	}
+
+	// the wire has neither the plaintext nor a fixed prefix
+	var w [2]bytes.Buffer
+	for i := range w {
+		a, b := net.Pipe()
+		go func() {
+			clientTransport(tr, a).Write(msg)
+			a.Close()
+		}()
+		io.Copy(&w[i], b)
+	}
+	if bytes.Contains(w[0].Bytes(), []byte("CONNECT")) || bytes.Equal(w[0].Bytes()[:16], w[1].Bytes()[:16]) {
+		t.Errorf("wire: %x %x", w[0].Bytes(), w[1].Bytes())
+	}
+}
+
+// A client through a scrambled listener, and a proxy that has it as a
+// scrambled parent
+func TestTransportProxy(t *testing.T) {
+	echo := startEcho(t)
+	front := startHTTPProxy(t, &ListenConf{Transport: testScramble})
+	tr, _ := newStreamTransport(&testScramble)
+
+	nc, err := net.Dial("tcp", front)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := clientTransport(tr, nc)
+	io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil || !bytes.HasPrefix(b[:n], []byte("HTTP/1.0 200")) {
+		t.Fatalf("CONNECT: %q %v", b[:n], err)
+	}
+	io.WriteString(c, "ping")
+	if _, err = io.ReadFull(c, b[:4]); err != nil || string(b[:4]) != "ping" {
+		t.Errorf("echo: %q %v", b[:4], err)
+	}
+	c.Close()
+
+	// a plain client of the scrambled listener gets nowhere
+	pc, err := net.Dial("tcp", front)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(pc, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	if n, _ := pc.Read(b); bytes.Contains(b[:n], []byte(" 200 ")) {
+		t.Errorf("plain client: %q", b[:n])
+	}
+	pc.Close()
+
+	back := startHTTPProxy(t, &ListenConf{Parent: "http://" + front, ParentTransport: testScramble})
+	tc, br := connectTunnel(t, back, echo.Addr().String(), "", "")
+	io.WriteString(tc, "pong")
+	if _, err = io.ReadFull(br, b[:4]); err != nil || string(b[:4]) != "pong" {
+		t.Errorf("through the parent: %q %v", b[:4], err)
+	}
+	tc.Close()
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
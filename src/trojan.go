@@ -0,0 +1,207 @@
+// trojan.go -- Trojan clients and parents
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Trojan hides a proxy in TLS: after the handshake the client sends
+// the hex SHA-224 of its password, CRLF, a SOCKS5 style command and
+// address, CRLF and then the tunnel data; nothing is sent back. A SOCKS
+// listener with TLS and a "trojan" block speaks it instead of SOCKS;
+// anything else that arrives is handed to the fallback (a web server)
+// so the listener looks like one. A trojan:// parent is spoken to the
+// same way.
+
+var (
+	errTrojan      = errors.New("trojan: bad request")
+	errTrojanShort = errors.New("trojan: short request")
+)
+
+// The Trojan side of a SOCKS listener
+type trojanServer struct {
+	users    map[string]string // hex SHA-224 of a password -> its user
+	fallback string            // host:port; "" closes bad clients
+}
+
+// Return the hex SHA-224 of the password 'pw'
+func trojanHash(pw string) string {
+	h := sha256.Sum224([]byte(pw))
+	return hex.EncodeToString(h[:])
+}
+
+// Return the Trojan server of 'tc' or nil if it has no users
+func newTrojan(tc *TrojanConf, lt *listenTLS) (*trojanServer, error) {
+	if len(tc.Users) == 0 {
+		if len(tc.Fallback) > 0 {
+			return nil, fmt.Errorf("trojan: fallback without users")
+		}
+		return nil, nil
+	}
+	if lt == nil {
+		return nil, fmt.Errorf("trojan: needs tls")
+	}
+	if lt.plain {
+		return nil, fmt.Errorf("trojan: not with tls 'plain'")
+	}
+	if len(tc.Fallback) > 0 {
+		if _, _, err := net.SplitHostPort(tc.Fallback); err != nil {
+			return nil, fmt.Errorf("trojan: fallback %s: %s", tc.Fallback, err)
+		}
+	}
+
+	t := &trojanServer{users: make(map[string]string), fallback: tc.Fallback}
+	names := make([]string, 0, len(tc.Users))
+	for u := range tc.Users {
+		names = append(names, u)
+	}
+	sort.Strings(names)
+	for _, u := range names {
+		h := trojanHash(tc.Users[u])
+		if o, ok := t.users[h]; ok {
+			return nil, fmt.Errorf("trojan: users %s and %s have the same password", o, u)
+		}
+		t.users[h] = u
+	}
+	return t, nil
+}
+
+// Decode the request at the start of 'b'; return it and its length
+func (t *trojanServer) parse(b []byte) (*socksReq, int, error) {
+	for i := 0; i < len(b) && i < 56; i++ {
+		if c := b[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return nil, 0, errTrojan
+		}
+	}
+	if len(b) < 60 {
+		return nil, 0, errTrojanShort
+	}
+	user, ok := t.users[string(b[:56])]
+	if !ok || string(b[56:58]) != "\r\n" {
+		return nil, 0, errTrojan
+	}
+
+	host, port, n, err := parseAddr(b[59:])
+	if err != nil {
+		if a := b[59]; a == 1 || a == 3 || a == 4 {
+			return nil, 0, errTrojanShort
+		}
+		return nil, 0, errTrojan
+	}
+	end := 59 + n
+	if len(b) < end+2 {
+		return nil, 0, errTrojanShort
+	}
+	if string(b[end:end+2]) != "\r\n" {
+		return nil, 0, errTrojan
+	}
+	return &socksReq{cmd: b[58], host: host, port: port, user: user}, end + 2, nil
+}
+
+// Read the request of the client 'c'; return it and the connection to
+// relay, which has the tunnel data that came with the request. A client
+// with a bad request is given to the fallback.
+func (t *trojanServer) request(ctx context.Context, c net.Conn) (*socksReq, net.Conn, error) {
+	buf := make([]byte, 1024)
+	n := 0
+	for {
+		m, err := c.Read(buf[n:])
+		n += m
+		r, used, perr := t.parse(buf[:n])
+		if perr == nil {
+			if used == n {
+				return r, c, nil
+			}
+			return r, &trojanConn{tcpConn: clientConn(c), pre: buf[used:n]}, nil
+		}
+		if perr != errTrojanShort || err != nil || n == len(buf) {
+			t.serveFallback(ctx, c, buf[:n])
+			return nil, nil, errTrojan
+		}
+	}
+}
+
+// Relay the client 'c' that sent 'pre' to the fallback
+func (t *trojanServer) serveFallback(ctx context.Context, c net.Conn, pre []byte) {
+	if len(t.fallback) == 0 {
+		return
+	}
+	var nd net.Dialer
+	dctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT)
+	f, err := nd.DialContext(dctx, "tcp", t.fallback)
+	cancel()
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	c.SetDeadline(time.Time{})
+	if _, err := f.Write(pre); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(f, c)
+		f.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(c, f)
+}
+
+// A Trojan client whose first tunnel bytes came with its request
+type trojanConn struct {
+	tcpConn
+	pre []byte
+}
+
+func (c *trojanConn) Read(b []byte) (int, error) {
+	if len(c.pre) > 0 {
+		n := copy(b, c.pre)
+		c.pre = c.pre[n:]
+		return n, nil
+	}
+	return c.tcpConn.Read(b)
+}
+
+// Open a tunnel to 'addr' on the connection 'c' to a Trojan parent
+func trojanClient(c tcpConn, key, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	pn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in '%s'", addr)
+	}
+
+	b := append([]byte(key), "\r\n\x01"...)
+	if ip := net.ParseIP(host); ip != nil {
+		b = encodeAddr(b, ip, int(pn))
+	} else if len(host) > 0 && len(host) < 256 {
+		b = append(append(b, 3, byte(len(host))), host...)
+		b = append(b, byte(pn>>8), byte(pn))
+	} else {
+		return nil, fmt.Errorf("bad host in '%s'", addr)
+	}
+	b = append(b, "\r\n"...)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
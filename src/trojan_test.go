@@ -0,0 +1,148 @@
+// trojan_test.go -- tests for Trojan clients and parents
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestTrojanConf(t *testing.T) {
+	lt := &listenTLS{}
+	if ts, err := newTrojan(&TrojanConf{}, nil); ts != nil || err != nil {
+		t.Errorf("none: %v %v", ts, err)
+	}
+	for _, tc := range []TrojanConf{
+		{Fallback: "127.0.0.1:80"},
+		{Users: map[string]string{"a": "x"}, Fallback: "nowhere"},
+		{Users: map[string]string{"a": "x", "b": "x"}},
+	} {
+		if _, err := newTrojan(&tc, lt); err == nil {
+			t.Errorf("%+v: no error", tc)
+		}
+	}
+	if _, err := newTrojan(&TrojanConf{Users: map[string]string{"a": "x"}}, nil); err == nil {
+		t.Errorf("no tls: no error")
+	}
+
+	// the hash of the Trojan docs' example
+	if h := trojanHash("password"); h != "d63dc919e201d7bc4c825630d2cf25fdc93d4b2f0d46706d29038d01" {
+		t.Errorf("hash: %s", h)
+	}
+
+	ts, _ := newTrojan(&TrojanConf{Users: map[string]string{"alice": "password"}}, lt)
+	h := trojanHash("password")
+	req := h + "\r\n\x01\x03\x0bexample.com\x01\xbb\r\nGET"
+	if r, n, err := ts.parse([]byte(req)); err != nil || r.Addr() != "example.com:443" || r.user != "alice" || req[n:] != "GET" {
+		t.Errorf("parse: %+v %d %v", r, n, err)
+	}
+	for _, v := range []struct {
+		s   string
+		err error
+	}{
+		{"GET / HTTP/1.1\r\n", errTrojan},
+		{h[:30], errTrojanShort},
+		{trojanHash("other") + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\n", errTrojan},
+		{h + "\r\n\x01\x01\x7f\x00", errTrojanShort},
+		{h + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50xx", errTrojan},
+	} {
+		if _, _, err := ts.parse([]byte(v.s)); err != v.err {
+			t.Errorf("%q: %v", v.s, err)
+		}
+	}
+}
+
+func TestTrojan(t *testing.T) {
+	ca := newTestCA(t)
+	echo := startEcho(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "just a web site")
+	}))
+	defer web.Close()
+
+	addr := startSocksProxy(t, &ListenConf{
+		TLS: TLSConf{Cert: ca.server(t)},
+		Trojan: TrojanConf{
+			Users:    map[string]string{"alice": "wonderland"},
+			Fallback: web.Listener.Addr().String(),
+		},
+	})
+	dial := func() *tls.Conn {
+		c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+
+	// the request and the first data in one write
+	c := dial()
+	b := encodeAddr([]byte(trojanHash("wonderland")+"\r\n\x01"), net.IPv4(127, 0, 0, 1),
+		echo.Addr().(*net.TCPAddr).Port)
+	c.Write(append(b, "\r\nping"...))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+		t.Errorf("tunnel: %q %v", got, err)
+	}
+	c.Close()
+
+	// anyone else sees the web site
+	for _, pw := range []string{"", "alice"} {
+		c = dial()
+		if len(pw) > 0 {
+			io.WriteString(c, trojanHash(pw)+"\r\n")
+		}
+		io.WriteString(c, "GET / HTTP/1.0\r\nHost: www.example.com\r\n\r\n")
+		r, _ := ioutil.ReadAll(c)
+		if !strings.Contains(string(r), "just a web site") != (len(pw) > 0) {
+			t.Errorf("fallback, password %q: %q", pw, r)
+		}
+		c.Close()
+	}
+
+	// goproxy as the client
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{
+		Listen: "trojan",
+		Parent: "trojan://wonderland@" + addr,
+		Rules:  []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.parent.Close()
+	d.parent.tls.RootCAs = ca.pool
+	pc, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(pc, "pong")
+	if _, err := io.ReadFull(pc, got); err != nil || string(got) != "pong" {
+		t.Errorf("parent: %q %v", got, err)
+	}
+	pc.Close()
+
+	for i := 0; i < 100 && len(sessionStats("", time.Now())) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,443 @@
+// udp.go -- SOCKSv5 UDP ASSOCIATE relay
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// NAT behavior of the UDP relay. This decides which remote hosts
+// can send datagrams to the client via the relay:
+//
+//   - port-restricted: only the ip:port the client has sent to
+//   - restricted: any port on an IP the client has sent to
+//   - full-cone: any host that knows the external address of the relay
+const (
+	natPortRestricted = iota
+	natRestricted
+	natFullCone
+)
+
+// Default idle timeout for a UDP association (seconds)
+const UDP_TIMEOUT = 60
+
+// Reassembly timeout for fragmented datagrams (seconds)
+const UDP_FRAG_TIMEOUT = 5
+
+// Room for the largest SOCKSv5 UDP header (IPv6 address)
+const udpHdrMax = 3 + 1 + 16 + 2
+
+// Largest payload we will reassemble
+const udpMaxPayload = 65507
+
+// Convert a config string to NAT behavior
+func parseNat(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "", "port-restricted":
+		return natPortRestricted, nil
+	case "restricted":
+		return natRestricted, nil
+	case "full-cone":
+		return natFullCone, nil
+	}
+	return 0, fmt.Errorf("unknown UDP nat type '%s'", s)
+}
+
+// A single UDP association
+type udpAssoc struct {
+	*socksProxy
+	log *L.Logger // of the session
+
+	ctl net.Conn     // TCP control connection
+	cli *net.UDPConn // socket facing the client
+	ext *net.UDPConn // socket facing remote hosts
+
+	user string // authenticated client; "" if none
+
+	tout time.Duration
+	last int64 // time of last activity (unix nsec); atomic
+
+	sync.Mutex
+	cip    net.IP          // IP address of the client
+	peer   *net.UDPAddr    // client's UDP address - declared or learnt
+	remote map[string]bool // remote endpoints the client sent to
+
+	// only used by fromClient()
+	frag udpFrag
+
+	once sync.Once
+}
+
+// Reassembly queue for a fragment sequence from the client
+type udpFrag struct {
+	hi   uint8     // highest fragment position processed
+	addr []byte    // ATYP ADDR PORT of the sequence
+	data []byte    // payload so far
+	t0   time.Time // start of the sequence
+}
+
+// Handle a UDP ASSOCIATE request on 'lhs'. This returns when the
+// association is done.
+func (px *socksProxy) associate(ctx context.Context, lhs net.Conn, r *socksReq) {
+	ls := lhs.RemoteAddr().String()
+	log := logOf(ctx, px.log)
+
+	la := lhs.LocalAddr().(*net.TCPAddr)
+	ra := lhs.RemoteAddr().(*net.TCPAddr)
+
+	cli, err := net.ListenUDP("udp", &net.UDPAddr{IP: la.IP})
+	if err != nil {
+		log.Error("%s can't create UDP relay: %s", ls, err)
+		px.reply(lhs, 1, nil)
+		return
+	}
+
+	src, err := px.dial.source(r.user, nil)
+	if err != nil {
+		log.Info("%s: %s", ls, err)
+		cli.Close()
+		px.reply(lhs, 1, nil)
+		return
+	}
+	var ea *net.UDPAddr
+	if src != nil {
+		ea = &net.UDPAddr{IP: src}
+	}
+
+	ext, err := net.ListenUDP("udp", ea)
+	if err != nil {
+		log.Error("%s can't create UDP relay: %s", ls, err)
+		cli.Close()
+		px.reply(lhs, 1, nil)
+		return
+	}
+
+	tout := px.cfg.UDP.Timeout
+	if tout <= 0 {
+		tout = UDP_TIMEOUT
+	}
+
+	a := &udpAssoc{
+		socksProxy: px,
+		log:        log,
+		ctl:        lhs,
+		cli:        cli,
+		ext:        ext,
+		user:       r.user,
+		tout:       time.Duration(tout) * time.Second,
+		cip:        ra.IP,
+		remote:     make(map[string]bool),
+	}
+
+	// The client may tell us the port it will send datagrams from. The
+	// address must be its own; else replies could be steered to a third
+	// party. If it isn't, we learn the peer from the first datagram.
+	if r.port != 0 {
+		ip := net.ParseIP(r.host)
+		switch {
+		case ip == nil || ip.IsUnspecified() || ip.Equal(ra.IP):
+			a.peer = &net.UDPAddr{IP: ra.IP, Port: r.port}
+		default:
+			log.Debug("%s UDP ASSOCIATE: ignoring declared address %s", ls, r.host)
+		}
+	}
+
+	a.touch()
+	px.reply(lhs, 0, cli.LocalAddr())
+
+	log.Debug("%s UDP ASSOCIATE via %s [%s]", ls, cli.LocalAddr().String(), ext.LocalAddr().String())
+
+	a.relay()
+
+	log.Debug("%s UDP ASSOCIATE via %s done", ls, cli.LocalAddr().String())
+}
+
+// Relay datagrams until the control connection is closed, the
+// association is idle or the proxy is shutdown.
+func (a *udpAssoc) relay() {
+	var wg sync.WaitGroup
+
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-a.ctx.Done():
+			a.close()
+		case <-stop:
+		}
+	}()
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer a.close()
+
+		// The association lives as long as the TCP connection
+		b := make([]byte, 64)
+		for {
+			if _, err := a.ctl.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer a.close()
+		a.fromClient()
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer a.close()
+		a.fromRemote()
+	}()
+
+	wg.Wait()
+	close(stop)
+}
+
+// Forward datagrams from the client to remote hosts
+func (a *udpAssoc) fromClient() {
+	log := a.log
+	b := make([]byte, 65536)
+
+	for {
+		a.cli.SetReadDeadline(time.Now().Add(a.tout))
+		n, src, err := a.cli.ReadFromUDP(b)
+		if err != nil {
+			if a.busy(err) {
+				continue
+			}
+			return
+		}
+
+		if !a.isPeer(src) {
+			log.Debug("%s: dropping datagram from unknown client %s", a.cli.LocalAddr().String(), src)
+			continue
+		}
+
+		// RSV(2) FRAG(1) ATYP ADDR PORT DATA
+		if n < 4 {
+			continue
+		}
+
+		host, port, hl, err := parseAddr(b[3:n])
+		if err != nil {
+			log.Debug("%s: bad UDP header: %s", src, err)
+			continue
+		}
+
+		data := b[3+hl : n]
+		if b[2] != 0 {
+			var ok bool
+			if data, ok = a.reassemble(src, b[2], b[3:3+hl], data); !ok {
+				continue
+			}
+		}
+
+		dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			log.Debug("%s: can't resolve %s: %s", src, host, err)
+			continue
+		}
+
+		if err = a.dial.CheckUDP(a.user, host, dst); err != nil {
+			log.Debug("%s: %s", src, err)
+			continue
+		}
+
+		a.touch()
+		a.permit(dst)
+		if _, err = a.ext.WriteToUDP(data, dst); err != nil {
+			log.Debug("%s: can't send to %s: %s", src, dst, err)
+		}
+	}
+}
+
+// Forward datagrams from remote hosts to the client
+func (a *udpAssoc) fromRemote() {
+	log := a.log
+	b := make([]byte, 65536+udpHdrMax)
+
+	for {
+		a.ext.SetReadDeadline(time.Now().Add(a.tout))
+		n, src, err := a.ext.ReadFromUDP(b[udpHdrMax:])
+		if err != nil {
+			if a.busy(err) {
+				continue
+			}
+			return
+		}
+
+		peer := a.permitted(src)
+		if peer == nil {
+			log.Debug("%s: dropping datagram from %s", a.ext.LocalAddr().String(), src)
+			continue
+		}
+
+		a.touch()
+
+		// Prepend the header in place
+		var hb [udpHdrMax]byte
+		h := encodeAddr(hb[:3], src.IP, src.Port)
+		i := udpHdrMax - len(h)
+		copy(b[i:], h)
+
+		if _, err = a.cli.WriteToUDP(b[i:udpHdrMax+n], peer); err != nil {
+			log.Debug("%s: can't send to %s: %s", src, peer, err)
+		}
+	}
+}
+
+// Add a fragment to the reassembly queue. The low 7 bits of 'frag' are
+// the fragment position and the high bit marks the last fragment.
+// Return the full payload and true when the sequence is complete.
+// Sequences that time out, arrive out of order or grow too large are
+// discarded.
+func (a *udpAssoc) reassemble(src *net.UDPAddr, frag uint8, addr, data []byte) ([]byte, bool) {
+	log := a.log
+	f := &a.frag
+	pos := frag & 0x7f
+	now := time.Now()
+
+	if f.hi > 0 && now.Sub(f.t0) > UDP_FRAG_TIMEOUT*time.Second {
+		log.Info("%s: fragment sequence timed out after %d fragments; discarded", src, f.hi)
+		f.reset()
+	}
+
+	// A lower position starts a new sequence
+	if pos <= f.hi {
+		log.Info("%s: fragment %d after %d; discarding sequence", src, pos, f.hi)
+		f.reset()
+	}
+
+	if pos != f.hi+1 {
+		log.Info("%s: missing fragment %d (saw %d); discarding sequence", src, f.hi+1, pos)
+		f.reset()
+		return nil, false
+	}
+
+	if f.hi == 0 {
+		f.t0 = now
+		f.addr = append(f.addr[:0], addr...)
+	} else if !bytes.Equal(f.addr, addr) {
+		log.Info("%s: fragment %d has a different destination; discarding sequence", src, pos)
+		f.reset()
+		return nil, false
+	}
+
+	if len(f.data)+len(data) > udpMaxPayload {
+		log.Info("%s: reassembled datagram exceeds %d bytes; discarding sequence", src, udpMaxPayload)
+		f.reset()
+		return nil, false
+	}
+
+	f.data = append(f.data, data...)
+	f.hi = pos
+
+	if frag&0x80 == 0 {
+		return nil, false
+	}
+
+	d := f.data
+	f.data = nil
+	f.reset()
+	return d, true
+}
+
+func (f *udpFrag) reset() {
+	f.hi = 0
+	f.data = f.data[:0]
+}
+
+// Return true if the client address 'src' belongs to this association.
+// The first datagram from the client's IP fixes the peer address if the
+// client didn't declare it.
+func (a *udpAssoc) isPeer(src *net.UDPAddr) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.peer == nil {
+		if !src.IP.Equal(a.cip) {
+			return false
+		}
+		a.peer = src
+		return true
+	}
+	return a.peer.IP.Equal(src.IP) && a.peer.Port == src.Port
+}
+
+// Record that the client has sent to 'dst'
+func (a *udpAssoc) permit(dst *net.UDPAddr) {
+	if a.nat == natFullCone {
+		return
+	}
+
+	a.Lock()
+	a.remote[a.key(dst)] = true
+	a.Unlock()
+}
+
+// Return the client address if datagrams from 'src' may be relayed,
+// nil otherwise.
+func (a *udpAssoc) permitted(src *net.UDPAddr) *net.UDPAddr {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.peer == nil {
+		return nil
+	}
+
+	if a.nat == natFullCone || a.remote[a.key(src)] {
+		return a.peer
+	}
+	return nil
+}
+
+// Return the map key for a remote endpoint as per the NAT behavior
+func (a *udpAssoc) key(u *net.UDPAddr) string {
+	if a.nat == natRestricted {
+		return u.IP.String()
+	}
+	return u.String()
+}
+
+func (a *udpAssoc) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Return true if 'err' is a read timeout while the association
+// is still active in the other direction.
+func (a *udpAssoc) busy(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		last := time.Unix(0, atomic.LoadInt64(&a.last))
+		return time.Since(last) < a.tout
+	}
+	return false
+}
+
+func (a *udpAssoc) close() {
+	a.once.Do(func() {
+		a.ctl.Close()
+		a.cli.Close()
+		a.ext.Close()
+	})
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,157 @@
+// udp_test.go -- tests for SOCKS UDP fragment reassembly
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// A fragment as sent by the client
+type frag struct {
+	frag uint8
+	addr string
+	data string
+}
+
+func newTestAssoc(t *testing.T) *udpAssoc {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &udpAssoc{socksProxy: &socksProxy{log: log}, log: log}
+}
+
+// Feed the fragments 'v' to 'a'; return the datagrams completed
+func feed(a *udpAssoc, v []frag) []string {
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+
+	var out []string
+	for _, f := range v {
+		if d, ok := a.reassemble(src, f.frag, []byte(f.addr), []byte(f.data)); ok {
+			out = append(out, string(d))
+		}
+	}
+	return out
+}
+
+func TestReassemble(t *testing.T) {
+	const last = 0x80
+
+	tests := []struct {
+		name string
+		v    []frag
+		want []string
+	}{
+		{"single", []frag{{1 | last, "A", "abc"}}, []string{"abc"}},
+		{"in order", []frag{{1, "A", "ab"}, {2, "A", "cd"}, {3 | last, "A", "ef"}},
+			[]string{"abcdef"}},
+		{"back to back", []frag{{1, "A", "ab"}, {2 | last, "A", "cd"}, {1, "A", "x"}, {2 | last, "A", "y"}},
+			[]string{"abcd", "xy"}},
+		{"unterminated", []frag{{1, "A", "ab"}, {2, "A", "cd"}}, nil},
+
+		{"starts past 1", []frag{{2, "A", "ab"}, {3 | last, "A", "cd"}}, nil},
+		{"gap", []frag{{1, "A", "ab"}, {3 | last, "A", "ef"}}, nil},
+		{"gap then late fragment", []frag{{1, "A", "ab"}, {3, "A", "ef"}, {2 | last, "A", "cd"}}, nil},
+		{"swapped", []frag{{2, "A", "cd"}, {1, "A", "ab"}, {3 | last, "A", "ef"}}, nil},
+		{"restart", []frag{{1, "A", "ab"}, {2, "A", "cd"}, {1, "A", "x"}, {2 | last, "A", "y"}},
+			[]string{"xy"}},
+		{"duplicate", []frag{{1, "A", "ab"}, {1, "A", "ab"}, {2 | last, "A", "cd"}},
+			[]string{"abcd"}},
+		{"recovers after gap", []frag{{1, "A", "ab"}, {3, "A", "ef"}, {1, "A", "x"}, {2 | last, "A", "y"}},
+			[]string{"xy"}},
+
+		{"destination change", []frag{{1, "A", "ab"}, {2 | last, "B", "cd"}}, nil},
+		{"destination change then new sequence", []frag{{1, "A", "ab"}, {2, "B", "cd"}, {1, "B", "x"}, {2 | last, "B", "y"}},
+			[]string{"xy"}},
+	}
+
+	for _, tt := range tests {
+		a := newTestAssoc(t)
+		got := feed(a, tt.v)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	a := newTestAssoc(t)
+
+	if got := feed(a, []frag{{1, "A", "ab"}, {2, "A", "cd"}}); got != nil {
+		t.Fatalf("incomplete sequence returned %q", got)
+	}
+
+	// The rest arrives after the timeout: the old fragments are gone
+	a.frag.t0 = a.frag.t0.Add(-(UDP_FRAG_TIMEOUT + 1) * time.Second)
+	if got := feed(a, []frag{{3 | 0x80, "A", "ef"}}); got != nil {
+		t.Errorf("timed out sequence returned %q", got)
+	}
+
+	// A new sequence after the timeout works
+	a.frag.t0 = a.frag.t0.Add(-(UDP_FRAG_TIMEOUT + 1) * time.Second)
+	if got := feed(a, []frag{{1, "A", "x"}, {2 | 0x80, "A", "y"}}); len(got) != 1 || got[0] != "xy" {
+		t.Errorf("sequence after timeout: got %q", got)
+	}
+}
+
+func TestReassembleSize(t *testing.T) {
+	big := string(bytes.Repeat([]byte{'z'}, 30000))
+
+	// Exactly the limit is fine
+	a := newTestAssoc(t)
+	rest := big[:udpMaxPayload-2*len(big)]
+	got := feed(a, []frag{{1, "A", big}, {2, "A", big}, {3 | 0x80, "A", rest}})
+	if len(got) != 1 || len(got[0]) != udpMaxPayload {
+		t.Errorf("payload at the limit not reassembled")
+	}
+
+	// One more byte discards the sequence
+	a = newTestAssoc(t)
+	if got := feed(a, []frag{{1, "A", big}, {2, "A", big}, {3 | 0x80, "A", rest + "z"}}); got != nil {
+		t.Errorf("oversize payload reassembled")
+	}
+
+	// and the fragments that follow don't complete it
+	if got := feed(a, []frag{{4 | 0x80, "A", "x"}}); got != nil {
+		t.Errorf("oversize sequence completed")
+	}
+}
+
+// A returned datagram must not be overwritten by the next sequence
+func TestReassembleNoAlias(t *testing.T) {
+	a := newTestAssoc(t)
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+
+	a.reassemble(src, 1, []byte("A"), []byte("ab"))
+	d, ok := a.reassemble(src, 2|0x80, []byte("A"), []byte("cd"))
+	if !ok {
+		t.Fatal("not reassembled")
+	}
+
+	a.reassemble(src, 1, []byte("A"), []byte("XY"))
+	a.reassemble(src, 2, []byte("A"), []byte("ZW"))
+	if string(d) != "abcd" {
+		t.Errorf("datagram changed to %q", d)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
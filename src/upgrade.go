@@ -0,0 +1,211 @@
+// upgrade.go -- HTTP Upgrade (WebSocket) passthrough
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Seconds an origin has to answer an Upgrade request
+const UPGRADE_TIMEOUT = 30
+
+// Return the protocol the request with headers 'h' wants to upgrade to
+// (e.g. "websocket") or "" if it doesn't.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// Relay a request to upgrade to 'proto'. If the origin switches
+// protocols the client and origin connections become a tunnel, with
+// the tunnel timeouts and byte limit; else the origin's answer is
+// relayed as is.
+func (p *HTTPProxy) handleUpgrade(w http.ResponseWriter, r *http.Request, proto string) {
+	log := logOf(r.Context(), p.log)
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't support Upgrade", http.StatusNotImplemented)
+		return
+	}
+
+	// wss:// goes through CONNECT; we can't hand over a TLS session
+	if r.URL.Scheme != "http" {
+		http.Error(w, "Upgrade needs CONNECT for "+r.URL.Scheme, http.StatusNotImplemented)
+		return
+	}
+
+	host := extractHost(r.URL)
+	ctx := r.Context()
+	t0 := time.Now()
+
+	dest, err := p.dial.DialContext(ctx, "tcp", host)
+	p.cp.respond(w)
+	if err != nil {
+		if pe := isDenied(err); pe != nil {
+			log.Info("%s: %s", r.RemoteAddr, pe)
+		} else {
+			log.Debug("can't connect to %s: %s", host, err)
+		}
+		p.replyError(w, r, err, host)
+		return
+	}
+	d := dest.(tcpConn)
+
+	req := r.WithContext(ctx)
+	req.Header = cloneCleanHeader(r.Header)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", proto)
+	req.Close = false
+	if r.ContentLength == 0 {
+		req.Body = nil
+	} else {
+		req.Body = p.cp.body(w, r, log)
+	}
+
+	d.SetDeadline(time.Now().Add(UPGRADE_TIMEOUT * time.Second))
+	br := bufio.NewReader(d)
+
+	var res *http.Response
+	if err = req.Write(d); err == nil {
+		res, err = http.ReadResponse(br, req)
+	}
+	p.cp.respond(w)
+	if err != nil {
+		d.Close()
+		log.Debug("%s: upgrade to %s: %s", r.Host, proto, err)
+		http.Error(w, fmt.Sprintf("can't upgrade: %s", err), http.StatusBadGateway)
+		return
+	}
+	t1 := time.Now()
+
+	// The origin said no; it's an ordinary response
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer d.Close()
+
+		copyHeader(w.Header(), cleanHeaders(res.Header))
+		w.WriteHeader(res.StatusCode)
+
+		nr, err := io.Copy(p.cp.writer(w, r, log), p.lim.responseBody(res.Body))
+		res.Body.Close()
+		if err == errResponseTooLarge {
+			panic(http.ErrAbortHandler)
+		}
+		p.logRequest(r, res.StatusCode, nr, t0, t1, "")
+		return
+	}
+
+	if got := res.Header.Get("Upgrade"); !strings.EqualFold(got, proto) {
+		d.Close()
+		log.Info("%s: upgrade to %s: origin %s switched to %q", r.RemoteAddr, proto, host, got)
+		http.Error(w, "Origin switched to another protocol", http.StatusBadGateway)
+		return
+	}
+
+	client, brw, err := h.Hijack()
+	if err != nil {
+		d.Close()
+		log.Warn("can't do Upgrade: hijack failed: %s", err)
+		return
+	}
+	s := clientConn(client)
+
+	// Either side may have sent data right after the handshake; it is
+	// sitting in our buffers.
+	var down, up int
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	res.Header.Write(&b)
+	b.WriteString("\r\n")
+	if n := br.Buffered(); n > 0 {
+		x, _ := br.Peek(n)
+		b.Write(x)
+		down += n
+	}
+
+	s.SetWriteDeadline(time.Now().Add(UPGRADE_TIMEOUT * time.Second))
+	_, err = s.Write(b.Bytes())
+	if err == nil {
+		if n := brw.Reader.Buffered(); n > 0 {
+			x, _ := brw.Reader.Peek(n)
+			_, err = d.Write(x)
+			up += n
+		}
+	}
+	if err != nil {
+		s.Close()
+		d.Close()
+		log.Debug("%s: upgrade to %s: %s", r.RemoteAddr, proto, err)
+		return
+	}
+
+	// From here on it's a tunnel with its own timeouts
+	s.SetDeadline(time.Time{})
+	d.SetDeadline(time.Time{})
+
+	log.Debug("%s: UPGRADE %s %s %s", s.RemoteAddr().String(), proto, host, filterNotes(ctx))
+
+	// Hijacked connections aren't closed by the server's Shutdown()
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer func() {
+		stop()
+		cancel()
+	}()
+
+	cp := &CancellableCopier{
+		Lhs:          s,
+		Rhs:          d,
+		ReadTimeout:  p.conf.Tunnel.Idle,
+		WriteTimeout: 15, // XXX Config file
+		Linger:       p.conf.Tunnel.Linger,
+		Sockmap:      p.conf.Tunnel.Sockmap,
+		IOBufsize:    p.conf.Bufsize,
+		MaxBytes:     p.conf.Tunnel.MaxBytes,
+	}
+
+	// The bytes sent with the handshake count too
+	down0, up0 := int64(down), int64(up)
+	moved := func() (int64, int64) {
+		in, out := cp.Moved()
+		return in + up0, out + down0
+	}
+	sess := p.auth.begin(ctx, "upgrade", host, moved)
+	live := startSession(ctx, p.conf.Listen, "upgrade", host, cp, moved)
+
+	nd, nu, err := cp.Copy(ctx)
+	live.done()
+	p.auth.end(sess)
+	down += nd
+	up += nu
+	if err != nil {
+		log.Info("%s: UPGRADE %s %s closed: %s (limit %d bytes)",
+			s.RemoteAddr().String(), proto, host, err, cp.MaxBytes)
+	} else if err := cutShort(ctx); err != nil {
+		log.Info("%s: UPGRADE %s %s closed: %s", s.RemoteAddr().String(), proto, host, err)
+	}
+
+	log.Debug("%s: UPGRADE %s %s done: %d bytes down, %d up, %s",
+		s.RemoteAddr().String(), proto, host, down, up, time.Since(t1))
+	p.logRequest(r, res.StatusCode, int64(down+up), t0, t1, "")
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,193 @@
+// upgrade_test.go -- tests for HTTP Upgrade passthrough
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Start an HTTP proxy for 'lc' on a loopback port
+func startHTTPProxy(t *testing.T, lc *ListenConf) string {
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc.Listen = "127.0.0.1:0"
+	lc.Rules = append(lc.Rules, RuleConf{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"})
+
+	px, err := NewHTTPProxy(lc, log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	px.Start()
+	t.Cleanup(px.Stop)
+	return px.(*HTTPProxy).Addr().String()
+}
+
+// An origin that switches /ws to an echo protocol and refuses the rest
+func startUpgradeOrigin(t *testing.T, hdrs chan<- http.Header) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				r, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				hdrs <- r.Header
+
+				if r.URL.Path != "/ws" {
+					io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 2\r\n\r\nno")
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+					"Connection: Upgrade\r\nSec-WebSocket-Accept: abc\r\n\r\nhello")
+				io.Copy(c, br)
+			}(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Send an upgrade request for 'path' through the proxy
+func upgradeRequest(t *testing.T, proxy, origin, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "GET http://%s%s HTTP/1.1\r\nHost: %s\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Upgrade: websocket\r\nProxy-Connection: keep-alive\r\nSec-WebSocket-Key: k\r\n\r\n",
+		origin, path, origin)
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, res
+}
+
+func TestUpgradeType(t *testing.T) {
+	tests := []struct {
+		conn, up string
+		want     string
+	}{
+		{"Upgrade", "websocket", "websocket"},
+		{"keep-alive, upgrade", "websocket", "websocket"},
+		{"keep-alive", "websocket", ""},
+		{"Upgrade", "", ""},
+		{"", "websocket", ""},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if len(tt.conn) > 0 {
+			h.Set("Connection", tt.conn)
+		}
+		if len(tt.up) > 0 {
+			h.Set("Upgrade", tt.up)
+		}
+		if got := upgradeType(h); got != tt.want {
+			t.Errorf("%q %q: got %q", tt.conn, tt.up, got)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	hdrs := make(chan http.Header, 4)
+	origin := startUpgradeOrigin(t, hdrs)
+	proxy := startHTTPProxy(t, &ListenConf{})
+
+	c, br, res := upgradeRequest(t, proxy, origin, "/ws")
+	defer c.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "websocket" ||
+		res.Header.Get("Sec-WebSocket-Accept") != "abc" {
+		t.Fatalf("response %d %v", res.StatusCode, res.Header)
+	}
+
+	h := <-hdrs
+	if h.Get("Connection") != "Upgrade" || h.Get("Upgrade") != "websocket" ||
+		h.Get("Sec-WebSocket-Key") != "k" || len(h.Get("Proxy-Connection")) > 0 {
+		t.Errorf("origin got %v", h)
+	}
+
+	// Sent by the origin with the 101
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello" {
+		t.Fatalf("first frame %q, %v", b, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("ping %d", i)
+		io.WriteString(c, msg)
+		b = make([]byte, len(msg))
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != msg {
+			t.Fatalf("echo %q, %v", b, err)
+		}
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	hdrs := make(chan http.Header, 4)
+	origin := startUpgradeOrigin(t, hdrs)
+	proxy := startHTTPProxy(t, &ListenConf{})
+
+	c, _, res := upgradeRequest(t, proxy, origin, "/other")
+	defer c.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusForbidden || string(b) != "no" || len(res.Header.Get("Upgrade")) > 0 {
+		t.Errorf("response %d %q %v", res.StatusCode, b, res.Header)
+	}
+}
+
+func TestUpgradeLimit(t *testing.T) {
+	hdrs := make(chan http.Header, 4)
+	origin := startUpgradeOrigin(t, hdrs)
+	proxy := startHTTPProxy(t, &ListenConf{Tunnel: TunnelConf{MaxBytes: 1000}})
+
+	c, br, res := upgradeRequest(t, proxy, origin, "/ws")
+	defer c.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response %d", res.StatusCode)
+	}
+
+	go io.WriteString(c, strings.Repeat("x", 4000))
+	n, _ := io.Copy(ioutil.Discard, br)
+	if n >= 2000 {
+		t.Errorf("%d bytes echoed past the limit", n)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,701 @@
+// upstream.go -- parent proxies and upstream connection pools
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool defaults
+const (
+	POOL_MAXIDLE = 32
+	POOL_IDLE    = 60
+	POOL_RETRIES = 1
+
+	// TLS sessions cached for resumption
+	POOL_TLS_SESSIONS = 256
+)
+
+var (
+	errParentBusy  = errors.New("parent proxy connection limit reached")
+	errPinMismatch = errors.New("tls: no certificate of the parent matches its pins")
+)
+
+// Upstream pool limits with defaults filled in
+type poolPolicy struct {
+	maxIdle  int
+	perHost  int
+	idle     time.Duration
+	lifetime time.Duration
+	retries  int
+	sessions int // TLS session cache size; 0 disables it
+
+	hello func(*tls.Config) // ClientHello profile; nil is crypto/tls'
+}
+
+func newPoolPolicy(pc *PoolConf) *poolPolicy {
+	pp := &poolPolicy{
+		maxIdle:  pc.MaxIdle,
+		perHost:  pc.PerHost,
+		idle:     time.Duration(pc.Idle) * time.Second,
+		lifetime: time.Duration(pc.Lifetime) * time.Second,
+		retries:  pc.Retries,
+		sessions: pc.TLSSessions,
+	}
+
+	if pp.maxIdle <= 0 {
+		pp.maxIdle = POOL_MAXIDLE
+	}
+	if pp.idle <= 0 {
+		pp.idle = POOL_IDLE * time.Second
+	}
+	switch {
+	case pp.retries == 0:
+		pp.retries = POOL_RETRIES
+	case pp.retries < 0:
+		pp.retries = 0
+	}
+	switch {
+	case pp.sessions == 0:
+		pp.sessions = POOL_TLS_SESSIONS
+	case pp.sessions < 0:
+		pp.sessions = 0
+	}
+	return pp
+}
+
+// An upstream connection that knows its age. The HTTP transport keeps
+// these in its pool; a request that gets an expired one asks the
+// transport not to reuse it again (see HTTPProxy.ServeHTTP).
+type agedConn struct {
+	net.Conn
+	born     time.Time
+	lifetime time.Duration
+}
+
+func (c *agedConn) expired() bool {
+	return c.lifetime > 0 && time.Since(c.born) > c.lifetime
+}
+
+// Return true if 'c' is an upstream connection past its lifetime
+func expired(c net.Conn) bool {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	ac, ok := c.(*agedConn)
+	return ok && ac.expired()
+}
+
+// HTTP transport for the forward path: pooled connections to origins
+// or, if there is one, to the parent proxy. TLS sessions with origins
+// are cached, so a new connection to an origin we talked to recently
+// resumes its session instead of doing a full handshake.
+func newTransport(d *dialer) *http.Transport {
+	pp := d.pool
+	tr := &http.Transport{
+		TLSHandshakeTimeout: 8 * time.Second,
+		MaxIdleConnsPerHost: pp.maxIdle,
+		MaxConnsPerHost:     pp.perHost,
+		IdleConnTimeout:     pp.idle,
+		TLSClientConfig:     &tls.Config{},
+	}
+
+	if pp.sessions > 0 {
+		tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(pp.sessions)
+	}
+	if pp.hello != nil {
+		pp.hello(tr.TLSClientConfig)
+	}
+
+	// A fronted parent routes by the Host header, which on the forward
+	// path names the origin, and a V2Ray parent doesn't proxy HTTP:
+	// those requests go in tunnels too
+	if p := d.parent; p != nil && len(p.host) == 0 && len(p.proto) == 0 {
+		tr.Proxy = http.ProxyURL(p.url)
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			t0 := time.Now()
+			c, err := p.DialContext(ctx, network, addr)
+			if err == nil {
+				observe("goproxy_dial_seconds", routeLabels(ctx, d.listen), time.Since(t0))
+			}
+			return c, err
+		}
+		return tr
+	}
+
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &agedConn{Conn: c, born: time.Now(), lifetime: pp.lifetime}, nil
+	}
+	if d.ech != nil {
+		tr.DialTLSContext = d.ech.dialTLS(tr)
+	}
+	return tr
+}
+
+// Transports of users with their own source addresses: a pooled
+// connection from one user's address must not carry the requests of
+// another. HTTP/2 connections of these aren't coalesced.
+type userTransports struct {
+	d     *dialer
+	http2 bool
+
+	sync.Mutex
+	m map[string]*http.Transport
+}
+
+// Return the transport of 'user'; 'tr' if it has no source address
+func (u *userTransports) get(user string, tr *http.Transport) *http.Transport {
+	if len(user) == 0 {
+		return tr
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	t, ok := u.m[user]
+	if !ok {
+		t = newTransport(u.d)
+		t.ForceAttemptHTTP2 = u.http2
+		u.m[user] = t
+	}
+	return t
+}
+
+func (u *userTransports) Close() {
+	u.Lock()
+	defer u.Unlock()
+	for _, t := range u.m {
+		t.CloseIdleConnections()
+	}
+}
+
+// A parent HTTP proxy. Tunnels are made with CONNECT; each takes a
+// connection from a small pool of pre-dialed spares - so bursts of
+// clients don't wait for the TCP handshake to the parent. An https
+// parent with a front domain is dialed at the front, which is also the
+// name in the TLS SNI; the Host header of the CONNECT names the parent
+// (domain fronting). A V2Ray or Trojan parent (v2ray.go, trojan.go) is
+// sent a VLESS, VMess or Trojan request instead of CONNECT.
+type parent struct {
+	sync.Mutex
+
+	url  *url.URL
+	addr string // dialed: the parent's or the front's
+	host string // Host header of the CONNECT; "" is the destination
+	auth string // Proxy-Authorization value
+
+	tls   *tls.Config // TLS of tunnels to an https parent; nil if none
+	pins  *tlsPins    // of its certificates; nil if none
+	trans Transport   // stream transport under it all; nil if none
+
+	proto  string   // "vless", "vmess", "trojan" or "socks5"; "" is HTTP
+	id     [16]byte // the V2Ray user
+	trojan string   // hex SHA-224 of the Trojan password
+
+	suser, spass string // SOCKS5 credentials
+	tor          bool   // a Tor SOCKS port: names are resolved by Tor
+	isolate      string // the streams Tor keeps apart
+
+	nd *net.Dialer
+	pp *poolPolicy
+
+	spare []*spareConn
+	sem   chan bool // per-host cap; nil if unlimited
+
+	okAt time.Time // of the last connection that worked
+}
+
+// An idle pre-dialed connection to the parent
+type spareConn struct {
+	*net.TCPConn
+	born time.Time
+	idle time.Time
+}
+
+// A connection that holds a slot of the per-host cap until it is closed
+type capConn struct {
+	*net.TCPConn
+	once sync.Once
+	sem  chan bool
+}
+
+func (c *capConn) Close() error {
+	c.once.Do(func() { <-c.sem })
+	return c.TCPConn.Close()
+}
+
+func newParent(s, front string, pp *poolPolicy, nd *net.Dialer) (*parent, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("parent %s: %s", s, err)
+	}
+
+	port := "80"
+	switch u.Scheme {
+	case "http":
+		if len(front) > 0 {
+			return nil, fmt.Errorf("parent %s: a front needs an https parent", s)
+		}
+	case "https":
+		port = "443"
+	case "socks5", "tor":
+		if len(front) > 0 {
+			return nil, fmt.Errorf("parent %s: a front needs an https parent", s)
+		}
+		port = "1080"
+		if u.Scheme == "tor" {
+			port = "9050"
+		}
+	case "vless", "vmess", "trojan":
+		if len(front) > 0 {
+			return nil, fmt.Errorf("parent %s: a front needs an https parent", s)
+		}
+		if len(u.Port()) == 0 {
+			return nil, fmt.Errorf("parent %s: needs a port", s)
+		}
+	default:
+		return nil, fmt.Errorf("parent %s: unsupported scheme '%s'", s, u.Scheme)
+	}
+	if len(u.Port()) > 0 {
+		port = u.Port()
+	}
+
+	p := &parent{
+		url:  u,
+		addr: net.JoinHostPort(u.Hostname(), port),
+		nd:   nd,
+		pp:   pp,
+	}
+	if u.Scheme == "https" {
+		p.tls = &tls.Config{ServerName: u.Hostname(), ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	}
+	if u.Scheme == "vless" || u.Scheme == "vmess" {
+		if p.id, err = parseUUID(u.User.Username()); err != nil {
+			return nil, fmt.Errorf("parent %s: %s", s, err)
+		}
+		p.proto = u.Scheme
+
+		q := u.Query()
+		switch q.Get("security") {
+		case "tls":
+			sni := q.Get("sni")
+			if len(sni) == 0 {
+				sni = u.Hostname()
+			}
+			p.tls = &tls.Config{ServerName: sni, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+		case "", "none":
+		default:
+			return nil, fmt.Errorf("parent %s: unsupported security '%s'", s, q.Get("security"))
+		}
+	}
+	if u.Scheme == "trojan" {
+		pw := u.User.Username()
+		if len(pw) == 0 {
+			return nil, fmt.Errorf("parent %s: needs a password", s)
+		}
+		p.proto, p.trojan = u.Scheme, trojanHash(pw)
+
+		// Trojan is always in TLS
+		sni := u.Query().Get("sni")
+		if len(sni) == 0 {
+			sni = u.Hostname()
+		}
+		p.tls = &tls.Config{ServerName: sni, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	}
+
+	if u.Scheme == "socks5" || u.Scheme == "tor" {
+		if err := p.setSocks(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(front) > 0 {
+		fh, fp, err := net.SplitHostPort(front)
+		if err != nil {
+			fh, fp = front, port
+		}
+		if len(fh) == 0 {
+			return nil, fmt.Errorf("parent %s: bad front '%s'", s, front)
+		}
+		p.addr = net.JoinHostPort(fh, fp)
+		p.host = u.Host
+		p.tls.ServerName = fh
+	}
+
+	pins, err := parsePins(u.Query())
+	if err != nil {
+		return nil, fmt.Errorf("parent %s: %s", s, err)
+	}
+	if pins != nil {
+		if p.tls == nil {
+			return nil, fmt.Errorf("parent %s: pins need TLS", s)
+		}
+		p.pins = pins
+		cfg := p.tls
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return pins.verify(cs, cfg.ServerName)
+		}
+	}
+
+	if u.User != nil && len(p.proto) == 0 {
+		pw, _ := u.User.Password()
+		cred := u.User.Username() + ":" + pw
+		p.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred))
+	}
+
+	if pp.perHost > 0 {
+		p.sem = make(chan bool, pp.perHost)
+	}
+	return p, nil
+}
+
+// Open a tunnel to 'addr' through the parent
+func (p *parent) connect(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := startSpan(ctx, "handshake", _SPAN_CLIENT)
+	sp.set("goproxy.parent", p.addr)
+	if p.trans != nil {
+		c = clientTransport(p.trans, c)
+	}
+	if p.tls != nil {
+		tc := tls.Client(c, p.tls)
+		c.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+		if err = tc.HandshakeContext(ctx); err == nil {
+			c = &tlsConn{tc}
+		}
+	}
+	switch {
+	case err != nil:
+	case p.proto == "socks5":
+		err = p.socks(ctx, c, addr)
+	case len(p.proto) > 0:
+		c, err = p.v2ray(c, addr)
+	default:
+		err = p.handshake(c, addr)
+	}
+	sp.fail(err)
+	sp.finish()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send CONNECT and read the reply without reading past it; the tunnel
+// data that follows belongs to the client.
+func (p *parent) handshake(c net.Conn, addr string) error {
+	c.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	host := p.host
+	if len(host) == 0 {
+		host = addr
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, host)
+	if len(p.auth) > 0 {
+		req += "Proxy-Authorization: " + p.auth + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := c.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	var hdr []byte
+	var b [1]byte
+	for !endOfHeader(hdr) {
+		if len(hdr) > MAX_HEADER_BYTES {
+			return fmt.Errorf("parent %s: reply header too large", p.addr)
+		}
+		if _, err := c.Read(b[:]); err != nil {
+			return fmt.Errorf("parent %s: %s", p.addr, err)
+		}
+		hdr = append(hdr, b[0])
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(hdr)), nil)
+	if err != nil {
+		return fmt.Errorf("parent %s: %s", p.addr, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("parent %s: CONNECT %s: %s", p.addr, addr, res.Status)
+		if cause := httpCause(res.StatusCode); cause != nil {
+			return newError(cause, msg)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func endOfHeader(b []byte) bool {
+	n := len(b)
+	return n >= 4 && string(b[n-4:]) == "\r\n\r\n"
+}
+
+// Return a connection to the parent: a live spare if there is one,
+// else a new one. Either way, top up the spares in the background.
+func (p *parent) get(ctx context.Context) (net.Conn, error) {
+	if p.sem != nil {
+		t := time.NewTimer(DIAL_TIMEOUT)
+		defer t.Stop()
+
+		select {
+		case p.sem <- true:
+		case <-t.C:
+			return nil, errParentBusy
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c := p.take()
+	if c == nil {
+		nc, err := p.dial(ctx)
+		if err != nil {
+			if p.sem != nil {
+				<-p.sem
+			}
+			return nil, err
+		}
+		c = nc
+	}
+
+	go p.refill()
+
+	if p.sem != nil {
+		return &capConn{TCPConn: c, sem: p.sem}, nil
+	}
+	return c, nil
+}
+
+// Take a live spare (or nil)
+func (p *parent) take() *net.TCPConn {
+	now := time.Now()
+
+	p.Lock()
+	defer p.Unlock()
+
+	for len(p.spare) > 0 {
+		n := len(p.spare) - 1
+		s := p.spare[n]
+		p.spare = p.spare[:n]
+
+		if p.stale(s, now) || !alive(s.TCPConn) {
+			s.Close()
+			continue
+		}
+		return s.TCPConn
+	}
+	return nil
+}
+
+func (p *parent) stale(s *spareConn, now time.Time) bool {
+	if now.Sub(s.idle) > p.pp.idle {
+		return true
+	}
+	return p.pp.lifetime > 0 && now.Sub(s.born) > p.pp.lifetime
+}
+
+// Add a spare if we have fewer than maxIdle. The per-host cap counts
+// connections in use and being dialed; a spare is counted once taken.
+func (p *parent) refill() {
+	p.Lock()
+	n := len(p.spare)
+	p.Unlock()
+
+	if n >= p.pp.maxIdle {
+		return
+	}
+
+	if p.sem != nil {
+		select {
+		case p.sem <- true:
+			defer func() { <-p.sem }()
+		default:
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	c, err := p.dial(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	p.Lock()
+	p.expire(now)
+	if len(p.spare) < p.pp.maxIdle {
+		p.spare = append(p.spare, &spareConn{TCPConn: c, born: now, idle: now})
+		c = nil
+	}
+	p.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Drop stale spares; called with the lock held
+func (p *parent) expire(now time.Time) {
+	v := p.spare[:0]
+	for _, s := range p.spare {
+		if p.stale(s, now) {
+			s.Close()
+			continue
+		}
+		v = append(v, s)
+	}
+	p.spare = v
+}
+
+func (p *parent) dial(ctx context.Context) (*net.TCPConn, error) {
+	c, err := p.nd.DialContext(ctx, "tcp", p.addr)
+	p.seen(err)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.TCPConn), nil
+}
+
+// Dial the parent for the HTTP transport; these are pooled by the
+// transport itself.
+func (p *parent) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := p.nd.DialContext(ctx, network, p.addr)
+	p.seen(err)
+	if err != nil {
+		return nil, err
+	}
+	if p.trans != nil {
+		c = clientTransport(p.trans, c)
+	}
+	return &agedConn{Conn: c, born: time.Now(), lifetime: p.pp.lifetime}, nil
+}
+
+// Close all spares
+func (p *parent) Close() {
+	p.Lock()
+	for _, s := range p.spare {
+		s.Close()
+	}
+	p.spare = nil
+	p.Unlock()
+}
+
+// Pins of the certificates of a parent, from the 'pin' (SHA-256 of a
+// public key (SPKI) in base64, as curl's --pinnedpubkey has it after
+// "sha256//") and 'certpin' (SHA-256 of a certificate, hex as openssl
+// prints it) of its URL
+type tlsPins struct {
+	spki  [][32]byte
+	cert  [][32]byte
+	roots *x509.CertPool // of verified chains; nil is the system's
+}
+
+// Return the pins in 'q' or nil if there are none
+func parsePins(q url.Values) (*tlsPins, error) {
+	p := &tlsPins{}
+	for _, s := range q["pin"] {
+		// a '+' of base64 is a space once the query is decoded
+		s = strings.TrimPrefix(s, "sha256//")
+		s = strings.ReplaceAll(s, " ", "+")
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		}
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("pin %q: not a base64 SHA-256", s)
+		}
+		p.spki = append(p.spki, [32]byte(b))
+	}
+	for _, s := range q["certpin"] {
+		b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("certpin %q: not a hex SHA-256", s)
+		}
+		p.cert = append(p.cert, [32]byte(b))
+	}
+	if len(p.spki) == 0 && len(p.cert) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (p *tlsPins) match(c *x509.Certificate) bool {
+	k := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	for _, h := range p.spki {
+		if h == k {
+			return true
+		}
+	}
+	k = sha256.Sum256(c.Raw)
+	for _, h := range p.cert {
+		if h == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the certificates of the parent: a pinned one it sends is
+// trusted by itself (the parent may have a self-signed one); else one of
+// a chain verified to 'name' must be pinned (e.g. the parent's own CA).
+func (p *tlsPins) verify(cs tls.ConnectionState, name string) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errPinMismatch
+	}
+	if p.match(certs[0]) {
+		return nil
+	}
+
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{DNSName: name, Intermediates: inter, Roots: p.roots})
+	if err != nil {
+		return err
+	}
+	for _, ch := range chains {
+		for _, c := range ch[1:] {
+			if p.match(c) {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
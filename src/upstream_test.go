@@ -0,0 +1,288 @@
+// upstream_test.go -- tests for upstream connections
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+// Return the resumption status of each TLS handshake with 'srv', one
+// GET per connection, through a transport for 'pc'.
+func tlsHandshakes(t *testing.T, pc PoolConf, maxVers uint16) []bool {
+	var mu sync.Mutex
+	var resumed []bool
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{
+		MaxVersion: maxVers,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			mu.Lock()
+			resumed = append(resumed, cs.DidResume)
+			mu.Unlock()
+			return nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	log, err := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &ListenConf{
+		Pool:  pc,
+		Rules: []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}},
+	}
+	d, err := newDialer(lc, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTransport(d)
+	tr.DisableKeepAlives = true
+	tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for i := 0; i < 3; i++ {
+		if got := get(t, tr, srv.URL+"/"); got != "ok" {
+			t.Fatalf("got %q", got)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return resumed
+}
+
+func TestTLSResume(t *testing.T) {
+	for _, vers := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		v := tlsHandshakes(t, PoolConf{}, vers)
+		if len(v) != 3 || v[0] || !v[1] || !v[2] {
+			t.Errorf("version %x: resumed %v", vers, v)
+		}
+	}
+}
+
+func TestTLSResumeDisabled(t *testing.T) {
+	v := tlsHandshakes(t, PoolConf{TLSSessions: -1}, tls.VersionTLS13)
+	if len(v) != 3 || v[0] || v[1] || v[2] {
+		t.Errorf("resumed %v", v)
+	}
+}
+
+func TestParentFront(t *testing.T) {
+	for _, v := range [][2]string{
+		{"http://proxy.example.com:3128", "cdn.example.net"},
+		{"socks4://proxy.example.com:1080", ""},
+		{"https://proxy.example.com", ":443"},
+	} {
+		if _, err := newParent(v[0], v[1], newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+			t.Errorf("%s front %q: no error", v[0], v[1])
+		}
+	}
+
+	// An https parent behind a front that routes by Host
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	ln := tls.NewListener(tl, srv.TLS)
+
+	type seen struct{ sni, host, target string }
+	ch := make(chan seen, 1)
+	echo := startEcho(t)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		var s seen
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil || l == "\r\n" {
+				break
+			}
+			if f := strings.Fields(l); f[0] == "CONNECT" {
+				s.target = f[1]
+			} else if f[0] == "Host:" {
+				s.host = f[1]
+			}
+		}
+		s.sni = c.(*tls.Conn).ConnectionState().ServerName
+		ch <- s
+		e, err := net.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			return
+		}
+		defer e.Close()
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+		go io.Copy(e, br)
+		io.Copy(c, e)
+	}()
+
+	_, port, _ := net.SplitHostPort(tl.Addr().String())
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{
+		Listen:      "front",
+		Parent:      "https://proxy.internal:8443",
+		ParentFront: "localhost:" + port,
+		Rules:       []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.parent.Close()
+	d.parent.tls.InsecureSkipVerify = true
+	if tr := newTransport(d); tr.Proxy != nil {
+		t.Errorf("fronted parent: plain HTTP is forwarded")
+	}
+
+	c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if s := <-ch; s.sni != "localhost" || s.host != "proxy.internal:8443" || s.target != echo.Addr().String() {
+		t.Errorf("parent saw %+v", s)
+	}
+	io.WriteString(c, "hello\n")
+	if l, _ := bufio.NewReader(c).ReadString('\n'); l != "hello\n" {
+		t.Errorf("tunnel: %q", l)
+	}
+	if _, ok := c.(tcpConn); !ok {
+		t.Errorf("tunnel is a %T", c)
+	}
+}
+
+// A parent over TLS with the certificate in 'fn'; it answers each
+// CONNECT with a 200 and then echoes
+func startTLSParent(t *testing.T, fn string) string {
+	cert, err := tls.LoadX509KeyPair(fn, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					l, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == "\r\n" {
+						break
+					}
+				}
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+				io.Copy(c, br)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestParentPins(t *testing.T) {
+	ca := newTestCA(t)
+	_, fn := ca.issue(t, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	leaf, _ := tls.LoadX509KeyPair(fn, fn)
+	lc, _ := x509.ParseCertificate(leaf.Certificate[0])
+	addr := startTLSParent(t, fn)
+
+	spki := func(c *x509.Certificate) string {
+		h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		return "sha256//" + base64.StdEncoding.EncodeToString(h[:])
+	}
+	fp := sha256.Sum256(lc.Raw)
+	var hexfp []string
+	for _, b := range fp {
+		hexfp = append(hexfp, fmt.Sprintf("%02X", b))
+	}
+	other := sha256.Sum256([]byte("other"))
+
+	for _, tt := range []struct {
+		query string
+		roots bool // the test CA is trusted
+		ok    bool
+	}{
+		{"pin=" + spki(lc), false, true},
+		{"certpin=" + strings.Join(hexfp, ":"), false, true},
+		{"pin=" + spki(ca.cert), true, true},
+		{"pin=" + spki(ca.cert), false, false},
+		{"pin=" + base64.StdEncoding.EncodeToString(other[:]), true, false},
+	} {
+		p, err := newParent("https://"+addr+"?"+tt.query, "", newPoolPolicy(&PoolConf{}), &net.Dialer{})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.query, err)
+		}
+		if tt.roots {
+			p.pins.roots = ca.pool
+		}
+		c, err := p.connect(context.Background(), "example.com:80")
+		if err == nil {
+			io.WriteString(c, "hi")
+			b := make([]byte, 2)
+			if _, err = io.ReadFull(c, b); err == nil && string(b) != "hi" {
+				err = fmt.Errorf("echo %q", b)
+			}
+			c.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s (roots %v): %v", tt.query, tt.roots, err)
+		}
+		p.Close()
+	}
+
+	for _, s := range []string{
+		"http://proxy.example.com:3128?pin=" + spki(lc),
+		"vless://" + testUUID + "@example.com:443?pin=" + spki(lc),
+		"https://proxy.example.com?pin=sha256/short",
+		"https://proxy.example.com?certpin=ab:cd",
+	} {
+		if _, err := newParent(s, "", newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
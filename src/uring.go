@@ -0,0 +1,427 @@
+// uring.go -- minimal io_uring on raw system calls
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// +build linux,iouring
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// io_uring system calls; the numbers are the same on all architectures
+const (
+	_SYS_IO_URING_SETUP = 425
+	_SYS_IO_URING_ENTER = 426
+)
+
+// mmap offsets of the rings
+const (
+	_IORING_OFF_SQ_RING = 0
+	_IORING_OFF_CQ_RING = 0x8000000
+	_IORING_OFF_SQES    = 0x10000000
+)
+
+const (
+	_IORING_SETUP_CQSIZE   = 1 << 3
+	_IORING_FEAT_NODROP    = 1 << 1
+	_IORING_FEAT_FAST_POLL = 1 << 5
+	_IOSQE_IO_LINK         = 1 << 2
+
+	_IORING_OP_POLL_ADD     = 6
+	_IORING_OP_ASYNC_CANCEL = 14
+	_IORING_OP_LINK_TIMEOUT = 15
+	_IORING_OP_SEND         = 26
+	_IORING_OP_RECV         = 27
+
+	_POLLIN       = 0x1
+	_POLLOUT      = 0x4
+	_MSG_NOSIGNAL = 0x4000
+)
+
+// Submission and completion queue sizes. Submissions are flushed to the
+// kernel right away, so the SQ needn't be large; the CQ has room for a
+// burst of completions (the kernel keeps any overflow).
+const (
+	URING_ENTRIES    = 256
+	URING_CQ_ENTRIES = 16384
+)
+
+var errRingWoken = errors.New("io_uring wait interrupted")
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	flags, dropped, array, resv1      uint32
+	userAddr                          uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	overflow, cqes, flags, resv1      uint32
+	userAddr                          uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags uint32
+	sqThreadCPU, sqThreadIdle   uint32
+	features, wqFd              uint32
+	resv                        [3]uint32
+	sqOff                       sqringOffsets
+	cqOff                       cqringOffsets
+}
+
+// struct io_uring_sqe
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// struct io_uring_cqe
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// struct __kernel_timespec
+type kernelTimespec struct {
+	sec  int64
+	nsec int64
+}
+
+// An io_uring shared by all tunnels. Any goroutine can submit; a
+// goroutine waiting on the ring fd in the netpoller reaps completions and
+// hands each to the goroutine waiting for it.
+type ioRing struct {
+	fd int
+
+	// the ring fd on the netpoller: it is readable when there are
+	// completions
+	file *os.File
+
+	// submission queue; guarded by the mutex
+	sync.Mutex
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqSize  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	// completion queue; guarded by its mutex
+	cq     sync.Mutex
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+
+	// ops waiting for their completion, by user_data
+	pend struct {
+		sync.Mutex
+		id uint64
+		m  map[uint64]chan int32
+	}
+}
+
+// The process wide ring; set up on first use
+var ring struct {
+	sync.Once
+	r   *ioRing
+	err error
+}
+
+func getRing() (*ioRing, error) {
+	ring.Do(func() {
+		ring.r, ring.err = newRing()
+	})
+	return ring.r, ring.err
+}
+
+func newRing() (*ioRing, error) {
+	p := uringParams{
+		flags:     _IORING_SETUP_CQSIZE,
+		cqEntries: URING_CQ_ENTRIES,
+	}
+
+	fd, _, e := syscall.Syscall(_SYS_IO_URING_SETUP, URING_ENTRIES, uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", e)
+	}
+
+	r := &ioRing{fd: int(fd)}
+	if err := r.mmap(&p); err != nil {
+		syscall.Close(r.fd)
+		return nil, err
+	}
+
+	// NODROP: completions are never lost; FAST_POLL (5.7) also means
+	// SEND and RECV are there.
+	want := uint32(_IORING_FEAT_NODROP | _IORING_FEAT_FAST_POLL)
+	if p.features&want != want {
+		syscall.Close(r.fd)
+		return nil, errors.New("io_uring: kernel is too old (need 5.7+)")
+	}
+
+	if err := syscall.SetNonblock(r.fd, true); err != nil {
+		syscall.Close(r.fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	r.file = os.NewFile(uintptr(r.fd), "io_uring")
+	rc, err := r.file.SyscallConn()
+	if err != nil {
+		r.file.Close()
+		return nil, err
+	}
+
+	r.pend.m = make(map[uint64]chan int32)
+	go r.reap(rc)
+	return r, nil
+}
+
+// Map the rings and the SQE array
+func (r *ioRing) mmap(p *uringParams) error {
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	flags := syscall.MAP_SHARED | syscall.MAP_POPULATE
+
+	sq, err := syscall.Mmap(r.fd, _IORING_OFF_SQ_RING, int(p.sqOff.array+p.sqEntries*4), prot, flags)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	cq, err := syscall.Mmap(r.fd, _IORING_OFF_CQ_RING, int(p.cqOff.cqes+p.cqEntries*16), prot, flags)
+	if err != nil {
+		syscall.Munmap(sq)
+		return os.NewSyscallError("mmap", err)
+	}
+	sqes, err := syscall.Mmap(r.fd, _IORING_OFF_SQES, int(p.sqEntries*64), prot, flags)
+	if err != nil {
+		syscall.Munmap(sq)
+		syscall.Munmap(cq)
+		return os.NewSyscallError("mmap", err)
+	}
+
+	u32 := func(b []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&b[off]))
+	}
+
+	r.sqHead = u32(sq, p.sqOff.head)
+	r.sqTail = u32(sq, p.sqOff.tail)
+	r.sqMask = *u32(sq, p.sqOff.ringMask)
+	r.sqSize = p.sqEntries
+	r.sqArray = unsafe.Slice(u32(sq, p.sqOff.array), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&sqes[0])), p.sqEntries)
+
+	r.cqHead = u32(cq, p.cqOff.head)
+	r.cqTail = u32(cq, p.cqOff.tail)
+	r.cqMask = *u32(cq, p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&cq[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// Queue the SQEs in 'v' and submit them. Submission happens before this
+// returns - so a file descriptor in 'v' only has to be valid for as long
+// as this call.
+//
+// Ops that complete during submission (most RECVs and SENDs on ready
+// sockets) are delivered right here instead of waking the reaper.
+func (r *ioRing) submit(v ...uringSQE) error {
+	err := r.enqueue(v)
+	r.drain()
+	return err
+}
+
+func (r *ioRing) enqueue(v []uringSQE) error {
+	r.Lock()
+	defer r.Unlock()
+
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead)+uint32(len(v)) > r.sqSize {
+		return syscall.EBUSY
+	}
+
+	for i := range v {
+		j := (tail + uint32(i)) & r.sqMask
+		r.sqes[j] = v[i]
+		r.sqArray[j] = j
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(len(v)))
+
+	for n := len(v); n > 0; {
+		m, _, e := syscall.Syscall6(_SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(n), 0, 0, 0, 0)
+		switch e {
+		case 0:
+			n -= int(m)
+		case syscall.EINTR:
+		case syscall.EAGAIN, syscall.EBUSY:
+			// out of kernel resources or the CQ is backed up
+			time.Sleep(time.Millisecond)
+		default:
+			return os.NewSyscallError("io_uring_enter", e)
+		}
+	}
+	return nil
+}
+
+// Deliver completions that didn't happen during submission. The
+// netpoller tells us when the ring has some; no thread blocks in
+// io_uring_enter.
+func (r *ioRing) reap(rc syscall.RawConn) {
+	for {
+		rc.Read(func(_ uintptr) bool {
+			return r.drain() > 0
+		})
+	}
+}
+
+// Deliver the completions in the CQ to their waiters; return how many
+func (r *ioRing) drain() int {
+	r.cq.Lock()
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := &r.cqes[head&r.cqMask]
+		r.complete(cqe.userData, cqe.res)
+	}
+	n := int(head - *r.cqHead)
+	atomic.StoreUint32(r.cqHead, head)
+	r.cq.Unlock()
+	return n
+}
+
+// Return a new user_data whose completion goes to 'ch'; 'ch' must have
+// room for it.
+func (r *ioRing) expect(ch chan int32) uint64 {
+	r.pend.Lock()
+	r.pend.id++
+	id := r.pend.id
+	r.pend.m[id] = ch
+	r.pend.Unlock()
+	return id
+}
+
+func (r *ioRing) forget(id uint64) {
+	r.pend.Lock()
+	delete(r.pend.m, id)
+	r.pend.Unlock()
+}
+
+// Ops we don't wait for (link timeouts, cancels) have user_data 0
+func (r *ioRing) complete(id uint64, res int32) {
+	if id == 0 {
+		return
+	}
+
+	r.pend.Lock()
+	ch := r.pend.m[id]
+	delete(r.pend.m, id)
+	r.pend.Unlock()
+
+	if ch != nil {
+		ch <- res
+	}
+}
+
+// Wait until the socket 'rc' is ready for 'events'. Return
+// os.ErrDeadlineExceeded after 'tmo' and errRingWoken if 'wake' is
+// closed first. 'ch' receives the completion.
+func (r *ioRing) poll(ch chan int32, rc syscall.RawConn, events uint32, tmo time.Duration, wake <-chan struct{}) error {
+	// the kernel copies the timespec when the SQE is submitted
+	ts := &kernelTimespec{sec: int64(tmo / time.Second), nsec: int64(tmo % time.Second)}
+
+	id := r.expect(ch)
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = r.submit(
+			uringSQE{opcode: _IORING_OP_POLL_ADD, flags: _IOSQE_IO_LINK, fd: int32(fd), opFlags: events, userData: id},
+			uringSQE{opcode: _IORING_OP_LINK_TIMEOUT, fd: -1, addr: uint64(uintptr(unsafe.Pointer(ts))), len: 1},
+		)
+	})
+	runtime.KeepAlive(ts)
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		r.forget(id)
+		return err
+	}
+
+	var res int32
+	woken := false
+	select {
+	case res = <-ch:
+	case <-wake:
+		// If the cancel can't be submitted, the link timeout still
+		// ends the poll.
+		woken = true
+		r.submit(uringSQE{opcode: _IORING_OP_ASYNC_CANCEL, fd: -1, addr: id})
+		res = <-ch
+	}
+
+	switch {
+	case res >= 0:
+		return nil
+	case res == -int32(syscall.ECANCELED) && woken:
+		return errRingWoken
+	case res == -int32(syscall.ECANCELED):
+		return os.ErrDeadlineExceeded
+	}
+	return syscall.Errno(-res)
+}
+
+// Do a RECV or SEND ('op') with 'b' on the socket 'rc' and wait for it.
+// The sockets are non-blocking: these complete right away, with EAGAIN
+// if the socket isn't ready.
+func (r *ioRing) io(ch chan int32, rc syscall.RawConn, op uint8, b []byte, flags uint32) (int, error) {
+	id := r.expect(ch)
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = r.submit(uringSQE{
+			opcode:   op,
+			fd:       int32(fd),
+			addr:     uint64(uintptr(unsafe.Pointer(&b[0]))),
+			len:      uint32(len(b)),
+			opFlags:  flags,
+			userData: id,
+		})
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		r.forget(id)
+		return 0, err
+	}
+
+	// 'b' must stay live while the kernel uses it
+	res := <-ch
+	runtime.KeepAlive(b)
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -28,6 +28,12 @@ func isReset(err error) bool {
 	return false
 }
 
+// Return true if err is an I/O timeout
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
 // Format a time duration
 func format(t time.Duration) string {
 	u0 := t.Nanoseconds() / 1000
@@ -49,8 +55,13 @@ func AclOK(cfg *ListenConf, conn net.Conn) bool {
 		return false
 	}
 
+	return AclIP(cfg, h.IP)
+}
+
+// Return true if the host 'ip' passes the ACL checks
+func AclIP(cfg *ListenConf, ip net.IP) bool {
 	for _, n := range cfg.Deny {
-		if n.Contains(h.IP) {
+		if n.Contains(ip) {
 			return false
 		}
 	}
@@ -60,7 +71,7 @@ func AclOK(cfg *ListenConf, conn net.Conn) bool {
 	}
 
 	for _, n := range cfg.Allow {
-		if n.Contains(h.IP) {
+		if n.Contains(ip) {
 			return true
 		}
 	}
@@ -0,0 +1,410 @@
+// v2ray.go -- VLESS and VMess parents
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A parent can be a V2Ray (or Xray) server speaking VLESS or VMess
+// instead of an HTTP proxy: vless://uuid@host:port or
+// vmess://uuid@host:port, with ?security=tls (and &sni=name) if the
+// server's inbound is behind TLS. Only TCP tunnels are opened; the
+// VMess is the AEAD one (alterId 0) with AES-128-GCM chunks.
+
+const (
+	// most bytes of payload in a VMess chunk
+	VMESS_CHUNK = 8192
+
+	// the salt of a VMess user's command key
+	vmessSalt = "c48619fe-8f02-49e0-b9e9-edf763e17e21"
+)
+
+var errV2rayEOF = errors.New("vmess: connection closed mid-chunk")
+
+// Return the 16 bytes of the UUID 's', with or without dashes
+func parseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	h := strings.ReplaceAll(s, "-", "")
+	if len(h) != 32 {
+		return id, fmt.Errorf("bad uuid '%s'", s)
+	}
+	if _, err := hex.Decode(id[:], []byte(h)); err != nil {
+		return id, fmt.Errorf("bad uuid '%s'", s)
+	}
+	return id, nil
+}
+
+// Append the port and address of 'addr' as VLESS and VMess have them
+func v2rayAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	pn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in '%s'", addr)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(pn))
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		b = append(append(b, 1), ip.To4()...)
+	case ip != nil:
+		b = append(append(b, 3), ip...)
+	case len(host) > 0 && len(host) < 256:
+		b = append(append(b, 2, byte(len(host))), host...)
+	default:
+		return nil, fmt.Errorf("bad host in '%s'", addr)
+	}
+	return b, nil
+}
+
+// Open a tunnel to 'addr' on the connection 'c' to a V2Ray or Trojan
+// parent; return 'c' itself if it fails
+func (p *parent) v2ray(c net.Conn, addr string) (net.Conn, error) {
+	tc, ok := c.(tcpConn)
+	if !ok {
+		return c, fmt.Errorf("%s: not a stream", p.proto)
+	}
+	c.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	var v net.Conn
+	var err error
+	switch p.proto {
+	case "vless":
+		v, err = vlessClient(tc, p.id, addr)
+	case "vmess":
+		v, err = vmessClient(tc, p.id, addr)
+	default:
+		v, err = trojanClient(tc, p.trojan, addr)
+	}
+	if err != nil {
+		return c, fmt.Errorf("parent %s: %s", p.addr, err)
+	}
+	return v, nil
+}
+
+// A VLESS tunnel: the request header goes out at once, the response
+// header comes in front of the first bytes from the server.
+type vlessConn struct {
+	tcpConn
+
+	mu   sync.Mutex
+	seen bool
+}
+
+func vlessClient(c tcpConn, id [16]byte, addr string) (net.Conn, error) {
+	// version, uuid, no addons, TCP
+	hdr := append(append([]byte{0}, id[:]...), 0, 1)
+	hdr, err := v2rayAddr(hdr, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &vlessConn{tcpConn: c}, nil
+}
+
+func (c *vlessConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.seen {
+		var h [2]byte
+		if _, err := io.ReadFull(c.tcpConn, h[:]); err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		if h[0] != 0 {
+			c.mu.Unlock()
+			return 0, fmt.Errorf("vless: response version %d", h[0])
+		}
+		if _, err := io.CopyN(io.Discard, c.tcpConn, int64(h[1])); err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.seen = true
+	}
+	c.mu.Unlock()
+	return c.tcpConn.Read(b)
+}
+
+// The response header is read by Read; the kernel can't skip it
+func (c *vlessConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoRawConn
+}
+
+// The VMess AEAD KDF: HMAC-SHA256 nested once for each element of
+// 'path', keyed by "VMess AEAD KDF" at the root
+func vmessKDF(key []byte, path ...string) []byte {
+	h := func() hash.Hash { return hmac.New(sha256.New, []byte("VMess AEAD KDF")) }
+	for _, p := range path {
+		prev, k := h, []byte(p)
+		h = func() hash.Hash { return hmac.New(prev, k) }
+	}
+	m := h()
+	m.Write(key)
+	return m.Sum(nil)
+}
+
+// Return AES-128-GCM keyed by the first 16 bytes of 'key'
+func vmessGCM(key []byte) cipher.AEAD {
+	b, _ := aes.NewCipher(key[:16])
+	g, _ := cipher.NewGCM(b)
+	return g
+}
+
+// Return the command key of the VMess user 'id'
+func vmessCmdKey(id [16]byte) []byte {
+	k := md5.Sum(append(id[:], vmessSalt...))
+	return k[:]
+}
+
+// Return the sealed request header 'hdr' of the user with 'cmdKey'
+func vmessSeal(cmdKey, hdr []byte, now time.Time) ([]byte, error) {
+	var auth [16]byte
+	binary.BigEndian.PutUint64(auth[:], uint64(now.Unix()))
+	if _, err := rand.Read(auth[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(auth[12:], crc32.ChecksumIEEE(auth[:12]))
+	b, _ := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	b.Encrypt(auth[:], auth[:])
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	a, n := string(auth[:]), string(nonce)
+	lk := vmessKDF(cmdKey, "VMess Header AEAD Key_Length", a, n)
+	ln := vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", a, n)[:12]
+	hk := vmessKDF(cmdKey, "VMess Header AEAD Key", a, n)
+	hn := vmessKDF(cmdKey, "VMess Header AEAD Nonce", a, n)[:12]
+
+	out := append([]byte(nil), auth[:]...)
+	out = vmessGCM(lk).Seal(out, ln, binary.BigEndian.AppendUint16(nil, uint16(len(hdr))), auth[:])
+	out = append(out, nonce...)
+	return vmessGCM(hk).Seal(out, hn, hdr, auth[:]), nil
+}
+
+// A VMess tunnel. Each direction is a stream of chunks: a two byte
+// length and the payload sealed with AES-128-GCM; an empty chunk ends
+// it. The response header comes in front of the first chunk.
+type vmessConn struct {
+	tcpConn
+
+	wmu   sync.Mutex
+	enc   cipher.AEAD
+	wiv   [16]byte
+	wn    uint16
+	wdone bool
+
+	rmu   sync.Mutex
+	dec   cipher.AEAD
+	riv   [16]byte
+	rn    uint16
+	rkey  []byte
+	rauth byte
+	seen  bool
+	eof   bool
+	buf   []byte
+}
+
+func vmessClient(c tcpConn, id [16]byte, addr string) (net.Conn, error) {
+	var r [33]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return nil, err
+	}
+	// body key, body iv, response auth
+	key, iv := r[:16], r[16:32]
+	v := &vmessConn{tcpConn: c, enc: vmessGCM(key), rauth: r[32]}
+	copy(v.wiv[:], iv)
+	rk, ri := sha256.Sum256(key), sha256.Sum256(iv)
+	v.rkey = rk[:16]
+	copy(v.riv[:], ri[:16])
+	v.dec = vmessGCM(v.rkey)
+
+	var pad [1]byte
+	rand.Read(pad[:])
+	plen := int(pad[0] & 0xf)
+
+	// version, body iv and key, response auth, chunk stream,
+	// padding and AES-128-GCM, TCP
+	hdr := append([]byte{1}, iv...)
+	hdr = append(hdr, key...)
+	hdr = append(hdr, r[32], 0x01, byte(plen<<4)|3, 0, 1)
+	hdr, err := v2rayAddr(hdr, addr)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, plen)
+	rand.Read(p)
+	hdr = append(hdr, p...)
+	f := fnv.New32a()
+	f.Write(hdr)
+	hdr = f.Sum(hdr)
+
+	out, err := vmessSeal(vmessCmdKey(id), hdr, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(out); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Return the nonce of chunk 'n' of a direction with 'iv'
+func vmessNonce(iv [16]byte, n uint16) []byte {
+	binary.BigEndian.PutUint16(iv[:], n)
+	return iv[:12]
+}
+
+func (c *vmessConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wdone {
+		return 0, net.ErrClosed
+	}
+
+	var out []byte
+	for p := b; len(p) > 0; {
+		n := min(len(p), VMESS_CHUNK)
+		out = c.seal(out, p[:n])
+		p = p[n:]
+	}
+	if _, err := c.tcpConn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Append the chunk of 'p' to 'out'
+func (c *vmessConn) seal(out, p []byte) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(p)+c.enc.Overhead()))
+	out = c.enc.Seal(out, vmessNonce(c.wiv, c.wn), p, nil)
+	c.wn++
+	return out
+}
+
+// End our direction with an empty chunk
+func (c *vmessConn) CloseWrite() error {
+	c.wmu.Lock()
+	if !c.wdone {
+		c.wdone = true
+		c.tcpConn.Write(c.seal(nil, nil))
+	}
+	c.wmu.Unlock()
+	return c.tcpConn.CloseWrite()
+}
+
+// Read the response header
+func (c *vmessConn) header() error {
+	lk := vmessKDF(c.rkey, "AEAD Resp Header Len Key")
+	ln := vmessKDF(c.riv[:], "AEAD Resp Header Len IV")[:12]
+	b := make([]byte, 18)
+	if _, err := io.ReadFull(c.tcpConn, b); err != nil {
+		return err
+	}
+	l, err := vmessGCM(lk).Open(nil, ln, b, nil)
+	if err != nil || len(l) != 2 {
+		return fmt.Errorf("vmess: bad response header")
+	}
+
+	hk := vmessKDF(c.rkey, "AEAD Resp Header Key")
+	hn := vmessKDF(c.riv[:], "AEAD Resp Header IV")[:12]
+	b = make([]byte, int(binary.BigEndian.Uint16(l))+16)
+	if _, err := io.ReadFull(c.tcpConn, b); err != nil {
+		return err
+	}
+	h, err := vmessGCM(hk).Open(nil, hn, b, nil)
+	if err != nil || len(h) < 4 || h[0] != c.rauth {
+		return fmt.Errorf("vmess: bad response header")
+	}
+	return nil
+}
+
+// Read and open the next chunk
+func (c *vmessConn) chunk() error {
+	var l [2]byte
+	if _, err := io.ReadFull(c.tcpConn, l[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n < c.dec.Overhead() {
+		return fmt.Errorf("vmess: bad chunk length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.tcpConn, b); err != nil {
+		if err == io.EOF {
+			err = errV2rayEOF
+		}
+		return err
+	}
+	p, err := c.dec.Open(b[:0], vmessNonce(c.riv, c.rn), b, nil)
+	if err != nil {
+		return fmt.Errorf("vmess: bad chunk")
+	}
+	c.rn++
+	if len(p) == 0 {
+		c.eof = true
+	}
+	c.buf = p
+	return nil
+}
+
+func (c *vmessConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if !c.seen {
+		if err := c.header(); err != nil {
+			return 0, err
+		}
+		c.seen = true
+	}
+	for len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.chunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *vmessConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoRawConn
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,269 @@
+// v2ray_test.go -- tests for VLESS and VMess parents
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// Read the port and address of a VLESS or VMess request
+func readV2rayAddr(t *testing.T, r io.Reader) string {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Error(err)
+		return ""
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b)))
+	var host []byte
+	switch b[2] {
+	case 1:
+		host = make([]byte, 4)
+	case 3:
+		host = make([]byte, 16)
+	case 2:
+		var n [1]byte
+		io.ReadFull(r, n[:])
+		host = make([]byte, n[0])
+	}
+	io.ReadFull(r, host)
+	if b[2] == 2 {
+		return net.JoinHostPort(string(host), port)
+	}
+	return net.JoinHostPort(net.IP(host).String(), port)
+}
+
+// Relay 'c' and a connection to 'addr' until both are done
+func relayTo(c net.Conn, addr string) {
+	d, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	go func() {
+		io.Copy(d, c)
+		d.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(c, d)
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// Return the first 16 bytes of the SHA-256 of 'b'
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:16]
+}
+
+// A VLESS server for the user 'id'
+func serveVLESS(t *testing.T, ln net.Listener, id [16]byte) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			// spares the parent closes unused send nothing
+			b := make([]byte, 1+16+1)
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			if b[0] != 0 || !bytes.Equal(b[1:17], id[:]) {
+				t.Errorf("vless: request %x", b)
+				return
+			}
+			io.CopyN(io.Discard, c, int64(b[17]))
+			var cmd [1]byte
+			io.ReadFull(c, cmd[:])
+			addr := readV2rayAddr(t, c)
+			c.Write([]byte{0, 0})
+			relayTo(c, addr)
+		}()
+	}
+}
+
+// A VMess (AEAD) server for the user 'id'
+func serveVMess(t *testing.T, ln net.Listener, id [16]byte) {
+	cmdKey := vmessCmdKey(id)
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer nc.Close()
+			b := make([]byte, 16+18+8)
+			if _, err := io.ReadFull(nc, b); err != nil {
+				return
+			}
+			auth, elen, nonce := b[:16], b[16:34], b[34:]
+			var plain [16]byte
+			blk, _ := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+			blk.Decrypt(plain[:], auth)
+			ts := int64(binary.BigEndian.Uint64(plain[:]))
+			if crc32.ChecksumIEEE(plain[:12]) != binary.BigEndian.Uint32(plain[12:]) || time.Now().Unix()-ts > 120 {
+				t.Errorf("vmess: bad auth id %x", plain)
+				return
+			}
+
+			a, n := string(auth), string(nonce)
+			l, err := vmessGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", a, n)).Open(nil,
+				vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", a, n)[:12], elen, auth)
+			if err != nil {
+				t.Errorf("vmess: header length: %s", err)
+				return
+			}
+			eh := make([]byte, int(binary.BigEndian.Uint16(l))+16)
+			io.ReadFull(nc, eh)
+			h, err := vmessGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", a, n)).Open(nil,
+				vmessKDF(cmdKey, "VMess Header AEAD Nonce", a, n)[:12], eh, auth)
+			if err != nil {
+				t.Errorf("vmess: header: %s", err)
+				return
+			}
+			f := fnv.New32a()
+			f.Write(h[:len(h)-4])
+			if !bytes.Equal(f.Sum(nil), h[len(h)-4:]) || h[0] != 1 || h[35]&0xf != 3 || h[37] != 1 {
+				t.Errorf("vmess: header %x", h)
+				return
+			}
+			iv, key, rauth := h[1:17], h[17:33], h[33]
+			addr := readV2rayAddr(t, bytes.NewReader(h[38:]))
+
+			// the server's side of the chunk streams
+			c := &vmessConn{tcpConn: nc.(*net.TCPConn), dec: vmessGCM(key), seen: true}
+			copy(c.riv[:], iv)
+			rk, ri := sha256Sum(key), sha256Sum(iv)
+			c.enc = vmessGCM(rk)
+			copy(c.wiv[:], ri)
+
+			rh := []byte{rauth, 0, 0, 0}
+			out := vmessGCM(vmessKDF(rk, "AEAD Resp Header Len Key")).Seal(nil,
+				vmessKDF(ri, "AEAD Resp Header Len IV")[:12], []byte{0, byte(len(rh))}, nil)
+			out = vmessGCM(vmessKDF(rk, "AEAD Resp Header Key")).Seal(out,
+				vmessKDF(ri, "AEAD Resp Header IV")[:12], rh, nil)
+			nc.Write(out)
+			relayTo(c, addr)
+		}()
+	}
+}
+
+func TestV2rayParent(t *testing.T) {
+	for _, s := range []string{
+		"vless://" + testUUID + "@example.com",
+		"vless://not-a-uuid@example.com:443",
+		"vmess://" + testUUID + "@example.com:443?security=reality",
+	} {
+		if _, err := newParent(s, "", newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+	if _, err := newParent("vless://"+testUUID+"@example.com:443", "cdn.example.net",
+		newPoolPolicy(&PoolConf{}), &net.Dialer{}); err == nil {
+		t.Errorf("front: no error")
+	}
+
+	id, _ := parseUUID(testUUID)
+	if u, err := parseUUID("b831381d63244d53ad4f8cda48b30811"); err != nil || u != id {
+		t.Errorf("uuid without dashes: %x %v", u, err)
+	}
+	if b, _ := v2rayAddr(nil, "[::1]:80"); !bytes.Equal(b, append([]byte{0, 80, 3}, net.IPv6loopback...)) {
+		t.Errorf("ipv6: %x", b)
+	}
+	if b, _ := v2rayAddr(nil, "a.io:443"); string(b) != "\x01\xbb\x02\x04a.io" {
+		t.Errorf("domain: %x", b)
+	}
+}
+
+func TestV2ray(t *testing.T) {
+	id, _ := parseUUID(testUUID)
+	echo := startEcho(t)
+
+	// a VLESS inbound behind TLS
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	go serveVLESS(t, tls.NewListener(tl, srv.TLS), id)
+
+	vl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vl.Close()
+	go serveVMess(t, vl, id)
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	for _, parent := range []string{
+		"vless://" + testUUID + "@" + tl.Addr().String() + "?security=tls&sni=example.com",
+		"vmess://" + testUUID + "@" + vl.Addr().String(),
+	} {
+		d, err := newDialer(&ListenConf{
+			Listen: "v2ray",
+			Parent: parent,
+			Rules:  []RuleConf{{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"}},
+		}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.parent.tls != nil {
+			d.parent.tls.InsecureSkipVerify = true
+		}
+		if tr := newTransport(d); tr.Proxy != nil {
+			t.Errorf("%s: plain HTTP is forwarded", parent)
+		}
+
+		c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %s", parent, err)
+		}
+
+		// more than a chunk
+		msg := bytes.Repeat([]byte("0123456789abcdef"), VMESS_CHUNK/8)
+		go c.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: echo %d bytes: %v", parent, len(got), err)
+		}
+
+		// the half-close reaches the origin and comes back
+		c.(tcpConn).CloseWrite()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(got); n != 0 || err != io.EOF {
+			t.Errorf("%s: after close: %d %v", parent, n, err)
+		}
+		c.Close()
+		d.parent.Close()
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
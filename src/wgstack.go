@@ -0,0 +1,991 @@
+// wgstack.go -- a small TCP/IP stack for WireGuard egress
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The packets in a WireGuard tunnel are IP; tunnels to destinations
+// need a TCP of our own on the tunnel's addresses. This one is small:
+// no window scaling, SACK or congestion control beyond a fixed window,
+// out of order segments are dropped (and fetched again by the dup ACKs
+// they cause) and every segment is ACKed at once. It is enough for the
+// point to point tunnel of an egress, and for the CONNECT-IP sessions
+// that end the TCP of clients here (connectip.go).
+
+const (
+	// bytes a connection buffers in each direction
+	WG_TCP_RCVBUF = 65535
+	WG_TCP_SNDBUF = 256 << 10
+
+	// retransmissions before a connection is given up
+	WG_TCP_RETRIES = 8
+
+	// how long closed connections linger for the peer's last segments
+	WG_TCP_LINGER = 2 * time.Second
+
+	// a half-closed connection the peer doesn't finish
+	WG_TCP_FINWAIT = 60 * time.Second
+)
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// TCP states
+const (
+	tcpSynSent = iota
+	tcpSynRcvd
+	tcpEstablished
+	tcpFinWait1
+	tcpFinWait2
+	tcpClosing
+	tcpTimeWait
+	tcpCloseWait
+	tcpLastAck
+	tcpClosed
+)
+
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+func seqLE(a, b uint32) bool { return int32(a-b) <= 0 }
+
+// A connection on the stack
+type wgFlow struct {
+	lport uint16
+	raddr netip.Addr
+	rport uint16
+	laddr netip.Addr
+}
+
+// The TCP/IP of a WireGuard device; 'out' sends a packet into the tunnel.
+// A stack with 'any' set takes connections to every address, as if it
+// were each destination; its port 0 listener gets those to every port.
+type wgStack struct {
+	out   func([]byte)
+	addrs []netip.Addr
+	mtu   int
+	any   bool
+	ipid  atomic.Uint32
+
+	mu    sync.Mutex
+	conns map[wgFlow]*wgConn
+	lns   map[uint16]*wgListener
+}
+
+func newWGStack(addrs []netip.Addr, mtu int, out func([]byte)) *wgStack {
+	return &wgStack{out: out, addrs: addrs, mtu: mtu,
+		conns: make(map[wgFlow]*wgConn), lns: make(map[uint16]*wgListener)}
+}
+
+// Return our address of the family of 'a'; invalid if there is none
+func (s *wgStack) local(a netip.Addr) netip.Addr {
+	for _, l := range s.addrs {
+		if l.Is4() == a.Is4() {
+			return l
+		}
+	}
+	return netip.Addr{}
+}
+
+// The checksum of the TCP segment 'seg' from 'src' to 'dst'
+func tcpChecksum(src, dst netip.Addr, seg []byte) uint16 {
+	return ipChecksum(src, dst, 6, seg)
+}
+
+// Send a segment of the flow 'f' from 'laddr'
+func (s *wgStack) send(laddr netip.Addr, f wgFlow, seq, ack uint32, flags byte, wnd uint16, mss int, data []byte) {
+	hl := 20
+	if mss > 0 {
+		hl += 4
+	}
+	seg := make([]byte, hl+len(data))
+	binary.BigEndian.PutUint16(seg[0:], f.lport)
+	binary.BigEndian.PutUint16(seg[2:], f.rport)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = byte(hl/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], wnd)
+	if mss > 0 {
+		seg[20], seg[21] = 2, 4
+		binary.BigEndian.PutUint16(seg[22:], uint16(mss))
+	}
+	copy(seg[hl:], data)
+	binary.BigEndian.PutUint16(seg[16:], tcpChecksum(laddr, f.raddr, seg))
+
+	var ip []byte
+	if laddr.Is4() {
+		ip = make([]byte, 20, 20+len(seg))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(seg)))
+		binary.BigEndian.PutUint16(ip[4:], uint16(s.ipid.Add(1)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8], ip[9] = 64, 6
+		a, b := laddr.As4(), f.raddr.As4()
+		copy(ip[12:], a[:])
+		copy(ip[16:], b[:])
+		binary.BigEndian.PutUint16(ip[10:], ^fold(csum(0, ip)))
+	} else {
+		ip = make([]byte, 40, 40+len(seg))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(seg)))
+		ip[6], ip[7] = 6, 64
+		a, b := laddr.As16(), f.raddr.As16()
+		copy(ip[8:], a[:])
+		copy(ip[24:], b[:])
+	}
+	s.out(append(ip, seg...))
+}
+
+// Take a packet from the tunnel
+func (s *wgStack) input(pkt []byte) {
+	var src, dst netip.Addr
+	var seg []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		hl, n := int(pkt[0]&0xf)*4, int(binary.BigEndian.Uint16(pkt[2:]))
+		if pkt[9] != 6 || hl < 20 || n < hl || n > len(pkt) || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return
+		}
+		src, dst = netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+		seg = pkt[hl:n]
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		n := 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if pkt[6] != 6 || n > len(pkt) {
+			return
+		}
+		src, dst = netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+		seg = pkt[40:n]
+	default:
+		return
+	}
+	if len(seg) < 20 || (!s.any && s.local(dst) != dst) || tcpChecksum(src, dst, seg) != 0 {
+		return
+	}
+
+	hl := int(seg[12]>>4) * 4
+	if hl < 20 || hl > len(seg) {
+		return
+	}
+	h := tcpSeg{
+		seq:   binary.BigEndian.Uint32(seg[4:]),
+		ack:   binary.BigEndian.Uint32(seg[8:]),
+		flags: seg[13],
+		wnd:   uint32(binary.BigEndian.Uint16(seg[14:])),
+		mss:   tcpMSS(seg[20:hl]),
+		data:  seg[hl:],
+	}
+	f := wgFlow{binary.BigEndian.Uint16(seg[2:]), src, binary.BigEndian.Uint16(seg[0:]), dst}
+
+	s.mu.Lock()
+	c := s.conns[f]
+	ln := s.lns[f.lport]
+	if ln == nil && s.any {
+		ln = s.lns[0]
+	}
+	s.mu.Unlock()
+
+	switch {
+	case c != nil:
+		c.input(&h)
+	case ln != nil && h.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN:
+		ln.syn(dst, f, &h)
+	case h.flags&tcpRST == 0:
+		s.reset(dst, f, &h)
+	}
+}
+
+// Refuse the segment 'h' of a flow we don't have
+func (s *wgStack) reset(laddr netip.Addr, f wgFlow, h *tcpSeg) {
+	if h.flags&tcpACK != 0 {
+		s.send(laddr, f, h.ack, 0, tcpRST, 0, 0, nil)
+		return
+	}
+	n := uint32(len(h.data))
+	if h.flags&tcpSYN != 0 {
+		n++
+	}
+	if h.flags&tcpFIN != 0 {
+		n++
+	}
+	s.send(laddr, f, 0, h.seq+n, tcpRST|tcpACK, 0, 0, nil)
+}
+
+func (s *wgStack) remove(c *wgConn) {
+	s.mu.Lock()
+	if s.conns[c.flow] == c {
+		delete(s.conns, c.flow)
+	}
+	s.mu.Unlock()
+}
+
+// Drop all connections
+func (s *wgStack) close() {
+	s.mu.Lock()
+	v := make([]*wgConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		v = append(v, c)
+	}
+	s.mu.Unlock()
+	for _, c := range v {
+		c.abort(net.ErrClosed, false)
+	}
+}
+
+// The MSS of the options 'o'; 0 if there is none
+func tcpMSS(o []byte) int {
+	for len(o) > 0 {
+		switch o[0] {
+		case 0:
+			return 0
+		case 1:
+			o = o[1:]
+			continue
+		}
+		if len(o) < 2 || int(o[1]) < 2 || int(o[1]) > len(o) {
+			return 0
+		}
+		if o[0] == 2 && o[1] == 4 {
+			return int(binary.BigEndian.Uint16(o[2:]))
+		}
+		o = o[o[1]:]
+	}
+	return 0
+}
+
+// A received segment
+type tcpSeg struct {
+	seq, ack uint32
+	flags    byte
+	wnd      uint32
+	mss      int
+	data     []byte
+}
+
+// Make a connection of the flow 'f' from 'laddr' and register it; nil
+// if the flow is taken
+func (s *wgStack) newConn(laddr netip.Addr, f wgFlow) *wgConn {
+	c := &wgConn{s: s, laddr: laddr, flow: f, rto: time.Second, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	c.mss = s.mtu - 40
+	if !laddr.Is4() {
+		c.mss = s.mtu - 60
+	}
+	c.iss = rand.Uint32()
+	c.sndUna, c.sndNxt = c.iss, c.iss+1
+	c.sndMax, c.recover = c.sndNxt, c.sndNxt
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[f]; ok {
+		return nil
+	}
+	s.conns[f] = c
+	return c
+}
+
+// Open a connection to 'raddr':'rport'
+func (s *wgStack) dial(ctx context.Context, raddr netip.Addr, rport int) (*wgConn, error) {
+	laddr := s.local(raddr)
+	if !laddr.IsValid() {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EAFNOSUPPORT}
+	}
+
+	var c *wgConn
+	for c == nil {
+		f := wgFlow{uint16(32768 + rand.Intn(28232)), raddr, uint16(rport), laddr}
+		c = s.newConn(laddr, f)
+	}
+
+	c.mu.Lock()
+	c.state = tcpSynSent
+	c.sendSyn()
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.abort(ctx.Err(), true)
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: c.RemoteAddr(), Err: err}
+	}
+	return c, nil
+}
+
+// A listening port of the stack
+type wgListener struct {
+	s    *wgStack
+	port uint16
+	ch   chan *wgConn
+	once sync.Once
+	done chan struct{}
+}
+
+// Listen on 'port' of the stack's addresses
+func (s *wgStack) listen(port uint16) *wgListener {
+	ln := &wgListener{s: s, port: port, ch: make(chan *wgConn, 16), done: make(chan struct{})}
+	s.mu.Lock()
+	s.lns[port] = ln
+	s.mu.Unlock()
+	return ln
+}
+
+func (ln *wgListener) syn(laddr netip.Addr, f wgFlow, h *tcpSeg) {
+	c := ln.s.newConn(laddr, f)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.ln = ln
+	c.state = tcpSynRcvd
+	c.rcvNxt = h.seq + 1
+	c.sndWnd = h.wnd
+	if h.mss > 0 {
+		c.mss = min(c.mss, h.mss)
+	}
+	c.sendSyn()
+	c.mu.Unlock()
+}
+
+func (ln *wgListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.ch:
+		return c, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *wgListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.done)
+		ln.s.mu.Lock()
+		delete(ln.s.lns, ln.port)
+		ln.s.mu.Unlock()
+	})
+	return nil
+}
+
+func (ln *wgListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: ln.s.addrs[0].AsSlice(), Port: int(ln.port)}
+}
+
+// A TCP connection on the stack; it is a tcpConn without raw access
+type wgConn struct {
+	s     *wgStack
+	laddr netip.Addr
+	flow  wgFlow
+	ln    *wgListener // of a passive open until it is accepted
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error
+	done  chan struct{} // closed when the handshake ends
+	shut  bool          // Close was called
+
+	iss, sndUna, sndNxt uint32
+	sndMax              uint32 // sndNxt before going back
+	recover             uint32 // sndMax when we last went back
+	sndWnd              uint32
+	out                 []byte // from sndUna: in flight, then unsent
+	finQueued, finSent  bool
+	finSeq              uint32 // of our FIN once it is queued
+	mss                 int
+
+	rcvNxt uint32
+	in     []byte
+	rcvFin bool
+
+	rto, srtt, rttvar time.Duration
+	rttOn             bool
+	rttSeq            uint32
+	rttAt             time.Time
+	timer             *time.Timer
+	retries           int
+	dupAcks           int
+
+	rdl, wdl time.Time
+	dlTimer  *time.Timer
+}
+
+// The window we advertise
+func (c *wgConn) window() uint16 {
+	return uint16(max(WG_TCP_RCVBUF-len(c.in), 0))
+}
+
+func (c *wgConn) seg(seq uint32, flags byte, data []byte) {
+	c.s.send(c.laddr, c.flow, seq, c.rcvNxt, flags, c.window(), 0, data)
+}
+
+func (c *wgConn) ack() {
+	c.seg(c.sndNxt, tcpACK, nil)
+}
+
+func (c *wgConn) sendSyn() {
+	flags, ack := byte(tcpSYN), uint32(0)
+	if c.state == tcpSynRcvd {
+		flags, ack = tcpSYN|tcpACK, c.rcvNxt
+	}
+	c.s.send(c.laddr, c.flow, c.iss, ack, flags, c.window(), c.mss, nil)
+	c.arm()
+}
+
+// Start the retransmission timer unless it runs
+func (c *wgConn) arm() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.expired)
+	}
+}
+
+func (c *wgConn) disarm() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *wgConn) rearm() {
+	c.disarm()
+	if c.sndNxt != c.sndUna || (len(c.out) > 0 && c.sndWnd == 0) {
+		c.arm()
+	}
+}
+
+// Finish the handshake with 'err' (nil if it worked)
+func (c *wgConn) handshakeDone(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+}
+
+// Drop the connection with 'err'; tell the peer if 'rst'
+func (c *wgConn) abort(err error, rst bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kill(err, rst)
+}
+
+func (c *wgConn) kill(err error, rst bool) {
+	if c.state == tcpClosed {
+		return
+	}
+	if rst && c.state != tcpSynSent {
+		c.seg(c.sndNxt, tcpRST|tcpACK, nil)
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = tcpClosed
+	c.disarm()
+	c.handshakeDone(err)
+	c.s.remove(c)
+	c.cond.Broadcast()
+}
+
+// Close after the peer has had time for its last segments
+func (c *wgConn) linger() {
+	c.state = tcpTimeWait
+	c.disarm()
+	c.timer = time.AfterFunc(WG_TCP_LINGER, func() {
+		c.mu.Lock()
+		c.state = tcpClosed
+		c.s.remove(c)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	c.cond.Broadcast()
+}
+
+// The retransmission timer
+func (c *wgConn) expired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if c.state == tcpClosed || c.state == tcpTimeWait {
+		return
+	}
+
+	c.retries++
+	if c.retries > WG_TCP_RETRIES {
+		c.kill(syscall.ETIMEDOUT, true)
+		return
+	}
+	c.rto = min(2*c.rto, 60*time.Second)
+	c.rttOn = false
+
+	switch {
+	case c.state == tcpSynSent || c.state == tcpSynRcvd:
+		c.sendSyn()
+		return
+	case c.sndNxt != c.sndUna:
+		c.goBack()
+	case len(c.out) > 0 && c.sndWnd == 0:
+		// probe the closed window with a byte
+		c.seg(c.sndNxt, tcpACK, c.out[:1])
+		c.sent(1)
+	}
+	c.arm()
+}
+
+// Send everything after sndUna again: the peer may have dropped what
+// came after a lost segment, as we do
+func (c *wgConn) goBack() {
+	c.sndNxt, c.recover = c.sndUna, c.sndMax
+	c.finSent, c.rttOn, c.dupAcks = false, false, 0
+	c.push()
+}
+
+// Note 'n' sent at sndNxt
+func (c *wgConn) sent(n int) {
+	c.sndNxt += uint32(n)
+	if seqLT(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+}
+
+// Send what the window allows, then the FIN if it is due
+func (c *wgConn) push() {
+	for !c.finSent {
+		inflight := int(c.sndNxt - c.sndUna)
+		unsent := len(c.out) - inflight
+		if unsent <= 0 {
+			if c.finQueued {
+				c.seg(c.sndNxt, tcpFIN|tcpACK, nil)
+				c.finSent = true
+				c.sent(1)
+				c.arm()
+			}
+			return
+		}
+		can := int(c.sndWnd) - inflight
+		if can <= 0 {
+			if inflight == 0 {
+				c.arm()
+			}
+			return
+		}
+		n := min(unsent, can, c.mss)
+		c.seg(c.sndNxt, tcpACK|tcpPSH, c.out[inflight:inflight+n])
+		if !c.rttOn {
+			c.rttOn, c.rttSeq, c.rttAt = true, c.sndNxt+uint32(n), time.Now()
+		}
+		c.sent(n)
+		c.arm()
+	}
+}
+
+// Take an RTT sample (RFC 6298)
+func (c *wgConn) sample(r time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = r, r/2
+	} else {
+		d := c.srtt - r
+		if d < 0 {
+			d = -d
+		}
+		c.rttvar = (3*c.rttvar + d) / 4
+		c.srtt = (7*c.srtt + r) / 8
+	}
+	c.unback()
+}
+
+// Drop the backoff of the timer
+func (c *wgConn) unback() {
+	if c.srtt > 0 {
+		c.rto = min(max(c.srtt+4*c.rttvar, 200*time.Millisecond), 60*time.Second)
+	}
+}
+
+// Process the segment 'h'
+func (c *wgConn) input(h *tcpSeg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case tcpClosed:
+		return
+	case tcpSynSent:
+		if h.flags&tcpACK == 0 || h.ack != c.iss+1 {
+			return
+		}
+		if h.flags&tcpRST != 0 {
+			c.kill(syscall.ECONNREFUSED, false)
+			return
+		}
+		if h.flags&tcpSYN == 0 {
+			return
+		}
+		c.rcvNxt = h.seq + 1
+		c.sndUna, c.sndWnd = h.ack, h.wnd
+		if h.mss > 0 {
+			c.mss = min(c.mss, h.mss)
+		}
+		c.state, c.retries = tcpEstablished, 0
+		c.disarm()
+		c.ack()
+		c.handshakeDone(nil)
+		return
+	}
+
+	if h.flags&tcpRST != 0 {
+		if h.seq == c.rcvNxt || (seqLE(c.rcvNxt, h.seq) && seqLT(h.seq, c.rcvNxt+uint32(c.window()))) {
+			c.kill(syscall.ECONNRESET, false)
+		}
+		return
+	}
+	if h.flags&tcpSYN != 0 {
+		// a retransmitted SYN; our SYN-ACK or ACK was lost
+		if c.state == tcpSynRcvd {
+			c.sendSyn()
+		} else {
+			c.ack()
+		}
+		return
+	}
+	if h.flags&tcpACK == 0 {
+		return
+	}
+
+	if c.state == tcpSynRcvd {
+		if h.ack != c.iss+1 {
+			return
+		}
+		c.sndUna, c.sndWnd = h.ack, h.wnd
+		c.state, c.retries = tcpEstablished, 0
+		c.disarm()
+		c.handshakeDone(nil)
+		select {
+		case c.ln.ch <- c:
+		default:
+			c.kill(syscall.ECONNREFUSED, true)
+			return
+		}
+		c.ln = nil
+	}
+
+	c.acked(h)
+	if c.state == tcpClosed {
+		return
+	}
+	c.receive(h)
+}
+
+// Process the ACK of 'h'
+func (c *wgConn) acked(h *tcpSeg) {
+	switch {
+	case seqLT(c.sndUna, h.ack) && seqLE(h.ack, c.sndMax):
+		n := int(h.ack - c.sndUna)
+		d := min(n, len(c.out))
+		c.out = c.out[d:]
+		if len(c.out) == 0 {
+			c.out = nil
+		}
+		c.sndUna = h.ack
+		if seqLT(c.sndNxt, h.ack) {
+			// what we sent before going back got there
+			c.sndNxt = h.ack
+		}
+		fin := c.finQueued && h.ack == c.finSeq+1
+		if fin {
+			c.finSent = true
+		}
+		if c.rttOn && seqLE(c.rttSeq, h.ack) {
+			c.sample(time.Since(c.rttAt))
+			c.rttOn = false
+		}
+		if c.retries > 0 {
+			c.retries = 0
+			c.unback()
+		}
+		c.dupAcks = 0
+		c.sndWnd = h.wnd
+		c.rearm()
+		c.cond.Broadcast()
+
+		if fin {
+			switch c.state {
+			case tcpFinWait1:
+				c.state = tcpFinWait2
+				c.finWait()
+			case tcpClosing:
+				c.linger()
+			case tcpLastAck:
+				c.state = tcpClosed
+				c.disarm()
+				c.s.remove(c)
+				c.cond.Broadcast()
+				return
+			}
+		}
+	case h.ack == c.sndUna && len(h.data) == 0 && h.flags&tcpFIN == 0 && c.sndNxt != c.sndUna && h.wnd == c.sndWnd:
+		c.dupAcks++
+		if c.dupAcks == 3 && seqLE(c.recover, c.sndUna) {
+			c.goBack()
+		}
+	default:
+		if h.ack == c.sndUna {
+			c.sndWnd = h.wnd
+		}
+	}
+	c.push()
+}
+
+// Bound the wait of FIN_WAIT_2 and of a Close with the peer silent
+func (c *wgConn) finWait() {
+	c.disarm()
+	c.timer = time.AfterFunc(WG_TCP_FINWAIT, func() {
+		c.abort(syscall.ETIMEDOUT, true)
+	})
+}
+
+// Take the data and FIN of 'h'
+func (c *wgConn) receive(h *tcpSeg) {
+	data, fin := h.data, h.flags&tcpFIN != 0
+	if len(data) == 0 && !fin {
+		return
+	}
+	if c.rcvFin || c.state == tcpTimeWait {
+		c.ack()
+		return
+	}
+
+	end := h.seq + uint32(len(data))
+	if seqLT(c.rcvNxt, h.seq) || seqLT(end, c.rcvNxt) || (end == c.rcvNxt && !fin) {
+		// out of order or old: ask again for what we need
+		c.ack()
+		return
+	}
+	data = data[c.rcvNxt-h.seq:]
+	if room := WG_TCP_RCVBUF - len(c.in); len(data) > room {
+		data, fin = data[:room], false
+	}
+
+	// after Close there is no one to read it
+	if c.shut && len(data) > 0 {
+		c.kill(syscall.ECONNRESET, true)
+		return
+	}
+	c.in = append(c.in, data...)
+	c.rcvNxt += uint32(len(data))
+	if fin {
+		c.rcvNxt++
+		c.rcvFin = true
+		switch c.state {
+		case tcpEstablished:
+			c.state = tcpCloseWait
+		case tcpFinWait1:
+			c.state = tcpClosing
+		case tcpFinWait2:
+			c.ack()
+			c.linger()
+			return
+		}
+	}
+	c.ack()
+	c.cond.Broadcast()
+}
+
+// Wait for the condition of 'c' or the deadline 'dl'
+func (c *wgConn) wait(dl time.Time) error {
+	if !dl.IsZero() && !time.Now().Before(dl) {
+		return os.ErrDeadlineExceeded
+	}
+	c.cond.Wait()
+	return nil
+}
+
+func (c *wgConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.in) == 0 {
+		switch {
+		case c.shut:
+			return 0, net.ErrClosed
+		case c.rcvFin:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.rdl); err != nil {
+			return 0, err
+		}
+	}
+
+	closed := int(c.window()) < c.mss
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	if len(c.in) == 0 {
+		c.in = nil
+	}
+	if closed && int(c.window()) >= c.mss && c.state != tcpClosed {
+		c.ack()
+	}
+	return n, nil
+}
+
+func (c *wgConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for len(b) > 0 {
+		switch {
+		case c.err != nil:
+			return n, c.err
+		case c.shut || c.finQueued || c.state == tcpClosed:
+			return n, syscall.EPIPE
+		}
+		room := WG_TCP_SNDBUF - len(c.out)
+		if room <= 0 {
+			if err := c.wait(c.wdl); err != nil {
+				return n, err
+			}
+			continue
+		}
+		k := min(room, len(b))
+		c.out = append(c.out, b[:k]...)
+		b, n = b[k:], n+k
+		c.push()
+	}
+	return n, nil
+}
+
+// Send our FIN once the data before it is sent
+func (c *wgConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeWrite()
+	return nil
+}
+
+func (c *wgConn) closeWrite() {
+	if c.finQueued {
+		return
+	}
+	switch c.state {
+	case tcpEstablished:
+		c.state = tcpFinWait1
+	case tcpCloseWait:
+		c.state = tcpLastAck
+	default:
+		return
+	}
+	c.finQueued, c.finSeq = true, c.sndUna+uint32(len(c.out))
+	c.push()
+}
+
+func (c *wgConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shut {
+		return nil
+	}
+	c.shut = true
+	switch {
+	case c.state == tcpClosed || c.state == tcpTimeWait:
+	case c.state == tcpSynSent || c.state == tcpSynRcvd || len(c.in) > 0:
+		c.kill(net.ErrClosed, true)
+	default:
+		c.closeWrite()
+		if c.state == tcpFinWait1 || c.state == tcpFinWait2 {
+			// the peer gets a while to finish
+			time.AfterFunc(WG_TCP_FINWAIT, func() { c.abort(syscall.ETIMEDOUT, true) })
+		}
+	}
+	if c.dlTimer != nil {
+		c.dlTimer.Stop()
+	}
+	c.in = nil
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *wgConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.laddr.AsSlice(), Port: int(c.flow.lport)}
+}
+
+func (c *wgConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.flow.raddr.AsSlice(), Port: int(c.flow.rport)}
+}
+
+// Set the deadlines; waiters are woken when the earlier one is due
+func (c *wgConn) deadlines(rd, wd *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rd != nil {
+		c.rdl = *rd
+	}
+	if wd != nil {
+		c.wdl = *wd
+	}
+	if c.dlTimer != nil {
+		c.dlTimer.Stop()
+		c.dlTimer = nil
+	}
+	dl := c.rdl
+	if dl.IsZero() || (!c.wdl.IsZero() && c.wdl.Before(dl)) {
+		dl = c.wdl
+	}
+	if !dl.IsZero() {
+		c.dlTimer = time.AfterFunc(time.Until(dl), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+func (c *wgConn) SetDeadline(t time.Time) error {
+	c.deadlines(&t, &t)
+	return nil
+}
+
+func (c *wgConn) SetReadDeadline(t time.Time) error {
+	c.deadlines(&t, nil)
+	return nil
+}
+
+func (c *wgConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines(nil, &t)
+	return nil
+}
+
+func (c *wgConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoRawConn
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,817 @@
+// wireguard.go -- WireGuard egress for rules
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// A listener's "wireguard" devices are userspace WireGuard peers; a
+// rule naming one sends the connections it allows through that tunnel
+// instead of from this host. Each device has one peer, its own UDP
+// socket and keys, and a TCP/IP stack of its own (wgstack.go) on the
+// tunnel addresses: nothing is configured on the host. Names are still
+// looked up here and the rules see the addresses they resolve to.
+
+const (
+	WG_MTU = 1420
+
+	// the timers of the protocol (WireGuard paper, section 6)
+	WG_REKEY_AFTER   = 120 * time.Second
+	WG_REJECT_AFTER  = 180 * time.Second
+	WG_REKEY_TIMEOUT = 5 * time.Second
+	WG_REKEY_ATTEMPT = 90 * time.Second
+	WG_KEEPALIVE     = 10 * time.Second
+
+	// packets held for a handshake
+	WG_QUEUE = 256
+)
+
+const (
+	wgConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1    = "mac1----"
+
+	wgInitLen = 148
+	wgRespLen = 92
+)
+
+var wgNonce0 [12]byte
+
+// A handshake we started
+type wgHandshake struct {
+	idx   uint32
+	eph   []byte
+	ck, h [32]byte
+	sent  time.Time
+}
+
+// The keys of a session
+type wgKeys struct {
+	send, recv    cipher.AEAD
+	local, remote uint32
+	initiator     bool
+	born          time.Time
+
+	// under the device's lock
+	n      uint64 // next counter we send
+	replay wgReplay
+}
+
+// The counters seen in a session
+type wgReplay struct {
+	max  uint64
+	bits uint64 // bit i is max-i
+	seen bool
+}
+
+// Note 'n'; false if it was seen or is too old
+func (r *wgReplay) ok(n uint64) bool {
+	switch {
+	case !r.seen || n > r.max:
+		if d := n - r.max; !r.seen || d >= 64 {
+			r.bits = 1
+		} else {
+			r.bits = r.bits<<d | 1
+		}
+		r.max, r.seen = n, true
+		return true
+	case r.max-n >= 64:
+		return false
+	}
+	m := uint64(1) << (r.max - n)
+	if r.bits&m != 0 {
+		return false
+	}
+	r.bits |= m
+	return true
+}
+
+// A WireGuard device with one peer
+type wgDevice struct {
+	name    string
+	priv    []byte
+	pub     [32]byte
+	peer    [32]byte
+	psk     [32]byte
+	ss      []byte // static-static DH
+	allowed []netip.Prefix
+	ka      time.Duration // persistent keepalive; 0 is off
+
+	// start of every handshake with the responder's key mixed in
+	ck0, hPeer, hSelf [32]byte
+	macPeer, macSelf  [32]byte
+
+	conn  *net.UDPConn
+	stack *wgStack
+	done  chan struct{}
+
+	mu              sync.Mutex
+	endpoint        *net.UDPAddr
+	hs              *wgHandshake
+	hsStart         time.Time
+	cur, prev, next *wgKeys
+	lastTS          [12]byte
+	lastSent        time.Time
+	lastRecv        time.Time
+	lastData        time.Time // data (not keepalives) received
+	unanswered      time.Time // first data sent since we last heard
+	queue           [][]byte
+	closed          bool
+
+	handshakes, rx, tx atomic.Uint64
+}
+
+// Decode the base64 key 'k'
+func wgKey(what, k string) ([32]byte, error) {
+	var v [32]byte
+	b, err := base64.StdEncoding.DecodeString(k)
+	if err != nil || len(b) != 32 {
+		return v, fmt.Errorf("%s: not a base64 32 byte key", what)
+	}
+	copy(v[:], b)
+	return v, nil
+}
+
+// X25519 of 'priv' and 'pub'
+func wgDH(priv, pub []byte) ([]byte, error) {
+	return curve25519.X25519(priv, pub)
+}
+
+// A new ephemeral key and its public key
+func wgEphemeral() ([]byte, []byte, error) {
+	k := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(k); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	return k, pub, err
+}
+
+// ChaCha20-Poly1305 of the 32 byte 'key'
+func wgAEAD(key []byte) cipher.AEAD {
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// The hash functions of WireGuard: BLAKE2s, keyed BLAKE2s and HMAC of it
+func wgHash(v ...[]byte) [32]byte {
+	h, _ := blake2s.New256(nil)
+	for _, b := range v {
+		h.Write(b)
+	}
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+func wgMAC(key, b []byte) [16]byte {
+	h, err := blake2s.New128(key)
+	if err != nil {
+		panic(err)
+	}
+	h.Write(b)
+	var out [16]byte
+	h.Sum(out[:0])
+	return out
+}
+
+func wgHMAC(key []byte, v ...[]byte) [32]byte {
+	m := hmac.New(func() hash.Hash { h, _ := blake2s.New256(nil); return h }, key)
+	for _, b := range v {
+		m.Write(b)
+	}
+	var out [32]byte
+	m.Sum(out[:0])
+	return out
+}
+
+// The HKDF of WireGuard: 'n' keys from the chaining key 'ck' and 'in'
+func wgKDF(n int, ck, in []byte) [][32]byte {
+	prk := wgHMAC(ck, in)
+	var v [][32]byte
+	prev := []byte{}
+	for i := 1; i <= n; i++ {
+		t := wgHMAC(prk[:], prev, []byte{byte(i)})
+		v = append(v, t)
+		prev = t[:]
+	}
+	return v
+}
+
+func newWireGuard(wc *WireGuardConf) (*wgDevice, error) {
+	if len(wc.Name) == 0 {
+		return nil, fmt.Errorf("wireguard: needs a name")
+	}
+	d := &wgDevice{name: wc.Name, ka: time.Duration(wc.Peer.Keepalive) * time.Second,
+		done: make(chan struct{})}
+	errf := func(f string, v ...interface{}) error {
+		return fmt.Errorf("wireguard %s: %s", d.name, fmt.Sprintf(f, v...))
+	}
+
+	k, err := wgKey("privatekey", wc.PrivateKey)
+	if err != nil {
+		return nil, errf("%s", err)
+	}
+	d.priv = k[:]
+	pub, err := curve25519.X25519(d.priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, errf("privatekey: %s", err)
+	}
+	copy(d.pub[:], pub)
+	if d.peer, err = wgKey("peer publickey", wc.Peer.PublicKey); err != nil {
+		return nil, errf("%s", err)
+	}
+	if len(wc.Peer.PresharedKey) > 0 {
+		if d.psk, err = wgKey("peer presharedkey", wc.Peer.PresharedKey); err != nil {
+			return nil, errf("%s", err)
+		}
+	}
+	if d.ss, err = wgDH(d.priv, d.peer[:]); err != nil {
+		return nil, errf("peer publickey: %s", err)
+	}
+
+	var addrs []netip.Addr
+	for _, s := range wc.Address {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			p, perr := netip.ParsePrefix(s)
+			if perr != nil {
+				return nil, errf("address %s: %s", s, err)
+			}
+			a = p.Addr()
+		}
+		addrs = append(addrs, a.Unmap())
+	}
+	if len(addrs) == 0 {
+		return nil, errf("needs an address")
+	}
+
+	ips := wc.Peer.AllowedIPs
+	if len(ips) == 0 {
+		ips = []string{"0.0.0.0/0", "::/0"}
+	}
+	for _, s := range ips {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, errf("allowedips %s: %s", s, err)
+		}
+		d.allowed = append(d.allowed, p.Masked())
+	}
+
+	mtu := wc.MTU
+	if mtu == 0 {
+		mtu = WG_MTU
+	}
+	if mtu < 1280 || mtu > 65535-80 {
+		return nil, errf("mtu %d is out of range", mtu)
+	}
+
+	if len(wc.Peer.Endpoint) > 0 {
+		if d.endpoint, err = net.ResolveUDPAddr("udp", wc.Peer.Endpoint); err != nil {
+			return nil, errf("endpoint %s: %s", wc.Peer.Endpoint, err)
+		}
+	} else if wc.ListenPort == 0 {
+		return nil, errf("needs a peer endpoint or a listenport")
+	}
+
+	d.ck0 = wgHash([]byte(wgConstruction))
+	h := wgHash(d.ck0[:], []byte(wgIdentifier))
+	d.hPeer, d.hSelf = wgHash(h[:], d.peer[:]), wgHash(h[:], d.pub[:])
+	d.macPeer = wgHash([]byte(wgLabelMAC1), d.peer[:])
+	d.macSelf = wgHash([]byte(wgLabelMAC1), d.pub[:])
+
+	if d.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: wc.ListenPort}); err != nil {
+		return nil, errf("%s", err)
+	}
+	d.stack = newWGStack(addrs, mtu, d.write)
+
+	go d.recv()
+	go d.timers()
+	return d, nil
+}
+
+func (d *wgDevice) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.done)
+	d.mu.Unlock()
+
+	d.conn.Close()
+	d.stack.close()
+}
+
+// True if the peer is the route to 'a'
+func (d *wgDevice) routes(a netip.Addr) bool {
+	for _, p := range d.allowed {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open a TCP connection to 'ip:port' through the tunnel
+func (d *wgDevice) dial(ctx context.Context, ip net.IP, port int) (net.Conn, error) {
+	a, ok := netip.AddrFromSlice(ip)
+	if a = a.Unmap(); !ok || !d.routes(a) {
+		return nil, fmt.Errorf("wireguard %s: %s isn't in the peer's allowedips", d.name, ip)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT)
+	defer cancel()
+	c, err := d.stack.dial(ctx, a, port)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// A random session index that isn't in use
+func (d *wgDevice) index() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		i := binary.LittleEndian.Uint32(b[:])
+		if i != 0 && d.keysOf(i) == nil && (d.hs == nil || d.hs.idx != i) {
+			return i
+		}
+	}
+}
+
+// The keys of our index 'i'; nil if there are none
+func (d *wgDevice) keysOf(i uint32) *wgKeys {
+	for _, k := range []*wgKeys{d.cur, d.next, d.prev} {
+		if k != nil && k.local == i {
+			return k
+		}
+	}
+	return nil
+}
+
+// The TAI64N label of 't'
+func tai64n(t time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b
+}
+
+// Start a handshake unless one is on
+func (d *wgDevice) handshake() {
+	if d.hs == nil {
+		d.hsStart = time.Now()
+		d.initiate()
+	}
+}
+
+// Send a handshake initiation (the first message of Noise IK)
+func (d *wgDevice) initiate() {
+	if d.endpoint == nil || d.closed {
+		return
+	}
+	eph, e, err := wgEphemeral()
+	if err != nil {
+		return
+	}
+	ck := wgKDF(1, d.ck0[:], e)[0]
+	h := wgHash(d.hPeer[:], e)
+	ss, err := wgDH(eph, d.peer[:])
+	if err != nil {
+		return
+	}
+	k := wgKDF(2, ck[:], ss)
+
+	m := make([]byte, wgInitLen)
+	m[0] = 1
+	idx := d.index()
+	binary.LittleEndian.PutUint32(m[4:], idx)
+	copy(m[8:], e)
+	wgAEAD(k[1][:]).Seal(m[40:40], wgNonce0[:], d.pub[:], h[:])
+	h = wgHash(h[:], m[40:88])
+	k = wgKDF(2, k[0][:], d.ss)
+	wgAEAD(k[1][:]).Seal(m[88:88], wgNonce0[:], tai64n(time.Now()), h[:])
+	h = wgHash(h[:], m[88:116])
+	mac := wgMAC(d.macPeer[:], m[:116])
+	copy(m[116:], mac[:])
+
+	d.hs = &wgHandshake{idx: idx, eph: eph, ck: k[0], h: h, sent: time.Now()}
+	d.conn.WriteToUDP(m, d.endpoint)
+}
+
+// Answer the initiation 'm' from 'from'
+func (d *wgDevice) onInit(m []byte, from *net.UDPAddr) {
+	if len(m) != wgInitLen {
+		return
+	}
+	if mac := wgMAC(d.macSelf[:], m[:116]); !bytes.Equal(mac[:], m[116:132]) {
+		return
+	}
+
+	e := m[8:40]
+	ck := wgKDF(1, d.ck0[:], e)[0]
+	h := wgHash(d.hSelf[:], e)
+	ss, err := wgDH(d.priv, e)
+	if err != nil {
+		return
+	}
+	k := wgKDF(2, ck[:], ss)
+	spub, err := wgAEAD(k[1][:]).Open(nil, wgNonce0[:], m[40:88], h[:])
+	if err != nil || !bytes.Equal(spub, d.peer[:]) {
+		return
+	}
+	h = wgHash(h[:], m[40:88])
+	k = wgKDF(2, k[0][:], d.ss)
+	ts, err := wgAEAD(k[1][:]).Open(nil, wgNonce0[:], m[88:116], h[:])
+	if err != nil {
+		return
+	}
+	h = wgHash(h[:], m[88:116])
+	ck = k[0]
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || bytes.Compare(ts, d.lastTS[:]) <= 0 {
+		// a replay
+		return
+	}
+	copy(d.lastTS[:], ts)
+
+	eph, er, err := wgEphemeral()
+	if err != nil {
+		return
+	}
+	ck = wgKDF(1, ck[:], er)[0]
+	h = wgHash(h[:], er)
+	ee, err := wgDH(eph, e)
+	if err != nil {
+		return
+	}
+	ck = wgKDF(1, ck[:], ee)[0]
+	se, err := wgDH(eph, d.peer[:])
+	if err != nil {
+		return
+	}
+	ck = wgKDF(1, ck[:], se)[0]
+	k = wgKDF(3, ck[:], d.psk[:])
+	h = wgHash(h[:], k[1][:])
+
+	r := make([]byte, wgRespLen)
+	r[0] = 2
+	idx := d.index()
+	binary.LittleEndian.PutUint32(r[4:], idx)
+	copy(r[8:12], m[4:8])
+	copy(r[12:], er)
+	wgAEAD(k[2][:]).Seal(r[44:44], wgNonce0[:], nil, h[:])
+	mac := wgMAC(d.macPeer[:], r[:60])
+	copy(r[60:], mac[:])
+
+	t := wgKDF(2, k[0][:], nil)
+	d.next = &wgKeys{send: wgAEAD(t[1][:]), recv: wgAEAD(t[0][:]), local: idx,
+		remote: binary.LittleEndian.Uint32(m[4:]), born: time.Now()}
+	d.endpoint = from
+	d.handshakes.Add(1)
+	d.conn.WriteToUDP(r, from)
+}
+
+// Finish our handshake with the response 'm' from 'from'
+func (d *wgDevice) onResp(m []byte, from *net.UDPAddr) {
+	if len(m) != wgRespLen {
+		return
+	}
+	if mac := wgMAC(d.macSelf[:], m[:60]); !bytes.Equal(mac[:], m[60:76]) {
+		return
+	}
+
+	d.mu.Lock()
+	hs := d.hs
+	d.mu.Unlock()
+	if hs == nil || binary.LittleEndian.Uint32(m[8:]) != hs.idx {
+		return
+	}
+
+	er := m[12:44]
+	ck := wgKDF(1, hs.ck[:], er)[0]
+	h := wgHash(hs.h[:], er)
+	ee, err := wgDH(hs.eph, er)
+	if err != nil {
+		return
+	}
+	ck = wgKDF(1, ck[:], ee)[0]
+	se, err := wgDH(d.priv, er)
+	if err != nil {
+		return
+	}
+	ck = wgKDF(1, ck[:], se)[0]
+	k := wgKDF(3, ck[:], d.psk[:])
+	h = wgHash(h[:], k[1][:])
+	if _, err := wgAEAD(k[2][:]).Open(nil, wgNonce0[:], m[44:60], h[:]); err != nil {
+		return
+	}
+	t := wgKDF(2, k[0][:], nil)
+
+	d.mu.Lock()
+	if d.hs != hs {
+		d.mu.Unlock()
+		return
+	}
+	d.hs = nil
+	d.prev, d.cur = d.cur, &wgKeys{send: wgAEAD(t[0][:]), recv: wgAEAD(t[1][:]),
+		local: hs.idx, remote: binary.LittleEndian.Uint32(m[4:]), initiator: true, born: time.Now()}
+	d.endpoint = from
+	d.lastRecv = time.Now()
+	q := d.queue
+	d.queue = nil
+	d.mu.Unlock()
+	d.handshakes.Add(1)
+
+	// the responder can send once it hears from us
+	for _, p := range q {
+		d.write(p)
+	}
+	if len(q) == 0 {
+		d.write(nil)
+	}
+}
+
+// The length of the IP packet at the start of 'p'; 0 if there is none
+func ipLen(p []byte) int {
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		if n := int(binary.BigEndian.Uint16(p[2:])); n >= 20 {
+			return n
+		}
+	case len(p) >= 40 && p[0]>>4 == 6:
+		return 40 + int(binary.BigEndian.Uint16(p[4:]))
+	}
+	return 0
+}
+
+// Take the data message 'm' from 'from'
+func (d *wgDevice) onData(m []byte, from *net.UDPAddr) {
+	if len(m) < 32 {
+		return
+	}
+	d.mu.Lock()
+	k := d.keysOf(binary.LittleEndian.Uint32(m[4:]))
+	d.mu.Unlock()
+	if k == nil || time.Since(k.born) > WG_REJECT_AFTER {
+		return
+	}
+
+	var nonce [12]byte
+	copy(nonce[4:], m[8:16])
+	p, err := k.recv.Open(nil, nonce[:], m[16:], nil)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	var q [][]byte
+	d.mu.Lock()
+	if !k.replay.ok(binary.LittleEndian.Uint64(m[8:])) {
+		d.mu.Unlock()
+		return
+	}
+	if k == d.next {
+		// the initiator confirmed the session
+		d.prev, d.cur, d.next = d.cur, k, nil
+		q, d.queue = d.queue, nil
+	}
+	d.endpoint = from
+	d.lastRecv = now
+	d.unanswered = time.Time{}
+	if len(p) > 0 {
+		d.lastData = now
+	}
+	d.mu.Unlock()
+	d.rx.Add(uint64(len(m)))
+
+	for _, b := range q {
+		d.write(b)
+	}
+	n := ipLen(p)
+	if n == 0 || n > len(p) {
+		return
+	}
+	p = p[:n]
+	var src netip.Addr
+	if p[0]>>4 == 4 {
+		src = netip.AddrFrom4([4]byte(p[12:16]))
+	} else {
+		src = netip.AddrFrom16([16]byte(p[8:24]))
+	}
+	if d.routes(src) {
+		d.stack.input(p)
+	}
+}
+
+// Send the IP packet 'p' to the peer; nil is a keepalive
+func (d *wgDevice) write(p []byte) {
+	now := time.Now()
+	d.mu.Lock()
+	k := d.cur
+	if k == nil || now.Sub(k.born) > WG_REJECT_AFTER {
+		if len(p) > 0 && len(d.queue) < WG_QUEUE {
+			d.queue = append(d.queue, p)
+		}
+		if d.next == nil || now.Sub(d.next.born) > WG_REKEY_TIMEOUT {
+			d.handshake()
+		}
+		d.mu.Unlock()
+		return
+	}
+	if k.initiator && now.Sub(k.born) > WG_REKEY_AFTER {
+		d.handshake()
+	}
+	n := k.n
+	k.n++
+	ep := d.endpoint
+	d.lastSent = now
+	if len(p) > 0 && d.unanswered.IsZero() {
+		d.unanswered = now
+	}
+	d.mu.Unlock()
+
+	// padded to 16 bytes, within the MTU
+	pad := (len(p) + 15) &^ 15
+	if pad > d.stack.mtu {
+		pad = max(len(p), d.stack.mtu)
+	}
+	m := make([]byte, 16, 16+pad+16)
+	m[0] = 4
+	binary.LittleEndian.PutUint32(m[4:], k.remote)
+	binary.LittleEndian.PutUint64(m[8:], n)
+	var nonce [12]byte
+	copy(nonce[4:], m[8:16])
+	plain := make([]byte, pad)
+	copy(plain, p)
+	m = k.send.Seal(m, nonce[:], plain, nil)
+	d.tx.Add(uint64(len(m)))
+	d.conn.WriteToUDP(m, ep)
+}
+
+// Read the messages of the peer
+func (d *wgDevice) recv() {
+	b := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFromUDP(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		m := b[:n]
+		if n < 4 || m[1]|m[2]|m[3] != 0 {
+			continue
+		}
+		// cookie replies (3) are for a responder under load; we
+		// retry the handshake instead
+		switch m[0] {
+		case 1:
+			d.onInit(m, from)
+		case 2:
+			d.onResp(m, from)
+		case 4:
+			d.onData(m, from)
+		}
+	}
+}
+
+// Run the timers of the handshake, keepalives and key expiry
+func (d *wgDevice) timers() {
+	t := time.NewTicker(250 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-t.C:
+			if d.tick(now) {
+				d.write(nil)
+			}
+		}
+	}
+}
+
+// The timers at 'now'; true if a keepalive is due
+func (d *wgDevice) tick(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if hs := d.hs; hs != nil && now.Sub(hs.sent) > WG_REKEY_TIMEOUT {
+		d.hs = nil
+		if now.Sub(d.hsStart) > WG_REKEY_ATTEMPT {
+			d.queue = nil
+		} else {
+			d.initiate()
+		}
+	}
+
+	if k := d.cur; k != nil && now.Sub(k.born) > 3*WG_REJECT_AFTER {
+		d.cur, d.prev, d.next = nil, nil, nil
+	}
+	if d.cur == nil {
+		if d.ka > 0 {
+			d.handshake()
+		}
+		return false
+	}
+
+	// the peer got data and nothing back
+	if !d.unanswered.IsZero() && now.Sub(d.unanswered) > WG_KEEPALIVE+WG_REKEY_TIMEOUT {
+		d.unanswered = time.Time{}
+		d.handshake()
+	}
+	if d.lastData.After(d.lastSent) && now.Sub(d.lastData) > WG_KEEPALIVE {
+		return true
+	}
+	return d.ka > 0 && now.Sub(d.lastSent) > d.ka
+}
+
+// The WireGuard devices of a listener
+type wgSet struct {
+	listener string
+	m        map[string]*wgDevice
+}
+
+func newWGSet(v []WireGuardConf, listen string) (*wgSet, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	s := &wgSet{listener: listen, m: make(map[string]*wgDevice)}
+	for i := range v {
+		if _, ok := s.m[v[i].Name]; ok {
+			s.Close()
+			return nil, fmt.Errorf("wireguard %s: defined twice", v[i].Name)
+		}
+		d, err := newWireGuard(&v[i])
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.m[d.name] = d
+	}
+	return s, nil
+}
+
+func (s *wgSet) Close() {
+	for _, d := range s.m {
+		d.Close()
+	}
+}
+
+func (s *wgSet) metrics() []metric {
+	names := make([]string, 0, len(s.m))
+	for n := range s.m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var v []metric
+	for _, n := range names {
+		d := s.m[n]
+		l := fmt.Sprintf("listener=%q,device=%q", s.listener, n)
+		v = append(v,
+			metric{"goproxy_wireguard_handshakes_total", "counter", "WireGuard handshakes completed", l, float64(d.handshakes.Load())},
+			metric{"goproxy_wireguard_bytes_total", "counter", "Bytes of WireGuard messages", l + `,direction="rx"`, float64(d.rx.Load())},
+			metric{"goproxy_wireguard_bytes_total", "counter", "Bytes of WireGuard messages", l + `,direction="tx"`, float64(d.tx.Load())},
+		)
+	}
+	return v
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98:
@@ -0,0 +1,288 @@
+// wireguard_test.go -- tests for WireGuard egress
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	L "github.com/opencoff/go-proxies/logger"
+)
+
+func TestWGCrypto(t *testing.T) {
+	seq := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		return b
+	}
+	key := bytes.Repeat([]byte("k"), 32)
+	for _, v := range []struct {
+		got  []byte
+		want string
+	}{
+		{func() []byte { h := wgHash(); return h[:] }(), "69217a3079908094e11121d042354a7c1f55b6482ca1a51e1b250dfd1ed0eef9"},
+		{func() []byte { h := wgHash(seq(64)); return h[:] }(), "56f34e8b96557e90c1f24b52d0c89d51086acf1b00f634cf1dde9233b8eaaa3e"},
+		{func() []byte { h := wgHash([]byte("abc")); return h[:] }(), "508c5e8c327c14e2e1a72ba34eeb452f37458b209ed63a294d999b4c86675982"},
+		{func() []byte { h := wgMAC(key, seq(200)); return h[:] }(), "a74b2926087ee84d2ca3c8402d4e695b"},
+		{func() []byte { h := wgHMAC([]byte("key"), seq(100)); return h[:] }(), "69783e50bdf192bc0279041a723c3077a8a8f124295c7da627dff6fd53314056"},
+	} {
+		if s := hex.EncodeToString(v.got); s != v.want {
+			t.Errorf("got %s, want %s", s, v.want)
+		}
+	}
+
+	// RFC 8439, 2.8.2: the AEAD is wired up as WireGuard wants it
+	k, _ := hex.DecodeString("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce, _ := hex.DecodeString("070000004041424344454647")
+	ad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	msg := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	a := wgAEAD(k)
+	ct := a.Seal(nil, nonce, msg, ad)
+	if h := hex.EncodeToString(ct[:16]); h != "d31a8d34648e60db7b86afbc53ef7ec2" {
+		t.Errorf("chacha20: %s", h)
+	}
+	if h := hex.EncodeToString(ct[len(ct)-16:]); h != "1ae10b594f09e26a7e902ecbd0600691" {
+		t.Errorf("poly1305: %s", h)
+	}
+	if p, err := a.Open(nil, nonce, ct, ad); err != nil || !bytes.Equal(p, msg) {
+		t.Errorf("open: %v", err)
+	}
+	ct[3] ^= 1
+	if _, err := a.Open(nil, nonce, ct, ad); err == nil {
+		t.Errorf("tampered: %v", err)
+	}
+}
+
+func TestWGReplay(t *testing.T) {
+	var r wgReplay
+	for _, v := range []struct {
+		n  uint64
+		ok bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false},
+		{100, true}, {36, false}, {37, true}, {37, false}, {99, true}, {200, true}, {100, false},
+	} {
+		if ok := r.ok(v.n); ok != v.ok {
+			t.Errorf("%d: %v", v.n, ok)
+		}
+	}
+}
+
+// Two stacks whose links lose one in 'n' packets
+func lossyStacks(n int) (*wgStack, *wgStack) {
+	var a, b *wgStack
+	link := func(to **wgStack) func([]byte) {
+		ch := make(chan []byte, 4096)
+		go func() {
+			for p := range ch {
+				(*to).input(p)
+			}
+		}()
+		return func(p []byte) {
+			if mrand.Intn(n) != 0 {
+				ch <- p
+			}
+		}
+	}
+	a = newWGStack([]netip.Addr{netip.MustParseAddr("10.9.0.1")}, 1400, link(&b))
+	b = newWGStack([]netip.Addr{netip.MustParseAddr("10.9.0.2")}, 1400, link(&a))
+	return a, b
+}
+
+func TestWGStackLoss(t *testing.T) {
+	a, b := lossyStacks(20)
+	defer a.close()
+	defer b.close()
+	ln := b.listen(80)
+	defer ln.Close()
+
+	msg := make([]byte, 100<<10)
+	rand.Read(msg)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(msg)
+		c.Close()
+	}()
+
+	c, err := a.dial(context.Background(), netip.MustParseAddr("10.9.0.2"), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("read %d bytes: %v", len(got), err)
+	}
+	c.Close()
+
+	if _, err := a.dial(context.Background(), netip.MustParseAddr("10.9.0.2"), 81); err == nil {
+		t.Errorf("closed port: no error")
+	}
+}
+
+// A base64 private key and its public key
+func wgTestKey(t *testing.T) (string, string) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k.Bytes()),
+		base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+}
+
+// A free UDP port on the loopback
+func freeUDPPort(t *testing.T) int {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestWireGuardConf(t *testing.T) {
+	priv, pub := wgTestKey(t)
+	for _, wc := range []WireGuardConf{
+		{PrivateKey: priv, Address: []string{"10.0.0.2"}, Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1"}},
+		{Name: "a", PrivateKey: "short", Address: []string{"10.0.0.2"}, Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1"}},
+		{Name: "a", PrivateKey: priv, Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1"}},
+		{Name: "a", PrivateKey: priv, Address: []string{"10.0.0.2"}, Peer: WireGuardPeerConf{PublicKey: pub}},
+		{Name: "a", PrivateKey: priv, Address: []string{"10.0.0.2"}, MTU: 500, Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1"}},
+		{Name: "a", PrivateKey: priv, Address: []string{"10.0.0.2"}, Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1", AllowedIPs: []string{"10.0.0.1"}}},
+	} {
+		if d, err := newWireGuard(&wc); err == nil {
+			d.Close()
+			t.Errorf("%+v: no error", wc)
+		}
+	}
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	wg := []WireGuardConf{{Name: "wg0", PrivateKey: priv, Address: []string{"10.0.0.2/32"},
+		Peer: WireGuardPeerConf{PublicKey: pub, Endpoint: "127.0.0.1:1"}}}
+	for _, lc := range []ListenConf{
+		{Listen: "wg", WireGuard: wg, Rules: []RuleConf{{Name: "a", Action: "allow", WireGuard: "wg1"}}},
+		{Listen: "wg", Rules: []RuleConf{{Name: "a", Action: "allow", WireGuard: "wg0"}}},
+		{Listen: "wg", WireGuard: wg, Parent: "http://127.0.0.1:3128",
+			Rules: []RuleConf{{Name: "a", Action: "allow", WireGuard: "wg0"}}},
+		{Listen: "wg", WireGuard: append(wg, wg[0])},
+	} {
+		if d, err := newDialer(&lc, log); err == nil {
+			d.Close()
+			t.Errorf("%+v: no error", lc)
+		}
+	}
+}
+
+func TestWireGuard(t *testing.T) {
+	cpriv, cpub := wgTestKey(t)
+	spriv, spub := wgTestKey(t)
+	psk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	port := freeUDPPort(t)
+
+	// the peer, with an echo server on its stack
+	srv, err := newWireGuard(&WireGuardConf{Name: "peer", PrivateKey: spriv,
+		Address: []string{"10.7.0.1", "fd00:7::1"}, ListenPort: port,
+		Peer: WireGuardPeerConf{PublicKey: cpub, PresharedKey: psk, AllowedIPs: []string{"10.7.0.2/32", "fd00:7::2/128"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ln := srv.stack.listen(7)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.(tcpConn).CloseWrite()
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	log, _ := L.New(ioutil.Discard, L.LOG_DEBUG, "", 0)
+	d, err := newDialer(&ListenConf{
+		Listen: "wg",
+		WireGuard: []WireGuardConf{{Name: "wg0", PrivateKey: cpriv, Address: []string{"10.7.0.2", "fd00:7::2"},
+			Peer: WireGuardPeerConf{PublicKey: spub, PresharedKey: psk,
+				Endpoint: "127.0.0.1:" + strconv.Itoa(port), AllowedIPs: []string{"10.7.0.0/24", "fd00:7::/64"}}}},
+		Rules: []RuleConf{
+			{Name: "tunnel", Dest: []string{"10.7.0.0/24", "fd00:7::/64"}, Action: "allow", WireGuard: "wg0"},
+			{Name: "lo", Dest: []string{"127.0.0.0/8"}, Action: "allow"},
+		},
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// more than the windows each way
+	msg := make([]byte, 300<<10)
+	rand.Read(msg)
+	for _, addr := range []string{"10.7.0.1:7", "[fd00:7::1]:7"} {
+		c, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: %s", addr, err)
+		}
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		go c.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: echo: %v", addr, err)
+		}
+		c.(tcpConn).CloseWrite()
+		if n, err := c.Read(got); n != 0 || err != io.EOF {
+			t.Errorf("%s: after close: %d %v", addr, n, err)
+		}
+		c.Close()
+	}
+
+	// nothing listens on the peer's port 8
+	if _, err := d.DialContext(context.Background(), "tcp", "10.7.0.1:8"); err == nil {
+		t.Errorf("closed port: no error")
+	}
+
+	// other rules dial directly
+	echo := startEcho(t)
+	c, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Errorf("direct: %T", c)
+	}
+	c.Close()
+
+	if n := d.wg.m["wg0"].handshakes.Load(); n != 1 {
+		t.Errorf("handshakes: %d", n)
+	}
+}
+
+// vim: ft=go:sw=8:ts=8:noexpandtab:tw=98: